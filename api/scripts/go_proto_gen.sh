@@ -39,3 +39,43 @@ cp -f bazel-bin/api/envoy/v9/http/path_rewrite/config_go_proto_/github.com/Googl
 bazel build //api/envoy/v9/http/backend_auth:config_go_proto
 mkdir -p src/go/proto/api/envoy/v9/http/backend_auth
 cp -f bazel-bin/api/envoy/v9/http/backend_auth/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/backend_auth/* src/go/proto/api/envoy/v9/http/backend_auth
+# HTTP filter etag
+bazel build //api/envoy/v9/http/etag:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/http/etag
+cp -f bazel-bin/api/envoy/v9/http/etag/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/etag/* src/go/proto/api/envoy/v9/http/etag
+# HTTP filter idempotency
+bazel build //api/envoy/v9/http/idempotency:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/http/idempotency
+cp -f bazel-bin/api/envoy/v9/http/idempotency/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/idempotency/* src/go/proto/api/envoy/v9/http/idempotency
+# HTTP filter rate_limit
+bazel build //api/envoy/v9/http/rate_limit:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/http/rate_limit
+cp -f bazel-bin/api/envoy/v9/http/rate_limit/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/rate_limit/* src/go/proto/api/envoy/v9/http/rate_limit
+# HTTP filter concurrency_limit
+bazel build //api/envoy/v9/http/concurrency_limit:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/http/concurrency_limit
+cp -f bazel-bin/api/envoy/v9/http/concurrency_limit/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/concurrency_limit/* src/go/proto/api/envoy/v9/http/concurrency_limit
+# HTTP filter grpc_status_mapping
+bazel build //api/envoy/v9/http/grpc_status_mapping:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/http/grpc_status_mapping
+cp -f bazel-bin/api/envoy/v9/http/grpc_status_mapping/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/grpc_status_mapping/* src/go/proto/api/envoy/v9/http/grpc_status_mapping
+# HTTP filter body_validation
+bazel build //api/envoy/v9/http/body_validation:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/http/body_validation
+cp -f bazel-bin/api/envoy/v9/http/body_validation/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/body_validation/* src/go/proto/api/envoy/v9/http/body_validation
+# HTTP filter stream_format
+bazel build //api/envoy/v9/http/stream_format:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/http/stream_format
+cp -f bazel-bin/api/envoy/v9/http/stream_format/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/stream_format/* src/go/proto/api/envoy/v9/http/stream_format
+# HTTP filter cache_control
+bazel build //api/envoy/v9/http/cache_control:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/http/cache_control
+cp -f bazel-bin/api/envoy/v9/http/cache_control/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/cache_control/* src/go/proto/api/envoy/v9/http/cache_control
+# HTTP filter query_rewrite
+bazel build //api/envoy/v9/http/query_rewrite:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/http/query_rewrite
+cp -f bazel-bin/api/envoy/v9/http/query_rewrite/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/query_rewrite/* src/go/proto/api/envoy/v9/http/query_rewrite
+# Access log filter response_code_details
+bazel build //api/envoy/v9/access_log/response_code_details:config_go_proto
+mkdir -p src/go/proto/api/envoy/v9/access_log/response_code_details
+cp -f bazel-bin/api/envoy/v9/access_log/response_code_details/config_go_proto_/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/access_log/response_code_details/* src/go/proto/api/envoy/v9/access_log/response_code_details
@@ -32,6 +32,9 @@ ENVOY_BIN = "bin/envoy"
 # Health check period in secs, for Config Manager and Envoy.
 HEALTH_CHECK_PERIOD = 60
 
+# The time given to the Config Manager to exit after the drain timeout.
+DRAIN_EXIT_GRACE_PERIOD = 10
+
 # bootstrap config file will write here.
 # By default, envoy writes some logs to /tmp too
 # If root file system is read-only, this folder should be
@@ -65,7 +68,14 @@ def gen_bootstrap_conf(args):
         cmd.extend(
             ["--http_request_timeout_s",
              str(args.http_request_timeout_s)])
-
+    if args.statsd_address:
+        cmd.extend(["--statsd_address", args.statsd_address])
+        if args.statsd_prefix:
+            cmd.extend(["--statsd_prefix", args.statsd_prefix])
+        if args.statsd_tag_format:
+            cmd.extend(["--statsd_tag_format", args.statsd_tag_format])
+    if args.enable_delta_xds:
+        cmd.append("--enable_delta_xds")
 
     bootstrap_file = DEFAULT_CONFIG_DIR + BOOTSTRAP_CONFIG
     cmd.append(bootstrap_file)
@@ -121,6 +131,80 @@ environment variable or by passing "-k" flag to this script.
         With this flag, ESPv2 will use "fixed" rollout strategy and following
         flags will be ignored:
            --service, --version, and --rollout_strategy.
+        The file is in JSON, or in the proto text format if its extension is
+        .textproto, .prototxt or .pbtxt. An OpenAPI 3 document in JSON, with
+        the x-google-backend and x-google-issuer extensions, is converted to
+        the service config, so no Service Management is needed.
+        ''')
+
+    parser.add_argument(
+        '--service_json_watch_interval',
+        default=None,
+        help='''
+        If set, check the file of --service_json_path for changes at this
+        interval, e.g. "5s", and apply the modified service config.
+        ''')
+
+    parser.add_argument(
+        '--config_file',
+        default=None,
+        help='''
+        Path to a JSON file setting the flags of the config manager by name,
+        e.g. a mounted Kubernetes ConfigMap. $VAR and ${VAR} are expanded from
+        the environment. The flags passed by this script take precedence.
+        ''')
+
+    parser.add_argument(
+        '--additional_services',
+        default=None,
+        help='''
+        Comma separated NAME:CONFIG_ID list of the other Endpoints services
+        served by ESPv2, e.g.
+        "echo.endpoints.project123.cloud.goog:2020-01-01r0". Each service is
+        served on the virtual host of its name and endpoint names, the one of
+        --service is the default. Their configs are fetched at startup. The
+        services share the flags and the filters of ESPv2: the gRPC
+        transcoder matches the HTTP rules of all their apis, and
+        --rate_limit_service_address is not supported with them.
+        ''')
+
+    parser.add_argument(
+        '--additional_service_json_paths',
+        default=None,
+        help='''
+        Comma separated paths to the endpoint service configs of the other
+        services served by ESPv2, like --additional_services.
+        ''')
+
+    parser.add_argument(
+        '--service_config_url',
+        default=None,
+        help='''
+        Specify a gs://BUCKET/OBJECT uri or a signed https url for ESPv2 to
+        fetch the endpoint service config from. Like --service_json_path,
+        ESPv2 will use "fixed" rollout strategy and following flags will be
+        ignored:
+           --service, --version, and --rollout_strategy.
+        ''')
+
+    parser.add_argument(
+        '--service_config_url_poll_interval',
+        default=None,
+        help='''
+        If set, fetch the service config of --service_config_url again at this
+        interval, e.g. "60s", and apply it if its ETag changed.
+        ''')
+
+    parser.add_argument(
+        '--grpc_reflection',
+        action='store_true',
+        default=False,
+        help='''
+        If set, ESPv2 synthesizes the service config from the gRPC server
+        reflection service of the backend, which must be a grpc:// or
+        grpcs:// --backend. The protos are fetched again on each poll of
+        the config manager debug endpoint. Cannot be used together with
+        --service_json_path or --service_config_url.
         ''')
 
     parser.add_argument(
@@ -184,6 +268,226 @@ environment variable or by passing "-k" flag to this script.
         with value "max-age=31536000; includeSubdomains;" is added for all responses from local backend.
         Not valid for remote backends.''')
 
+    parser.add_argument('--enable_rds', action='store_true',
+        help='''Serve the routes through RDS instead of inlining them in the listener,
+        so a service config change only affecting the routes doesn't drain the
+        listener and its long-lived streams. The service control filter config
+        in the listener carries the service config id, so while service
+        control is enabled every rollout of a new config id still updates the
+        listener.''')
+
+    parser.add_argument('--api_version_header', default=None,
+        help='''If set, e.g. to Accept-Version, the apis of the service config
+        with different versions can share their http patterns, and the
+        requests are routed to the api whose version equals the value of this
+        header. Requests without it are routed to the api listed first.
+        The http patterns of the gRPC methods can't be shared, since the
+        gRPC-JSON transcoder binds each http pattern once.
+        Default: not used.''')
+
+    parser.add_argument('--api_base_path', default=None,
+        help='''If set, e.g. to /gateway/v1, the routes of the operations match
+        their http patterns under this path prefix, which is stripped before
+        the requests are forwarded to the backends. It lets ESPv2 serve behind
+        a load balancer routing by path prefix without editing the http rules.
+        The --healthz path and the gRPC health checks are not prefixed.''')
+
+    parser.add_argument('--response_cache_selectors', default=None,
+        help='''Comma-separated SELECTOR[=TTL] of the GET operations whose
+        responses are cached in memory by ESPv2, e.g.
+        "bookstore.Bookstore.GetShelf=5m,bookstore.Bookstore.ListShelves".
+        Their responses without a Cache-Control header get
+        "Cache-Control: max-age=TTL"; the Cache-Control of the backend, e.g.
+        private or no-store, is kept. The API keys are in the cache key. The
+        requests with an Authorization header, e.g. a JWT, are never cached.
+        Default: none.''')
+
+    parser.add_argument('--response_cache_ttl', default=None,
+        help='''The default time the responses of --response_cache_selectors
+        are cached, e.g. 30s. Default: 60s.''')
+
+    parser.add_argument('--response_cache_key_query_params', default=None,
+        help='''Comma-separated query parameters in the cache key of the
+        cached responses, in addition to the ones of the API keys. Default:
+        all of them.''')
+
+    parser.add_argument('--response_cache_key_headers', default=None,
+        help='''Comma-separated request headers in the cache key of the cached
+        responses, in addition to the ones of the API keys, sent to the
+        clients in the Vary header. Default: none.''')
+
+    parser.add_argument('--etag_selectors', default=None,
+        help='''Comma-separated selectors of the GET operations whose
+        successful JSON responses, transcoded ones included, get a strong
+        ETag. The requests with a matching If-None-Match header get a 304 Not
+        Modified without the body.''')
+
+    parser.add_argument('--etag_max_body_bytes', default=None,
+        help='''The max size of the response bodies of --etag_selectors
+        buffered to compute their ETag. The responses with a larger body pass
+        through without an ETag. If 0, the size is not limited.
+        Default: 1048576.''')
+
+    parser.add_argument('--idempotency_selectors', default=None,
+        help='''Comma-separated selectors of the mutating operations whose
+        requests are deduplicated by their --idempotency_key_header. The
+        duplicates of an in-flight request get a 409 Conflict, the duplicates
+        of a completed one get its stored response for --idempotency_ttl.''')
+
+    parser.add_argument('--idempotency_key_header', default=None,
+        help='''The request header carrying the idempotency key of
+        --idempotency_selectors. Default: Idempotency-Key.''')
+
+    parser.add_argument('--idempotency_ttl', default=None,
+        help='''How long the responses of --idempotency_selectors are replayed
+        to the duplicate requests, e.g. "30m". Default: 10m.''')
+
+    parser.add_argument('--rate_limit_tiers', default=None,
+        help='''Comma-separated TIER=REQUESTS/PERIOD limits of the consumer
+        tiers, e.g. "free=10/1m,gold=1000/1m". The requests of each api key
+        are limited by the tier of its consumer in each proxy, those over the
+        limit get a 429 Too Many Requests.''')
+
+    parser.add_argument('--rate_limit_consumer_tiers', default=None,
+        help='''Comma-separated PROJECT_NUMBER=TIER tiers of the consumers, by
+        the consumer project number of the Check responses, e.g.
+        "123456=gold".''')
+
+    parser.add_argument('--rate_limit_default_tier', default=None,
+        help='''The tier of the consumers not in --rate_limit_consumer_tiers.
+        Default: default.''')
+
+    parser.add_argument('--rate_limit_service_address', default=None,
+        help='''The address of a gRPC rate limit service limiting the consumer
+        tiers across all the proxies, in the format grpc://HOST:PORT or
+        grpcs://HOST:PORT. Its descriptors are "consumer_tier" and
+        "api_key_hash", in the domain of the service name.''')
+
+    parser.add_argument('--concurrency_limits', default=None,
+        help='''Comma-separated SELECTOR=N of the operations with at most N
+        requests in flight at a time in each proxy, e.g.
+        "bookstore.Bookstore.ListShelves=100". The requests over the limit get
+        a 503 Service Unavailable.''')
+
+    parser.add_argument('--spike_arrest_rps', default=None, type=int,
+        help='''If set, each proxy serves at most this number of requests per
+        rolling second, separately from the quotas. The requests are spread
+        over the second, those over the limit get a 429 Too Many Requests.''')
+
+    parser.add_argument('--spike_arrest_burst', default=None, type=int,
+        help='''The number of requests of --spike_arrest_rps allowed at once
+        after an idle time. By default, the requests are only smoothed.''')
+
+    parser.add_argument('--deny_user_agents', default=None,
+        help='''Comma-separated case-insensitive substrings of the user agents
+        denied with a 403 Forbidden ahead of the backends and of Service
+        Control, e.g. "sqlmap,nikto".''')
+
+    parser.add_argument('--deny_paths', default=None,
+        help='''Comma-separated case-insensitive substrings of the request
+        paths denied with a 403 Forbidden ahead of the backends and of Service
+        Control, e.g. "/wp-admin,.php".''')
+
+    parser.add_argument('--upload_backend_address', default=None,
+        help='''The address of the backend serving the large requests of
+        --upload_size_thresholds, e.g. "http://127.0.0.1:8090".''')
+
+    parser.add_argument('--upload_size_thresholds', default=None,
+        help='''Comma-separated SELECTOR=BYTES of the operations whose requests
+        with a larger Content-Length are routed to --upload_backend_address,
+        e.g. "bookstore.Bookstore.CreateBook=1048576".''')
+
+    parser.add_argument('--query_param_matchers', default=None,
+        help='''Semicolon-separated SELECTOR=PARAM[:VALUE][,PARAM[:VALUE]...]
+        of the operations whose routes only match the requests with the query
+        parameters, e.g. "storage.Objects.GetMedia=alt:media". Such an
+        operation can have the http pattern of another one, unless either
+        is a gRPC method, since the gRPC-JSON transcoder binds each http
+        pattern once.''')
+
+    parser.add_argument('--enable_operation_virtual_clusters',
+        action='store_true',
+        help='''Envoy breaks down the request counts and latencies by
+        operation in the vhost.backend.vcluster.OPERATION stats, with the dots
+        of the operation replaced by underscores.''')
+
+    parser.add_argument('--honor_grpc_timeout_header', action='store_true',
+        help='''The grpc-timeout header sent by the clients shortens the
+        deadline of their gRPC requests, including the HTTP requests
+        transcoded to gRPC, but never lengthens the deadline of the
+        operation. The requests to the HTTP backends keep the deadline of
+        their operation.''')
+
+    parser.add_argument('--transcoding_grpc_status_http_codes', default=None,
+        help='''Comma-separated gRPC status codes and the HTTP status codes
+        of the transcoded errors with them, e.g. "NOT_FOUND:410,ABORTED:409".
+        Default: the HTTP status codes of the gRPC-JSON transcoder.''')
+
+    parser.add_argument('--transcoding_operation_grpc_status_http_codes',
+        default=None,
+        help='''Semicolon-separated overrides of
+        --transcoding_grpc_status_http_codes for selected operations, e.g.
+        "bookstore.Bookstore.GetShelf=NOT_FOUND:404,ABORTED:409".''')
+
+    parser.add_argument('--transcoding_validate_request_body',
+        action='store_true',
+        help='''Validate the JSON request bodies of the transcoded gRPC
+        methods against the message types of the service config: the JSON
+        type of the values, the required fields, the enum values and the
+        range of the integers. The invalid requests get a 400 listing the
+        invalid fields.''')
+
+    parser.add_argument('--transcoding_reject_unknown_body_fields',
+        action='store_true',
+        help='''Reject the JSON request bodies of the transcoded gRPC
+        methods with fields not in their message type, at any depth. By
+        default, the gRPC-JSON transcoder ignores them.''')
+
+    parser.add_argument('--transcoding_body_validation_opt_out_selectors',
+        default=None,
+        help='''Comma-separated selectors of the operations whose JSON
+        request bodies are neither validated by
+        --transcoding_validate_request_body nor checked by
+        --transcoding_reject_unknown_body_fields. Default: none.''')
+
+    parser.add_argument('--transcoding_stream_formats',
+        default=None,
+        help='''Comma-separated SELECTOR=ndjson|sse streaming the
+        server-streaming gRPC methods transcoded to JSON as newline delimited
+        JSON or Server-Sent Events, message by message, instead of a single
+        JSON array, e.g. "bookstore.Bookstore.ListShelves=sse". Their routes
+        have no response timeout. Default: none.''')
+
+    parser.add_argument('--transcoding_operation_print_options',
+        default=None,
+        help='''The per-operation overrides of the transcoding print
+        options, in the format
+        "SELECTOR=OPTION:BOOL[,OPTION:BOOL...][;SELECTOR=...]", e.g.
+        "bookstore.Bookstore.GetShelf=always_print_primitive_fields:true".
+        OPTION is always_print_primitive_fields, always_print_enums_as_ints or
+        preserve_proto_field_names. The other options of the operation keep
+        the value of their --transcoding_* flag. Default: none.''')
+
+    parser.add_argument('--maintenance_selectors', default=None,
+        help='''Comma-separated selectors of the operations in maintenance.
+        Their routes respond --maintenance_status_code with a Retry-After
+        header without reaching the backend. Default: none.''')
+
+    parser.add_argument('--maintenance_status_code', default=None, type=int,
+        choices=[503, 423],
+        help='''The status code of the operations in maintenance.
+        Default: 503.''')
+
+    parser.add_argument('--maintenance_retry_after', default=None,
+        help='''The Retry-After of the responses of the operations in
+        maintenance, as a duration like "60s". Not sent if "0s".
+        Default: 60s.''')
+
+    parser.add_argument('--enable_delta_xds', action='store_true',
+        help='''Use the incremental variant of ADS between Envoy and the config
+        manager, so a service config rollout only sends the changed resources
+        to Envoy.''')
+
     parser.add_argument('--generate_self_signed_cert', action='store_true',
         help='''Generate a self-signed certificate and key at start, then
         store them in /tmp/ssl/endpoints/server.crt and /tmp/ssl/endponts/server.key.
@@ -192,6 +496,47 @@ environment variable or by passing "-k" flag to this script.
         "localhost" and valid for 10 years.
         ''')
 
+    parser.add_argument('--acme_domains', default=None,
+        help='''Comma-separated domains of the server certificate that ESPv2
+        obtains and renews through ACME, e.g. from Let's Encrypt, and serves
+        on its listener. The listener doesn't accept connections until the
+        first certificate is issued. It cannot be used together with
+        --ssl_server_cert_path.''')
+    parser.add_argument('--acme_accept_tos', action='store_true',
+        help='''With --acme_domains, agree to the terms of service of the ACME
+        CA. Required.''')
+    parser.add_argument('--acme_email', default=None,
+        help='''With --acme_domains, the contact email of the ACME account,
+        notified by the CA about the certificates expiring without renewal.''')
+    parser.add_argument('--acme_directory_url', default=None,
+        help='''With --acme_domains, the directory URL of the ACME CA.
+        Default: the production directory of Let's Encrypt.''')
+    parser.add_argument('--acme_challenge', default=None,
+        choices=['http-01', 'dns-01'],
+        help='''With --acme_domains, how the CA validates the domains:
+        `http-01` on the listener of --acme_http_port, or `dns-01` with TXT
+        records published in the Cloud DNS managed zone of
+        --acme_dns_project and --acme_dns_managed_zone, required for the
+        wildcard domains. Default: `http-01`.''')
+    parser.add_argument('--acme_http_port', default=None, type=int,
+        help='''With --acme_domains, the port of a plain HTTP listener serving
+        the `http-01` challenges and redirecting the other requests to HTTPS.
+        The CA validates the challenges on port 80, which must be forwarded
+        to it.''')
+    parser.add_argument('--acme_dns_project', default=None,
+        help='''With --acme_challenge=dns-01, the project of the Cloud DNS
+        managed zone of the domains.''')
+    parser.add_argument('--acme_dns_managed_zone', default=None,
+        help='''With --acme_challenge=dns-01, the Cloud DNS managed zone of the
+        domains.''')
+    parser.add_argument('--acme_cache_dir', default=None,
+        help='''With --acme_domains, a directory keeping the ACME account key and
+        the certificate across restarts, e.g. on a persistent volume. Without
+        it, every start orders a new certificate, which the CAs rate limit.''')
+    parser.add_argument('--acme_renew_before_days', default=None, type=int,
+        help='''With --acme_domains, how many days before its expiration the
+        certificate is renewed. Default: 30.''')
+
     parser.add_argument('-z', '--healthz', default=None, help='''Define a
         health checking endpoint on the same ports as the application backend.
         For example, "-z healthz" makes ESPv2 return code 200 for location
@@ -199,6 +544,50 @@ environment variable or by passing "-k" flag to this script.
         don't use any paths conflicting with your normal requests.
         Default: not used.''')
 
+    parser.add_argument('--healthz_mode', default=None,
+        choices=['proxy_only', 'backend_aware'],
+        help='''How the health checking endpoint of --healthz is answered.
+        With "proxy_only", it returns 200 while ESPv2 is up. With
+        "backend_aware", ESPv2 actively health checks the backend, with the
+        gRPC health checking protocol for gRPC backends and by connecting
+        for the others, and it returns 503 while the backend is unhealthy.
+        Default: proxy_only.''')
+
+    parser.add_argument('--healthz_grpc_service', default=None,
+        help='''The service whose status in the gRPC health checking
+        protocol decides the answer of the health checking endpoint, with
+        --healthz_mode=backend_aware and a gRPC backend. The endpoint returns
+        200 while the backend reports SERVING for it, and 503 otherwise.
+        Default: the overall status of the backend.''')
+
+    parser.add_argument('--enable_grpc_health_passthrough', action='store_true',
+        help='''Route the calls to grpc.health.v1.Health/Check to the gRPC
+        backend without service control, even if the service config does not
+        define the grpc.health.v1.Health service. Default: disabled.''')
+
+    parser.add_argument(
+        '--readiness_port',
+        default=None,
+        type=int,
+        help='''If set, the config manager serves "/ready" on this port for
+        readiness probes, e.g. of Kubernetes. It returns 503 until Envoy
+        accepted the first generated config, then 200 with the service name
+        and config id as JSON. It also serves the metrics of the config
+        translation on "/metrics" in the Prometheus text format.''')
+
+    parser.add_argument(
+        '--drain_timeout',
+        default=None,
+        type=int,
+        help='''If set, on SIGTERM ESPv2 fails its health checks, drains the
+        listeners of Envoy and waits up to this number of seconds for the
+        in-flight requests and streams to complete. It then flushes the last
+        Service Control reports and waits up to 5 more seconds for them to be
+        sent, before exiting. It requires the admin
+        interface enabled by --status_port. The termination grace period of
+        the container, e.g. terminationGracePeriodSeconds of Kubernetes, should
+        be longer.''')
+
     parser.add_argument(
         '-R',
         '--rollout_strategy',
@@ -207,6 +596,57 @@ environment variable or by passing "-k" flag to this script.
         Default value: {strategy}'''.format(strategy=DEFAULT_ROLLOUT_STRATEGY),
         choices=['fixed', 'managed'])
 
+    parser.add_argument(
+        '--rollout_traffic_split',
+        action='store_true',
+        help='''With the managed rollout strategy, pick the service config of
+        this instance by the traffic percentages of the latest rollout, instead
+        of the one with the highest traffic. The instances of the service then
+        split the traffic between the configs of a rollout in progress.''')
+    parser.add_argument(
+        '--rollout_dual_serving',
+        action='store_true',
+        help='''With the managed rollout strategy, apply the service config
+        with the highest traffic of the latest rollout, but check and report
+        each request to Service Control with the config id it's assigned to by
+        the traffic percentages of the rollout in progress.''')
+
+    parser.add_argument(
+        '--fallback_to_managed_rollout',
+        action='store_true',
+        help='''With the service config pinned by --version, fall back to the
+        one of the latest rollout if the pinned one fails to be fetched and
+        applied at startup.''')
+
+    parser.add_argument(
+        '--halt_rollout_on_nack',
+        action='store_true',
+        help='''When Envoy rejects a service config, which is rolled back to
+        the last accepted one, stop applying new rollouts until resumed with a
+        POST to /debug/resume_rollout of the config manager.''')
+    parser.add_argument(
+        '--canary_bake_period',
+        default=None, type=int,
+        help='''If set, watch the requests served by Envoy for this many
+        seconds after it accepts a new service config, and roll back to the
+        previous one if their error rate or latency breach the canary
+        thresholds. The rolled back config isn't applied again.''')
+    parser.add_argument(
+        '--canary_max_error_rate',
+        default=None, type=float,
+        help='''With --canary_bake_period, the highest fraction of 5xx
+        responses during the bake. The default is 0.05.''')
+    parser.add_argument(
+        '--canary_min_requests',
+        default=None, type=int,
+        help='''With --canary_bake_period, the requests served during the bake
+        before their error rate is checked. The default is 100.''')
+    parser.add_argument(
+        '--canary_max_latency_ms',
+        default=None, type=int,
+        help='''With --canary_bake_period, the highest P99 latency of the
+        requests in milliseconds over a stats flush interval of Envoy.''')
+
     # Customize management service url prefix.
     parser.add_argument(
         '-g',
@@ -244,6 +684,8 @@ environment variable or by passing "-k" flag to this script.
         help='''
         Only works when --cors_preset is 'basic'. Configures the CORS header
         Access-Control-Allow-Origin. Defaults to "*" which allows all origins.
+        Accepts a comma-separated list of origins, and a wildcard for the
+        subdomains of an origin, e.g. "https://example.com,https://*.example.com".
         ''')
     parser.add_argument(
         '--cors_allow_origin_regex',
@@ -284,6 +726,40 @@ environment variable or by passing "-k" flag to this script.
         Only works when --cors_preset is in use. Enable the CORS header
         Access-Control-Allow-Credentials. By default, this header is disabled.
         ''')
+    parser.add_argument(
+        '--cors_max_age',
+        default=None,
+        help='''
+        Only works when --cors_preset is in use. Configures the CORS header
+        Access-Control-Max-Age, e.g. 1h. Defaults to 480h (20 days). Set it to
+        0s to not send the header.
+        ''')
+    parser.add_argument(
+        '--cors_allow_private_network',
+        action='store_true',
+        help='''
+        Only works when --cors_preset is in use. Enable the CORS header
+        Access-Control-Allow-Private-Network in the preflight responses, so
+        public websites can reach the service on a private network. By
+        default, this header is disabled.
+        ''')
+    parser.add_argument(
+        '--cors_reflect_request_headers',
+        action='store_true',
+        help='''
+        Only works when --cors_preset is in use. Configures the CORS header
+        Access-Control-Allow-Headers of the preflight responses to the
+        Access-Control-Request-Headers of the requests, instead of
+        --cors_allow_headers.
+        ''')
+    parser.add_argument(
+        '--cors_preflight_direct_response',
+        action='store_true',
+        help='''
+        Only works when --cors_preset is in use. Answers the OPTIONS requests
+        directly from ESPv2, without forwarding them to the local backend. Use
+        it when all the operations are routed to remote backends.
+        ''')
     parser.add_argument(
         '--check_metadata',
         action='store_true',
@@ -358,6 +834,55 @@ environment variable or by passing "-k" flag to this script.
         help='''
         Specify JWT public key cache duration in seconds. The default is 5 minutes.'''
     )
+    parser.add_argument(
+        '--jwks_cache_dir',
+        default=None,
+        help='''
+        If set, the JWKS documents and OpenID discovery results fetched by the
+        config manager are persisted in this directory. When the jwks_uri of a
+        provider is unavailable, its cached JWKS is used instead, so restarts
+        during an identity provider outage can still validate tokens.'''
+    )
+    parser.add_argument(
+        '--jwks_cache_ttl',
+        default=None,
+        help='''
+        How long the entries of --jwks_cache_dir are used, e.g. `12h`.
+        The default is 24 hours.'''
+    )
+    parser.add_argument(
+        '--openid_discovery_budget',
+        default=None,
+        help='''
+        The overall time for the retries of an OpenID Connect Discovery, e.g.
+        `30s`. See the openid_discovery callout of --callout_policies.
+        By default there is no limit.'''
+    )
+    parser.add_argument(
+        '--defer_openid_discovery',
+        action='store_true',
+        help='''
+        If set, a failed OpenID Connect Discovery doesn't prevent the proxy
+        startup. The tokens of the provider are rejected until its discovery,
+        retried in the background, succeeds.'''
+    )
+    parser.add_argument(
+        '--audit_mode',
+        action='store_true',
+        help='''
+        If set, the JWT authentication, API key and quota failures of all
+        operations are only logged and reported, and the requests are still
+        forwarded. It allows rolling out new auth requirements on the existing
+        traffic before enforcing them. The failures are logged by service
+        control, so it requires a service config with a control environment.'''
+    )
+    parser.add_argument(
+        '--audit_mode_selectors',
+        default=None,
+        help='''
+        Comma-separated selectors of the operations in audit mode, see
+        --audit_mode.'''
+    )
     parser.add_argument(
         '--http_request_timeout_s',
         default=None, type=int,
@@ -367,6 +892,19 @@ environment variable or by passing "-k" flag to this script.
         This timeout does not apply to requests proxied to the backend.
         Must be > 0 and the default is 30 seconds if not set.
         ''')
+    parser.add_argument(
+        '--callout_policies',
+        default=None,
+        help='''
+        Override the timeout and retries of the calls to the control-plane
+        dependencies, instead of --http_request_timeout_s for all of them.
+        The format is "CALLOUT=KEY:VALUE[,KEY:VALUE...][;CALLOUT=...]", where
+        CALLOUT is one of "imds", "iam", "jwks", "openid_discovery" or
+        "service_control", and KEY is one of "timeout", "retries" or
+        "retry_backoff". Only the timeout of "imds", "iam" and "jwks" can be
+        set. For example,
+        "jwks=timeout:5s;openid_discovery=timeout:2s,retries:3".
+        ''')
     parser.add_argument(
         '--service_control_check_timeout_ms',
         default=None,
@@ -409,6 +947,16 @@ environment variable or by passing "-k" flag to this script.
         Set the retry times for service control Report request.
         Must be >= 0 and the default is 5 if not set.
         ''')
+    parser.add_argument(
+        '--backend_consumer_headers',
+        default=None,
+        help='''
+        Comma-separated consumer info forwarded to the backend after a
+        successful Check: `project_number` in the
+        X-Endpoint-API-Consumer-Project-Number header, and `api_key_hash`,
+        the SHA-256 of the api key, in the X-Endpoint-API-Key-Hash header.
+        The same headers sent by the clients are removed. Default: none.
+        ''')
     parser.add_argument(
         '--backend_retry_ons',
         default=None,
@@ -428,10 +976,77 @@ environment variable or by passing "-k" flag to this script.
         help='''
         The allowed number of retries. Must be >= 0 and defaults to 1. 
         ''')
+    parser.add_argument(
+        '--backend_host_rewrite',
+        default=None,
+        choices=['preserve', 'backend_address', 'literal'],
+        help='''
+        How the Host header of the requests to the local backend of
+        --backend is rewritten: kept from the client (`preserve`), set to the
+        host and the non-default port of --backend (`backend_address`) or set
+        to --backend_host_rewrite_literal (`literal`). Default: `preserve`.
+        The remote backends of the backend rules always get their own host.
+        ''')
+    parser.add_argument(
+        '--backend_host_rewrite_literal',
+        default=None,
+        help='''
+        The Host header of the requests to the local backend with
+        --backend_host_rewrite=literal, e.g. api.example.com.
+        ''')
+    parser.add_argument(
+        '--path_rewrite_query_params',
+        default=None,
+        choices=['preserve', 'merge', 'drop'],
+        help='''
+        How the backends with path_translation CONSTANT_ADDRESS get the query
+        parameters of the original request: all of them (`preserve`), all
+        except the ones named after a path template variable (`merge`) or
+        none of them (`drop`). Default: `preserve`.
+        ''')
+    parser.add_argument(
+        '--path_rewrite_original_path_header',
+        default=None,
+        help='''
+        If set, the backends with path_translation CONSTANT_ADDRESS get the
+        original path of the request in this request header.
+        ''')
+    parser.add_argument(
+        '--forward_original_path',
+        action='store_true',
+        help='''
+        If set, the remote backends get the original path of the request in
+        the x-envoy-original-path header, e.g. to build the externally visible
+        URL of pagination links.
+        ''')
+    parser.add_argument(
+        '--forward_original_host',
+        action='store_true',
+        help='''
+        If set, the remote backends get the original host of the request in
+        the x-forwarded-host header.
+        ''')
+    parser.add_argument(
+        '--forward_original_method',
+        action='store_true',
+        help='''
+        If set, the remote backends get the original HTTP method of the
+        request, before x-http-method-override, in the x-envoy-original-method
+        header.
+        ''')
+    parser.add_argument(
+        '--strict_selector_validation',
+        action='store_true',
+        help='''
+        If set, reject the service configs with usage, backend, authentication
+        or system parameter rules whose selector is not a method in
+        apis.methods, e.g. because of a typo.
+        ''')
     parser.add_argument(
         '--access_log',
         help='''
         Path to a local file to which the access log entries will be written.
+        Use /dev/stdout or /dev/stderr to write them to the console.
         '''
     )
     parser.add_argument(
@@ -444,6 +1059,86 @@ environment variable or by passing "-k" flag to this script.
         https://www.envoyproxy.io/docs/envoy/latest/configuration/observability/access_log#format-strings
         '''
     )
+    parser.add_argument(
+        '--access_log_json_format',
+        help='''
+        A JSON object to write each access log entry as JSON, e.g.
+        {"status":"%%RESPONSE_CODE%%","path":"%%REQ(:PATH)%%"}.
+        It cannot be used together with --access_log_format.
+        '''
+    )
+    parser.add_argument(
+        '--access_log_min_status_code',
+        default=None,
+        type=int,
+        help='''
+        If set, only log the requests whose response code is not less than it,
+        e.g. 400 to only log errors.
+        '''
+    )
+    parser.add_argument(
+        '--audit_log',
+        help='''
+        Path to a local file to which the auth outcome of every request is
+        written as JSON, distinct from the access log: the path without its
+        query, the operation, JWT issuer and subject, SHA-256 of the api key,
+        the ALLOW or DENY decision and its reason. The decision is DENY for
+        the requests rejected by the auth or the quota checks of ESPv2, by
+        their response code details.
+        '''
+    )
+
+    parser.add_argument(
+        '--statsd_address',
+        default=None,
+        help='''
+        If set, flush the stats of ESPv2 to the StatsD server at this UDP
+        address, in the form of IP:PORT.
+        '''
+    )
+    parser.add_argument(
+        '--statsd_prefix',
+        default=None,
+        help='''
+        The prefix of the stats flushed to the StatsD server. Defaults to "envoy".
+        '''
+    )
+    parser.add_argument(
+        '--statsd_tag_format',
+        default=None,
+        choices=['statsd', 'dogstatsd'],
+        help='''
+        The format of the stats flushed to the StatsD server. Use "dogstatsd"
+        to emit the stat tags for Datadog. Defaults to "statsd".
+        '''
+    )
+    parser.add_argument(
+        '--prometheus_metrics_port',
+        default=None,
+        type=int,
+        help='''
+        If set, serve the stats of ESPv2 in the Prometheus format on /metrics
+        at this port. It requires the admin interface enabled by --status_port.
+        '''
+    )
+    parser.add_argument(
+        '--prometheus_metrics_address',
+        default=None,
+        help='''
+        The address the listener of --prometheus_metrics_port binds to. The
+        stats are served without authentication, so by default it's only
+        reachable locally on 127.0.0.1. Use 0.0.0.0 to let a remote Prometheus
+        server scrape them.
+        '''
+    )
+    parser.add_argument(
+        '--prometheus_stats_filter',
+        default=None,
+        help='''
+        The regex selecting the stats served on /metrics. By default, only the
+        request counts, the upstream latencies and the filter errors are served.
+        '''
+    )
 
     parser.add_argument(
         '--disable_tracing',
@@ -514,8 +1209,27 @@ environment variable or by passing "-k" flag to this script.
         help='''
         By default, the proxy tries to talk to GCP metadata server to get VM
         location in the first few requests. Setting this flag to true to skip
-        this step.
+        this step. The config generation then fails if Service Control or IAM
+        are called without --service_account_key or a non-GCP
+        --metadata_provider to get their access tokens.
         ''')
+    parser.add_argument(
+        '--gcp_project_id_override',
+        default=None,
+        help='''The project id reported to Service Control instead of the
+        one of the metadata server, e.g. on GKE on-prem or other clouds.''')
+    parser.add_argument(
+        '--gcp_zone_override',
+        default=None,
+        help='''The zone or region reported to Service Control instead of the
+        one of the metadata server.''')
+    parser.add_argument(
+        '--gcp_attributes_file',
+        default=None,
+        help='''A JSON file with the "projectId", "zone" and "platform"
+        reported to Service Control instead of the ones of the metadata
+        server. Its fields are overridden by --gcp_project_id_override and
+        --gcp_zone_override.''')
     parser.add_argument(
         '--service_account_key',
         help='''
@@ -523,7 +1237,21 @@ environment variable or by passing "-k" flag to this script.
         service management.  You can also set {creds_key} environment variable to
         the location of the service account credentials JSON file. If the option is
         omitted, the proxy contacts the metadata service to fetch an access token.
+        Besides a service account key, the file can hold the refresh token of a
+        user ("authorized_user") or an external account of the workload
+        identity federation ("external_account").
         '''.format(creds_key=GOOGLE_CREDS_KEY))
+    parser.add_argument(
+        '--impersonate_service_account',
+        default=None,
+        help='''In the form of EMAIL[,DELEGATE...]. The access tokens of
+        Service Control and Service Management and the identity tokens of
+        backend auth are minted for the service account EMAIL through the IAM
+        Credentials API, with the credentials of --service_account_key or of
+        the metadata service and through the comma-separated chain of
+        delegates. It cannot be used together with
+        --service_control_iam_service_account or
+        --backend_auth_iam_service_account.''')
 
     parser.add_argument(
         '--dns_resolver_addresses',
@@ -591,6 +1319,18 @@ environment variable or by passing "-k" flag to this script.
         Otherwise use ignored_query_parameters. Defaults to false.
         ''')
 
+    parser.add_argument(
+        '--transcoding_query_array_style',
+        default=None,
+        choices=['repeat', 'brackets'],
+        help='''
+        The query style of the repeated fields in grpc-json transcoding. With
+        "repeat", they are bound from "param=a&param=b". With "brackets", they
+        are bound from "param[]=a&param[]=b" too, as sent by the
+        OpenAPI-generated clients. The nested fields are bound from
+        "obj.field=value" either way. Defaults to "repeat".
+        ''')
+
     # Start Deprecated Flags Section
 
     parser.add_argument(
@@ -704,6 +1444,43 @@ def enforce_conflict_args(args):
           if args.service_json_path:
             return "Flag -R or --rollout_strategy must be fixed with --service_json_path."
 
+    if args.rollout_traffic_split and args.rollout_strategy != "managed":
+        return "Flag --rollout_traffic_split has to be used together with --rollout_strategy=managed."
+
+    if args.rollout_dual_serving and args.rollout_strategy != "managed":
+        return "Flag --rollout_dual_serving has to be used together with --rollout_strategy=managed."
+
+    if args.rollout_dual_serving and args.rollout_traffic_split:
+        return "Flag --rollout_dual_serving cannot be used together with --rollout_traffic_split."
+
+    if args.fallback_to_managed_rollout and not args.version:
+        return "Flag --fallback_to_managed_rollout has to be used together with --version."
+
+    if args.service_json_watch_interval and not args.service_json_path:
+        return "Flag --service_json_watch_interval has to be used together with --service_json_path."
+
+    if args.service_config_url_poll_interval and not args.service_config_url:
+        return "Flag --service_config_url_poll_interval has to be used together with --service_config_url."
+
+    if args.service_config_url:
+        if args.service_json_path:
+            return "Flag --service_config_url cannot be used together with --service_json_path."
+        if args.service:
+            return "Flag --service cannot be used together with --service_config_url."
+        if args.version:
+            return "Flag --version cannot be used together with --service_config_url."
+        if args.rollout_strategy and args.rollout_strategy != DEFAULT_ROLLOUT_STRATEGY:
+            return "Flag -R or --rollout_strategy must be fixed with --service_config_url."
+
+    if args.healthz_mode == 'backend_aware' and not args.healthz:
+        return "Flag --healthz_mode=backend_aware requires --healthz."
+
+    if args.grpc_reflection:
+        if args.service_json_path:
+            return "Flag --grpc_reflection cannot be used together with --service_json_path."
+        if args.service_config_url:
+            return "Flag --grpc_reflection cannot be used together with --service_config_url."
+
     if args.service_json_path:
         if args.service:
             return "Flag --service cannot be used together with --service_json_path."
@@ -720,6 +1497,27 @@ def enforce_conflict_args(args):
     if not args.access_log and args.access_log_format:
         return "Flag --access_log_format has to be used together with --access_log."
 
+    if not args.access_log and args.access_log_json_format:
+        return "Flag --access_log_json_format has to be used together with --access_log."
+
+    if args.access_log_format and args.access_log_json_format:
+        return "Flag --access_log_format cannot be used together with --access_log_json_format."
+
+    if args.prometheus_metrics_port and not args.status_port:
+        return "Flag --prometheus_metrics_port has to be used together with --status_port."
+
+    if args.drain_timeout and not args.status_port:
+        return "Flag --drain_timeout has to be used together with --status_port."
+
+    if args.canary_bake_period and not args.status_port:
+        return "Flag --canary_bake_period has to be used together with --status_port."
+
+    if args.backend_host_rewrite == "literal" and not args.backend_host_rewrite_literal:
+        return "Flag --backend_host_rewrite=literal has to be used together with --backend_host_rewrite_literal."
+
+    if args.backend_host_rewrite_literal and args.backend_host_rewrite != "literal":
+        return "Flag --backend_host_rewrite_literal has to be used together with --backend_host_rewrite=literal."
+
     if args.ssl_port and args.ssl_server_cert_path:
         return "Flag --ssl_port is going to be deprecated, please use --ssl_server_cert_path only."
     if args.tls_mutual_auth and (args.ssl_backend_client_cert_path or args.ssl_client_cert_path):
@@ -729,6 +1527,26 @@ def enforce_conflict_args(args):
     if args.generate_self_signed_cert and args.ssl_server_cert_path:
          return "Flag --generate_self_signed_cert and --ssl_server_cert_path cannot be used simutaneously."
 
+    if args.acme_domains:
+        if args.ssl_server_cert_path or args.ssl_port or args.generate_self_signed_cert:
+            return "Flag --acme_domains cannot be used together with --ssl_server_cert_path, --ssl_port or --generate_self_signed_cert."
+        if not args.acme_accept_tos:
+            return "Flag --acme_domains has to be used together with --acme_accept_tos."
+        if args.acme_challenge == "dns-01":
+            if not args.acme_dns_project or not args.acme_dns_managed_zone:
+                return "Flag --acme_challenge=dns-01 has to be used together with --acme_dns_project and --acme_dns_managed_zone."
+        elif not args.acme_http_port:
+            return "Flag --acme_domains has to be used together with --acme_http_port, unless --acme_challenge=dns-01."
+        if args.acme_http_port and args.acme_http_port < 1024:
+            return "Port {} is a privileged port. " \
+                   "For security purposes, the ESPv2 container cannot bind to it. " \
+                   "Use any port above 1024 instead.".format(args.acme_http_port)
+    elif (args.acme_accept_tos or args.acme_email or args.acme_directory_url
+          or args.acme_challenge or args.acme_http_port or args.acme_dns_project
+          or args.acme_dns_managed_zone or args.acme_cache_dir
+          or args.acme_renew_before_days):
+        return "Flags --acme_* have to be used together with --acme_domains."
+
     port_flags = []
     port_num = DEFAULT_LISTENER_PORT
     if args.http_port:
@@ -793,6 +1611,18 @@ def gen_proxy_config(args):
     if args.healthz:
       proxy_conf.extend(["--healthz", args.healthz])
 
+    if args.healthz_mode:
+      proxy_conf.extend(["--healthz_mode", args.healthz_mode])
+
+    if args.healthz_grpc_service:
+      proxy_conf.extend(["--healthz_grpc_service", args.healthz_grpc_service])
+
+    if args.enable_grpc_health_passthrough:
+      proxy_conf.append("--enable_grpc_health_passthrough")
+
+    if args.readiness_port:
+      proxy_conf.extend(["--config_manager_readiness_port", str(args.readiness_port)])
+
     if args.enable_debug:
         proxy_conf.extend(["--v", "1"])
     else:
@@ -808,6 +1638,24 @@ def gen_proxy_config(args):
     if args.jwks_cache_duration_in_s:
          proxy_conf.extend(["--jwks_cache_duration_in_s", args.jwks_cache_duration_in_s])
 
+    if args.jwks_cache_dir:
+        proxy_conf.extend(["--jwks_cache_dir", args.jwks_cache_dir])
+
+    if args.jwks_cache_ttl:
+        proxy_conf.extend(["--jwks_cache_ttl", args.jwks_cache_ttl])
+
+    if args.openid_discovery_budget:
+        proxy_conf.extend(["--openid_discovery_budget", args.openid_discovery_budget])
+
+    if args.defer_openid_discovery:
+        proxy_conf.append("--defer_openid_discovery")
+
+    if args.audit_mode:
+        proxy_conf.append("--audit_mode")
+
+    if args.audit_mode_selectors:
+        proxy_conf.extend(["--audit_mode_selectors", args.audit_mode_selectors])
+
     if args.management:
         proxy_conf.extend(["--service_management_url", args.management])
 
@@ -873,15 +1721,151 @@ def gen_proxy_config(args):
                    ' -days 3650 -subj "/CN=localhost"'))
         proxy_conf.extend(["--ssl_server_cert_path", "/tmp/ssl/endpoints"])
 
+    if args.acme_domains:
+        proxy_conf.extend(["--acme_domains", args.acme_domains])
+    if args.acme_accept_tos:
+        proxy_conf.append("--acme_accept_tos")
+    if args.acme_email:
+        proxy_conf.extend(["--acme_email", args.acme_email])
+    if args.acme_directory_url:
+        proxy_conf.extend(["--acme_directory_url", args.acme_directory_url])
+    if args.acme_challenge:
+        proxy_conf.extend(["--acme_challenge", args.acme_challenge])
+    if args.acme_http_port:
+        proxy_conf.extend(["--acme_http_port", str(args.acme_http_port)])
+    if args.acme_dns_project:
+        proxy_conf.extend(["--acme_dns_project", args.acme_dns_project])
+    if args.acme_dns_managed_zone:
+        proxy_conf.extend(["--acme_dns_managed_zone", args.acme_dns_managed_zone])
+    if args.acme_cache_dir:
+        proxy_conf.extend(["--acme_cache_dir", args.acme_cache_dir])
+    if args.acme_renew_before_days:
+        proxy_conf.extend(["--acme_renew_before", "{}h".format(24 * args.acme_renew_before_days)])
+
     if args.enable_strict_transport_security:
             proxy_conf.append("--enable_strict_transport_security")
 
+    if args.enable_rds:
+        proxy_conf.append("--enable_rds")
+
+    if args.api_version_header:
+        proxy_conf.extend(["--api_version_header", args.api_version_header])
+    if args.api_base_path:
+        proxy_conf.extend(["--api_base_path", args.api_base_path])
+
+    if args.response_cache_selectors:
+        proxy_conf.extend(["--response_cache_selectors", args.response_cache_selectors])
+
+    if args.response_cache_ttl:
+        proxy_conf.extend(["--response_cache_ttl", args.response_cache_ttl])
+
+    if args.response_cache_key_query_params:
+        proxy_conf.extend(["--response_cache_key_query_params", args.response_cache_key_query_params])
+
+    if args.response_cache_key_headers:
+        proxy_conf.extend(["--response_cache_key_headers", args.response_cache_key_headers])
+
+    if args.etag_selectors:
+        proxy_conf.extend(["--etag_selectors", args.etag_selectors])
+
+    if args.etag_max_body_bytes:
+        proxy_conf.extend(["--etag_max_body_bytes", args.etag_max_body_bytes])
+
+    if args.idempotency_selectors:
+        proxy_conf.extend(["--idempotency_selectors", args.idempotency_selectors])
+
+    if args.idempotency_key_header:
+        proxy_conf.extend(["--idempotency_key_header", args.idempotency_key_header])
+
+    if args.idempotency_ttl:
+        proxy_conf.extend(["--idempotency_ttl", args.idempotency_ttl])
+
+    if args.rate_limit_tiers:
+        proxy_conf.extend(["--rate_limit_tiers", args.rate_limit_tiers])
+
+    if args.rate_limit_consumer_tiers:
+        proxy_conf.extend(["--rate_limit_consumer_tiers", args.rate_limit_consumer_tiers])
+
+    if args.rate_limit_default_tier:
+        proxy_conf.extend(["--rate_limit_default_tier", args.rate_limit_default_tier])
+
+    if args.rate_limit_service_address:
+        proxy_conf.extend(["--rate_limit_service_address", args.rate_limit_service_address])
+
+    if args.concurrency_limits:
+        proxy_conf.extend(["--concurrency_limits", args.concurrency_limits])
+
+    if args.spike_arrest_rps:
+        proxy_conf.extend(["--spike_arrest_rps", str(args.spike_arrest_rps)])
+
+    if args.spike_arrest_burst:
+        proxy_conf.extend(["--spike_arrest_burst", str(args.spike_arrest_burst)])
+
+    if args.deny_user_agents:
+        proxy_conf.extend(["--deny_user_agents", args.deny_user_agents])
+
+    if args.deny_paths:
+        proxy_conf.extend(["--deny_paths", args.deny_paths])
+
+    if args.upload_backend_address:
+        proxy_conf.extend(["--upload_backend_address", args.upload_backend_address])
+
+    if args.upload_size_thresholds:
+        proxy_conf.extend(["--upload_size_thresholds", args.upload_size_thresholds])
+
+    if args.query_param_matchers:
+        proxy_conf.extend(["--query_param_matchers", args.query_param_matchers])
+
+    if args.enable_operation_virtual_clusters:
+        proxy_conf.append("--enable_operation_virtual_clusters")
+
+    if args.honor_grpc_timeout_header:
+        proxy_conf.append("--honor_grpc_timeout_header")
+
+    if args.transcoding_grpc_status_http_codes:
+        proxy_conf.extend(["--transcoding_grpc_status_http_codes",
+            args.transcoding_grpc_status_http_codes])
+
+    if args.transcoding_operation_grpc_status_http_codes:
+        proxy_conf.extend(["--transcoding_operation_grpc_status_http_codes",
+            args.transcoding_operation_grpc_status_http_codes])
+
+    if args.transcoding_validate_request_body:
+        proxy_conf.append("--transcoding_validate_request_body")
+
+    if args.transcoding_reject_unknown_body_fields:
+        proxy_conf.append("--transcoding_reject_unknown_body_fields")
+
+    if args.transcoding_body_validation_opt_out_selectors:
+        proxy_conf.extend(["--transcoding_body_validation_opt_out_selectors",
+            args.transcoding_body_validation_opt_out_selectors])
+
+    if args.transcoding_stream_formats:
+        proxy_conf.extend(["--transcoding_stream_formats",
+            args.transcoding_stream_formats])
+
+    if args.transcoding_operation_print_options:
+        proxy_conf.extend(["--transcoding_operation_print_options",
+            args.transcoding_operation_print_options])
+
+    if args.maintenance_selectors:
+        proxy_conf.extend(["--maintenance_selectors", args.maintenance_selectors])
+
+    if args.maintenance_status_code:
+        proxy_conf.extend(["--maintenance_status_code", str(args.maintenance_status_code)])
+
+    if args.maintenance_retry_after:
+        proxy_conf.extend(["--maintenance_retry_after", args.maintenance_retry_after])
+
     if args.service:
         proxy_conf.extend(["--service", args.service])
 
     if args.http_request_timeout_s:
         proxy_conf.extend( ["--http_request_timeout_s", str(args.http_request_timeout_s)])
 
+    if args.callout_policies:
+        proxy_conf.extend(["--callout_policies", args.callout_policies])
+
     if args.service_control_check_retries:
         proxy_conf.extend([
             "--service_control_check_retries",
@@ -922,11 +1906,50 @@ def gen_proxy_config(args):
     if args.service_control_network_fail_policy == "close":
         proxy_conf.extend(["--service_control_network_fail_open=false"])
 
+    if args.backend_consumer_headers:
+        proxy_conf.extend([
+            "--backend_consumer_headers",
+            args.backend_consumer_headers
+        ])
+
     if args.version:
         proxy_conf.extend(["--service_config_id", args.version])
+    if args.fallback_to_managed_rollout:
+        proxy_conf.append("--fallback_to_managed_rollout")
+    if args.halt_rollout_on_nack:
+        proxy_conf.append("--halt_rollout_on_nack")
+    if args.canary_bake_period:
+        proxy_conf.extend(["--canary_bake_period", "{}s".format(args.canary_bake_period)])
+    if args.canary_max_error_rate is not None:
+        proxy_conf.extend(["--canary_max_error_rate", str(args.canary_max_error_rate)])
+    if args.canary_min_requests is not None:
+        proxy_conf.extend(["--canary_min_requests", str(args.canary_min_requests)])
+    if args.canary_max_latency_ms:
+        proxy_conf.extend(["--canary_max_latency", "{}ms".format(args.canary_max_latency_ms)])
+    if args.rollout_traffic_split:
+        proxy_conf.append("--rollout_traffic_split")
+    if args.rollout_dual_serving:
+        proxy_conf.append("--rollout_dual_serving")
 
     if args.service_json_path:
         proxy_conf.extend(["--service_json_path", args.service_json_path])
+    if args.service_json_watch_interval:
+        proxy_conf.extend(["--service_json_watch_interval",
+                           args.service_json_watch_interval])
+    if args.config_file:
+        proxy_conf.extend(["--config_file", args.config_file])
+    if args.additional_services:
+        proxy_conf.extend(["--additional_services", args.additional_services])
+    if args.additional_service_json_paths:
+        proxy_conf.extend(["--additional_service_json_paths",
+                           args.additional_service_json_paths])
+    if args.service_config_url:
+        proxy_conf.extend(["--service_config_url", args.service_config_url])
+    if args.service_config_url_poll_interval:
+        proxy_conf.extend(["--service_config_url_poll_interval",
+                           args.service_config_url_poll_interval])
+    if args.grpc_reflection:
+        proxy_conf.append("--grpc_reflection")
 
     if args.check_metadata:
         proxy_conf.append("--check_metadata")
@@ -940,12 +1963,64 @@ def gen_proxy_config(args):
     if args.backend_retry_num:
         proxy_conf.extend(["--backend_retry_num", args.backend_retry_num])
 
+    if args.backend_host_rewrite:
+        proxy_conf.extend(["--backend_host_rewrite",
+                           args.backend_host_rewrite])
+
+    if args.backend_host_rewrite_literal:
+        proxy_conf.extend(["--backend_host_rewrite_literal",
+                           args.backend_host_rewrite_literal])
+
+    if args.path_rewrite_query_params:
+        proxy_conf.extend(["--path_rewrite_query_params",
+                           args.path_rewrite_query_params])
+
+    if args.path_rewrite_original_path_header:
+        proxy_conf.extend(["--path_rewrite_original_path_header",
+                           args.path_rewrite_original_path_header])
+
+    if args.forward_original_path:
+        proxy_conf.append("--forward_original_path")
+
+    if args.forward_original_host:
+        proxy_conf.append("--forward_original_host")
+
+    if args.forward_original_method:
+        proxy_conf.append("--forward_original_method")
+
+    if args.strict_selector_validation:
+        proxy_conf.append("--strict_selector_validation")
+
     if args.access_log:
         proxy_conf.extend(["--access_log",
                            args.access_log])
     if args.access_log_format:
         proxy_conf.extend(["--access_log_format",
                            args.access_log_format])
+    if args.access_log_json_format:
+        proxy_conf.extend(["--access_log_json_format",
+                           args.access_log_json_format])
+    if args.access_log_min_status_code:
+        proxy_conf.extend(["--access_log_min_status_code",
+                           str(args.access_log_min_status_code)])
+    if args.audit_log:
+        proxy_conf.extend(["--audit_log", args.audit_log])
+
+    if args.prometheus_metrics_port:
+        proxy_conf.extend(["--prometheus_metrics_port",
+                           str(args.prometheus_metrics_port),
+                           "--admin_port", str(args.status_port)])
+    if args.prometheus_metrics_address:
+        proxy_conf.extend(["--prometheus_metrics_address",
+                           args.prometheus_metrics_address])
+    if args.prometheus_stats_filter:
+        proxy_conf.extend(["--prometheus_stats_filter",
+                           args.prometheus_stats_filter])
+
+    if args.drain_timeout:
+        proxy_conf.extend(["--drain_timeout", "{}s".format(args.drain_timeout)])
+        if not args.prometheus_metrics_port:
+            proxy_conf.extend(["--admin_port", str(args.status_port)])
 
     if args.disable_tracing:
         proxy_conf.append("--disable_tracing")
@@ -984,6 +2059,10 @@ def gen_proxy_config(args):
     if args.transcoding_ignore_unknown_query_parameters:
         proxy_conf.append("--transcoding_ignore_unknown_query_parameters")
 
+    if args.transcoding_query_array_style:
+        proxy_conf.extend(["--transcoding_query_array_style",
+            args.transcoding_query_array_style])
+
     if args.on_serverless:
         proxy_conf.extend([
             "--compute_platform_override", SERVERLESS_PLATFORM])
@@ -1004,6 +2083,9 @@ def gen_proxy_config(args):
         proxy_conf.append("--envoy_use_remote_address")
 
     if args.cors_preset:
+        # The allowed headers are the requested ones when reflected.
+        if args.cors_reflect_request_headers:
+            args.cors_allow_headers = ''
         proxy_conf.extend([
             "--cors_preset",
             args.cors_preset,
@@ -1020,6 +2102,14 @@ def gen_proxy_config(args):
         ])
         if args.cors_allow_credentials:
             proxy_conf.append("--cors_allow_credentials")
+        if args.cors_max_age:
+            proxy_conf.extend(["--cors_max_age", args.cors_max_age])
+        if args.cors_allow_private_network:
+            proxy_conf.append("--cors_allow_private_network")
+        if args.cors_reflect_request_headers:
+            proxy_conf.append("--cors_reflect_request_headers")
+        if args.cors_preflight_direct_response:
+            proxy_conf.append("--cors_preflight_direct_response")
 
     # Set credentials file from the environment variable
     if args.service_account_key is None and GOOGLE_CREDS_KEY in os.environ:
@@ -1027,9 +2117,20 @@ def gen_proxy_config(args):
 
     if args.service_account_key:
         proxy_conf.extend(["--service_account_key", args.service_account_key])
+    if args.impersonate_service_account:
+        proxy_conf.extend(["--impersonate_service_account", args.impersonate_service_account])
     if args.non_gcp:
         proxy_conf.append("--non_gcp")
 
+    if args.gcp_project_id_override:
+        proxy_conf.extend(["--gcp_project_id_override", args.gcp_project_id_override])
+
+    if args.gcp_zone_override:
+        proxy_conf.extend(["--gcp_zone_override", args.gcp_zone_override])
+
+    if args.gcp_attributes_file:
+        proxy_conf.extend(["--gcp_attributes_file", args.gcp_attributes_file])
+
     if args.enable_debug:
         proxy_conf.append("--suppress_envoy_headers=false")
 
@@ -1080,6 +2181,20 @@ def start_envoy(args):
     t.start()
     return proc
 
+def shutdown_gracefully(cm_proc, envoy_proc, drain_timeout):
+    # The Config Manager drains Envoy on SIGTERM, while still serving its
+    # config, then exits.
+    logging.info("Draining ESPv2, up to {} seconds.".format(drain_timeout))
+    cm_proc.send_signal(signal.SIGTERM)
+    try:
+        cm_proc.wait(timeout=drain_timeout + DRAIN_EXIT_GRACE_PERIOD)
+    except subprocess.TimeoutExpired:
+        logging.warning("Config Manager didn't exit after draining, killing it.")
+        cm_proc.kill()
+    envoy_proc.send_signal(signal.SIGTERM)
+    envoy_proc.wait()
+    sys.exit(0)
+
 
 if __name__ == '__main__':
     logging.basicConfig(format='%(levelname)s: %(message)s', level=logging.INFO)
@@ -1090,6 +2205,11 @@ if __name__ == '__main__':
     cm_proc = start_config_manager(gen_proxy_config(args))
     envoy_proc = start_envoy(args)
 
+    if args.drain_timeout:
+        signal.signal(signal.SIGTERM,
+                      lambda signum, frame: shutdown_gracefully(
+                          cm_proc, envoy_proc, args.drain_timeout))
+
     while True:
         time.sleep(HEALTH_CHECK_PERIOD)
         if not cm_proc or cm_proc.poll():
@@ -130,6 +130,20 @@ Status set_int64_metric_to_constant_1(const SupportedMetric& m,
   return Status::OK;
 }
 
+Status set_int64_metric_to_request_bytes(const SupportedMetric& m,
+                                         const ReportRequestInfo& info,
+                                         Operation* operation) {
+  AddInt64Metric(m.name, info.request_bytes, operation);
+  return Status::OK;
+}
+
+Status set_int64_metric_to_response_bytes(const SupportedMetric& m,
+                                          const ReportRequestInfo& info,
+                                          Operation* operation) {
+  AddInt64Metric(m.name, info.response_bytes, operation);
+  return Status::OK;
+}
+
 Status set_distribution_metric_to_request_size(const SupportedMetric& m,
                                                const ReportRequestInfo& info,
                                                Operation* operation) {
@@ -320,6 +334,38 @@ const SupportedMetric supported_metrics[] = {
         SupportedMetric::PRODUCER_BY_CONSUMER,
         set_distribution_metric_to_overhead_time,
     },
+    {
+        "serviceruntime.googleapis.com/api/consumer/request_bytes",
+        ::google::api::MetricDescriptor_MetricKind_DELTA,
+        ::google::api::MetricDescriptor_ValueType_INT64,
+        SupportedMetric::INTERMEDIATE,
+        SupportedMetric::CONSUMER,
+        set_int64_metric_to_request_bytes,
+    },
+    {
+        "serviceruntime.googleapis.com/api/producer/request_bytes",
+        ::google::api::MetricDescriptor_MetricKind_DELTA,
+        ::google::api::MetricDescriptor_ValueType_INT64,
+        SupportedMetric::INTERMEDIATE,
+        SupportedMetric::PRODUCER,
+        set_int64_metric_to_request_bytes,
+    },
+    {
+        "serviceruntime.googleapis.com/api/consumer/response_bytes",
+        ::google::api::MetricDescriptor_MetricKind_DELTA,
+        ::google::api::MetricDescriptor_ValueType_INT64,
+        SupportedMetric::INTERMEDIATE,
+        SupportedMetric::CONSUMER,
+        set_int64_metric_to_response_bytes,
+    },
+    {
+        "serviceruntime.googleapis.com/api/producer/response_bytes",
+        ::google::api::MetricDescriptor_MetricKind_DELTA,
+        ::google::api::MetricDescriptor_ValueType_INT64,
+        SupportedMetric::INTERMEDIATE,
+        SupportedMetric::PRODUCER,
+        set_int64_metric_to_response_bytes,
+    },
 };
 
 const int supported_metrics_count =
@@ -800,6 +846,27 @@ void SetOperationCommonFields(const OperationInfo& info,
   *op->mutable_end_time() = current_time;
 }
 
+// Returns true if the metric should be sent in the report.
+bool IsMetricReported(const SupportedMetric& m, const ReportRequestInfo& info) {
+  switch (m.tag) {
+    case SupportedMetric::START:
+      return info.is_first_report;
+    case SupportedMetric::INTERMEDIATE:
+      return info.is_streaming;
+    case SupportedMetric::FINAL:
+      return info.is_final_report;
+  }
+  return false;
+}
+
+// Adds the operator defined labels. Labels already set are not overridden.
+void SetCustomLabels(const OperationInfo& info,
+                     Map<std::string, std::string>* labels) {
+  for (const auto& label : info.custom_labels) {
+    labels->insert({label.first, label.second});
+  }
+}
+
 void FillLogEntry(const ReportRequestInfo& info, const std::string& name,
                   const std::string& config_id, const Timestamp& current_time,
                   LogEntry* log_entry) {
@@ -1040,6 +1107,7 @@ Status RequestBuilder::FillCheckRequest(const CheckRequestInfo& info,
   if (!info.ios_bundle_id.empty()) {
     (*labels)[kServiceControlIosBundleId] = info.ios_bundle_id;
   }
+  SetCustomLabels(info, labels);
 
   return Status::OK;
 }
@@ -1075,6 +1143,7 @@ Status RequestBuilder::FillReportRequest(const ReportRequestInfo& info,
         if (!status.ok()) return status;
       }
     }
+    SetCustomLabels(info, labels);
 
     // Report will reject consumer metric if it's based on a invalid/unknown api
     // key, or if the service is not activated in the consumer project.
@@ -1084,6 +1153,9 @@ Status RequestBuilder::FillReportRequest(const ReportRequestInfo& info,
     // Populate all metrics.
     for (auto it = metrics_.begin(), end = metrics_.end(); it != end; it++) {
       const SupportedMetric* m = *it;
+      if (!IsMetricReported(*m, info)) {
+        continue;
+      }
       if (send_consumer_metric || m->mark != SupportedMetric::CONSUMER) {
         if (m->set && m->mark != SupportedMetric::PRODUCER_BY_CONSUMER) {
           status = (m->set)(*m, info, op);
@@ -1093,6 +1165,11 @@ Status RequestBuilder::FillReportRequest(const ReportRequestInfo& info,
     }
   }
 
+  // Intermediate reports of a stream only carry metrics.
+  if (!info.is_final_report) {
+    return Status::OK;
+  }
+
   // Fill log entries.
   for (auto it = logs_.begin(), end = logs_.end(); it != end; it++) {
     FillLogEntry(info, *it, service_config_id_, current_time,
@@ -1133,6 +1210,7 @@ Status RequestBuilder::AppendByConsumerOperations(
         if (!status.ok()) return status;
       }
     }
+    SetCustomLabels(info, labels);
 
     // Populate all metrics.
     for (auto it = metrics_.begin(), end = metrics_.end(); it != end; it++) {
@@ -411,6 +411,99 @@ TEST_F(RequestBuilderTest, ReportApiKeyNotVerifiedTest) {
   }
 }
 
+TEST_F(RequestBuilderTest, CheckCustomLabelsTest) {
+  CheckRequestInfo info;
+  FillOperationInfo(&info);
+  FillCheckRequestInfo(&info);
+  info.custom_labels = {
+      {"tenant", "tenant-a"},
+      {"servicecontrol.googleapis.com/caller_ip", "5.6.7.8"}};
+
+  gasv1::CheckRequest request;
+  ASSERT_TRUE(scp_.FillCheckRequest(info, &request).ok());
+
+  const auto& labels = request.operation().labels();
+  ASSERT_EQ(labels.at("tenant"), "tenant-a");
+  // Labels set by the proxy are not overridden.
+  ASSERT_EQ(labels.at("servicecontrol.googleapis.com/caller_ip"), "1.2.3.4");
+}
+
+TEST_F(RequestBuilderTest, ReportCustomLabelsTest) {
+  ReportRequestInfo info;
+  FillOperationInfo(&info);
+  FillReportRequestInfo(&info);
+  info.check_response_info.consumer_project_number = "123456";
+  info.custom_labels = {{"tenant", "tenant-a"}, {"/response_code", "999"}};
+
+  gasv1::ReportRequest request;
+  ASSERT_TRUE(scp_.FillReportRequest(info, &request).ok());
+
+  ASSERT_EQ(request.operations_size(), 2);
+  for (const auto& op : request.operations()) {
+    ASSERT_EQ(op.labels().at("tenant"), "tenant-a");
+    // Labels set by the proxy are not overridden.
+    ASSERT_EQ(op.labels().at("/response_code"), "200");
+  }
+}
+
+bool HasMetric(const gasv1::Operation& op, const std::string& metric_name) {
+  for (const auto& metric_value_set : op.metric_value_sets()) {
+    if (metric_value_set.metric_name() == metric_name) {
+      return true;
+    }
+  }
+  return false;
+}
+
+TEST_F(RequestBuilderTest, StreamIntermediateReportTest) {
+  ReportRequestInfo info;
+  FillOperationInfo(&info);
+  FillReportRequestInfo(&info);
+  info.is_first_report = true;
+  info.is_final_report = false;
+  info.is_streaming = true;
+  info.request_bytes = 100;
+  info.response_bytes = 200;
+
+  gasv1::ReportRequest request;
+  ASSERT_TRUE(scp_.FillReportRequest(info, &request).ok());
+
+  ASSERT_EQ(request.operations_size(), 1);
+  const auto& op = request.operations(0);
+  EXPECT_TRUE(HasMetric(
+      op, "serviceruntime.googleapis.com/api/producer/request_count"));
+  EXPECT_TRUE(HasMetric(
+      op, "serviceruntime.googleapis.com/api/producer/request_bytes"));
+  EXPECT_TRUE(HasMetric(
+      op, "serviceruntime.googleapis.com/api/producer/response_bytes"));
+  EXPECT_FALSE(HasMetric(
+      op, "serviceruntime.googleapis.com/api/producer/request_sizes"));
+  EXPECT_EQ(op.log_entries_size(), 0);
+}
+
+TEST_F(RequestBuilderTest, StreamFinalReportTest) {
+  ReportRequestInfo info;
+  FillOperationInfo(&info);
+  FillReportRequestInfo(&info);
+  info.is_first_report = false;
+  info.is_final_report = true;
+  info.is_streaming = true;
+
+  gasv1::ReportRequest request;
+  ASSERT_TRUE(scp_.FillReportRequest(info, &request).ok());
+
+  ASSERT_EQ(request.operations_size(), 1);
+  const auto& op = request.operations(0);
+  // The request is already counted by the first report.
+  EXPECT_FALSE(HasMetric(
+      op, "serviceruntime.googleapis.com/api/producer/request_count"));
+  EXPECT_TRUE(HasMetric(
+      op, "serviceruntime.googleapis.com/api/producer/request_bytes"));
+  EXPECT_TRUE(HasMetric(
+      op, "serviceruntime.googleapis.com/api/producer/request_sizes"));
+  EXPECT_EQ(op.log_entries_size(), 1);
+}
+
 TEST_F(RequestBuilderTest, CredentailIdIssuerOnlyTest) {
   ReportRequestInfo info;
   FillOperationInfo(&info);
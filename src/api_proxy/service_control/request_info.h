@@ -17,6 +17,8 @@
 #include <chrono>
 #include <memory>
 #include <string>
+#include <utility>
+#include <vector>
 
 #include "google/api/quota.pb.h"
 #include "google/protobuf/stubs/status.h"
@@ -121,6 +123,10 @@ struct OperationInfo {
   // The client IP address.
   std::string client_ip;
 
+  // The operator defined labels, added to the operation if the label is not
+  // set by the proxy.
+  std::vector<std::pair<std::string, std::string>> custom_labels;
+
   OperationInfo() {}
 };
 
@@ -256,13 +262,30 @@ struct ReportRequestInfo : public OperationInfo {
   // The response code detail.
   std::string response_code_detail;
 
+  // Long lived streams are reported periodically. The START metrics are only
+  // sent in the first report, and the FINAL metrics and the log entries are
+  // only sent in the final report.
+  bool is_first_report;
+  bool is_final_report;
+
+  // If true, the INTERMEDIATE metrics are sent with the bytes transferred
+  // since the previous report of the stream.
+  bool is_streaming;
+  int64_t request_bytes;
+  int64_t response_bytes;
+
   ReportRequestInfo()
       : response_code(200),
         request_size(-1),
         response_size(-1),
         frontend_protocol(protocol::UNKNOWN),
         backend_protocol(protocol::UNKNOWN),
-        compute_platform("UNKNOWN(ESPv2)") {}
+        compute_platform("UNKNOWN(ESPv2)"),
+        is_first_report(true),
+        is_final_report(true),
+        is_streaming(false),
+        request_bytes(0),
+        response_bytes(0) {}
 };
 
 }  // namespace service_control
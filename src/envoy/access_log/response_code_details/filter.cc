@@ -0,0 +1,49 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/access_log/response_code_details/filter.h"
+
+#include "absl/strings/match.h"
+
+namespace espv2 {
+namespace envoy {
+namespace access_log_filters {
+namespace response_code_details {
+
+Filter::Filter(const ::espv2::api::envoy::v9::access_log::
+                   response_code_details::FilterConfig& config)
+    : prefixes_(config.prefixes().begin(), config.prefixes().end()),
+      invert_(config.invert()) {}
+
+bool Filter::evaluate(const Envoy::StreamInfo::StreamInfo& info,
+                      const Envoy::Http::RequestHeaderMap&,
+                      const Envoy::Http::ResponseHeaderMap&,
+                      const Envoy::Http::ResponseTrailerMap&) const {
+  bool matched = false;
+  const auto& details = info.responseCodeDetails();
+  if (details.has_value()) {
+    for (const auto& prefix : prefixes_) {
+      if (absl::StartsWith(details.value(), prefix)) {
+        matched = true;
+        break;
+      }
+    }
+  }
+  return matched != invert_;
+}
+
+}  // namespace response_code_details
+}  // namespace access_log_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,51 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+#include <vector>
+
+#include "api/envoy/v9/access_log/response_code_details/config.pb.h"
+#include "envoy/access_log/access_log.h"
+
+namespace espv2 {
+namespace envoy {
+namespace access_log_filters {
+namespace response_code_details {
+
+// The name of the access log filter.
+constexpr const char kFilterName[] =
+    "com.google.espv2.access_log_filters.response_code_details";
+
+// The access log filter matching the response code details by prefix.
+class Filter : public Envoy::AccessLog::Filter {
+ public:
+  Filter(const ::espv2::api::envoy::v9::access_log::response_code_details::
+             FilterConfig& config);
+
+  bool evaluate(const Envoy::StreamInfo::StreamInfo& info,
+                const Envoy::Http::RequestHeaderMap&,
+                const Envoy::Http::ResponseHeaderMap&,
+                const Envoy::Http::ResponseTrailerMap&) const override;
+
+ private:
+  const std::vector<std::string> prefixes_;
+  const bool invert_;
+};
+
+}  // namespace response_code_details
+}  // namespace access_log_filters
+}  // namespace envoy
+}  // namespace espv2
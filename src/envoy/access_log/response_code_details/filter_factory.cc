@@ -0,0 +1,64 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "api/envoy/v9/access_log/response_code_details/config.pb.h"
+#include "api/envoy/v9/access_log/response_code_details/config.pb.validate.h"
+#include "common/access_log/access_log_impl.h"
+#include "common/protobuf/message_validator_impl.h"
+#include "common/protobuf/utility.h"
+#include "envoy/registry/registry.h"
+#include "src/envoy/access_log/response_code_details/filter.h"
+
+namespace espv2 {
+namespace envoy {
+namespace access_log_filters {
+namespace response_code_details {
+
+using ::espv2::api::envoy::v9::access_log::response_code_details::
+    FilterConfig;
+
+/**
+ * Config registration for ESPv2 response code details access log filter.
+ */
+class FilterFactory : public Envoy::AccessLog::ExtensionFilterFactory {
+ public:
+  Envoy::AccessLog::FilterPtr createFilter(
+      const ::envoy::config::accesslog::v3::ExtensionFilter& config,
+      Envoy::Runtime::Loader&, Envoy::Random::RandomGenerator&) override {
+    const auto proto_config =
+        Envoy::MessageUtil::anyConvertAndValidate<FilterConfig>(
+            config.typed_config(),
+            Envoy::ProtobufMessage::getStrictValidationVisitor());
+    return std::make_unique<Filter>(proto_config);
+  }
+
+  Envoy::ProtobufTypes::MessagePtr createEmptyConfigProto() override {
+    return std::make_unique<FilterConfig>();
+  }
+
+  std::string name() const override { return kFilterName; }
+};
+
+/**
+ * Static registration for the response code details access log filter.
+ * @see RegisterFactory.
+ */
+static Envoy::Registry::RegisterFactory<
+    FilterFactory, Envoy::AccessLog::ExtensionFilterFactory>
+    register_;
+
+}  // namespace response_code_details
+}  // namespace access_log_filters
+}  // namespace envoy
+}  // namespace espv2
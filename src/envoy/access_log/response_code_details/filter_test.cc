@@ -0,0 +1,74 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/access_log/response_code_details/filter.h"
+
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/stream_info/mocks.h"
+#include "test/test_common/utility.h"
+
+using ::testing::NiceMock;
+
+namespace espv2 {
+namespace envoy {
+namespace access_log_filters {
+namespace response_code_details {
+namespace {
+
+class ResponseCodeDetailsFilterTest : public ::testing::Test {
+ protected:
+  bool evaluate(bool invert, absl::optional<std::string> details) {
+    ::espv2::api::envoy::v9::access_log::response_code_details::FilterConfig
+        config;
+    config.add_prefixes("service_control_check_error");
+    config.add_prefixes("rate_limit_");
+    config.set_invert(invert);
+    Filter filter(config);
+
+    stream_info_.response_code_details_ = details;
+    return filter.evaluate(stream_info_, request_headers_, response_headers_,
+                           response_trailers_);
+  }
+
+  NiceMock<Envoy::StreamInfo::MockStreamInfo> stream_info_;
+  Envoy::Http::TestRequestHeaderMapImpl request_headers_;
+  Envoy::Http::TestResponseHeaderMapImpl response_headers_;
+  Envoy::Http::TestResponseTrailerMapImpl response_trailers_;
+};
+
+TEST_F(ResponseCodeDetailsFilterTest, MatchPrefix) {
+  EXPECT_TRUE(
+      evaluate(false, "service_control_check_error{API_KEY_INVALID}"));
+  EXPECT_TRUE(evaluate(false, "rate_limit_too_many_requests{free}"));
+}
+
+TEST_F(ResponseCodeDetailsFilterTest, NoMatch) {
+  EXPECT_FALSE(evaluate(false, "via_upstream"));
+  EXPECT_FALSE(evaluate(false, "service_control_undefined_request"));
+  EXPECT_FALSE(evaluate(false, absl::nullopt));
+}
+
+TEST_F(ResponseCodeDetailsFilterTest, Invert) {
+  EXPECT_FALSE(
+      evaluate(true, "service_control_check_error{API_KEY_INVALID}"));
+  EXPECT_TRUE(evaluate(true, "via_upstream"));
+  EXPECT_TRUE(evaluate(true, absl::nullopt));
+}
+
+}  // namespace
+}  // namespace response_code_details
+}  // namespace access_log_filters
+}  // namespace envoy
+}  // namespace espv2
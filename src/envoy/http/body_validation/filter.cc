@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/body_validation/filter.h"
+
+#include "absl/strings/match.h"
+#include "absl/strings/str_cat.h"
+#include "absl/strings/str_join.h"
+#include "common/buffer/buffer_impl.h"
+#include "common/http/codes.h"
+#include "common/protobuf/utility.h"
+#include "src/envoy/utils/rc_detail_utils.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace body_validation {
+
+using Envoy::Http::FilterDataStatus;
+using Envoy::Http::FilterHeadersStatus;
+using Envoy::Http::FilterTrailersStatus;
+
+namespace {
+
+// The gRPC requests are not transcoded.
+constexpr absl::string_view kGrpcContentType = "application/grpc";
+
+}  // namespace
+
+FilterHeadersStatus Filter::decodeHeaders(
+    Envoy::Http::RequestHeaderMap& headers, bool end_stream) {
+  if (absl::StartsWith(headers.getContentTypeValue(), kGrpcContentType)) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  auto route = decoder_callbacks_->route();
+  if (route == nullptr || route->routeEntry() == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+  per_route_ =
+      route->routeEntry()->perFilterConfigTyped<PerRouteFilterConfig>(
+          kFilterName);
+  if (per_route_ == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  if (end_stream) {
+    return validate(Envoy::Buffer::OwnedImpl())
+               ? FilterHeadersStatus::Continue
+               : FilterHeadersStatus::StopIteration;
+  }
+  // Hold the headers until the whole body is buffered.
+  return FilterHeadersStatus::StopIteration;
+}
+
+FilterDataStatus Filter::decodeData(Envoy::Buffer::Instance& data,
+                                    bool end_stream) {
+  if (per_route_ == nullptr) {
+    return FilterDataStatus::Continue;
+  }
+  if (!end_stream) {
+    return FilterDataStatus::StopIterationAndBuffer;
+  }
+  return validate(data) ? FilterDataStatus::Continue
+                        : FilterDataStatus::StopIterationNoBuffer;
+}
+
+FilterTrailersStatus Filter::decodeTrailers(Envoy::Http::RequestTrailerMap&) {
+  if (per_route_ == nullptr) {
+    return FilterTrailersStatus::Continue;
+  }
+  return validate(Envoy::Buffer::OwnedImpl())
+             ? FilterTrailersStatus::Continue
+             : FilterTrailersStatus::StopIteration;
+}
+
+bool Filter::validate(const Envoy::Buffer::Instance& data) {
+  Envoy::Buffer::OwnedImpl body;
+  const Envoy::Buffer::Instance* buffered =
+      decoder_callbacks_->decodingBuffer();
+  if (buffered != nullptr) {
+    body.add(*buffered);
+  }
+  body.add(data);
+
+  // An empty body is an empty message.
+  Envoy::ProtobufWkt::Struct json;
+  if (body.length() > 0) {
+    try {
+      Envoy::MessageUtil::loadFromJson(body.toString(), json);
+    } catch (const Envoy::EnvoyException& e) {
+      // The transcoder rejects it with its own error.
+      ENVOY_LOG(debug, "request body is not a JSON object: {}", e.what());
+      config_->stats().not_json_.inc();
+      return true;
+    }
+  }
+
+  const std::vector<std::string> errors =
+      config_->validator().validate(json, per_route_->options());
+  if (errors.empty()) {
+    config_->stats().valid_.inc();
+    return true;
+  }
+
+  const std::string error_msg =
+      absl::StrCat("Invalid JSON request body: ", absl::StrJoin(errors, "; "));
+  ENVOY_LOG(debug, "{}", error_msg);
+  config_->stats().invalid_.inc();
+  decoder_callbacks_->sendLocalReply(
+      Envoy::Http::Code::BadRequest, error_msg, nullptr, absl::nullopt,
+      utils::generateRcDetails(utils::kRcDetailFilterBodyValidation,
+                               utils::kRcDetailErrorTypeBadRequest));
+  return false;
+}
+
+}  // namespace body_validation
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,57 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include "common/common/logger.h"
+#include "envoy/http/filter.h"
+#include "envoy/http/header_map.h"
+#include "extensions/filters/http/common/pass_through_filter.h"
+#include "src/envoy/http/body_validation/filter_config.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace body_validation {
+
+// Validates the JSON request bodies transcoded to gRPC against the types of
+// the service config, and rejects the invalid ones with a 400.
+class Filter : public Envoy::Http::PassThroughDecoderFilter,
+               public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
+ public:
+  Filter(FilterConfigSharedPtr config) : config_(config) {}
+
+  // Envoy::Http::StreamDecoderFilter
+  Envoy::Http::FilterHeadersStatus decodeHeaders(
+      Envoy::Http::RequestHeaderMap& headers, bool end_stream) override;
+  Envoy::Http::FilterDataStatus decodeData(Envoy::Buffer::Instance& data,
+                                           bool end_stream) override;
+  Envoy::Http::FilterTrailersStatus decodeTrailers(
+      Envoy::Http::RequestTrailerMap&) override;
+
+ private:
+  // Validates the buffered body plus the last data. Returns false if the
+  // request is rejected.
+  bool validate(const Envoy::Buffer::Instance& data);
+
+  const FilterConfigSharedPtr config_;
+
+  // The per-route config of the request whose body is buffered, if any.
+  const PerRouteFilterConfig* per_route_{};
+};
+
+}  // namespace body_validation
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
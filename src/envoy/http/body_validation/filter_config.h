@@ -0,0 +1,95 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "api/envoy/v9/http/body_validation/config.pb.h"
+#include "envoy/router/router.h"
+#include "envoy/stats/scope.h"
+#include "envoy/stats/stats_macros.h"
+#include "src/envoy/http/body_validation/validator.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace body_validation {
+
+// The filter name.
+constexpr const char kFilterName[] =
+    "com.google.espv2.filters.http.body_validation";
+
+/**
+ * All stats for the body validation filter. @see stats_macros.h
+ */
+#define ALL_BODY_VALIDATION_FILTER_STATS(COUNTER) \
+  COUNTER(valid)                                  \
+  COUNTER(invalid)                                \
+  COUNTER(not_json)
+
+/**
+ * Wrapper struct for body validation filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_BODY_VALIDATION_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+class FilterConfig {
+ public:
+  FilterConfig(
+      const ::espv2::api::envoy::v9::http::body_validation::FilterConfig&
+          proto_config,
+      const std::string& stats_prefix, Envoy::Stats::Scope& scope)
+      : validator_(proto_config), stats_(generateStats(stats_prefix, scope)) {}
+
+  const Validator& validator() const { return validator_; }
+  FilterStats& stats() { return stats_; }
+
+ private:
+  FilterStats generateStats(const std::string& prefix,
+                            Envoy::Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "body_validation.";
+    return {ALL_BODY_VALIDATION_FILTER_STATS(
+        POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  const Validator validator_;
+  // The stats
+  FilterStats stats_;
+};
+
+using FilterConfigSharedPtr = std::shared_ptr<FilterConfig>;
+
+class PerRouteFilterConfig : public Envoy::Router::RouteSpecificFilterConfig {
+ public:
+  PerRouteFilterConfig(const ::espv2::api::envoy::v9::http::body_validation::
+                           PerRouteFilterConfig& proto) {
+    options_.body_type = proto.body_type();
+    options_.bound_fields.insert(proto.bound_fields().begin(),
+                                 proto.bound_fields().end());
+    options_.validate_fields = proto.validate_fields();
+    options_.reject_unknown_fields = proto.reject_unknown_fields();
+  }
+
+  const ValidationOptions& options() const { return options_; }
+
+ private:
+  ValidationOptions options_;
+};
+
+}  // namespace body_validation
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,202 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/body_validation/filter.h"
+
+#include "common/buffer/buffer_impl.h"
+#include "common/common/empty_string.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/router/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/utility.h"
+
+using ::testing::_;
+using ::testing::Invoke;
+using ::testing::NiceMock;
+using ::testing::Return;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace body_validation {
+namespace {
+
+constexpr char kFilterConfig[] = R"(
+message_types:
+  library.Book:
+    fields:
+    - name: title
+      json_name: title
+      kind: STRING
+      cardinality: REQUIRED
+)";
+
+class BodyValidationFilterTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    ::espv2::api::envoy::v9::http::body_validation::FilterConfig proto;
+    Envoy::TestUtility::loadFromYaml(kFilterConfig, proto);
+    config_ = std::make_shared<FilterConfig>(proto, Envoy::EMPTY_STRING,
+                                             mock_factory_context_.scope_);
+    mock_route_ = std::make_shared<NiceMock<Envoy::Router::MockRoute>>();
+    EXPECT_CALL(mock_decoder_callbacks_, route())
+        .WillRepeatedly(Return(mock_route_));
+    filter_ = std::make_unique<Filter>(config_);
+    filter_->setDecoderFilterCallbacks(mock_decoder_callbacks_);
+  }
+
+  // Validates the fields of a library.Book body.
+  void setPerRoute() {
+    ::espv2::api::envoy::v9::http::body_validation::PerRouteFilterConfig
+        proto;
+    proto.set_body_type("library.Book");
+    proto.set_validate_fields(true);
+    per_route_ = std::make_shared<PerRouteFilterConfig>(proto);
+    EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+        .WillRepeatedly(
+            Invoke([this](const std::string&)
+                       -> const Envoy::Router::RouteSpecificFilterConfig* {
+              return per_route_.get();
+            }));
+  }
+
+  uint64_t counter(const std::string& name) {
+    return Envoy::TestUtility::findCounter(mock_factory_context_.scope_,
+                                           "body_validation." + name)
+        ->value();
+  }
+
+  FilterConfigSharedPtr config_;
+  std::shared_ptr<PerRouteFilterConfig> per_route_;
+  NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+  std::shared_ptr<NiceMock<Envoy::Router::MockRoute>> mock_route_;
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks>
+      mock_decoder_callbacks_;
+  std::unique_ptr<Filter> filter_;
+};
+
+TEST_F(BodyValidationFilterTest, NoPerRouteConfig) {
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "POST"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data("{}");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->decodeData(data, true));
+}
+
+TEST_F(BodyValidationFilterTest, GrpcRequest) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "POST"}, {"content-type", "application/grpc"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data("not json");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->decodeData(data, true));
+}
+
+TEST_F(BodyValidationFilterTest, ValidBody) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "POST"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->decodeHeaders(headers, false));
+
+  Envoy::Buffer::OwnedImpl buffered(R"({"title":)");
+  EXPECT_CALL(mock_decoder_callbacks_, decodingBuffer())
+      .WillRepeatedly(Return(&buffered));
+  Envoy::Buffer::OwnedImpl data1(R"({"title":)");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::StopIterationAndBuffer,
+            filter_->decodeData(data1, false));
+  Envoy::Buffer::OwnedImpl data2(R"("Dune"})");
+  EXPECT_CALL(mock_decoder_callbacks_, sendLocalReply(_, _, _, _, _)).Times(0);
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->decodeData(data2, true));
+  EXPECT_EQ(counter("valid"), 1);
+}
+
+TEST_F(BodyValidationFilterTest, InvalidBody) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "POST"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->decodeHeaders(headers, false));
+
+  // The unknown fields are only rejected if the per-route config says so.
+  EXPECT_CALL(mock_decoder_callbacks_,
+              sendLocalReply(Envoy::Http::Code::BadRequest,
+                             "Invalid JSON request body: title: expected a "
+                             "string",
+                             _, _, "body_validation_bad_request"));
+  Envoy::Buffer::OwnedImpl data(R"({"title": 1, "author": "Frank Herbert"})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::StopIterationNoBuffer,
+            filter_->decodeData(data, true));
+  EXPECT_EQ(counter("invalid"), 1);
+}
+
+TEST_F(BodyValidationFilterTest, MissingBody) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl headers{{":method", "POST"}};
+  EXPECT_CALL(mock_decoder_callbacks_,
+              sendLocalReply(Envoy::Http::Code::BadRequest,
+                             "Invalid JSON request body: title: required "
+                             "field is missing",
+                             _, _, "body_validation_bad_request"));
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->decodeHeaders(headers, true));
+}
+
+TEST_F(BodyValidationFilterTest, NotJson) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "POST"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->decodeHeaders(headers, false));
+
+  // It is left to the transcoder.
+  EXPECT_CALL(mock_decoder_callbacks_, sendLocalReply(_, _, _, _, _)).Times(0);
+  Envoy::Buffer::OwnedImpl data("[not json");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->decodeData(data, true));
+  EXPECT_EQ(counter("not_json"), 1);
+}
+
+TEST_F(BodyValidationFilterTest, Trailers) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "POST"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->decodeHeaders(headers, false));
+
+  Envoy::Buffer::OwnedImpl buffered(R"({"title": "Dune"})");
+  EXPECT_CALL(mock_decoder_callbacks_, decodingBuffer())
+      .WillRepeatedly(Return(&buffered));
+  Envoy::Buffer::OwnedImpl data(R"({"title": "Dune"})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::StopIterationAndBuffer,
+            filter_->decodeData(data, false));
+  Envoy::Http::TestRequestTrailerMapImpl trailers;
+  EXPECT_EQ(Envoy::Http::FilterTrailersStatus::Continue,
+            filter_->decodeTrailers(trailers));
+  EXPECT_EQ(counter("valid"), 1);
+}
+
+}  // namespace
+}  // namespace body_validation
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,322 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/body_validation/validator.h"
+
+#include <cmath>
+#include <limits>
+
+#include "absl/strings/numbers.h"
+#include "absl/strings/str_cat.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace body_validation {
+
+namespace {
+
+using ::espv2::api::envoy::v9::http::body_validation::Field;
+using Envoy::ProtobufWkt::Value;
+
+std::string joinPath(const std::string& path, const std::string& name) {
+  return path.empty() ? name : absl::StrCat(path, ".", name);
+}
+
+void addError(std::vector<std::string>& errors, const std::string& path,
+              absl::string_view error) {
+  if (errors.size() < Validator::kMaxErrors) {
+    errors.push_back(absl::StrCat(path, ": ", error));
+  }
+}
+
+// Returns true if the number is an integer in [min, max].
+bool isIntegerInRange(double number, double min, double max) {
+  return std::isfinite(number) && std::floor(number) == number &&
+         number >= min && number <= max;
+}
+
+// Returns true if the string is an integer of the kind.
+bool isIntegerString(const std::string& value, Field::Kind kind) {
+  switch (kind) {
+    case Field::INT32: {
+      int32_t i;
+      return absl::SimpleAtoi(value, &i);
+    }
+    case Field::UINT32: {
+      uint32_t i;
+      return absl::SimpleAtoi(value, &i);
+    }
+    case Field::INT64: {
+      int64_t i;
+      return absl::SimpleAtoi(value, &i);
+    }
+    default: {
+      uint64_t i;
+      return absl::SimpleAtoi(value, &i);
+    }
+  }
+}
+
+// Returns true if the number is in the range of the integer kind. The 64-bit
+// bounds are the closest doubles.
+bool isIntegerNumber(double number, Field::Kind kind) {
+  switch (kind) {
+    case Field::INT32:
+      return isIntegerInRange(number, std::numeric_limits<int32_t>::min(),
+                              std::numeric_limits<int32_t>::max());
+    case Field::UINT32:
+      return isIntegerInRange(number, 0, std::numeric_limits<uint32_t>::max());
+    case Field::INT64:
+      return isIntegerInRange(number, std::numeric_limits<int64_t>::min(),
+                              std::numeric_limits<int64_t>::max());
+    default:
+      return isIntegerInRange(number, 0, std::numeric_limits<uint64_t>::max());
+  }
+}
+
+absl::string_view integerKindName(Field::Kind kind) {
+  switch (kind) {
+    case Field::INT32:
+      return "int32";
+    case Field::UINT32:
+      return "uint32";
+    case Field::INT64:
+      return "int64";
+    default:
+      return "uint64";
+  }
+}
+
+}  // namespace
+
+Validator::Validator(
+    const ::espv2::api::envoy::v9::http::body_validation::FilterConfig&
+        proto_config)
+    : proto_config_(proto_config) {
+  for (const auto& message : proto_config_.message_types()) {
+    MessageIndex& index = messages_[message.first];
+    for (const Field& field : message.second.fields()) {
+      index.fields[field.name()] = &field;
+      if (!field.json_name().empty()) {
+        index.fields[field.json_name()] = &field;
+      }
+      if (field.cardinality() == Field::REQUIRED) {
+        index.required_fields.push_back(&field);
+      }
+    }
+  }
+  for (const auto& enum_type : proto_config_.enum_types()) {
+    enums_[enum_type.first].insert(enum_type.second.values().begin(),
+                                   enum_type.second.values().end());
+  }
+}
+
+std::vector<std::string> Validator::validate(
+    const Envoy::ProtobufWkt::Struct& body,
+    const ValidationOptions& options) const {
+  std::vector<std::string> errors;
+  validateMessage(body, options.body_type, "", options, errors);
+  return errors;
+}
+
+void Validator::validateMessage(const Envoy::ProtobufWkt::Struct& object,
+                                const std::string& type_name,
+                                const std::string& path,
+                                const ValidationOptions& options,
+                                std::vector<std::string>& errors) const {
+  const auto message_it = messages_.find(type_name);
+  if (message_it == messages_.end()) {
+    return;
+  }
+  const MessageIndex& message = message_it->second;
+
+  for (const auto& member : object.fields()) {
+    const std::string member_path = joinPath(path, member.first);
+    const auto field_it = message.fields.find(member.first);
+    if (field_it == message.fields.end()) {
+      if (options.reject_unknown_fields) {
+        addError(errors, member_path, "unknown field");
+      }
+      continue;
+    }
+    validateField(member.second, *field_it->second, member_path, options,
+                  errors);
+  }
+
+  if (!options.validate_fields) {
+    return;
+  }
+  for (const Field* field : message.required_fields) {
+    // The fields bound by the path are set by the transcoder.
+    if (options.bound_fields.contains(joinPath(path, field->name())) ||
+        options.bound_fields.contains(joinPath(path, field->json_name()))) {
+      continue;
+    }
+    bool found = false;
+    for (const std::string& name : {field->name(), field->json_name()}) {
+      const auto it = object.fields().find(name);
+      found = found || (it != object.fields().end() &&
+                        it->second.kind_case() != Value::kNullValue);
+    }
+    if (!found) {
+      addError(errors,
+               joinPath(path, field->json_name().empty() ? field->name()
+                                                         : field->json_name()),
+               "required field is missing");
+    }
+  }
+}
+
+void Validator::validateField(const Value& value, const Field& field,
+                              const std::string& path,
+                              const ValidationOptions& options,
+                              std::vector<std::string>& errors) const {
+  // A null field keeps its default value.
+  if (value.kind_case() == Value::kNullValue) {
+    return;
+  }
+
+  switch (field.cardinality()) {
+    case Field::REPEATED:
+      if (value.kind_case() != Value::kListValue) {
+        if (options.validate_fields) {
+          addError(errors, path, "expected an array");
+        }
+        return;
+      }
+      for (int i = 0; i < value.list_value().values_size(); ++i) {
+        validateValue(value.list_value().values(i), field,
+                      absl::StrCat(path, "[", i, "]"), options, errors);
+      }
+      return;
+    case Field::MAP:
+      if (value.kind_case() != Value::kStructValue) {
+        if (options.validate_fields) {
+          addError(errors, path, "expected an object");
+        }
+        return;
+      }
+      for (const auto& entry : value.struct_value().fields()) {
+        validateValue(entry.second, field, joinPath(path, entry.first),
+                      options, errors);
+      }
+      return;
+    default:
+      validateValue(value, field, path, options, errors);
+      return;
+  }
+}
+
+void Validator::validateValue(const Value& value, const Field& field,
+                              const std::string& path,
+                              const ValidationOptions& options,
+                              std::vector<std::string>& errors) const {
+  if (value.kind_case() == Value::kNullValue) {
+    return;
+  }
+
+  if (field.kind() == Field::MESSAGE) {
+    // The message types not in the config, e.g. the well-known types, have
+    // their own JSON mapping.
+    if (!messages_.contains(field.type_name())) {
+      return;
+    }
+    if (value.kind_case() != Value::kStructValue) {
+      if (options.validate_fields) {
+        addError(errors, path, "expected an object");
+      }
+      return;
+    }
+    validateMessage(value.struct_value(), field.type_name(), path, options,
+                    errors);
+    return;
+  }
+
+  if (!options.validate_fields) {
+    return;
+  }
+  const std::string error = checkScalar(value, field);
+  if (!error.empty()) {
+    addError(errors, path, error);
+  }
+}
+
+std::string Validator::checkScalar(const Value& value,
+                                   const Field& field) const {
+  switch (field.kind()) {
+    case Field::STRING:
+      if (value.kind_case() != Value::kStringValue) {
+        return "expected a string";
+      }
+      return "";
+    case Field::BOOL:
+      if (value.kind_case() == Value::kBoolValue ||
+          (value.kind_case() == Value::kStringValue &&
+           (value.string_value() == "true" ||
+            value.string_value() == "false"))) {
+        return "";
+      }
+      return "expected a boolean";
+    case Field::INT32:
+    case Field::UINT32:
+    case Field::INT64:
+    case Field::UINT64:
+      if ((value.kind_case() == Value::kNumberValue &&
+           isIntegerNumber(value.number_value(), field.kind())) ||
+          (value.kind_case() == Value::kStringValue &&
+           isIntegerString(value.string_value(), field.kind()))) {
+        return "";
+      }
+      return absl::StrCat("expected an integer in the ",
+                          integerKindName(field.kind()), " range");
+    case Field::DOUBLE: {
+      if (value.kind_case() == Value::kNumberValue) {
+        return "";
+      }
+      double number;
+      if (value.kind_case() == Value::kStringValue &&
+          (value.string_value() == "NaN" ||
+           value.string_value() == "Infinity" ||
+           value.string_value() == "-Infinity" ||
+           absl::SimpleAtod(value.string_value(), &number))) {
+        return "";
+      }
+      return "expected a number";
+    }
+    case Field::ENUM: {
+      if (value.kind_case() == Value::kNumberValue &&
+          isIntegerNumber(value.number_value(), Field::INT32)) {
+        return "";
+      }
+      if (value.kind_case() != Value::kStringValue) {
+        return "expected an enum value";
+      }
+      const auto enum_it = enums_.find(field.type_name());
+      if (enum_it != enums_.end() &&
+          !enum_it->second.contains(value.string_value())) {
+        return absl::StrCat("invalid enum value \"", value.string_value(),
+                            "\"");
+      }
+      return "";
+    }
+    default:
+      return "";
+  }
+}
+
+}  // namespace body_validation
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+#include <vector>
+
+#include "absl/container/flat_hash_map.h"
+#include "absl/container/flat_hash_set.h"
+#include "api/envoy/v9/http/body_validation/config.pb.h"
+#include "common/protobuf/protobuf.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace body_validation {
+
+// What is validated in a JSON body.
+struct ValidationOptions {
+  // The message type of the body.
+  std::string body_type;
+  // The paths of the fields of the body type which are not required in the
+  // body, e.g. "book.name".
+  absl::flat_hash_set<std::string> bound_fields;
+  bool validate_fields{};
+  bool reject_unknown_fields{};
+};
+
+// Validates the JSON bodies against the message types of the filter config.
+class Validator {
+ public:
+  Validator(const ::espv2::api::envoy::v9::http::body_validation::FilterConfig&
+                proto_config);
+
+  // The fields are indexed by their message, so the validator is not copied.
+  Validator(const Validator&) = delete;
+  Validator& operator=(const Validator&) = delete;
+
+  // Returns the errors of the JSON body, as "field.path: error", empty if the
+  // body is valid. At most kMaxErrors are returned.
+  std::vector<std::string> validate(const Envoy::ProtobufWkt::Struct& body,
+                                    const ValidationOptions& options) const;
+
+  static constexpr size_t kMaxErrors = 10;
+
+ private:
+  using FieldProto = ::espv2::api::envoy::v9::http::body_validation::Field;
+
+  // The fields of a message type by their name and their JSON name, and its
+  // required fields.
+  struct MessageIndex {
+    absl::flat_hash_map<std::string, const FieldProto*> fields;
+    std::vector<const FieldProto*> required_fields;
+  };
+
+  void validateMessage(const Envoy::ProtobufWkt::Struct& object,
+                       const std::string& type_name, const std::string& path,
+                       const ValidationOptions& options,
+                       std::vector<std::string>& errors) const;
+  void validateField(const Envoy::ProtobufWkt::Value& value,
+                     const FieldProto& field, const std::string& path,
+                     const ValidationOptions& options,
+                     std::vector<std::string>& errors) const;
+  void validateValue(const Envoy::ProtobufWkt::Value& value,
+                     const FieldProto& field, const std::string& path,
+                     const ValidationOptions& options,
+                     std::vector<std::string>& errors) const;
+  // Returns the error of the scalar value of the field, empty if it is valid.
+  std::string checkScalar(const Envoy::ProtobufWkt::Value& value,
+                          const FieldProto& field) const;
+
+  const ::espv2::api::envoy::v9::http::body_validation::FilterConfig
+      proto_config_;
+  absl::flat_hash_map<std::string, MessageIndex> messages_;
+  absl::flat_hash_map<std::string, absl::flat_hash_set<std::string>> enums_;
+};
+
+}  // namespace body_validation
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
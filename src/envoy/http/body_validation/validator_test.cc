@@ -0,0 +1,233 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/body_validation/validator.h"
+
+#include "absl/strings/str_cat.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/test_common/utility.h"
+
+using ::testing::ElementsAre;
+using ::testing::IsEmpty;
+using ::testing::UnorderedElementsAre;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace body_validation {
+namespace {
+
+constexpr char kFilterConfig[] = R"(
+message_types:
+  library.CreateBookRequest:
+    fields:
+    - name: shelf
+      json_name: shelf
+      kind: INT64
+    - name: book
+      json_name: book
+      kind: MESSAGE
+      type_name: library.Book
+  library.Book:
+    fields:
+    - name: title
+      json_name: title
+      kind: STRING
+      cardinality: REQUIRED
+    - name: page_count
+      json_name: pageCount
+      kind: INT32
+    - name: kind
+      json_name: kind
+      kind: ENUM
+      type_name: library.Kind
+    - name: available
+      json_name: available
+      kind: BOOL
+    - name: price
+      json_name: price
+      kind: DOUBLE
+    - name: authors
+      json_name: authors
+      kind: MESSAGE
+      type_name: library.Author
+      cardinality: REPEATED
+    - name: labels
+      json_name: labels
+      kind: STRING
+      cardinality: MAP
+    - name: published
+      json_name: published
+      kind: MESSAGE
+      type_name: google.protobuf.Timestamp
+  library.Author:
+    fields:
+    - name: name
+      json_name: name
+      kind: STRING
+enum_types:
+  library.Kind:
+    values: ["KIND_UNSPECIFIED", "FICTION", "NONFICTION"]
+)";
+
+class ValidatorTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    ::espv2::api::envoy::v9::http::body_validation::FilterConfig proto;
+    Envoy::TestUtility::loadFromYaml(kFilterConfig, proto);
+    validator_ = std::make_unique<Validator>(proto);
+  }
+
+  std::vector<std::string> validate(const std::string& body,
+                                    const ValidationOptions& options) {
+    Envoy::ProtobufWkt::Struct json;
+    Envoy::MessageUtil::loadFromJson(body, json);
+    return validator_->validate(json, options);
+  }
+
+  // Validates the fields of a library.Book body.
+  ValidationOptions bookOptions() {
+    ValidationOptions options;
+    options.body_type = "library.Book";
+    options.validate_fields = true;
+    return options;
+  }
+
+  std::unique_ptr<Validator> validator_;
+};
+
+TEST_F(ValidatorTest, ValidBody) {
+  EXPECT_THAT(validate(R"({
+    "title": "Dune",
+    "page_count": "412",
+    "kind": "FICTION",
+    "available": "true",
+    "price": "NaN",
+    "authors": [{"name": "Frank Herbert"}, null],
+    "labels": {"genre": "sci-fi"},
+    "published": "1965-08-01T00:00:00Z"
+  })",
+                       bookOptions()),
+              IsEmpty());
+}
+
+TEST_F(ValidatorTest, InvalidValues) {
+  EXPECT_THAT(validate(R"({
+    "title": 1,
+    "pageCount": 1.5,
+    "kind": "POETRY",
+    "available": "yes",
+    "price": "cheap",
+    "authors": {"name": "Frank Herbert"},
+    "labels": {"genre": 1}
+  })",
+                       bookOptions()),
+              UnorderedElementsAre(
+                  "title: expected a string",
+                  "pageCount: expected an integer in the int32 range",
+                  "kind: invalid enum value \"POETRY\"",
+                  "available: expected a boolean", "price: expected a number",
+                  "authors: expected an array",
+                  "labels.genre: expected a string"));
+}
+
+TEST_F(ValidatorTest, IntegerRanges) {
+  EXPECT_THAT(validate(R"({"title": "Dune", "pageCount": 2147483648})",
+                       bookOptions()),
+              ElementsAre("pageCount: expected an integer in the int32 range"));
+  EXPECT_THAT(validate(R"({"title": "Dune", "pageCount": "-2147483648"})",
+                       bookOptions()),
+              IsEmpty());
+
+  ValidationOptions options;
+  options.body_type = "library.CreateBookRequest";
+  options.validate_fields = true;
+  EXPECT_THAT(validate(R"({"shelf": "9223372036854775807"})", options),
+              IsEmpty());
+  EXPECT_THAT(validate(R"({"shelf": "9223372036854775808"})", options),
+              ElementsAre("shelf: expected an integer in the int64 range"));
+}
+
+TEST_F(ValidatorTest, RequiredFields) {
+  EXPECT_THAT(validate(R"({"pageCount": 412})", bookOptions()),
+              ElementsAre("title: required field is missing"));
+  EXPECT_THAT(validate(R"({"title": null})", bookOptions()),
+              ElementsAre("title: required field is missing"));
+
+  ValidationOptions options;
+  options.body_type = "library.CreateBookRequest";
+  options.validate_fields = true;
+  EXPECT_THAT(validate(R"({"book": {}})", options),
+              ElementsAre("book.title: required field is missing"));
+}
+
+TEST_F(ValidatorTest, BoundFieldsNotRequired) {
+  ValidationOptions options = bookOptions();
+  options.bound_fields.insert("title");
+  EXPECT_THAT(validate(R"({})", options), IsEmpty());
+
+  options.body_type = "library.CreateBookRequest";
+  options.bound_fields = {"book.title"};
+  EXPECT_THAT(validate(R"({"book": {}})", options), IsEmpty());
+}
+
+TEST_F(ValidatorTest, UnknownFields) {
+  ValidationOptions options;
+  options.body_type = "library.CreateBookRequest";
+  options.reject_unknown_fields = true;
+  EXPECT_THAT(
+      validate(R"({
+        "shelf": "not validated",
+        "shelve": 1,
+        "book": {"titel": "Dune", "authors": [{"nam": "Frank Herbert"}]}
+      })",
+               options),
+      UnorderedElementsAre("shelve: unknown field", "book.titel: unknown field",
+                           "book.authors[0].nam: unknown field"));
+}
+
+TEST_F(ValidatorTest, UnknownFieldsAllowed) {
+  EXPECT_THAT(validate(R"({"title": "Dune", "titel": "Dune"})", bookOptions()),
+              IsEmpty());
+}
+
+TEST_F(ValidatorTest, TypesNotInConfig) {
+  // The well-known types are not in the config, they accept any value.
+  ValidationOptions options = bookOptions();
+  options.reject_unknown_fields = true;
+  EXPECT_THAT(validate(R"({"title": "Dune", "published": {"seconds": 1}})",
+                       options),
+              IsEmpty());
+
+  options.body_type = "library.Unknown";
+  EXPECT_THAT(validate(R"({"any": "field"})", options), IsEmpty());
+}
+
+TEST_F(ValidatorTest, MaxErrors) {
+  ValidationOptions options = bookOptions();
+  options.reject_unknown_fields = true;
+  std::string body = R"({"title": "Dune")";
+  for (int i = 0; i < 20; ++i) {
+    absl::StrAppend(&body, ", \"unknown", i, "\": 1");
+  }
+  absl::StrAppend(&body, "}");
+  EXPECT_EQ(validate(body, options).size(), Validator::kMaxErrors);
+}
+
+}  // namespace
+}  // namespace body_validation
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
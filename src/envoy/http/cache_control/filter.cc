@@ -0,0 +1,101 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/cache_control/filter.h"
+
+#include <vector>
+
+#include "absl/strings/ascii.h"
+#include "absl/strings/match.h"
+#include "absl/strings/str_join.h"
+#include "absl/strings/str_split.h"
+#include "src/envoy/utils/http_header_utils.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace cache_control {
+
+using Envoy::Http::FilterHeadersStatus;
+
+namespace {
+
+const Envoy::Http::LowerCaseString kCacheControlHeader{"cache-control"};
+const Envoy::Http::LowerCaseString kVaryHeader{"vary"};
+
+}  // namespace
+
+std::string mergeVary(absl::string_view vary,
+                      const std::vector<std::string>& headers) {
+  std::vector<std::string> merged;
+  for (absl::string_view header : absl::StrSplit(vary, ',')) {
+    header = absl::StripAsciiWhitespace(header);
+    if (header == "*") {
+      return std::string(vary);
+    }
+    if (!header.empty()) {
+      merged.emplace_back(header);
+    }
+  }
+  for (const std::string& header : headers) {
+    bool found = false;
+    for (const std::string& existing : merged) {
+      if (absl::EqualsIgnoreCase(existing, header)) {
+        found = true;
+        break;
+      }
+    }
+    if (!found) {
+      merged.push_back(header);
+    }
+  }
+  return absl::StrJoin(merged, ", ");
+}
+
+FilterHeadersStatus Filter::encodeHeaders(
+    Envoy::Http::ResponseHeaderMap& headers, bool) {
+  auto route = encoder_callbacks_->route();
+  if (route == nullptr || route->routeEntry() == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+  const auto* per_route =
+      route->routeEntry()->perFilterConfigTyped<PerRouteFilterConfig>(
+          kFilterName);
+  if (per_route == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  // The caching policy of the backend, e.g. private or no-store, is kept.
+  if (utils::extractHeader(headers, kCacheControlHeader).empty()) {
+    config_->stats().cache_control_added_.inc();
+    headers.setCopy(kCacheControlHeader, per_route->cacheControl());
+  } else {
+    config_->stats().cache_control_kept_.inc();
+  }
+
+  // The responses differing by the request headers of the cache key, e.g.
+  // the API keys, must vary on them, whoever set their Cache-Control.
+  if (!per_route->varyHeaders().empty()) {
+    const std::string vary =
+        mergeVary(utils::extractHeader(headers, kVaryHeader),
+                  per_route->varyHeaders());
+    headers.setCopy(kVaryHeader, vary);
+  }
+  return FilterHeadersStatus::Continue;
+}
+
+}  // namespace cache_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,56 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+#include <vector>
+
+#include "absl/strings/string_view.h"
+#include "common/common/logger.h"
+#include "envoy/http/filter.h"
+#include "envoy/http/header_map.h"
+#include "extensions/filters/http/common/pass_through_filter.h"
+#include "src/envoy/http/cache_control/filter_config.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace cache_control {
+
+// Adds the default Cache-Control header of the route to the responses
+// without one, and merges the request headers of the cache key into their
+// Vary header, before the Envoy cache filter checks their cacheability.
+class Filter : public Envoy::Http::PassThroughEncoderFilter,
+               public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
+ public:
+  Filter(FilterConfigSharedPtr config) : config_(config) {}
+
+  // Envoy::Http::StreamEncoderFilter
+  Envoy::Http::FilterHeadersStatus encodeHeaders(
+      Envoy::Http::ResponseHeaderMap& headers, bool end_stream) override;
+
+ private:
+  const FilterConfigSharedPtr config_;
+};
+
+// Returns the Vary header with the headers appended, unless it already has
+// them or is "*".
+std::string mergeVary(absl::string_view vary,
+                      const std::vector<std::string>& headers);
+
+}  // namespace cache_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
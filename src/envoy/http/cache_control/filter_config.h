@@ -0,0 +1,91 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+#include <vector>
+
+#include "api/envoy/v9/http/cache_control/config.pb.h"
+#include "envoy/router/router.h"
+#include "envoy/stats/scope.h"
+#include "envoy/stats/stats_macros.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace cache_control {
+
+// The filter name.
+constexpr const char kFilterName[] =
+    "com.google.espv2.filters.http.cache_control";
+
+/**
+ * All stats for the cache control filter. @see stats_macros.h
+ */
+#define ALL_CACHE_CONTROL_FILTER_STATS(COUNTER) \
+  COUNTER(cache_control_added)                  \
+  COUNTER(cache_control_kept)
+
+/**
+ * Wrapper struct for cache control filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_CACHE_CONTROL_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+class FilterConfig {
+ public:
+  FilterConfig(const std::string& stats_prefix, Envoy::Stats::Scope& scope)
+      : stats_(generateStats(stats_prefix, scope)) {}
+
+  FilterStats& stats() { return stats_; }
+
+ private:
+  FilterStats generateStats(const std::string& prefix,
+                            Envoy::Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "cache_control.";
+    return {ALL_CACHE_CONTROL_FILTER_STATS(
+        POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  // The stats
+  FilterStats stats_;
+};
+
+using FilterConfigSharedPtr = std::shared_ptr<FilterConfig>;
+
+class PerRouteFilterConfig : public Envoy::Router::RouteSpecificFilterConfig {
+ public:
+  PerRouteFilterConfig(const ::espv2::api::envoy::v9::http::cache_control::
+                           PerRouteFilterConfig& proto)
+      : cache_control_("max-age=" + std::to_string(proto.max_age())),
+        vary_headers_(proto.vary_headers().begin(),
+                      proto.vary_headers().end()) {}
+
+  // The Cache-Control header of the responses without one.
+  const std::string& cacheControl() const { return cache_control_; }
+
+  // The request headers merged into the Vary header.
+  const std::vector<std::string>& varyHeaders() const { return vary_headers_; }
+
+ private:
+  const std::string cache_control_;
+  const std::vector<std::string> vary_headers_;
+};
+
+}  // namespace cache_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,132 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/cache_control/filter.h"
+
+#include "common/common/empty_string.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/router/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/utility.h"
+
+using ::testing::NiceMock;
+using ::testing::Return;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace cache_control {
+namespace {
+
+class CacheControlFilterTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    mock_route_ = std::make_shared<NiceMock<Envoy::Router::MockRoute>>();
+    EXPECT_CALL(mock_encoder_callbacks_, route())
+        .WillRepeatedly(Return(mock_route_));
+    config_ = std::make_shared<FilterConfig>(Envoy::EMPTY_STRING,
+                                             mock_factory_context_.scope_);
+    filter_ = std::make_unique<Filter>(config_);
+    filter_->setEncoderFilterCallbacks(mock_encoder_callbacks_);
+  }
+
+  void setPerRoute(uint32_t max_age, std::vector<std::string> vary_headers) {
+    ::espv2::api::envoy::v9::http::cache_control::PerRouteFilterConfig proto;
+    proto.set_max_age(max_age);
+    for (const std::string& header : vary_headers) {
+      proto.add_vary_headers(header);
+    }
+    per_route_ = std::make_shared<PerRouteFilterConfig>(proto);
+    EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+        .WillRepeatedly(Return(per_route_.get()));
+  }
+
+  uint64_t counter(const std::string& name) {
+    return Envoy::TestUtility::findCounter(mock_factory_context_.scope_,
+                                           "cache_control." + name)
+        ->value();
+  }
+
+  FilterConfigSharedPtr config_;
+  std::shared_ptr<PerRouteFilterConfig> per_route_;
+  NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+  std::shared_ptr<NiceMock<Envoy::Router::MockRoute>> mock_route_;
+  NiceMock<Envoy::Http::MockStreamEncoderFilterCallbacks>
+      mock_encoder_callbacks_;
+  std::unique_ptr<Filter> filter_;
+};
+
+TEST_F(CacheControlFilterTest, NoPerRouteConfig) {
+  Envoy::Http::TestResponseHeaderMapImpl headers{{":status", "200"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, true));
+
+  EXPECT_FALSE(headers.has("cache-control"));
+  EXPECT_FALSE(headers.has("vary"));
+  EXPECT_EQ(counter("cache_control_added"), 0);
+}
+
+TEST_F(CacheControlFilterTest, AddCacheControl) {
+  setPerRoute(60, {"x-api-key"});
+  Envoy::Http::TestResponseHeaderMapImpl headers{{":status", "200"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+
+  EXPECT_EQ(headers.get_("cache-control"), "max-age=60");
+  EXPECT_EQ(headers.get_("vary"), "x-api-key");
+  EXPECT_EQ(counter("cache_control_added"), 1);
+}
+
+TEST_F(CacheControlFilterTest, KeepBackendCacheControl) {
+  setPerRoute(60, {"x-api-key"});
+  for (const std::string cache_control :
+       {"private, max-age=10", "no-store", "public, max-age=5"}) {
+    Envoy::Http::TestResponseHeaderMapImpl headers{
+        {":status", "200"}, {"cache-control", cache_control}};
+    EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+              filter_->encodeHeaders(headers, false));
+
+    EXPECT_EQ(headers.get_("cache-control"), cache_control);
+    EXPECT_EQ(headers.get_("vary"), "x-api-key");
+  }
+  EXPECT_EQ(counter("cache_control_added"), 0);
+  EXPECT_EQ(counter("cache_control_kept"), 3);
+}
+
+TEST_F(CacheControlFilterTest, MergeBackendVary) {
+  setPerRoute(60, {"Accept-Language", "x-api-key"});
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "200"}, {"vary", "Accept-Encoding, accept-language"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+
+  EXPECT_EQ(headers.get_("vary"),
+            "Accept-Encoding, accept-language, x-api-key");
+}
+
+TEST(MergeVaryTest, MergeVary) {
+  EXPECT_EQ(mergeVary("", {"x-api-key"}), "x-api-key");
+  EXPECT_EQ(mergeVary("X-Api-Key", {"x-api-key"}), "X-Api-Key");
+  EXPECT_EQ(mergeVary(" a ,, b ", {"c"}), "a, b, c");
+  EXPECT_EQ(mergeVary("*", {"x-api-key"}), "*");
+}
+
+}  // namespace
+}  // namespace cache_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,53 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/concurrency_limit/concurrency_counters.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace concurrency_limit {
+
+bool ConcurrencyCounters::tryAcquire(absl::string_view operation,
+                                     uint32_t max_requests) {
+  absl::MutexLock lock(&mutex_);
+  uint32_t& in_flight = in_flight_[operation];
+  if (in_flight >= max_requests) {
+    return false;
+  }
+  ++in_flight;
+  return true;
+}
+
+void ConcurrencyCounters::release(absl::string_view operation) {
+  absl::MutexLock lock(&mutex_);
+  auto it = in_flight_.find(operation);
+  if (it == in_flight_.end()) {
+    return;
+  }
+  if (--it->second == 0) {
+    in_flight_.erase(it);
+  }
+}
+
+uint32_t ConcurrencyCounters::inFlight(absl::string_view operation) {
+  absl::MutexLock lock(&mutex_);
+  auto it = in_flight_.find(operation);
+  return it == in_flight_.end() ? 0 : it->second;
+}
+
+}  // namespace concurrency_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
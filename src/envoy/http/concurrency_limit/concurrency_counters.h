@@ -0,0 +1,59 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <memory>
+#include <string>
+
+#include "absl/base/thread_annotations.h"
+#include "absl/container/flat_hash_map.h"
+#include "absl/strings/string_view.h"
+#include "absl/synchronization/mutex.h"
+#include "envoy/singleton/instance.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace concurrency_limit {
+
+// Counts the requests in flight of each operation, shared by all the worker
+// threads.
+//
+// It is a singleton shared by the filter configs, so the requests in flight
+// through the config of a drained listener are counted with the new ones.
+class ConcurrencyCounters : public Envoy::Singleton::Instance {
+ public:
+  // Counts a request of the operation, unless it already has max_requests in
+  // flight. Returns whether the request is counted.
+  bool tryAcquire(absl::string_view operation, uint32_t max_requests);
+
+  // Stops counting a counted request of the operation.
+  void release(absl::string_view operation);
+
+  // Returns the requests in flight of the operation.
+  uint32_t inFlight(absl::string_view operation);
+
+ private:
+  absl::Mutex mutex_;
+  absl::flat_hash_map<std::string, uint32_t> in_flight_
+      ABSL_GUARDED_BY(mutex_);
+};
+
+using ConcurrencyCountersSharedPtr = std::shared_ptr<ConcurrencyCounters>;
+
+}  // namespace concurrency_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,56 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/concurrency_limit/concurrency_counters.h"
+
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace concurrency_limit {
+namespace {
+
+TEST(ConcurrencyCountersTest, LimitedByOperation) {
+  ConcurrencyCounters counters;
+  EXPECT_TRUE(counters.tryAcquire("op1", 2));
+  EXPECT_TRUE(counters.tryAcquire("op1", 2));
+  EXPECT_FALSE(counters.tryAcquire("op1", 2));
+  EXPECT_EQ(counters.inFlight("op1"), 2);
+
+  // The other operations have their own counts.
+  EXPECT_TRUE(counters.tryAcquire("op2", 2));
+  EXPECT_EQ(counters.inFlight("op2"), 1);
+}
+
+TEST(ConcurrencyCountersTest, Released) {
+  ConcurrencyCounters counters;
+  EXPECT_TRUE(counters.tryAcquire("op", 1));
+  EXPECT_FALSE(counters.tryAcquire("op", 1));
+
+  counters.release("op");
+  EXPECT_EQ(counters.inFlight("op"), 0);
+  EXPECT_TRUE(counters.tryAcquire("op", 1));
+
+  // Releasing an operation without requests is ignored.
+  counters.release("unknown");
+  EXPECT_EQ(counters.inFlight("unknown"), 0);
+}
+
+}  // namespace
+}  // namespace concurrency_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
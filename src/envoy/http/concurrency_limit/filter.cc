@@ -0,0 +1,72 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/concurrency_limit/filter.h"
+
+#include "absl/strings/str_cat.h"
+#include "common/http/codes.h"
+#include "src/envoy/utils/rc_detail_utils.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace concurrency_limit {
+
+using Envoy::Http::FilterHeadersStatus;
+
+FilterHeadersStatus Filter::decodeHeaders(Envoy::Http::RequestHeaderMap&,
+                                          bool) {
+  auto route = decoder_callbacks_->route();
+  if (route == nullptr || route->routeEntry() == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+  const auto* per_route =
+      route->routeEntry()->perFilterConfigTyped<PerRouteFilterConfig>(
+          kFilterName);
+  if (per_route == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  if (config_->counters().tryAcquire(per_route->operation_name(),
+                                     per_route->max_concurrent_requests())) {
+    config_->stats().allowed_.inc();
+    operation_ = std::string(per_route->operation_name());
+    return FilterHeadersStatus::Continue;
+  }
+
+  config_->stats().denied_.inc();
+  const std::string error_msg =
+      absl::StrCat("Too many concurrent requests for the operation `",
+                   per_route->operation_name(), "`.");
+  ENVOY_LOG(debug, "{}", error_msg);
+  decoder_callbacks_->sendLocalReply(
+      Envoy::Http::Code::ServiceUnavailable, error_msg, nullptr,
+      absl::nullopt,
+      utils::generateRcDetails(
+          utils::kRcDetailFilterConcurrencyLimit,
+          utils::kRcDetailErrorTypeTooManyConcurrentRequests));
+  return FilterHeadersStatus::StopIteration;
+}
+
+void Filter::onDestroy() {
+  if (!operation_.empty()) {
+    config_->counters().release(operation_);
+    operation_.clear();
+  }
+}
+
+}  // namespace concurrency_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
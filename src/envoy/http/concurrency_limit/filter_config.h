@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "api/envoy/v9/http/concurrency_limit/config.pb.h"
+#include "envoy/router/router.h"
+#include "envoy/stats/scope.h"
+#include "envoy/stats/stats_macros.h"
+#include "src/envoy/http/concurrency_limit/concurrency_counters.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace concurrency_limit {
+
+// The filter name.
+constexpr const char kFilterName[] =
+    "com.google.espv2.filters.http.concurrency_limit";
+
+/**
+ * All stats for the concurrency limit filter. @see stats_macros.h
+ */
+#define ALL_CONCURRENCY_LIMIT_FILTER_STATS(COUNTER) \
+  COUNTER(allowed)                                  \
+  COUNTER(denied)
+
+/**
+ * Wrapper struct for concurrency limit filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_CONCURRENCY_LIMIT_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+class FilterConfig {
+ public:
+  // The counters are the singleton of the filter configs.
+  FilterConfig(ConcurrencyCountersSharedPtr counters,
+               const std::string& stats_prefix, Envoy::Stats::Scope& scope)
+      : counters_(std::move(counters)),
+        stats_(generateStats(stats_prefix, scope)) {}
+
+  ConcurrencyCounters& counters() { return *counters_; }
+  FilterStats& stats() { return stats_; }
+
+ private:
+  FilterStats generateStats(const std::string& prefix,
+                            Envoy::Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "concurrency_limit.";
+    return {ALL_CONCURRENCY_LIMIT_FILTER_STATS(
+        POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  // The counters shared by the filters of all the worker threads and the
+  // filter configs.
+  ConcurrencyCountersSharedPtr counters_;
+  // The stats
+  FilterStats stats_;
+};
+
+using FilterConfigSharedPtr = std::shared_ptr<FilterConfig>;
+
+class PerRouteFilterConfig : public Envoy::Router::RouteSpecificFilterConfig {
+ public:
+  PerRouteFilterConfig(const ::espv2::api::envoy::v9::http::concurrency_limit::
+                           PerRouteFilterConfig& proto)
+      : operation_name_(proto.operation_name()),
+        max_concurrent_requests_(proto.max_concurrent_requests()) {}
+
+  absl::string_view operation_name() const { return operation_name_; }
+  uint32_t max_concurrent_requests() const { return max_concurrent_requests_; }
+
+ private:
+  const std::string operation_name_;
+  const uint32_t max_concurrent_requests_;
+};
+
+}  // namespace concurrency_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,140 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/concurrency_limit/filter.h"
+
+#include "common/common/empty_string.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/router/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/utility.h"
+
+using ::testing::_;
+using ::testing::Invoke;
+using ::testing::NiceMock;
+using ::testing::Return;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace concurrency_limit {
+namespace {
+
+class ConcurrencyLimitFilterTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    counters_ = std::make_shared<ConcurrencyCounters>();
+    config_ = std::make_shared<FilterConfig>(counters_, Envoy::EMPTY_STRING,
+                                             mock_factory_context_.scope_);
+    mock_route_ = std::make_shared<NiceMock<Envoy::Router::MockRoute>>();
+    EXPECT_CALL(mock_decoder_callbacks_, route())
+        .WillRepeatedly(Return(mock_route_));
+  }
+
+  void setPerRoute(uint32_t max_concurrent_requests) {
+    ::espv2::api::envoy::v9::http::concurrency_limit::PerRouteFilterConfig
+        proto;
+    proto.set_operation_name("bookstore.GetShelf");
+    proto.set_max_concurrent_requests(max_concurrent_requests);
+    auto per_route = std::make_shared<PerRouteFilterConfig>(proto);
+    EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+        .WillRepeatedly(
+            Invoke([per_route](const std::string&)
+                       -> const Envoy::Router::RouteSpecificFilterConfig* {
+              return per_route.get();
+            }));
+  }
+
+  // Sends a request through a new filter and returns the filter.
+  std::unique_ptr<Filter> sendRequest(
+      Envoy::Http::FilterHeadersStatus want_status) {
+    auto filter = std::make_unique<Filter>(config_);
+    filter->setDecoderFilterCallbacks(mock_decoder_callbacks_);
+    Envoy::Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                                  {":path", "/shelves/1"}};
+    EXPECT_EQ(want_status, filter->decodeHeaders(headers, true));
+    return filter;
+  }
+
+  uint64_t counter(const std::string& name) {
+    return Envoy::TestUtility::findCounter(mock_factory_context_.scope_,
+                                           "concurrency_limit." + name)
+        ->value();
+  }
+
+  ConcurrencyCountersSharedPtr counters_;
+  FilterConfigSharedPtr config_;
+  NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+  std::shared_ptr<NiceMock<Envoy::Router::MockRoute>> mock_route_;
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks>
+      mock_decoder_callbacks_;
+};
+
+TEST_F(ConcurrencyLimitFilterTest, NoPerRouteConfig) {
+  auto filter = sendRequest(Envoy::Http::FilterHeadersStatus::Continue);
+  filter->onDestroy();
+  EXPECT_EQ(counter("allowed"), 0);
+}
+
+TEST_F(ConcurrencyLimitFilterTest, DeniedOverLimit) {
+  setPerRoute(2);
+  auto filter1 = sendRequest(Envoy::Http::FilterHeadersStatus::Continue);
+  auto filter2 = sendRequest(Envoy::Http::FilterHeadersStatus::Continue);
+
+  EXPECT_CALL(mock_decoder_callbacks_,
+              sendLocalReply(Envoy::Http::Code::ServiceUnavailable,
+                             "Too many concurrent requests for the operation "
+                             "`bookstore.GetShelf`.",
+                             _, _,
+                             "concurrency_limit_too_many_concurrent_requests"));
+  auto filter3 = sendRequest(Envoy::Http::FilterHeadersStatus::StopIteration);
+  filter3->onDestroy();
+  EXPECT_EQ(config_->counters().inFlight("bookstore.GetShelf"), 2);
+
+  // A completed request makes room for another one.
+  filter1->onDestroy();
+  auto filter4 = sendRequest(Envoy::Http::FilterHeadersStatus::Continue);
+
+  filter2->onDestroy();
+  filter4->onDestroy();
+  EXPECT_EQ(config_->counters().inFlight("bookstore.GetShelf"), 0);
+  EXPECT_EQ(counter("allowed"), 3);
+  EXPECT_EQ(counter("denied"), 1);
+}
+
+TEST_F(ConcurrencyLimitFilterTest, CountedAcrossConfigUpdates) {
+  setPerRoute(1);
+  auto filter1 = sendRequest(Envoy::Http::FilterHeadersStatus::Continue);
+
+  // The config of the updated listener shares the counters, so the request
+  // in flight through the old config is counted.
+  config_ = std::make_shared<FilterConfig>(counters_, Envoy::EMPTY_STRING,
+                                           mock_factory_context_.scope_);
+  auto filter2 = sendRequest(Envoy::Http::FilterHeadersStatus::StopIteration);
+  filter2->onDestroy();
+
+  filter1->onDestroy();
+  auto filter3 = sendRequest(Envoy::Http::FilterHeadersStatus::Continue);
+  filter3->onDestroy();
+  EXPECT_EQ(counters_->inFlight("bookstore.GetShelf"), 0);
+}
+
+}  // namespace
+}  // namespace concurrency_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
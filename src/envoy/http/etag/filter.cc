@@ -0,0 +1,189 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/etag/filter.h"
+
+#include <string>
+
+#include "absl/strings/ascii.h"
+#include "absl/strings/match.h"
+#include "absl/strings/str_cat.h"
+#include "absl/strings/str_split.h"
+#include "common/buffer/buffer_impl.h"
+#include "common/common/hex.h"
+#include "common/crypto/utility.h"
+#include "common/http/headers.h"
+#include "common/http/utility.h"
+#include "src/envoy/utils/http_header_utils.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace etag {
+
+using Envoy::Http::FilterDataStatus;
+using Envoy::Http::FilterHeadersStatus;
+using Envoy::Http::FilterTrailersStatus;
+
+namespace {
+
+const Envoy::Http::LowerCaseString kEtagHeader{"etag"};
+const Envoy::Http::LowerCaseString kIfNoneMatchHeader{"if-none-match"};
+
+constexpr absl::string_view kJsonContentType = "application/json";
+constexpr absl::string_view kWeakEtagPrefix = "W/";
+
+// Returns true if one of the entity tags of the If-None-Match header matches
+// the etag. The comparison is weak, as required by RFC 7232 section 3.2.
+bool ifNoneMatch(absl::string_view if_none_match, absl::string_view etag) {
+  for (absl::string_view tag : absl::StrSplit(if_none_match, ',')) {
+    tag = absl::StripAsciiWhitespace(tag);
+    absl::ConsumePrefix(&tag, kWeakEtagPrefix);
+    if (tag == "*" || tag == etag) {
+      return true;
+    }
+  }
+  return false;
+}
+
+}  // namespace
+
+FilterHeadersStatus Filter::decodeHeaders(
+    Envoy::Http::RequestHeaderMap& headers, bool) {
+  if (headers.getMethodValue() !=
+      Envoy::Http::Headers::get().MethodValues.Get) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  auto route = decoder_callbacks_->route();
+  if (route == nullptr || route->routeEntry() == nullptr ||
+      route->routeEntry()->perFilterConfigTyped<PerRouteFilterConfig>(
+          kFilterName) == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  enabled_ = true;
+  if_none_match_ =
+      std::string(utils::extractHeader(headers, kIfNoneMatchHeader));
+  return FilterHeadersStatus::Continue;
+}
+
+FilterHeadersStatus Filter::encodeHeaders(
+    Envoy::Http::ResponseHeaderMap& headers, bool end_stream) {
+  if (!enabled_) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  // Only the successful JSON responses without their own ETag get one.
+  if (Envoy::Http::Utility::getResponseStatus(headers) !=
+          Envoy::enumToInt(Envoy::Http::Code::OK) ||
+      !absl::StartsWith(headers.getContentTypeValue(), kJsonContentType) ||
+      !utils::extractHeader(headers, kEtagHeader).empty()) {
+    enabled_ = false;
+    return FilterHeadersStatus::Continue;
+  }
+
+  response_headers_ = &headers;
+  if (end_stream) {
+    Envoy::Buffer::OwnedImpl empty;
+    setEtag(empty);
+    return FilterHeadersStatus::Continue;
+  }
+  // Hold the headers until the whole body is buffered.
+  return FilterHeadersStatus::StopIteration;
+}
+
+FilterDataStatus Filter::encodeData(Envoy::Buffer::Instance& data,
+                                    bool end_stream) {
+  if (!enabled_) {
+    return FilterDataStatus::Continue;
+  }
+
+  // Over the max body size, the headers and the buffered body continue
+  // without an ETag.
+  const Envoy::Buffer::Instance* buffered =
+      encoder_callbacks_->encodingBuffer();
+  const uint64_t body_bytes =
+      data.length() + (buffered != nullptr ? buffered->length() : 0);
+  if (config_->maxBodyBytes() > 0 && body_bytes > config_->maxBodyBytes()) {
+    ENVOY_LOG(debug, "Response body over {} bytes, no ETag",
+              config_->maxBodyBytes());
+    config_->stats().body_too_large_.inc();
+    enabled_ = false;
+    return FilterDataStatus::Continue;
+  }
+
+  if (!end_stream) {
+    return FilterDataStatus::StopIterationAndBuffer;
+  }
+  setEtag(data);
+  return FilterDataStatus::Continue;
+}
+
+FilterTrailersStatus Filter::encodeTrailers(
+    Envoy::Http::ResponseTrailerMap&) {
+  if (enabled_) {
+    Envoy::Buffer::OwnedImpl empty;
+    setEtag(empty);
+  }
+  return FilterTrailersStatus::Continue;
+}
+
+void Filter::setEtag(Envoy::Buffer::Instance& data) {
+  // The transcoder sets the status of the gRPC errors in encodeTrailers, after
+  // the 200 of encodeHeaders.
+  if (Envoy::Http::Utility::getResponseStatus(*response_headers_) !=
+      Envoy::enumToInt(Envoy::Http::Code::OK)) {
+    return;
+  }
+
+  Envoy::Buffer::OwnedImpl body;
+  const Envoy::Buffer::Instance* buffered =
+      encoder_callbacks_->encodingBuffer();
+  if (buffered != nullptr) {
+    body.add(*buffered);
+  }
+  body.add(data);
+
+  const std::string etag = absl::StrCat(
+      "\"",
+      Envoy::Hex::encode(
+          Envoy::Common::Crypto::UtilitySingleton::get().getSha256Digest(
+              body)),
+      "\"");
+  response_headers_->setCopy(kEtagHeader, etag);
+  config_->stats().etag_added_.inc();
+
+  if (if_none_match_.empty() || !ifNoneMatch(if_none_match_, etag)) {
+    return;
+  }
+
+  ENVOY_LOG(debug, "ETag {} matches If-None-Match, responding 304", etag);
+  response_headers_->setStatus(
+      Envoy::enumToInt(Envoy::Http::Code::NotModified));
+  response_headers_->removeContentLength();
+  data.drain(data.length());
+  if (buffered != nullptr) {
+    encoder_callbacks_->modifyEncodingBuffer(
+        [](Envoy::Buffer::Instance& buffer) {
+          buffer.drain(buffer.length());
+        });
+  }
+  config_->stats().not_modified_.inc();
+}
+
+}  // namespace etag
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
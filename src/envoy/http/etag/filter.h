@@ -0,0 +1,67 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "common/common/logger.h"
+#include "envoy/http/filter.h"
+#include "envoy/http/header_map.h"
+#include "extensions/filters/http/common/pass_through_filter.h"
+#include "src/envoy/http/etag/filter_config.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace etag {
+
+// Computes a strong ETag over the JSON body of the successful responses to
+// the GET requests of the routes enabling it. The responses whose ETag
+// matches the If-None-Match request header become 304 Not Modified.
+class Filter : public Envoy::Http::PassThroughFilter,
+               public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
+ public:
+  Filter(FilterConfigSharedPtr config) : config_(config) {}
+
+  // Envoy::Http::StreamDecoderFilter
+  Envoy::Http::FilterHeadersStatus decodeHeaders(Envoy::Http::RequestHeaderMap&,
+                                                 bool) override;
+
+  // Envoy::Http::StreamEncoderFilter
+  Envoy::Http::FilterHeadersStatus encodeHeaders(
+      Envoy::Http::ResponseHeaderMap& headers, bool end_stream) override;
+  Envoy::Http::FilterDataStatus encodeData(Envoy::Buffer::Instance& data,
+                                           bool end_stream) override;
+  Envoy::Http::FilterTrailersStatus encodeTrailers(
+      Envoy::Http::ResponseTrailerMap&) override;
+
+ private:
+  // Sets the ETag of the buffered body plus the last data, and turns the
+  // response into a 304 if it matches the If-None-Match request header.
+  void setEtag(Envoy::Buffer::Instance& data);
+
+  const FilterConfigSharedPtr config_;
+
+  // Whether the response body is buffered to compute its ETag.
+  bool enabled_{};
+  // The If-None-Match header of the request.
+  std::string if_none_match_;
+  Envoy::Http::ResponseHeaderMap* response_headers_{};
+};
+
+}  // namespace etag
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,80 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include "api/envoy/v9/http/etag/config.pb.h"
+#include "envoy/router/router.h"
+#include "envoy/stats/scope.h"
+#include "envoy/stats/stats_macros.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace etag {
+
+// The filter name.
+constexpr const char kFilterName[] = "com.google.espv2.filters.http.etag";
+
+/**
+ * All stats for the etag filter. @see stats_macros.h
+ */
+#define ALL_ETAG_FILTER_STATS(COUNTER) \
+  COUNTER(etag_added)                  \
+  COUNTER(not_modified)                \
+  COUNTER(body_too_large)
+
+/**
+ * Wrapper struct for etag filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_ETAG_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+class FilterConfig {
+ public:
+  FilterConfig(
+      const ::espv2::api::envoy::v9::http::etag::FilterConfig& proto_config,
+      const std::string& stats_prefix, Envoy::Stats::Scope& scope)
+      : max_body_bytes_(proto_config.max_body_bytes()),
+        stats_(generateStats(stats_prefix, scope)) {}
+
+  // The max size of the buffered body, 0 if not limited.
+  uint32_t maxBodyBytes() const { return max_body_bytes_; }
+
+  FilterStats& stats() { return stats_; }
+
+ private:
+  FilterStats generateStats(const std::string& prefix,
+                            Envoy::Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "etag.";
+    return {ALL_ETAG_FILTER_STATS(POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  const uint32_t max_body_bytes_;
+
+  // The stats
+  FilterStats stats_;
+};
+
+using FilterConfigSharedPtr = std::shared_ptr<FilterConfig>;
+
+// The per-route config has no field, the filter is enabled for the routes
+// having it.
+class PerRouteFilterConfig : public Envoy::Router::RouteSpecificFilterConfig {};
+
+}  // namespace etag
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
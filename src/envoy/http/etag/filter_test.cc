@@ -0,0 +1,276 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/etag/filter.h"
+
+#include "absl/strings/str_cat.h"
+#include "common/buffer/buffer_impl.h"
+#include "common/common/empty_string.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/router/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/utility.h"
+
+using ::testing::Invoke;
+using ::testing::NiceMock;
+using ::testing::Return;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace etag {
+namespace {
+
+// The strong ETag of kResponseBody.
+constexpr char kResponseBody[] = R"({"id":"1"})";
+constexpr char kResponseEtag[] =
+    R"("5811967f540d300d249ab30ae681359a7815fdb5d3dc71a94be1d491006a6b27")";
+
+// The max body size, over kResponseBody.
+constexpr uint32_t kMaxBodyBytes = 16;
+
+class EtagFilterTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    ::espv2::api::envoy::v9::http::etag::FilterConfig proto_config;
+    proto_config.set_max_body_bytes(kMaxBodyBytes);
+    config_ = std::make_shared<FilterConfig>(
+        proto_config, Envoy::EMPTY_STRING, mock_factory_context_.scope_);
+    mock_route_ = std::make_shared<NiceMock<Envoy::Router::MockRoute>>();
+    EXPECT_CALL(mock_decoder_callbacks_, route())
+        .WillRepeatedly(Return(mock_route_));
+
+    filter_ = std::make_unique<Filter>(config_);
+    filter_->setDecoderFilterCallbacks(mock_decoder_callbacks_);
+    filter_->setEncoderFilterCallbacks(mock_encoder_callbacks_);
+  }
+
+  void setPerRoute() {
+    auto per_route = std::make_shared<PerRouteFilterConfig>();
+    EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+        .WillRepeatedly(
+            Invoke([per_route](const std::string&)
+                       -> const Envoy::Router::RouteSpecificFilterConfig* {
+              return per_route.get();
+            }));
+  }
+
+  uint64_t counter(const std::string& name) {
+    return Envoy::TestUtility::findCounter(mock_factory_context_.scope_,
+                                           "etag." + name)
+        ->value();
+  }
+
+  FilterConfigSharedPtr config_;
+  std::unique_ptr<Filter> filter_;
+  testing::NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+  std::shared_ptr<NiceMock<Envoy::Router::MockRoute>> mock_route_;
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks>
+      mock_decoder_callbacks_;
+  NiceMock<Envoy::Http::MockStreamEncoderFilterCallbacks>
+      mock_encoder_callbacks_;
+};
+
+TEST_F(EtagFilterTest, EtagAdded) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl request_headers{{":method", "GET"},
+                                                        {":path", "/books/1"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(request_headers, true));
+
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(response_headers, false));
+
+  Envoy::Buffer::OwnedImpl data(kResponseBody);
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(response_headers.get_("etag"), kResponseEtag);
+  EXPECT_EQ(response_headers.getStatusValue(), "200");
+  EXPECT_EQ(data.toString(), kResponseBody);
+  EXPECT_EQ(counter("etag_added"), 1);
+  EXPECT_EQ(counter("not_modified"), 0);
+}
+
+TEST_F(EtagFilterTest, NotModified) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl request_headers{
+      {":method", "GET"},
+      {":path", "/books/1"},
+      {"if-none-match", absl::StrCat(R"("other", W/)", kResponseEtag)}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(request_headers, true));
+
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "200"},
+      {"content-type", "application/json"},
+      {"content-length", "10"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(response_headers, false));
+
+  Envoy::Buffer::OwnedImpl data(kResponseBody);
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(response_headers.get_("etag"), kResponseEtag);
+  EXPECT_EQ(response_headers.getStatusValue(), "304");
+  EXPECT_EQ(response_headers.ContentLength(), nullptr);
+  EXPECT_EQ(data.length(), 0);
+  EXPECT_EQ(counter("etag_added"), 1);
+  EXPECT_EQ(counter("not_modified"), 1);
+}
+
+TEST_F(EtagFilterTest, IfNoneMatchMismatched) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl request_headers{
+      {":method", "GET"}, {":path", "/books/1"}, {"if-none-match", R"("1")"}};
+  filter_->decodeHeaders(request_headers, true);
+
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  filter_->encodeHeaders(response_headers, false);
+  Envoy::Buffer::OwnedImpl data(kResponseBody);
+  filter_->encodeData(data, true);
+
+  EXPECT_EQ(response_headers.getStatusValue(), "200");
+  EXPECT_EQ(data.toString(), kResponseBody);
+  EXPECT_EQ(counter("not_modified"), 0);
+}
+
+TEST_F(EtagFilterTest, NoPerRouteConfig) {
+  Envoy::Http::TestRequestHeaderMapImpl request_headers{{":method", "GET"},
+                                                        {":path", "/books/1"}};
+  filter_->decodeHeaders(request_headers, true);
+
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(response_headers, false));
+  EXPECT_FALSE(response_headers.has("etag"));
+}
+
+TEST_F(EtagFilterTest, NotGetRequest) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl request_headers{{":method", "POST"},
+                                                        {":path", "/books"}};
+  filter_->decodeHeaders(request_headers, false);
+
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(response_headers, false));
+  EXPECT_FALSE(response_headers.has("etag"));
+}
+
+TEST_F(EtagFilterTest, NotJsonOrNotSuccessfulResponse) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl request_headers{{":method", "GET"},
+                                                        {":path", "/books/1"}};
+  filter_->decodeHeaders(request_headers, true);
+
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "200"}, {"content-type", "text/html"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(response_headers, false));
+  EXPECT_FALSE(response_headers.has("etag"));
+
+  Filter filter(config_);
+  filter.setDecoderFilterCallbacks(mock_decoder_callbacks_);
+  filter.setEncoderFilterCallbacks(mock_encoder_callbacks_);
+  filter.decodeHeaders(request_headers, true);
+  Envoy::Http::TestResponseHeaderMapImpl error_headers{
+      {":status", "404"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter.encodeHeaders(error_headers, false));
+  EXPECT_FALSE(error_headers.has("etag"));
+}
+
+TEST_F(EtagFilterTest, BackendEtagKept) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl request_headers{{":method", "GET"},
+                                                        {":path", "/books/1"}};
+  filter_->decodeHeaders(request_headers, true);
+
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "200"},
+      {"content-type", "application/json"},
+      {"etag", R"("v1")"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(response_headers, false));
+  EXPECT_EQ(response_headers.get_("etag"), R"("v1")");
+}
+
+TEST_F(EtagFilterTest, TranscodedGrpcError) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl request_headers{{":method", "GET"},
+                                                        {":path", "/books/1"}};
+  filter_->decodeHeaders(request_headers, true);
+
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(response_headers, false));
+
+  // The transcoder sets the status of the gRPC error with the trailers.
+  response_headers.setStatus(404);
+  Envoy::Http::TestResponseTrailerMapImpl response_trailers;
+  EXPECT_EQ(Envoy::Http::FilterTrailersStatus::Continue,
+            filter_->encodeTrailers(response_trailers));
+
+  EXPECT_FALSE(response_headers.has("etag"));
+  EXPECT_EQ(response_headers.getStatusValue(), "404");
+  EXPECT_EQ(counter("etag_added"), 0);
+}
+
+TEST_F(EtagFilterTest, BodyTooLarge) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl request_headers{{":method", "GET"},
+                                                        {":path", "/books/1"}};
+  filter_->decodeHeaders(request_headers, true);
+
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(response_headers, false));
+
+  Envoy::Buffer::OwnedImpl first(kResponseBody);
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::StopIterationAndBuffer,
+            filter_->encodeData(first, false));
+
+  // The buffered body plus this data is over kMaxBodyBytes.
+  Envoy::Buffer::OwnedImpl buffered(kResponseBody);
+  EXPECT_CALL(mock_encoder_callbacks_, encodingBuffer())
+      .WillRepeatedly(Return(&buffered));
+  Envoy::Buffer::OwnedImpl second(kResponseBody);
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(second, false));
+
+  Envoy::Buffer::OwnedImpl last(kResponseBody);
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(last, true));
+  EXPECT_FALSE(response_headers.has("etag"));
+  EXPECT_EQ(counter("etag_added"), 0);
+  EXPECT_EQ(counter("body_too_large"), 1);
+}
+
+}  // namespace
+}  // namespace etag
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,223 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/grpc_status_mapping/filter.h"
+
+#include "absl/strings/match.h"
+#include "absl/strings/str_cat.h"
+#include "absl/strings/str_replace.h"
+#include "common/buffer/buffer_impl.h"
+#include "common/http/utility.h"
+#include "common/protobuf/utility.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace grpc_status_mapping {
+
+using Envoy::Http::FilterDataStatus;
+using Envoy::Http::FilterHeadersStatus;
+using Envoy::Http::FilterTrailersStatus;
+
+namespace {
+
+constexpr absl::string_view kJsonContentType = "application/json";
+constexpr absl::string_view kCodeField = "code";
+constexpr absl::string_view kMessageField = "message";
+constexpr absl::string_view kDetailsField = "details";
+
+// The operators of the error body format, the same as the local reply ones.
+constexpr absl::string_view kResponseCodeOperator = "%RESPONSE_CODE%";
+constexpr absl::string_view kLocalReplyBodyOperator = "%LOCAL_REPLY_BODY%";
+constexpr absl::string_view kResponseCodeDetailsOperator =
+    "%RESPONSE_CODE_DETAILS%";
+// The response code details of the responses from the backend.
+constexpr absl::string_view kViaUpstream = "via_upstream";
+
+// Replaces the operators in the string values of the JSON value.
+void substitute(Envoy::ProtobufWkt::Value& value, uint32_t http_status_code,
+                const std::string& message) {
+  switch (value.kind_case()) {
+    case Envoy::ProtobufWkt::Value::kStringValue:
+      // Like the local reply JSON format, a lone %RESPONSE_CODE% is a number.
+      if (value.string_value() == kResponseCodeOperator) {
+        value.set_number_value(http_status_code);
+        return;
+      }
+      value.set_string_value(absl::StrReplaceAll(
+          value.string_value(),
+          {{kResponseCodeOperator, absl::StrCat(http_status_code)},
+           {kLocalReplyBodyOperator, message},
+           {kResponseCodeDetailsOperator, kViaUpstream}}));
+      return;
+    case Envoy::ProtobufWkt::Value::kStructValue:
+      for (auto& field : *value.mutable_struct_value()->mutable_fields()) {
+        substitute(field.second, http_status_code, message);
+      }
+      return;
+    case Envoy::ProtobufWkt::Value::kListValue:
+      for (auto& item : *value.mutable_list_value()->mutable_values()) {
+        substitute(item, http_status_code, message);
+      }
+      return;
+    default:
+      return;
+  }
+}
+
+// Returns the error body of the format, with the message and the details of
+// the google.rpc.Status.
+std::string formatBody(const Envoy::ProtobufWkt::Struct& format,
+                       bool include_details, uint32_t http_status_code,
+                       const Envoy::ProtobufWkt::Struct& status) {
+  std::string message;
+  const auto message_it = status.fields().find(std::string(kMessageField));
+  if (message_it != status.fields().end()) {
+    message = message_it->second.string_value();
+  }
+
+  Envoy::ProtobufWkt::Value body;
+  *body.mutable_struct_value() = format;
+  substitute(body, http_status_code, message);
+
+  if (include_details) {
+    auto& details =
+        (*body.mutable_struct_value()->mutable_fields())[std::string(
+            kDetailsField)];
+    const auto details_it = status.fields().find(std::string(kDetailsField));
+    if (details_it != status.fields().end()) {
+      details = details_it->second;
+    } else {
+      details.mutable_list_value();
+    }
+  }
+  return Envoy::MessageUtil::getJsonStringFromMessage(body.struct_value(),
+                                                      false, true);
+}
+
+}  // namespace
+
+FilterHeadersStatus Filter::encodeHeaders(
+    Envoy::Http::ResponseHeaderMap& headers, bool end_stream) {
+  // The transcoded gRPC errors are the JSON error responses, and always have
+  // a body.
+  if (end_stream ||
+      Envoy::Http::Utility::getResponseStatus(headers) <
+          Envoy::enumToInt(Envoy::Http::Code::BadRequest) ||
+      !absl::StartsWith(headers.getContentTypeValue(), kJsonContentType)) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  auto route = encoder_callbacks_->route();
+  if (route == nullptr || route->routeEntry() == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+  per_route_ =
+      route->routeEntry()->perFilterConfigTyped<PerRouteFilterConfig>(
+          kFilterName);
+  if (per_route_ == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  response_headers_ = &headers;
+  // Hold the headers until the whole body is buffered.
+  return FilterHeadersStatus::StopIteration;
+}
+
+FilterDataStatus Filter::encodeData(Envoy::Buffer::Instance& data,
+                                    bool end_stream) {
+  if (per_route_ == nullptr) {
+    return FilterDataStatus::Continue;
+  }
+  if (!end_stream) {
+    return FilterDataStatus::StopIterationAndBuffer;
+  }
+  mapStatus(data);
+  return FilterDataStatus::Continue;
+}
+
+FilterTrailersStatus Filter::encodeTrailers(
+    Envoy::Http::ResponseTrailerMap&) {
+  if (per_route_ != nullptr) {
+    Envoy::Buffer::OwnedImpl data;
+    mapStatus(data);
+    if (data.length() > 0) {
+      encoder_callbacks_->addEncodedData(data, false);
+    }
+  }
+  return FilterTrailersStatus::Continue;
+}
+
+void Filter::mapStatus(Envoy::Buffer::Instance& data) {
+  Envoy::Buffer::OwnedImpl body;
+  const Envoy::Buffer::Instance* buffered =
+      encoder_callbacks_->encodingBuffer();
+  if (buffered != nullptr) {
+    body.add(*buffered);
+  }
+  body.add(data);
+
+  Envoy::ProtobufWkt::Struct status;
+  try {
+    Envoy::MessageUtil::loadFromJson(body.toString(), status);
+  } catch (const Envoy::EnvoyException& e) {
+    ENVOY_LOG(debug, "error response body is not JSON: {}", e.what());
+    config_->stats().invalid_body_.inc();
+    return;
+  }
+
+  const auto it = status.fields().find(std::string(kCodeField));
+  if (it == status.fields().end() ||
+      it->second.kind_case() != Envoy::ProtobufWkt::Value::kNumberValue) {
+    ENVOY_LOG(debug, "error response body has no gRPC status code");
+    config_->stats().invalid_body_.inc();
+    return;
+  }
+
+  uint32_t http_status_code = per_route_->httpStatusCode(
+      static_cast<uint32_t>(it->second.number_value()));
+  if (http_status_code != 0) {
+    ENVOY_LOG(debug, "mapping gRPC status code {} to HTTP status code {}",
+              it->second.number_value(), http_status_code);
+    response_headers_->setStatus(http_status_code);
+    config_->stats().mapped_.inc();
+  } else {
+    http_status_code =
+        Envoy::Http::Utility::getResponseStatus(*response_headers_);
+  }
+
+  const Envoy::ProtobufWkt::Struct* format = config_->errorBodyFormat();
+  if (format == nullptr) {
+    return;
+  }
+  const std::string formatted =
+      formatBody(*format, config_->includeDetails(), http_status_code, status);
+  data.drain(data.length());
+  if (buffered != nullptr) {
+    encoder_callbacks_->modifyEncodingBuffer(
+        [](Envoy::Buffer::Instance& buffer) {
+          buffer.drain(buffer.length());
+        });
+  }
+  data.add(formatted);
+  if (response_headers_->ContentLength() != nullptr) {
+    response_headers_->setContentLength(formatted.size());
+  }
+  config_->stats().formatted_.inc();
+}
+
+}  // namespace grpc_status_mapping
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
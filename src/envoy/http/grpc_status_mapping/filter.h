@@ -0,0 +1,60 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include "common/common/logger.h"
+#include "envoy/http/filter.h"
+#include "envoy/http/header_map.h"
+#include "extensions/filters/http/common/pass_through_filter.h"
+#include "src/envoy/http/grpc_status_mapping/filter_config.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace grpc_status_mapping {
+
+// Overrides the HTTP status code of the error responses transcoded from gRPC,
+// by the gRPC status code of their JSON google.rpc.Status body, and replaces
+// the body by the configured JSON error body format.
+class Filter : public Envoy::Http::PassThroughEncoderFilter,
+               public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
+ public:
+  Filter(FilterConfigSharedPtr config) : config_(config) {}
+
+  // Envoy::Http::StreamEncoderFilter
+  Envoy::Http::FilterHeadersStatus encodeHeaders(
+      Envoy::Http::ResponseHeaderMap& headers, bool end_stream) override;
+  Envoy::Http::FilterDataStatus encodeData(Envoy::Buffer::Instance& data,
+                                           bool end_stream) override;
+  Envoy::Http::FilterTrailersStatus encodeTrailers(
+      Envoy::Http::ResponseTrailerMap&) override;
+
+ private:
+  // Sets the HTTP status code of the gRPC status code in the buffered body
+  // plus the last data, and replaces them by the formatted body if the error
+  // body format is configured.
+  void mapStatus(Envoy::Buffer::Instance& data);
+
+  const FilterConfigSharedPtr config_;
+
+  // The per-route config of the response whose body is buffered, if any.
+  const PerRouteFilterConfig* per_route_{};
+  Envoy::Http::ResponseHeaderMap* response_headers_{};
+};
+
+}  // namespace grpc_status_mapping
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include "absl/container/flat_hash_map.h"
+#include "api/envoy/v9/http/grpc_status_mapping/config.pb.h"
+#include "common/protobuf/protobuf.h"
+#include "envoy/router/router.h"
+#include "envoy/stats/scope.h"
+#include "envoy/stats/stats_macros.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace grpc_status_mapping {
+
+// The filter name.
+constexpr const char kFilterName[] =
+    "com.google.espv2.filters.http.grpc_status_mapping";
+
+/**
+ * All stats for the gRPC status mapping filter. @see stats_macros.h
+ */
+#define ALL_GRPC_STATUS_MAPPING_FILTER_STATS(COUNTER) \
+  COUNTER(mapped)                                     \
+  COUNTER(formatted)                                  \
+  COUNTER(invalid_body)
+
+/**
+ * Wrapper struct for gRPC status mapping filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_GRPC_STATUS_MAPPING_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+class FilterConfig {
+ public:
+  FilterConfig(
+      const ::espv2::api::envoy::v9::http::grpc_status_mapping::FilterConfig&
+          proto_config,
+      const std::string& stats_prefix, Envoy::Stats::Scope& scope)
+      : proto_config_(proto_config),
+        stats_(generateStats(stats_prefix, scope)) {}
+
+  FilterStats& stats() { return stats_; }
+
+  // The JSON object replacing the body of the errors, nullptr if the body is
+  // kept.
+  const Envoy::ProtobufWkt::Struct* errorBodyFormat() const {
+    return proto_config_.has_error_body_format()
+               ? &proto_config_.error_body_format()
+               : nullptr;
+  }
+
+  bool includeDetails() const { return proto_config_.include_details(); }
+
+ private:
+  FilterStats generateStats(const std::string& prefix,
+                            Envoy::Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "grpc_status_mapping.";
+    return {ALL_GRPC_STATUS_MAPPING_FILTER_STATS(
+        POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  const ::espv2::api::envoy::v9::http::grpc_status_mapping::FilterConfig
+      proto_config_;
+
+  // The stats
+  FilterStats stats_;
+};
+
+using FilterConfigSharedPtr = std::shared_ptr<FilterConfig>;
+
+class PerRouteFilterConfig : public Envoy::Router::RouteSpecificFilterConfig {
+ public:
+  PerRouteFilterConfig(const ::espv2::api::envoy::v9::http::
+                           grpc_status_mapping::PerRouteFilterConfig& proto)
+      : http_status_codes_(proto.http_status_codes().begin(),
+                           proto.http_status_codes().end()) {}
+
+  // Returns the HTTP status code of the gRPC status code, 0 if it keeps the
+  // default one.
+  uint32_t httpStatusCode(uint32_t grpc_status_code) const {
+    auto it = http_status_codes_.find(grpc_status_code);
+    return it == http_status_codes_.end() ? 0 : it->second;
+  }
+
+ private:
+  const absl::flat_hash_map<uint32_t, uint32_t> http_status_codes_;
+};
+
+}  // namespace grpc_status_mapping
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,293 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/grpc_status_mapping/filter.h"
+
+#include "absl/strings/str_cat.h"
+#include "common/buffer/buffer_impl.h"
+#include "common/common/empty_string.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/router/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/utility.h"
+
+using ::testing::_;
+using ::testing::Invoke;
+using ::testing::NiceMock;
+using ::testing::Return;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace grpc_status_mapping {
+namespace {
+
+class GrpcStatusMappingFilterTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    mock_route_ = std::make_shared<NiceMock<Envoy::Router::MockRoute>>();
+    EXPECT_CALL(mock_encoder_callbacks_, route())
+        .WillRepeatedly(Return(mock_route_));
+    setFilterConfig("");
+  }
+
+  void setFilterConfig(const std::string& config_yaml) {
+    ::espv2::api::envoy::v9::http::grpc_status_mapping::FilterConfig proto;
+    if (!config_yaml.empty()) {
+      Envoy::TestUtility::loadFromYaml(config_yaml, proto);
+    }
+    config_ = std::make_shared<FilterConfig>(proto, Envoy::EMPTY_STRING,
+                                             mock_factory_context_.scope_);
+    filter_ = std::make_unique<Filter>(config_);
+    filter_->setEncoderFilterCallbacks(mock_encoder_callbacks_);
+  }
+
+  // Maps NOT_FOUND to 410 Gone.
+  void setPerRoute() {
+    ::espv2::api::envoy::v9::http::grpc_status_mapping::PerRouteFilterConfig
+        proto;
+    (*proto.mutable_http_status_codes())[5] = 410;
+    per_route_ = std::make_shared<PerRouteFilterConfig>(proto);
+    EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+        .WillRepeatedly(
+            Invoke([this](const std::string&)
+                       -> const Envoy::Router::RouteSpecificFilterConfig* {
+              return per_route_.get();
+            }));
+  }
+
+  uint64_t counter(const std::string& name) {
+    return Envoy::TestUtility::findCounter(mock_factory_context_.scope_,
+                                           "grpc_status_mapping." + name)
+        ->value();
+  }
+
+  FilterConfigSharedPtr config_;
+  std::shared_ptr<PerRouteFilterConfig> per_route_;
+  NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+  std::shared_ptr<NiceMock<Envoy::Router::MockRoute>> mock_route_;
+  NiceMock<Envoy::Http::MockStreamEncoderFilterCallbacks>
+      mock_encoder_callbacks_;
+  std::unique_ptr<Filter> filter_;
+};
+
+TEST_F(GrpcStatusMappingFilterTest, NoPerRouteConfig) {
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "404"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data(R"({"code":5,"message":"no shelf"})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+  EXPECT_EQ(headers.getStatusValue(), "404");
+}
+
+TEST_F(GrpcStatusMappingFilterTest, SuccessfulResponse) {
+  setPerRoute();
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data(R"({"code":5})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+  EXPECT_EQ(headers.getStatusValue(), "200");
+}
+
+TEST_F(GrpcStatusMappingFilterTest, MappedStatus) {
+  setPerRoute();
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "404"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(headers, false));
+
+  Envoy::Buffer::OwnedImpl buffered(R"({"code":5,)");
+  EXPECT_CALL(mock_encoder_callbacks_, encodingBuffer())
+      .WillRepeatedly(Return(&buffered));
+  Envoy::Buffer::OwnedImpl data1(R"({"code":5,)");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::StopIterationAndBuffer,
+            filter_->encodeData(data1, false));
+  Envoy::Buffer::OwnedImpl data2(R"("message":"no shelf"})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data2, true));
+
+  EXPECT_EQ(headers.getStatusValue(), "410");
+  EXPECT_EQ(counter("mapped"), 1);
+}
+
+TEST_F(GrpcStatusMappingFilterTest, UnmappedStatus) {
+  setPerRoute();
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "400"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data(R"({"code":3,"message":"bad shelf"})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(headers.getStatusValue(), "400");
+  EXPECT_EQ(counter("mapped"), 0);
+}
+
+TEST_F(GrpcStatusMappingFilterTest, InvalidBody) {
+  setPerRoute();
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "404"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data("not json");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(headers.getStatusValue(), "404");
+  EXPECT_EQ(counter("invalid_body"), 1);
+}
+
+TEST_F(GrpcStatusMappingFilterTest, FormattedBody) {
+  setFilterConfig(R"(
+error_body_format:
+  code: "%RESPONSE_CODE%"
+  error:
+    status: "HTTP %RESPONSE_CODE%"
+    message: "%LOCAL_REPLY_BODY%"
+    details: "%RESPONSE_CODE_DETAILS%"
+)");
+  setPerRoute();
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "404"},
+      {"content-type", "application/json"},
+      {"content-length", "48"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(headers, false));
+
+  Envoy::Buffer::OwnedImpl buffered(R"({"code":5,)");
+  EXPECT_CALL(mock_encoder_callbacks_, encodingBuffer())
+      .WillRepeatedly(Return(&buffered));
+  EXPECT_CALL(mock_encoder_callbacks_, modifyEncodingBuffer(_))
+      .WillOnce(Invoke(
+          [&buffered](std::function<void(Envoy::Buffer::Instance&)> callback) {
+            callback(buffered);
+          }));
+  Envoy::Buffer::OwnedImpl data(
+      R"("message":"no shelf","details":[{"@type":"x"}]})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(headers.getStatusValue(), "410");
+  EXPECT_EQ(buffered.length(), 0);
+  Envoy::ProtobufWkt::Struct want;
+  Envoy::MessageUtil::loadFromJson(R"({
+    "code": 410,
+    "error": {
+      "status": "HTTP 410",
+      "message": "no shelf",
+      "details": "via_upstream"
+    }
+  })",
+                                   want);
+  Envoy::ProtobufWkt::Struct got;
+  Envoy::MessageUtil::loadFromJson(data.toString(), got);
+  EXPECT_TRUE(Envoy::TestUtility::protoEqual(got, want));
+  EXPECT_EQ(headers.getContentLengthValue(), absl::StrCat(data.length()));
+  EXPECT_EQ(counter("formatted"), 1);
+}
+
+TEST_F(GrpcStatusMappingFilterTest, FormattedBodyWithDetails) {
+  setFilterConfig(R"(
+error_body_format:
+  code: "%RESPONSE_CODE%"
+  message: "%LOCAL_REPLY_BODY%"
+include_details: true
+)");
+  // An empty per-route config only formats the body.
+  per_route_ = std::make_shared<PerRouteFilterConfig>(
+      ::espv2::api::envoy::v9::http::grpc_status_mapping::
+          PerRouteFilterConfig());
+  EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+      .WillRepeatedly(Return(per_route_.get()));
+
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "400"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data(
+      R"({"code":3,"message":"bad shelf","details":[{"@type":"x"}]})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(headers.getStatusValue(), "400");
+  Envoy::ProtobufWkt::Struct want;
+  Envoy::MessageUtil::loadFromJson(R"({
+    "code": 400,
+    "message": "bad shelf",
+    "details": [{"@type": "x"}]
+  })",
+                                   want);
+  Envoy::ProtobufWkt::Struct got;
+  Envoy::MessageUtil::loadFromJson(data.toString(), got);
+  EXPECT_TRUE(Envoy::TestUtility::protoEqual(got, want));
+  EXPECT_EQ(counter("mapped"), 0);
+  EXPECT_EQ(counter("formatted"), 1);
+}
+
+TEST_F(GrpcStatusMappingFilterTest, FormattedBodyWithoutStatusDetails) {
+  setFilterConfig(R"(
+error_body_format:
+  message: "%LOCAL_REPLY_BODY%"
+include_details: true
+)");
+  setPerRoute();
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "400"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data(R"({"code":3,"message":"bad shelf"})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  Envoy::ProtobufWkt::Struct want;
+  Envoy::MessageUtil::loadFromJson(
+      R"({"message": "bad shelf", "details": []})", want);
+  Envoy::ProtobufWkt::Struct got;
+  Envoy::MessageUtil::loadFromJson(data.toString(), got);
+  EXPECT_TRUE(Envoy::TestUtility::protoEqual(got, want));
+}
+
+TEST_F(GrpcStatusMappingFilterTest, InvalidBodyNotFormatted) {
+  setFilterConfig(R"(
+error_body_format:
+  message: "%LOCAL_REPLY_BODY%"
+)");
+  setPerRoute();
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "404"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::StopIteration,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data("not json");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(data.toString(), "not json");
+  EXPECT_EQ(counter("invalid_body"), 1);
+  EXPECT_EQ(counter("formatted"), 0);
+}
+
+}  // namespace
+}  // namespace grpc_status_mapping
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
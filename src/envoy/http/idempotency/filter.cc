@@ -0,0 +1,232 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/idempotency/filter.h"
+
+#include <string>
+
+#include "absl/strings/str_cat.h"
+#include "common/buffer/buffer_impl.h"
+#include "common/common/hex.h"
+#include "common/crypto/utility.h"
+#include "common/http/codes.h"
+#include "common/http/header_map_impl.h"
+#include "common/http/utility.h"
+#include "src/envoy/utils/filter_state_utils.h"
+#include "src/envoy/utils/http_header_utils.h"
+#include "src/envoy/utils/rc_detail_utils.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace idempotency {
+
+using Envoy::Http::FilterDataStatus;
+using Envoy::Http::FilterHeadersStatus;
+using Envoy::Http::FilterTrailersStatus;
+
+namespace {
+
+const Envoy::Http::LowerCaseString kReplayedHeader{"idempotent-replayed"};
+
+// The response code details type of the replayed responses.
+constexpr char kRcDetailTypeReplayed[] = "replayed";
+
+// Copies all the headers of the map.
+HeaderList copyHeaders(const Envoy::Http::HeaderMap& headers) {
+  HeaderList list;
+  headers.iterate([&list](const Envoy::Http::HeaderEntry& header)
+                      -> Envoy::Http::HeaderMap::Iterate {
+    list.emplace_back(std::string(header.key().getStringView()),
+                      std::string(header.value().getStringView()));
+    return Envoy::Http::HeaderMap::Iterate::Continue;
+  });
+  return list;
+}
+
+}  // namespace
+
+FilterHeadersStatus Filter::decodeHeaders(
+    Envoy::Http::RequestHeaderMap& headers, bool) {
+  const absl::string_view idempotency_key =
+      utils::extractHeader(headers, config_->key_header());
+  if (idempotency_key.empty()) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  auto route = decoder_callbacks_->route();
+  if (route == nullptr || route->routeEntry() == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+  const auto* per_route =
+      route->routeEntry()->perFilterConfigTyped<PerRouteFilterConfig>(
+          kFilterName);
+  if (per_route == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  // Scope the key by the operation and the caller, so different callers
+  // never get each other's responses.
+  Envoy::Buffer::OwnedImpl scoped_key(absl::StrCat(
+      per_route->operation_name(), "\n",
+      utils::getStringFilterState(
+          *decoder_callbacks_->streamInfo().filterState(),
+          utils::kFilterStateApiKeyHash),
+      "\n", utils::readHeaderEntry(headers.Authorization()), "\n",
+      idempotency_key));
+  const std::string key = Envoy::Hex::encode(
+      Envoy::Common::Crypto::UtilitySingleton::get().getSha256Digest(
+          scoped_key));
+
+  StoredResponseConstSharedPtr stored;
+  switch (config_->store().start(key, headers.getPathValue(), stored)) {
+    case StartResult::Started:
+      config_->stats().started_.inc();
+      key_ = key;
+      return FilterHeadersStatus::Continue;
+    case StartResult::Completed:
+      config_->stats().replayed_.inc();
+      replay(*stored);
+      return FilterHeadersStatus::StopIteration;
+    case StartResult::InFlight:
+      config_->stats().denied_by_in_flight_.inc();
+      rejectRequest(
+          Envoy::Http::Code::Conflict,
+          absl::StrCat("A request with the same ",
+                       config_->key_header().get(), " is in progress."),
+          utils::generateRcDetails(utils::kRcDetailFilterIdempotency,
+                                   utils::kRcDetailErrorTypeRequestInProgress));
+      return FilterHeadersStatus::StopIteration;
+    case StartResult::PathMismatched:
+      config_->stats().denied_by_path_mismatch_.inc();
+      rejectRequest(
+          Envoy::Http::Code::UnprocessableEntity,
+          absl::StrCat("The ", config_->key_header().get(),
+                       " was already used by a request with another path."),
+          utils::generateRcDetails(utils::kRcDetailFilterIdempotency,
+                                   utils::kRcDetailErrorTypeKeyReused));
+      return FilterHeadersStatus::StopIteration;
+    case StartResult::Full:
+      config_->stats().store_full_.inc();
+      return FilterHeadersStatus::Continue;
+  }
+  return FilterHeadersStatus::Continue;
+}
+
+FilterHeadersStatus Filter::encodeHeaders(
+    Envoy::Http::ResponseHeaderMap& headers, bool end_stream) {
+  if (key_.empty()) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  // The 5xx responses are not stored, so the client can retry them.
+  if (Envoy::Http::CodeUtility::is5xx(
+          Envoy::Http::Utility::getResponseStatus(headers))) {
+    finish(false);
+    return FilterHeadersStatus::Continue;
+  }
+
+  response_ = std::make_unique<StoredResponse>();
+  response_->headers = copyHeaders(headers);
+  if (end_stream) {
+    finish(true);
+  }
+  return FilterHeadersStatus::Continue;
+}
+
+FilterDataStatus Filter::encodeData(Envoy::Buffer::Instance& data,
+                                    bool end_stream) {
+  if (key_.empty()) {
+    return FilterDataStatus::Continue;
+  }
+
+  if (response_->body.size() + data.length() >
+      config_->max_response_bytes()) {
+    finish(false);
+    return FilterDataStatus::Continue;
+  }
+  response_->body.append(data.toString());
+  if (end_stream) {
+    finish(true);
+  }
+  return FilterDataStatus::Continue;
+}
+
+FilterTrailersStatus Filter::encodeTrailers(
+    Envoy::Http::ResponseTrailerMap& trailers) {
+  if (!key_.empty()) {
+    response_->trailers = copyHeaders(trailers);
+    finish(true);
+  }
+  return FilterTrailersStatus::Continue;
+}
+
+void Filter::onDestroy() {
+  // The request is reset before its response completes.
+  if (!key_.empty()) {
+    finish(false);
+  }
+}
+
+void Filter::finish(bool store) {
+  if (store) {
+    config_->store().complete(key_, std::move(response_));
+  } else {
+    config_->stats().not_stored_.inc();
+    config_->store().release(key_);
+  }
+  key_.clear();
+  response_.reset();
+}
+
+void Filter::replay(const StoredResponse& response) {
+  ENVOY_LOG(debug, "replaying the stored response of the idempotency key");
+  auto headers = Envoy::Http::ResponseHeaderMapImpl::create();
+  for (const auto& header : response.headers) {
+    headers->addCopy(Envoy::Http::LowerCaseString(header.first),
+                     header.second);
+  }
+  headers->setCopy(kReplayedHeader, "true");
+
+  decoder_callbacks_->streamInfo().setResponseCodeDetails(
+      utils::generateRcDetails(utils::kRcDetailFilterIdempotency,
+                               kRcDetailTypeReplayed));
+  const bool has_trailers = !response.trailers.empty();
+  decoder_callbacks_->encodeHeaders(std::move(headers),
+                                    response.body.empty() && !has_trailers);
+  if (!response.body.empty()) {
+    Envoy::Buffer::OwnedImpl body(response.body);
+    decoder_callbacks_->encodeData(body, !has_trailers);
+  }
+  if (has_trailers) {
+    auto trailers = Envoy::Http::ResponseTrailerMapImpl::create();
+    for (const auto& trailer : response.trailers) {
+      trailers->addCopy(Envoy::Http::LowerCaseString(trailer.first),
+                        trailer.second);
+    }
+    decoder_callbacks_->encodeTrailers(std::move(trailers));
+  }
+}
+
+void Filter::rejectRequest(Envoy::Http::Code code, absl::string_view error_msg,
+                           absl::string_view details) {
+  ENVOY_LOG(debug, "{}", error_msg);
+  decoder_callbacks_->sendLocalReply(code, error_msg, nullptr, absl::nullopt,
+                                     details);
+}
+
+}  // namespace idempotency
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,70 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "common/common/logger.h"
+#include "envoy/http/filter.h"
+#include "envoy/http/header_map.h"
+#include "extensions/filters/http/common/pass_through_filter.h"
+#include "src/envoy/http/idempotency/filter_config.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace idempotency {
+
+// Deduplicates the requests with the same idempotency key: the in-flight
+// duplicates get a 409, the completed ones get the stored response.
+class Filter : public Envoy::Http::PassThroughFilter,
+               public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
+ public:
+  Filter(FilterConfigSharedPtr config) : config_(config) {}
+
+  // Envoy::Http::StreamFilterBase
+  void onDestroy() override;
+
+  // Envoy::Http::StreamDecoderFilter
+  Envoy::Http::FilterHeadersStatus decodeHeaders(Envoy::Http::RequestHeaderMap&,
+                                                 bool) override;
+
+  // Envoy::Http::StreamEncoderFilter
+  Envoy::Http::FilterHeadersStatus encodeHeaders(
+      Envoy::Http::ResponseHeaderMap& headers, bool end_stream) override;
+  Envoy::Http::FilterDataStatus encodeData(Envoy::Buffer::Instance& data,
+                                           bool end_stream) override;
+  Envoy::Http::FilterTrailersStatus encodeTrailers(
+      Envoy::Http::ResponseTrailerMap& trailers) override;
+
+ private:
+  void replay(const StoredResponse& response);
+  void rejectRequest(Envoy::Http::Code code, absl::string_view error_msg,
+                     absl::string_view details);
+  // Stores the response, or forgets the key if the response is not stored.
+  void finish(bool store);
+
+  const FilterConfigSharedPtr config_;
+
+  // The store key of the started request, empty if not started.
+  std::string key_;
+  // The response being stored.
+  std::unique_ptr<StoredResponse> response_;
+};
+
+}  // namespace idempotency
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
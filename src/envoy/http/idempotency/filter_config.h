@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "api/envoy/v9/http/idempotency/config.pb.h"
+#include "envoy/common/time.h"
+#include "envoy/http/header_map.h"
+#include "envoy/router/router.h"
+#include "envoy/stats/scope.h"
+#include "envoy/stats/stats_macros.h"
+#include "google/protobuf/util/time_util.h"
+#include "src/envoy/http/idempotency/response_store.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace idempotency {
+
+// The filter name.
+constexpr const char kFilterName[] =
+    "com.google.espv2.filters.http.idempotency";
+
+constexpr uint32_t kDefaultMaxEntries = 1000;
+constexpr uint32_t kDefaultMaxResponseBytes = 65536;
+
+/**
+ * All stats for the idempotency filter. @see stats_macros.h
+ */
+#define ALL_IDEMPOTENCY_FILTER_STATS(COUNTER) \
+  COUNTER(started)                            \
+  COUNTER(replayed)                           \
+  COUNTER(denied_by_in_flight)                \
+  COUNTER(denied_by_path_mismatch)            \
+  COUNTER(store_full)                         \
+  COUNTER(not_stored)
+
+/**
+ * Wrapper struct for idempotency filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_IDEMPOTENCY_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+// The ttl of the keys of the filter config.
+inline std::chrono::milliseconds storeTtl(
+    const ::espv2::api::envoy::v9::http::idempotency::FilterConfig& proto) {
+  return std::chrono::milliseconds(
+      ::google::protobuf::util::TimeUtil::DurationToMilliseconds(
+          proto.ttl()));
+}
+
+// The max entries of the store of the filter config.
+inline uint32_t storeMaxEntries(
+    const ::espv2::api::envoy::v9::http::idempotency::FilterConfig& proto) {
+  return proto.max_entries() > 0 ? proto.max_entries() : kDefaultMaxEntries;
+}
+
+class FilterConfig {
+ public:
+  // The store is the singleton of the filter configs, its limits are set to
+  // the ones of this config.
+  FilterConfig(
+      const ::espv2::api::envoy::v9::http::idempotency::FilterConfig& proto,
+      ResponseStoreSharedPtr store, const std::string& stats_prefix,
+      Envoy::Stats::Scope& scope)
+      : key_header_(proto.key_header()),
+        max_response_bytes_(proto.max_response_bytes() > 0
+                                ? proto.max_response_bytes()
+                                : kDefaultMaxResponseBytes),
+        store_(std::move(store)),
+        stats_(generateStats(stats_prefix, scope)) {
+    store_->setLimits(storeTtl(proto), storeMaxEntries(proto));
+  }
+
+  const Envoy::Http::LowerCaseString& key_header() const {
+    return key_header_;
+  }
+  uint32_t max_response_bytes() const { return max_response_bytes_; }
+  ResponseStore& store() { return *store_; }
+  FilterStats& stats() { return stats_; }
+
+ private:
+  FilterStats generateStats(const std::string& prefix,
+                            Envoy::Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "idempotency.";
+    return {ALL_IDEMPOTENCY_FILTER_STATS(
+        POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  const Envoy::Http::LowerCaseString key_header_;
+  const uint32_t max_response_bytes_;
+  // The store shared by the filters of all the worker threads and the
+  // filter configs.
+  ResponseStoreSharedPtr store_;
+  // The stats
+  FilterStats stats_;
+};
+
+using FilterConfigSharedPtr = std::shared_ptr<FilterConfig>;
+
+class PerRouteFilterConfig : public Envoy::Router::RouteSpecificFilterConfig {
+ public:
+  PerRouteFilterConfig(
+      const ::espv2::api::envoy::v9::http::idempotency::PerRouteFilterConfig&
+          proto)
+      : operation_name_(proto.operation_name()) {}
+
+  absl::string_view operation_name() const { return operation_name_; }
+
+ private:
+  const std::string operation_name_;
+};
+
+}  // namespace idempotency
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
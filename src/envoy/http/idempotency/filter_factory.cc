@@ -0,0 +1,80 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "api/envoy/v9/http/idempotency/config.pb.h"
+#include "api/envoy/v9/http/idempotency/config.pb.validate.h"
+#include "envoy/registry/registry.h"
+#include "envoy/singleton/manager.h"
+#include "extensions/filters/http/common/factory_base.h"
+#include "src/envoy/http/idempotency/filter.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace idempotency {
+
+SINGLETON_MANAGER_REGISTRATION(idempotency_response_store);
+
+/**
+ * Config registration for ESPv2 idempotency filter.
+ */
+class FilterFactory
+    : public Envoy::Extensions::HttpFilters::Common::FactoryBase<
+          ::espv2::api::envoy::v9::http::idempotency::FilterConfig,
+          ::espv2::api::envoy::v9::http::idempotency::PerRouteFilterConfig> {
+ public:
+  FilterFactory() : FactoryBase(kFilterName) {}
+
+ private:
+  Envoy::Http::FilterFactoryCb createFilterFactoryFromProtoTyped(
+      const ::espv2::api::envoy::v9::http::idempotency::FilterConfig&
+          proto_config,
+      const std::string& stats_prefix,
+      Envoy::Server::Configuration::FactoryContext& context) override {
+    auto store = context.singletonManager().getTyped<ResponseStore>(
+        SINGLETON_MANAGER_REGISTERED_NAME(idempotency_response_store),
+        [&context, &proto_config] {
+          return std::make_shared<ResponseStore>(
+              context.timeSource(), storeTtl(proto_config),
+              storeMaxEntries(proto_config));
+        });
+    auto filter_config = std::make_shared<FilterConfig>(
+        proto_config, store, stats_prefix, context.scope());
+    return [filter_config](
+               Envoy::Http::FilterChainFactoryCallbacks& callbacks) -> void {
+      callbacks.addStreamFilter(std::make_shared<Filter>(filter_config));
+    };
+  }
+
+  Envoy::Router::RouteSpecificFilterConfigConstSharedPtr
+  createRouteSpecificFilterConfigTyped(
+      const ::espv2::api::envoy::v9::http::idempotency::PerRouteFilterConfig&
+          per_route,
+      Envoy::Server::Configuration::ServerFactoryContext&,
+      Envoy::ProtobufMessage::ValidationVisitor&) override {
+    return std::make_shared<PerRouteFilterConfig>(per_route);
+  }
+};
+
+/**
+ * Static registration for the idempotency filter. @see RegisterFactory.
+ */
+static Envoy::Registry::RegisterFactory<
+    FilterFactory, Envoy::Server::Configuration::NamedHttpFilterConfigFactory>
+    register_;
+
+}  // namespace idempotency
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,211 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/idempotency/filter.h"
+
+#include "common/buffer/buffer_impl.h"
+#include "common/common/empty_string.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/router/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/simulated_time_system.h"
+#include "test/test_common/utility.h"
+
+using ::testing::_;
+using ::testing::Invoke;
+using ::testing::NiceMock;
+using ::testing::Return;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace idempotency {
+namespace {
+
+constexpr char kFilterConfig[] = R"(
+key_header: "idempotency-key"
+ttl:
+  seconds: 60
+)";
+
+class IdempotencyFilterTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    ::espv2::api::envoy::v9::http::idempotency::FilterConfig proto_config;
+    Envoy::TestUtility::loadFromYaml(kFilterConfig, proto_config);
+    config_ = std::make_shared<FilterConfig>(
+        proto_config,
+        std::make_shared<ResponseStore>(test_time_, storeTtl(proto_config),
+                                        storeMaxEntries(proto_config)),
+        Envoy::EMPTY_STRING, mock_factory_context_.scope_);
+
+    ::espv2::api::envoy::v9::http::idempotency::PerRouteFilterConfig
+        per_route_config;
+    per_route_config.set_operation_name("bookstore.CreateShelf");
+    per_route_ = std::make_shared<PerRouteFilterConfig>(per_route_config);
+    mock_route_ = std::make_shared<NiceMock<Envoy::Router::MockRoute>>();
+  }
+
+  std::unique_ptr<Filter> makeFilter(
+      NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks>& decoder_cb) {
+    EXPECT_CALL(decoder_cb, route()).WillRepeatedly(Return(mock_route_));
+    auto filter = std::make_unique<Filter>(config_);
+    filter->setDecoderFilterCallbacks(decoder_cb);
+    filter->setEncoderFilterCallbacks(mock_encoder_callbacks_);
+    return filter;
+  }
+
+  void setPerRoute() {
+    EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+        .WillRepeatedly(
+            Invoke([this](const std::string&)
+                       -> const Envoy::Router::RouteSpecificFilterConfig* {
+              return per_route_.get();
+            }));
+  }
+
+  // Sends a request with the key through a filter and returns its filter.
+  std::unique_ptr<Filter> sendRequest(
+      NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks>& decoder_cb,
+      Envoy::Http::FilterHeadersStatus want_status,
+      const std::string& path = "/shelves") {
+    auto filter = makeFilter(decoder_cb);
+    Envoy::Http::TestRequestHeaderMapImpl headers{
+        {":method", "POST"}, {":path", path}, {"idempotency-key", "abc"}};
+    EXPECT_EQ(want_status, filter->decodeHeaders(headers, false));
+    return filter;
+  }
+
+  uint64_t counter(const std::string& name) {
+    return Envoy::TestUtility::findCounter(mock_factory_context_.scope_,
+                                           "idempotency." + name)
+        ->value();
+  }
+
+  Envoy::Event::SimulatedTimeSystem test_time_;
+  FilterConfigSharedPtr config_;
+  std::shared_ptr<PerRouteFilterConfig> per_route_;
+  NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+  std::shared_ptr<NiceMock<Envoy::Router::MockRoute>> mock_route_;
+  NiceMock<Envoy::Http::MockStreamEncoderFilterCallbacks>
+      mock_encoder_callbacks_;
+};
+
+TEST_F(IdempotencyFilterTest, NoPerRouteConfig) {
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> decoder_cb;
+  sendRequest(decoder_cb, Envoy::Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(counter("started"), 0);
+}
+
+TEST_F(IdempotencyFilterTest, NoIdempotencyKey) {
+  setPerRoute();
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> decoder_cb;
+  auto filter = makeFilter(decoder_cb);
+  Envoy::Http::TestRequestHeaderMapImpl headers{{":method", "POST"},
+                                                {":path", "/shelves"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter->decodeHeaders(headers, false));
+  EXPECT_EQ(counter("started"), 0);
+}
+
+TEST_F(IdempotencyFilterTest, InFlightThenReplayed) {
+  setPerRoute();
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> first_cb;
+  auto first =
+      sendRequest(first_cb, Envoy::Http::FilterHeadersStatus::Continue);
+
+  // A duplicate while the first request is in flight.
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> in_flight_cb;
+  EXPECT_CALL(in_flight_cb,
+              sendLocalReply(Envoy::Http::Code::Conflict, _, _, _,
+                             "idempotency_request_in_progress"));
+  sendRequest(in_flight_cb, Envoy::Http::FilterHeadersStatus::StopIteration);
+
+  // The response of the first request completes.
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{
+      {":status", "201"}, {"content-type", "application/json"}};
+  first->encodeHeaders(response_headers, false);
+  Envoy::Buffer::OwnedImpl body(R"({"id":"1"})");
+  first->encodeData(body, true);
+  first->onDestroy();
+
+  // A duplicate gets the stored response.
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> replayed_cb;
+  EXPECT_CALL(replayed_cb, encodeHeaders_(_, false))
+      .WillOnce(Invoke([](Envoy::Http::ResponseHeaderMap& headers, bool) {
+        EXPECT_EQ(headers.getStatusValue(), "201");
+        EXPECT_EQ(headers.getContentTypeValue(), "application/json");
+        EXPECT_EQ(headers.get_("idempotent-replayed"), "true");
+      }));
+  EXPECT_CALL(replayed_cb, encodeData(_, true))
+      .WillOnce(Invoke([](Envoy::Buffer::Instance& data, bool) {
+        EXPECT_EQ(data.toString(), R"({"id":"1"})");
+      }));
+  sendRequest(replayed_cb, Envoy::Http::FilterHeadersStatus::StopIteration);
+
+  EXPECT_EQ(counter("started"), 1);
+  EXPECT_EQ(counter("denied_by_in_flight"), 1);
+  EXPECT_EQ(counter("replayed"), 1);
+}
+
+TEST_F(IdempotencyFilterTest, KeyReusedWithAnotherPath) {
+  setPerRoute();
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> first_cb;
+  auto first =
+      sendRequest(first_cb, Envoy::Http::FilterHeadersStatus::Continue);
+
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> second_cb;
+  EXPECT_CALL(second_cb,
+              sendLocalReply(Envoy::Http::Code::UnprocessableEntity, _, _, _,
+                             "idempotency_key_reused"));
+  sendRequest(second_cb, Envoy::Http::FilterHeadersStatus::StopIteration,
+              "/shelves?name=other");
+  EXPECT_EQ(counter("denied_by_path_mismatch"), 1);
+}
+
+TEST_F(IdempotencyFilterTest, ServerErrorNotStored) {
+  setPerRoute();
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> first_cb;
+  auto first =
+      sendRequest(first_cb, Envoy::Http::FilterHeadersStatus::Continue);
+  Envoy::Http::TestResponseHeaderMapImpl response_headers{{":status", "503"}};
+  first->encodeHeaders(response_headers, true);
+
+  // The retry is forwarded to the backend.
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> retry_cb;
+  sendRequest(retry_cb, Envoy::Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(counter("started"), 2);
+  EXPECT_EQ(counter("not_stored"), 1);
+}
+
+TEST_F(IdempotencyFilterTest, ResetRequestNotStored) {
+  setPerRoute();
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> first_cb;
+  auto first =
+      sendRequest(first_cb, Envoy::Http::FilterHeadersStatus::Continue);
+  first->onDestroy();
+
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> retry_cb;
+  sendRequest(retry_cb, Envoy::Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(counter("started"), 2);
+}
+
+}  // namespace
+}  // namespace idempotency
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
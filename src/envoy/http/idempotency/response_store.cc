@@ -0,0 +1,92 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/idempotency/response_store.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace idempotency {
+
+void ResponseStore::setLimits(std::chrono::milliseconds ttl,
+                              uint32_t max_entries) {
+  absl::MutexLock lock(&mutex_);
+  ttl_ = ttl;
+  max_entries_ = max_entries;
+}
+
+StartResult ResponseStore::start(const std::string& key,
+                                 absl::string_view path,
+                                 StoredResponseConstSharedPtr& response) {
+  const Envoy::MonotonicTime now = time_source_.monotonicTime();
+  absl::MutexLock lock(&mutex_);
+
+  auto it = entries_.find(key);
+  if (it != entries_.end() && it->second.expire_time <= now) {
+    entries_.erase(it);
+    it = entries_.end();
+  }
+  if (it != entries_.end()) {
+    if (it->second.path != path) {
+      return StartResult::PathMismatched;
+    }
+    if (it->second.response == nullptr) {
+      return StartResult::InFlight;
+    }
+    response = it->second.response;
+    return StartResult::Completed;
+  }
+
+  if (entries_.size() >= max_entries_) {
+    removeExpired(now);
+    if (entries_.size() >= max_entries_) {
+      return StartResult::Full;
+    }
+  }
+  entries_[key] = Entry{std::string(path), now + ttl_, nullptr};
+  return StartResult::Started;
+}
+
+void ResponseStore::complete(const std::string& key,
+                             StoredResponseConstSharedPtr response) {
+  const Envoy::MonotonicTime now = time_source_.monotonicTime();
+  absl::MutexLock lock(&mutex_);
+
+  auto it = entries_.find(key);
+  if (it == entries_.end()) {
+    return;
+  }
+  it->second.expire_time = now + ttl_;
+  it->second.response = std::move(response);
+}
+
+void ResponseStore::release(const std::string& key) {
+  absl::MutexLock lock(&mutex_);
+  entries_.erase(key);
+}
+
+void ResponseStore::removeExpired(Envoy::MonotonicTime now) {
+  for (auto it = entries_.begin(); it != entries_.end();) {
+    if (it->second.expire_time <= now) {
+      entries_.erase(it++);
+    } else {
+      ++it;
+    }
+  }
+}
+
+}  // namespace idempotency
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,110 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <chrono>
+#include <memory>
+#include <string>
+#include <utility>
+#include <vector>
+
+#include "absl/base/thread_annotations.h"
+#include "absl/container/flat_hash_map.h"
+#include "absl/strings/string_view.h"
+#include "absl/synchronization/mutex.h"
+#include "envoy/common/time.h"
+#include "envoy/singleton/instance.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace idempotency {
+
+using HeaderList = std::vector<std::pair<std::string, std::string>>;
+
+// A completed response, replayed to the requests with the same key.
+struct StoredResponse {
+  HeaderList headers;
+  std::string body;
+  HeaderList trailers;
+};
+
+using StoredResponseConstSharedPtr = std::shared_ptr<const StoredResponse>;
+
+// The outcome of ResponseStore::start.
+enum class StartResult {
+  // The key is new, the request is forwarded and its response is expected.
+  Started,
+  // A request with the key is still in flight.
+  InFlight,
+  // A request with the key completed, its response is replayed.
+  Completed,
+  // The key was used by a request with another path.
+  PathMismatched,
+  // The store is full, the request is forwarded without deduplication.
+  Full,
+};
+
+// Stores the state of the idempotency keys, shared by all the worker threads.
+// Both the in-flight and the completed keys expire after the ttl.
+//
+// It is a singleton shared by the filter configs, so the keys outlive the
+// listener updates.
+class ResponseStore : public Envoy::Singleton::Instance {
+ public:
+  ResponseStore(Envoy::TimeSource& time_source, std::chrono::milliseconds ttl,
+                uint32_t max_entries)
+      : time_source_(time_source), ttl_(ttl), max_entries_(max_entries) {}
+
+  // Sets the ttl and the max entries of a new filter config. The stored keys
+  // keep their expire time.
+  void setLimits(std::chrono::milliseconds ttl, uint32_t max_entries);
+
+  // Starts a request with the key, unless the key is already in the store.
+  // On Completed, sets the response to replay.
+  StartResult start(const std::string& key, absl::string_view path,
+                    StoredResponseConstSharedPtr& response);
+
+  // Stores the response of the started request with the key.
+  void complete(const std::string& key, StoredResponseConstSharedPtr response);
+
+  // Forgets the started request with the key, so it can be retried.
+  void release(const std::string& key);
+
+ private:
+  struct Entry {
+    std::string path;
+    Envoy::MonotonicTime expire_time;
+    // Not set while the request is in flight.
+    StoredResponseConstSharedPtr response;
+  };
+
+  void removeExpired(Envoy::MonotonicTime now)
+      ABSL_EXCLUSIVE_LOCKS_REQUIRED(mutex_);
+
+  Envoy::TimeSource& time_source_;
+
+  absl::Mutex mutex_;
+  std::chrono::milliseconds ttl_ ABSL_GUARDED_BY(mutex_);
+  uint32_t max_entries_ ABSL_GUARDED_BY(mutex_);
+  absl::flat_hash_map<std::string, Entry> entries_ ABSL_GUARDED_BY(mutex_);
+};
+
+using ResponseStoreSharedPtr = std::shared_ptr<ResponseStore>;
+
+}  // namespace idempotency
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,101 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/idempotency/response_store.h"
+
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/test_common/simulated_time_system.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace idempotency {
+namespace {
+
+class ResponseStoreTest : public ::testing::Test {
+ protected:
+  ResponseStoreTest() : store_(test_time_, std::chrono::seconds(60), 2) {}
+
+  StartResult start(const std::string& key, absl::string_view path = "/v1") {
+    StoredResponseConstSharedPtr response;
+    return store_.start(key, path, response);
+  }
+
+  Envoy::Event::SimulatedTimeSystem test_time_;
+  ResponseStore store_;
+};
+
+TEST_F(ResponseStoreTest, InFlightThenCompleted) {
+  EXPECT_EQ(start("key"), StartResult::Started);
+  EXPECT_EQ(start("key"), StartResult::InFlight);
+
+  auto stored = std::make_shared<StoredResponse>();
+  stored->body = "body";
+  store_.complete("key", stored);
+
+  StoredResponseConstSharedPtr response;
+  EXPECT_EQ(store_.start("key", "/v1", response), StartResult::Completed);
+  EXPECT_EQ(response->body, "body");
+}
+
+TEST_F(ResponseStoreTest, PathMismatched) {
+  EXPECT_EQ(start("key", "/v1"), StartResult::Started);
+  EXPECT_EQ(start("key", "/v2"), StartResult::PathMismatched);
+}
+
+TEST_F(ResponseStoreTest, Released) {
+  EXPECT_EQ(start("key"), StartResult::Started);
+  store_.release("key");
+  EXPECT_EQ(start("key"), StartResult::Started);
+}
+
+TEST_F(ResponseStoreTest, Expired) {
+  EXPECT_EQ(start("key"), StartResult::Started);
+  store_.complete("key", std::make_shared<StoredResponse>());
+
+  test_time_.advanceTimeWait(std::chrono::seconds(61));
+  EXPECT_EQ(start("key"), StartResult::Started);
+}
+
+TEST_F(ResponseStoreTest, Full) {
+  EXPECT_EQ(start("key1"), StartResult::Started);
+  EXPECT_EQ(start("key2"), StartResult::Started);
+  EXPECT_EQ(start("key3"), StartResult::Full);
+
+  // The expired entries make room for the new ones.
+  test_time_.advanceTimeWait(std::chrono::seconds(61));
+  EXPECT_EQ(start("key3"), StartResult::Started);
+}
+
+TEST_F(ResponseStoreTest, LimitsUpdated) {
+  EXPECT_EQ(start("key1"), StartResult::Started);
+  EXPECT_EQ(start("key2"), StartResult::Started);
+
+  // The keys are kept with the limits of a new filter config.
+  store_.setLimits(std::chrono::seconds(10), 3);
+  EXPECT_EQ(start("key1"), StartResult::InFlight);
+  EXPECT_EQ(start("key3"), StartResult::Started);
+  EXPECT_EQ(start("key4"), StartResult::Full);
+
+  test_time_.advanceTimeWait(std::chrono::seconds(11));
+  EXPECT_EQ(start("key1"), StartResult::InFlight);
+  EXPECT_EQ(start("key3"), StartResult::Started);
+}
+
+}  // namespace
+}  // namespace idempotency
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -31,6 +31,9 @@ class ConfigParser {
 
   // Get the url template
   virtual absl::string_view url_template() const PURE;
+
+  // Get the header to send the original path in, empty if not sent.
+  virtual absl::string_view original_path_header() const PURE;
 };
 
 using ConfigParserPtr = std::unique_ptr<ConfigParser>;
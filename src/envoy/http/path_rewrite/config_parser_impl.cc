@@ -15,6 +15,8 @@
 #include "src/envoy/http/path_rewrite/config_parser_impl.h"
 
 #include "absl/strings/str_cat.h"
+#include "absl/strings/str_join.h"
+#include "absl/strings/str_split.h"
 #include "common/common/empty_string.h"
 #include "src/api_proxy/path_matcher/variable_binding_utils.h"
 
@@ -27,6 +29,21 @@ namespace {
 // Use fixed HTTP method for path_matcher
 constexpr const char kHttpMethod[] = "GET";
 
+using ::espv2::api::envoy::v9::http::path_rewrite::ConstantPath;
+
+// Remove the query parameters with one of the names.
+std::string removeQueryParams(absl::string_view query,
+                              const absl::flat_hash_set<std::string>& names) {
+  std::vector<absl::string_view> kept;
+  for (absl::string_view param : absl::StrSplit(query, '&')) {
+    absl::string_view name = param.substr(0, param.find('='));
+    if (!names.contains(name)) {
+      kept.push_back(param);
+    }
+  }
+  return absl::StrJoin(kept, "&");
+}
+
 }  // namespace
 
 ConfigParserImpl::ConfigParserImpl(
@@ -84,8 +101,16 @@ absl::string_view ConfigParserImpl::url_template() const {
   return Envoy::EMPTY_STRING;
 }
 
-bool ConfigParserImpl::getVariableBindings(const std::string& origin_path,
-                                           std::string& query) const {
+absl::string_view ConfigParserImpl::original_path_header() const {
+  if (config_.has_constant_path()) {
+    return config_.constant_path().original_path_header();
+  }
+  return Envoy::EMPTY_STRING;
+}
+
+bool ConfigParserImpl::getVariableBindings(
+    const std::string& origin_path, std::string& query,
+    absl::flat_hash_set<std::string>& names) const {
   query = Envoy::EMPTY_STRING;
   if (!path_matcher_) {
     return true;
@@ -106,13 +131,18 @@ bool ConfigParserImpl::getVariableBindings(const std::string& origin_path,
         variable_bindings);
     ENVOY_LOG(debug, "Extracted query parameters: {}", query);
   }
+  for (const auto& variable_binding : variable_bindings) {
+    names.insert(absl::StrJoin(variable_binding.field_path, "."));
+  }
   return true;
 }
 
 bool ConfigParserImpl::constPath(const std::string& origin_path,
                                  std::string& new_path) const {
   std::string extracted_query_params;
-  if (!getVariableBindings(origin_path, extracted_query_params)) {
+  absl::flat_hash_set<std::string> variable_names;
+  if (!getVariableBindings(origin_path, extracted_query_params,
+                           variable_names)) {
     return false;
   }
 
@@ -120,6 +150,27 @@ bool ConfigParserImpl::constPath(const std::string& origin_path,
   new_path = path_cfg.path();
 
   std::size_t originalQueryParamPos = origin_path.find('?');
+  if (originalQueryParamPos != std::string::npos &&
+      path_cfg.query_params() != ConstantPath::PRESERVE) {
+    std::string query_params;
+    if (path_cfg.query_params() == ConstantPath::MERGE) {
+      query_params = removeQueryParams(
+          absl::string_view(origin_path).substr(originalQueryParamPos + 1),
+          variable_names);
+    }
+    if (!extracted_query_params.empty()) {
+      query_params = query_params.empty()
+                         ? extracted_query_params
+                         : absl::StrCat(query_params, "&",
+                                        extracted_query_params);
+    }
+    if (!query_params.empty()) {
+      absl::StrAppend(&new_path, "?", query_params);
+    }
+    ENVOY_LOG(debug, "Use constant path, new path: {}", new_path);
+    return true;
+  }
+
   if (originalQueryParamPos == std::string::npos) {
     // No query param in original request.
     if (!extracted_query_params.empty()) {
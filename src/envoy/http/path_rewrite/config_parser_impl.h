@@ -13,6 +13,7 @@
 // limitations under the License.
 #pragma once
 
+#include "absl/container/flat_hash_set.h"
 #include "api/envoy/v9/http/path_rewrite/config.pb.h"
 #include "api/envoy/v9/http/path_rewrite/config.pb.validate.h"
 #include "common/common/logger.h"
@@ -37,12 +38,14 @@ class ConfigParserImpl
 
   absl::string_view url_template() const override;
 
+  absl::string_view original_path_header() const override;
+
  private:
   // rewrite const path.
   bool constPath(const std::string& origin_path, std::string& new_path) const;
-  // extract query parameters from variable bindings
-  bool getVariableBindings(const std::string& origin_path,
-                           std::string& query) const;
+  // extract query parameters from variable bindings, and their names.
+  bool getVariableBindings(const std::string& origin_path, std::string& query,
+                           absl::flat_hash_set<std::string>& names) const;
 
   // the per-route config
   ::espv2::api::envoy::v9::http::path_rewrite::PerRouteFilterConfig config_;
@@ -210,6 +210,52 @@ TEST_F(ConfigParserImplTest, ConstantPathNoUrlTemplateRoot) {
   EXPECT_EQ(new_path_, "/?xyz=123");
 }
 
+TEST_F(ConfigParserImplTest, ConstantPathMergeQueryParams) {
+  setUp(R"(
+  constant_path: {
+     path: "/foo"
+     url_template: "/bar/{abc}"
+     query_params: MERGE
+  }
+)");
+
+  // /bar/567?abc=1&xyz=123 => /foo?xyz=123&abc=567
+  EXPECT_TRUE(obj_->rewrite("/bar/567?abc=1&xyz=123", new_path_));
+  EXPECT_EQ(new_path_, "/foo?xyz=123&abc=567");
+
+  // /bar/567?abc=1 => /foo?abc=567
+  EXPECT_TRUE(obj_->rewrite("/bar/567?abc=1", new_path_));
+  EXPECT_EQ(new_path_, "/foo?abc=567");
+}
+
+TEST_F(ConfigParserImplTest, ConstantPathDropQueryParams) {
+  setUp(R"(
+  constant_path: {
+     path: "/foo"
+     url_template: "/bar/{abc}"
+     query_params: DROP
+  }
+)");
+
+  // /bar/567?xyz=123 => /foo?abc=567
+  EXPECT_TRUE(obj_->rewrite("/bar/567?xyz=123", new_path_));
+  EXPECT_EQ(new_path_, "/foo?abc=567");
+
+  // /bar/567 => /foo?abc=567
+  EXPECT_TRUE(obj_->rewrite("/bar/567", new_path_));
+  EXPECT_EQ(new_path_, "/foo?abc=567");
+}
+
+TEST_F(ConfigParserImplTest, ConstantPathOriginalPathHeader) {
+  setUp(R"(
+  constant_path: {
+     path: "/foo"
+     original_path_header: "x-original-path"
+  }
+)");
+  EXPECT_EQ(obj_->original_path_header(), "x-original-path");
+}
+
 }  // namespace path_rewrite
 }  // namespace http_filters
 }  // namespace envoy
@@ -129,6 +129,14 @@ FilterHeadersStatus Filter::decodeHeaders(RequestHeaderMap& headers, bool) {
   if (!headers.EnvoyOriginalPath()) {
     headers.setEnvoyOriginalPath(headers.getPathValue());
   }
+  // Overwrite the header sent by the client, if any.
+  absl::string_view original_path_header =
+      per_route->config_parser().original_path_header();
+  if (!original_path_header.empty()) {
+    headers.setCopy(
+        Envoy::Http::LowerCaseString(std::string(original_path_header)),
+        original_path);
+  }
   headers.setPath(new_path);
   return FilterHeadersStatus::Continue;
 }
@@ -245,6 +245,7 @@ TEST_F(FilterTest, PathUpdated) {
   // path changed.
   EXPECT_EQ(headers.Path()->value().getStringView(), "/tree/2");
   EXPECT_EQ(headers.EnvoyOriginalPath()->value().getStringView(), "/books/1");
+  EXPECT_FALSE(headers.has("x-original-path"));
 
   // Stats.
   const Envoy::Stats::CounterSharedPtr counter =
@@ -253,6 +254,32 @@ TEST_F(FilterTest, PathUpdated) {
   EXPECT_EQ(counter->value(), 1);
 }
 
+TEST_F(FilterTest, OriginalPathHeaderOverwritten) {
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "GET"},
+      {":path", "/books/1?a=1"},
+      {"x-original-path", "/spoofed"}};
+  EXPECT_CALL(mock_decoder_callbacks_, route())
+      .WillRepeatedly(Return(mock_route_));
+  EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+      .WillRepeatedly(Return(per_route_config_.get()));
+
+  EXPECT_CALL(*raw_mock_parser_, rewrite("/books/1?a=1", _))
+      .WillOnce(Invoke([](absl::string_view, std::string& new_path) -> bool {
+        new_path = "/tree";
+        return true;
+      }));
+  EXPECT_CALL(*raw_mock_parser_, original_path_header())
+      .WillOnce(Return("X-Original-Path"));
+
+  Envoy::Http::FilterHeadersStatus status =
+      filter_->decodeHeaders(headers, false);
+
+  EXPECT_EQ(status, Envoy::Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(headers.Path()->value().getStringView(), "/tree");
+  EXPECT_EQ(headers.get_("x-original-path"), "/books/1?a=1");
+}
+
 }  // namespace path_rewrite
 }  // namespace http_filters
 }  // namespace envoy
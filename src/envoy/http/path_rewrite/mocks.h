@@ -25,6 +25,7 @@ class MockConfigParser : public ConfigParser {
   MOCK_METHOD(bool, rewrite,
               (absl::string_view origin_path, std::string& new_path), (const));
   MOCK_METHOD(absl::string_view, url_template, (), (const));
+  MOCK_METHOD(absl::string_view, original_path_header, (), (const));
 };
 
 }  // namespace path_rewrite
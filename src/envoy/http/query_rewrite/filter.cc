@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/query_rewrite/filter.h"
+
+#include <vector>
+
+#include "absl/strings/match.h"
+#include "absl/strings/str_cat.h"
+#include "absl/strings/str_join.h"
+#include "absl/strings/str_split.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace query_rewrite {
+
+using Envoy::Http::FilterHeadersStatus;
+
+namespace {
+
+constexpr absl::string_view kArrayBrackets = "[]";
+constexpr absl::string_view kEncodedArrayBrackets = "%5B%5D";
+
+// Strips the suffix from the name, unless it is the whole name.
+bool stripSuffix(absl::string_view& name, absl::string_view suffix) {
+  if (name.size() <= suffix.size() || !absl::EndsWithIgnoreCase(name, suffix)) {
+    return false;
+  }
+  name.remove_suffix(suffix.size());
+  return true;
+}
+
+}  // namespace
+
+bool stripArrayBrackets(absl::string_view path, std::string& new_path) {
+  const size_t query_start = path.find('?');
+  if (query_start == absl::string_view::npos) {
+    return false;
+  }
+
+  bool changed = false;
+  std::vector<std::string> params;
+  for (absl::string_view param :
+       absl::StrSplit(path.substr(query_start + 1), '&')) {
+    const size_t value_start = param.find('=');
+    absl::string_view name = param.substr(0, value_start);
+    absl::string_view value = value_start == absl::string_view::npos
+                                  ? absl::string_view()
+                                  : param.substr(value_start);
+    if (stripSuffix(name, kArrayBrackets) ||
+        stripSuffix(name, kEncodedArrayBrackets)) {
+      changed = true;
+    }
+    params.push_back(absl::StrCat(name, value));
+  }
+  if (!changed) {
+    return false;
+  }
+
+  new_path = absl::StrCat(path.substr(0, query_start + 1),
+                          absl::StrJoin(params, "&"));
+  return true;
+}
+
+FilterHeadersStatus Filter::decodeHeaders(
+    Envoy::Http::RequestHeaderMap& headers, bool) {
+  auto route = decoder_callbacks_->route();
+  if (route == nullptr || route->routeEntry() == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+  const auto* per_route =
+      route->routeEntry()->perFilterConfigTyped<PerRouteFilterConfig>(
+          kFilterName);
+  if (per_route == nullptr || headers.Path() == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  std::string new_path;
+  if (!stripArrayBrackets(headers.getPathValue(), new_path)) {
+    config_->stats().query_not_changed_.inc();
+    return FilterHeadersStatus::Continue;
+  }
+
+  ENVOY_LOG(debug, "query parameters rewritten to {}", new_path);
+  config_->stats().query_rewritten_.inc();
+  headers.setPath(new_path);
+  return FilterHeadersStatus::Continue;
+}
+
+}  // namespace query_rewrite
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,55 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "absl/strings/string_view.h"
+#include "common/common/logger.h"
+#include "envoy/http/filter.h"
+#include "envoy/http/header_map.h"
+#include "extensions/filters/http/common/pass_through_filter.h"
+#include "src/envoy/http/query_rewrite/filter_config.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace query_rewrite {
+
+// Strips the "[]" suffix from the names of the query parameters of the
+// request, so the grpc_json_transcoder filter behind it binds the
+// "param[]=a&param[]=b" style to the repeated fields.
+class Filter : public Envoy::Http::PassThroughDecoderFilter,
+               public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
+ public:
+  Filter(FilterConfigSharedPtr config) : config_(config) {}
+
+  // Envoy::Http::StreamDecoderFilter
+  Envoy::Http::FilterHeadersStatus decodeHeaders(
+      Envoy::Http::RequestHeaderMap& headers, bool end_stream) override;
+
+ private:
+  const FilterConfigSharedPtr config_;
+};
+
+// Sets new_path to the path with the "[]" suffix, plain or percent-encoded,
+// stripped from the names of its query parameters. Returns false if no name
+// has it.
+bool stripArrayBrackets(absl::string_view path, std::string& new_path);
+
+}  // namespace query_rewrite
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
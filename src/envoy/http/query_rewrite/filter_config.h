@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "api/envoy/v9/http/query_rewrite/config.pb.h"
+#include "envoy/router/router.h"
+#include "envoy/stats/scope.h"
+#include "envoy/stats/stats_macros.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace query_rewrite {
+
+// The filter name.
+constexpr const char kFilterName[] =
+    "com.google.espv2.filters.http.query_rewrite";
+
+/**
+ * All stats for the query rewrite filter. @see stats_macros.h
+ */
+#define ALL_QUERY_REWRITE_FILTER_STATS(COUNTER) \
+  COUNTER(query_rewritten)                      \
+  COUNTER(query_not_changed)
+
+/**
+ * Wrapper struct for query rewrite filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_QUERY_REWRITE_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+class FilterConfig {
+ public:
+  FilterConfig(const std::string& stats_prefix, Envoy::Stats::Scope& scope)
+      : stats_(generateStats(stats_prefix, scope)) {}
+
+  FilterStats& stats() { return stats_; }
+
+ private:
+  FilterStats generateStats(const std::string& prefix,
+                            Envoy::Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "query_rewrite.";
+    return {ALL_QUERY_REWRITE_FILTER_STATS(
+        POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  // The stats
+  FilterStats stats_;
+};
+
+using FilterConfigSharedPtr = std::shared_ptr<FilterConfig>;
+
+// The per-route config has no field, the filter is enabled for the routes
+// having it.
+class PerRouteFilterConfig : public Envoy::Router::RouteSpecificFilterConfig {};
+
+}  // namespace query_rewrite
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
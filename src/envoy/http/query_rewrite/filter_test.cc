@@ -0,0 +1,117 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/query_rewrite/filter.h"
+
+#include "common/common/empty_string.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/router/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/utility.h"
+
+using ::testing::NiceMock;
+using ::testing::Return;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace query_rewrite {
+namespace {
+
+class QueryRewriteFilterTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    mock_route_ = std::make_shared<NiceMock<Envoy::Router::MockRoute>>();
+    EXPECT_CALL(mock_decoder_callbacks_, route())
+        .WillRepeatedly(Return(mock_route_));
+    config_ = std::make_shared<FilterConfig>(Envoy::EMPTY_STRING,
+                                             mock_factory_context_.scope_);
+    filter_ = std::make_unique<Filter>(config_);
+    filter_->setDecoderFilterCallbacks(mock_decoder_callbacks_);
+  }
+
+  void setPerRoute() {
+    per_route_ = std::make_shared<PerRouteFilterConfig>();
+    EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+        .WillRepeatedly(Return(per_route_.get()));
+  }
+
+  uint64_t counter(const std::string& name) {
+    return Envoy::TestUtility::findCounter(mock_factory_context_.scope_,
+                                           "query_rewrite." + name)
+        ->value();
+  }
+
+  FilterConfigSharedPtr config_;
+  std::shared_ptr<PerRouteFilterConfig> per_route_;
+  NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+  std::shared_ptr<NiceMock<Envoy::Router::MockRoute>> mock_route_;
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks>
+      mock_decoder_callbacks_;
+  std::unique_ptr<Filter> filter_;
+};
+
+TEST_F(QueryRewriteFilterTest, NoPerRouteConfig) {
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "GET"}, {":path", "/v1/books?tag[]=a&tag[]=b"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(headers, true));
+
+  EXPECT_EQ(headers.getPathValue(), "/v1/books?tag[]=a&tag[]=b");
+  EXPECT_EQ(counter("query_rewritten"), 0);
+}
+
+TEST_F(QueryRewriteFilterTest, StripArrayBrackets) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "GET"}, {":path", "/v1/books?tag[]=a&tag%5b%5d=b&page=2"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(headers, true));
+
+  EXPECT_EQ(headers.getPathValue(), "/v1/books?tag=a&tag=b&page=2");
+  EXPECT_EQ(counter("query_rewritten"), 1);
+}
+
+TEST_F(QueryRewriteFilterTest, QueryNotChanged) {
+  setPerRoute();
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "GET"}, {":path", "/v1/books?tag=a&tag=b&shelf.id=1"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(headers, true));
+
+  EXPECT_EQ(headers.getPathValue(), "/v1/books?tag=a&tag=b&shelf.id=1");
+  EXPECT_EQ(counter("query_not_changed"), 1);
+}
+
+TEST(StripArrayBracketsTest, StripArrayBrackets) {
+  std::string new_path;
+  EXPECT_FALSE(stripArrayBrackets("/v1/books", new_path));
+  EXPECT_FALSE(stripArrayBrackets("/v1/books?tag=a", new_path));
+  // A name of only brackets, and brackets in the values, are kept.
+  EXPECT_FALSE(stripArrayBrackets("/v1/books?[]=a&tag=[]", new_path));
+
+  EXPECT_TRUE(stripArrayBrackets("/v1/books?tag[]", new_path));
+  EXPECT_EQ(new_path, "/v1/books?tag");
+  EXPECT_TRUE(stripArrayBrackets("/v1/books?tag%5B%5D=a&&x=1", new_path));
+  EXPECT_EQ(new_path, "/v1/books?tag=a&&x=1");
+}
+
+}  // namespace
+}  // namespace query_rewrite
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
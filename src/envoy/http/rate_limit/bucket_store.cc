@@ -0,0 +1,77 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/rate_limit/bucket_store.h"
+
+#include <algorithm>
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace rate_limit {
+
+ConsumeResult BucketStore::consume(const std::string& key,
+                                   uint32_t max_tokens,
+                                   std::chrono::milliseconds period) {
+  const Envoy::MonotonicTime now = time_source_.monotonicTime();
+  absl::MutexLock lock(&mutex_);
+
+  auto it = buckets_.find(key);
+  if (it == buckets_.end()) {
+    if (buckets_.size() >= max_buckets_) {
+      removeFull(now);
+      if (buckets_.size() >= max_buckets_) {
+        return ConsumeResult::Full;
+      }
+    }
+    it = buckets_
+             .emplace(key,
+                      Bucket{static_cast<double>(max_tokens), now, now})
+             .first;
+  }
+
+  Bucket& bucket = it->second;
+  const double elapsed_ms =
+      std::chrono::duration<double, std::milli>(now - bucket.refill_time)
+          .count();
+  bucket.tokens = std::min<double>(
+      max_tokens, bucket.tokens + elapsed_ms * max_tokens / period.count());
+  bucket.refill_time = now;
+  if (bucket.tokens < 1) {
+    return ConsumeResult::Denied;
+  }
+
+  bucket.tokens -= 1;
+  const double missing_ms =
+      (max_tokens - bucket.tokens) * period.count() / max_tokens;
+  bucket.full_time =
+      now + std::chrono::duration_cast<Envoy::MonotonicTime::duration>(
+                std::chrono::duration<double, std::milli>(missing_ms));
+  return ConsumeResult::Allowed;
+}
+
+void BucketStore::removeFull(Envoy::MonotonicTime now) {
+  for (auto it = buckets_.begin(); it != buckets_.end();) {
+    if (it->second.full_time <= now) {
+      buckets_.erase(it++);
+    } else {
+      ++it;
+    }
+  }
+}
+
+}  // namespace rate_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,76 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <chrono>
+#include <memory>
+#include <string>
+
+#include "absl/base/thread_annotations.h"
+#include "absl/container/flat_hash_map.h"
+#include "absl/synchronization/mutex.h"
+#include "envoy/common/time.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace rate_limit {
+
+// The outcome of BucketStore::consume.
+enum class ConsumeResult {
+  // A token was consumed, the request is allowed.
+  Allowed,
+  // The bucket is empty, the request is denied.
+  Denied,
+  // The store is full, the request is allowed without limit.
+  Full,
+};
+
+// Stores the token buckets of the api keys, shared by all the worker threads.
+// A bucket holds up to `max_tokens` tokens, refilled over the `period`.
+class BucketStore {
+ public:
+  BucketStore(Envoy::TimeSource& time_source, uint32_t max_buckets)
+      : time_source_(time_source), max_buckets_(max_buckets) {}
+
+  // Consumes a token from the bucket with the key, creating a full bucket if
+  // the key is new.
+  ConsumeResult consume(const std::string& key, uint32_t max_tokens,
+                        std::chrono::milliseconds period);
+
+ private:
+  struct Bucket {
+    double tokens;
+    Envoy::MonotonicTime refill_time;
+    // Once refilled up to max_tokens, the bucket is the same as a new one.
+    Envoy::MonotonicTime full_time;
+  };
+
+  void removeFull(Envoy::MonotonicTime now)
+      ABSL_EXCLUSIVE_LOCKS_REQUIRED(mutex_);
+
+  Envoy::TimeSource& time_source_;
+  const uint32_t max_buckets_;
+
+  absl::Mutex mutex_;
+  absl::flat_hash_map<std::string, Bucket> buckets_ ABSL_GUARDED_BY(mutex_);
+};
+
+using BucketStoreSharedPtr = std::shared_ptr<BucketStore>;
+
+}  // namespace rate_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,78 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/rate_limit/bucket_store.h"
+
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/test_common/simulated_time_system.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace rate_limit {
+namespace {
+
+class BucketStoreTest : public ::testing::Test {
+ protected:
+  BucketStoreTest() : store_(test_time_, 2) {}
+
+  ConsumeResult consume(const std::string& key) {
+    return store_.consume(key, 2, std::chrono::seconds(60));
+  }
+
+  Envoy::Event::SimulatedTimeSystem test_time_;
+  BucketStore store_;
+};
+
+TEST_F(BucketStoreTest, DeniedWhenEmpty) {
+  EXPECT_EQ(consume("key"), ConsumeResult::Allowed);
+  EXPECT_EQ(consume("key"), ConsumeResult::Allowed);
+  EXPECT_EQ(consume("key"), ConsumeResult::Denied);
+
+  // The other keys have their own buckets.
+  EXPECT_EQ(consume("other"), ConsumeResult::Allowed);
+}
+
+TEST_F(BucketStoreTest, Refilled) {
+  EXPECT_EQ(consume("key"), ConsumeResult::Allowed);
+  EXPECT_EQ(consume("key"), ConsumeResult::Allowed);
+  EXPECT_EQ(consume("key"), ConsumeResult::Denied);
+
+  // A token is refilled every 30 seconds.
+  test_time_.advanceTimeWait(std::chrono::seconds(30));
+  EXPECT_EQ(consume("key"), ConsumeResult::Allowed);
+  EXPECT_EQ(consume("key"), ConsumeResult::Denied);
+}
+
+TEST_F(BucketStoreTest, ZeroTokens) {
+  EXPECT_EQ(store_.consume("key", 0, std::chrono::seconds(60)),
+            ConsumeResult::Denied);
+}
+
+TEST_F(BucketStoreTest, Full) {
+  EXPECT_EQ(consume("key1"), ConsumeResult::Allowed);
+  EXPECT_EQ(consume("key2"), ConsumeResult::Allowed);
+  EXPECT_EQ(consume("key3"), ConsumeResult::Full);
+
+  // The refilled buckets make room for the new ones.
+  test_time_.advanceTimeWait(std::chrono::seconds(30));
+  EXPECT_EQ(consume("key3"), ConsumeResult::Allowed);
+}
+
+}  // namespace
+}  // namespace rate_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
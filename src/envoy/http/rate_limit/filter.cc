@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/rate_limit/filter.h"
+
+#include <string>
+
+#include "absl/strings/str_cat.h"
+#include "common/http/codes.h"
+#include "src/envoy/utils/filter_state_utils.h"
+#include "src/envoy/utils/rc_detail_utils.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace rate_limit {
+
+using Envoy::Http::FilterHeadersStatus;
+
+namespace {
+
+// Returns the string field of the struct, or empty if not found.
+absl::string_view getStringField(const ::google::protobuf::Struct& metadata,
+                                 const std::string& name) {
+  const auto it = metadata.fields().find(name);
+  if (it == metadata.fields().end()) {
+    return "";
+  }
+  return it->second.string_value();
+}
+
+}  // namespace
+
+FilterHeadersStatus Filter::decodeHeaders(Envoy::Http::RequestHeaderMap&,
+                                          bool) {
+  const auto& filter_metadata =
+      decoder_callbacks_->streamInfo().dynamicMetadata().filter_metadata();
+  const auto it = filter_metadata.find(utils::kDynamicMetadataServiceControl);
+  if (it == filter_metadata.end()) {
+    return FilterHeadersStatus::Continue;
+  }
+  const absl::string_view tier =
+      getStringField(it->second, utils::kDynamicMetadataConsumerTier);
+  const absl::string_view api_key_hash =
+      getStringField(it->second, utils::kDynamicMetadataApiKeyHash);
+  const TierLimit* limit = config_->tierLimit(tier);
+  if (api_key_hash.empty() || limit == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  // The tier is part of the key, so the api keys changing tier start over.
+  switch (config_->store().consume(absl::StrCat(tier, "\n", api_key_hash),
+                                   limit->requests, limit->period)) {
+    case ConsumeResult::Allowed:
+      config_->stats().allowed_.inc();
+      return FilterHeadersStatus::Continue;
+    case ConsumeResult::Full:
+      config_->stats().store_full_.inc();
+      return FilterHeadersStatus::Continue;
+    case ConsumeResult::Denied:
+      break;
+  }
+
+  config_->stats().denied_.inc();
+  const std::string error_msg =
+      absl::StrCat("Too many requests for the consumer tier `", tier, "`.");
+  ENVOY_LOG(debug, "{}", error_msg);
+  decoder_callbacks_->sendLocalReply(
+      Envoy::Http::Code::TooManyRequests, error_msg, nullptr, absl::nullopt,
+      utils::generateRcDetails(utils::kRcDetailFilterRateLimit,
+                               utils::kRcDetailErrorTypeTooManyRequests,
+                               std::string(tier)));
+  return FilterHeadersStatus::StopIteration;
+}
+
+}  // namespace rate_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <algorithm>
+#include <chrono>
+#include <string>
+
+#include "absl/container/flat_hash_map.h"
+#include "api/envoy/v9/http/rate_limit/config.pb.h"
+#include "envoy/common/time.h"
+#include "envoy/stats/scope.h"
+#include "envoy/stats/stats_macros.h"
+#include "google/protobuf/util/time_util.h"
+#include "src/envoy/http/rate_limit/bucket_store.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace rate_limit {
+
+constexpr const char kFilterName[] = "com.google.espv2.filters.http.rate_limit";
+
+constexpr uint32_t kDefaultMaxBuckets = 10000;
+
+/**
+ * All stats for the rate limit filter. @see stats_macros.h
+ */
+#define ALL_RATE_LIMIT_FILTER_STATS(COUNTER) \
+  COUNTER(allowed)                           \
+  COUNTER(denied)                            \
+  COUNTER(store_full)
+
+/**
+ * Wrapper struct for rate limit filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_RATE_LIMIT_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+// The limit of a tier.
+struct TierLimit {
+  uint32_t requests;
+  std::chrono::milliseconds period;
+};
+
+class FilterConfig {
+ public:
+  FilterConfig(
+      const ::espv2::api::envoy::v9::http::rate_limit::FilterConfig& proto,
+      const std::string& stats_prefix, Envoy::Stats::Scope& scope,
+      Envoy::TimeSource& time_source)
+      : store_(std::make_shared<BucketStore>(
+            time_source, proto.max_buckets() > 0 ? proto.max_buckets()
+                                                 : kDefaultMaxBuckets)),
+        stats_(generateStats(stats_prefix, scope)) {
+    for (const auto& it : proto.tier_limits()) {
+      // The sub-millisecond periods are rounded up to a millisecond.
+      const int64_t period_ms = std::max<int64_t>(
+          1, ::google::protobuf::util::TimeUtil::DurationToMilliseconds(
+                 it.second.period()));
+      tier_limits_[it.first] =
+          TierLimit{it.second.requests(), std::chrono::milliseconds(period_ms)};
+    }
+  }
+
+  // Returns the limit of the tier, or nullptr if the tier is not limited.
+  const TierLimit* tierLimit(absl::string_view tier) const {
+    const auto it = tier_limits_.find(tier);
+    return it == tier_limits_.end() ? nullptr : &it->second;
+  }
+  BucketStore& store() { return *store_; }
+  FilterStats& stats() { return stats_; }
+
+ private:
+  FilterStats generateStats(const std::string& prefix,
+                            Envoy::Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "rate_limit.";
+    return {ALL_RATE_LIMIT_FILTER_STATS(
+        POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  absl::flat_hash_map<std::string, TierLimit> tier_limits_;
+  // The store shared by the filters of all the worker threads.
+  BucketStoreSharedPtr store_;
+  // The stats
+  FilterStats stats_;
+};
+
+using FilterConfigSharedPtr = std::shared_ptr<FilterConfig>;
+
+}  // namespace rate_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
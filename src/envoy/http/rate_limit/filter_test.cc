@@ -0,0 +1,140 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/rate_limit/filter.h"
+
+#include "common/common/empty_string.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "src/envoy/utils/filter_state_utils.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/simulated_time_system.h"
+#include "test/test_common/utility.h"
+
+using ::testing::_;
+using ::testing::NiceMock;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace rate_limit {
+namespace {
+
+constexpr char kFilterConfig[] = R"(
+tier_limits:
+  gold:
+    requests: 2
+    period:
+      seconds: 60
+  free:
+    requests: 0
+    period:
+      seconds: 60
+)";
+
+class RateLimitFilterTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    ::espv2::api::envoy::v9::http::rate_limit::FilterConfig proto_config;
+    Envoy::TestUtility::loadFromYaml(kFilterConfig, proto_config);
+    config_ = std::make_shared<FilterConfig>(
+        proto_config, Envoy::EMPTY_STRING, mock_factory_context_.scope_,
+        test_time_);
+  }
+
+  // Sends a request of the consumer through a new filter.
+  Envoy::Http::FilterHeadersStatus sendRequest(
+      NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks>& decoder_cb,
+      const std::string& tier, const std::string& api_key_hash) {
+    ::google::protobuf::Struct metadata;
+    auto& fields = *metadata.mutable_fields();
+    fields[utils::kDynamicMetadataConsumerTier].set_string_value(tier);
+    fields[utils::kDynamicMetadataApiKeyHash].set_string_value(api_key_hash);
+    (*decoder_cb.stream_info_.metadata_.mutable_filter_metadata())
+        [utils::kDynamicMetadataServiceControl] = metadata;
+
+    Filter filter(config_);
+    filter.setDecoderFilterCallbacks(decoder_cb);
+    Envoy::Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                                  {":path", "/shelves"}};
+    return filter.decodeHeaders(headers, true);
+  }
+
+  uint64_t counter(const std::string& name) {
+    return Envoy::TestUtility::findCounter(mock_factory_context_.scope_,
+                                           "rate_limit." + name)
+        ->value();
+  }
+
+  Envoy::Event::SimulatedTimeSystem test_time_;
+  FilterConfigSharedPtr config_;
+  NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+};
+
+TEST_F(RateLimitFilterTest, NoMetadata) {
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> decoder_cb;
+  Filter filter(config_);
+  filter.setDecoderFilterCallbacks(decoder_cb);
+  Envoy::Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                                {":path", "/shelves"}};
+  EXPECT_EQ(filter.decodeHeaders(headers, true),
+            Envoy::Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(counter("allowed"), 0);
+}
+
+TEST_F(RateLimitFilterTest, TierWithoutLimit) {
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> decoder_cb;
+  for (int i = 0; i < 3; ++i) {
+    EXPECT_EQ(sendRequest(decoder_cb, "unknown", "hash"),
+              Envoy::Http::FilterHeadersStatus::Continue);
+  }
+  EXPECT_EQ(counter("allowed"), 0);
+}
+
+TEST_F(RateLimitFilterTest, DeniedOverLimit) {
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> decoder_cb;
+  EXPECT_EQ(sendRequest(decoder_cb, "gold", "hash"),
+            Envoy::Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest(decoder_cb, "gold", "hash"),
+            Envoy::Http::FilterHeadersStatus::Continue);
+
+  EXPECT_CALL(decoder_cb,
+              sendLocalReply(Envoy::Http::Code::TooManyRequests,
+                             "Too many requests for the consumer tier `gold`.",
+                             _, _, "rate_limit_too_many_requests{gold}"));
+  EXPECT_EQ(sendRequest(decoder_cb, "gold", "hash"),
+            Envoy::Http::FilterHeadersStatus::StopIteration);
+
+  // Each api key has its own limit.
+  EXPECT_EQ(sendRequest(decoder_cb, "gold", "other-hash"),
+            Envoy::Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(counter("allowed"), 3);
+  EXPECT_EQ(counter("denied"), 1);
+}
+
+TEST_F(RateLimitFilterTest, ZeroRequestsTier) {
+  NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks> decoder_cb;
+  EXPECT_CALL(decoder_cb, sendLocalReply(Envoy::Http::Code::TooManyRequests,
+                                         _, _, _, _));
+  EXPECT_EQ(sendRequest(decoder_cb, "free", "hash"),
+            Envoy::Http::FilterHeadersStatus::StopIteration);
+}
+
+}  // namespace
+}  // namespace rate_limit
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,192 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/service_control/api_key_grace_store.h"
+
+#include <cstdio>
+#include <fstream>
+#include <vector>
+
+#include "absl/strings/numbers.h"
+#include "absl/strings/str_cat.h"
+#include "absl/strings/str_split.h"
+#include "common/buffer/buffer_impl.h"
+#include "common/common/hex.h"
+#include "common/crypto/utility.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace service_control {
+namespace {
+
+using ::espv2::api_proxy::service_control::CheckResponseInfo;
+using ::espv2::api_proxy::service_control::api_key::ApiKeyState;
+
+// Each line of the file is an entry with the tab separated fields: the key
+// hash, the verified time in millisecond since epoch, the consumer project
+// number, the consumer type and the consumer number.
+constexpr char kFieldSeparator = '\t';
+constexpr size_t kFieldCount = 5;
+
+std::string hashKey(const std::string& key) {
+  return Envoy::Hex::encode(
+      Envoy::Common::Crypto::UtilitySingleton::get().getSha256Digest(
+          Envoy::Buffer::OwnedImpl(key)));
+}
+
+}  // namespace
+
+ApiKeyGraceStore::ApiKeyGraceStore(Envoy::TimeSource& time_source,
+                                   const std::string& path)
+    : time_source_(time_source),
+      path_(path),
+      grace_period_(0),
+      max_entries_(0) {
+  if (!path_.empty()) {
+    load();
+  }
+}
+
+ApiKeyGraceStore::~ApiKeyGraceStore() { save(); }
+
+void ApiKeyGraceStore::setLimits(std::chrono::milliseconds grace_period,
+                                 uint32_t max_entries) {
+  absl::MutexLock lock(&mutex_);
+  grace_period_ = grace_period;
+  max_entries_ = max_entries;
+}
+
+void ApiKeyGraceStore::record(const std::string& key,
+                              const CheckResponseInfo& info) {
+  const std::string hash = hashKey(key);
+  const auto now = time_source_.systemTime();
+
+  absl::MutexLock lock(&mutex_);
+  if (grace_period_.count() == 0) {
+    return;
+  }
+  if (entries_.size() >= max_entries_ &&
+      entries_.find(hash) == entries_.end()) {
+    // Drop the expired entries to bound the memory usage.
+    removeExpired(now);
+    if (entries_.size() >= max_entries_) {
+      return;
+    }
+  }
+  entries_[hash] = Entry{now, info.consumer_project_number,
+                         info.consumer_type, info.consumer_number};
+  dirty_ = true;
+}
+
+bool ApiKeyGraceStore::lookup(const std::string& key,
+                              CheckResponseInfo& info) {
+  const std::string hash = hashKey(key);
+
+  absl::MutexLock lock(&mutex_);
+  const auto it = entries_.find(hash);
+  if (it == entries_.end()) {
+    return false;
+  }
+  if (time_source_.systemTime() - it->second.verified_time > grace_period_) {
+    entries_.erase(it);
+    dirty_ = true;
+    return false;
+  }
+  info.consumer_project_number = it->second.consumer_project_number;
+  info.consumer_type = it->second.consumer_type;
+  info.consumer_number = it->second.consumer_number;
+  info.api_key_state = ApiKeyState::VERIFIED;
+  return true;
+}
+
+void ApiKeyGraceStore::removeExpired(Envoy::SystemTime now) {
+  for (auto it = entries_.begin(); it != entries_.end();) {
+    if (now - it->second.verified_time > grace_period_) {
+      entries_.erase(it++);
+      dirty_ = true;
+    } else {
+      ++it;
+    }
+  }
+}
+
+void ApiKeyGraceStore::load() {
+  std::ifstream file(path_);
+  if (!file) {
+    ENVOY_LOG(info, "no verified API keys loaded, fail to open {}", path_);
+    return;
+  }
+
+  absl::MutexLock lock(&mutex_);
+  std::string line;
+  while (std::getline(file, line)) {
+    const std::vector<std::string> fields =
+        absl::StrSplit(line, kFieldSeparator);
+    int64_t verified_ms;
+    if (fields.size() != kFieldCount ||
+        !absl::SimpleAtoi(fields[1], &verified_ms)) {
+      ENVOY_LOG(warn, "skip a malformed verified API key in {}", path_);
+      continue;
+    }
+    entries_[fields[0]] =
+        Entry{Envoy::SystemTime(std::chrono::milliseconds(verified_ms)),
+              fields[2], fields[3], fields[4]};
+  }
+  ENVOY_LOG(info, "loaded {} verified API keys from {}", entries_.size(),
+            path_);
+}
+
+void ApiKeyGraceStore::save() {
+  if (path_.empty()) {
+    return;
+  }
+
+  absl::MutexLock lock(&mutex_);
+  if (!dirty_) {
+    return;
+  }
+  removeExpired(time_source_.systemTime());
+
+  // Write a temporary file, then rename it, so a crash never leaves a
+  // partial file.
+  const std::string tmp_path = absl::StrCat(path_, ".tmp");
+  {
+    std::ofstream file(tmp_path, std::ofstream::trunc);
+    for (const auto& it : entries_) {
+      const auto verified_ms =
+          std::chrono::duration_cast<std::chrono::milliseconds>(
+              it.second.verified_time.time_since_epoch())
+              .count();
+      file << it.first << kFieldSeparator << verified_ms << kFieldSeparator
+           << it.second.consumer_project_number << kFieldSeparator
+           << it.second.consumer_type << kFieldSeparator
+           << it.second.consumer_number << "\n";
+    }
+    if (!file.flush()) {
+      ENVOY_LOG(warn, "fail to write the verified API keys to {}", tmp_path);
+      return;
+    }
+  }
+  if (std::rename(tmp_path.c_str(), path_.c_str()) != 0) {
+    ENVOY_LOG(warn, "fail to rename {} to {}", tmp_path, path_);
+    return;
+  }
+  dirty_ = false;
+}
+
+}  // namespace service_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
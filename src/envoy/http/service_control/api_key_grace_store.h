@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <chrono>
+#include <memory>
+#include <string>
+
+#include "absl/base/thread_annotations.h"
+#include "absl/container/flat_hash_map.h"
+#include "absl/synchronization/mutex.h"
+#include "common/common/logger.h"
+#include "envoy/common/time.h"
+#include "envoy/singleton/instance.h"
+#include "src/api_proxy/service_control/request_info.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace service_control {
+
+// Stores the API keys verified by Check, shared by all the worker threads.
+// They are accepted within the grace period if Check is unavailable.
+//
+// It is a singleton shared by the filter configs, so the keys outlive the
+// listener updates. If the path is not empty, the keys are loaded from the
+// file on creation and written by save(), so they outlive Envoy restarts.
+// Only the SHA-256 hashes of the keys are stored.
+class ApiKeyGraceStore
+    : public Envoy::Singleton::Instance,
+      public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
+ public:
+  ApiKeyGraceStore(Envoy::TimeSource& time_source, const std::string& path);
+  ~ApiKeyGraceStore() override;
+
+  // Sets the grace period and the max entries of a new filter config. The
+  // stored keys keep their verified time.
+  void setLimits(std::chrono::milliseconds grace_period, uint32_t max_entries);
+
+  // Records the key verified by Check now.
+  void record(const std::string& key,
+              const ::espv2::api_proxy::service_control::CheckResponseInfo&
+                  info);
+
+  // Returns true and fills info if the key was verified within the grace
+  // period.
+  bool lookup(const std::string& key,
+              ::espv2::api_proxy::service_control::CheckResponseInfo& info);
+
+  // Writes the keys to the file, if they changed since the last save.
+  void save();
+
+ private:
+  struct Entry {
+    Envoy::SystemTime verified_time;
+    std::string consumer_project_number;
+    std::string consumer_type;
+    std::string consumer_number;
+  };
+
+  void load();
+  void removeExpired(Envoy::SystemTime now)
+      ABSL_EXCLUSIVE_LOCKS_REQUIRED(mutex_);
+
+  Envoy::TimeSource& time_source_;
+  const std::string path_;
+
+  absl::Mutex mutex_;
+  std::chrono::milliseconds grace_period_ ABSL_GUARDED_BY(mutex_);
+  uint32_t max_entries_ ABSL_GUARDED_BY(mutex_);
+  // Keyed by the SHA-256 hash of the key.
+  absl::flat_hash_map<std::string, Entry> entries_ ABSL_GUARDED_BY(mutex_);
+  bool dirty_ ABSL_GUARDED_BY(mutex_) = false;
+};
+
+using ApiKeyGraceStoreSharedPtr = std::shared_ptr<ApiKeyGraceStore>;
+
+}  // namespace service_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,161 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/service_control/api_key_grace_store.h"
+
+#include <cstdio>
+#include <fstream>
+#include <sstream>
+
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/test_common/environment.h"
+#include "test/test_common/simulated_time_system.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace service_control {
+namespace {
+
+using ::espv2::api_proxy::service_control::CheckResponseInfo;
+using ::espv2::api_proxy::service_control::api_key::ApiKeyState;
+
+class ApiKeyGraceStoreTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    path_ = Envoy::TestEnvironment::temporaryPath("api_key_grace_store");
+    std::remove(path_.c_str());
+  }
+
+  ApiKeyGraceStoreSharedPtr createStore(const std::string& path) {
+    auto store = std::make_shared<ApiKeyGraceStore>(test_time_, path);
+    store->setLimits(std::chrono::seconds(60), 2);
+    return store;
+  }
+
+  CheckResponseInfo verifiedInfo(const std::string& project_number) {
+    CheckResponseInfo info;
+    info.consumer_project_number = project_number;
+    info.consumer_type = "PROJECT";
+    info.consumer_number = project_number;
+    info.api_key_state = ApiKeyState::VERIFIED;
+    return info;
+  }
+
+  std::string readFile() {
+    std::ifstream file(path_);
+    std::stringstream content;
+    content << file.rdbuf();
+    return content.str();
+  }
+
+  Envoy::Event::SimulatedTimeSystem test_time_;
+  std::string path_;
+};
+
+TEST_F(ApiKeyGraceStoreTest, VerifiedWithinGracePeriod) {
+  auto store = createStore("");
+  store->record("key1", verifiedInfo("123"));
+
+  CheckResponseInfo info;
+  EXPECT_TRUE(store->lookup("key1", info));
+  EXPECT_EQ(info.consumer_project_number, "123");
+  EXPECT_EQ(info.consumer_type, "PROJECT");
+  EXPECT_EQ(info.api_key_state, ApiKeyState::VERIFIED);
+  EXPECT_FALSE(store->lookup("key2", info));
+
+  test_time_.advanceTimeWait(std::chrono::seconds(61));
+  EXPECT_FALSE(store->lookup("key1", info));
+}
+
+TEST_F(ApiKeyGraceStoreTest, Disabled) {
+  ApiKeyGraceStore store(test_time_, "");
+  store.record("key1", verifiedInfo("123"));
+
+  CheckResponseInfo info;
+  EXPECT_FALSE(store.lookup("key1", info));
+}
+
+TEST_F(ApiKeyGraceStoreTest, Full) {
+  auto store = createStore("");
+  store->record("key1", verifiedInfo("1"));
+  store->record("key2", verifiedInfo("2"));
+  store->record("key3", verifiedInfo("3"));
+
+  CheckResponseInfo info;
+  EXPECT_TRUE(store->lookup("key1", info));
+  EXPECT_FALSE(store->lookup("key3", info));
+
+  // The expired keys are dropped for the new ones.
+  test_time_.advanceTimeWait(std::chrono::seconds(61));
+  store->record("key3", verifiedInfo("3"));
+  EXPECT_TRUE(store->lookup("key3", info));
+}
+
+TEST_F(ApiKeyGraceStoreTest, LimitsUpdated) {
+  auto store = createStore("");
+  store->record("key1", verifiedInfo("1"));
+
+  // The keys are kept with the limits of a new filter config.
+  store->setLimits(std::chrono::seconds(10), 3);
+  CheckResponseInfo info;
+  EXPECT_TRUE(store->lookup("key1", info));
+
+  test_time_.advanceTimeWait(std::chrono::seconds(11));
+  EXPECT_FALSE(store->lookup("key1", info));
+}
+
+TEST_F(ApiKeyGraceStoreTest, PersistedAcrossRestarts) {
+  auto store = createStore(path_);
+  store->record("key1", verifiedInfo("123"));
+  store->save();
+
+  // The file holds the key hashes, not the keys.
+  EXPECT_THAT(readFile(), ::testing::Not(::testing::HasSubstr("key1")));
+
+  auto restarted = createStore(path_);
+  CheckResponseInfo info;
+  EXPECT_TRUE(restarted->lookup("key1", info));
+  EXPECT_EQ(info.consumer_project_number, "123");
+  EXPECT_EQ(info.api_key_state, ApiKeyState::VERIFIED);
+
+  // The verified time is kept across the restarts.
+  test_time_.advanceTimeWait(std::chrono::seconds(61));
+  EXPECT_FALSE(restarted->lookup("key1", info));
+}
+
+TEST_F(ApiKeyGraceStoreTest, SavedOnDestruction) {
+  createStore(path_)->record("key1", verifiedInfo("123"));
+
+  CheckResponseInfo info;
+  EXPECT_TRUE(createStore(path_)->lookup("key1", info));
+}
+
+TEST_F(ApiKeyGraceStoreTest, MalformedLinesSkipped) {
+  {
+    std::ofstream file(path_);
+    file << "not an entry\n";
+  }
+  auto store = createStore(path_);
+
+  CheckResponseInfo info;
+  EXPECT_FALSE(store->lookup("not an entry", info));
+}
+
+}  // namespace
+}  // namespace service_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
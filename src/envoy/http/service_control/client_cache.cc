@@ -14,6 +14,9 @@
 
 #include "src/envoy/http/service_control/client_cache.h"
 
+#include <algorithm>
+
+#include "absl/strings/match.h"
 #include "common/tracing/http_tracer_impl.h"
 #include "src/api_proxy/service_control/check_response_convert_utils.h"
 #include "src/api_proxy/service_control/request_builder.h"
@@ -25,6 +28,7 @@ namespace http_filters {
 namespace service_control {
 
 using ::espv2::api::envoy::v9::http::service_control::FilterConfig;
+using ::espv2::api::envoy::v9::http::service_control::OperationCallingConfig;
 using ::google::protobuf::util::Status;
 using ::google::protobuf::util::error::Code;
 
@@ -89,11 +93,16 @@ api_proxy::service_control::ScResponseError failCallStatusToScResponseError(
       /*is_network_error=*/true, ScResponseErrorType::ERROR_TYPE_UNSPECIFIED};
 }
 
+// The prefix of the consumer_id in Check requests identified by API keys.
+constexpr char kConsumerIdApiKeyPrefix[] = "api_key:";
+
 // Generates CheckAggregationOptions.
-CheckAggregationOptions getCheckAggregationOptions() {
-  return CheckAggregationOptions(kCheckAggregationEntries,
-                                 kCheckAggregationFlushIntervalMs,
-                                 kCheckAggregationExpirationMs);
+CheckAggregationOptions getCheckAggregationOptions(uint32_t entries,
+                                                   uint32_t expiration_ms) {
+  // The flush interval must be shorter than the expiration.
+  return CheckAggregationOptions(
+      entries, std::min(kCheckAggregationFlushIntervalMs, expiration_ms),
+      expiration_ms);
 }
 
 // Generates QuotaAggregationOptions.
@@ -164,6 +173,14 @@ Status ClientCache::processScCallTransportStatus(const Status& status,
 }
 
 void ClientCache::initHttpRequestSetting(const FilterConfig& filter_config) {
+  for (const auto& requirement : filter_config.requirements()) {
+    if (requirement.has_sc_calling_config() &&
+        requirement.service_name() == config_.service_name()) {
+      operation_calling_configs_[requirement.operation_name()] =
+          requirement.sc_calling_config();
+    }
+  }
+
   if (!filter_config.has_sc_calling_config()) {
     network_fail_open_ = kDefaultNetworkFailOpen;
     check_timeout_ms_ = kCheckDefaultTimeoutInMs;
@@ -172,6 +189,9 @@ void ClientCache::initHttpRequestSetting(const FilterConfig& filter_config) {
     check_retries_ = kCheckDefaultNumberOfRetries;
     quota_retries_ = kAllocateQuotaDefaultNumberOfRetries;
     report_retries_ = kReportDefaultNumberOfRetries;
+    check_cache_entries_ = kCheckAggregationEntries;
+    check_cache_expiration_ms_ = kCheckAggregationExpirationMs;
+    api_key_grace_period_ms_ = 0;
     return;
   }
   const auto& sc_calling_config = filter_config.sc_calling_config();
@@ -197,11 +217,36 @@ void ClientCache::initHttpRequestSetting(const FilterConfig& filter_config) {
   report_retries_ = sc_calling_config.has_report_retries()
                         ? sc_calling_config.report_retries().value()
                         : kReportDefaultNumberOfRetries;
+
+  check_cache_entries_ = sc_calling_config.has_check_cache_entries()
+                             ? sc_calling_config.check_cache_entries().value()
+                             : kCheckAggregationEntries;
+  check_cache_expiration_ms_ =
+      sc_calling_config.has_check_cache_expiration_ms()
+          ? sc_calling_config.check_cache_expiration_ms().value()
+          : kCheckAggregationExpirationMs;
+  api_key_grace_period_ms_ =
+      sc_calling_config.has_api_key_grace_period_ms()
+          ? sc_calling_config.api_key_grace_period_ms().value()
+          : 0;
+}
+
+const OperationCallingConfig* ClientCache::findOperationCallingConfig(
+    const std::string& operation_name) const {
+  const auto it = operation_calling_configs_.find(operation_name);
+  if (it == operation_calling_configs_.end()) {
+    return nullptr;
+  }
+  return &it->second;
 }
 
 void ClientCache::collectCallStatus(CallStatusStats& call_stats,
-                                    const Code& code) {
+                                    const Code& code,
+                                    Envoy::MonotonicTime start_time) {
   ServiceControlFilterStats::collectCallStatus(call_stats, code);
+  ServiceControlFilterStats::collectCallLatency(
+      call_stats, std::chrono::duration_cast<std::chrono::milliseconds>(
+                      time_source_.monotonicTime() - start_time));
 }
 
 ClientCache::ClientCache(
@@ -210,15 +255,23 @@ ClientCache::ClientCache(
     Envoy::Stats::Scope& scope, Envoy::Upstream::ClusterManager& cm,
     Envoy::TimeSource& time_source, Envoy::Event::Dispatcher& dispatcher,
     std::function<const std::string&()> sc_token_fn,
-    std::function<const std::string&()> quota_token_fn)
+    std::function<const std::string&()> quota_token_fn,
+    ApiKeyGraceStoreSharedPtr api_key_grace_store)
     : config_(config),
       filter_stats_(ServiceControlFilterStats::create(stats_prefix, scope)),
+      api_key_grace_store_(api_key_grace_store),
       time_source_(time_source) {
-  ServiceControlClientOptions options(getCheckAggregationOptions(),
-                                      getQuotaAggregationOptions(),
-                                      getReportAggregationOptions());
-
   initHttpRequestSetting(filter_config);
+  if (api_key_grace_period_ms_ > 0) {
+    api_key_grace_store_->setLimits(
+        std::chrono::milliseconds(api_key_grace_period_ms_),
+        check_cache_entries_);
+  }
+  ServiceControlClientOptions options(
+      getCheckAggregationOptions(check_cache_entries_,
+                                 check_cache_expiration_ms_),
+      getQuotaAggregationOptions(), getReportAggregationOptions());
+
   check_call_factory_ = std::make_unique<HttpCallFactoryImpl>(
       cm, dispatcher, filter_config.service_control_uri(),
       absl::StrCat("/", config_.service_name(), ":check"), sc_token_fn,
@@ -243,13 +296,15 @@ ClientCache::ClientCache(
                                    TransportDoneFunc on_done) {
     // Don't support tracing on this transport
     auto& null_span = Envoy::Tracing::NullSpan::instance();
+    const Envoy::MonotonicTime start_time = time_source_.monotonicTime();
     auto* call = check_call_factory_->createHttpCall(
         request, null_span,
-        [this, response, on_done](const Status& status,
-                                  const std::string& body) {
+        [this, response, on_done, start_time](const Status& status,
+                                              const std::string& body) {
           Status final_status = processScCallTransportStatus<CheckResponse>(
               status, response, body);
-          collectCallStatus(filter_stats_.check_, final_status.code());
+          collectCallStatus(filter_stats_.check_, final_status.code(),
+                            start_time);
           on_done(final_status);
         });
     call->call();
@@ -260,14 +315,16 @@ ClientCache::ClientCache(
                                    TransportDoneFunc on_done) {
     // Don't support tracing on this transport
     auto& null_span = Envoy::Tracing::NullSpan::instance();
+    const Envoy::MonotonicTime start_time = time_source_.monotonicTime();
     auto* call = quota_call_factory_->createHttpCall(
         request, null_span,
-        [this, response, on_done](const Status& status,
-                                  const std::string& body) {
+        [this, response, on_done, start_time](const Status& status,
+                                              const std::string& body) {
           Status final_status =
               processScCallTransportStatus<AllocateQuotaResponse>(
                   status, response, body);
-          collectCallStatus(filter_stats_.allocate_quota_, final_status.code());
+          collectCallStatus(filter_stats_.allocate_quota_, final_status.code(),
+                            start_time);
           on_done(final_status);
         });
     call->call();
@@ -278,13 +335,15 @@ ClientCache::ClientCache(
                                     TransportDoneFunc on_done) {
     // Don't support tracing on this transport
     auto& null_span = Envoy::Tracing::NullSpan::instance();
+    const Envoy::MonotonicTime start_time = time_source_.monotonicTime();
     auto* call = report_call_factory_->createHttpCall(
         request, null_span,
-        [this, response, on_done](const Status& status,
-                                  const std::string& body) {
+        [this, response, on_done, start_time](const Status& status,
+                                              const std::string& body) {
           Status final_status = processScCallTransportStatus<ReportResponse>(
               status, response, body);
-          collectCallStatus(filter_stats_.report_, final_status.code());
+          collectCallStatus(filter_stats_.report_, final_status.code(),
+                            start_time);
 
           on_done(final_status);
         });
@@ -298,10 +357,19 @@ ClientCache::ClientCache(
         new EnvoyPeriodicTimer(dispatcher, interval_ms, callback));
   };
 
+  client_options_ = std::make_unique<ServiceControlClientOptions>(options);
   client_ = ::google::service_control_client::CreateServiceControlClient(
       config_.service_name(), config_.service_config_id(), options);
 }
 
+void ClientCache::flushReports() {
+  // The caching client only flushes all its aggregated requests on
+  // destruction, so it is replaced by a new one. The http call factories are
+  // kept, so the flushed calls are sent.
+  client_ = ::google::service_control_client::CreateServiceControlClient(
+      config_.service_name(), config_.service_config_id(), *client_options_);
+}
+
 void ClientCache::collectScResponseErrorStats(ScResponseErrorType error_type) {
   switch (error_type) {
     case ScResponseErrorType::CONSUMER_BLOCKED:
@@ -323,19 +391,41 @@ CancelFunc ClientCache::callCheck(const CheckRequest& request,
                                   Envoy::Tracing::Span& parent_span,
                                   CheckDoneFunc on_done) {
   CancelFunc cancel_fn;
-  auto check_transport = [this, &parent_span, &cancel_fn](
-                             const CheckRequest& request,
-                             CheckResponse* response,
-                             TransportDoneFunc on_done) {
-    auto* call = check_call_factory_->createHttpCall(
-        request, parent_span,
-        [this, response, on_done](const Status& status,
-                                  const std::string& body) {
-          Status final_status = processScCallTransportStatus<CheckResponse>(
-              status, response, body);
-          collectCallStatus(filter_stats_.check_, final_status.code());
-          on_done(final_status);
-        });
+  const std::string& operation_name = request.operation().operation_name();
+  const OperationCallingConfig* operation_config =
+      findOperationCallingConfig(operation_name);
+  // The check transport is only called on a cache miss.
+  bool cache_miss = false;
+  auto check_transport = [this, &parent_span, &cancel_fn, &cache_miss,
+                          operation_config](const CheckRequest& request,
+                                            CheckResponse* response,
+                                            TransportDoneFunc on_done) {
+    cache_miss = true;
+    const Envoy::MonotonicTime start_time = time_source_.monotonicTime();
+    auto done_fn = [this, response, on_done, start_time](
+                       const Status& status, const std::string& body) {
+      Status final_status =
+          processScCallTransportStatus<CheckResponse>(status, response, body);
+      collectCallStatus(filter_stats_.check_, final_status.code(), start_time);
+      on_done(final_status);
+    };
+
+    HttpCall* call;
+    if (operation_config != nullptr &&
+        (operation_config->has_check_timeout_ms() ||
+         operation_config->has_check_retries())) {
+      const uint32_t timeout_ms =
+          operation_config->has_check_timeout_ms()
+              ? operation_config->check_timeout_ms().value()
+              : check_timeout_ms_;
+      const uint32_t retries = operation_config->has_check_retries()
+                                   ? operation_config->check_retries().value()
+                                   : check_retries_;
+      call = check_call_factory_->createHttpCall(request, parent_span, done_fn,
+                                                 timeout_ms, retries);
+    } else {
+      call = check_call_factory_->createHttpCall(request, parent_span, done_fn);
+    }
     call->call();
     cancel_fn = [call]() { call->cancel(); };
   };
@@ -343,19 +433,43 @@ CancelFunc ClientCache::callCheck(const CheckRequest& request,
   parent_span.log(time_source_.systemTime(),
                   "Service Control cache query: Check");
 
+  // Only requests identified by API keys are eligible for the grace period.
+  std::string grace_key;
+  const auto& consumer_id = request.operation().consumer_id();
+  if (absl::StartsWith(consumer_id, kConsumerIdApiKeyPrefix)) {
+    grace_key = absl::StrCat(config_.service_name(), "|", consumer_id, "|",
+                             operation_name);
+  }
+
   auto* response = new CheckResponse;
   client_->Check(
       request, response,
-      [this, response, on_done](const Status& http_status) {
-        handleCheckResponse(http_status, response, on_done);
+      [this, response, on_done, grace_key,
+       operation_name](const Status& http_status) {
+        handleCheckResponse(http_status, response, on_done, grace_key,
+                            operation_name);
       },
       check_transport);
+  if (cache_miss) {
+    filter_stats_.filter_.check_cache_miss_.inc();
+  } else {
+    filter_stats_.filter_.check_cache_hit_.inc();
+  }
   return cancel_fn;
 }
 
 void ClientCache::handleCheckResponse(const Status& http_status,
                                       CheckResponse* response,
-                                      CheckDoneFunc on_done) {
+                                      CheckDoneFunc on_done,
+                                      const std::string& grace_key,
+                                      const std::string& operation_name) {
+  const OperationCallingConfig* operation_config =
+      findOperationCallingConfig(operation_name);
+  const bool network_fail_open =
+      operation_config != nullptr && operation_config->has_network_fail_open()
+          ? operation_config->network_fail_open().value()
+          : network_fail_open_;
+
   CheckResponseInfo response_info;
   Status final_status;
 
@@ -374,13 +488,27 @@ void ClientCache::handleCheckResponse(const Status& http_status,
   if (final_status.ok()) {
     // Everything succeeded, API Key is trusted.
     response_info.api_key_state = ApiKeyState::VERIFIED;
+    if (api_key_grace_period_ms_ > 0 && !grace_key.empty()) {
+      api_key_grace_store_->record(grace_key, response_info);
+    }
     on_done(final_status, response_info);
   } else if (final_status.error_code() == Code::UNAVAILABLE) {
     // All 5xx errors are already translated to Unavailable.
     // API Key cannot be trusted due to a network error.
     response_info.api_key_state = ApiKeyState::NOT_CHECKED;
 
-    if (network_fail_open_) {
+    CheckResponseInfo verified_info;
+    if (api_key_grace_period_ms_ > 0 && !grace_key.empty() &&
+        api_key_grace_store_->lookup(grace_key, verified_info)) {
+      // The API key was recently verified, trust it for the grace period.
+      filter_stats_.filter_.allowed_control_plane_fault_.inc();
+      ENVOY_LOG(warn,
+                "Google Service Control Check is unavailable, but the "
+                "request is allowed since the API key was verified within "
+                "the grace period. Original error: {}",
+                final_status.error_message());
+      on_done(Status::OK, verified_info);
+    } else if (network_fail_open) {
       filter_stats_.filter_.allowed_control_plane_fault_.inc();
       ENVOY_LOG(warn,
                 "Google Service Control Check is unavailable, but the "
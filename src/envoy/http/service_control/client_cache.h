@@ -14,6 +14,7 @@
 
 #pragma once
 
+#include "absl/container/flat_hash_map.h"
 #include "api/envoy/v9/http/service_control/config.pb.h"
 #include "common/common/logger.h"
 #include "envoy/event/dispatcher.h"
@@ -21,6 +22,7 @@
 #include "envoy/upstream/cluster_manager.h"
 #include "include/service_control_client.h"
 #include "src/api_proxy/service_control/request_info.h"
+#include "src/envoy/http/service_control/api_key_grace_store.h"
 #include "src/envoy/http/service_control/filter_stats.h"
 #include "src/envoy/http/service_control/http_call.h"
 #include "src/envoy/http/service_control/service_control_callback_func.h"
@@ -34,6 +36,8 @@ namespace service_control {
 namespace test {
 class ClientCacheCheckResponseTest;
 class ClientCacheCheckResponseErrorTypeTest;
+class ClientCacheCheckResponseApiKeyGracePeriodTest;
+class ClientCacheCheckResponseOperationOverrideTest;
 class ClientCacheQuotaResponseTest;
 class ClientCacheQuotaResponseErrorTypeTest;
 class ClientCacheHttpRequestTest;
@@ -50,7 +54,8 @@ class ClientCache : public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
       Envoy::Upstream::ClusterManager& cm, Envoy::TimeSource& time_source,
       Envoy::Event::Dispatcher& dispatcher,
       std::function<const std::string&()> sc_token_fn,
-      std::function<const std::string&()> quota_token_fn);
+      std::function<const std::string&()> quota_token_fn,
+      ApiKeyGraceStoreSharedPtr api_key_grace_store);
 
   CancelFunc callCheck(
       const ::google::api::servicecontrol::v1::CheckRequest& request,
@@ -63,9 +68,15 @@ class ClientCache : public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
   void callReport(
       const ::google::api::servicecontrol::v1::ReportRequest& request);
 
+  // Sends the aggregated reports now instead of at the next flush interval.
+  // The cached check responses are dropped too.
+  void flushReports();
+
  private:
   friend class test::ClientCacheCheckResponseTest;
   friend class test::ClientCacheCheckResponseErrorTypeTest;
+  friend class test::ClientCacheCheckResponseApiKeyGracePeriodTest;
+  friend class test::ClientCacheCheckResponseOperationOverrideTest;
   friend class test::ClientCacheQuotaResponseTest;
   friend class test::ClientCacheQuotaResponseErrorTypeTest;
   friend class test::ClientCacheHttpRequestTest;
@@ -76,10 +87,18 @@ class ClientCache : public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
 
   // Ownership of CheckResponse is passed to this function.
   // The function will always call CheckDoneFunc.
+  // If grace_key is not empty, the verified API key is recorded for the grace
+  // period, and is accepted if Check is unavailable within the period.
+  // The network fail policy of operation_name is used if it is overridden.
   void handleCheckResponse(
       const ::google::protobuf::util::Status& http_status,
       ::google::api::servicecontrol::v1::CheckResponse* response,
-      CheckDoneFunc on_done);
+      CheckDoneFunc on_done, const std::string& grace_key = "",
+      const std::string& operation_name = "");
+
+  // Returns the calling config overrides of the operation, or nullptr if none.
+  const ::espv2::api::envoy::v9::http::service_control::OperationCallingConfig*
+  findOperationCallingConfig(const std::string& operation_name) const;
 
   // Ownership of AllocateQuotaResponse is passed to this function.
   // The function will always call QuotaDoneFunction.
@@ -92,8 +111,11 @@ class ClientCache : public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
       const ::espv2::api::envoy::v9::http::service_control::FilterConfig&
           filter_config);
 
+  // Collects the status and the latency of a service control call that
+  // started at `start_time`.
   void collectCallStatus(CallStatusStats& filter_stats,
-                         const ::google::protobuf::util::error::Code& code);
+                         const ::google::protobuf::util::error::Code& code,
+                         Envoy::MonotonicTime start_time);
 
   template <class Response>
   static ::google::protobuf::util::Status processScCallTransportStatus(
@@ -118,9 +140,29 @@ class ClientCache : public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
   uint32_t report_retries_;
   uint32_t quota_retries_;
 
+  // the configurable check cache
+  uint32_t check_cache_entries_;
+  uint32_t check_cache_expiration_ms_;
+
+  // Per-operation overrides of the calling config, keyed by operation name.
+  absl::flat_hash_map<
+      std::string,
+      ::espv2::api::envoy::v9::http::service_control::OperationCallingConfig>
+      operation_calling_configs_;
+
+  // The grace period for recently verified API keys, 0 if disabled.
+  uint32_t api_key_grace_period_ms_;
+  // Recently verified API keys, keyed by service name, consumer id and
+  // operation name. Shared by all the worker threads and the filter configs.
+  ApiKeyGraceStoreSharedPtr api_key_grace_store_;
+
   // Used to retrieve the current time for tracing.
   Envoy::TimeSource& time_source_;
 
+  // The options of the caching client, to create it again on flushReports.
+  std::unique_ptr<::google::service_control_client::ServiceControlClientOptions>
+      client_options_;
+
   // The http call factories. On destruction, they automatically cancel all
   // pending RPCs. These should always be close to the last member variables in
   // the class to mitigate use-after-free of other class members (destructor
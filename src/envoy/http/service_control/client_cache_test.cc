@@ -70,7 +70,7 @@ class ClientCacheTestBase : public ::testing::Test {
   void SetUp() override {
     cache_ = std::make_unique<ClientCache>(
         service_config_, filter_config_, "test", context_.scope_, cm_,
-        time_source_, dispatcher_, token_fn_, token_fn_);
+        time_source_, dispatcher_, token_fn_, token_fn_, api_key_grace_store_);
   }
 
   void checkAndReset(Envoy::Stats::Counter& counter, const int expected_value) {
@@ -103,6 +103,8 @@ class ClientCacheTestBase : public ::testing::Test {
   NiceMock<Envoy::Server::Configuration::MockFactoryContext> context_;
   ServiceControlFilterStats stats_;
   std::function<const std::string&()> token_fn_;
+  ApiKeyGraceStoreSharedPtr api_key_grace_store_ =
+      std::make_shared<ApiKeyGraceStore>(time_source_, "");
 
   // Class under test.
   std::unique_ptr<ClientCache> cache_;
@@ -174,7 +176,7 @@ class ClientCacheCheckResponseNetworkFailClosedTest
         ->set_value(false);
     cache_ = std::make_unique<ClientCache>(
         service_config_, filter_config_, "test", context_.scope_, cm_,
-        time_source_, dispatcher_, token_fn_, token_fn_);
+        time_source_, dispatcher_, token_fn_, token_fn_, api_key_grace_store_);
   }
 };
 
@@ -196,6 +198,102 @@ TEST_F(ClientCacheCheckResponseNetworkFailClosedTest, Sc5xxBlocked) {
   checkAndReset(stats_.filter_.denied_control_plane_fault_, 1);
 }
 
+class ClientCacheCheckResponseApiKeyGracePeriodTest
+    : public ClientCacheTestBase {
+ protected:
+  void SetUp() override {
+    auto* sc_calling_config = filter_config_.mutable_sc_calling_config();
+    sc_calling_config->mutable_network_fail_open()->set_value(false);
+    sc_calling_config->mutable_api_key_grace_period_ms()->set_value(60000);
+    cache_ = std::make_unique<ClientCache>(
+        service_config_, filter_config_, "test", context_.scope_, cm_,
+        time_source_, dispatcher_, token_fn_, token_fn_, api_key_grace_store_);
+  }
+
+  void runTest(Code got_http_code, const std::string& grace_key,
+               Code want_client_code, ApiKeyState want_api_key_state) {
+    CheckDoneFunc on_done = [&](const Status& status,
+                                const CheckResponseInfo& info) {
+      EXPECT_EQ(status.code(), want_client_code);
+      EXPECT_EQ(info.api_key_state, want_api_key_state);
+    };
+
+    const Status http_status(got_http_code, Envoy::EMPTY_STRING);
+    cache_->handleCheckResponse(http_status, new CheckResponse(), on_done,
+                                grace_key);
+  }
+};
+
+TEST_F(ClientCacheCheckResponseApiKeyGracePeriodTest, VerifiedApiKeyAllowed) {
+  runTest(Code::OK, "api_key:foo|op", Code::OK, ApiKeyState::VERIFIED);
+
+  runTest(Code::UNAVAILABLE, "api_key:foo|op", Code::OK,
+          ApiKeyState::VERIFIED);
+  checkAndReset(stats_.filter_.allowed_control_plane_fault_, 1);
+}
+
+TEST_F(ClientCacheCheckResponseApiKeyGracePeriodTest,
+       VerifiedApiKeySharedByCaches) {
+  runTest(Code::OK, "api_key:foo|op", Code::OK, ApiKeyState::VERIFIED);
+
+  // Another worker thread or a new filter config shares the verified keys.
+  cache_ = std::make_unique<ClientCache>(
+      service_config_, filter_config_, "test", context_.scope_, cm_,
+      time_source_, dispatcher_, token_fn_, token_fn_, api_key_grace_store_);
+  runTest(Code::UNAVAILABLE, "api_key:foo|op", Code::OK,
+          ApiKeyState::VERIFIED);
+  checkAndReset(stats_.filter_.allowed_control_plane_fault_, 1);
+}
+
+TEST_F(ClientCacheCheckResponseApiKeyGracePeriodTest, UnknownApiKeyBlocked) {
+  runTest(Code::OK, "api_key:foo|op", Code::OK, ApiKeyState::VERIFIED);
+
+  runTest(Code::UNAVAILABLE, "api_key:bar|op", Code::UNAVAILABLE,
+          ApiKeyState::NOT_CHECKED);
+  checkAndReset(stats_.filter_.denied_control_plane_fault_, 1);
+}
+
+class ClientCacheCheckResponseOperationOverrideTest
+    : public ClientCacheTestBase {
+ protected:
+  void SetUp() override {
+    service_config_.set_service_name(kServiceName);
+    filter_config_.mutable_sc_calling_config()
+        ->mutable_network_fail_open()
+        ->set_value(true);
+    auto* requirement = filter_config_.add_requirements();
+    requirement->set_service_name(kServiceName);
+    requirement->set_operation_name("fail_closed_op");
+    requirement->mutable_sc_calling_config()
+        ->mutable_network_fail_open()
+        ->set_value(false);
+    cache_ = std::make_unique<ClientCache>(
+        service_config_, filter_config_, "test", context_.scope_, cm_,
+        time_source_, dispatcher_, token_fn_, token_fn_, api_key_grace_store_);
+  }
+
+  void runTest(const std::string& operation_name, Code want_client_code) {
+    CheckDoneFunc on_done = [&](const Status& status,
+                                const CheckResponseInfo&) {
+      EXPECT_EQ(status.code(), want_client_code);
+    };
+
+    const Status http_status(Code::UNAVAILABLE, Envoy::EMPTY_STRING);
+    cache_->handleCheckResponse(http_status, new CheckResponse(), on_done,
+                                /*grace_key=*/"", operation_name);
+  }
+};
+
+TEST_F(ClientCacheCheckResponseOperationOverrideTest, FailClosedOperation) {
+  runTest("fail_closed_op", Code::UNAVAILABLE);
+  checkAndReset(stats_.filter_.denied_control_plane_fault_, 1);
+}
+
+TEST_F(ClientCacheCheckResponseOperationOverrideTest, DefaultOperation) {
+  runTest("other_op", Code::OK);
+  checkAndReset(stats_.filter_.allowed_control_plane_fault_, 1);
+}
+
 class ClientCacheCheckResponseErrorTypeTest : public ClientCacheTestBase {
  protected:
   void runTest(CheckError_Code got_check_error_code,
@@ -322,7 +420,7 @@ class ClientCacheHttpRequestTest : public ClientCacheTestBase {
 
     cache_ = std::make_unique<ClientCache>(
         service_config_, filter_config_, "test", context_.scope_, cm_,
-        time_source_, dispatcher_, token_fn_, token_fn_);
+        time_source_, dispatcher_, token_fn_, token_fn_, api_key_grace_store_);
 
     // Setup mock http call.
     http_call_ = std::make_unique<MockHttpCall>();
@@ -546,6 +644,8 @@ TEST_F(ClientCacheCheckHttpRequestTest, SuccessfulHttpCallWithCache) {
   // Stats.
   checkAndReset(stats_.check_.OK_, 1);
   checkAndReset(stats_.check_.CANCELLED_, 1);
+  checkAndReset(stats_.filter_.check_cache_miss_, 1);
+  checkAndReset(stats_.filter_.check_cache_hit_, 2);
 }
 
 }  // namespace test
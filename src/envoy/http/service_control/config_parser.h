@@ -18,6 +18,7 @@
 #include "absl/strings/string_view.h"
 #include "api/envoy/v9/http/service_control/config.pb.h"
 #include "api/envoy/v9/http/service_control/requirement.pb.h"
+#include "common/common/hash.h"
 #include "common/protobuf/utility.h"
 #include "envoy/router/router.h"
 #include "src/envoy/http/service_control/service_control_call.h"
@@ -56,6 +57,21 @@ class ServiceContext {
                        kLowerBoundMinStreamReportIntervalMs),
           config);
     }
+
+    // Each config id of a rollout in progress has its own call, since the
+    // config id is set on all the requests sent by the call.
+    for (const auto& rollout_config_id : config_.rollout_config_ids()) {
+      RolloutCall rollout_call;
+      rollout_call.config = std::make_unique<
+          ::espv2::api::envoy::v9::http::service_control::Service>(config_);
+      rollout_call.config->clear_rollout_config_ids();
+      rollout_call.config->set_service_config_id(
+          rollout_config_id.service_config_id());
+      rollout_call.call = factory.create(*rollout_call.config);
+      rollout_percent_total_ += rollout_config_id.traffic_percent();
+      rollout_call.cumulative_percent = rollout_percent_total_;
+      rollout_calls_.push_back(std::move(rollout_call));
+    }
   }
 
   const ::espv2::api::envoy::v9::http::service_control::Service& config()
@@ -69,10 +85,40 @@ class ServiceContext {
 
   ServiceControlCall& call() const { return *service_control_call_; }
 
+  // The call of the config id the request is assigned to by the traffic
+  // percentages of the rollout in progress. The uuid of the request is hashed,
+  // so all the calls of a request use the same config id.
+  ServiceControlCall& call(absl::string_view uuid) const {
+    if (rollout_calls_.empty()) {
+      return *service_control_call_;
+    }
+    const double point =
+        static_cast<double>(Envoy::HashUtil::xxHash64(uuid) % 10000) / 10000 *
+        rollout_percent_total_;
+    for (const auto& rollout_call : rollout_calls_) {
+      if (point < rollout_call.cumulative_percent) {
+        return *rollout_call.call;
+      }
+    }
+    return *rollout_calls_.back().call;
+  }
+
  private:
+  struct RolloutCall {
+    // The service config with the config id of the rollout, referred to by
+    // the call.
+    std::unique_ptr<::espv2::api::envoy::v9::http::service_control::Service>
+        config;
+    ServiceControlCallPtr call;
+    // The sum of the traffic percentages up to this config id.
+    double cumulative_percent;
+  };
+
   const ::espv2::api::envoy::v9::http::service_control::Service& config_;
   ServiceControlCallPtr service_control_call_;
   int64_t min_stream_report_interval_ms_;
+  std::vector<RolloutCall> rollout_calls_;
+  double rollout_percent_total_ = 0;
 };
 using ServiceContextPtr = std::unique_ptr<ServiceContext>;
 
@@ -86,6 +132,9 @@ class RequirementContext {
     for (const auto& metric_cost : config.metric_costs()) {
       metric_costs_.push_back(
           std::make_pair(metric_cost.name(), metric_cost.cost()));
+      if (!metric_cost.cost_header().empty()) {
+        has_cost_headers_ = true;
+      }
     }
   }
 
@@ -100,10 +149,14 @@ class RequirementContext {
     return metric_costs_;
   }
 
+  // If true, some metric costs are derived from the request headers.
+  bool has_cost_headers() const { return has_cost_headers_; }
+
  private:
   const ::espv2::api::envoy::v9::http::service_control::Requirement& config_;
   const ServiceContext& service_ctx_;
   std::vector<std::pair<std::string, int>> metric_costs_;
+  bool has_cost_headers_ = false;
 };
 using RequirementContextPtr = std::unique_ptr<RequirementContext>;
 
@@ -149,6 +149,85 @@ requirements {
                           "min_stream_report_interval_ms");
 }
 
+TEST(ConfigParserTest, RolloutConfigIds) {
+  FilterConfig config;
+  const char kFilterConfigRollout[] = R"(
+services {
+  service_name: "echo"
+  service_config_id: "config-2"
+  rollout_config_ids {
+    service_config_id: "config-1"
+    traffic_percent: 20
+  }
+  rollout_config_ids {
+    service_config_id: "config-2"
+    traffic_percent: 80
+  }
+}
+requirements {
+  service_name: "echo"
+  operation_name: "get_foo"
+})";
+  ASSERT_TRUE(TextFormat::ParseFromString(kFilterConfigRollout, &config));
+
+  // Each call records the config id it was created with.
+  absl::flat_hash_map<const ServiceControlCall*, std::string> call_config_ids;
+  testing::NiceMock<MockServiceControlCallFactory> mock_factory;
+  ON_CALL(mock_factory, create(testing::_))
+      .WillByDefault(testing::Invoke(
+          [&call_config_ids](const ::espv2::api::envoy::v9::http::
+                                 service_control::Service& service)
+              -> ServiceControlCallPtr {
+            auto call = std::make_unique<MockServiceControlCall>();
+            call_config_ids[call.get()] = service.service_config_id();
+            return call;
+          }));
+  FilterConfigParser parser(config, mock_factory);
+  EXPECT_EQ(call_config_ids.size(), 3);
+
+  const ServiceContext& service_ctx =
+      parser.find_requirement("get_foo")->service_ctx();
+  EXPECT_EQ(call_config_ids[&service_ctx.call()], "config-2");
+
+  absl::flat_hash_map<std::string, int> assigned;
+  for (int i = 0; i < 1000; ++i) {
+    const std::string uuid = absl::StrCat("uuid-", i);
+    ServiceControlCall& call = service_ctx.call(uuid);
+    // A request is always assigned to the same config id.
+    EXPECT_EQ(&call, &service_ctx.call(uuid));
+    EXPECT_NE(&call, &service_ctx.call());
+    assigned[call_config_ids[&call]]++;
+  }
+  EXPECT_NEAR(assigned["config-1"], 200, 50);
+  EXPECT_NEAR(assigned["config-2"], 800, 50);
+}
+
+TEST(ConfigParserTest, NoRolloutConfigIds) {
+  FilterConfig config;
+  const char kFilterConfigBasic[] = R"(
+services {
+  service_name: "echo"
+  service_config_id: "config-1"
+}
+requirements {
+  service_name: "echo"
+  operation_name: "get_foo"
+})";
+  ASSERT_TRUE(TextFormat::ParseFromString(kFilterConfigBasic, &config));
+  testing::NiceMock<MockServiceControlCallFactory> mock_factory;
+  ON_CALL(mock_factory, create(testing::_))
+      .WillByDefault(testing::Invoke(
+          [](const ::espv2::api::envoy::v9::http::service_control::Service&)
+              -> ServiceControlCallPtr {
+            return std::make_unique<MockServiceControlCall>();
+          }));
+  FilterConfigParser parser(config, mock_factory);
+
+  const ServiceContext& service_ctx =
+      parser.find_requirement("get_foo")->service_ctx();
+  EXPECT_EQ(&service_ctx.call("uuid-1"), &service_ctx.call());
+}
+
 }  // namespace
 }  // namespace service_control
 }  // namespace http_filters
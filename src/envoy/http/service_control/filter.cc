@@ -19,6 +19,7 @@
 #include "common/grpc/status.h"
 #include "envoy/http/header_map.h"
 #include "src/envoy/http/service_control/handler.h"
+#include "src/envoy/utils/filter_state_utils.h"
 #include "src/envoy/utils/http_header_utils.h"
 #include "src/envoy/utils/rc_detail_utils.h"
 
@@ -29,6 +30,10 @@ namespace service_control {
 
 void ServiceControlFilter::onDestroy() {
   ENVOY_LOG(debug, "Called ServiceControl Filter : {}", __func__);
+  if (intermediate_report_timer_) {
+    intermediate_report_timer_->disableTimer();
+    intermediate_report_timer_.reset();
+  }
   if (handler_) {
     handler_->onDestroy();
   }
@@ -53,11 +58,19 @@ Envoy::Http::FilterHeadersStatus ServiceControlFilter::decodeHeaders(
     return Envoy::Http::FilterHeadersStatus::StopIteration;
   }
 
+  const std::string original_method(headers.getMethodValue());
   if (utils::handleHttpMethodOverride(headers)) {
     // Update later filters that the HTTP method has changed by clearing the
     // route cache.
     ENVOY_LOG(debug, "HTTP method override occurred, recalculating route");
     decoder_callbacks_->clearRouteCache();
+
+    // Keep the original method for the routes forwarding it to the backend.
+    ::google::protobuf::Struct metadata;
+    (*metadata.mutable_fields())[utils::kDynamicMetadataOriginalMethod]
+        .set_string_value(original_method);
+    decoder_callbacks_->streamInfo().setDynamicMetadata(
+        utils::kDynamicMetadataServiceControl, metadata);
   }
 
   // Make sure route is calculated
@@ -108,12 +121,30 @@ void ServiceControlFilter::onCheckDone(
   }
 
   stats_.filter_.allowed_.inc();
+  handler_->fillDynamicMetadata(decoder_callbacks_->streamInfo());
   state_ = Complete;
+  startIntermediateReportTimer();
   if (stopped_) {
     decoder_callbacks_->continueDecoding();
   }
 }
 
+void ServiceControlFilter::startIntermediateReportTimer() {
+  const std::chrono::milliseconds interval(
+      handler_->intermediateReportIntervalMs());
+  if (interval.count() == 0) {
+    return;
+  }
+
+  intermediate_report_timer_ =
+      decoder_callbacks_->dispatcher().createTimer([this, interval]() {
+        ENVOY_LOG(debug, "Sending intermediate report");
+        handler_->callIntermediateReport();
+        intermediate_report_timer_->enableTimer(interval);
+      });
+  intermediate_report_timer_->enableTimer(interval);
+}
+
 void ServiceControlFilter::rejectRequest(Envoy::Http::Code code,
                                          absl::string_view error_msg,
                                          absl::string_view rc_detail) {
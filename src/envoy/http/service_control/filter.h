@@ -18,6 +18,7 @@
 
 #include "common/common/logger.h"
 #include "envoy/access_log/access_log.h"
+#include "envoy/event/timer.h"
 #include "envoy/http/filter.h"
 #include "envoy/http/header_map.h"
 #include "extensions/filters/http/common/pass_through_filter.h"
@@ -64,6 +65,9 @@ class ServiceControlFilter
   void rejectRequest(Envoy::Http::Code code, absl::string_view error_msg,
                      absl::string_view rc_detail);
 
+  // Starts the timer to send intermediate reports if enabled.
+  void startIntermediateReportTimer();
+
   ServiceControlFilterStats& stats_;
   const ServiceControlHandlerFactory& factory_;
 
@@ -75,6 +79,9 @@ class ServiceControlFilter
   State state_ = Init;
   // Mark if request has been stopped.
   bool stopped_ = false;
+
+  // The timer to send intermediate reports for long lived streams.
+  Envoy::Event::TimerPtr intermediate_report_timer_;
 };
 
 }  // namespace service_control
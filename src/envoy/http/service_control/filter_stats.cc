@@ -85,6 +85,11 @@ void ServiceControlFilterStats::collectCallStatus(CallStatusStats& stats,
   }
 }
 
+void ServiceControlFilterStats::collectCallLatency(
+    CallStatusStats& stats, std::chrono::milliseconds latency) {
+  stats.latency_.recordValue(latency.count());
+}
+
 }  // namespace service_control
 }  // namespace http_filters
 }  // namespace envoy
@@ -14,6 +14,8 @@
 
 #pragma once
 
+#include <chrono>
+
 #include "envoy/stats/scope.h"
 #include "envoy/stats/stats_macros.h"
 #include "google/protobuf/stubs/status.h"
@@ -37,34 +39,39 @@ namespace service_control {
   COUNTER(denied_consumer_error)         \
   COUNTER(denied_consumer_quota)         \
   COUNTER(denied_producer_error)         \
+  COUNTER(check_cache_hit)               \
+  COUNTER(check_cache_miss)              \
+  COUNTER(audited)                       \
   HISTOGRAM(request_time, Milliseconds)  \
   HISTOGRAM(backend_time, Milliseconds)  \
   HISTOGRAM(overhead_time, Milliseconds)
 
 /**
  * Service control call status stats.
- * These match the canonical RPC status codes.
+ * The counters match the canonical RPC status codes.
  * https://github.com/googleapis/googleapis/blob/master/google/rpc/code.proto
+ * The latency is recorded for each call made to service control.
  * @see stats_macros.h
  */
-#define CALL_STATUS_STATS(COUNTER) \
-  COUNTER(OK)                      \
-  COUNTER(CANCELLED)               \
-  COUNTER(UNKNOWN)                 \
-  COUNTER(INVALID_ARGUMENT)        \
-  COUNTER(DEADLINE_EXCEEDED)       \
-  COUNTER(NOT_FOUND)               \
-  COUNTER(ALREADY_EXISTS)          \
-  COUNTER(PERMISSION_DENIED)       \
-  COUNTER(RESOURCE_EXHAUSTED)      \
-  COUNTER(FAILED_PRECONDITION)     \
-  COUNTER(ABORTED)                 \
-  COUNTER(OUT_OF_RANGE)            \
-  COUNTER(UNIMPLEMENTED)           \
-  COUNTER(INTERNAL)                \
-  COUNTER(UNAVAILABLE)             \
-  COUNTER(DATA_LOSS)               \
-  COUNTER(UNAUTHENTICATED)
+#define CALL_STATUS_STATS(COUNTER, HISTOGRAM) \
+  COUNTER(OK)                                 \
+  COUNTER(CANCELLED)                          \
+  COUNTER(UNKNOWN)                            \
+  COUNTER(INVALID_ARGUMENT)                   \
+  COUNTER(DEADLINE_EXCEEDED)                  \
+  COUNTER(NOT_FOUND)                          \
+  COUNTER(ALREADY_EXISTS)                     \
+  COUNTER(PERMISSION_DENIED)                  \
+  COUNTER(RESOURCE_EXHAUSTED)                 \
+  COUNTER(FAILED_PRECONDITION)                \
+  COUNTER(ABORTED)                            \
+  COUNTER(OUT_OF_RANGE)                       \
+  COUNTER(UNIMPLEMENTED)                      \
+  COUNTER(INTERNAL)                           \
+  COUNTER(UNAVAILABLE)                        \
+  COUNTER(DATA_LOSS)                          \
+  COUNTER(UNAUTHENTICATED)                    \
+  HISTOGRAM(latency, Milliseconds)
 
 /**
  * Wrapper struct for general service control filter stats. @see stats_macros.h
@@ -77,7 +84,7 @@ struct FilterStats {
  * Wrapper struct for service control call status stats. @see stats_macros.h
  */
 struct CallStatusStats {
-  CALL_STATUS_STATS(GENERATE_COUNTER_STRUCT);
+  CALL_STATUS_STATS(GENERATE_COUNTER_STRUCT, GENERATE_HISTOGRAM_STRUCT);
 };
 
 /**
@@ -98,6 +105,10 @@ struct ServiceControlFilterStats {
       CallStatusStats& filter_stats,
       const ::google::protobuf::util::error::Code& code);
 
+  // Collect service control call latency.
+  static void collectCallLatency(CallStatusStats& filter_stats,
+                                 std::chrono::milliseconds latency);
+
   // Create a stat struct.
   static ServiceControlFilterStats create(const std::string& prefix,
                                           Envoy::Stats::Scope& scope) {
@@ -106,11 +117,15 @@ struct ServiceControlFilterStats {
     return {{FILTER_STATS(POOL_COUNTER_PREFIX(scope, final_prefix),
                           POOL_HISTOGRAM_PREFIX(scope, final_prefix))},
             {CALL_STATUS_STATS(
-                POOL_COUNTER_PREFIX(scope, final_prefix + "check."))},
+                POOL_COUNTER_PREFIX(scope, final_prefix + "check."),
+                POOL_HISTOGRAM_PREFIX(scope, final_prefix + "check."))},
             {CALL_STATUS_STATS(
-                POOL_COUNTER_PREFIX(scope, final_prefix + "allocate_quota."))},
+                POOL_COUNTER_PREFIX(scope, final_prefix + "allocate_quota."),
+                POOL_HISTOGRAM_PREFIX(scope,
+                                      final_prefix + "allocate_quota."))},
             {CALL_STATUS_STATS(
-                POOL_COUNTER_PREFIX(scope, final_prefix + "report."))}};
+                POOL_COUNTER_PREFIX(scope, final_prefix + "report."),
+                POOL_HISTOGRAM_PREFIX(scope, final_prefix + "report."))}};
   }
 };
 
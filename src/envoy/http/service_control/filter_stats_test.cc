@@ -88,6 +88,16 @@ TEST_F(FilterStatsTest, CollectCallStatus) {
   runTest(mappings, ServiceControlFilterStats::collectCallStatus);
 }
 
+TEST_F(FilterStatsTest, CollectCallLatency) {
+  EXPECT_CALL(context_.scope_,
+              deliverHistogramToSinks(
+                  testing::Property(&Envoy::Stats::Metric::name,
+                                    "service_control.report.latency"),
+                  25));
+  ServiceControlFilterStats::collectCallLatency(
+      stats_.report_, std::chrono::milliseconds(25));
+}
+
 }  // namespace
 }  // namespace service_control
 }  // namespace http_filters
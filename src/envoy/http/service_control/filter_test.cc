@@ -21,6 +21,8 @@
 #include "gtest/gtest.h"
 #include "src/envoy/http/service_control/handler.h"
 #include "src/envoy/http/service_control/mocks.h"
+#include "src/envoy/utils/filter_state_utils.h"
+#include "test/mocks/event/mocks.h"
 #include "test/mocks/server/mocks.h"
 #include "test/mocks/stats/mocks.h"
 #include "test/mocks/tracing/mocks.h"
@@ -133,6 +135,7 @@ TEST_F(ServiceControlFilterTest, DecodeHeadersSyncOKStatus) {
         callback.onCheckDone(Status::OK, "");
       }));
   EXPECT_CALL(*mock_handler_, fillFilterState(_));
+  EXPECT_CALL(*mock_handler_, fillDynamicMetadata(_));
   EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
             filter_->decodeHeaders(req_headers_, true));
 
@@ -141,6 +144,58 @@ TEST_F(ServiceControlFilterTest, DecodeHeadersSyncOKStatus) {
   filter_->onDestroy();
 }
 
+TEST_F(ServiceControlFilterTest, DecodeHeadersMethodOverride) {
+  Envoy::Http::TestRequestHeaderMapImpl headers{
+      {":method", "POST"},
+      {":path", "/bar"},
+      {"x-http-method-override", "PATCH"}};
+
+  // The original method is kept in the dynamic metadata.
+  EXPECT_CALL(mock_decoder_callbacks_, clearRouteCache());
+  EXPECT_CALL(mock_decoder_callbacks_.stream_info_,
+              setDynamicMetadata(utils::kDynamicMetadataServiceControl, _))
+      .WillOnce(Invoke(
+          [](const std::string&, const ::google::protobuf::Struct& metadata) {
+            EXPECT_EQ(metadata.fields()
+                          .at(utils::kDynamicMetadataOriginalMethod)
+                          .string_value(),
+                      "POST");
+          }));
+  EXPECT_CALL(*mock_handler_, callCheck(_, _, _))
+      .WillOnce(Invoke([](Envoy::Http::RequestHeaderMap&, Envoy::Tracing::Span&,
+                          ServiceControlHandler::CheckDoneCallback& callback) {
+        callback.onCheckDone(Status::OK, "");
+      }));
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(headers, true));
+  EXPECT_EQ(headers.getMethodValue(), "PATCH");
+}
+
+TEST_F(ServiceControlFilterTest, IntermediateReportTimer) {
+  // Test: If intermediate reports are enabled, they are sent periodically
+  // after the check succeeds, until the filter is destroyed.
+  auto* timer = new testing::NiceMock<Envoy::Event::MockTimer>(
+      &mock_decoder_callbacks_.dispatcher_);
+  EXPECT_CALL(*mock_handler_, intermediateReportIntervalMs())
+      .WillOnce(Return(100));
+  EXPECT_CALL(*timer, enableTimer(std::chrono::milliseconds(100), _))
+      .Times(2);
+
+  EXPECT_CALL(*mock_handler_, callCheck(_, _, _))
+      .WillOnce(Invoke([](Envoy::Http::RequestHeaderMap&, Envoy::Tracing::Span&,
+                          ServiceControlHandler::CheckDoneCallback& callback) {
+        callback.onCheckDone(Status::OK, "");
+      }));
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(req_headers_, true));
+
+  EXPECT_CALL(*mock_handler_, callIntermediateReport()).Times(1);
+  timer->invokeCallback();
+
+  EXPECT_CALL(*timer, disableTimer());
+  filter_->onDestroy();
+}
+
 TEST_F(ServiceControlFilterTest, OnDestoryWithoutHandler) {
   // Test: calling filter::onDestroy() without handler
   EXPECT_CALL(mock_handler_factory_, createHandler(_, _, _)).Times(0);
@@ -50,10 +50,22 @@ class ServiceControlHandler {
       const Envoy::Http::ResponseHeaderMap* response_headers,
       const Envoy::Http::ResponseTrailerMap* response_trailers) PURE;
 
+  // Returns the interval in milliseconds to send intermediate reports for the
+  // stream, or 0 if intermediate reports are disabled.
+  virtual int64_t intermediateReportIntervalMs() const PURE;
+
+  // Make an intermediate report call for a stream that is still in progress.
+  virtual void callIntermediateReport() PURE;
+
   // Fill filter state with request information for access logging.
   virtual void fillFilterState(
       ::Envoy::StreamInfo::FilterState& filter_state) PURE;
 
+  // Fill dynamic metadata with the consumer tier for rate limiting. Only
+  // called after a successful check.
+  virtual void fillDynamicMetadata(
+      ::Envoy::StreamInfo::StreamInfo& stream_info) PURE;
+
   // The request is about to be destroyed need to cancel all async requests.
   virtual void onDestroy() PURE;
 };
@@ -15,8 +15,10 @@
 #include "src/envoy/http/service_control/handler_impl.h"
 
 #include <chrono>
+#include <limits>
 
 #include "absl/strings/match.h"
+#include "absl/strings/numbers.h"
 #include "common/common/empty_string.h"
 #include "common/http/headers.h"
 #include "common/http/utility.h"
@@ -34,6 +36,7 @@ using Envoy::Http::CustomHeaders;
 using Envoy::Http::CustomInlineHeaderRegistry;
 using Envoy::Http::RegisterCustomInlineHeader;
 using ::Envoy::StreamInfo::FilterState;
+using ::espv2::api::envoy::v9::http::service_control::ReportRedaction;
 using ::espv2::api_proxy::service_control::CheckResponseInfo;
 using ::espv2::api_proxy::service_control::OperationInfo;
 using ::espv2::api_proxy::service_control::QuotaResponseInfo;
@@ -49,6 +52,9 @@ RegisterCustomInlineHeader<CustomInlineHeaderRegistry::Type::RequestHeaders>
 // The HTTP header suffix to send consumer info to backend.
 constexpr char kConsumerTypeHeaderSuffix[] = "api-consumer-type";
 constexpr char kConsumerNumberHeaderSuffix[] = "api-consumer-number";
+constexpr char kConsumerProjectNumberHeaderSuffix[] =
+    "api-consumer-project-number";
+constexpr char kApiKeyHashHeaderSuffix[] = "api-key-hash";
 
 // CheckRequest headers
 const Envoy::Http::LowerCaseString kIosBundleIdHeader{
@@ -58,6 +64,9 @@ const Envoy::Http::LowerCaseString kAndroidCertHeader{"x-android-cert"};
 
 constexpr char JwtPayloadIssuerPath[] = "iss";
 constexpr char JwtPayloadAudiencePath[] = "aud";
+
+// The rc detail of a JWT authentication failure allowed in audit mode.
+constexpr char kAuditRcDetailJwtAuthn[] = "jwt_authn_audited";
 }  // namespace
 
 ServiceControlHandlerImpl::ServiceControlHandlerImpl(
@@ -74,6 +83,11 @@ ServiceControlHandlerImpl::ServiceControlHandlerImpl(
                             kConsumerTypeHeaderSuffix),
       consumer_number_header_(cfg_parser_.config().generated_header_prefix() +
                               kConsumerNumberHeaderSuffix),
+      consumer_project_number_header_(
+          cfg_parser_.config().generated_header_prefix() +
+          kConsumerProjectNumberHeaderSuffix),
+      api_key_hash_header_(cfg_parser_.config().generated_header_prefix() +
+                           kApiKeyHashHeaderSuffix),
       is_grpc_(false),
       filter_stats_(filter_stats) {
   is_grpc_ = Envoy::Grpc::Common::hasGrpcContentType(headers);
@@ -102,6 +116,9 @@ ServiceControlHandlerImpl::ServiceControlHandlerImpl(
     extractAPIKey(headers, cfg_parser_.default_api_keys().locations(),
                   api_key_);
   }
+
+  fillCustomLabels(headers);
+  fillMetricCosts(headers);
 }
 
 ServiceControlHandlerImpl::~ServiceControlHandlerImpl() {}
@@ -127,11 +144,41 @@ absl::string_view ServiceControlHandlerImpl::getOperationFromPerRoute(
 void ServiceControlHandlerImpl::fillFilterState(FilterState& filter_state) {
   utils::setStringFilterState(filter_state, utils::kFilterStateApiKey,
                               api_key_);
+  if (!api_key_.empty()) {
+    utils::setStringFilterState(filter_state, utils::kFilterStateApiKeyHash,
+                                redactValue(api_key_, ReportRedaction::HASH));
+  }
 
   utils::setStringFilterState(filter_state, utils::kFilterStateApiMethod,
                               require_ctx_->config().operation_name());
 }
 
+void ServiceControlHandlerImpl::fillDynamicMetadata(
+    Envoy::StreamInfo::StreamInfo& stream_info) {
+  if (!hasApiKey()) {
+    return;
+  }
+
+  const auto& consumer_tiers = cfg_parser_.config().consumer_tiers();
+  std::string tier = consumer_tiers.default_tier();
+  const auto it = consumer_tiers.project_number_tiers().find(
+      check_response_info_.consumer_project_number);
+  if (it != consumer_tiers.project_number_tiers().end()) {
+    tier = it->second;
+  }
+  if (tier.empty()) {
+    return;
+  }
+
+  ::google::protobuf::Struct metadata;
+  auto& fields = *metadata.mutable_fields();
+  fields[utils::kDynamicMetadataConsumerTier].set_string_value(tier);
+  fields[utils::kDynamicMetadataApiKeyHash].set_string_value(
+      redactValue(api_key_, ReportRedaction::HASH));
+  stream_info.setDynamicMetadata(utils::kDynamicMetadataServiceControl,
+                                 metadata);
+}
+
 void ServiceControlHandlerImpl::onDestroy() {
   if (cancel_fn_) {
     cancel_fn_();
@@ -139,6 +186,53 @@ void ServiceControlHandlerImpl::onDestroy() {
   }
 }
 
+void ServiceControlHandlerImpl::fillCustomLabels(
+    const Envoy::Http::RequestHeaderMap& headers) {
+  const auto& service_config = require_ctx_->service_ctx().config();
+  for (const auto& label : service_config.custom_labels()) {
+    custom_labels_.emplace_back(label.first, label.second);
+  }
+  for (const auto& header_label : service_config.header_labels()) {
+    const absl::string_view value = utils::extractHeader(
+        headers, Envoy::Http::LowerCaseString(header_label.header()));
+    if (!value.empty()) {
+      custom_labels_.emplace_back(header_label.label(), std::string(value));
+    }
+  }
+}
+
+void ServiceControlHandlerImpl::fillMetricCosts(
+    const Envoy::Http::RequestHeaderMap& headers) {
+  if (!require_ctx_->has_cost_headers()) {
+    return;
+  }
+
+  metric_costs_ = require_ctx_->metric_costs();
+  const auto& config = require_ctx_->config();
+  for (int i = 0; i < config.metric_costs_size(); ++i) {
+    const auto& metric_cost = config.metric_costs(i);
+    if (metric_cost.cost_header().empty()) {
+      continue;
+    }
+    const absl::string_view value = utils::extractHeader(
+        headers, Envoy::Http::LowerCaseString(metric_cost.cost_header()));
+    // A count of 0 would let the clients skip the quota, it is invalid.
+    int64_t count;
+    if (value.empty() || !absl::SimpleAtoi(value, &count) || count < 1) {
+      ENVOY_LOG(debug, "Invalid quota cost header {}: {}",
+                metric_cost.cost_header(), value);
+      continue;
+    }
+    // Clamp the cost to the range of the quota request cost.
+    const int64_t max_cost = std::numeric_limits<int>::max();
+    int64_t cost = max_cost;
+    if (metric_cost.cost() == 0 || count <= max_cost / metric_cost.cost()) {
+      cost = metric_cost.cost() * count;
+    }
+    metric_costs_[i].second = static_cast<int>(cost);
+  }
+}
+
 void ServiceControlHandlerImpl::fillOperationInfo(
     ::espv2::api_proxy::service_control::OperationInfo& info) {
   info.operation_id = uuid_;
@@ -154,6 +248,7 @@ void ServiceControlHandlerImpl::fillOperationInfo(
   }
 
   info.api_key = api_key_;
+  info.custom_labels = custom_labels_;
 }
 
 void ServiceControlHandlerImpl::prepareReportRequest(
@@ -169,6 +264,10 @@ void ServiceControlHandlerImpl::prepareReportRequest(
 
   info.check_response_info = check_response_info_;
   info.status = check_status_;
+  if (!audit_status_.ok()) {
+    absl::StrAppend(&info.log_message, ", allowed in audit mode despite: ",
+                    audit_status_.ToString());
+  }
 
   fillGCPInfo(cfg_parser_.config(), info);
 }
@@ -176,6 +275,16 @@ void ServiceControlHandlerImpl::prepareReportRequest(
 void ServiceControlHandlerImpl::callCheck(
     Envoy::Http::RequestHeaderMap& headers, Envoy::Tracing::Span& parent_span,
     CheckDoneCallback& callback) {
+  // The backend trusts the consumer headers, so the ones sent by the clients
+  // are removed.
+  const auto& consumer_headers = cfg_parser_.config().consumer_headers();
+  if (consumer_headers.project_number()) {
+    headers.remove(consumer_project_number_header_);
+  }
+  if (consumer_headers.api_key_hash()) {
+    headers.remove(api_key_hash_header_);
+  }
+
   // NOTE: this shouldn't happen in practice because Path Matcher filter would
   // have already rejected the request.
   if (!isConfigured()) {
@@ -190,6 +299,15 @@ void ServiceControlHandlerImpl::callCheck(
   }
   check_callback_ = &callback;
 
+  if (isAuditMode() && require_ctx_->config().audit_jwt_authn() &&
+      !hasJwtPayload(
+          stream_info_.dynamicMetadata(),
+          require_ctx_->service_ctx().config().jwt_payload_metadata_name())) {
+    recordAuditFailure(
+        Status(Code::UNAUTHENTICATED, "Jwt is missing or invalid"),
+        kAuditRcDetailJwtAuthn);
+  }
+
   if (!isCheckRequired()) {
     callQuota();
     return;
@@ -202,7 +320,7 @@ void ServiceControlHandlerImpl::callCheck(
                "Method doesn't allow unregistered callers (callers without "
                "established identity). Please use API Key or other form of "
                "API consumer identity to call this API.");
-    callback.onCheckDone(
+    onCheckDone(
         check_status_,
         utils::generateRcDetails(utils::kRcDetailFilterServiceControl,
                                  utils::kRcDetailErrorTypeBadRequest,
@@ -224,7 +342,7 @@ void ServiceControlHandlerImpl::callCheck(
       std::string(utils::extractHeader(headers, kAndroidCertHeader));
 
   on_check_done_called_ = false;
-  cancel_fn_ = require_ctx_->service_ctx().call().callCheck(
+  cancel_fn_ = require_ctx_->service_ctx().call(uuid_).callCheck(
       info, parent_span,
       [this, &headers](const Status& status,
                        const CheckResponseInfo& response_info) {
@@ -240,12 +358,13 @@ void ServiceControlHandlerImpl::callCheck(
 // TODO(taoxuy): add unit test
 void ServiceControlHandlerImpl::callQuota() {
   if (!isQuotaRequired()) {
-    check_callback_->onCheckDone(check_status_, rc_detail_);
+    onCheckDone(check_status_, rc_detail_);
     return;
   }
 
   ::espv2::api_proxy::service_control::QuotaRequestInfo info{
-      require_ctx_->metric_costs()};
+      require_ctx_->has_cost_headers() ? metric_costs_
+                                       : require_ctx_->metric_costs()};
   info.method_name = require_ctx_->config().operation_name();
   fillOperationInfo(info);
 
@@ -253,7 +372,7 @@ void ServiceControlHandlerImpl::callQuota() {
   // transport, need to save its cancel function.
   // For now, quota cache is always enabled, in-flight transport
   // is not called.
-  require_ctx_->service_ctx().call().callQuota(
+  require_ctx_->service_ctx().call(uuid_).callQuota(
       info,
       [this](const Status& status, const QuotaResponseInfo& response_info) {
         if (!response_info.error.name.empty()) {
@@ -265,10 +384,34 @@ void ServiceControlHandlerImpl::callQuota() {
               response_info.error.name);
         }
         check_status_ = status;
-        check_callback_->onCheckDone(status, rc_detail_);
+        onCheckDone(status, rc_detail_);
       });
 }
 
+void ServiceControlHandlerImpl::onCheckDone(const Status& status,
+                                            const std::string& rc_detail) {
+  if (status.ok() || !isAuditMode()) {
+    check_callback_->onCheckDone(status, rc_detail);
+    return;
+  }
+  recordAuditFailure(status, rc_detail);
+  check_status_ = Status::OK;
+  check_callback_->onCheckDone(Status::OK, "");
+}
+
+void ServiceControlHandlerImpl::recordAuditFailure(
+    const Status& status, absl::string_view rc_detail) {
+  ENVOY_LOG(warn,
+            "Allowing request {} {} of operation {} in audit mode despite: {} "
+            "({})",
+            http_method_, path_, require_ctx_->config().operation_name(),
+            status.ToString(), rc_detail);
+  filter_stats_.filter_.audited_.inc();
+  if (audit_status_.ok()) {
+    audit_status_ = status;
+  }
+}
+
 void ServiceControlHandlerImpl::onCheckResponse(
     Envoy::Http::RequestHeaderMap& headers, const Status& status,
     const CheckResponseInfo& response_info) {
@@ -296,10 +439,21 @@ void ServiceControlHandlerImpl::onCheckResponse(
   }
 
   if (!check_status_.ok()) {
-    check_callback_->onCheckDone(check_status_, rc_detail_);
+    onCheckDone(check_status_, rc_detail_);
     return;
   }
 
+  const auto& consumer_headers = cfg_parser_.config().consumer_headers();
+  if (consumer_headers.project_number() &&
+      !response_info.consumer_project_number.empty()) {
+    headers.setReferenceKey(consumer_project_number_header_,
+                            response_info.consumer_project_number);
+  }
+  if (consumer_headers.api_key_hash() && !api_key_.empty()) {
+    headers.setCopy(api_key_hash_header_,
+                    redactValue(api_key_, ReportRedaction::HASH));
+  }
+
   callQuota();
 }
 
@@ -313,9 +467,11 @@ void ServiceControlHandlerImpl::callReport(
 
   ::espv2::api_proxy::service_control::ReportRequestInfo info;
   prepareReportRequest(info);
+  const auto& redaction =
+      require_ctx_->service_ctx().config().report_redaction();
   fillLoggedHeader(request_headers,
                    require_ctx_->service_ctx().config().log_request_headers(),
-                   info.request_headers);
+                   info.request_headers, &redaction.request_headers());
   fillLoggedHeader(response_headers,
                    require_ctx_->service_ctx().config().log_response_headers(),
                    info.response_headers);
@@ -343,6 +499,7 @@ void ServiceControlHandlerImpl::callReport(
     info.referer = std::string(utils::readHeaderEntry(
         request_headers->getInline(referer_handle.handle())));
   }
+  redactReportRequestInfo(redaction, info);
 
   fillLatency(stream_info_, info.latency, filter_stats_);
 
@@ -360,8 +517,53 @@ void ServiceControlHandlerImpl::callReport(
   info.response_size = stream_info_.bytesSent() + response_header_size;
 
   info.response_code_detail = stream_info_.responseCodeDetails().value_or("");
+  fillStreamReportInfo(info, /*is_final_report=*/true);
+
+  require_ctx_->service_ctx().call(uuid_).callReport(info);
+}
 
-  require_ctx_->service_ctx().call().callReport(info);
+int64_t ServiceControlHandlerImpl::intermediateReportIntervalMs() const {
+  if (!require_ctx_->config().send_intermediate_reports() ||
+      !isReportRequired()) {
+    return 0;
+  }
+  return require_ctx_->service_ctx().get_min_stream_report_interval_ms();
+}
+
+void ServiceControlHandlerImpl::callIntermediateReport() {
+  if (intermediateReportIntervalMs() == 0) {
+    return;
+  }
+
+  ::espv2::api_proxy::service_control::ReportRequestInfo info;
+  prepareReportRequest(info);
+  redactReportRequestInfo(
+      require_ctx_->service_ctx().config().report_redaction(), info);
+  info.backend_protocol =
+      getBackendProtocol(require_ctx_->service_ctx().config());
+  info.response_code = stream_info_.responseCode().value_or(200);
+  fillStreamReportInfo(info, /*is_final_report=*/false);
+
+  require_ctx_->service_ctx().call(uuid_).callReport(info);
+}
+
+void ServiceControlHandlerImpl::fillStreamReportInfo(
+    ::espv2::api_proxy::service_control::ReportRequestInfo& info,
+    bool is_final_report) {
+  info.is_first_report = is_first_report_;
+  info.is_final_report = is_final_report;
+  is_first_report_ = false;
+
+  if (!require_ctx_->config().send_intermediate_reports()) {
+    return;
+  }
+  const uint64_t request_bytes = stream_info_.bytesReceived();
+  const uint64_t response_bytes = stream_info_.bytesSent();
+  info.is_streaming = true;
+  info.request_bytes = request_bytes - reported_request_bytes_;
+  info.response_bytes = response_bytes - reported_response_bytes_;
+  reported_request_bytes_ = request_bytes;
+  reported_response_bytes_ = response_bytes;
 }
 
 }  // namespace service_control
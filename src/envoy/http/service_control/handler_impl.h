@@ -59,8 +59,15 @@ class ServiceControlHandlerImpl
       const Envoy::Http::ResponseHeaderMap* response_headers,
       const Envoy::Http::ResponseTrailerMap* response_trailers) override;
 
+  int64_t intermediateReportIntervalMs() const override;
+
+  void callIntermediateReport() override;
+
   void fillFilterState(::Envoy::StreamInfo::FilterState& filter_state) override;
 
+  void fillDynamicMetadata(
+      ::Envoy::StreamInfo::StreamInfo& stream_info) override;
+
   void onDestroy() override;
 
  private:
@@ -69,11 +76,22 @@ class ServiceControlHandlerImpl
 
   void callQuota();
 
+  // Collects the static and the request header derived labels.
+  void fillCustomLabels(const Envoy::Http::RequestHeaderMap& headers);
+
+  // Computes the metric costs that are derived from the request headers.
+  void fillMetricCosts(const Envoy::Http::RequestHeaderMap& headers);
+
   void fillOperationInfo(
       ::espv2::api_proxy::service_control::OperationInfo& info);
   void prepareReportRequest(
       ::espv2::api_proxy::service_control::ReportRequestInfo& info);
 
+  // Fills the stream report state, and advances it to the next report.
+  void fillStreamReportInfo(
+      ::espv2::api_proxy::service_control::ReportRequestInfo& info,
+      bool is_final_report);
+
   bool isConfigured() const {
     return require_ctx_ != cfg_parser_.non_match_rqm_ctx();
   }
@@ -85,7 +103,8 @@ class ServiceControlHandlerImpl
 
   bool isCheckRequired() const {
     return !require_ctx_->config().api_key().allow_without_api_key() &&
-           !require_ctx_->config().skip_service_control();
+           !require_ctx_->config().skip_service_control() &&
+           !require_ctx_->config().skip_check();
   }
 
   bool isReportRequired() const {
@@ -94,6 +113,18 @@ class ServiceControlHandlerImpl
 
   bool hasApiKey() const { return !api_key_.empty(); }
 
+  bool isAuditMode() const { return require_ctx_->config().audit_mode(); }
+
+  // Calls the check callback. In audit mode, a failure is recorded and the
+  // request is allowed.
+  void onCheckDone(const ::google::protobuf::util::Status& status,
+                   const std::string& rc_detail);
+
+  // Logs a failure allowed in audit mode, and keeps the first one for the
+  // Report.
+  void recordAuditFailure(const ::google::protobuf::util::Status& status,
+                          absl::string_view rc_detail);
+
   void onCheckResponse(
       Envoy::Http::RequestHeaderMap& headers,
       const ::google::protobuf::util::Status& status,
@@ -117,6 +148,13 @@ class ServiceControlHandlerImpl
   std::string uuid_;
   std::string api_key_;
 
+  // The operator defined labels for Check and Report.
+  std::vector<std::pair<std::string, std::string>> custom_labels_;
+
+  // The metric costs of this request, only set if some costs are derived
+  // from the request headers.
+  std::vector<std::pair<std::string, int>> metric_costs_;
+
   // Considering the request headers can be modified, the original downstream
   // header should be used as request_header_size. This variable is used to
   // remember the downstream header size when HandlerImpl object is created.
@@ -125,6 +163,8 @@ class ServiceControlHandlerImpl
   // The name of headers to send consumer info
   const Envoy::Http::LowerCaseString consumer_type_header_;
   const Envoy::Http::LowerCaseString consumer_number_header_;
+  const Envoy::Http::LowerCaseString consumer_project_number_header_;
+  const Envoy::Http::LowerCaseString api_key_hash_header_;
 
   CheckDoneCallback* check_callback_{};
   ::espv2::api_proxy::service_control::CheckResponseInfo check_response_info_;
@@ -133,12 +173,21 @@ class ServiceControlHandlerImpl
   // The response code detail.
   std::string rc_detail_;
 
+  // The first failure allowed in audit mode.
+  ::google::protobuf::util::Status audit_status_;
+
   CancelFunc cancel_fn_;
   bool on_check_done_called_;
 
   // If true, it is a grpc and need to send multiple reports.
   bool is_grpc_;
 
+  // The state of the intermediate reports of a stream. The byte counts are
+  // the totals already reported.
+  bool is_first_report_ = true;
+  uint64_t reported_request_bytes_ = 0;
+  uint64_t reported_response_bytes_ = 0;
+
   // Filter statistics.
   ServiceControlFilterStats& filter_stats_;
 };
@@ -15,6 +15,8 @@
 
 #include "src/envoy/http/service_control/handler_impl.h"
 
+#include <limits>
+
 #include "common/common/empty_string.h"
 #include "envoy/http/header_map.h"
 #include "gmock/gmock.h"
@@ -55,6 +57,7 @@ using ::testing::_;
 using ::testing::ByMove;
 using ::testing::MockFunction;
 using ::testing::Return;
+using ::testing::SaveArg;
 
 const char kFilterConfig[] = R"(
 services {
@@ -143,6 +146,45 @@ requirements {
     cost: 1
   }
 }
+requirements {
+  service_name: "echo"
+  api_name: "test_api"
+  api_version: "test_version"
+  operation_name: "quota_cost_header"
+  api_key: {
+    allow_without_api_key: true
+  }
+  metric_costs: {
+    name: "metric_name_1"
+    cost: 2
+    cost_header: "x-batch-size"
+  }
+  metric_costs: {
+    name: "metric_name_2"
+    cost: 4
+  }
+}
+requirements {
+  service_name: "echo"
+  api_name: "test_api"
+  api_version: "test_version"
+  operation_name: "skip_check"
+  api_key: {
+    allow_without_api_key: false
+  }
+  skip_check: true
+}
+requirements {
+  service_name: "echo"
+  api_name: "test_api"
+  api_version: "test_version"
+  operation_name: "audit_mode"
+  api_key: {
+    allow_without_api_key: false
+  }
+  audit_mode: true
+  audit_jwt_authn: true
+}
 requirements {
   service_name: "echo"
   api_name: "test_api"
@@ -589,6 +631,43 @@ TEST_F(HandlerTest, HandlerSuccessfulCheckSyncWithoutApiKeyRestrictionFields) {
   handler.callReport(&headers, &response_headers, &resp_trailer_);
 }
 
+TEST_F(HandlerTest, HandlerSuccessfulCheckSyncWithConsumerHeaders) {
+  // Test: Check succeeds and the consumer project number and api key hash are
+  // sent to the backend, replacing the headers sent by the client.
+  const std::string filter_config = std::string(kFilterConfig) + R"(
+consumer_headers {
+  project_number: true
+  api_key_hash: true
+})";
+  setUp(filter_config.c_str());
+  setPerRouteOperation("get_header_key");
+  TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                   {":path", "/echo"},
+                                   {"x-api-key", "foobar"},
+                                   {"api-consumer-project-number", "spoofed"},
+                                   {"api-key-hash", "spoofed"}};
+  ServiceControlHandlerImpl handler(headers, mock_stream_info_, "test-uuid",
+                                    *cfg_parser_, test_time_, stats_);
+  CheckResponseInfo response_info;
+  response_info.consumer_project_number = "123456";
+
+  EXPECT_CALL(*mock_call_, callCheck(_, _, _))
+      .WillOnce(Invoke([&response_info](const CheckRequestInfo&,
+                                        Envoy::Tracing::Span&,
+                                        CheckDoneFunc on_done) {
+        on_done(Status::OK, response_info);
+        return nullptr;
+      }));
+  EXPECT_CALL(mock_check_done_callback_, onCheckDone(Status::OK, ""));
+  handler.callCheck(headers, *mock_span_, mock_check_done_callback_);
+
+  EXPECT_EQ(headers.get_("api-consumer-project-number"), "123456");
+  // The sha256 of "foobar".
+  EXPECT_EQ(
+      headers.get_("api-key-hash"),
+      "c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2");
+}
+
 TEST_F(HandlerTest, HandlerSuccessfulQuotaSync) {
   // Test: Quota is required and succeeds.
   setPerRouteOperation("get_header_key_quota");
@@ -627,6 +706,121 @@ TEST_F(HandlerTest, HandlerSuccessfulQuotaSync) {
   handler.callReport(&headers, &response_headers, &resp_trailer_);
 }
 
+TEST_F(HandlerTest, HandlerQuotaCostHeader) {
+  // Test: The metric cost is multiplied by the value of the cost header.
+  struct TestCase {
+    std::string batch_size;
+    int want_cost;
+  };
+  const std::vector<TestCase> test_cases = {
+      {"5", 10},
+      {"1", 2},
+      {"0", 2},
+      {"-1", 2},
+      {"abc", 2},
+      {"9223372036854775807", std::numeric_limits<int>::max()},
+  };
+
+  for (const auto& tc : test_cases) {
+    setUp(kFilterConfig);
+    setPerRouteOperation("quota_cost_header");
+    TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                     {":path", "/echo?key=foobar"},
+                                     {"x-batch-size", tc.batch_size}};
+    ServiceControlHandlerImpl handler(headers, mock_stream_info_, "test-uuid",
+                                      *cfg_parser_, test_time_, stats_);
+
+    const std::vector<std::pair<std::string, int>> want_metric_costs = {
+        {"metric_name_1", tc.want_cost}, {"metric_name_2", 4}};
+    QuotaRequestInfo expected_quota_info{want_metric_costs};
+    expected_quota_info.method_name = "quota_cost_header";
+    expected_quota_info.api_key = "foobar";
+
+    QuotaResponseInfo quota_response_info;
+    EXPECT_CALL(*mock_call_,
+                callQuota(MatchesQuotaInfo(expected_quota_info), _))
+        .WillOnce(Invoke([&quota_response_info](const QuotaRequestInfo&,
+                                                QuotaDoneFunc on_done) {
+          on_done(Status::OK, quota_response_info);
+        }));
+
+    EXPECT_CALL(mock_check_done_callback_, onCheckDone(Status::OK, ""));
+    handler.callCheck(headers, *mock_span_, mock_check_done_callback_);
+  }
+}
+
+TEST_F(HandlerTest, HandlerSkipCheck) {
+  // Test: Check is skipped without an API key, but Report is still sent.
+  setPerRouteOperation("skip_check");
+  TestRequestHeaderMapImpl headers{{":method", "GET"}, {":path", "/echo"}};
+  TestResponseHeaderMapImpl response_headers{
+      {"content-type", "application/grpc"}};
+  ServiceControlHandlerImpl handler(headers, mock_stream_info_, "test-uuid",
+                                    *cfg_parser_, test_time_, stats_);
+
+  EXPECT_CALL(*mock_call_, callCheck(_, _, _)).Times(0);
+  EXPECT_CALL(*mock_call_, callQuota(_, _)).Times(0);
+  EXPECT_CALL(mock_check_done_callback_, onCheckDone(Status::OK, ""));
+  handler.callCheck(headers, *mock_span_, mock_check_done_callback_);
+
+  EXPECT_CALL(*mock_call_, callReport(_));
+  handler.callReport(&headers, &response_headers, &resp_trailer_);
+}
+
+TEST_F(HandlerTest, HandlerAuditModeMissingApiKeyAndJwt) {
+  // Test: In audit mode, the request without an API key and a verified JWT is
+  // allowed, and the failure is logged in the Report.
+  setPerRouteOperation("audit_mode");
+  TestRequestHeaderMapImpl headers{{":method", "GET"}, {":path", "/echo"}};
+  TestResponseHeaderMapImpl response_headers{
+      {"content-type", "application/grpc"}};
+  ServiceControlHandlerImpl handler(headers, mock_stream_info_, "test-uuid",
+                                    *cfg_parser_, test_time_, stats_);
+
+  EXPECT_CALL(*mock_call_, callCheck(_, _, _)).Times(0);
+  EXPECT_CALL(mock_check_done_callback_, onCheckDone(Status::OK, ""));
+  handler.callCheck(headers, *mock_span_, mock_check_done_callback_);
+
+  EXPECT_CALL(*mock_call_, callReport(_))
+      .WillOnce(Invoke([](const ReportRequestInfo& info) {
+        EXPECT_TRUE(info.status.ok());
+        EXPECT_EQ(info.log_message,
+                  "audit_mode is called, allowed in audit mode despite: "
+                  "UNAUTHENTICATED:Jwt is missing or invalid");
+      }));
+  handler.callReport(&headers, &response_headers, &resp_trailer_);
+
+  // Stats.
+  checkAndReset(stats_.filter_.audited_, 2);
+}
+
+TEST_F(HandlerTest, HandlerAuditModeFailCheck) {
+  // Test: In audit mode, the request failing the Check is allowed.
+  setPerRouteOperation("audit_mode");
+  TestRequestHeaderMapImpl headers{
+      {":method", "GET"}, {":path", "/echo"}, {"x-api-key", "foobar"}};
+  ServiceControlHandlerImpl handler(headers, mock_stream_info_, "test-uuid",
+                                    *cfg_parser_, test_time_, stats_);
+
+  Status bad_status = Status(Code::PERMISSION_DENIED,
+                             "test bad status returned from service control");
+  CheckResponseInfo response_info;
+  response_info.error = {"API_KEY_INVALID", false,
+                         ScResponseErrorType::API_KEY_INVALID};
+  EXPECT_CALL(*mock_call_, callCheck(_, _, _))
+      .WillOnce(Invoke([&response_info, bad_status](const CheckRequestInfo&,
+                                                    Envoy::Tracing::Span&,
+                                                    CheckDoneFunc on_done) {
+        on_done(bad_status, response_info);
+        return nullptr;
+      }));
+  EXPECT_CALL(mock_check_done_callback_, onCheckDone(Status::OK, ""));
+  handler.callCheck(headers, *mock_span_, mock_check_done_callback_);
+
+  // Stats: the missing JWT and the failed Check.
+  checkAndReset(stats_.filter_.audited_, 2);
+}
+
 TEST_F(HandlerTest, HandlerCallQuotaWithoutCheck) {
   // Test: Quota is required but the Check is not
   setPerRouteOperation("call_quota_without_check");
@@ -724,6 +918,88 @@ TEST_F(HandlerTest, FillFilterState) {
   EXPECT_EQ(utils::getStringFilterState(*mock_stream_info_.filter_state_,
                                         utils::kFilterStateApiMethod),
             "get_header_key");
+  // The SHA-256 of "foobar".
+  EXPECT_EQ(utils::getStringFilterState(*mock_stream_info_.filter_state_,
+                                        utils::kFilterStateApiKeyHash),
+            "c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2");
+}
+
+TEST_F(HandlerTest, FillDynamicMetadata) {
+  // Test: After a successful check, the consumer tier of the project number
+  // and the api key hash are set in the dynamic metadata.
+  const std::string filter_config = std::string(kFilterConfig) + R"(
+consumer_tiers {
+  project_number_tiers {
+    key: "123456"
+    value: "gold"
+  }
+  default_tier: "free"
+})";
+  setUp(filter_config.c_str());
+  setPerRouteOperation("get_header_key");
+  TestRequestHeaderMapImpl headers{
+      {":method", "GET"}, {":path", "/echo"}, {"x-api-key", "foobar"}};
+  ServiceControlHandlerImpl handler(headers, mock_stream_info_, "test-uuid",
+                                    *cfg_parser_, test_time_, stats_);
+  CheckResponseInfo response_info;
+  response_info.consumer_project_number = "123456";
+  EXPECT_CALL(*mock_call_, callCheck(_, _, _))
+      .WillOnce(Invoke([&response_info](const CheckRequestInfo&,
+                                        Envoy::Tracing::Span&,
+                                        CheckDoneFunc on_done) {
+        on_done(Status::OK, response_info);
+        return nullptr;
+      }));
+  EXPECT_CALL(mock_check_done_callback_, onCheckDone(Status::OK, ""));
+  handler.callCheck(headers, *mock_span_, mock_check_done_callback_);
+
+  ::google::protobuf::Struct metadata;
+  EXPECT_CALL(mock_stream_info_,
+              setDynamicMetadata(utils::kDynamicMetadataServiceControl, _))
+      .WillOnce(SaveArg<1>(&metadata));
+  handler.fillDynamicMetadata(mock_stream_info_);
+
+  EXPECT_EQ(metadata.fields()
+                .at(utils::kDynamicMetadataConsumerTier)
+                .string_value(),
+            "gold");
+  // The SHA-256 of "foobar".
+  EXPECT_EQ(
+      metadata.fields().at(utils::kDynamicMetadataApiKeyHash).string_value(),
+      "c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2");
+}
+
+TEST_F(HandlerTest, FillDynamicMetadataDefaultTier) {
+  // Test: Without a tier for the consumer project number, the default tier is
+  // used, and without any tier no metadata is set.
+  const std::string filter_config = std::string(kFilterConfig) + R"(
+consumer_tiers {
+  default_tier: "free"
+})";
+  setUp(filter_config.c_str());
+  setPerRouteOperation("get_header_key");
+  TestRequestHeaderMapImpl headers{
+      {":method", "GET"}, {":path", "/echo"}, {"x-api-key", "foobar"}};
+  ServiceControlHandlerImpl handler(headers, mock_stream_info_, "test-uuid",
+                                    *cfg_parser_, test_time_, stats_);
+
+  ::google::protobuf::Struct metadata;
+  EXPECT_CALL(mock_stream_info_,
+              setDynamicMetadata(utils::kDynamicMetadataServiceControl, _))
+      .WillOnce(SaveArg<1>(&metadata));
+  handler.fillDynamicMetadata(mock_stream_info_);
+  EXPECT_EQ(metadata.fields()
+                .at(utils::kDynamicMetadataConsumerTier)
+                .string_value(),
+            "free");
+
+  setUp(kFilterConfig);
+  setPerRouteOperation("get_header_key");
+  ServiceControlHandlerImpl no_tier_handler(headers, mock_stream_info_,
+                                            "test-uuid", *cfg_parser_,
+                                            test_time_, stats_);
+  EXPECT_CALL(mock_stream_info_, setDynamicMetadata(_, _)).Times(0);
+  no_tier_handler.fillDynamicMetadata(mock_stream_info_);
 }
 
 TEST_F(HandlerTest, HandlerFailQuotaSync) {
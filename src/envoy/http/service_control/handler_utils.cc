@@ -17,10 +17,15 @@
 #include <sstream>
 #include <vector>
 
+#include "absl/strings/ascii.h"
+#include "absl/strings/match.h"
 #include "absl/strings/str_cat.h"
 #include "absl/strings/str_split.h"
 #include "api/envoy/v9/http/service_control/config.pb.h"
+#include "common/buffer/buffer_impl.h"
+#include "common/common/hex.h"
 #include "common/common/logger.h"
+#include "common/crypto/utility.h"
 #include "common/http/header_utility.h"
 #include "common/http/utility.h"
 #include "envoy/http/header_map.h"
@@ -29,8 +34,10 @@
 #include "src/api_proxy/service_control/request_builder.h"
 
 using ::espv2::api::envoy::v9::http::service_control::ApiKeyLocation;
+using ::espv2::api::envoy::v9::http::service_control::ReportRedaction;
 using ::espv2::api::envoy::v9::http::service_control::Service;
 using ::espv2::api_proxy::service_control::LatencyInfo;
+using ::espv2::api_proxy::service_control::ReportRequestInfo;
 using ::espv2::api_proxy::service_control::protocol::Protocol;
 
 namespace espv2 {
@@ -72,14 +79,30 @@ bool extractAPIKeyFromQuery(const Envoy::Http::RequestHeaderMap& headers,
 }
 
 bool extractAPIKeyFromHeader(const Envoy::Http::RequestHeaderMap& headers,
-                             const std::string& header, std::string& api_key) {
+                             const std::string& header,
+                             const std::string& value_prefix,
+                             std::string& api_key) {
   // TODO(qiwzhang): optimize this by using LowerCaseString at init.
   auto entry = headers.get(Envoy::Http::LowerCaseString(header));
-  if (!entry.empty()) {
-    api_key = std::string(entry[0]->value().getStringView());
-    return true;
+  if (entry.empty()) {
+    return false;
   }
-  return false;
+
+  absl::string_view value = entry[0]->value().getStringView();
+  if (!value_prefix.empty()) {
+    // The header may carry other credentials, e.g. "Authorization: Bearer",
+    // only use it when the value has the expected scheme.
+    if (!absl::StartsWithIgnoreCase(value, value_prefix)) {
+      return false;
+    }
+    value = absl::StripLeadingAsciiWhitespace(
+        value.substr(value_prefix.size()));
+    if (value.empty()) {
+      return false;
+    }
+  }
+  api_key = std::string(value);
+  return true;
 }
 
 bool extractAPIKeyFromCookie(const Envoy::Http::RequestHeaderMap& headers,
@@ -149,17 +172,70 @@ void fillGCPInfo(
 void fillLoggedHeader(
     const Envoy::Http::HeaderMap* headers,
     const ::google::protobuf::RepeatedPtrField<::std::string>& log_headers,
-    std::string& info_header_field) {
+    std::string& info_header_field,
+    const ::google::protobuf::Map<std::string, ReportRedaction::Action>*
+        redactions) {
   if (headers == nullptr) {
     return;
   }
   for (const auto& log_header : log_headers) {
+    const Envoy::Http::LowerCaseString header_name(log_header);
     const auto entry = Envoy::Http::HeaderUtility::getAllOfHeaderAsString(
-        *headers, Envoy::Http::LowerCaseString(log_header));
-    if (entry.result().has_value()) {
-      absl::StrAppend(&info_header_field, log_header, "=",
-                      entry.result().value(), ";");
+        *headers, header_name);
+    if (!entry.result().has_value()) {
+      continue;
     }
+
+    ReportRedaction::Action action = ReportRedaction::KEEP;
+    if (redactions != nullptr) {
+      const auto it = redactions->find(header_name.get());
+      if (it != redactions->end()) {
+        action = it->second;
+      }
+    }
+    if (action == ReportRedaction::DROP) {
+      continue;
+    }
+    absl::StrAppend(&info_header_field, log_header, "=",
+                    redactValue(entry.result().value(), action), ";");
+  }
+}
+
+std::string redactValue(absl::string_view value,
+                        ReportRedaction::Action action) {
+  switch (action) {
+    case ReportRedaction::DROP:
+      return "";
+    case ReportRedaction::HASH: {
+      Envoy::Buffer::OwnedImpl buffer(value);
+      return Envoy::Hex::encode(
+          Envoy::Common::Crypto::UtilitySingleton::get().getSha256Digest(
+              buffer));
+    }
+    default:
+      return std::string(value);
+  }
+}
+
+void redactReportRequestInfo(const ReportRedaction& redaction,
+                             ReportRequestInfo& info) {
+  const size_t query_pos = info.url.find('?');
+  if (query_pos != std::string::npos &&
+      redaction.url_query() != ReportRedaction::KEEP) {
+    const std::string query =
+        redactValue(absl::string_view(info.url).substr(query_pos + 1),
+                    redaction.url_query());
+    info.url.resize(query_pos);
+    if (!query.empty()) {
+      absl::StrAppend(&info.url, "?", query);
+    }
+  }
+
+  if (!info.client_ip.empty()) {
+    info.client_ip = redactValue(info.client_ip, redaction.client_ip());
+  }
+  if (!info.referer.empty()) {
+    info.referer = redactValue(info.referer, redaction.referer());
   }
 }
 
@@ -260,6 +336,16 @@ void fillJwtPayload(const ::envoy::config::core::v3::Metadata& metadata,
   }
 }
 
+bool hasJwtPayload(const ::envoy::config::core::v3::Metadata& metadata,
+                   const std::string& jwt_payload_metadata_name) {
+  const Envoy::ProtobufWkt::Value& value =
+      Envoy::Config::Metadata::metadataValue(
+          &metadata,
+          Envoy::Extensions::HttpFilters::HttpFilterNames::get().JwtAuthn,
+          jwt_payload_metadata_name);
+  return &value != &Envoy::ProtobufWkt::Value::default_instance();
+}
+
 bool extractAPIKey(
     const Envoy::Http::RequestHeaderMap& headers,
     const ::google::protobuf::RepeatedPtrField<
@@ -279,7 +365,8 @@ bool extractAPIKey(
           return true;
         break;
       case ApiKeyLocation::kHeader:
-        if (extractAPIKeyFromHeader(headers, location.header(), api_key))
+        if (extractAPIKeyFromHeader(headers, location.header(),
+                                    location.value_prefix(), api_key))
           return true;
         break;
       case ApiKeyLocation::kCookie:
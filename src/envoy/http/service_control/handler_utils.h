@@ -45,11 +45,28 @@ void fillGCPInfo(
     ::espv2::api_proxy::service_control::ReportRequestInfo& info);
 
 // Searches the `headers` for the given `log_headers` and appends all matches
-// to the string provided.
+// to the string provided. If `redactions` is set, the header values are
+// redacted by the actions keyed by the lower case header names.
 void fillLoggedHeader(
     const Envoy::Http::HeaderMap* headers,
     const ::google::protobuf::RepeatedPtrField<::std::string>& log_headers,
-    std::string& info_header_field);
+    std::string& info_header_field,
+    const ::google::protobuf::Map<
+        std::string, ::espv2::api::envoy::v9::http::service_control::
+                         ReportRedaction::Action>* redactions = nullptr);
+
+// Returns the value redacted by the action. An empty string is returned if the
+// value is dropped.
+std::string redactValue(
+    absl::string_view value,
+    ::espv2::api::envoy::v9::http::service_control::ReportRedaction::Action
+        action);
+
+// Redacts the url query, client IP and referer of the info provided.
+void redactReportRequestInfo(
+    const ::espv2::api::envoy::v9::http::service_control::ReportRedaction&
+        redaction,
+    ::espv2::api_proxy::service_control::ReportRequestInfo& info);
 
 // Fills the `request_time_ms`, `backend_time_ms`, and `overhead_time_ms` of the
 // info provided.
@@ -69,6 +86,10 @@ void fillJwtPayload(const ::envoy::config::core::v3::Metadata& metadata,
                     const std::string& jwt_payload_path,
                     std::string& info_iss_or_aud);
 
+// Returns true if the jwt_authn filter verified a JWT of the request.
+bool hasJwtPayload(const ::envoy::config::core::v3::Metadata& metadata,
+                   const std::string& jwt_payload_metadata_name);
+
 // Returns the protocol of the frontend request or UNKNOWN if not found
 ::espv2::api_proxy::service_control::protocol::Protocol getFrontendProtocol(
     const Envoy::Http::ResponseHeaderMap* response_headers,
@@ -27,6 +27,7 @@
 
 using ::espv2::api::envoy::v9::http::service_control::ApiKeyRequirement;
 using ::espv2::api::envoy::v9::http::service_control::FilterConfig;
+using ::espv2::api::envoy::v9::http::service_control::ReportRedaction;
 using ::espv2::api::envoy::v9::http::service_control::Service;
 using ::espv2::api_proxy::service_control::LatencyInfo;
 using ::espv2::api_proxy::service_control::ReportRequestInfo;
@@ -163,6 +164,81 @@ TEST(ServiceControlUtils, FillLoggedHeader) {
   EXPECT_TRUE(output == "log-this=bar,foo;" || output == "log-this=foo,bar;");
 }
 
+TEST(ServiceControlUtils, FillLoggedHeaderWithRedaction) {
+  Service service;
+  ASSERT_TRUE(TextFormat::ParseFromString(
+      R"(
+log_request_headers: "User-Agent"
+log_request_headers: "x-secret"
+log_request_headers: "log-this"
+report_redaction {
+  request_headers { key: "user-agent" value: HASH }
+  request_headers { key: "x-secret" value: DROP }
+})",
+      &service));
+
+  Envoy::Http::TestRequestHeaderMapImpl headers{{"user-agent", "Mozilla/5.0"},
+                                                {"x-secret", "foo"},
+                                                {"log-this", "bar"}};
+  std::string output;
+  fillLoggedHeader(&headers, service.log_request_headers(), output,
+                   &service.report_redaction().request_headers());
+  EXPECT_EQ(output,
+            "User-Agent="
+            "1066b48224bb188ceb955605f4fcff98893be2688d7e965afb04d36d17e7f0d7;"
+            "log-this=bar;");
+}
+
+TEST(ServiceControlUtils, RedactReportRequestInfo) {
+  struct TestCase {
+    std::string redaction_proto;
+    std::string expected_url;
+    std::string expected_client_ip;
+    std::string expected_referer;
+  };
+  const TestCase test_cases[] = {
+      // Test: Nothing is redacted by default
+      {
+          "",
+          "/shelves?secret=1",
+          "1.2.3.4",
+          "https://example.com",
+      },
+
+      // Test: Drop all fields
+      {
+          "url_query: DROP client_ip: DROP referer: DROP",
+          "/shelves",
+          Envoy::EMPTY_STRING,
+          Envoy::EMPTY_STRING,
+      },
+
+      // Test: Hash the query and client IP
+      {
+          "url_query: HASH client_ip: HASH",
+          "/shelves?"
+          "ecf2848c33e9a349ba665c24c1cc7d7adf99a3bc3b06b3d1bd4078d743816086",
+          "6694f83c9f476da31f5df6bcc520034e7e57d421d247b9d34f49edbfc84a764c",
+          "https://example.com",
+      },
+  };
+
+  for (const auto& test : test_cases) {
+    ReportRedaction redaction;
+    ASSERT_TRUE(TextFormat::ParseFromString(test.redaction_proto, &redaction));
+
+    ReportRequestInfo info;
+    info.url = "/shelves?secret=1";
+    info.client_ip = "1.2.3.4";
+    info.referer = "https://example.com";
+    redactReportRequestInfo(redaction, info);
+
+    EXPECT_EQ(test.expected_url, info.url);
+    EXPECT_EQ(test.expected_client_ip, info.client_ip);
+    EXPECT_EQ(test.expected_referer, info.referer);
+  }
+}
+
 TEST(ServiceControlUtils, ExtractApiKey) {
   struct TestCase {
     std::string requirement_proto;
@@ -220,6 +296,29 @@ TEST(ServiceControlUtils, ExtractApiKey) {
           "foobar",
       },
 
+      // Test: find apikey in header location with value prefix
+      {
+          R"(locations: { header: "authorization" value_prefix: "ApiKey" } )",
+          {{"authorization", "apikey  foobar"}},
+          "foobar",
+      },
+
+      // Test: header value does not have the expected value prefix
+      {
+          R"(locations: { header: "authorization" value_prefix: "ApiKey" } )",
+          {{"authorization", "Bearer foobar"}},
+          Envoy::EMPTY_STRING,
+      },
+
+      // Test: header with value prefix does not match, use next location
+      {
+          R"(
+            locations: { header: "authorization" value_prefix: "ApiKey" }
+            locations: { cookie: "apikey" } )",
+          {{"authorization", "Bearer token"}, {"cookie", "apikey=foobar"}},
+          "foobar",
+      },
+
       // Test: query location expected but not provided
       {
           R"(locations: { query: "apikey" } )",
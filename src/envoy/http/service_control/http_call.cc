@@ -324,10 +324,16 @@ HttpCallFactoryImpl::HttpCallFactoryImpl(
 HttpCall* HttpCallFactoryImpl::createHttpCall(
     const Envoy::Protobuf::Message& body, Envoy::Tracing::Span& parent_span,
     HttpCall::DoneFunc on_done) {
+  return createHttpCall(body, parent_span, on_done, timeout_ms_, retries_);
+}
+
+HttpCall* HttpCallFactoryImpl::createHttpCall(
+    const Envoy::Protobuf::Message& body, Envoy::Tracing::Span& parent_span,
+    HttpCall::DoneFunc on_done, uint32_t timeout_ms, uint32_t retries) {
   ENVOY_LOG(debug, "{} is created", trace_operation_name_);
   HttpCallImpl* http_call = new HttpCallImpl(
-      cm_, dispatcher_, uri_, suffix_url_, token_fn_, body, timeout_ms_,
-      retries_, parent_span, time_source_, trace_operation_name_);
+      cm_, dispatcher_, uri_, suffix_url_, token_fn_, body, timeout_ms,
+      retries, parent_span, time_source_, trace_operation_name_);
   http_call->setDoneFunc([this, on_done, http_call](const Status& status,
                                                     const std::string& body) {
     // When the call is finished, it should be removed from active_calls_ .
@@ -47,6 +47,12 @@ class HttpCallFactory
                                    Envoy::Tracing::Span& parent_span,
                                    HttpCall::DoneFunc on_done) PURE;
 
+  // Same as above, but overrides the timeout and retries of the factory.
+  virtual HttpCall* createHttpCall(const Envoy::Protobuf::Message& body,
+                                   Envoy::Tracing::Span& parent_span,
+                                   HttpCall::DoneFunc on_done,
+                                   uint32_t timeout_ms, uint32_t retries) PURE;
+
   virtual ~HttpCallFactory(){};
 };
 
@@ -65,6 +71,11 @@ class HttpCallFactoryImpl : public HttpCallFactory {
                            Envoy::Tracing::Span& parent_span,
                            HttpCall::DoneFunc on_done);
 
+  HttpCall* createHttpCall(const Envoy::Protobuf::Message& body,
+                           Envoy::Tracing::Span& parent_span,
+                           HttpCall::DoneFunc on_done, uint32_t timeout_ms,
+                           uint32_t retries);
+
   ~HttpCallFactoryImpl();
 
  private:
@@ -38,10 +38,17 @@ class MockServiceControlHandler : public ServiceControlHandler {
                const Envoy::Http::ResponseTrailerMap* response_trailers),
               (override));
 
+  MOCK_METHOD(int64_t, intermediateReportIntervalMs, (), (const, override));
+
+  MOCK_METHOD(void, callIntermediateReport, (), (override));
+
   MOCK_METHOD(void, onDestroy, (), (override));
 
   MOCK_METHOD(void, fillFilterState,
               (::Envoy::StreamInfo::FilterState & filter_state), (override));
+
+  MOCK_METHOD(void, fillDynamicMetadata,
+              (::Envoy::StreamInfo::StreamInfo & stream_info), (override));
 };
 
 class MockServiceControlHandlerFactory : public ServiceControlHandlerFactory {
@@ -108,6 +115,10 @@ class MockHttpCallFactory : public HttpCallFactory {
   MOCK_METHOD(HttpCall*, createHttpCall,
               (const Envoy::Protobuf::Message& body,
                Envoy::Tracing::Span& parent_span, HttpCall::DoneFunc on_done));
+  MOCK_METHOD(HttpCall*, createHttpCall,
+              (const Envoy::Protobuf::Message& body,
+               Envoy::Tracing::Span& parent_span, HttpCall::DoneFunc on_done,
+               uint32_t timeout_ms, uint32_t retries));
 };
 
 }  // namespace service_control
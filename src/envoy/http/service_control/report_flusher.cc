@@ -0,0 +1,71 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+#include "src/envoy/http/service_control/report_flusher.h"
+
+#include "absl/strings/str_cat.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace service_control {
+
+ReportFlusher::ReportFlusher(Envoy::Server::Admin& admin,
+                             Envoy::Stats::Scope& scope)
+    : admin_(admin),
+      pending_(scope.gaugeFromString(
+          kFlushReportsPendingStat,
+          Envoy::Stats::Gauge::ImportMode::NeverImport)) {
+  if (!admin_.addHandler(
+          kFlushReportsPath, "flush the aggregated Service Control reports",
+          [this](absl::string_view, Envoy::Http::ResponseHeaderMap&,
+                 Envoy::Buffer::Instance& response,
+                 Envoy::Server::AdminStream&) -> Envoy::Http::Code {
+            return handleFlush(response);
+          },
+          /*removable=*/true, /*mutates_server_state=*/true)) {
+    ENVOY_LOG(warn, "fail to add the admin handler {}", kFlushReportsPath);
+  }
+}
+
+ReportFlusher::~ReportFlusher() { admin_.removeHandler(kFlushReportsPath); }
+
+uint64_t ReportFlusher::add(FlushFunc flush) {
+  const uint64_t handle = next_handle_++;
+  flushes_[handle] = std::move(flush);
+  return handle;
+}
+
+void ReportFlusher::remove(uint64_t handle) { flushes_.erase(handle); }
+
+Envoy::Http::Code ReportFlusher::handleFlush(
+    Envoy::Buffer::Instance& response) {
+  // The gauge belongs to the root scope, which outlives the flusher.
+  Envoy::Stats::Gauge& pending = pending_;
+  for (const auto& it : flushes_) {
+    pending.inc();
+    it.second([&pending]() { pending.dec(); });
+  }
+  ENVOY_LOG(info, "flushing the reports of {} service control calls",
+            flushes_.size());
+  response.add(absl::StrCat("flushing the reports of ", flushes_.size(),
+                            " service control calls\n"));
+  return Envoy::Http::Code::OK;
+}
+
+}  // namespace service_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
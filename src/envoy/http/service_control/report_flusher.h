@@ -0,0 +1,73 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+#pragma once
+
+#include <functional>
+
+#include "absl/container/flat_hash_map.h"
+#include "common/common/logger.h"
+#include "envoy/server/admin.h"
+#include "envoy/singleton/instance.h"
+#include "envoy/stats/scope.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace service_control {
+
+// The admin path flushing the aggregated reports.
+constexpr char kFlushReportsPath[] = "/service_control/flush_reports";
+
+// The gauge of the flushes not done on all the worker threads yet.
+constexpr char kFlushReportsPendingStat[] =
+    "service_control.report_flushes_pending";
+
+// Flushes the aggregated reports of all the Service Control calls on a POST
+// to kFlushReportsPath, e.g. before Envoy exits. The flushed report calls
+// are sent to the Service Control cluster once the pending flushes are done.
+//
+// It is a singleton shared by the filter configs, so the handler outlives
+// the listener updates.
+class ReportFlusher
+    : public Envoy::Singleton::Instance,
+      public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
+ public:
+  // Flushes the reports on all the worker threads, then calls done on the
+  // main thread.
+  using FlushFunc = std::function<void(std::function<void()> done)>;
+
+  ReportFlusher(Envoy::Server::Admin& admin, Envoy::Stats::Scope& scope);
+  ~ReportFlusher() override;
+
+  // Adds a flush function, returns the handle to remove it.
+  uint64_t add(FlushFunc flush);
+  void remove(uint64_t handle);
+
+ private:
+  Envoy::Http::Code handleFlush(Envoy::Buffer::Instance& response);
+
+  Envoy::Server::Admin& admin_;
+  Envoy::Stats::Gauge& pending_;
+  absl::flat_hash_map<uint64_t, FlushFunc> flushes_;
+  uint64_t next_handle_ = 0;
+};
+
+using ReportFlusherSharedPtr = std::shared_ptr<ReportFlusher>;
+
+}  // namespace service_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
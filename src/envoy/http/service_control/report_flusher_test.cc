@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+#include "src/envoy/http/service_control/report_flusher.h"
+
+#include "common/buffer/buffer_impl.h"
+#include "common/stats/isolated_store_impl.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/server/admin.h"
+#include "test/mocks/server/admin_stream.h"
+#include "test/test_common/utility.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace service_control {
+namespace test {
+
+using ::testing::_;
+using ::testing::DoAll;
+using ::testing::Return;
+using ::testing::SaveArg;
+
+class ReportFlusherTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    EXPECT_CALL(admin_, addHandler(kFlushReportsPath, _, _, true, true))
+        .WillOnce(DoAll(SaveArg<2>(&handler_), Return(true)));
+    flusher_ = std::make_unique<ReportFlusher>(admin_, store_);
+  }
+
+  void TearDown() override {
+    EXPECT_CALL(admin_, removeHandler(kFlushReportsPath))
+        .WillOnce(Return(true));
+    flusher_.reset();
+  }
+
+  Envoy::Http::Code flush() {
+    Envoy::Http::TestResponseHeaderMapImpl response_headers;
+    Envoy::Buffer::OwnedImpl response;
+    return handler_(kFlushReportsPath, response_headers, response,
+                    admin_stream_);
+  }
+
+  uint64_t pending() {
+    return store_.gaugeFromString(kFlushReportsPendingStat,
+                                  Envoy::Stats::Gauge::ImportMode::NeverImport)
+        .value();
+  }
+
+  ::testing::NiceMock<Envoy::Server::MockAdmin> admin_;
+  ::testing::NiceMock<Envoy::Server::MockAdminStream> admin_stream_;
+  Envoy::Stats::IsolatedStoreImpl store_;
+  Envoy::Server::Admin::HandlerCb handler_;
+  std::unique_ptr<ReportFlusher> flusher_;
+};
+
+TEST_F(ReportFlusherTest, FlushesTheAddedCalls) {
+  std::vector<std::function<void()>> dones;
+  const uint64_t handle1 = flusher_->add(
+      [&dones](std::function<void()> done) { dones.push_back(done); });
+  flusher_->add(
+      [&dones](std::function<void()> done) { dones.push_back(done); });
+
+  EXPECT_EQ(flush(), Envoy::Http::Code::OK);
+  EXPECT_EQ(dones.size(), 2);
+  EXPECT_EQ(pending(), 2);
+
+  dones[0]();
+  dones[1]();
+  EXPECT_EQ(pending(), 0);
+
+  // The removed calls are not flushed.
+  flusher_->remove(handle1);
+  EXPECT_EQ(flush(), Envoy::Http::Code::OK);
+  EXPECT_EQ(dones.size(), 3);
+  EXPECT_EQ(pending(), 1);
+  dones[2]();
+  EXPECT_EQ(pending(), 0);
+}
+
+TEST_F(ReportFlusherTest, NoCalls) {
+  EXPECT_EQ(flush(), Envoy::Http::Code::OK);
+  EXPECT_EQ(pending(), 0);
+}
+
+}  // namespace test
+}  // namespace service_control
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -15,6 +15,7 @@
 // limitations under the License.
 
 #include "common/common/assert.h"
+#include "envoy/singleton/manager.h"
 #include "google/protobuf/util/time_util.h"
 #include "src/api_proxy/service_control/logs_metrics_loader.h"
 #include "src/envoy/http/service_control/service_control_call_impl.h"
@@ -34,6 +35,16 @@ using ::google::protobuf::util::TimeUtil;
 using token::TokenSubscriber;
 using token::TokenType;
 
+SINGLETON_MANAGER_REGISTRATION(service_control_report_flusher);
+SINGLETON_MANAGER_REGISTRATION(service_control_api_key_grace_store);
+
+namespace {
+
+// The interval to save the verified API keys to the file.
+constexpr std::chrono::milliseconds kApiKeyGraceSaveInterval(10000);
+
+}  // namespace
+
 void ServiceControlCallImpl::createImdsTokenSub() {
   const std::string& token_cluster = filter_config_.imds_token().cluster();
   const std::string& token_uri = filter_config_.imds_token().uri();
@@ -108,15 +119,31 @@ ServiceControlCallImpl::ServiceControlCallImpl(
     : filter_config_(*proto_config),
       token_subscriber_factory_(context),
       tls_(context.threadLocal()) {
+  const auto& sc_calling_config = filter_config_.sc_calling_config();
+  api_key_grace_store_ = context.singletonManager().getTyped<ApiKeyGraceStore>(
+      SINGLETON_MANAGER_REGISTERED_NAME(service_control_api_key_grace_store),
+      [&context, &sc_calling_config] {
+        return std::make_shared<ApiKeyGraceStore>(
+            context.timeSource(), sc_calling_config.api_key_grace_cache_path());
+      });
+  if (!sc_calling_config.api_key_grace_cache_path().empty()) {
+    api_key_grace_save_timer_ = context.dispatcher().createTimer([this]() {
+      api_key_grace_store_->save();
+      api_key_grace_save_timer_->enableTimer(kApiKeyGraceSaveInterval);
+    });
+    api_key_grace_save_timer_->enableTimer(kApiKeyGraceSaveInterval);
+  }
+
   // Pass shared_ptr of proto_config to the function capture so that
   // it will not be released when the function is called.
   tls_.set([proto_config, &config, stats_prefix, &scope = context.scope(),
             &cm = context.clusterManager(),
-            &time_source =
-                context.timeSource()](Envoy::Event::Dispatcher& dispatcher) {
-    return std::make_shared<ThreadLocalCache>(config, *proto_config,
-                                              stats_prefix, scope, cm,
-                                              time_source, dispatcher);
+            &time_source = context.timeSource(),
+            api_key_grace_store = api_key_grace_store_](
+               Envoy::Event::Dispatcher& dispatcher) {
+    return std::make_shared<ThreadLocalCache>(
+        config, *proto_config, stats_prefix, scope, cm, time_source,
+        dispatcher, api_key_grace_store);
   });
 
   switch (filter_config_.access_token_case()) {
@@ -130,6 +157,21 @@ ServiceControlCallImpl::ServiceControlCallImpl(
       NOT_REACHED_GCOVR_EXCL_LINE;
   }
 
+  report_flusher_ = context.singletonManager().getTyped<ReportFlusher>(
+      SINGLETON_MANAGER_REGISTERED_NAME(service_control_report_flusher),
+      [&context] {
+        return std::make_shared<ReportFlusher>(context.admin(),
+                                               context.scope());
+      });
+  report_flusher_handle_ =
+      report_flusher_->add([this](std::function<void()> done) {
+        tls_.runOnAllThreads(
+            [](Envoy::OptRef<ThreadLocalCache> object) {
+              object->client_cache().flushReports();
+            },
+            done);
+      });
+
   if (config.has_service_config()) {
     std::set<std::string> logs, metrics, labels;
     (void)LogsMetricsLoader::Load(config.service_config(), &logs, &metrics,
@@ -143,6 +185,10 @@ ServiceControlCallImpl::ServiceControlCallImpl(
   }
 }  // namespace ServiceControl
 
+ServiceControlCallImpl::~ServiceControlCallImpl() {
+  report_flusher_->remove(report_flusher_handle_);
+}
+
 CancelFunc ServiceControlCallImpl::callCheck(
     const ::espv2::api_proxy::service_control::CheckRequestInfo& request_info,
     Envoy::Tracing::Span& parent_span, CheckDoneFunc on_done) {
@@ -22,7 +22,9 @@
 #include "envoy/upstream/cluster_manager.h"
 #include "google/api/service.pb.h"
 #include "src/api_proxy/service_control/request_builder.h"
+#include "src/envoy/http/service_control/api_key_grace_store.h"
 #include "src/envoy/http/service_control/client_cache.h"
+#include "src/envoy/http/service_control/report_flusher.h"
 #include "src/envoy/http/service_control/service_control_call.h"
 #include "src/envoy/token/token_subscriber_factory_impl.h"
 
@@ -46,11 +48,13 @@ class ThreadLocalCache : public Envoy::ThreadLocal::ThreadLocalObject {
           filter_config,
       const std::string& stats_prefix, Envoy::Stats::Scope& scope,
       Envoy::Upstream::ClusterManager& cm, Envoy::TimeSource& time_source,
-      Envoy::Event::Dispatcher& dispatcher)
+      Envoy::Event::Dispatcher& dispatcher,
+      ApiKeyGraceStoreSharedPtr api_key_grace_store)
       : client_cache_(
             config, filter_config, stats_prefix, scope, cm, time_source,
             dispatcher, [this]() -> const std::string& { return sc_token(); },
-            [this]() -> const std::string& { return quota_token(); }) {}
+            [this]() -> const std::string& { return quota_token(); },
+            api_key_grace_store) {}
 
   void set_sc_token(TokenSharedPtr sc_token) { sc_token_ = sc_token; }
   const std::string& sc_token() const {
@@ -84,6 +88,7 @@ class ServiceControlCallImpl
       const ::espv2::api::envoy::v9::http::service_control::Service& config,
       const std::string& stats_prefix,
       Envoy::Server::Configuration::FactoryContext& context);
+  ~ServiceControlCallImpl() override;
 
   CancelFunc callCheck(
       const ::espv2::api_proxy::service_control::CheckRequestInfo& request_info,
@@ -120,6 +125,15 @@ class ServiceControlCallImpl
   // Token subscriber used to fetch access token from iam for service control
   token::TokenSubscriberPtr iam_token_sub_;
 
+  // Flushes the reports of the thread local caches on an admin request.
+  ReportFlusherSharedPtr report_flusher_;
+  uint64_t report_flusher_handle_;
+
+  // The API keys verified by Check, shared by the filter configs.
+  ApiKeyGraceStoreSharedPtr api_key_grace_store_;
+  // Periodically saves the verified API keys to the file.
+  Envoy::Event::TimerPtr api_key_grace_save_timer_;
+
   Envoy::ThreadLocal::TypedSlot<ThreadLocalCache> tls_;
 };  // namespace ServiceControl
 
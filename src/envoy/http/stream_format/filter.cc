@@ -0,0 +1,135 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/stream_format/filter.h"
+
+#include "absl/strings/match.h"
+#include "absl/strings/str_cat.h"
+#include "common/buffer/buffer_impl.h"
+#include "common/grpc/common.h"
+#include "common/http/utility.h"
+#include "common/protobuf/utility.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace stream_format {
+
+using Envoy::Http::FilterDataStatus;
+using Envoy::Http::FilterHeadersStatus;
+using Envoy::Http::FilterTrailersStatus;
+
+namespace {
+
+using ProtoPerRouteFilterConfig =
+    ::espv2::api::envoy::v9::http::stream_format::PerRouteFilterConfig;
+
+constexpr absl::string_view kJsonContentType = "application/json";
+constexpr absl::string_view kNdjsonContentType = "application/x-ndjson";
+constexpr absl::string_view kSseContentType = "text/event-stream";
+
+}  // namespace
+
+FilterHeadersStatus Filter::encodeHeaders(
+    Envoy::Http::ResponseHeaderMap& headers, bool end_stream) {
+  // The transcoded server streams are JSON arrays in 200 responses. The
+  // errors before the first message are JSON error responses.
+  if (end_stream ||
+      Envoy::Http::Utility::getResponseStatus(headers) !=
+          Envoy::enumToInt(Envoy::Http::Code::OK) ||
+      !absl::StartsWith(headers.getContentTypeValue(), kJsonContentType)) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  auto route = encoder_callbacks_->route();
+  if (route == nullptr || route->routeEntry() == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+  per_route_ =
+      route->routeEntry()->perFilterConfigTyped<PerRouteFilterConfig>(
+          kFilterName);
+  if (per_route_ == nullptr) {
+    return FilterHeadersStatus::Continue;
+  }
+
+  config_->stats().reframed_.inc();
+  headers.setContentType(per_route_->format() ==
+                                 ProtoPerRouteFilterConfig::SSE
+                             ? kSseContentType
+                             : kNdjsonContentType);
+  headers.removeContentLength();
+  return FilterHeadersStatus::Continue;
+}
+
+FilterDataStatus Filter::encodeData(Envoy::Buffer::Instance& data, bool) {
+  if (per_route_ == nullptr || splitter_.invalid()) {
+    return FilterDataStatus::Continue;
+  }
+
+  const std::vector<std::string> messages = splitter_.split(data.toString());
+  if (splitter_.invalid()) {
+    // Passed through as is.
+    ENVOY_LOG(debug, "streamed response body is not a JSON array");
+    config_->stats().not_array_.inc();
+    return FilterDataStatus::Continue;
+  }
+
+  data.drain(data.length());
+  for (const std::string& message : messages) {
+    data.add(frame(message, false));
+  }
+  return FilterDataStatus::Continue;
+}
+
+FilterTrailersStatus Filter::encodeTrailers(
+    Envoy::Http::ResponseTrailerMap& trailers) {
+  if (per_route_ == nullptr || splitter_.invalid()) {
+    return FilterTrailersStatus::Continue;
+  }
+
+  // The gRPC errors after the first message are only in the trailers, which
+  // the HTTP/1.1 clients don't get. They are sent as a last message.
+  const auto grpc_status = Envoy::Grpc::Common::getGrpcStatus(trailers);
+  if (!grpc_status ||
+      grpc_status.value() == Envoy::Grpc::Status::WellKnownGrpcStatus::Ok) {
+    return FilterTrailersStatus::Continue;
+  }
+  Envoy::ProtobufWkt::Struct status;
+  (*status.mutable_fields())["code"].set_number_value(grpc_status.value());
+  (*status.mutable_fields())["message"].set_string_value(
+      Envoy::Http::Utility::PercentEncoding::decode(
+          Envoy::Grpc::Common::getGrpcMessage(trailers)));
+
+  config_->stats().stream_error_.inc();
+  Envoy::Buffer::OwnedImpl data(frame(
+      Envoy::MessageUtil::getJsonStringFromMessage(status, false, true),
+      true));
+  encoder_callbacks_->addEncodedData(data, true);
+  return FilterTrailersStatus::Continue;
+}
+
+std::string Filter::frame(const std::string& message, bool error) const {
+  // The transcoder prints each message on a single line.
+  if (per_route_->format() == ProtoPerRouteFilterConfig::SSE) {
+    return error ? absl::StrCat("event: error\ndata: ", message, "\n\n")
+                 : absl::StrCat("data: ", message, "\n\n");
+  }
+  return error ? absl::StrCat("{\"error\":", message, "}\n")
+               : absl::StrCat(message, "\n");
+}
+
+}  // namespace stream_format
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
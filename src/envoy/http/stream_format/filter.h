@@ -0,0 +1,60 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "common/common/logger.h"
+#include "envoy/http/filter.h"
+#include "envoy/http/header_map.h"
+#include "extensions/filters/http/common/pass_through_filter.h"
+#include "src/envoy/http/stream_format/filter_config.h"
+#include "src/envoy/http/stream_format/json_array_splitter.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace stream_format {
+
+// Reframes the JSON array of the messages of the transcoded server streams
+// into newline delimited JSON or Server-Sent Events, message by message.
+class Filter : public Envoy::Http::PassThroughEncoderFilter,
+               public Envoy::Logger::Loggable<Envoy::Logger::Id::filter> {
+ public:
+  Filter(FilterConfigSharedPtr config) : config_(config) {}
+
+  // Envoy::Http::StreamEncoderFilter
+  Envoy::Http::FilterHeadersStatus encodeHeaders(
+      Envoy::Http::ResponseHeaderMap& headers, bool end_stream) override;
+  Envoy::Http::FilterDataStatus encodeData(Envoy::Buffer::Instance& data,
+                                           bool end_stream) override;
+  Envoy::Http::FilterTrailersStatus encodeTrailers(
+      Envoy::Http::ResponseTrailerMap& trailers) override;
+
+ private:
+  // Returns the message framed in the format of the route.
+  std::string frame(const std::string& message, bool error) const;
+
+  const FilterConfigSharedPtr config_;
+
+  // The per-route config of the response being reframed, if any.
+  const PerRouteFilterConfig* per_route_{};
+  JsonArraySplitter splitter_;
+};
+
+}  // namespace stream_format
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,87 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "api/envoy/v9/http/stream_format/config.pb.h"
+#include "envoy/router/router.h"
+#include "envoy/stats/scope.h"
+#include "envoy/stats/stats_macros.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace stream_format {
+
+// The filter name.
+constexpr const char kFilterName[] =
+    "com.google.espv2.filters.http.stream_format";
+
+/**
+ * All stats for the stream format filter. @see stats_macros.h
+ */
+#define ALL_STREAM_FORMAT_FILTER_STATS(COUNTER) \
+  COUNTER(reframed)                             \
+  COUNTER(not_array)                            \
+  COUNTER(stream_error)
+
+/**
+ * Wrapper struct for stream format filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_STREAM_FORMAT_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+class FilterConfig {
+ public:
+  FilterConfig(const std::string& stats_prefix, Envoy::Stats::Scope& scope)
+      : stats_(generateStats(stats_prefix, scope)) {}
+
+  FilterStats& stats() { return stats_; }
+
+ private:
+  FilterStats generateStats(const std::string& prefix,
+                            Envoy::Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "stream_format.";
+    return {ALL_STREAM_FORMAT_FILTER_STATS(
+        POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  // The stats
+  FilterStats stats_;
+};
+
+using FilterConfigSharedPtr = std::shared_ptr<FilterConfig>;
+
+using Format =
+    ::espv2::api::envoy::v9::http::stream_format::PerRouteFilterConfig::Format;
+
+class PerRouteFilterConfig : public Envoy::Router::RouteSpecificFilterConfig {
+ public:
+  PerRouteFilterConfig(const ::espv2::api::envoy::v9::http::stream_format::
+                           PerRouteFilterConfig& proto)
+      : format_(proto.format()) {}
+
+  Format format() const { return format_; }
+
+ private:
+  const Format format_;
+};
+
+}  // namespace stream_format
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
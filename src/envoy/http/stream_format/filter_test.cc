@@ -0,0 +1,193 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/stream_format/filter.h"
+
+#include "common/buffer/buffer_impl.h"
+#include "common/common/empty_string.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/router/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/utility.h"
+
+using ::testing::_;
+using ::testing::Invoke;
+using ::testing::NiceMock;
+using ::testing::Return;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace stream_format {
+namespace {
+
+class StreamFormatFilterTest : public ::testing::Test {
+ protected:
+  void SetUp() override {
+    mock_route_ = std::make_shared<NiceMock<Envoy::Router::MockRoute>>();
+    EXPECT_CALL(mock_encoder_callbacks_, route())
+        .WillRepeatedly(Return(mock_route_));
+    config_ = std::make_shared<FilterConfig>(Envoy::EMPTY_STRING,
+                                             mock_factory_context_.scope_);
+    filter_ = std::make_unique<Filter>(config_);
+    filter_->setEncoderFilterCallbacks(mock_encoder_callbacks_);
+  }
+
+  void setPerRoute(Format format) {
+    ::espv2::api::envoy::v9::http::stream_format::PerRouteFilterConfig proto;
+    proto.set_format(format);
+    per_route_ = std::make_shared<PerRouteFilterConfig>(proto);
+    EXPECT_CALL(mock_route_->route_entry_, perFilterConfig(kFilterName))
+        .WillRepeatedly(Return(per_route_.get()));
+  }
+
+  uint64_t counter(const std::string& name) {
+    return Envoy::TestUtility::findCounter(mock_factory_context_.scope_,
+                                           "stream_format." + name)
+        ->value();
+  }
+
+  FilterConfigSharedPtr config_;
+  std::shared_ptr<PerRouteFilterConfig> per_route_;
+  NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+  std::shared_ptr<NiceMock<Envoy::Router::MockRoute>> mock_route_;
+  NiceMock<Envoy::Http::MockStreamEncoderFilterCallbacks>
+      mock_encoder_callbacks_;
+  std::unique_ptr<Filter> filter_;
+};
+
+TEST_F(StreamFormatFilterTest, NoPerRouteConfig) {
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data(R"([{"id":1}])");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(headers.getContentTypeValue(), "application/json");
+  EXPECT_EQ(data.toString(), R"([{"id":1}])");
+  EXPECT_EQ(counter("reframed"), 0);
+}
+
+TEST_F(StreamFormatFilterTest, ErrorResponse) {
+  setPerRoute(::espv2::api::envoy::v9::http::stream_format::
+                  PerRouteFilterConfig::NDJSON);
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "404"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data(R"({"code":5,"message":"no shelf"})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(headers.getContentTypeValue(), "application/json");
+  EXPECT_EQ(data.toString(), R"({"code":5,"message":"no shelf"})");
+  EXPECT_EQ(counter("reframed"), 0);
+}
+
+TEST_F(StreamFormatFilterTest, Ndjson) {
+  setPerRoute(::espv2::api::envoy::v9::http::stream_format::
+                  PerRouteFilterConfig::NDJSON);
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "200"},
+      {"content-type", "application/json"},
+      {"content-length", "21"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+  EXPECT_EQ(headers.getContentTypeValue(), "application/x-ndjson");
+  EXPECT_FALSE(headers.has("content-length"));
+
+  Envoy::Buffer::OwnedImpl data1(R"([{"id":1},{"id")");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data1, false));
+  EXPECT_EQ(data1.toString(), "{\"id\":1}\n");
+  Envoy::Buffer::OwnedImpl data2(R"(:2}])");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data2, false));
+  EXPECT_EQ(data2.toString(), "{\"id\":2}\n");
+
+  Envoy::Http::TestResponseTrailerMapImpl trailers{{"grpc-status", "0"}};
+  EXPECT_CALL(mock_encoder_callbacks_, addEncodedData(_, _)).Times(0);
+  EXPECT_EQ(Envoy::Http::FilterTrailersStatus::Continue,
+            filter_->encodeTrailers(trailers));
+  EXPECT_EQ(counter("reframed"), 1);
+  EXPECT_EQ(counter("stream_error"), 0);
+}
+
+TEST_F(StreamFormatFilterTest, ServerSentEvents) {
+  setPerRoute(
+      ::espv2::api::envoy::v9::http::stream_format::PerRouteFilterConfig::SSE);
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+  EXPECT_EQ(headers.getContentTypeValue(), "text/event-stream");
+
+  Envoy::Buffer::OwnedImpl data(R"([{"id":1},{"id":2}])");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+  EXPECT_EQ(data.toString(),
+            "data: {\"id\":1}\n\n"
+            "data: {\"id\":2}\n\n");
+}
+
+TEST_F(StreamFormatFilterTest, StreamError) {
+  setPerRoute(
+      ::espv2::api::envoy::v9::http::stream_format::PerRouteFilterConfig::SSE);
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data(R"([{"id":1}])");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, false));
+
+  std::string added;
+  EXPECT_CALL(mock_encoder_callbacks_, addEncodedData(_, true))
+      .WillOnce(Invoke([&added](Envoy::Buffer::Instance& data, bool) {
+        added = data.toString();
+      }));
+  Envoy::Http::TestResponseTrailerMapImpl trailers{
+      {"grpc-status", "5"}, {"grpc-message", "no%20shelf"}};
+  EXPECT_EQ(Envoy::Http::FilterTrailersStatus::Continue,
+            filter_->encodeTrailers(trailers));
+  EXPECT_EQ(added,
+            "event: error\ndata: {\"code\":5,\"message\":\"no shelf\"}\n\n");
+  EXPECT_EQ(counter("stream_error"), 1);
+}
+
+TEST_F(StreamFormatFilterTest, NotArray) {
+  setPerRoute(::espv2::api::envoy::v9::http::stream_format::
+                  PerRouteFilterConfig::NDJSON);
+  Envoy::Http::TestResponseHeaderMapImpl headers{
+      {":status", "200"}, {"content-type", "application/json"}};
+  EXPECT_EQ(Envoy::Http::FilterHeadersStatus::Continue,
+            filter_->encodeHeaders(headers, false));
+  Envoy::Buffer::OwnedImpl data(R"({"id":1})");
+  EXPECT_EQ(Envoy::Http::FilterDataStatus::Continue,
+            filter_->encodeData(data, true));
+
+  EXPECT_EQ(data.toString(), R"({"id":1})");
+  EXPECT_EQ(counter("not_array"), 1);
+}
+
+}  // namespace
+}  // namespace stream_format
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
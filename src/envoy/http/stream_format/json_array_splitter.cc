@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/stream_format/json_array_splitter.h"
+
+#include "absl/strings/ascii.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace stream_format {
+
+std::vector<std::string> JsonArraySplitter::split(absl::string_view data) {
+  std::vector<std::string> elements;
+  const auto complete_element = [&elements, this]() {
+    absl::StripTrailingAsciiWhitespace(&element_);
+    if (!element_.empty()) {
+      elements.push_back(std::move(element_));
+    }
+    element_.clear();
+  };
+
+  for (const char c : data) {
+    switch (state_) {
+      case State::Start:
+        if (absl::ascii_isspace(c)) {
+          continue;
+        }
+        if (c != '[') {
+          state_ = State::Invalid;
+          return elements;
+        }
+        state_ = State::InArray;
+        depth_ = 1;
+        continue;
+      case State::Done:
+      case State::Invalid:
+        return elements;
+      case State::InArray:
+        break;
+    }
+
+    if (in_string_) {
+      element_.push_back(c);
+      if (escaped_) {
+        escaped_ = false;
+      } else if (c == '\\') {
+        escaped_ = true;
+      } else if (c == '"') {
+        in_string_ = false;
+      }
+      continue;
+    }
+
+    if (depth_ == 1) {
+      if (c == ',') {
+        complete_element();
+        continue;
+      }
+      if (c == ']') {
+        complete_element();
+        state_ = State::Done;
+        continue;
+      }
+      if (element_.empty() && absl::ascii_isspace(c)) {
+        continue;
+      }
+    }
+
+    element_.push_back(c);
+    switch (c) {
+      case '"':
+        in_string_ = true;
+        break;
+      case '{':
+      case '[':
+        ++depth_;
+        break;
+      case '}':
+      case ']':
+        --depth_;
+        break;
+      default:
+        break;
+    }
+  }
+  return elements;
+}
+
+}  // namespace stream_format
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
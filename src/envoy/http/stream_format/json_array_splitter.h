@@ -0,0 +1,57 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+#include <vector>
+
+#include "absl/strings/string_view.h"
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace stream_format {
+
+// Splits the JSON array of the messages of a server stream, as the gRPC-JSON
+// transcoder writes it, into its elements. The array can be split at any
+// byte across the data of the response.
+class JsonArraySplitter {
+ public:
+  // Reads the data, and returns the elements of the array it completes.
+  std::vector<std::string> split(absl::string_view data);
+
+  // True once the closing bracket of the array is read.
+  bool done() const { return state_ == State::Done; }
+
+  // True if the data does not start with a JSON array. The next data is not
+  // read.
+  bool invalid() const { return state_ == State::Invalid; }
+
+ private:
+  enum class State { Start, InArray, Done, Invalid };
+
+  State state_{State::Start};
+  // The depth of the brackets and braces, 1 between the elements.
+  int depth_{};
+  bool in_string_{};
+  bool escaped_{};
+  // The element read so far.
+  std::string element_;
+};
+
+}  // namespace stream_format
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
@@ -0,0 +1,86 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/stream_format/json_array_splitter.h"
+
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+
+using ::testing::ElementsAre;
+using ::testing::IsEmpty;
+
+namespace espv2 {
+namespace envoy {
+namespace http_filters {
+namespace stream_format {
+namespace {
+
+TEST(JsonArraySplitterTest, WholeArray) {
+  JsonArraySplitter splitter;
+  EXPECT_THAT(splitter.split(R"([{"id":1},{"id":2}])"),
+              ElementsAre(R"({"id":1})", R"({"id":2})"));
+  EXPECT_TRUE(splitter.done());
+  EXPECT_FALSE(splitter.invalid());
+}
+
+TEST(JsonArraySplitterTest, EmptyArray) {
+  JsonArraySplitter splitter;
+  EXPECT_THAT(splitter.split(" [ ] "), IsEmpty());
+  EXPECT_TRUE(splitter.done());
+}
+
+TEST(JsonArraySplitterTest, SplitAcrossData) {
+  JsonArraySplitter splitter;
+  EXPECT_THAT(splitter.split("["), IsEmpty());
+  EXPECT_THAT(splitter.split(R"({"id":1,"na)"), IsEmpty());
+  EXPECT_THAT(splitter.split(R"(me":"a"})"), IsEmpty());
+  EXPECT_THAT(splitter.split(R"(,{"id")"),
+              ElementsAre(R"({"id":1,"name":"a"})"));
+  EXPECT_THAT(splitter.split(R"(:2})"), IsEmpty());
+  EXPECT_FALSE(splitter.done());
+  EXPECT_THAT(splitter.split("]"), ElementsAre(R"({"id":2})"));
+  EXPECT_TRUE(splitter.done());
+}
+
+TEST(JsonArraySplitterTest, StringsAndNestedValues) {
+  JsonArraySplitter splitter;
+  EXPECT_THAT(
+      splitter.split(
+          R"([{"name":"a,]}\"b","tags":[1,[2]]}, {"map":{"k":"v"}}])"),
+      ElementsAre(R"({"name":"a,]}\"b","tags":[1,[2]]})",
+                  R"({"map":{"k":"v"}})"));
+  EXPECT_TRUE(splitter.done());
+}
+
+TEST(JsonArraySplitterTest, EscapeSplitAcrossData) {
+  JsonArraySplitter splitter;
+  EXPECT_THAT(splitter.split(R"([{"name":"a\)"), IsEmpty());
+  EXPECT_THAT(splitter.split(R"("]"}])"),
+              ElementsAre(R"({"name":"a\"]"})"));
+  EXPECT_TRUE(splitter.done());
+}
+
+TEST(JsonArraySplitterTest, NotArray) {
+  JsonArraySplitter splitter;
+  EXPECT_THAT(splitter.split(R"({"code":5})"), IsEmpty());
+  EXPECT_TRUE(splitter.invalid());
+  EXPECT_THAT(splitter.split("[]"), IsEmpty());
+  EXPECT_FALSE(splitter.done());
+}
+
+}  // namespace
+}  // namespace stream_format
+}  // namespace http_filters
+}  // namespace envoy
+}  // namespace espv2
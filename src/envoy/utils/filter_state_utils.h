@@ -26,6 +26,20 @@ constexpr char kFilterStateApiKey[] =
     "com.google.espv2.filters.http.service_control.api_key";
 constexpr char kFilterStateApiMethod[] =
     "com.google.espv2.filters.http.service_control.api_method";
+// The hex SHA-256 of the api key, identifying it in the logs without the key.
+constexpr char kFilterStateApiKeyHash[] =
+    "com.google.espv2.filters.http.service_control.api_key_hash";
+
+// The dynamic metadata set by Service Control filter for rate limiting, under
+// the filter name:
+constexpr char kDynamicMetadataServiceControl[] =
+    "com.google.espv2.filters.http.service_control";
+// The tier of the consumer of the api key.
+constexpr char kDynamicMetadataConsumerTier[] = "consumer_tier";
+// The hex SHA-256 of the api key.
+constexpr char kDynamicMetadataApiKeyHash[] = "api_key_hash";
+// The HTTP method of the request before x-http-method-override.
+constexpr char kDynamicMetadataOriginalMethod[] = "original_method";
 
 // Sets a read only string value in the filter state.
 void setStringFilterState(Envoy::StreamInfo::FilterState& filter_state,
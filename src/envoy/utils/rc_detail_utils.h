@@ -25,6 +25,10 @@ namespace utils {
 const char kRcDetailFilterServiceControl[] = "service_control";
 const char kRcDetailFilterBackendAuth[] = "backend_auth";
 const char kRcDetailFilterPathRewrite[] = "path_rewrite";
+const char kRcDetailFilterIdempotency[] = "idempotency";
+const char kRcDetailFilterRateLimit[] = "rate_limit";
+const char kRcDetailFilterConcurrencyLimit[] = "concurrency_limit";
+const char kRcDetailFilterBodyValidation[] = "body_validation";
 
 // The error types
 //
@@ -40,6 +44,14 @@ const char kRcDetailErrorTypeScQuotaNetwork[] = "quota_network_failure";
 const char kRcDetailErrorTypeMissingBackendToken[] = "missing_backend_token";
 // The ones specific to the path rewrite filter
 const char kRcDetailErrorTypeWrongRouteConfig[] = "wrong_route_config";
+// The ones specific to the idempotency filter
+const char kRcDetailErrorTypeRequestInProgress[] = "request_in_progress";
+const char kRcDetailErrorTypeKeyReused[] = "key_reused";
+// The ones specific to the rate limit filter
+const char kRcDetailErrorTypeTooManyRequests[] = "too_many_requests";
+// The ones specific to the concurrency limit filter
+const char kRcDetailErrorTypeTooManyConcurrentRequests[] =
+    "too_many_concurrent_requests";
 
 // The detailed errors.
 const char kRcDetailErrorMissingApiKey[] = "MISSING_API_KEY";
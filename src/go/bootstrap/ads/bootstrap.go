@@ -34,6 +34,16 @@ func CreateBootstrapConfig(opts options.AdsBootstrapperOptions) (string, error)
 	// Parse ADS connect timeout
 	connectTimeoutProto := ptypes.DurationProto(opts.AdsConnectTimeout)
 
+	adsApiType := corepb.ApiConfigSource_GRPC
+	if opts.EnableDeltaXds {
+		adsApiType = corepb.ApiConfigSource_DELTA_GRPC
+	}
+
+	statsSinks, err := bt.CreateStatsSinks(opts.CommonOptions)
+	if err != nil {
+		return "", err
+	}
+
 	bt := &bootstrappb.Bootstrap{
 		// Node info
 		Node: bt.CreateNode(opts.CommonOptions),
@@ -44,6 +54,9 @@ func CreateBootstrapConfig(opts options.AdsBootstrapperOptions) (string, error)
 		// layer runtime
 		LayeredRuntime: bt.CreateLayeredRuntime(),
 
+		// stats sinks
+		StatsSinks: statsSinks,
+
 		// Dynamic resource
 		DynamicResources: &bootstrappb.Bootstrap_DynamicResources{
 			LdsConfig: &corepb.ConfigSource{
@@ -59,7 +72,7 @@ func CreateBootstrapConfig(opts options.AdsBootstrapperOptions) (string, error)
 				ResourceApiVersion: apiVersion,
 			},
 			AdsConfig: &corepb.ApiConfigSource{
-				ApiType:             corepb.ApiConfigSource_GRPC,
+				ApiType:             adsApiType,
 				TransportApiVersion: apiVersion,
 				GrpcServices: []*corepb.GrpcService{{
 					TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
@@ -201,6 +201,94 @@ func TestCreateBootstrapConfig(t *testing.T) {
       ]
    }
 }
+`,
+		},
+		{
+			desc: "bootstrap with incremental ADS",
+			args: map[string]string{
+				"enable_delta_xds": "true",
+			},
+			wantConfig: `
+{
+   "admin":{
+      "accessLogPath":"/dev/null",
+      "address":{
+         "socketAddress":{
+            "address":"0.0.0.0",
+            "portValue":8001
+         }
+      }
+   },
+   "dynamicResources":{
+      "adsConfig":{
+         "apiType":"DELTA_GRPC",
+         "grpcServices":[
+            {
+               "envoyGrpc":{
+                  "clusterName":"@espv2-ads-cluster"
+               }
+            }
+         ],
+         "transportApiVersion":"V3"
+      },
+      "cdsConfig":{
+         "ads":{
+            
+         },
+         "resourceApiVersion":"V3"
+      },
+      "ldsConfig":{
+         "ads":{
+            
+         },
+         "resourceApiVersion":"V3"
+      }
+   },
+   "layeredRuntime":{
+      "layers":[
+         {
+            "name":"deprecation",
+            "staticLayer":{
+               "re2.max_program_size.error_level":1000
+            }
+         }
+      ]
+   },
+   "node":{
+      "cluster":"test-node_cluster",
+      "id":"test-node"
+   },
+   "staticResources":{
+      "clusters":[
+         {
+            "connectTimeout":"10s",
+            "http2ProtocolOptions":{
+               
+            },
+            "loadAssignment":{
+               "clusterName":"@espv2-ads-cluster",
+               "endpoints":[
+                  {
+                     "lbEndpoints":[
+                        {
+                           "endpoint":{
+                              "address":{
+                                 "pipe":{
+                                    "path":"@espv2-ads-cluster"
+                                 }
+                              }
+                           }
+                        }
+                     ]
+                  }
+               ]
+            },
+            "name":"@espv2-ads-cluster",
+            "type":"STATIC"
+         }
+      ]
+   }
+}
 `,
 		},
 	}
@@ -25,6 +25,8 @@ import (
 
 var (
 	AdsConnectTimeout = flag.Duration("ads_connect_timeout", 10*time.Second, "ads connect timeout in seconds")
+	EnableDeltaXds    = flag.Bool("enable_delta_xds", false, `If true, Envoy uses the incremental variant of ADS, only receiving the resources changed by a
+	service config rollout instead of all of them.`)
 )
 
 func DefaultBootstrapperOptionsFromFlags() options.AdsBootstrapperOptions {
@@ -32,6 +34,7 @@ func DefaultBootstrapperOptionsFromFlags() options.AdsBootstrapperOptions {
 	opts := options.AdsBootstrapperOptions{
 		CommonOptions:     common_option,
 		AdsConnectTimeout: *AdsConnectTimeout,
+		EnableDeltaXds:    *EnableDeltaXds,
 	}
 
 	glog.Infof("ADS Bootstrapper options: %+v", opts)
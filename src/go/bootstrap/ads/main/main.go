@@ -20,11 +20,15 @@ import (
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/bootstrap/ads"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/bootstrap/ads/flags"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/commonflags"
 	"github.com/golang/glog"
 )
 
 func main() {
 	flag.Parse()
+	if err := commonflags.ApplyEnvironment(); err != nil {
+		glog.Exitf("fail to apply environment variables: %v", err)
+	}
 	outPath := flag.Arg(0)
 	glog.Infof("Output path: %s", outPath)
 	if outPath == "" {
@@ -30,12 +30,22 @@ import (
 // id is the service configuration ID. It is generated when deploying
 // service config to ServiceManagement Server, example: 2017-02-13r0.
 func ServiceToBootstrapConfig(serviceConfig *confpb.Service, id string, opts options.ConfigGeneratorOptions) (*bootstrappb.Bootstrap, error) {
+	if opts.EnableRds {
+		return nil, fmt.Errorf("RDS is not supported in a static bootstrap config, --enable_rds requires the config manager")
+	}
+
 	bt := &bootstrappb.Bootstrap{
 		Node:           bootstrap.CreateNode(opts.CommonOptions),
 		Admin:          bootstrap.CreateAdmin(opts.CommonOptions),
 		LayeredRuntime: bootstrap.CreateLayeredRuntime(),
 	}
 
+	statsSinks, err := bootstrap.CreateStatsSinks(opts.CommonOptions)
+	if err != nil {
+		return nil, err
+	}
+	bt.StatsSinks = statsSinks
+
 	serviceInfo, err := sc.NewServiceInfoFromServiceConfig(serviceConfig, id, opts)
 	if err != nil {
 		return nil, fmt.Errorf("fail to initialize ServiceInfo, %s", err)
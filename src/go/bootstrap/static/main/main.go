@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// configgen generates the complete Envoy config of a service config offline,
+// as a bootstrap with static listeners and clusters, without starting the
+// proxy. It accepts the same flags as the config manager, e.g.
+//
+//	configgen --service_json_path=service.json --backend_address=grpc://127.0.0.1:8082 envoy.json
+//
+// The config is written to stdout if no output path is given.
+//
+// With --validate_only, the service config is validated instead and the
+// problems found are reported, exiting non-zero on errors.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/bootstrap/static"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/commonflags"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/flags"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+
+	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
+)
+
+var validateOnly = flag.Bool("validate_only", false, `Validate the service config with the flags instead of generating the envoy config. The warnings and
+	errors found are written to stdout with the location of the rule, and the exit code is 1 if there is any error.`)
+
+func main() {
+	flag.Parse()
+	if err := commonflags.ApplyEnvironment(); err != nil {
+		glog.Exitf("fail to apply environment variables: %v", err)
+	}
+	outPath := flag.Arg(0)
+
+	opts := flags.EnvoyConfigOptionsFromFlags()
+	serviceConfig, err := configmanager.FetchServiceConfig(opts)
+	if err != nil {
+		glog.Exitf("failed to load service config, error: %v", err)
+	}
+
+	if *validateOnly {
+		diagnostics := gen.ValidateServiceConfig(serviceConfig, opts)
+		for _, d := range diagnostics {
+			fmt.Println(d)
+		}
+		if gen.HasErrors(diagnostics) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	bt, err := static.ServiceToBootstrapConfig(serviceConfig, serviceConfig.GetId(), opts)
+	if err != nil {
+		glog.Exitf("failed to generate envoy config, error: %v", err)
+	}
+	marshal := util.ProtoToJson
+	if opts.DeterministicOutput {
+		marshal = util.ProtoToIndentedJson
+	}
+	configStr, err := marshal(bt)
+	if err != nil {
+		glog.Exitf("failed to marshal envoy config, error: %v", err)
+	}
+
+	if outPath == "" || outPath == "-" {
+		if _, err := os.Stdout.WriteString(configStr + "\n"); err != nil {
+			glog.Exitf("failed to write config to stdout, error: %v", err)
+		}
+		return
+	}
+	glog.Infof("Output path: %s", outPath)
+	if err := ioutil.WriteFile(outPath, []byte(configStr), 0644); err != nil {
+		glog.Exitf("failed to write config to %v, error: %v", outPath, err)
+	}
+}
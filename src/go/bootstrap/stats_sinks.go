@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bootstrap
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	metricspb "github.com/envoyproxy/go-control-plane/envoy/config/metrics/v3"
+)
+
+// CreateStatsSinks outputs the stats sinks flushing the stats to the StatsD
+// or DogStatsD server at opts.StatsdAddress, if set.
+func CreateStatsSinks(opts options.CommonOptions) ([]*metricspb.StatsSink, error) {
+	if opts.StatsdAddress == "" {
+		return nil, nil
+	}
+
+	address, err := parseStatsdAddress(opts.StatsdAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	var name string
+	var sink proto.Message
+	switch opts.StatsdTagFormat {
+	case "", "statsd":
+		// Plain StatsD has no tags, they are kept in the stat names.
+		name = util.StatsdSink
+		sink = &metricspb.StatsdSink{
+			StatsdSpecifier: &metricspb.StatsdSink_Address{
+				Address: address,
+			},
+			Prefix: opts.StatsdPrefix,
+		}
+	case "dogstatsd":
+		name = util.DogStatsdSink
+		sink = &metricspb.DogStatsdSink{
+			DogStatsdSpecifier: &metricspb.DogStatsdSink_Address{
+				Address: address,
+			},
+			Prefix: opts.StatsdPrefix,
+		}
+	default:
+		return nil, fmt.Errorf(`invalid statsd tag format %q, must be one of "statsd" or "dogstatsd"`, opts.StatsdTagFormat)
+	}
+
+	typedConfig, err := ptypes.MarshalAny(sink)
+	if err != nil {
+		return nil, err
+	}
+	return []*metricspb.StatsSink{
+		{
+			Name: name,
+			ConfigType: &metricspb.StatsSink_TypedConfig{
+				TypedConfig: typedConfig,
+			},
+		},
+	}, nil
+}
+
+// parseStatsdAddress parses the UDP address of the StatsD server, in the
+// form of IP:PORT. Envoy does not resolve the hostnames of stats sinks.
+func parseStatsdAddress(address string) (*corepb.Address, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid statsd address %q, must be IP:PORT: %v", address, err)
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid statsd address %q, host must be an IP address", address)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid statsd address %q, port must be in the range [1, 65535]", address)
+	}
+
+	return &corepb.Address{
+		Address: &corepb.Address_SocketAddress{
+			SocketAddress: &corepb.SocketAddress{
+				Protocol: corepb.SocketAddress_UDP,
+				Address:  host,
+				PortSpecifier: &corepb.SocketAddress_PortValue{
+					PortValue: uint32(port),
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+
+	bootstrappb "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+)
+
+func TestCreateStatsSinks(t *testing.T) {
+	testData := []struct {
+		desc            string
+		statsdAddress   string
+		statsdPrefix    string
+		statsdTagFormat string
+		want            string
+		wantError       string
+	}{
+		{
+			desc: "No stats sink without statsd address",
+			want: `{}`,
+		},
+		{
+			desc:            "StatsD sink is created",
+			statsdAddress:   "127.0.0.1:8125",
+			statsdTagFormat: "statsd",
+			want: `{"statsSinks": [
+  {
+    "name": "envoy.stat_sinks.statsd",
+    "typedConfig": {
+      "@type": "type.googleapis.com/envoy.config.metrics.v3.StatsdSink",
+      "address": {
+        "socketAddress": {
+          "protocol": "UDP",
+          "address": "127.0.0.1",
+          "portValue": 8125
+        }
+      }
+    }
+  }
+]}`,
+		},
+		{
+			desc:            "DogStatsD sink is created with prefix on IPv6",
+			statsdAddress:   "[::1]:8125",
+			statsdPrefix:    "espv2",
+			statsdTagFormat: "dogstatsd",
+			want: `{"statsSinks": [
+  {
+    "name": "envoy.stat_sinks.dog_statsd",
+    "typedConfig": {
+      "@type": "type.googleapis.com/envoy.config.metrics.v3.DogStatsdSink",
+      "address": {
+        "socketAddress": {
+          "protocol": "UDP",
+          "address": "::1",
+          "portValue": 8125
+        }
+      },
+      "prefix": "espv2"
+    }
+  }
+]}`,
+		},
+		{
+			desc:            "Failed with hostname in statsd address",
+			statsdAddress:   "statsd:8125",
+			statsdTagFormat: "statsd",
+			wantError:       `invalid statsd address "statsd:8125", host must be an IP address`,
+		},
+		{
+			desc:            "Failed with invalid port in statsd address",
+			statsdAddress:   "127.0.0.1:0",
+			statsdTagFormat: "statsd",
+			wantError:       `invalid statsd address "127.0.0.1:0", port must be in the range [1, 65535]`,
+		},
+		{
+			desc:            "Failed with unknown tag format",
+			statsdAddress:   "127.0.0.1:8125",
+			statsdTagFormat: "influxdb",
+			wantError:       `invalid statsd tag format "influxdb", must be one of "statsd" or "dogstatsd"`,
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultCommonOptions()
+		opts.StatsdAddress = tc.statsdAddress
+		opts.StatsdPrefix = tc.statsdPrefix
+		opts.StatsdTagFormat = tc.statsdTagFormat
+
+		got, err := CreateStatsSinks(opts)
+		if err != nil {
+			if err.Error() != tc.wantError {
+				t.Errorf("Test (%s): failed, got error: %v, want error: %v", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if tc.wantError != "" {
+			t.Errorf("Test (%s): failed, got no error, want error: %v", tc.desc, tc.wantError)
+			continue
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		gotJson, err := marshaler.MarshalToString(&bootstrappb.Bootstrap{
+			StatsSinks: got,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := util.JsonEqual(tc.want, gotJson); err != nil {
+			t.Errorf("Test (%s): failed, \n %v", tc.desc, err)
+		}
+	}
+}
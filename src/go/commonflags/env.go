@@ -0,0 +1,61 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commonflags
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvPrefix prefixes the environment variables of the flags, e.g.
+// ESPv2_BACKEND_ADDRESS sets --backend_address.
+const EnvPrefix = "ESPv2_"
+
+// EnvName returns the environment variable of a flag.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// ApplyEnvironment sets the flags not set on the command line from their
+// ESPv2_ environment variables, so a flag takes precedence over its variable,
+// which takes precedence over the default. It must be called after
+// flag.Parse.
+func ApplyEnvironment() error {
+	return applyEnvironment(flag.CommandLine, os.LookupEnv)
+}
+
+func applyEnvironment(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	setOnCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || setOnCommandLine[f.Name] {
+			return
+		}
+		value, ok := lookupEnv(EnvName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q of environment variable %s: %v", value, EnvName(f.Name), setErr)
+		}
+	})
+	return err
+}
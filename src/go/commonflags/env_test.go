@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commonflags
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnvironment(t *testing.T) {
+	testData := []struct {
+		desc       string
+		args       []string
+		env        map[string]string
+		wantValues map[string]string
+		wantError  string
+	}{
+		{
+			desc: "flags set from the environment",
+			env: map[string]string{
+				"ESPv2_BACKEND_ADDRESS": "grpc://127.0.0.1:8082",
+				"ESPv2_ENABLE_TRACING":  "true",
+			},
+			wantValues: map[string]string{
+				"backend_address": "grpc://127.0.0.1:8082",
+				"enable_tracing":  "true",
+				"listener_port":   "8080",
+			},
+		},
+		{
+			desc: "flags on the command line override the environment",
+			args: []string{"--listener_port=9000"},
+			env: map[string]string{
+				"ESPv2_LISTENER_PORT": "8000",
+			},
+			wantValues: map[string]string{
+				"backend_address": "http://127.0.0.1:8082",
+				"listener_port":   "9000",
+			},
+		},
+		{
+			desc: "variables without the exact prefix are ignored",
+			env: map[string]string{
+				"ESPV2_LISTENER_PORT": "8000",
+				"LISTENER_PORT":       "8000",
+			},
+			wantValues: map[string]string{
+				"listener_port": "8080",
+			},
+		},
+		{
+			desc: "invalid value",
+			env: map[string]string{
+				"ESPv2_LISTENER_PORT": "eighty",
+			},
+			wantError: `invalid value "eighty" of environment variable ESPv2_LISTENER_PORT`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.String("backend_address", "http://127.0.0.1:8082", "")
+			fs.Int("listener_port", 8080, "")
+			fs.Bool("enable_tracing", false, "")
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyEnvironment(fs, func(name string) (string, bool) {
+				value, ok := tc.env[name]
+				return value, ok
+			})
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Errorf("want error: %s, get error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotValues := make(map[string]string)
+			for name := range tc.wantValues {
+				gotValues[name] = fs.Lookup(name).Value.String()
+			}
+			if !reflect.DeepEqual(gotValues, tc.wantValues) {
+				t.Errorf("want flag values %v, get %v", tc.wantValues, gotValues)
+			}
+		})
+	}
+}
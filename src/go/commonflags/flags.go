@@ -33,8 +33,9 @@ var (
 	AdminPort                  = flag.Int("admin_port", 8001, "Enables envoy's admin interface on this port if it is not 0. Not recommended for production use-cases, as the admin port is unauthenticated.")
 	HttpRequestTimeoutS        = flag.Int("http_request_timeout_s", 30, `Set the timeout in second for all requests. Must be > 0 and the default is 30 seconds if not set.`)
 	Node                       = flag.String("node", "ESPv2", "envoy node id")
-	NonGCP                     = flag.Bool("non_gcp", false, `By default, the proxy tries to talk to GCP metadata server to get VM location in the first few requests. Setting this flag to true to skip this step`)
+	NonGCP                     = flag.Bool("non_gcp", false, `By default, the proxy tries to talk to GCP metadata server to get VM location in the first few requests. Setting this flag to true to skip this step. The config generation then fails if Service Control or IAM are called without --service_account_key or a non-GCP --metadata_provider to get their access tokens.`)
 	GeneratedHeaderPrefix      = flag.String("generated_header_prefix", "X-Endpoint-", "Set the header prefix for the generated headers. By default, it is `X-Endpoint-`")
+	TracingProvider            = flag.String("tracing_provider", "stackdriver", `The tracer to export spans to, must be one of "stackdriver" or "zipkin". Use "zipkin" for Zipkin or Jaeger collectors.`)
 	TracingProjectId           = flag.String("tracing_project_id", "", "The Google project id required for Stack driver tracing. If not set, will automatically use fetch it from GCP Metadata server")
 	TracingStackdriverAddress  = flag.String("tracing_stackdriver_address", "", "By default, the Stackdriver exporter will connect to production Stackdriver. If this is non-empty, it will connect to this address. It must be in the gRPC format and implement the cloud trace v2 RPCs.")
 	TracingSamplingRate        = flag.Float64("tracing_sample_rate", 0.001, "tracing sampling rate from 0.0 to 1.0")
@@ -45,6 +46,15 @@ var (
 	TracingMaxNumMessageEvents = flag.Int64("tracing_max_num_message_events", 128, "Sets the maximum number of message events that each span can contain. Defaults to the maximum allowed by Stackdriver. In practice, the number of message events published will be much less.")
 	TracingMaxNumLinks         = flag.Int64("tracing_max_num_links", 128, "Sets the maximum number of links that each span can contain. Defaults to the maximum allowed by Stackdriver. In practice, the number of links published will be much less.")
 
+	TracingZipkinCollectorAddress = flag.String("tracing_zipkin_collector_address", "", `The address of the Zipkin compatible collector used when --tracing_provider is "zipkin",
+	e.g. http://zipkin:9411/api/v2/spans or http://jaeger-collector:9411/api/v2/spans. The path defaults to /api/v2/spans.`)
+	TracingZipkinSharedSpanContext = flag.Bool("tracing_zipkin_shared_span_context", true, "Whether the client and server spans of a request share the same span context for Zipkin tracing.")
+	TracingZipkinTraceId128Bit     = flag.Bool("tracing_zipkin_trace_id_128bit", false, "Whether to generate 128-bit trace ids for Zipkin tracing. By default, 64-bit trace ids are generated.")
+
+	StatsdAddress   = flag.String("statsd_address", "", "If set, flush the stats to the StatsD server at this UDP address, in the form of IP:PORT.")
+	StatsdPrefix    = flag.String("statsd_prefix", "", `The prefix of the stats flushed to the StatsD server. Defaults to "envoy".`)
+	StatsdTagFormat = flag.String("statsd_tag_format", "statsd", `The format of the stats flushed to the StatsD server, must be one of "statsd" or "dogstatsd". Use "dogstatsd" to emit the stat tags for Datadog.`)
+
 	//Suspected Envoy has listener initialization bug: if a http filter needs to use
 	//a cluster with DSN lookup for initialization, e.g. fetching a remote access
 	//token, the cluster is not ready so the whole listener is destroyed. ADS will
@@ -55,6 +65,9 @@ var (
 	MetadataURL = flag.String("metadata_url", "http://169.254.169.254", "url of metadata server")
 	IamURL      = flag.String("iam_url", "https://iamcredentials.googleapis.com", "url of iam server")
 
+	MetadataProvider  = flag.String("metadata_provider", "gcp", `The platform used to fetch instance attributes and access tokens, must be one of "gcp", "aws", "azure" or "static_token_file". Providers other than "gcp" read access tokens from --metadata_token_file.`)
+	MetadataTokenFile = flag.String("metadata_token_file", "", `Path to a file holding the access token used when --metadata_provider is not "gcp". The file may contain either the raw token or a JSON object with "access_token" and "expires_in" fields, and is re-read when the token expires.`)
+
 	ServiceControlIamServiceAccount = flag.String("service_control_iam_service_account", "", "The service account used to fetch access token for the Service Control from Google Cloud IAM")
 	ServiceControlIamDelegates      = flag.String("service_control_iam_delegates", "", "The sequence of service accounts in a delegation chain used to fetch access token for the Service Control from Google Cloud IAM. The multiple delegates should be separated by \",\" and the flag only applies when ServiceControlIamServiceAccount is not empty.")
 
@@ -64,25 +77,34 @@ var (
 
 func DefaultCommonOptionsFromFlags() options.CommonOptions {
 	opts := options.CommonOptions{
-		AdminAddress:               *AdminAddress,
-		AdminPort:                  *AdminPort,
-		AdsNamedPipe:               *AdsNamedPipe,
-		DisableTracing:             *DisableTracing,
-		HttpRequestTimeout:         time.Duration(*HttpRequestTimeoutS) * time.Second,
-		Node:                       *Node,
-		NonGCP:                     *NonGCP,
-		GeneratedHeaderPrefix:      *GeneratedHeaderPrefix,
-		TracingProjectId:           *TracingProjectId,
-		TracingStackdriverAddress:  *TracingStackdriverAddress,
-		TracingSamplingRate:        *TracingSamplingRate,
-		TracingIncomingContext:     *TracingIncomingContext,
-		TracingOutgoingContext:     *TracingOutgoingContext,
-		TracingMaxNumAttributes:    *TracingMaxNumAttributes,
-		TracingMaxNumAnnotations:   *TracingMaxNumAnnotations,
-		TracingMaxNumMessageEvents: *TracingMaxNumMessageEvents,
-		TracingMaxNumLinks:         *TracingMaxNumLinks,
-		MetadataURL:                *MetadataURL,
-		IamURL:                     *IamURL,
+		AdminAddress:                   *AdminAddress,
+		AdminPort:                      *AdminPort,
+		AdsNamedPipe:                   *AdsNamedPipe,
+		DisableTracing:                 *DisableTracing,
+		HttpRequestTimeout:             time.Duration(*HttpRequestTimeoutS) * time.Second,
+		Node:                           *Node,
+		NonGCP:                         *NonGCP,
+		GeneratedHeaderPrefix:          *GeneratedHeaderPrefix,
+		TracingProvider:                *TracingProvider,
+		TracingProjectId:               *TracingProjectId,
+		TracingStackdriverAddress:      *TracingStackdriverAddress,
+		TracingSamplingRate:            *TracingSamplingRate,
+		TracingIncomingContext:         *TracingIncomingContext,
+		TracingOutgoingContext:         *TracingOutgoingContext,
+		TracingMaxNumAttributes:        *TracingMaxNumAttributes,
+		TracingMaxNumAnnotations:       *TracingMaxNumAnnotations,
+		TracingMaxNumMessageEvents:     *TracingMaxNumMessageEvents,
+		TracingMaxNumLinks:             *TracingMaxNumLinks,
+		TracingZipkinCollectorAddress:  *TracingZipkinCollectorAddress,
+		TracingZipkinSharedSpanContext: *TracingZipkinSharedSpanContext,
+		TracingZipkinTraceId128Bit:     *TracingZipkinTraceId128Bit,
+		StatsdAddress:                  *StatsdAddress,
+		StatsdPrefix:                   *StatsdPrefix,
+		StatsdTagFormat:                *StatsdTagFormat,
+		MetadataURL:                    *MetadataURL,
+		IamURL:                         *IamURL,
+		MetadataProvider:               *MetadataProvider,
+		MetadataTokenFile:              *MetadataTokenFile,
 	}
 	if *BackendAuthIamServiceAccount != "" {
 		opts.BackendAuthCredentials = &options.IAMCredentialsOptions{
@@ -0,0 +1,169 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	routerpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tlspb "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+)
+
+// MakeSecrets provides the secrets served to Envoy through SDS: the server
+// certificate issued through ACME, once the config manager obtained it.
+func MakeSecrets(serviceInfo *configinfo.ServiceInfo) []*tlspb.Secret {
+	cert := serviceInfo.AcmeCertificate
+	if serviceInfo.Options.AcmeDomains == "" || cert == nil {
+		return nil
+	}
+	return []*tlspb.Secret{
+		{
+			Name: util.AcmeSecretName,
+			Type: &tlspb.Secret_TlsCertificate{
+				TlsCertificate: &tlspb.TlsCertificate{
+					CertificateChain: &corepb.DataSource{
+						Specifier: &corepb.DataSource_InlineBytes{
+							InlineBytes: cert.CertificateChain,
+						},
+					},
+					PrivateKey: &corepb.DataSource{
+						Specifier: &corepb.DataSource_InlineBytes{
+							InlineBytes: cert.PrivateKey,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// makeAcmeHttpListener provides the plain HTTP listener of --acme_http_port.
+// It answers the pending ACME HTTP-01 challenges with their key
+// authorizations, and redirects the other requests to HTTPS. It has none of
+// the filters of the service, the CA must reach the challenges unauthenticated.
+func makeAcmeHttpListener(serviceInfo *configinfo.ServiceInfo) (*listenerpb.Listener, error) {
+	tokens := make([]string, 0, len(serviceInfo.AcmeHttpChallenges))
+	for token := range serviceInfo.AcmeHttpChallenges {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	var routes []*routepb.Route
+	for _, token := range tokens {
+		routes = append(routes, &routepb.Route{
+			Match: &routepb.RouteMatch{
+				PathSpecifier: &routepb.RouteMatch_Path{
+					Path: util.AcmeHttpChallengePathPrefix + token,
+				},
+			},
+			Action: &routepb.Route_DirectResponse{
+				DirectResponse: &routepb.DirectResponseAction{
+					Status: http.StatusOK,
+					Body: &corepb.DataSource{
+						Specifier: &corepb.DataSource_InlineString{
+							InlineString: serviceInfo.AcmeHttpChallenges[token],
+						},
+					},
+				},
+			},
+			ResponseHeadersToAdd: []*corepb.HeaderValueOption{
+				{
+					Header: &corepb.HeaderValue{
+						Key:   "content-type",
+						Value: "text/plain",
+					},
+				},
+			},
+		})
+	}
+	routes = append(routes, &routepb.Route{
+		Match: &routepb.RouteMatch{
+			PathSpecifier: &routepb.RouteMatch_Prefix{
+				Prefix: "/",
+			},
+		},
+		Action: &routepb.Route_Redirect{
+			Redirect: &routepb.RedirectAction{
+				SchemeRewriteSpecifier: &routepb.RedirectAction_HttpsRedirect{
+					HttpsRedirect: true,
+				},
+			},
+		},
+	})
+
+	router, _ := ptypes.MarshalAny(&routerpb.Router{
+		SuppressEnvoyHeaders: true,
+	})
+	httpConMgr := &hcmpb.HttpConnectionManager{
+		CodecType:  hcmpb.HttpConnectionManager_AUTO,
+		StatPrefix: "acme_http",
+		RouteSpecifier: &hcmpb.HttpConnectionManager_RouteConfig{
+			RouteConfig: &routepb.RouteConfiguration{
+				Name: "acme_http_route",
+				VirtualHosts: []*routepb.VirtualHost{
+					{
+						Name:    "acme_http",
+						Domains: []string{"*"},
+						Routes:  routes,
+					},
+				},
+			},
+		},
+		HttpFilters: []*hcmpb.HttpFilter{
+			{
+				Name:       util.Router,
+				ConfigType: &hcmpb.HttpFilter_TypedConfig{TypedConfig: router},
+			},
+		},
+	}
+
+	httpFilterConfig, err := ptypes.MarshalAny(httpConMgr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &listenerpb.Listener{
+		Name: util.AcmeHttpListenerName,
+		Address: &corepb.Address{
+			Address: &corepb.Address_SocketAddress{
+				SocketAddress: &corepb.SocketAddress{
+					Address: serviceInfo.Options.ListenerAddress,
+					PortSpecifier: &corepb.SocketAddress_PortValue{
+						PortValue: uint32(serviceInfo.Options.AcmeHttpPort),
+					},
+				},
+			},
+		},
+		FilterChains: []*listenerpb.FilterChain{
+			{
+				Filters: []*listenerpb.Filter{
+					{
+						Name:       util.HTTPConnectionManager,
+						ConfigType: &listenerpb.Filter_TypedConfig{TypedConfig: httpFilterConfig},
+					},
+				},
+			},
+		},
+	}, nil
+}
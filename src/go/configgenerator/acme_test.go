@@ -0,0 +1,314 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
+
+	tlspb "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestMakeAcmeHttpListener(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.AcmeDomains = "api.example.com"
+	opts.AcmeHttpPort = 8080
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+			},
+		},
+	}, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeServiceInfo.AcmeHttpChallenges = map[string]string{
+		"token-b": "token-b.thumbprint",
+		"token-a": "token-a.thumbprint",
+	}
+
+	listener, err := makeAcmeHttpListener(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantListener := `
+{
+  "address":{
+    "socketAddress":{
+      "address":"0.0.0.0",
+      "portValue":8080
+    }
+  },
+  "filterChains":[
+    {
+      "filters":[
+        {
+          "name":"envoy.filters.network.http_connection_manager",
+          "typedConfig":{
+            "@type":"type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+            "httpFilters":[
+              {
+                "name":"envoy.filters.http.router",
+                "typedConfig":{
+                  "@type":"type.googleapis.com/envoy.extensions.filters.http.router.v3.Router",
+                  "suppressEnvoyHeaders":true
+                }
+              }
+            ],
+            "routeConfig":{
+              "name":"acme_http_route",
+              "virtualHosts":[
+                {
+                  "domains":[
+                    "*"
+                  ],
+                  "name":"acme_http",
+                  "routes":[
+                    {
+                      "match":{
+                        "path":"/.well-known/acme-challenge/token-a"
+                      },
+                      "directResponse":{
+                        "status":200,
+                        "body":{
+                          "inlineString":"token-a.thumbprint"
+                        }
+                      },
+                      "responseHeadersToAdd":[
+                        {
+                          "header":{
+                            "key":"content-type",
+                            "value":"text/plain"
+                          }
+                        }
+                      ]
+                    },
+                    {
+                      "match":{
+                        "path":"/.well-known/acme-challenge/token-b"
+                      },
+                      "directResponse":{
+                        "status":200,
+                        "body":{
+                          "inlineString":"token-b.thumbprint"
+                        }
+                      },
+                      "responseHeadersToAdd":[
+                        {
+                          "header":{
+                            "key":"content-type",
+                            "value":"text/plain"
+                          }
+                        }
+                      ]
+                    },
+                    {
+                      "match":{
+                        "prefix":"/"
+                      },
+                      "redirect":{
+                        "httpsRedirect":true
+                      }
+                    }
+                  ]
+                }
+              ]
+            },
+            "statPrefix":"acme_http"
+          }
+        }
+      ]
+    }
+  ],
+  "name":"acme_http_listener"
+}`
+
+	marshaler := &jsonpb.Marshaler{}
+	gotListener, err := marshaler.MarshalToString(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.JsonEqual(wantListener, gotListener); err != nil {
+		t.Errorf("makeAcmeHttpListener failed, \n %v ", err)
+	}
+}
+
+func TestMakeListenersForAcme(t *testing.T) {
+	testData := []struct {
+		desc              string
+		acmeDomains       string
+		acmeHttpPort      int
+		sslServerCertPath string
+		wantListeners     []string
+		wantSdsSecret     string
+		wantError         string
+	}{
+		{
+			desc:          "No ACME by default",
+			wantListeners: []string{util.IngressListenerName},
+		},
+		{
+			desc:          "Certificate of the ingress listener through SDS",
+			acmeDomains:   "api.example.com",
+			wantListeners: []string{util.IngressListenerName},
+			wantSdsSecret: util.AcmeSecretName,
+		},
+		{
+			desc:          "HTTP listener of the challenges",
+			acmeDomains:   "api.example.com",
+			acmeHttpPort:  8080,
+			wantListeners: []string{util.IngressListenerName, util.AcmeHttpListenerName},
+			wantSdsSecret: util.AcmeSecretName,
+		},
+		{
+			desc:              "Failed with a server certificate path",
+			acmeDomains:       "api.example.com",
+			sslServerCertPath: "/etc/ssl/endpoints",
+			wantError:         "--acme_domains cannot be used together with --ssl_server_cert_path",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.AcmeDomains = tc.acmeDomains
+			opts.AcmeHttpPort = tc.acmeHttpPort
+			opts.SslServerCertPath = tc.sslServerCertPath
+			opts.DisableTracing = true
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			}, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			listeners, err := MakeListeners(fakeServiceInfo)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotListeners []string
+			for _, listener := range listeners {
+				gotListeners = append(gotListeners, listener.GetName())
+			}
+			if !reflect.DeepEqual(gotListeners, tc.wantListeners) {
+				t.Errorf("got listeners: %v, want: %v", gotListeners, tc.wantListeners)
+			}
+
+			gotSdsSecret := ""
+			if transportSocket := listeners[0].GetFilterChains()[0].GetTransportSocket(); transportSocket != nil {
+				tlsContext := &tlspb.DownstreamTlsContext{}
+				if err := ptypes.UnmarshalAny(transportSocket.GetTypedConfig(), tlsContext); err != nil {
+					t.Fatal(err)
+				}
+				for _, config := range tlsContext.GetCommonTlsContext().GetTlsCertificateSdsSecretConfigs() {
+					gotSdsSecret = config.GetName()
+				}
+			}
+			if gotSdsSecret != tc.wantSdsSecret {
+				t.Errorf("got SDS secret: %q, want: %q", gotSdsSecret, tc.wantSdsSecret)
+			}
+		})
+	}
+}
+
+func TestMakeSecrets(t *testing.T) {
+	testData := []struct {
+		desc        string
+		acmeDomains string
+		certificate *configinfo.AcmeCertificate
+		wantSecrets string
+	}{
+		{
+			desc:        "No secret until the certificate is issued",
+			acmeDomains: "api.example.com",
+		},
+		{
+			desc:        "No secret without ACME",
+			certificate: &configinfo.AcmeCertificate{},
+		},
+		{
+			desc:        "Secret of the issued certificate",
+			acmeDomains: "api.example.com",
+			certificate: &configinfo.AcmeCertificate{
+				CertificateChain: []byte("cert"),
+				PrivateKey:       []byte("key"),
+			},
+			wantSecrets: `{
+				"name":"acme_server_cert",
+				"tlsCertificate":{
+					"certificateChain":{
+						"inlineBytes":"Y2VydA=="
+					},
+					"privateKey":{
+						"inlineBytes":"a2V5"
+					}
+				}
+			}`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			fakeServiceInfo := &configinfo.ServiceInfo{
+				Options:         options.DefaultConfigGeneratorOptions(),
+				AcmeCertificate: tc.certificate,
+			}
+			fakeServiceInfo.Options.AcmeDomains = tc.acmeDomains
+
+			secrets := MakeSecrets(fakeServiceInfo)
+			if tc.wantSecrets == "" {
+				if len(secrets) != 0 {
+					t.Fatalf("expected no secrets, got: %v", secrets)
+				}
+				return
+			}
+			if len(secrets) != 1 {
+				t.Fatalf("expected 1 secret, got: %v", secrets)
+			}
+			marshaler := &jsonpb.Marshaler{}
+			gotSecret, err := marshaler.MarshalToString(secrets[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(tc.wantSecrets, gotSecret); err != nil {
+				t.Errorf("MakeSecrets failed, \n %v ", err)
+			}
+		})
+	}
+}
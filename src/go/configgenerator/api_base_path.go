@@ -0,0 +1,128 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/golang/protobuf/proto"
+
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// makeApiBasePathRewrite strips --api_base_path from the path forwarded by
+// the router. The path_rewrite filter runs first, so the path prefix of the
+// backend is kept ahead of it. The constant paths of the backends and the
+// paths of the transcoded gRPC calls don't have it anymore.
+func makeApiBasePathRewrite(apiBasePath string, method *configinfo.MethodInfo) *matcher.RegexMatchAndSubstitute {
+	if method.BackendInfo.TranslationType == confpb.BackendRule_CONSTANT_ADDRESS {
+		return nil
+	}
+
+	backendPrefix := ""
+	if method.BackendInfo.TranslationType == confpb.BackendRule_APPEND_PATH_TO_ADDRESS {
+		backendPrefix = strings.TrimSuffix(method.BackendInfo.Path, "/")
+	}
+	return &matcher.RegexMatchAndSubstitute{
+		Pattern: &matcher.RegexMatcher{
+			EngineType: &matcher.RegexMatcher_GoogleRe2{
+				GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+			},
+			// The root of the api base path has no trailing slash.
+			Regex: "^" + regexp.QuoteMeta(backendPrefix+apiBasePath) + "/?",
+		},
+		Substitution: backendPrefix + "/",
+	}
+}
+
+// prefixTranscoderHttpRules prepends --api_base_path to the google.api.http
+// options of the methods of the transcoded apis in the proto descriptor, so
+// the transcoder matches the paths of their routes.
+func prefixTranscoderHttpRules(descriptorBin []byte, apiNames []string, apiBasePath string) ([]byte, error) {
+	descriptorSet := &descpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(descriptorBin, descriptorSet); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal the proto descriptor, %v", err)
+	}
+
+	transcoded := make(map[string]bool)
+	for _, apiName := range apiNames {
+		transcoded[apiName] = true
+	}
+	for _, file := range descriptorSet.GetFile() {
+		for _, service := range file.GetService() {
+			apiName := service.GetName()
+			if file.GetPackage() != "" {
+				apiName = file.GetPackage() + "." + apiName
+			}
+			if !transcoded[apiName] {
+				continue
+			}
+
+			for _, method := range service.GetMethod() {
+				if method.GetOptions() == nil || !proto.HasExtension(method.GetOptions(), annotationspb.E_Http) {
+					continue
+				}
+				ext, err := proto.GetExtension(method.GetOptions(), annotationspb.E_Http)
+				if err != nil {
+					return nil, fmt.Errorf("fail to read the http rule of method %s.%s, %v", apiName, method.GetName(), err)
+				}
+				rule, ok := ext.(*annotationspb.HttpRule)
+				if !ok {
+					return nil, fmt.Errorf("unexpected type %T of the http rule of method %s.%s", ext, apiName, method.GetName())
+				}
+
+				rule = proto.Clone(rule).(*annotationspb.HttpRule)
+				prefixHttpRule(rule, apiBasePath)
+				for _, binding := range rule.GetAdditionalBindings() {
+					prefixHttpRule(binding, apiBasePath)
+				}
+				if err := proto.SetExtension(method.GetOptions(), annotationspb.E_Http, rule); err != nil {
+					return nil, fmt.Errorf("fail to set the http rule of method %s.%s, %v", apiName, method.GetName(), err)
+				}
+			}
+		}
+	}
+	return proto.Marshal(descriptorSet)
+}
+
+// prefixHttpRule prepends the path prefix to the path of the http rule.
+func prefixHttpRule(rule *annotationspb.HttpRule, prefix string) {
+	prefixed := func(path string) string {
+		if path == "/" {
+			return prefix
+		}
+		return prefix + path
+	}
+	switch pattern := rule.GetPattern().(type) {
+	case *annotationspb.HttpRule_Get:
+		pattern.Get = prefixed(pattern.Get)
+	case *annotationspb.HttpRule_Put:
+		pattern.Put = prefixed(pattern.Put)
+	case *annotationspb.HttpRule_Post:
+		pattern.Post = prefixed(pattern.Post)
+	case *annotationspb.HttpRule_Delete:
+		pattern.Delete = prefixed(pattern.Delete)
+	case *annotationspb.HttpRule_Patch:
+		pattern.Patch = prefixed(pattern.Patch)
+	case *annotationspb.HttpRule_Custom:
+		pattern.Custom.Path = prefixed(pattern.Custom.Path)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestMakeRouteTableForApiBasePath(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Foo",
+					},
+					{
+						Name: "Bar",
+					},
+					{
+						Name: "Baz",
+					},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector:        "endpoints.examples.bookstore.Bookstore.Bar",
+					Address:         "https://testapipb.com/bar",
+					PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+				},
+				{
+					Selector:        "endpoints.examples.bookstore.Bookstore.Baz",
+					Address:         "https://testapipb.com/baz",
+					PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Foo",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/foo/{id}",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Bar",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/bar",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Baz",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/baz",
+				},
+			},
+		}},
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.ApiBasePath = "/gateway/v1"
+	opts.Healthz = "/healthz"
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := makeRouteTable(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The routes by their path or regex match, with the regex rewrite of the
+	// forwarded path.
+	wantRewrites := map[string]string{
+		`^/gateway/v1/foo/[^\/]+\/?$`: `{"pattern":{"googleRe2":{},"regex":"^/gateway/v1/?"},"substitution":"/"}`,
+		"/gateway/v1/bar":             `{"pattern":{"googleRe2":{},"regex":"^/bar/gateway/v1/?"},"substitution":"/bar/"}`,
+		"/gateway/v1/bar/":            `{"pattern":{"googleRe2":{},"regex":"^/bar/gateway/v1/?"},"substitution":"/bar/"}`,
+		"/gateway/v1/baz":             "",
+		"/gateway/v1/baz/":            "",
+		"/healthz":                    "",
+		"/healthz/":                   "",
+	}
+	gotMatches := make(map[string]bool)
+	for _, route := range routes {
+		match := route.GetMatch().GetPath() + route.GetMatch().GetSafeRegex().GetRegex()
+		wantRewrite, ok := wantRewrites[match]
+		if !ok {
+			t.Errorf("unexpected route match %s", match)
+			continue
+		}
+		gotMatches[match] = true
+
+		rewrite := route.GetRoute().GetRegexRewrite()
+		if wantRewrite == "" {
+			if rewrite != nil {
+				t.Errorf("route %s: want no regex rewrite, get %v", match, rewrite)
+			}
+			continue
+		}
+		gotRewrite, err := util.ProtoToJson(rewrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(wantRewrite, gotRewrite); err != nil {
+			t.Errorf("route %s: regex rewrite mismatch: %v", match, err)
+		}
+	}
+	for match := range wantRewrites {
+		if !gotMatches[match] {
+			t.Errorf("route match %s is missing", match)
+		}
+	}
+}
+
+func TestPrefixTranscoderHttpRules(t *testing.T) {
+	makeMethod := func(name string, rule *annotationspb.HttpRule) *descpb.MethodDescriptorProto {
+		method := &descpb.MethodDescriptorProto{
+			Name:    proto.String(name),
+			Options: &descpb.MethodOptions{},
+		}
+		if rule != nil {
+			if err := proto.SetExtension(method.Options, annotationspb.E_Http, rule); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return method
+	}
+	descriptorSet := &descpb.FileDescriptorSet{
+		File: []*descpb.FileDescriptorProto{
+			{
+				Name:    proto.String("bookstore.proto"),
+				Package: proto.String("endpoints.examples.bookstore"),
+				Service: []*descpb.ServiceDescriptorProto{
+					{
+						Name: proto.String("Bookstore"),
+						Method: []*descpb.MethodDescriptorProto{
+							makeMethod("GetShelf", &annotationspb.HttpRule{
+								Pattern: &annotationspb.HttpRule_Get{
+									Get: "/v1/shelves/{shelf}",
+								},
+								AdditionalBindings: []*annotationspb.HttpRule{
+									{
+										Pattern: &annotationspb.HttpRule_Custom{
+											Custom: &annotationspb.CustomHttpPattern{
+												Kind: "HEAD",
+												Path: "/",
+											},
+										},
+									},
+								},
+							}),
+							makeMethod("WatchShelves", nil),
+						},
+					},
+					{
+						Name: proto.String("Library"),
+						Method: []*descpb.MethodDescriptorProto{
+							makeMethod("GetBook", &annotationspb.HttpRule{
+								Pattern: &annotationspb.HttpRule_Get{
+									Get: "/v1/books/{book}",
+								},
+							}),
+						},
+					},
+				},
+			},
+		},
+	}
+	descriptorBin, err := proto.Marshal(descriptorSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefixed, err := prefixTranscoderHttpRules(descriptorBin, []string{"endpoints.examples.bookstore.Bookstore"}, "/gateway/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &descpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(prefixed, got); err != nil {
+		t.Fatal(err)
+	}
+
+	httpRule := func(method *descpb.MethodDescriptorProto) *annotationspb.HttpRule {
+		if !proto.HasExtension(method.GetOptions(), annotationspb.E_Http) {
+			return nil
+		}
+		ext, err := proto.GetExtension(method.GetOptions(), annotationspb.E_Http)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ext.(*annotationspb.HttpRule)
+	}
+	services := got.GetFile()[0].GetService()
+
+	getShelf := httpRule(services[0].GetMethod()[0])
+	if path := getShelf.GetGet(); path != "/gateway/v1/v1/shelves/{shelf}" {
+		t.Errorf("want the http rule of a transcoded api prefixed, get %s", path)
+	}
+	if path := getShelf.GetAdditionalBindings()[0].GetCustom().GetPath(); path != "/gateway/v1" {
+		t.Errorf("want the additional binding of the root path prefixed, get %s", path)
+	}
+	if rule := httpRule(services[0].GetMethod()[1]); rule != nil {
+		t.Errorf("want no http rule added to a method without one, get %v", rule)
+	}
+	if path := httpRule(services[1].GetMethod()[0]).GetGet(); path != "/v1/books/{book}" {
+		t.Errorf("want the http rule of an api not transcoded unchanged, get %s", path)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	rcdpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/access_log/response_code_details"
+
+	acpb "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	facpb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
+	alspb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	htmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/header_to_metadata/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+const (
+	auditDecisionAllow = "ALLOW"
+	auditDecisionDeny  = "DENY"
+
+	// The log names of the audit log entries streamed to the gRPC Access Log
+	// Service.
+	auditLogAllowName = "espv2_audit_allow"
+	auditLogDenyName  = "espv2_audit_deny"
+
+	// The dynamic metadata of the request path without its query, so the API
+	// keys and the JWTs of the query parameters are not written to the audit
+	// log.
+	auditLogMetadataNamespace = "com.google.espv2.audit_log"
+	auditLogPathKey           = "path"
+)
+
+// The prefixes of the response code details of the requests rejected by the
+// auth or the quota of the proxy.
+var auditDenyResponseCodeDetails = []string{
+	// Envoy filters.
+	"jwt_authn_access_denied",
+	"rbac_access_denied",
+	"local_rate_limited",
+	"request_rate_limited",
+	// ESPv2 filters.
+	"service_control_check_error",
+	"service_control_check_network_failure",
+	"service_control_quota_error",
+	"service_control_quota_network_failure",
+	"service_control_bad_request{MISSING_API_KEY}",
+	"rate_limit_too_many_requests",
+	"concurrency_limit_too_many_concurrent_requests",
+}
+
+// makeAuditLogs returns the access logs writing the auth outcome of every
+// request, to the file of --audit_log and to the gRPC Access Log Service.
+//
+// The decision is DENY for the requests rejected by the auth or the quota of
+// the proxy, matched by their response code details, and ALLOW for the others,
+// including the ones the backend rejects. Each decision gets its own access
+// log, so the entries carry it without Envoy evaluating it. The reason is the
+// response code details, e.g. jwt_authn_access_denied{Jwt_is_missing} or
+// via_upstream.
+func makeAuditLogs(opts *options.ConfigGeneratorOptions) ([]*acpb.AccessLog, error) {
+	if opts.AuditLogToAccessLogService && opts.AccessLogServiceAddress == "" {
+		return nil, fmt.Errorf("--audit_log_to_access_log_service requires --access_log_service_address")
+	}
+
+	var auditLogs []*acpb.AccessLog
+	for _, decision := range []string{auditDecisionAllow, auditDecisionDeny} {
+		filter := makeAuditLogFilter(decision)
+		if opts.AuditLog != "" {
+			auditLogs = append(auditLogs, makeFileAuditLog(opts.AuditLog, decision, filter))
+		}
+		if opts.AuditLogToAccessLogService {
+			auditLogs = append(auditLogs, makeGrpcAuditLog(decision, filter))
+		}
+	}
+	return auditLogs, nil
+}
+
+func makeFileAuditLog(path, decision string, filter *acpb.AccessLogFilter) *acpb.AccessLog {
+	jwtPayload := func(claim string) string {
+		return fmt.Sprintf("%%DYNAMIC_METADATA(%s:%s:%s)%%", util.JwtAuthn, util.JwtPayloadMetadataName, claim)
+	}
+	fields := map[string]string{
+		"timestamp":     "%START_TIME%",
+		"request_id":    "%REQ(X-REQUEST-ID)%",
+		"method":        "%REQ(:METHOD)%",
+		"path":          fmt.Sprintf("%%DYNAMIC_METADATA(%s:%s)%%", auditLogMetadataNamespace, auditLogPathKey),
+		"operation":     fmt.Sprintf("%%FILTER_STATE(%s)%%", util.FilterStateApiMethod),
+		"issuer":        jwtPayload("iss"),
+		"subject":       jwtPayload("sub"),
+		"api_key_hash":  fmt.Sprintf("%%FILTER_STATE(%s)%%", util.FilterStateApiKeyHash),
+		"decision":      decision,
+		"reason":        "%RESPONSE_CODE_DETAILS%",
+		"response_code": "%RESPONSE_CODE%",
+	}
+	jsonFormat := &structpb.Struct{
+		Fields: make(map[string]*structpb.Value),
+	}
+	for key, value := range fields {
+		jsonFormat.Fields[key] = &structpb.Value{
+			Kind: &structpb.Value_StringValue{StringValue: value},
+		}
+	}
+
+	fileAccessLog := &facpb.FileAccessLog{
+		Path: path,
+		AccessLogFormat: &facpb.FileAccessLog_LogFormat{
+			LogFormat: &corepb.SubstitutionFormatString{
+				Format: &corepb.SubstitutionFormatString_JsonFormat{
+					JsonFormat: jsonFormat,
+				},
+			},
+		},
+	}
+	serialized, _ := ptypes.MarshalAny(fileAccessLog)
+	return &acpb.AccessLog{
+		Name:   util.AccessFileLogger,
+		Filter: filter,
+		ConfigType: &acpb.AccessLog_TypedConfig{
+			TypedConfig: serialized,
+		},
+	}
+}
+
+// makeGrpcAuditLog streams the audit log entries of a decision under its own
+// log name. The JWT payloads are sent in the dynamic metadata of the entries.
+// Like in the other gRPC access logs, the request properties of the entries
+// have the path with its query.
+func makeGrpcAuditLog(decision string, filter *acpb.AccessLogFilter) *acpb.AccessLog {
+	logName := auditLogAllowName
+	if decision == auditDecisionDeny {
+		logName = auditLogDenyName
+	}
+	grpcAccessLog := &alspb.HttpGrpcAccessLogConfig{
+		CommonConfig: &alspb.CommonGrpcAccessLogConfig{
+			LogName: logName,
+			GrpcService: &corepb.GrpcService{
+				TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &corepb.GrpcService_EnvoyGrpc{
+						ClusterName: util.AccessLogServiceClusterName,
+					},
+				},
+			},
+			TransportApiVersion: corepb.ApiVersion_V3,
+			FilterStateObjectsToLog: []string{
+				util.FilterStateApiMethod,
+				util.FilterStateApiKeyHash,
+			},
+		},
+	}
+	serialized, _ := ptypes.MarshalAny(grpcAccessLog)
+	return &acpb.AccessLog{
+		Name:   util.HttpGrpcAccessLogger,
+		Filter: filter,
+		ConfigType: &acpb.AccessLog_TypedConfig{
+			TypedConfig: serialized,
+		},
+	}
+}
+
+// makeAuditLogPathFilter makes the filter writing the request path without its
+// query to the dynamic metadata of the audit log. It is the first filter, so
+// the path is the original one.
+func makeAuditLogPathFilter() (*hcmpb.HttpFilter, error) {
+	headerToMetadata := &htmpb.Config{
+		RequestRules: []*htmpb.Config_Rule{
+			{
+				Header: ":path",
+				OnHeaderPresent: &htmpb.Config_KeyValuePair{
+					MetadataNamespace: auditLogMetadataNamespace,
+					Key:               auditLogPathKey,
+					RegexValueRewrite: &matcher.RegexMatchAndSubstitute{
+						Pattern: &matcher.RegexMatcher{
+							EngineType: &matcher.RegexMatcher_GoogleRe2{
+								GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+							},
+							Regex: `\?.*`,
+						},
+					},
+				},
+			},
+		},
+	}
+	typedConfig, err := ptypes.MarshalAny(headerToMetadata)
+	if err != nil {
+		return nil, err
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.HeaderToMetadata,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{TypedConfig: typedConfig},
+	}, nil
+}
+
+// makeAuditLogFilter matches the requests of a decision by their response code
+// details: the auth and quota rejections of the proxy for DENY, the others for
+// ALLOW.
+func makeAuditLogFilter(decision string) *acpb.AccessLogFilter {
+	filterConfig := &rcdpb.FilterConfig{
+		Prefixes: auditDenyResponseCodeDetails,
+		Invert:   decision == auditDecisionAllow,
+	}
+	serialized, _ := ptypes.MarshalAny(filterConfig)
+	return &acpb.AccessLogFilter{
+		FilterSpecifier: &acpb.AccessLogFilter_ExtensionFilter{
+			ExtensionFilter: &acpb.ExtensionFilter{
+				Name: util.ResponseCodeDetailsAccessLogFilter,
+				ConfigType: &acpb.ExtensionFilter_TypedConfig{
+					TypedConfig: serialized,
+				},
+			},
+		},
+	}
+}
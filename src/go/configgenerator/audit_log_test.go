@@ -0,0 +1,196 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	rcdpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/access_log/response_code_details"
+
+	facpb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
+	alspb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	htmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/header_to_metadata/v3"
+)
+
+func TestMakeAuditLogs(t *testing.T) {
+	testData := []struct {
+		desc                       string
+		auditLog                   string
+		auditLogToAccessLogService bool
+		accessLogServiceAddress    string
+		// The audit logs, as "path|decision" for the files and the log names
+		// for the gRPC Access Log Service.
+		wantAuditLogs []string
+		wantError     string
+	}{
+		{
+			desc: "no audit log by default",
+		},
+		{
+			desc:          "audit log file",
+			auditLog:      "/var/log/audit.log",
+			wantAuditLogs: []string{"/var/log/audit.log|ALLOW", "/var/log/audit.log|DENY"},
+		},
+		{
+			desc:                       "audit log file and gRPC Access Log Service",
+			auditLog:                   "/dev/stdout",
+			auditLogToAccessLogService: true,
+			accessLogServiceAddress:    "grpc://als.example.com:443",
+			wantAuditLogs:              []string{"/dev/stdout|ALLOW", "espv2_audit_allow", "/dev/stdout|DENY", "espv2_audit_deny"},
+		},
+		{
+			desc:                       "gRPC Access Log Service without its address",
+			auditLogToAccessLogService: true,
+			wantError:                  "--audit_log_to_access_log_service requires --access_log_service_address",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.AuditLog = tc.auditLog
+			opts.AuditLogToAccessLogService = tc.auditLogToAccessLogService
+			opts.AccessLogServiceAddress = tc.accessLogServiceAddress
+
+			auditLogs, err := makeAuditLogs(&opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotAuditLogs []string
+			for _, auditLog := range auditLogs {
+				switch auditLog.GetName() {
+				case util.AccessFileLogger:
+					fileAccessLog := &facpb.FileAccessLog{}
+					if err := ptypes.UnmarshalAny(auditLog.GetTypedConfig(), fileAccessLog); err != nil {
+						t.Fatal(err)
+					}
+					fields := fileAccessLog.GetLogFormat().GetJsonFormat().GetFields()
+					if got := fields["api_key_hash"].GetStringValue(); got != "%FILTER_STATE(com.google.espv2.filters.http.service_control.api_key_hash)%" {
+						t.Errorf("got api_key_hash: %s", got)
+					}
+					if got := fields["path"].GetStringValue(); got != "%DYNAMIC_METADATA(com.google.espv2.audit_log:path)%" {
+						t.Errorf("got path: %s", got)
+					}
+					if got := fields["subject"].GetStringValue(); got != "%DYNAMIC_METADATA(envoy.filters.http.jwt_authn:jwt_payloads:sub)%" {
+						t.Errorf("got subject: %s", got)
+					}
+					gotAuditLogs = append(gotAuditLogs, fileAccessLog.GetPath()+"|"+fields["decision"].GetStringValue())
+				case util.HttpGrpcAccessLogger:
+					grpcAccessLog := &alspb.HttpGrpcAccessLogConfig{}
+					if err := ptypes.UnmarshalAny(auditLog.GetTypedConfig(), grpcAccessLog); err != nil {
+						t.Fatal(err)
+					}
+					gotAuditLogs = append(gotAuditLogs, grpcAccessLog.GetCommonConfig().GetLogName())
+				default:
+					t.Errorf("unexpected access log %s", auditLog.GetName())
+				}
+			}
+			if !reflect.DeepEqual(gotAuditLogs, tc.wantAuditLogs) {
+				t.Errorf("got audit logs: %v, want: %v", gotAuditLogs, tc.wantAuditLogs)
+			}
+		})
+	}
+}
+
+func TestMakeAuditLogFilter(t *testing.T) {
+	testData := []struct {
+		desc       string
+		decision   string
+		wantInvert bool
+	}{
+		{
+			desc:     "denied requests",
+			decision: auditDecisionDeny,
+		},
+		{
+			desc:       "allowed requests",
+			decision:   auditDecisionAllow,
+			wantInvert: true,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			extensionFilter := makeAuditLogFilter(tc.decision).GetExtensionFilter()
+			if extensionFilter.GetName() != util.ResponseCodeDetailsAccessLogFilter {
+				t.Fatalf("got access log filter: %s, want: %s", extensionFilter.GetName(), util.ResponseCodeDetailsAccessLogFilter)
+			}
+			filterConfig := &rcdpb.FilterConfig{}
+			if err := ptypes.UnmarshalAny(extensionFilter.GetTypedConfig(), filterConfig); err != nil {
+				t.Fatal(err)
+			}
+			if filterConfig.GetInvert() != tc.wantInvert {
+				t.Errorf("got invert: %v, want: %v", filterConfig.GetInvert(), tc.wantInvert)
+			}
+			for _, prefix := range []string{
+				"jwt_authn_access_denied",
+				"service_control_check_error",
+				"service_control_quota_error",
+				"local_rate_limited",
+			} {
+				found := false
+				for _, got := range filterConfig.GetPrefixes() {
+					found = found || got == prefix
+				}
+				if !found {
+					t.Errorf("missing response code details prefix %s in %v", prefix, filterConfig.GetPrefixes())
+				}
+			}
+		})
+	}
+}
+
+func TestMakeAuditLogPathFilter(t *testing.T) {
+	filter, err := makeAuditLogPathFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.GetName() != util.HeaderToMetadata {
+		t.Fatalf("got filter: %s, want: %s", filter.GetName(), util.HeaderToMetadata)
+	}
+	headerToMetadata := &htmpb.Config{}
+	if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), headerToMetadata); err != nil {
+		t.Fatal(err)
+	}
+	rules := headerToMetadata.GetRequestRules()
+	if len(rules) != 1 || rules[0].GetHeader() != ":path" {
+		t.Fatalf("got request rules: %v, want a single :path rule", rules)
+	}
+	kv := rules[0].GetOnHeaderPresent()
+	if kv.GetMetadataNamespace() != "com.google.espv2.audit_log" || kv.GetKey() != "path" {
+		t.Errorf("got metadata %s:%s", kv.GetMetadataNamespace(), kv.GetKey())
+	}
+
+	// The rewrite removes the query, e.g. ?key=<API key>.
+	rewrite := kv.GetRegexValueRewrite()
+	re := regexp.MustCompile(rewrite.GetPattern().GetRegex())
+	if got := re.ReplaceAllString("/v1/shelves?key=secret&access_token=jwt", rewrite.GetSubstitution()); got != "/v1/shelves" {
+		t.Errorf("got rewritten path: %s, want: /v1/shelves", got)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	bvpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/body_validation"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	ptypepb "google.golang.org/genproto/protobuf/ptype"
+)
+
+// bodyValidationKinds maps the kinds of the fields of the service config to
+// the kinds of the JSON values the body validation filter accepts.
+var bodyValidationKinds = map[ptypepb.Field_Kind]bvpb.Field_Kind{
+	ptypepb.Field_TYPE_STRING:   bvpb.Field_STRING,
+	ptypepb.Field_TYPE_BYTES:    bvpb.Field_STRING,
+	ptypepb.Field_TYPE_BOOL:     bvpb.Field_BOOL,
+	ptypepb.Field_TYPE_INT32:    bvpb.Field_INT32,
+	ptypepb.Field_TYPE_SINT32:   bvpb.Field_INT32,
+	ptypepb.Field_TYPE_SFIXED32: bvpb.Field_INT32,
+	ptypepb.Field_TYPE_UINT32:   bvpb.Field_UINT32,
+	ptypepb.Field_TYPE_FIXED32:  bvpb.Field_UINT32,
+	ptypepb.Field_TYPE_INT64:    bvpb.Field_INT64,
+	ptypepb.Field_TYPE_SINT64:   bvpb.Field_INT64,
+	ptypepb.Field_TYPE_SFIXED64: bvpb.Field_INT64,
+	ptypepb.Field_TYPE_UINT64:   bvpb.Field_UINT64,
+	ptypepb.Field_TYPE_FIXED64:  bvpb.Field_UINT64,
+	ptypepb.Field_TYPE_DOUBLE:   bvpb.Field_DOUBLE,
+	ptypepb.Field_TYPE_FLOAT:    bvpb.Field_DOUBLE,
+	ptypepb.Field_TYPE_ENUM:     bvpb.Field_ENUM,
+	ptypepb.Field_TYPE_MESSAGE:  bvpb.Field_MESSAGE,
+}
+
+// makeBodyValidationFilter validates the JSON request bodies of the http rules
+// with a RequestBodyValidation, ahead of the gRPC-JSON transcoder. Its config
+// has the message and enum types of the service config reachable from the
+// body types, without the well-known types, which have their own JSON
+// mapping and are left to the transcoder.
+func makeBodyValidationFilter(serviceInfo *configinfo.ServiceInfo) (*hcmpb.HttpFilter, error) {
+	var bodyTypes []string
+	for _, method := range serviceInfo.Methods {
+		for _, validation := range method.RequestBodyValidations {
+			bodyTypes = append(bodyTypes, validation.BodyType)
+		}
+	}
+	if len(bodyTypes) == 0 {
+		return nil, nil
+	}
+	// The methods are in a map, keep the config stable.
+	sort.Strings(bodyTypes)
+
+	types := make(map[string]*ptypepb.Type)
+	for _, t := range serviceInfo.ServiceConfig().GetTypes() {
+		types[t.GetName()] = t
+	}
+	enums := make(map[string]*ptypepb.Enum)
+	for _, e := range serviceInfo.ServiceConfig().GetEnums() {
+		enums[e.GetName()] = e
+	}
+
+	config := &bvpb.FilterConfig{
+		MessageTypes: make(map[string]*bvpb.MessageType),
+		EnumTypes:    make(map[string]*bvpb.EnumType),
+	}
+	for len(bodyTypes) > 0 {
+		typeName := bodyTypes[0]
+		bodyTypes = bodyTypes[1:]
+		t, ok := types[typeName]
+		if _, added := config.MessageTypes[typeName]; added || !ok || strings.HasPrefix(typeName, util.WellKnownTypePrefix) {
+			continue
+		}
+
+		messageType := &bvpb.MessageType{}
+		for _, field := range t.GetFields() {
+			bvField := makeBodyValidationField(field)
+			if valueField := mapEntryValueField(field, types); valueField != nil {
+				// The map fields are repeated map entries, whose values are
+				// validated.
+				bvField = makeBodyValidationField(valueField)
+				bvField.Name = field.GetName()
+				bvField.JsonName = field.GetJsonName()
+				bvField.Cardinality = bvpb.Field_MAP
+			}
+
+			switch bvField.Kind {
+			case bvpb.Field_MESSAGE:
+				bodyTypes = append(bodyTypes, bvField.TypeName)
+			case bvpb.Field_ENUM:
+				if e, ok := enums[bvField.TypeName]; ok {
+					enumType := &bvpb.EnumType{}
+					for _, value := range e.GetEnumvalue() {
+						enumType.Values = append(enumType.Values, value.GetName())
+					}
+					config.EnumTypes[bvField.TypeName] = enumType
+				}
+			}
+			messageType.Fields = append(messageType.Fields, bvField)
+		}
+		config.MessageTypes[typeName] = messageType
+	}
+
+	configAny, err := ptypes.MarshalAny(config)
+	if err != nil {
+		return nil, err
+	}
+	return &hcmpb.HttpFilter{
+		Name: util.BodyValidation,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{
+			TypedConfig: configAny,
+		},
+	}, nil
+}
+
+// makeBodyValidationField makes the body validation field of a field of the
+// service config. The fields of an unsupported kind, e.g. the groups, accept
+// any JSON value.
+func makeBodyValidationField(field *ptypepb.Field) *bvpb.Field {
+	bvField := &bvpb.Field{
+		Name:     field.GetName(),
+		JsonName: field.GetJsonName(),
+		Kind:     bodyValidationKinds[field.GetKind()],
+	}
+	if bvField.Kind == bvpb.Field_MESSAGE || bvField.Kind == bvpb.Field_ENUM {
+		bvField.TypeName = strings.TrimPrefix(field.GetTypeUrl(), util.TypeUrlPrefix)
+	}
+	switch field.GetCardinality() {
+	case ptypepb.Field_CARDINALITY_REQUIRED:
+		bvField.Cardinality = bvpb.Field_REQUIRED
+	case ptypepb.Field_CARDINALITY_REPEATED:
+		bvField.Cardinality = bvpb.Field_REPEATED
+	}
+	return bvField
+}
+
+// mapEntryValueField returns the value field of the map entry type of a map
+// field, or nil if the field is not a map. The service config has the map
+// entries as repeated messages, with the map_entry option or, without the
+// options, named "<Field>Entry" with a key and a value field.
+func mapEntryValueField(field *ptypepb.Field, types map[string]*ptypepb.Type) *ptypepb.Field {
+	if field.GetKind() != ptypepb.Field_TYPE_MESSAGE || field.GetCardinality() != ptypepb.Field_CARDINALITY_REPEATED {
+		return nil
+	}
+	entryType, ok := types[strings.TrimPrefix(field.GetTypeUrl(), util.TypeUrlPrefix)]
+	if !ok || len(entryType.GetFields()) != 2 {
+		return nil
+	}
+	isMapEntry := strings.HasSuffix(entryType.GetName(), "Entry")
+	for _, option := range entryType.GetOptions() {
+		isMapEntry = isMapEntry || option.GetName() == "map_entry"
+	}
+	key, value := entryType.GetFields()[0], entryType.GetFields()[1]
+	if !isMapEntry || key.GetName() != "key" || value.GetName() != "value" {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,337 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	bvpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/body_validation"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+	ptypepb "google.golang.org/genproto/protobuf/ptype"
+)
+
+func TestMakeBodyValidationFilter(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name:           "CreateBook",
+						RequestTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.CreateBookRequest",
+					},
+					{
+						Name:           "GetBook",
+						RequestTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.GetBookRequest",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.CreateBook",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/v1/shelves/{shelf}/books",
+				},
+				Body: "book",
+				AdditionalBindings: []*annotationspb.HttpRule{
+					{
+						Pattern: &annotationspb.HttpRule_Put{
+							Put: "/v1/shelves/{shelf}/books/{book.id}",
+						},
+						Body: "*",
+					},
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.GetBook",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/v1/shelves/{shelf}/books/{book}",
+				},
+			},
+		}},
+		Types: []*ptypepb.Type{
+			{
+				Name: "endpoints.examples.bookstore.CreateBookRequest",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "shelf",
+						JsonName: "shelf",
+						Kind:     ptypepb.Field_TYPE_INT64,
+					},
+					{
+						Name:     "book",
+						JsonName: "book",
+						Kind:     ptypepb.Field_TYPE_MESSAGE,
+						TypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.Book",
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.Book",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "id",
+						JsonName: "id",
+						Kind:     ptypepb.Field_TYPE_FIXED64,
+					},
+					{
+						Name:        "title",
+						JsonName:    "title",
+						Kind:        ptypepb.Field_TYPE_STRING,
+						Cardinality: ptypepb.Field_CARDINALITY_REQUIRED,
+					},
+					{
+						Name:     "page_count",
+						JsonName: "pageCount",
+						Kind:     ptypepb.Field_TYPE_SINT32,
+					},
+					{
+						Name:     "genre",
+						JsonName: "genre",
+						Kind:     ptypepb.Field_TYPE_ENUM,
+						TypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.Genre",
+					},
+					{
+						Name:        "authors",
+						JsonName:    "authors",
+						Kind:        ptypepb.Field_TYPE_STRING,
+						Cardinality: ptypepb.Field_CARDINALITY_REPEATED,
+					},
+					{
+						Name:        "labels",
+						JsonName:    "labels",
+						Kind:        ptypepb.Field_TYPE_MESSAGE,
+						Cardinality: ptypepb.Field_CARDINALITY_REPEATED,
+						TypeUrl:     "type.googleapis.com/endpoints.examples.bookstore.Book.LabelsEntry",
+					},
+					{
+						Name:     "published",
+						JsonName: "published",
+						Kind:     ptypepb.Field_TYPE_MESSAGE,
+						TypeUrl:  "type.googleapis.com/google.protobuf.Timestamp",
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.Book.LabelsEntry",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "key",
+						JsonName: "key",
+						Kind:     ptypepb.Field_TYPE_STRING,
+					},
+					{
+						Name:     "value",
+						JsonName: "value",
+						Kind:     ptypepb.Field_TYPE_BOOL,
+					},
+				},
+				Options: []*ptypepb.Option{
+					{
+						Name: "map_entry",
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.GetBookRequest",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "shelf",
+						JsonName: "shelf",
+						Kind:     ptypepb.Field_TYPE_INT64,
+					},
+					{
+						Name:     "book",
+						JsonName: "book",
+						Kind:     ptypepb.Field_TYPE_INT64,
+					},
+				},
+			},
+		},
+		Enums: []*ptypepb.Enum{
+			{
+				Name: "endpoints.examples.bookstore.Genre",
+				Enumvalue: []*ptypepb.EnumValue{
+					{
+						Name: "GENRE_UNSPECIFIED",
+					},
+					{
+						Name:   "FICTION",
+						Number: 1,
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                string
+		validateBody        bool
+		rejectUnknownFields bool
+		wantFilterConfig    string
+		// The routes with a body validation per-route config, as
+		// "method body_type bound_fields".
+		wantRoutes []string
+	}{
+		{
+			desc: "no body validation filter by default",
+		},
+		{
+			desc:         "body validation of the message types reachable from the bodies",
+			validateBody: true,
+			wantFilterConfig: `{
+				"messageTypes": {
+					"endpoints.examples.bookstore.CreateBookRequest": {
+						"fields": [
+							{"name": "shelf", "jsonName": "shelf", "kind": "INT64"},
+							{"name": "book", "jsonName": "book", "kind": "MESSAGE", "typeName": "endpoints.examples.bookstore.Book"}
+						]
+					},
+					"endpoints.examples.bookstore.Book": {
+						"fields": [
+							{"name": "id", "jsonName": "id", "kind": "UINT64"},
+							{"name": "title", "jsonName": "title", "kind": "STRING", "cardinality": "REQUIRED"},
+							{"name": "page_count", "jsonName": "pageCount", "kind": "INT32"},
+							{"name": "genre", "jsonName": "genre", "kind": "ENUM", "typeName": "endpoints.examples.bookstore.Genre"},
+							{"name": "authors", "jsonName": "authors", "kind": "STRING", "cardinality": "REPEATED"},
+							{"name": "labels", "jsonName": "labels", "kind": "BOOL", "cardinality": "MAP"},
+							{"name": "published", "jsonName": "published", "kind": "MESSAGE", "typeName": "google.protobuf.Timestamp"}
+						]
+					}
+				},
+				"enumTypes": {
+					"endpoints.examples.bookstore.Genre": {
+						"values": ["GENRE_UNSPECIFIED", "FICTION"]
+					}
+				}
+			}`,
+			wantRoutes: []string{
+				"POST endpoints.examples.bookstore.Book ",
+				"PUT endpoints.examples.bookstore.CreateBookRequest shelf,book.id",
+			},
+		},
+		{
+			desc:                "unknown fields rejected without validating the fields",
+			rejectUnknownFields: true,
+			wantFilterConfig: `{
+				"messageTypes": {
+					"endpoints.examples.bookstore.CreateBookRequest": {
+						"fields": [
+							{"name": "shelf", "jsonName": "shelf", "kind": "INT64"},
+							{"name": "book", "jsonName": "book", "kind": "MESSAGE", "typeName": "endpoints.examples.bookstore.Book"}
+						]
+					},
+					"endpoints.examples.bookstore.Book": {
+						"fields": [
+							{"name": "id", "jsonName": "id", "kind": "UINT64"},
+							{"name": "title", "jsonName": "title", "kind": "STRING", "cardinality": "REQUIRED"},
+							{"name": "page_count", "jsonName": "pageCount", "kind": "INT32"},
+							{"name": "genre", "jsonName": "genre", "kind": "ENUM", "typeName": "endpoints.examples.bookstore.Genre"},
+							{"name": "authors", "jsonName": "authors", "kind": "STRING", "cardinality": "REPEATED"},
+							{"name": "labels", "jsonName": "labels", "kind": "BOOL", "cardinality": "MAP"},
+							{"name": "published", "jsonName": "published", "kind": "MESSAGE", "typeName": "google.protobuf.Timestamp"}
+						]
+					}
+				},
+				"enumTypes": {
+					"endpoints.examples.bookstore.Genre": {
+						"values": ["GENRE_UNSPECIFIED", "FICTION"]
+					}
+				}
+			}`,
+			wantRoutes: []string{
+				"POST endpoints.examples.bookstore.Book ",
+				"PUT endpoints.examples.bookstore.CreateBookRequest shelf,book.id",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:8082"
+			opts.TranscodingValidateRequestBody = tc.validateBody
+			opts.TranscodingRejectUnknownBodyFields = tc.rejectUnknownFields
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filter, err := makeBodyValidationFilter(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantFilterConfig == "" {
+				if filter != nil {
+					t.Fatalf("got body validation filter: %v, want none", filter)
+				}
+			} else {
+				if filter.GetName() != util.BodyValidation {
+					t.Errorf("got filter name: %s, want: %s", filter.GetName(), util.BodyValidation)
+				}
+				gotFilterConfig := &bvpb.FilterConfig{}
+				if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), gotFilterConfig); err != nil {
+					t.Fatal(err)
+				}
+				wantFilterConfig := &bvpb.FilterConfig{}
+				if err := jsonpb.UnmarshalString(tc.wantFilterConfig, wantFilterConfig); err != nil {
+					t.Fatal(err)
+				}
+				if !proto.Equal(gotFilterConfig, wantFilterConfig) {
+					t.Errorf("got body validation config: %v, want: %v", gotFilterConfig, wantFilterConfig)
+				}
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotRoutes []string
+			for _, route := range routes {
+				perRouteAny, ok := route.GetTypedPerFilterConfig()[util.BodyValidation]
+				if !ok {
+					continue
+				}
+				perRoute := &bvpb.PerRouteFilterConfig{}
+				if err := ptypes.UnmarshalAny(perRouteAny, perRoute); err != nil {
+					t.Fatal(err)
+				}
+				if perRoute.GetValidateFields() != tc.validateBody || perRoute.GetRejectUnknownFields() != tc.rejectUnknownFields {
+					t.Errorf("got per-route config: %v, want validate_fields: %v, reject_unknown_fields: %v", perRoute, tc.validateBody, tc.rejectUnknownFields)
+				}
+				for _, header := range route.GetMatch().GetHeaders() {
+					if header.GetName() == ":method" {
+						gotRoutes = append(gotRoutes, header.GetExactMatch()+" "+perRoute.GetBodyType()+" "+strings.Join(perRoute.GetBoundFields(), ","))
+					}
+				}
+			}
+			if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+				t.Errorf("got body validation routes: %v, want: %v", gotRoutes, tc.wantRoutes)
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ package configgenerator
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
@@ -26,6 +27,18 @@ import (
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// The active health check of the local backend with
+// --healthz_mode=backend_aware.
+const (
+	backendHealthCheckTimeout            = 1 * time.Second
+	backendHealthCheckInterval           = 5 * time.Second
+	backendHealthCheckUnhealthyThreshold = 2
+	// The local backend is a single logical DNS host, the healthz path fails
+	// while it is unhealthy.
+	minHealthyBackendPercentage = 100
 )
 
 // MakeClusters provides dynamic cluster settings for Envoy
@@ -40,12 +53,20 @@ func MakeClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster, error) {
 		clusters = append(clusters, backendCluster)
 	}
 
-	if serviceInfo.Options.NonGCP {
+	if serviceInfo.UploadBackendCluster != nil {
+		uploadCluster, err := makeBackendCluster(&serviceInfo.Options, serviceInfo.UploadBackendCluster)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, uploadCluster)
+	}
+
+	if serviceInfo.Options.NonGCP || !util.IsGCPMetadataProvider(serviceInfo.Options.MetadataProvider) {
 		// Non-GCP will never use IMDS, only local token agent.
 		tokenAgentCluster := makeTokenAgentCluster(serviceInfo)
 		clusters = append(clusters, tokenAgentCluster)
 	} else {
-		if serviceInfo.Options.ServiceAccountKey != "" {
+		if serviceInfo.Options.UsesTokenAgent() {
 			tokenAgentCluster := makeTokenAgentCluster(serviceInfo)
 			clusters = append(clusters, tokenAgentCluster)
 		}
@@ -87,6 +108,38 @@ func MakeClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster, error) {
 		clusters = append(clusters, brClusters...)
 	}
 
+	adminCluster, err := makeAdminCluster(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	if adminCluster != nil {
+		clusters = append(clusters, adminCluster)
+	}
+
+	zipkinCluster, err := makeZipkinCollectorCluster(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	if zipkinCluster != nil {
+		clusters = append(clusters, zipkinCluster)
+	}
+
+	alsCluster, err := makeAccessLogServiceCluster(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	if alsCluster != nil {
+		clusters = append(clusters, alsCluster)
+	}
+
+	rlsCluster, err := makeRateLimitServiceCluster(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	if rlsCluster != nil {
+		clusters = append(clusters, rlsCluster)
+	}
+
 	providerClusters, err := makeJwtProviderClusters(serviceInfo)
 	if err != nil {
 		return nil, err
@@ -96,13 +149,32 @@ func MakeClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster, error) {
 		clusters = append(clusters, providerClusters...)
 	}
 
+	// The additional services share the clusters of the same names.
+	for _, additionalService := range serviceInfo.AdditionalServices {
+		additionalClusters, err := MakeClusters(additionalService)
+		if err != nil {
+			return nil, fmt.Errorf("fail to make the clusters of service %s: %v", additionalService.Name, err)
+		}
+		clusters = appendClusters(clusters, additionalClusters)
+	}
+
 	if serviceInfo.Options.DnsResolverAddresses != "" {
 		if err = addDnsResolversToClusters(serviceInfo.Options.DnsResolverAddresses, clusters); err != nil {
 			return nil, fmt.Errorf("fail to add dns resovlers to clusters : %v", err)
 		}
 	}
 
-	glog.Infof("generate clusters: %v", clusters)
+	if serviceInfo.Options.DeterministicOutput {
+		// The order of the clusters doesn't matter to Envoy.
+		sort.SliceStable(clusters, func(i, j int) bool {
+			return clusters[i].GetName() < clusters[j].GetName()
+		})
+	}
+
+	glog.Infof("generate %d clusters", len(clusters))
+	if glog.V(1) {
+		glog.Infof("generate clusters: %v", clusters)
+	}
 	return clusters, nil
 }
 
@@ -125,7 +197,7 @@ func makeMetadataCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error
 		return nil, err
 	}
 
-	connectTimeoutProto := ptypes.DurationProto(serviceInfo.Options.ClusterConnectTimeout)
+	connectTimeoutProto := ptypes.DurationProto(calloutConnectTimeout(serviceInfo, sc.ImdsCallout, serviceInfo.Options.ClusterConnectTimeout))
 	c := &clusterpb.Cluster{
 		Name:           util.MetadataServerClusterName,
 		LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
@@ -148,6 +220,15 @@ func makeMetadataCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error
 	return c, nil
 }
 
+// calloutConnectTimeout caps the connect timeout of the cluster of a callout by
+// the timeout of its callout policy, if any.
+func calloutConnectTimeout(serviceInfo *sc.ServiceInfo, callout string, connectTimeout time.Duration) time.Duration {
+	if policy := serviceInfo.CalloutPolicies[callout]; policy != nil && policy.Timeout > 0 && policy.Timeout < connectTimeout {
+		return policy.Timeout
+	}
+	return connectTimeout
+}
+
 func makeTokenAgentCluster(serviceInfo *sc.ServiceInfo) *clusterpb.Cluster {
 	return &clusterpb.Cluster{
 		Name:           util.TokenAgentClusterName,
@@ -169,7 +250,7 @@ func makeIamCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
 		return nil, err
 	}
 
-	connectTimeoutProto := ptypes.DurationProto(serviceInfo.Options.ClusterConnectTimeout)
+	connectTimeoutProto := ptypes.DurationProto(calloutConnectTimeout(serviceInfo, sc.IamCallout, serviceInfo.Options.ClusterConnectTimeout))
 	c := &clusterpb.Cluster{
 		Name:            util.IamServerClusterName,
 		LbPolicy:        clusterpb.Cluster_ROUND_ROBIN,
@@ -199,6 +280,9 @@ func makeJwtProviderClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster,
 	generatedClusters := map[string]bool{}
 
 	for _, provider := range authn.GetProviders() {
+		if serviceInfo.DeferredOpenIDProviders[provider.GetId()] {
+			continue
+		}
 		jwksUri := provider.GetJwksUri()
 		addr, err := util.ExtraAddressFromURI(jwksUri)
 		if err != nil {
@@ -217,7 +301,7 @@ func makeJwtProviderClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster,
 			return nil, fmt.Errorf("Fail to parse jwksUri %s with error %v", jwksUri, err)
 		}
 
-		connectTimeoutProto := ptypes.DurationProto(serviceInfo.Options.ClusterConnectTimeout)
+		connectTimeoutProto := ptypes.DurationProto(calloutConnectTimeout(serviceInfo, sc.JwksCallout, serviceInfo.Options.ClusterConnectTimeout))
 
 		c := &clusterpb.Cluster{
 			Name:           clusterName,
@@ -289,9 +373,60 @@ func makeLocalBackendCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, e
 		return nil, err
 	}
 
+	backendAware, err := isBackendAwareHealthz(serviceInfo.Options)
+	if err != nil {
+		return nil, err
+	}
+	if serviceInfo.Options.HealthzGrpcService != "" && (!backendAware || serviceInfo.LocalBackendCluster.Protocol != util.GRPC) {
+		return nil, fmt.Errorf("--healthz_grpc_service requires --healthz_mode=%s with a grpc:// or grpcs:// --backend_address", util.BackendAwareHealthzMode)
+	}
+	if backendAware {
+		c.HealthChecks = []*corepb.HealthCheck{makeBackendHealthCheck(serviceInfo.LocalBackendCluster, serviceInfo.Options.HealthzGrpcService)}
+	}
 	return c, nil
 }
 
+// isBackendAwareHealthz returns whether the healthz path reflects the health
+// of the local backend.
+func isBackendAwareHealthz(opts options.ConfigGeneratorOptions) (bool, error) {
+	switch opts.HealthzMode {
+	case "", util.ProxyOnlyHealthzMode:
+		return false, nil
+	case util.BackendAwareHealthzMode:
+		if opts.Healthz == "" {
+			return false, fmt.Errorf("--healthz_mode=%s requires a --healthz path", util.BackendAwareHealthzMode)
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid --healthz_mode %q, only %s or %s are valid", opts.HealthzMode, util.ProxyOnlyHealthzMode, util.BackendAwareHealthzMode)
+	}
+}
+
+// makeBackendHealthCheck makes the active health check of the local backend:
+// the gRPC health checking protocol for gRPC backends, checking the status of
+// grpcService, connecting for the others, which may not serve any health
+// check path.
+func makeBackendHealthCheck(brc *sc.BackendRoutingCluster, grpcService string) *corepb.HealthCheck {
+	hc := &corepb.HealthCheck{
+		Timeout:            ptypes.DurationProto(backendHealthCheckTimeout),
+		Interval:           ptypes.DurationProto(backendHealthCheckInterval),
+		UnhealthyThreshold: &wrapperspb.UInt32Value{Value: backendHealthCheckUnhealthyThreshold},
+		HealthyThreshold:   &wrapperspb.UInt32Value{Value: 1},
+	}
+	if brc.Protocol == util.GRPC {
+		hc.HealthChecker = &corepb.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &corepb.HealthCheck_GrpcHealthCheck{
+				ServiceName: grpcService,
+			},
+		}
+	} else {
+		hc.HealthChecker = &corepb.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &corepb.HealthCheck_TcpHealthCheck{},
+		}
+	}
+	return hc
+}
+
 func makeServiceControlCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
 	uri := serviceInfo.ServiceConfig().GetControl().GetEnvironment()
 	if uri == "" {
@@ -311,7 +446,7 @@ func makeServiceControlCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster,
 		return nil, fmt.Errorf("Invalid uri: service control should not have path part: %s, %s", uri, path)
 	}
 
-	connectTimeoutProto := ptypes.DurationProto(5 * time.Second)
+	connectTimeoutProto := ptypes.DurationProto(calloutConnectTimeout(serviceInfo, sc.ServiceControlCallout, 5*time.Second))
 	serviceInfo.ServiceControlURI = scheme + "://" + hostname + "/v1/services"
 	c := &clusterpb.Cluster{
 		Name:                 util.ServiceControlClusterName,
@@ -334,6 +469,122 @@ func makeServiceControlCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster,
 	return c, nil
 }
 
+// makeAdminCluster provides the cluster of the Envoy admin interface, which
+// serves the stats of the metrics listener.
+func makeAdminCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
+	if serviceInfo.Options.PrometheusMetricsPort == 0 {
+		return nil, nil
+	}
+	if serviceInfo.Options.AdminPort == 0 {
+		return nil, fmt.Errorf("--prometheus_metrics_port requires the admin interface, --admin_port cannot be 0")
+	}
+
+	// The admin interface is always reachable on loopback.
+	address := serviceInfo.Options.AdminAddress
+	switch address {
+	case "", "0.0.0.0":
+		address = "127.0.0.1"
+	case "::":
+		address = "::1"
+	}
+
+	return &clusterpb.Cluster{
+		Name:                 util.AdminClusterName,
+		LbPolicy:             clusterpb.Cluster_ROUND_ROBIN,
+		ConnectTimeout:       ptypes.DurationProto(serviceInfo.Options.ClusterConnectTimeout),
+		ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STATIC},
+		LoadAssignment:       util.CreateLoadAssignment(address, uint32(serviceInfo.Options.AdminPort)),
+	}, nil
+}
+
+func makeZipkinCollectorCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
+	if serviceInfo.Options.DisableTracing || serviceInfo.Options.TracingProvider != "zipkin" {
+		return nil, nil
+	}
+
+	address := serviceInfo.Options.TracingZipkinCollectorAddress
+	if address == "" {
+		return nil, fmt.Errorf("tracing_zipkin_collector_address is required when tracing_provider is zipkin")
+	}
+	scheme, hostname, port, _, err := util.ParseURI(address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &clusterpb.Cluster{
+		Name:                 util.ZipkinCollectorClusterName,
+		LbPolicy:             clusterpb.Cluster_ROUND_ROBIN,
+		ConnectTimeout:       ptypes.DurationProto(serviceInfo.Options.ClusterConnectTimeout),
+		DnsLookupFamily:      clusterpb.Cluster_V4_ONLY,
+		ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STRICT_DNS},
+		LoadAssignment:       util.CreateLoadAssignment(hostname, port),
+	}
+
+	if scheme == "https" {
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", nil, "")
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
+				c.Name, err)
+		}
+		c.TransportSocket = transportSocket
+	}
+
+	return c, nil
+}
+
+func makeAccessLogServiceCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
+	address := serviceInfo.Options.AccessLogServiceAddress
+	if address == "" {
+		return nil, nil
+	}
+	return makeGrpcServiceCluster(serviceInfo, util.AccessLogServiceClusterName, "access_log_service_address", address)
+}
+
+func makeRateLimitServiceCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
+	address := serviceInfo.Options.RateLimitServiceAddress
+	if address == "" {
+		return nil, nil
+	}
+	return makeGrpcServiceCluster(serviceInfo, util.RateLimitServiceClusterName, "rate_limit_service_address", address)
+}
+
+// makeGrpcServiceCluster makes the cluster of a gRPC service called by Envoy,
+// at the address of the flag.
+func makeGrpcServiceCluster(serviceInfo *sc.ServiceInfo, name, flagName, address string) (*clusterpb.Cluster, error) {
+	scheme, hostname, port, _, err := util.ParseURI(address)
+	if err != nil {
+		return nil, err
+	}
+	protocol, tls, err := util.ParseBackendProtocol(scheme, "")
+	if err != nil {
+		return nil, err
+	}
+	if protocol != util.GRPC {
+		return nil, fmt.Errorf("invalid --%s %s, must use the grpc or grpcs scheme", flagName, address)
+	}
+
+	c := &clusterpb.Cluster{
+		Name:                 name,
+		LbPolicy:             clusterpb.Cluster_ROUND_ROBIN,
+		ConnectTimeout:       ptypes.DurationProto(serviceInfo.Options.ClusterConnectTimeout),
+		DnsLookupFamily:      clusterpb.Cluster_V4_ONLY,
+		ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STRICT_DNS},
+		LoadAssignment:       util.CreateLoadAssignment(hostname, port),
+		Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+	}
+
+	if tls {
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", []string{"h2"}, "")
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
+				c.Name, err)
+		}
+		c.TransportSocket = transportSocket
+	}
+
+	return c, nil
+}
+
 func makeRemoteBackendClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster, error) {
 	var brClusters []*clusterpb.Cluster
 
@@ -28,6 +28,7 @@ import (
 
 	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	apipb "google.golang.org/genproto/protobuf/api"
@@ -784,6 +785,278 @@ func TestMakeIamCluster(t *testing.T) {
 	}
 }
 
+func TestMakeZipkinCollectorCluster(t *testing.T) {
+	testData := []struct {
+		desc             string
+		tracingProvider  string
+		collectorAddress string
+		wantedCluster    *clusterpb.Cluster
+	}{
+		{
+			desc:             "Success, generate zipkin collector cluster",
+			tracingProvider:  "zipkin",
+			collectorAddress: "http://zipkin:9411/api/v2/spans",
+			wantedCluster: &clusterpb.Cluster{
+				Name:                 "zipkin-collector-cluster",
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STRICT_DNS},
+				DnsLookupFamily:      clusterpb.Cluster_V4_ONLY,
+				LoadAssignment:       util.CreateLoadAssignment("zipkin", 9411),
+			},
+		},
+		{
+			desc:             "Success, generate zipkin collector cluster with TLS",
+			tracingProvider:  "zipkin",
+			collectorAddress: "https://jaeger.example.com/api/v2/spans",
+			wantedCluster: &clusterpb.Cluster{
+				Name:                 "zipkin-collector-cluster",
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STRICT_DNS},
+				DnsLookupFamily:      clusterpb.Cluster_V4_ONLY,
+				LoadAssignment:       util.CreateLoadAssignment("jaeger.example.com", 443),
+				TransportSocket:      createTransportSocket("jaeger.example.com"),
+			},
+		},
+		{
+			desc:            "Success, not generate zipkin collector cluster for stackdriver",
+			tracingProvider: "stackdriver",
+			wantedCluster:   nil,
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.1:80"
+		opts.TracingProvider = tc.tracingProvider
+		opts.TracingZipkinCollectorAddress = tc.collectorAddress
+
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cluster, err := makeZipkinCollectorCluster(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !proto.Equal(cluster, tc.wantedCluster) {
+			t.Errorf("Test Desc(%d): %s, makeZipkinCollectorCluster\ngot: %v,\nwant: %v", i, tc.desc, cluster, tc.wantedCluster)
+		}
+	}
+}
+
+func TestMakeAccessLogServiceCluster(t *testing.T) {
+	testData := []struct {
+		desc                    string
+		accessLogServiceAddress string
+		wantedCluster           *clusterpb.Cluster
+		wantedError             string
+	}{
+		{
+			desc:                    "Success, generate access log service cluster with TLS",
+			accessLogServiceAddress: "grpcs://als.example.com",
+			wantedCluster: &clusterpb.Cluster{
+				Name:                 "access-log-service-cluster",
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STRICT_DNS},
+				DnsLookupFamily:      clusterpb.Cluster_V4_ONLY,
+				LoadAssignment:       util.CreateLoadAssignment("als.example.com", 443),
+				Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+				TransportSocket:      createH2TransportSocket("als.example.com"),
+			},
+		},
+		{
+			desc:                    "Success, generate access log service cluster without TLS",
+			accessLogServiceAddress: "grpc://127.0.0.1:9001",
+			wantedCluster: &clusterpb.Cluster{
+				Name:                 "access-log-service-cluster",
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STRICT_DNS},
+				DnsLookupFamily:      clusterpb.Cluster_V4_ONLY,
+				LoadAssignment:       util.CreateLoadAssignment("127.0.0.1", 9001),
+				Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+			},
+		},
+		{
+			desc:          "Success, not generate access log service cluster without the address",
+			wantedCluster: nil,
+		},
+		{
+			desc:                    "Failure, the address is not gRPC",
+			accessLogServiceAddress: "https://als.example.com",
+			wantedError:             "must use the grpc or grpcs scheme",
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.1:80"
+		opts.AccessLogServiceAddress = tc.accessLogServiceAddress
+
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cluster, err := makeAccessLogServiceCluster(fakeServiceInfo)
+		if tc.wantedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantedError) {
+				t.Errorf("Test Desc(%d): %s, makeAccessLogServiceCluster got err: %v, want: %v", i, tc.desc, err, tc.wantedError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !proto.Equal(cluster, tc.wantedCluster) {
+			t.Errorf("Test Desc(%d): %s, makeAccessLogServiceCluster\ngot: %v,\nwant: %v", i, tc.desc, cluster, tc.wantedCluster)
+		}
+	}
+}
+
+func TestMakeLocalBackendClusterForHealthzMode(t *testing.T) {
+	testData := []struct {
+		desc               string
+		backendAddress     string
+		healthz            string
+		healthzMode        string
+		healthzGrpcService string
+		wantHealthCheck    *corepb.HealthCheck
+		wantError          string
+	}{
+		{
+			desc:           "proxy only health check",
+			backendAddress: "grpc://127.0.0.1:80",
+			healthz:        "healthz",
+			healthzMode:    "proxy_only",
+		},
+		{
+			desc:           "gRPC backend health checked with the gRPC health checking protocol",
+			backendAddress: "grpc://127.0.0.1:80",
+			healthz:        "healthz",
+			healthzMode:    "backend_aware",
+			wantHealthCheck: &corepb.HealthCheck{
+				Timeout:            ptypes.DurationProto(time.Second),
+				Interval:           ptypes.DurationProto(5 * time.Second),
+				UnhealthyThreshold: &wrapperspb.UInt32Value{Value: 2},
+				HealthyThreshold:   &wrapperspb.UInt32Value{Value: 1},
+				HealthChecker: &corepb.HealthCheck_GrpcHealthCheck_{
+					GrpcHealthCheck: &corepb.HealthCheck_GrpcHealthCheck{},
+				},
+			},
+		},
+		{
+			desc:           "http backend health checked by connecting",
+			backendAddress: "http://127.0.0.1:80",
+			healthz:        "healthz",
+			healthzMode:    "backend_aware",
+			wantHealthCheck: &corepb.HealthCheck{
+				Timeout:            ptypes.DurationProto(time.Second),
+				Interval:           ptypes.DurationProto(5 * time.Second),
+				UnhealthyThreshold: &wrapperspb.UInt32Value{Value: 2},
+				HealthyThreshold:   &wrapperspb.UInt32Value{Value: 1},
+				HealthChecker: &corepb.HealthCheck_TcpHealthCheck_{
+					TcpHealthCheck: &corepb.HealthCheck_TcpHealthCheck{},
+				},
+			},
+		},
+		{
+			desc:               "gRPC backend health checked for a service",
+			backendAddress:     "grpc://127.0.0.1:80",
+			healthz:            "healthz",
+			healthzMode:        "backend_aware",
+			healthzGrpcService: "endpoints.examples.bookstore.Bookstore",
+			wantHealthCheck: &corepb.HealthCheck{
+				Timeout:            ptypes.DurationProto(time.Second),
+				Interval:           ptypes.DurationProto(5 * time.Second),
+				UnhealthyThreshold: &wrapperspb.UInt32Value{Value: 2},
+				HealthyThreshold:   &wrapperspb.UInt32Value{Value: 1},
+				HealthChecker: &corepb.HealthCheck_GrpcHealthCheck_{
+					GrpcHealthCheck: &corepb.HealthCheck_GrpcHealthCheck{
+						ServiceName: "endpoints.examples.bookstore.Bookstore",
+					},
+				},
+			},
+		},
+		{
+			desc:               "health checked service with an http backend",
+			backendAddress:     "http://127.0.0.1:80",
+			healthz:            "healthz",
+			healthzMode:        "backend_aware",
+			healthzGrpcService: "endpoints.examples.bookstore.Bookstore",
+			wantError:          "--healthz_grpc_service requires --healthz_mode=backend_aware with a grpc:// or grpcs:// --backend_address",
+		},
+		{
+			desc:               "health checked service without backend aware health check",
+			backendAddress:     "grpc://127.0.0.1:80",
+			healthz:            "healthz",
+			healthzGrpcService: "endpoints.examples.bookstore.Bookstore",
+			wantError:          "--healthz_grpc_service requires --healthz_mode=backend_aware with a grpc:// or grpcs:// --backend_address",
+		},
+		{
+			desc:           "backend aware health check without healthz path",
+			backendAddress: "grpc://127.0.0.1:80",
+			healthzMode:    "backend_aware",
+			wantError:      "--healthz_mode=backend_aware requires a --healthz path",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = tc.backendAddress
+		opts.Healthz = tc.healthz
+		opts.HealthzMode = tc.healthzMode
+		opts.HealthzGrpcService = tc.healthzGrpcService
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cluster, err := makeLocalBackendCluster(fakeServiceInfo)
+		if tc.wantError != "" {
+			if err == nil || err.Error() != tc.wantError {
+				t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+
+		var wantHealthChecks []*corepb.HealthCheck
+		if tc.wantHealthCheck != nil {
+			wantHealthChecks = []*corepb.HealthCheck{tc.wantHealthCheck}
+		}
+		if !cmp.Equal(cluster.HealthChecks, wantHealthChecks, cmp.Comparer(proto.Equal)) {
+			t.Errorf("Test (%s): \nwant health checks: %v\nget: %v", tc.desc, wantHealthChecks, cluster.HealthChecks)
+		}
+	}
+}
+
 func TestMakeTokenAgentCluster(t *testing.T) {
 	fakeServiceInfo, _ := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
 		Apis: []*apipb.Api{
@@ -808,3 +1081,148 @@ func TestMakeTokenAgentCluster(t *testing.T) {
 		t.Errorf("Test makeTokenAgentClusters, \ngot: %v,\nwant: %v", cluster, wantCluster)
 	}
 }
+
+func TestCalloutConnectTimeout(t *testing.T) {
+	testData := []struct {
+		desc                      string
+		calloutPolicies           string
+		wantMetadataTimeout       time.Duration
+		wantServiceControlTimeout time.Duration
+	}{
+		{
+			desc:                      "no callout policies",
+			wantMetadataTimeout:       20 * time.Second,
+			wantServiceControlTimeout: 5 * time.Second,
+		},
+		{
+			desc:                      "callout timeouts shorter than the connect timeouts",
+			calloutPolicies:           "imds=timeout:1s;service_control=timeout:2s",
+			wantMetadataTimeout:       time.Second,
+			wantServiceControlTimeout: 2 * time.Second,
+		},
+		{
+			desc:                      "callout timeouts longer than the connect timeouts",
+			calloutPolicies:           "imds=timeout:1m;service_control=timeout:10s",
+			wantMetadataTimeout:       20 * time.Second,
+			wantServiceControlTimeout: 5 * time.Second,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.CalloutPolicies = tc.calloutPolicies
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+				Control: &confpb.Control{
+					Environment: testServiceControlEnv,
+				},
+			}, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			metadataCluster, err := makeMetadataCluster(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := metadataCluster.ConnectTimeout; !proto.Equal(got, ptypes.DurationProto(tc.wantMetadataTimeout)) {
+				t.Errorf("want metadata cluster connect timeout %v, got: %v", tc.wantMetadataTimeout, got)
+			}
+			serviceControlCluster, err := makeServiceControlCluster(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := serviceControlCluster.ConnectTimeout; !proto.Equal(got, ptypes.DurationProto(tc.wantServiceControlTimeout)) {
+				t.Errorf("want service control cluster connect timeout %v, got: %v", tc.wantServiceControlTimeout, got)
+			}
+		})
+	}
+}
+
+func TestMakeAdminCluster(t *testing.T) {
+	testData := []struct {
+		desc                  string
+		prometheusMetricsPort int
+		adminAddress          string
+		adminPort             int
+		wantedCluster         *clusterpb.Cluster
+		wantedError           string
+	}{
+		{
+			desc:                  "Success, generate admin cluster on the IPv4 loopback",
+			prometheusMetricsPort: 9090,
+			adminAddress:          "0.0.0.0",
+			adminPort:             8001,
+			wantedCluster: &clusterpb.Cluster{
+				Name:                 "admin-cluster",
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STATIC},
+				LoadAssignment:       util.CreateLoadAssignment("127.0.0.1", 8001),
+			},
+		},
+		{
+			desc:                  "Success, generate admin cluster on the IPv6 loopback",
+			prometheusMetricsPort: 9090,
+			adminAddress:          "::",
+			adminPort:             8001,
+			wantedCluster: &clusterpb.Cluster{
+				Name:                 "admin-cluster",
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STATIC},
+				LoadAssignment:       util.CreateLoadAssignment("::1", 8001),
+			},
+		},
+		{
+			desc:                  "Failure, admin interface is disabled",
+			prometheusMetricsPort: 9090,
+			adminPort:             0,
+			wantedError:           "--prometheus_metrics_port requires the admin interface, --admin_port cannot be 0",
+		},
+		{
+			desc:          "Success, not generate admin cluster without metrics port",
+			adminPort:     8001,
+			wantedCluster: nil,
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.1:80"
+		opts.PrometheusMetricsPort = tc.prometheusMetricsPort
+		opts.AdminAddress = tc.adminAddress
+		opts.AdminPort = tc.adminPort
+
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cluster, err := makeAdminCluster(fakeServiceInfo)
+		if err != nil {
+			if tc.wantedError == "" || err.Error() != tc.wantedError {
+				t.Errorf("Test Desc(%d): %s, makeAdminCluster got error: %v, want: %v", i, tc.desc, err, tc.wantedError)
+			}
+			continue
+		}
+		if tc.wantedError != "" {
+			t.Errorf("Test Desc(%d): %s, makeAdminCluster got no error, want: %v", i, tc.desc, tc.wantedError)
+		}
+
+		if !proto.Equal(cluster, tc.wantedCluster) {
+			t.Errorf("Test Desc(%d): %s, makeAdminCluster\ngot: %v,\nwant: %v", i, tc.desc, cluster, tc.wantedCluster)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"regexp"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+
+	rbacconfigpb "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+)
+
+const denyRulesPolicyName = "deny-rules"
+
+// makeDenyPermissions matches the requests of --deny_user_agents and
+// --deny_paths, any of the permissions matching denies the request.
+func makeDenyPermissions(serviceInfo *configinfo.ServiceInfo) []*rbacconfigpb.Permission {
+	var permissions []*rbacconfigpb.Permission
+	for _, userAgent := range serviceInfo.DenyUserAgents {
+		permissions = append(permissions, &rbacconfigpb.Permission{
+			Rule: &rbacconfigpb.Permission_Header{
+				Header: &routepb.HeaderMatcher{
+					Name: "user-agent",
+					HeaderMatchSpecifier: &routepb.HeaderMatcher_SafeRegexMatch{
+						SafeRegexMatch: &matcher.RegexMatcher{
+							EngineType: &matcher.RegexMatcher_GoogleRe2{
+								GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+							},
+							Regex: "(?i).*" + regexp.QuoteMeta(userAgent) + ".*",
+						},
+					},
+				},
+			},
+		})
+	}
+	for _, path := range serviceInfo.DenyPaths {
+		permissions = append(permissions, &rbacconfigpb.Permission{
+			Rule: &rbacconfigpb.Permission_UrlPath{
+				UrlPath: &matcher.PathMatcher{
+					Rule: &matcher.PathMatcher_Path{
+						Path: &matcher.StringMatcher{
+							MatchPattern: &matcher.StringMatcher_Contains{
+								Contains: path,
+							},
+							IgnoreCase: true,
+						},
+					},
+				},
+			},
+		})
+	}
+	return permissions
+}
+
+// makeDenyRulesRbac denies the requests matching any of the deny permissions,
+// from all the principals.
+func makeDenyRulesRbac(denyPermissions []*rbacconfigpb.Permission) *rbacconfigpb.RBAC {
+	return &rbacconfigpb.RBAC{
+		Action: rbacconfigpb.RBAC_DENY,
+		Policies: map[string]*rbacconfigpb.Policy{
+			denyRulesPolicyName: {
+				Permissions: denyPermissions,
+				Principals: []*rbacconfigpb.Principal{
+					{
+						Identifier: &rbacconfigpb.Principal_Any{
+							Any: true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
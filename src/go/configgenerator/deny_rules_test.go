@@ -0,0 +1,276 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestDenyRules(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Admin",
+					},
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer-0",
+					JwksUri: "https://fake-jwks.com",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: testApiName + ".Admin",
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "auth_provider",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc               string
+		denyUserAgents     string
+		denyPaths          string
+		jwtCallerAllowlist string
+		wantRbacFilter     string
+		wantRbacPerRoute   string
+	}{
+		{
+			desc:           "empty deny rules, no RBAC filter",
+			denyUserAgents: " ,",
+		},
+		{
+			desc:           "deny rules in the RBAC filter",
+			denyUserAgents: "sqlmap, Nikto/2",
+			denyPaths:      "/wp-admin,.php",
+			wantRbacFilter: `{
+				"name": "envoy.filters.http.rbac",
+				"typedConfig": {
+					"@type": "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC",
+					"rules": {
+						"action": "DENY",
+						"policies": {
+							"deny-rules": {
+								"permissions": [
+									{
+										"header": {
+											"name": "user-agent",
+											"safeRegexMatch": {
+												"googleRe2": {},
+												"regex": "(?i).*sqlmap.*"
+											}
+										}
+									},
+									{
+										"header": {
+											"name": "user-agent",
+											"safeRegexMatch": {
+												"googleRe2": {},
+												"regex": "(?i).*Nikto/2.*"
+											}
+										}
+									},
+									{
+										"urlPath": {
+											"path": {
+												"contains": "/wp-admin",
+												"ignoreCase": true
+											}
+										}
+									},
+									{
+										"urlPath": {
+											"path": {
+												"contains": ".php",
+												"ignoreCase": true
+											}
+										}
+									}
+								],
+								"principals": [
+									{
+										"any": true
+									}
+								]
+							}
+						}
+					}
+				}
+			}`,
+		},
+		{
+			desc:               "deny rules in the caller allowlist",
+			denyPaths:          ".php",
+			jwtCallerAllowlist: testApiName + ".Admin=admin@project.iam.gserviceaccount.com",
+			wantRbacFilter: `{
+				"name": "envoy.filters.http.rbac",
+				"typedConfig": {
+					"@type": "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC",
+					"rules": {
+						"action": "DENY",
+						"policies": {
+							"deny-rules": {
+								"permissions": [
+									{
+										"urlPath": {
+											"path": {
+												"contains": ".php",
+												"ignoreCase": true
+											}
+										}
+									}
+								],
+								"principals": [
+									{
+										"any": true
+									}
+								]
+							}
+						}
+					}
+				}
+			}`,
+			wantRbacPerRoute: `{
+				"rbac": {
+					"rules": {
+						"policies": {
+							"caller-allowlist": {
+								"permissions": [
+									{
+										"notRule": {
+											"orRules": {
+												"rules": [
+													{
+														"urlPath": {
+															"path": {
+																"contains": ".php",
+																"ignoreCase": true
+															}
+														}
+													}
+												]
+											}
+										}
+									}
+								],
+								"principals": [
+									{
+										"metadata": {
+											"filter": "envoy.filters.http.jwt_authn",
+											"path": [
+												{
+													"key": "jwt_payloads"
+												},
+												{
+													"key": "azp"
+												}
+											],
+											"value": {
+												"stringMatch": {
+													"exact": "admin@project.iam.gserviceaccount.com"
+												}
+											}
+										}
+									},
+									{
+										"metadata": {
+											"filter": "envoy.filters.http.jwt_authn",
+											"path": [
+												{
+													"key": "jwt_payloads"
+												},
+												{
+													"key": "email"
+												}
+											],
+											"value": {
+												"stringMatch": {
+													"exact": "admin@project.iam.gserviceaccount.com"
+												}
+											}
+										}
+									}
+								]
+							}
+						}
+					}
+				}
+			}`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.DenyUserAgents = tc.denyUserAgents
+			opts.DenyPaths = tc.denyPaths
+			opts.JwtCallerAllowlist = tc.jwtCallerAllowlist
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filter := makeRbacFilter(fakeServiceInfo)
+			if tc.wantRbacFilter == "" {
+				if filter != nil {
+					t.Errorf("expected no RBAC filter, got: %v", filter)
+				}
+				return
+			}
+
+			marshaler := &jsonpb.Marshaler{}
+			gotFilter, err := marshaler.MarshalToString(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(tc.wantRbacFilter, gotFilter); err != nil {
+				t.Errorf("makeRbacFilter failed,\n%v", err)
+			}
+
+			if tc.wantRbacPerRoute == "" {
+				return
+			}
+			method := fakeServiceInfo.Methods[testApiName+".Admin"]
+			gotPerRoute, err := marshaler.MarshalToString(makeCallerAllowlistRbac(method.AllowedCallers, makeDenyPermissions(fakeServiceInfo)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(tc.wantRbacPerRoute, gotPerRoute); err != nil {
+				t.Errorf("makeCallerAllowlistRbac failed,\n%v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tlspb "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// Resources are the xDS resources of Envoy generated for a service config.
+type Resources struct {
+	Clusters  []*clusterpb.Cluster
+	Listeners []*listenerpb.Listener
+	// Routes are only served separately through RDS, with --enable_rds.
+	// Otherwise the routes are inlined in the listeners.
+	Routes []*routepb.RouteConfiguration
+	// Secrets are served through SDS, e.g. the server certificate issued
+	// through ACME.
+	Secrets []*tlspb.Secret
+}
+
+// Generator translates service configs into the xDS resources of Envoy. It
+// is the entry point for the control planes embedding the ESPv2 config
+// generation:
+//
+//	g := configgenerator.NewGenerator(options.DefaultConfigGeneratorOptions())
+//	resources, err := g.Generate(serviceConfig)
+type Generator interface {
+	// Generate returns the resources serving the service config, along with
+	// the additional service configs served by the same listener.
+	Generate(serviceConfig *confpb.Service, additionalServiceConfigs ...*confpb.Service) (*Resources, error)
+}
+
+type generator struct {
+	opts options.ConfigGeneratorOptions
+}
+
+// NewGenerator returns a Generator with the options. The service configs are
+// not modified.
+func NewGenerator(opts options.ConfigGeneratorOptions) Generator {
+	return &generator{opts: opts}
+}
+
+func (g *generator) Generate(serviceConfig *confpb.Service, additionalServiceConfigs ...*confpb.Service) (*Resources, error) {
+	if serviceConfig == nil {
+		return nil, fmt.Errorf("service config is empty")
+	}
+	// The config generation fills in the service configs, generate from
+	// copies.
+	serviceConfig = proto.Clone(serviceConfig).(*confpb.Service)
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.GetId(), g.opts)
+	if err != nil {
+		return nil, fmt.Errorf("fail to initialize ServiceInfo, %s", err)
+	}
+	for _, config := range additionalServiceConfigs {
+		config = proto.Clone(config).(*confpb.Service)
+		additionalService, err := configinfo.NewServiceInfoFromServiceConfig(config, config.GetId(), g.opts)
+		if err != nil {
+			return nil, fmt.Errorf("fail to initialize ServiceInfo of service %s, %s", config.GetName(), err)
+		}
+		serviceInfo.AdditionalServices = append(serviceInfo.AdditionalServices, additionalService)
+	}
+	return MakeResources(serviceInfo)
+}
+
+// MakeResources makes the resources of the ServiceInfo, for the callers
+// filling in the ServiceInfo themselves, e.g. with GCP attributes or the
+// proto descriptor for transcoding.
+func MakeResources(serviceInfo *configinfo.ServiceInfo) (*Resources, error) {
+	clusters, err := MakeClusters(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	listeners, err := MakeListeners(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := MakeRoutes(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &Resources{
+		Clusters:  clusters,
+		Listeners: listeners,
+		Routes:    routes,
+		Secrets:   MakeSecrets(serviceInfo),
+	}, nil
+}
+
+// logConfig logs the config added to the resources. The configs of the
+// filters and routes grow with the operations of the service, and marshaling
+// them to JSON is slow and floods the logs of large services, so they are
+// only logged at verbosity 1.
+func logConfig(name string, config proto.Message) {
+	if !glog.V(1) {
+		glog.Infof("adding %s.", name)
+		return
+	}
+	jsonStr, _ := util.ProtoToJson(config)
+	glog.Infof("adding %s config: %v", name, jsonStr)
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/golang/protobuf/proto"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestGenerate(t *testing.T) {
+	testData := []struct {
+		desc                     string
+		serviceConfig            *confpb.Service
+		additionalServiceConfigs []*confpb.Service
+		enableRds                bool
+		deterministicOutput      bool
+		wantClusters             []string
+		wantRoutes               int
+		wantError                string
+	}{
+		{
+			desc: "service config",
+			serviceConfig: &confpb.Service{
+				Name: "bookstore.endpoints.project123.cloud.goog",
+				Id:   "2020-01-01r0",
+				Apis: []*apipb.Api{{Name: "endpoints.examples.bookstore.Bookstore"}},
+			},
+			wantClusters: []string{"backend-cluster-bookstore.endpoints.project123.cloud.goog_local", "metadata-cluster"},
+		},
+		{
+			desc: "service config with RDS",
+			serviceConfig: &confpb.Service{
+				Name: "bookstore.endpoints.project123.cloud.goog",
+				Id:   "2020-01-01r0",
+				Apis: []*apipb.Api{{Name: "endpoints.examples.bookstore.Bookstore"}},
+			},
+			enableRds:    true,
+			wantClusters: []string{"backend-cluster-bookstore.endpoints.project123.cloud.goog_local", "metadata-cluster"},
+			wantRoutes:   1,
+		},
+		{
+			desc: "additional service configs",
+			serviceConfig: &confpb.Service{
+				Name: "bookstore.endpoints.project123.cloud.goog",
+				Id:   "2020-01-01r0",
+				Apis: []*apipb.Api{{Name: "endpoints.examples.bookstore.Bookstore"}},
+			},
+			additionalServiceConfigs: []*confpb.Service{
+				{
+					Name: "echo.endpoints.project123.cloud.goog",
+					Id:   "2020-01-01r0",
+					Apis: []*apipb.Api{{Name: "echo.Echo"}},
+				},
+			},
+			wantClusters: []string{"backend-cluster-bookstore.endpoints.project123.cloud.goog_local", "metadata-cluster", "backend-cluster-echo.endpoints.project123.cloud.goog_local"},
+		},
+		{
+			desc: "additional service configs with deterministic output",
+			serviceConfig: &confpb.Service{
+				Name: "bookstore.endpoints.project123.cloud.goog",
+				Id:   "2020-01-01r0",
+				Apis: []*apipb.Api{{Name: "endpoints.examples.bookstore.Bookstore"}},
+			},
+			additionalServiceConfigs: []*confpb.Service{
+				{
+					Name: "echo.endpoints.project123.cloud.goog",
+					Id:   "2020-01-01r0",
+					Apis: []*apipb.Api{{Name: "echo.Echo"}},
+				},
+			},
+			deterministicOutput: true,
+			wantClusters:        []string{"backend-cluster-bookstore.endpoints.project123.cloud.goog_local", "backend-cluster-echo.endpoints.project123.cloud.goog_local", "metadata-cluster"},
+		},
+		{
+			desc: "service config without apis",
+			serviceConfig: &confpb.Service{
+				Name: "bookstore.endpoints.project123.cloud.goog",
+			},
+			wantError: "fail to initialize ServiceInfo",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.1:8082"
+		opts.DisableTracing = true
+		opts.EnableRds = tc.enableRds
+		opts.DeterministicOutput = tc.deterministicOutput
+		serviceConfig := proto.Clone(tc.serviceConfig).(*confpb.Service)
+
+		got, err := NewGenerator(opts).Generate(tc.serviceConfig, tc.additionalServiceConfigs...)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+
+		var gotClusters []string
+		for _, cluster := range got.Clusters {
+			gotClusters = append(gotClusters, cluster.GetName())
+		}
+		if strings.Join(gotClusters, ",") != strings.Join(tc.wantClusters, ",") {
+			t.Errorf("Test (%s): want clusters %v, get %v", tc.desc, tc.wantClusters, gotClusters)
+		}
+		if len(got.Listeners) != 1 {
+			t.Errorf("Test (%s): want 1 listener, get %d", tc.desc, len(got.Listeners))
+		}
+		if len(got.Routes) != tc.wantRoutes {
+			t.Errorf("Test (%s): want %d route configs, get %d", tc.desc, tc.wantRoutes, len(got.Routes))
+		}
+		if !proto.Equal(tc.serviceConfig, serviceConfig) {
+			t.Errorf("Test (%s): want the service config unmodified, get %v", tc.desc, tc.serviceConfig)
+		}
+	}
+}
+
+func TestGenerateInParallel(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+	opts.EnableRds = true
+	serviceConfig := makeLargeServiceConfig(500)
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	want, err := NewGenerator(opts).Generate(serviceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.GOMAXPROCS(8)
+	for i := 0; i < 3; i++ {
+		got, err := NewGenerator(opts).Generate(serviceConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(got.Routes[0], want.Routes[0]) {
+			t.Errorf("want the routes generated in parallel in the same order as sequentially")
+		}
+	}
+}
+
+// makeLargeServiceConfig makes a service config with the given number of
+// operations, each with its own http rule and JWT authentication.
+func makeLargeServiceConfig(operations int) *confpb.Service {
+	serviceConfig := &confpb.Service{
+		Name: "bookstore.endpoints.project123.cloud.goog",
+		Id:   "2020-01-01r0",
+		Apis: []*apipb.Api{{Name: "endpoints.examples.bookstore.Bookstore"}},
+		Http: &annotationspb.Http{},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer-0",
+					JwksUri: "https://fake-jwks.com",
+				},
+			},
+		},
+	}
+	for i := 0; i < operations; i++ {
+		name := fmt.Sprintf("Operation%d", i)
+		selector := "endpoints.examples.bookstore.Bookstore." + name
+		serviceConfig.Apis[0].Methods = append(serviceConfig.Apis[0].Methods, &apipb.Method{Name: name})
+		serviceConfig.Http.Rules = append(serviceConfig.Http.Rules, &annotationspb.HttpRule{
+			Selector: selector,
+			Pattern:  &annotationspb.HttpRule_Get{Get: fmt.Sprintf("/v1/resources%d/{resource}/items/{item=**}", i)},
+		})
+		serviceConfig.Authentication.Rules = append(serviceConfig.Authentication.Rules, &confpb.AuthenticationRule{
+			Selector:     selector,
+			Requirements: []*confpb.AuthRequirement{{ProviderId: "auth_provider"}},
+		})
+	}
+	return serviceConfig
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	for _, operations := range []int{100, 5000} {
+		b.Run(fmt.Sprintf("%d operations", operations), func(b *testing.B) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "http://127.0.0.1:8082"
+			opts.DisableTracing = true
+			gen := NewGenerator(opts)
+			serviceConfig := makeLargeServiceConfig(operations)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := gen.Generate(serviceConfig); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	idpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/idempotency"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+// makeIdempotencyFilter deduplicates the requests with the same idempotency
+// key, if any operation is in --idempotency_selectors.
+//
+// The keys and the stored responses live in the memory of Envoy, so the
+// duplicates are only caught when they reach the same proxy replica.
+func makeIdempotencyFilter(serviceInfo *configinfo.ServiceInfo) *hcmpb.HttpFilter {
+	needed := false
+	for _, method := range serviceInfo.Methods {
+		needed = needed || method.EnableIdempotency
+	}
+	if !needed {
+		return nil
+	}
+
+	idempotencyConfig := &idpb.FilterConfig{
+		KeyHeader: strings.ToLower(serviceInfo.Options.IdempotencyKeyHeader),
+		Ttl:       ptypes.DurationProto(serviceInfo.Options.IdempotencyTtl),
+	}
+	idempotencyConfigAny, _ := ptypes.MarshalAny(idempotencyConfig)
+	return &hcmpb.HttpFilter{
+		Name: util.Idempotency,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{
+			TypedConfig: idempotencyConfigAny,
+		},
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	idpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/idempotency"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestMakeIdempotencyFilter(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "CreateShelf",
+					},
+					{
+						Name: "GetShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/shelves",
+				},
+				AdditionalBindings: []*annotationspb.HttpRule{
+					{
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: "/shelves:create",
+						},
+					},
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.GetShelf",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/shelves/{shelf}",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                 string
+		idempotencySelectors string
+		idempotencyKeyHeader string
+		idempotencyTtl       time.Duration
+		wantFilterConfig     string
+		// The operations of the routes with an idempotency per-route config,
+		// as "method operation".
+		wantRoutes []string
+	}{
+		{
+			desc: "no idempotency filter without selectors",
+		},
+		{
+			desc:                 "default key header and ttl",
+			idempotencySelectors: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+			wantFilterConfig: `{
+				"keyHeader": "idempotency-key",
+				"ttl": "600s"
+			}`,
+			wantRoutes: []string{
+				"POST endpoints.examples.bookstore.Bookstore.CreateShelf",
+				"POST endpoints.examples.bookstore.Bookstore.CreateShelf",
+			},
+		},
+		{
+			desc:                 "custom key header and ttl",
+			idempotencySelectors: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+			idempotencyKeyHeader: "X-Request-Key",
+			idempotencyTtl:       time.Hour,
+			wantFilterConfig: `{
+				"keyHeader": "x-request-key",
+				"ttl": "3600s"
+			}`,
+			wantRoutes: []string{
+				"POST endpoints.examples.bookstore.Bookstore.CreateShelf",
+				"POST endpoints.examples.bookstore.Bookstore.CreateShelf",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.IdempotencySelectors = tc.idempotencySelectors
+			if tc.idempotencyKeyHeader != "" {
+				opts.IdempotencyKeyHeader = tc.idempotencyKeyHeader
+			}
+			if tc.idempotencyTtl != 0 {
+				opts.IdempotencyTtl = tc.idempotencyTtl
+			}
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filter := makeIdempotencyFilter(fakeServiceInfo)
+			if tc.wantFilterConfig == "" {
+				if filter != nil {
+					t.Fatalf("got idempotency filter: %v, want none", filter)
+				}
+			} else {
+				if filter.GetName() != util.Idempotency {
+					t.Errorf("got filter name: %s, want: %s", filter.GetName(), util.Idempotency)
+				}
+				gotFilterConfig := &idpb.FilterConfig{}
+				if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), gotFilterConfig); err != nil {
+					t.Fatal(err)
+				}
+				wantFilterConfig := &idpb.FilterConfig{}
+				if err := jsonpb.UnmarshalString(tc.wantFilterConfig, wantFilterConfig); err != nil {
+					t.Fatal(err)
+				}
+				if !proto.Equal(gotFilterConfig, wantFilterConfig) {
+					t.Errorf("got idempotency config: %v, want: %v", gotFilterConfig, wantFilterConfig)
+				}
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotRoutes []string
+			for _, route := range routes {
+				perRouteAny, ok := route.GetTypedPerFilterConfig()[util.Idempotency]
+				if !ok {
+					continue
+				}
+				perRoute := &idpb.PerRouteFilterConfig{}
+				if err := ptypes.UnmarshalAny(perRouteAny, perRoute); err != nil {
+					t.Fatal(err)
+				}
+				for _, header := range route.GetMatch().GetHeaders() {
+					if header.GetName() == ":method" {
+						gotRoutes = append(gotRoutes, header.GetExactMatch()+" "+perRoute.GetOperationName())
+					}
+				}
+			}
+			if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+				t.Errorf("got idempotency routes: %v, want: %v", gotRoutes, tc.wantRoutes)
+			}
+		})
+	}
+}
@@ -16,18 +16,25 @@ package configgenerator
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/tracing"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/backend_auth"
 	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/common"
+	etagpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/etag"
+	gsmpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/grpc_status_mapping"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
 
 	acpb "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
@@ -35,11 +42,15 @@ import (
 	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	facpb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
+	alspb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
 	transcoderpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_json_transcoder/v3"
 	hcpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/health_check/v3"
 	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	rbacpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
 	routerpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	durationpb "github.com/golang/protobuf/ptypes/duration"
 	emptypb "github.com/golang/protobuf/ptypes/empty"
 	structpb "github.com/golang/protobuf/ptypes/struct"
@@ -58,20 +69,259 @@ func MakeListeners(serviceInfo *sc.ServiceInfo) ([]*listenerpb.Listener, error)
 	if err != nil {
 		return nil, err
 	}
-	return []*listenerpb.Listener{listener}, nil
+	listeners := []*listenerpb.Listener{listener}
+
+	if serviceInfo.Options.PrometheusMetricsPort != 0 {
+		metricsListener, err := makeMetricsListener(serviceInfo)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, metricsListener)
+	}
+
+	if serviceInfo.Options.AcmeDomains != "" && serviceInfo.Options.AcmeHttpPort != 0 {
+		acmeListener, err := makeAcmeHttpListener(serviceInfo)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, acmeListener)
+	}
+	return listeners, nil
+}
+
+// makeMetricsListener provides a listener serving the Envoy stats filtered by
+// --prometheus_stats_filter in the Prometheus format on /metrics, through the
+// admin interface.
+func makeMetricsListener(serviceInfo *sc.ServiceInfo) (*listenerpb.Listener, error) {
+	route := &routepb.RouteConfiguration{
+		Name: "metrics_route",
+		VirtualHosts: []*routepb.VirtualHost{
+			{
+				Name:    "metrics",
+				Domains: []string{"*"},
+				Routes: []*routepb.Route{
+					{
+						// The whole path is rewritten, so only the requests without a
+						// query are forwarded to the admin interface.
+						Match: &routepb.RouteMatch{
+							PathSpecifier: &routepb.RouteMatch_Path{
+								Path: "/metrics",
+							},
+							Headers: []*routepb.HeaderMatcher{
+								{
+									Name: ":path",
+									HeaderMatchSpecifier: &routepb.HeaderMatcher_ExactMatch{
+										ExactMatch: "/metrics",
+									},
+								},
+							},
+						},
+						Action: &routepb.Route_Route{
+							Route: &routepb.RouteAction{
+								ClusterSpecifier: &routepb.RouteAction_Cluster{
+									Cluster: util.AdminClusterName,
+								},
+								PrefixRewrite: "/stats/prometheus?usedonly&filter=" + url.QueryEscape(serviceInfo.Options.PrometheusStatsFilter),
+							},
+						},
+					},
+					{
+						Match: &routepb.RouteMatch{
+							PathSpecifier: &routepb.RouteMatch_Path{
+								Path: "/metrics",
+							},
+						},
+						Action: &routepb.Route_Redirect{
+							Redirect: &routepb.RedirectAction{
+								PathRewriteSpecifier: &routepb.RedirectAction_PathRedirect{
+									PathRedirect: "/metrics",
+								},
+								StripQuery: true,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	router, _ := ptypes.MarshalAny(&routerpb.Router{
+		SuppressEnvoyHeaders: true,
+	})
+	httpConMgr := &hcmpb.HttpConnectionManager{
+		CodecType:  hcmpb.HttpConnectionManager_AUTO,
+		StatPrefix: "metrics",
+		RouteSpecifier: &hcmpb.HttpConnectionManager_RouteConfig{
+			RouteConfig: route,
+		},
+		HttpFilters: []*hcmpb.HttpFilter{
+			{
+				Name:       util.Router,
+				ConfigType: &hcmpb.HttpFilter_TypedConfig{TypedConfig: router},
+			},
+		},
+	}
+
+	httpFilterConfig, err := ptypes.MarshalAny(httpConMgr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &listenerpb.Listener{
+		Name: util.MetricsListenerName,
+		Address: &corepb.Address{
+			Address: &corepb.Address_SocketAddress{
+				SocketAddress: &corepb.SocketAddress{
+					Address: serviceInfo.Options.PrometheusMetricsAddress,
+					PortSpecifier: &corepb.SocketAddress_PortValue{
+						PortValue: uint32(serviceInfo.Options.PrometheusMetricsPort),
+					},
+				},
+			},
+		},
+		FilterChains: []*listenerpb.FilterChain{
+			{
+				Filters: []*listenerpb.Filter{
+					{
+						Name:       util.HTTPConnectionManager,
+						ConfigType: &listenerpb.Filter_TypedConfig{TypedConfig: httpFilterConfig},
+					},
+				},
+			},
+		},
+	}, nil
 }
 
 // makeListener provides a dynamic listener for Envoy
 func makeListener(serviceInfo *sc.ServiceInfo) (*listenerpb.Listener, error) {
+	httpFilters, err := MakeHttpFilters(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// The filters of the additional services are merged into the ones of the
+	// service, since they share the listener.
+	for _, additionalService := range serviceInfo.AdditionalServices {
+		additionalFilters, err := MakeHttpFilters(additionalService)
+		if err != nil {
+			return nil, fmt.Errorf("fail to make the filters of service %s: %v", additionalService.Name, err)
+		}
+		httpFilters, err = mergeHttpFilters(httpFilters, additionalFilters)
+		if err != nil {
+			return nil, fmt.Errorf("fail to merge the filters of service %s: %v", additionalService.Name, err)
+		}
+	}
+
+	// With RDS, the routes are served separately by MakeRoutes.
+	var route *routepb.RouteConfiguration
+	if !serviceInfo.Options.EnableRds {
+		var err error
+		route, err = MakeRouteConfig(serviceInfo)
+		if err != nil {
+			return nil, fmt.Errorf("makeHttpConnectionManagerRouteConfig got err: %s", err)
+		}
+	} else if serviceInfo.ServiceConfig().GetControl().GetEnvironment() != "" && !serviceInfo.Options.SkipServiceControlFilter {
+		glog.Warningf("--enable_rds only keeps the listener for the route changes keeping the config id: the service control filter carries the config id %s in the listener", serviceInfo.ConfigID)
+	}
+
+	httpConMgr, err := makeHttpConMgr(&serviceInfo.Options, route)
+	if err != nil {
+		return nil, fmt.Errorf("makeHttpConnectionManager got err: %s", err)
+	}
+
+	logConfig("Http Connection Manager", httpConMgr)
+	httpConMgr.HttpFilters = httpFilters
+
+	// HTTP filter configuration
+	httpFilterConfig, err := ptypes.MarshalAny(httpConMgr)
+	if err != nil {
+		return nil, err
+	}
+
+	filterChain := &listenerpb.FilterChain{
+		Filters: []*listenerpb.Filter{
+			{
+				Name:       util.HTTPConnectionManager,
+				ConfigType: &listenerpb.Filter_TypedConfig{TypedConfig: httpFilterConfig},
+			},
+		},
+	}
+
+	if serviceInfo.Options.AcmeDomains != "" {
+		if serviceInfo.Options.SslServerCertPath != "" {
+			return nil, fmt.Errorf("--acme_domains cannot be used together with --ssl_server_cert_path")
+		}
+		// The certificate issued through ACME is served through SDS, Envoy
+		// warms the listener until it gets it.
+		transportSocket, err := util.CreateDownstreamSdsTransportSocket(
+			util.AcmeSecretName,
+			serviceInfo.Options.SslMinimumProtocol,
+			serviceInfo.Options.SslMaximumProtocol,
+			serviceInfo.Options.SslServerCipherSuites,
+		)
+		if err != nil {
+			return nil, err
+		}
+		filterChain.TransportSocket = transportSocket
+	} else if serviceInfo.Options.SslServerCertPath != "" {
+		transportSocket, err := util.CreateDownstreamTransportSocket(
+			serviceInfo.Options.SslServerCertPath,
+			serviceInfo.Options.SslMinimumProtocol,
+			serviceInfo.Options.SslMaximumProtocol,
+			serviceInfo.Options.SslServerCipherSuites,
+		)
+		if err != nil {
+			return nil, err
+		}
+		filterChain.TransportSocket = transportSocket
+	}
+
+	listener := &listenerpb.Listener{
+		Name: util.IngressListenerName,
+		Address: &corepb.Address{
+			Address: &corepb.Address_SocketAddress{
+				SocketAddress: &corepb.SocketAddress{
+					Address: serviceInfo.Options.ListenerAddress,
+					PortSpecifier: &corepb.SocketAddress_PortValue{
+						PortValue: uint32(serviceInfo.Options.ListenerPort),
+					},
+				},
+			},
+		},
+		FilterChains: []*listenerpb.FilterChain{filterChain},
+	}
+
+	if serviceInfo.Options.ConnectionBufferLimitBytes >= 0 {
+		listener.PerConnectionBufferLimitBytes = &wrapperspb.UInt32Value{
+			Value: uint32(serviceInfo.Options.ConnectionBufferLimitBytes),
+		}
+	}
+
+	return listener, nil
+}
+
+// MakeHttpFilters makes the ordered http filters of the service, without the
+// filters of its additional services.
+func MakeHttpFilters(serviceInfo *sc.ServiceInfo) ([]*hcmpb.HttpFilter, error) {
 	httpFilters := []*hcmpb.HttpFilter{}
 
+	// Add the audit log path filter first, so it has the original path of the
+	// requests rejected by the other filters too.
+	if serviceInfo.Options.AuditLog != "" {
+		auditLogPathFilter, err := makeAuditLogPathFilter()
+		if err != nil {
+			return nil, err
+		}
+		httpFilters = append(httpFilters, auditLogPathFilter)
+		logConfig("Audit Log Path Filter", auditLogPathFilter)
+	}
+
 	if serviceInfo.Options.CorsPreset == "basic" || serviceInfo.Options.CorsPreset == "cors_with_regex" {
 		corsFilter := &hcmpb.HttpFilter{
 			Name: util.CORS,
 		}
 		httpFilters = append(httpFilters, corsFilter)
-		jsonStr, _ := util.ProtoToJson(corsFilter)
-		glog.Infof("adding CORS Filter config: %v", jsonStr)
+		logConfig("CORS Filter", corsFilter)
 	}
 
 	// Add Health Check filter if needed. It must behind Path Matcher filter, since Service Control
@@ -82,8 +332,14 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*listenerpb.Listener, error) {
 			return nil, err
 		}
 		httpFilters = append(httpFilters, hcFilter)
-		jsonStr, _ := util.ProtoToJson(hcFilter)
-		glog.V(1).Infof("adding Healthz filter config: %v", jsonStr)
+		logConfig("Healthz Filter", hcFilter)
+	}
+
+	// Add the spike arrest filter if needed. It is ahead of the auth filters,
+	// so the spikes don't reach the auth servers either.
+	if spikeArrestFilter := makeSpikeArrestFilter(serviceInfo); spikeArrestFilter != nil {
+		httpFilters = append(httpFilters, spikeArrestFilter)
+		logConfig("Spike Arrest Filter", spikeArrestFilter)
 	}
 
 	// Add JWT Authn filter if needed.
@@ -91,11 +347,18 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*listenerpb.Listener, error) {
 		jwtAuthnFilter := makeJwtAuthnFilter(serviceInfo)
 		if jwtAuthnFilter != nil {
 			httpFilters = append(httpFilters, jwtAuthnFilter)
-			jsonStr, _ := util.ProtoToJson(jwtAuthnFilter)
-			glog.Infof("adding JWT Authn Filter config: %v", jsonStr)
+			logConfig("JWT Authn Filter", jwtAuthnFilter)
 		}
 	}
 
+	// Add RBAC filter to enforce the caller allowlists and the deny rules if
+	// needed. It must be behind JWT Authn filter, since it matches against the
+	// JWT payload metadata.
+	if rbacFilter := makeRbacFilter(serviceInfo); rbacFilter != nil {
+		httpFilters = append(httpFilters, rbacFilter)
+		glog.Infof("adding RBAC Filter.")
+	}
+
 	// Add Service Control filter if needed.
 	if !serviceInfo.Options.SkipServiceControlFilter {
 		serviceControlFilter, err := makeServiceControlFilter(serviceInfo)
@@ -104,11 +367,73 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*listenerpb.Listener, error) {
 		}
 		if serviceControlFilter != nil {
 			httpFilters = append(httpFilters, serviceControlFilter)
-			jsonStr, _ := util.ProtoToJson(serviceControlFilter)
-			glog.Infof("adding Service Control Filter config: %v", jsonStr)
+			logConfig("Service Control Filter", serviceControlFilter)
 		}
 	}
 
+	// Add the rate limit filters if needed. They must be behind Service Control
+	// filter, which sets the consumer tier of the api key.
+	rateLimitFilters, err := makeRateLimitFilters(serviceInfo)
+	if err != nil {
+		return nil, fmt.Errorf("could not add the rate limit filters: %v", err)
+	}
+	for _, rateLimitFilter := range rateLimitFilters {
+		httpFilters = append(httpFilters, rateLimitFilter)
+		logConfig("Rate Limit Filter", rateLimitFilter)
+	}
+
+	// Add Concurrency Limit filter if needed. It must be behind the auth
+	// filters, so the unauthorized requests don't take the room of the others.
+	if needConcurrencyLimit(serviceInfo) {
+		httpFilters = append(httpFilters, &hcmpb.HttpFilter{
+			Name: util.ConcurrencyLimit,
+		})
+		glog.Infof("adding Concurrency Limit Filter.")
+	}
+
+	// Add Idempotency filter if needed. It must be behind the auth filters, so
+	// only the authorized requests are deduplicated, and behind Service Control
+	// filter, which sets the api key scoping the idempotency keys.
+	if idempotencyFilter := makeIdempotencyFilter(serviceInfo); idempotencyFilter != nil {
+		httpFilters = append(httpFilters, idempotencyFilter)
+		logConfig("Idempotency Filter", idempotencyFilter)
+	}
+
+	// Add Etag filter if needed. It must be ahead of Cache filter, so the
+	// responses served from the cache get an ETag too, and of gRPC Transcoder
+	// filter, so it hashes the transcoded JSON responses.
+	if needEtag(serviceInfo) {
+		if serviceInfo.Options.EtagMaxBodyBytes < 0 {
+			return nil, fmt.Errorf("invalid --etag_max_body_bytes %d, it must not be negative", serviceInfo.Options.EtagMaxBodyBytes)
+		}
+		etagConfig, err := ptypes.MarshalAny(&etagpb.FilterConfig{
+			MaxBodyBytes: uint32(serviceInfo.Options.EtagMaxBodyBytes),
+		})
+		if err != nil {
+			return nil, err
+		}
+		httpFilters = append(httpFilters, &hcmpb.HttpFilter{
+			Name: util.Etag,
+			ConfigType: &hcmpb.HttpFilter_TypedConfig{
+				TypedConfig: etagConfig,
+			},
+		})
+		glog.Infof("adding Etag Filter.")
+	}
+
+	// Add Cache filter if needed. It must be behind the auth filters, so only
+	// the authorized requests are served from the cache, and ahead of gRPC
+	// Transcoder filter, which turns the GET requests into gRPC ones.
+	if responseCacheFilter := makeResponseCacheFilter(serviceInfo); responseCacheFilter != nil {
+		httpFilters = append(httpFilters, responseCacheFilter)
+		logConfig("Cache Filter", responseCacheFilter)
+
+		// Add Cache Control filter behind it, so it sets the Cache-Control and
+		// Vary headers of the responses before Cache filter stores them.
+		httpFilters = append(httpFilters, makeCacheControlFilter())
+		glog.Infof("adding Cache Control Filter.")
+	}
+
 	// Add gRPC Transcoder filter and gRPCWeb filter configs for gRPC backend.
 	if serviceInfo.GrpcSupportRequired {
 		// grpc-web filter should be before grpc transcoder filter.
@@ -119,13 +444,72 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*listenerpb.Listener, error) {
 		grpcWebFilter := &hcmpb.HttpFilter{
 			Name: util.GRPCWeb,
 		}
-		httpFilters = append(httpFilters, grpcWebFilter)
-
 		transcoderFilter := makeTranscoderFilter(serviceInfo)
+
+		// Add Body Validation filter if needed. It must be ahead of gRPC
+		// Transcoder filter, which turns the JSON bodies into gRPC messages.
+		if transcoderFilter != nil {
+			bodyValidationFilter, err := makeBodyValidationFilter(serviceInfo)
+			if err != nil {
+				return nil, fmt.Errorf("could not add body validation filter: %v", err)
+			}
+			if bodyValidationFilter != nil {
+				httpFilters = append(httpFilters, bodyValidationFilter)
+				logConfig("Body Validation Filter", bodyValidationFilter)
+			}
+		}
+
+		// Add Stream Format filter if needed. It must be ahead of gRPC
+		// Transcoder filter, so it reads the JSON array of the transcoded
+		// server streams.
+		if transcoderFilter != nil && needStreamFormat(serviceInfo) {
+			streamFormatFilter := &hcmpb.HttpFilter{
+				Name: util.StreamFormat,
+			}
+			httpFilters = append(httpFilters, streamFormatFilter)
+			logConfig("Stream Format Filter", streamFormatFilter)
+		}
+
+		// Add gRPC Status Mapping filter if needed. It must be ahead of gRPC
+		// Transcoder filter, so it reads the gRPC status code of the transcoded
+		// JSON errors.
+		if transcoderFilter != nil && needGrpcStatusMapping(serviceInfo) {
+			grpcStatusMappingFilter, err := makeGrpcStatusMappingFilter(serviceInfo)
+			if err != nil {
+				return nil, err
+			}
+			httpFilters = append(httpFilters, grpcStatusMappingFilter)
+			logConfig("gRPC Status Mapping Filter", grpcStatusMappingFilter)
+		}
+
+		httpFilters = append(httpFilters, grpcWebFilter)
 		if transcoderFilter != nil {
+			// Add Query Rewrite filter if needed. It must be ahead of gRPC
+			// Transcoder filters, which bind the query parameters to the
+			// request messages.
+			if needQueryRewrite(serviceInfo) {
+				queryRewriteFilter := &hcmpb.HttpFilter{
+					Name: util.QueryRewrite,
+				}
+				httpFilters = append(httpFilters, queryRewriteFilter)
+				logConfig("Query Rewrite Filter", queryRewriteFilter)
+			}
+
+			// Add the gRPC Transcoder filters of the operations overriding the
+			// print options ahead of the one of all the operations. The
+			// requests they transcode have the application/grpc content type
+			// when they reach it, so it bypasses them.
+			printOptionsFilters, err := makeTranscoderPrintOptionsFilters(serviceInfo)
+			if err != nil {
+				return nil, err
+			}
+			for _, printOptionsFilter := range printOptionsFilters {
+				httpFilters = append(httpFilters, printOptionsFilter)
+				logConfig("Transcoder Filter with operation print options", printOptionsFilter)
+			}
+
 			httpFilters = append(httpFilters, transcoderFilter)
-			jsonStr, _ := util.ProtoToJson(transcoderFilter)
-			glog.Infof("adding Transcoder Filter config: %v", jsonStr)
+			logConfig("Transcoder Filter", transcoderFilter)
 		}
 	}
 
@@ -136,8 +520,7 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*listenerpb.Listener, error) {
 	}
 	if backendAuthFilter != nil {
 		httpFilters = append(httpFilters, backendAuthFilter)
-		jsonStr, _ := util.ProtoToJson(backendAuthFilter)
-		glog.Infof("adding Backend Auth Filter config: %v", jsonStr)
+		logConfig("Backend Auth Filter", backendAuthFilter)
 	}
 
 	if needPathRewrite(serviceInfo) {
@@ -159,174 +542,388 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*listenerpb.Listener, error) {
 	// Router filter should be the last.
 	routerFilter := makeRouterFilter(serviceInfo.Options)
 	httpFilters = append(httpFilters, routerFilter)
+	return httpFilters, nil
+}
 
-	route, err := MakeRouteConfig(serviceInfo)
+func makeHttpConMgr(opts *options.ConfigGeneratorOptions, route *routepb.RouteConfiguration) (*hcmpb.HttpConnectionManager, error) {
+	localReplyJsonFormat, err := makeLocalReplyJsonFormat(opts)
 	if err != nil {
-		return nil, fmt.Errorf("makeHttpConnectionManagerRouteConfig got err: %s", err)
+		return nil, err
 	}
-
-	httpConMgr, err := makeHttpConMgr(&serviceInfo.Options, route)
-	if err != nil {
-		return nil, fmt.Errorf("makeHttpConnectionManager got err: %s", err)
-	}
-
-	jsonStr, _ := util.ProtoToJson(httpConMgr)
-	glog.Infof("adding Http Connection Manager config: %v", jsonStr)
-	httpConMgr.HttpFilters = httpFilters
-
-	// HTTP filter configuration
-	httpFilterConfig, err := ptypes.MarshalAny(httpConMgr)
+	localReplyMappers, err := addLocalReplyErrorInfo(opts, localReplyJsonFormat)
 	if err != nil {
 		return nil, err
 	}
 
-	filterChain := &listenerpb.FilterChain{
-		Filters: []*listenerpb.Filter{
+	httpConMgr := &hcmpb.HttpConnectionManager{
+		UpgradeConfigs: []*hcmpb.HttpConnectionManager_UpgradeConfig{
 			{
-				Name:       util.HTTPConnectionManager,
-				ConfigType: &listenerpb.Filter_TypedConfig{TypedConfig: httpFilterConfig},
+				UpgradeType: "websocket",
+			},
+		},
+		CodecType:                    hcmpb.HttpConnectionManager_AUTO,
+		StatPrefix:                   statPrefix,
+		UseRemoteAddress:             &wrapperspb.BoolValue{Value: opts.EnvoyUseRemoteAddress},
+		XffNumTrustedHops:            uint32(opts.EnvoyXffNumTrustedHops),
+		PreserveExternalRequestId:    opts.PreserveExternalRequestId,
+		AlwaysSetRequestIdInResponse: opts.AlwaysSetRequestIdInResponse,
+		// Converting the error message for requests rejected by Envoy to JSON format.
+		LocalReplyConfig: &hcmpb.LocalReplyConfig{
+			Mappers: localReplyMappers,
+			BodyFormat: &corepb.SubstitutionFormatString{
+				Format: &corepb.SubstitutionFormatString_JsonFormat{
+					JsonFormat: localReplyJsonFormat,
+				},
 			},
 		},
 	}
 
-	if serviceInfo.Options.SslServerCertPath != "" {
-		transportSocket, err := util.CreateDownstreamTransportSocket(
-			serviceInfo.Options.SslServerCertPath,
-			serviceInfo.Options.SslMinimumProtocol,
-			serviceInfo.Options.SslMaximumProtocol,
-			serviceInfo.Options.SslServerCipherSuites,
-		)
+	if opts.EnableRds {
+		httpConMgr.RouteSpecifier = &hcmpb.HttpConnectionManager_Rds{
+			Rds: &hcmpb.Rds{
+				ConfigSource: &corepb.ConfigSource{
+					ResourceApiVersion: corepb.ApiVersion_V3,
+					ConfigSourceSpecifier: &corepb.ConfigSource_Ads{
+						Ads: &corepb.AggregatedConfigSource{},
+					},
+				},
+				RouteConfigName: routeName,
+			},
+		}
+	} else {
+		httpConMgr.RouteSpecifier = &hcmpb.HttpConnectionManager_RouteConfig{
+			RouteConfig: route,
+		}
+	}
+
+	if opts.AccessLog != "" {
+		accessLog, err := makeFileAccessLog(opts)
 		if err != nil {
 			return nil, err
 		}
-		filterChain.TransportSocket = transportSocket
+		httpConMgr.AccessLog = append(httpConMgr.AccessLog, accessLog)
 	}
 
-	listener := &listenerpb.Listener{
-		Name: util.IngressListenerName,
-		Address: &corepb.Address{
-			Address: &corepb.Address_SocketAddress{
-				SocketAddress: &corepb.SocketAddress{
-					Address: serviceInfo.Options.ListenerAddress,
-					PortSpecifier: &corepb.SocketAddress_PortValue{
-						PortValue: uint32(serviceInfo.Options.ListenerPort),
+	if opts.AccessLogServiceAddress != "" {
+		accessLog, err := makeGrpcAccessLog(opts)
+		if err != nil {
+			return nil, err
+		}
+		httpConMgr.AccessLog = append(httpConMgr.AccessLog, accessLog)
+	}
+
+	auditLogs, err := makeAuditLogs(opts)
+	if err != nil {
+		return nil, err
+	}
+	httpConMgr.AccessLog = append(httpConMgr.AccessLog, auditLogs...)
+
+	if !opts.DisableTracing {
+		httpConMgr.Tracing, err = tracing.CreateTracing(opts.CommonOptions)
+		if err != nil {
+			return nil, err
+		}
+		httpConMgr.Tracing.CustomTags, err = tracing.CreateCustomTags(opts.TracingCustomTags, opts.TracingHeaderTags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.UnderscoresInHeaders {
+		httpConMgr.CommonHttpProtocolOptions = &corepb.HttpProtocolOptions{
+			HeadersWithUnderscoresAction: corepb.HttpProtocolOptions_ALLOW,
+		}
+	} else {
+		httpConMgr.CommonHttpProtocolOptions = &corepb.HttpProtocolOptions{
+			HeadersWithUnderscoresAction: corepb.HttpProtocolOptions_REJECT_REQUEST,
+		}
+	}
+
+	if opts.EnableGrpcForHttp1 {
+		// Retain gRPC trailers if downstream is using http1.
+		httpConMgr.HttpProtocolOptions = &corepb.Http1ProtocolOptions{
+			EnableTrailers: true,
+		}
+	}
+
+	return httpConMgr, nil
+}
+
+func makeFileAccessLog(opts *options.ConfigGeneratorOptions) (*acpb.AccessLog, error) {
+	fileAccessLog := &facpb.FileAccessLog{
+		Path: opts.AccessLog,
+	}
+
+	if opts.AccessLogFormat != "" && opts.AccessLogJsonFormat != "" {
+		return nil, fmt.Errorf("--access_log_format and --access_log_json_format cannot be both specified")
+	}
+	if opts.AccessLogFormat != "" {
+		fileAccessLog.AccessLogFormat = &facpb.FileAccessLog_LogFormat{
+			LogFormat: &corepb.SubstitutionFormatString{
+				Format: &corepb.SubstitutionFormatString_TextFormat{
+					TextFormat: opts.AccessLogFormat,
+				},
+			},
+		}
+	}
+	if opts.AccessLogJsonFormat != "" {
+		jsonFormat := &structpb.Struct{}
+		if err := jsonpb.UnmarshalString(opts.AccessLogJsonFormat, jsonFormat); err != nil {
+			return nil, fmt.Errorf("invalid --access_log_json_format %q, must be a JSON object: %v", opts.AccessLogJsonFormat, err)
+		}
+		fileAccessLog.AccessLogFormat = &facpb.FileAccessLog_LogFormat{
+			LogFormat: &corepb.SubstitutionFormatString{
+				Format: &corepb.SubstitutionFormatString_JsonFormat{
+					JsonFormat: jsonFormat,
+				},
+			},
+		}
+	}
+
+	filter, err := makeAccessLogFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	serialized, _ := ptypes.MarshalAny(fileAccessLog)
+	return &acpb.AccessLog{
+		Name:   util.AccessFileLogger,
+		Filter: filter,
+		ConfigType: &acpb.AccessLog_TypedConfig{
+			TypedConfig: serialized,
+		},
+	}, nil
+}
+
+// makeGrpcAccessLog streams the access log entries to the gRPC Access Log
+// Service at --access_log_service_address, through the cluster generated by
+// makeAccessLogServiceCluster.
+func makeGrpcAccessLog(opts *options.ConfigGeneratorOptions) (*acpb.AccessLog, error) {
+	grpcAccessLog := &alspb.HttpGrpcAccessLogConfig{
+		CommonConfig: &alspb.CommonGrpcAccessLogConfig{
+			LogName: statPrefix,
+			GrpcService: &corepb.GrpcService{
+				TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &corepb.GrpcService_EnvoyGrpc{
+						ClusterName: util.AccessLogServiceClusterName,
 					},
 				},
 			},
+			TransportApiVersion: corepb.ApiVersion_V3,
 		},
-		FilterChains: []*listenerpb.FilterChain{filterChain},
 	}
 
-	if serviceInfo.Options.ConnectionBufferLimitBytes >= 0 {
-		listener.PerConnectionBufferLimitBytes = &wrapperspb.UInt32Value{
-			Value: uint32(serviceInfo.Options.ConnectionBufferLimitBytes),
+	if opts.AccessLogServiceBufferSizeBytes > 0 {
+		grpcAccessLog.CommonConfig.BufferSizeBytes = &wrapperspb.UInt32Value{
+			Value: uint32(opts.AccessLogServiceBufferSizeBytes),
 		}
 	}
+	if opts.AccessLogServiceBufferFlushInterval > 0 {
+		grpcAccessLog.CommonConfig.BufferFlushInterval = ptypes.DurationProto(opts.AccessLogServiceBufferFlushInterval)
+	}
+	if opts.AccessLogServiceRequestHeaders != "" {
+		grpcAccessLog.AdditionalRequestHeadersToLog = strings.Split(opts.AccessLogServiceRequestHeaders, ",")
+	}
+	if opts.AccessLogServiceResponseHeaders != "" {
+		grpcAccessLog.AdditionalResponseHeadersToLog = strings.Split(opts.AccessLogServiceResponseHeaders, ",")
+	}
 
-	return listener, nil
+	filter, err := makeAccessLogFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	serialized, _ := ptypes.MarshalAny(grpcAccessLog)
+	return &acpb.AccessLog{
+		Name:   util.HttpGrpcAccessLogger,
+		Filter: filter,
+		ConfigType: &acpb.AccessLog_TypedConfig{
+			TypedConfig: serialized,
+		},
+	}, nil
 }
 
-func makeHttpConMgr(opts *options.ConfigGeneratorOptions, route *routepb.RouteConfiguration) (*hcmpb.HttpConnectionManager, error) {
-	httpConMgr := &hcmpb.HttpConnectionManager{
-		UpgradeConfigs: []*hcmpb.HttpConnectionManager_UpgradeConfig{
-			{
-				UpgradeType: "websocket",
+func makeAccessLogFilter(opts *options.ConfigGeneratorOptions) (*acpb.AccessLogFilter, error) {
+	if opts.AccessLogMinStatusCode == 0 {
+		return nil, nil
+	}
+	if opts.AccessLogMinStatusCode < 100 || opts.AccessLogMinStatusCode > 599 {
+		return nil, fmt.Errorf("invalid --access_log_min_status_code %d, must be between 100 and 599", opts.AccessLogMinStatusCode)
+	}
+	return &acpb.AccessLogFilter{
+		FilterSpecifier: &acpb.AccessLogFilter_StatusCodeFilter{
+			StatusCodeFilter: &acpb.StatusCodeFilter{
+				Comparison: &acpb.ComparisonFilter{
+					Op: acpb.ComparisonFilter_GE,
+					Value: &corepb.RuntimeUInt32{
+						DefaultValue: uint32(opts.AccessLogMinStatusCode),
+						RuntimeKey:   "access_log.min_status_code",
+					},
+				},
 			},
 		},
-		CodecType:  hcmpb.HttpConnectionManager_AUTO,
-		StatPrefix: statPrefix,
-		RouteSpecifier: &hcmpb.HttpConnectionManager_RouteConfig{
-			RouteConfig: route,
-		},
-		UseRemoteAddress:  &wrapperspb.BoolValue{Value: opts.EnvoyUseRemoteAddress},
-		XffNumTrustedHops: uint32(opts.EnvoyXffNumTrustedHops),
-		// Converting the error message for requests rejected by Envoy to JSON format:
-		//
-		//    {
-		//       "code": "http-status-code",
-		//       "message": "the error message",
-		//    }
-		//
-		LocalReplyConfig: &hcmpb.LocalReplyConfig{
-			BodyFormat: &corepb.SubstitutionFormatString{
-				Format: &corepb.SubstitutionFormatString_JsonFormat{
-					JsonFormat: &structpb.Struct{
-						Fields: map[string]*structpb.Value{
-							"code": {
-								Kind: &structpb.Value_StringValue{StringValue: "%RESPONSE_CODE%"},
-							},
-							"message": {
-								Kind: &structpb.Value_StringValue{StringValue: "%LOCAL_REPLY_BODY%"},
-							},
-						},
+	}, nil
+}
+
+// makeLocalReplyJsonFormat returns the JSON format of the error responses
+// generated by Envoy. By default it is:
+//
+//    {
+//       "code": "http-status-code",
+//       "message": "the error message",
+//    }
+//
+// It can be replaced by --local_reply_json_format, and a "details" field is
+// added if --local_reply_include_details is set. Like the details of a
+// google.rpc.Status, it is a list, with a google.rpc.ErrorInfo having the
+// response code details in its metadata.
+func makeLocalReplyJsonFormat(opts *options.ConfigGeneratorOptions) (*structpb.Struct, error) {
+	jsonFormat, err := parseLocalReplyJsonFormat(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.LocalReplyIncludeDetails {
+		if _, ok := jsonFormat.Fields["details"]; ok {
+			return nil, fmt.Errorf("--local_reply_json_format cannot have the field \"details\" when --local_reply_include_details is set")
+		}
+		jsonFormat.Fields["details"] = &structpb.Value{
+			Kind: &structpb.Value_ListValue{
+				ListValue: &structpb.ListValue{
+					Values: []*structpb.Value{
+						structValue(map[string]*structpb.Value{
+							"@type": stringValue("type.googleapis.com/google.rpc.ErrorInfo"),
+							"metadata": structValue(map[string]*structpb.Value{
+								"response_code_details": stringValue("%RESPONSE_CODE_DETAILS%"),
+							}),
+						}),
 					},
 				},
 			},
+		}
+	}
+	return jsonFormat, nil
+}
+
+// parseLocalReplyJsonFormat returns --local_reply_json_format, or the default
+// JSON format of the error responses if it is not set.
+func parseLocalReplyJsonFormat(opts *options.ConfigGeneratorOptions) (*structpb.Struct, error) {
+	jsonFormat := &structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			"code": {
+				Kind: &structpb.Value_StringValue{StringValue: "%RESPONSE_CODE%"},
+			},
+			"message": {
+				Kind: &structpb.Value_StringValue{StringValue: "%LOCAL_REPLY_BODY%"},
+			},
 		},
 	}
 
-	if opts.AccessLog != "" {
-		fileAccessLog := &facpb.FileAccessLog{
-			Path: opts.AccessLog,
+	if opts.LocalReplyJsonFormat != "" {
+		jsonFormat = &structpb.Struct{}
+		if err := jsonpb.UnmarshalString(opts.LocalReplyJsonFormat, jsonFormat); err != nil {
+			return nil, fmt.Errorf("invalid --local_reply_json_format %q, must be a JSON object: %v", opts.LocalReplyJsonFormat, err)
 		}
-
-		if opts.AccessLogFormat != "" {
-			fileAccessLog.AccessLogFormat = &facpb.FileAccessLog_LogFormat{
-				LogFormat: &corepb.SubstitutionFormatString{
-					Format: &corepb.SubstitutionFormatString_TextFormat{
-						TextFormat: opts.AccessLogFormat,
-					},
-				},
-			}
+		if len(jsonFormat.GetFields()) == 0 {
+			return nil, fmt.Errorf("invalid --local_reply_json_format %q, must have at least one field", opts.LocalReplyJsonFormat)
 		}
+	}
+	return jsonFormat, nil
+}
 
-		serialized, _ := ptypes.MarshalAny(fileAccessLog)
+// makeGrpcStatusMappingFilter makes the gRPC Status Mapping filter. If the
+// transcoded gRPC errors of some methods are formatted, they get the JSON
+// format of the local replies, with the error_info and help fields, and with
+// the details of their google.rpc.Status as the "details" list if
+// --local_reply_include_details is set.
+func makeGrpcStatusMappingFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
+	filter := &hcmpb.HttpFilter{
+		Name: util.GrpcStatusMapping,
+	}
+	if !needGrpcErrorBodyFormat(serviceInfo) {
+		return filter, nil
+	}
 
-		httpConMgr.AccessLog = []*acpb.AccessLog{
-			{
-				Name:   util.AccessFileLogger,
-				Filter: nil,
-				ConfigType: &acpb.AccessLog_TypedConfig{
-					TypedConfig: serialized,
-				},
-			},
+	jsonFormat, err := parseLocalReplyJsonFormat(&serviceInfo.Options)
+	if err != nil {
+		return nil, err
+	}
+	if err := addErrorInfoFields(&serviceInfo.Options, jsonFormat, localReplyBackendErrorReason); err != nil {
+		return nil, err
+	}
+	gsmConfig, err := ptypes.MarshalAny(&gsmpb.FilterConfig{
+		ErrorBodyFormat: jsonFormat,
+		IncludeDetails:  serviceInfo.Options.LocalReplyIncludeDetails,
+	})
+	if err != nil {
+		return nil, err
+	}
+	filter.ConfigType = &hcmpb.HttpFilter_TypedConfig{
+		TypedConfig: gsmConfig,
+	}
+	return filter, nil
+}
+
+func needPathRewrite(serviceInfo *sc.ServiceInfo) bool {
+	for _, method := range serviceInfo.Methods {
+		for _, httpRule := range method.HttpRule {
+			if pr := MakePathRewriteConfig(method, httpRule); pr != nil {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	if !opts.DisableTracing {
-		var err error
-		httpConMgr.Tracing, err = tracing.CreateTracing(opts.CommonOptions)
-		if err != nil {
-			return nil, err
+func needConcurrencyLimit(serviceInfo *sc.ServiceInfo) bool {
+	for _, method := range serviceInfo.Methods {
+		if method.MaxConcurrentRequests > 0 {
+			return true
 		}
 	}
+	return false
+}
 
-	if opts.UnderscoresInHeaders {
-		httpConMgr.CommonHttpProtocolOptions = &corepb.HttpProtocolOptions{
-			HeadersWithUnderscoresAction: corepb.HttpProtocolOptions_ALLOW,
+func needGrpcStatusMapping(serviceInfo *sc.ServiceInfo) bool {
+	for _, method := range serviceInfo.Methods {
+		if len(method.GrpcStatusHttpCodes) > 0 || method.FormatGrpcErrorBody {
+			return true
 		}
-	} else {
-		httpConMgr.CommonHttpProtocolOptions = &corepb.HttpProtocolOptions{
-			HeadersWithUnderscoresAction: corepb.HttpProtocolOptions_REJECT_REQUEST,
+	}
+	return false
+}
+
+func needStreamFormat(serviceInfo *sc.ServiceInfo) bool {
+	for _, method := range serviceInfo.Methods {
+		if method.StreamFormat != "" {
+			return true
 		}
 	}
+	return false
+}
 
-	if opts.EnableGrpcForHttp1 {
-		// Retain gRPC trailers if downstream is using http1.
-		httpConMgr.HttpProtocolOptions = &corepb.Http1ProtocolOptions{
-			EnableTrailers: true,
+func needQueryRewrite(serviceInfo *sc.ServiceInfo) bool {
+	for _, method := range serviceInfo.Methods {
+		if method.StripQueryArrayBrackets {
+			return true
 		}
 	}
+	return false
+}
 
-	return httpConMgr, nil
+func needGrpcErrorBodyFormat(serviceInfo *sc.ServiceInfo) bool {
+	for _, method := range serviceInfo.Methods {
+		if method.FormatGrpcErrorBody {
+			return true
+		}
+	}
+	return false
 }
 
-func needPathRewrite(serviceInfo *sc.ServiceInfo) bool {
+func needEtag(serviceInfo *sc.ServiceInfo) bool {
 	for _, method := range serviceInfo.Methods {
-		for _, httpRule := range method.HttpRule {
-			if pr := MakePathRewriteConfig(method, httpRule); pr != nil {
-				return true
-			}
+		if method.EnableEtag {
+			return true
 		}
 	}
 	return false
@@ -370,6 +967,19 @@ func processJwtLocations(provider *confpb.AuthProvider) ([]*jwtpb.JwtHeader, []s
 	return jwtHeaders, jwtParams
 }
 
+// emptyJwks has no keys, so it rejects all the tokens.
+const emptyJwks = `{"keys":[]}`
+
+func makeLocalJwks(jwks string) *jwtpb.JwtProvider_LocalJwks {
+	return &jwtpb.JwtProvider_LocalJwks{
+		LocalJwks: &corepb.DataSource{
+			Specifier: &corepb.DataSource_InlineString{
+				InlineString: jwks,
+			},
+		},
+	}
+}
+
 func makeJwtAuthnFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 	auth := serviceInfo.ServiceConfig().GetAuthentication()
 	if len(auth.GetProviders()) == 0 {
@@ -377,33 +987,40 @@ func makeJwtAuthnFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 	}
 	providers := make(map[string]*jwtpb.JwtProvider)
 	for _, provider := range auth.GetProviders() {
-		addr, err := util.ExtraAddressFromURI(provider.GetJwksUri())
-		if err != nil {
-			return nil
-		}
-		clusterName := util.JwtProviderClusterName(addr)
 		fromHeaders, fromParams := processJwtLocations(provider)
 
 		jp := &jwtpb.JwtProvider{
-			Issuer: provider.GetIssuer(),
-			JwksSourceSpecifier: &jwtpb.JwtProvider_RemoteJwks{
+			Issuer:               provider.GetIssuer(),
+			FromHeaders:          fromHeaders,
+			FromParams:           fromParams,
+			ForwardPayloadHeader: serviceInfo.Options.GeneratedHeaderPrefix + util.JwtAuthnForwardPayloadHeaderSuffix,
+			Forward:              true,
+		}
+		if serviceInfo.DeferredOpenIDProviders[provider.GetId()] {
+			// The jwks_uri is not discovered yet, so no token is accepted.
+			jp.JwksSourceSpecifier = makeLocalJwks(emptyJwks)
+		} else if jwks, ok := serviceInfo.CachedJwks[provider.GetId()]; ok {
+			// The jwks_uri was unavailable when the config was generated.
+			jp.JwksSourceSpecifier = makeLocalJwks(jwks)
+		} else {
+			addr, err := util.ExtraAddressFromURI(provider.GetJwksUri())
+			if err != nil {
+				return nil
+			}
+			jp.JwksSourceSpecifier = &jwtpb.JwtProvider_RemoteJwks{
 				RemoteJwks: &jwtpb.RemoteJwks{
 					HttpUri: &corepb.HttpUri{
 						Uri: provider.GetJwksUri(),
 						HttpUpstreamType: &corepb.HttpUri_Cluster{
-							Cluster: clusterName,
+							Cluster: util.JwtProviderClusterName(addr),
 						},
-						Timeout: ptypes.DurationProto(serviceInfo.Options.HttpRequestTimeout),
+						Timeout: ptypes.DurationProto(serviceInfo.CalloutTimeout(sc.JwksCallout)),
 					},
 					CacheDuration: &durationpb.Duration{
 						Seconds: int64(serviceInfo.Options.JwksCacheDurationInS),
 					},
 				},
-			},
-			FromHeaders:          fromHeaders,
-			FromParams:           fromParams,
-			ForwardPayloadHeader: serviceInfo.Options.GeneratedHeaderPrefix + util.JwtAuthnForwardPayloadHeaderSuffix,
-			Forward:              true,
+			}
 		}
 
 		if len(provider.GetAudiences()) != 0 {
@@ -430,9 +1047,27 @@ func makeJwtAuthnFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 	}
 
 	requirements := make(map[string]*jwtpb.JwtRequirement)
-	for _, rule := range auth.GetRules() {
+	for _, rule := range serviceInfo.AuthenticationRules() {
 		if len(rule.GetRequirements()) > 0 {
-			requirements[rule.GetSelector()] = makeJwtRequirement(rule.GetRequirements(), rule.GetAllowWithoutCredential())
+			requirement := makeJwtRequirement(rule.GetRequirements(), rule.GetAllowWithoutCredential())
+			if method := serviceInfo.Methods[rule.GetSelector()]; method != nil && method.AuditMode {
+				// The failures are logged and reported by the service control filter.
+				requirement = &jwtpb.JwtRequirement{
+					RequiresType: &jwtpb.JwtRequirement_RequiresAny{
+						RequiresAny: &jwtpb.JwtRequirementOrList{
+							Requirements: []*jwtpb.JwtRequirement{
+								requirement,
+								{
+									RequiresType: &jwtpb.JwtRequirement_AllowMissingOrFailed{
+										AllowMissingOrFailed: &emptypb.Empty{},
+									},
+								},
+							},
+						},
+					},
+				}
+			}
+			requirements[rule.GetSelector()] = requirement
 		}
 	}
 
@@ -449,6 +1084,33 @@ func makeJwtAuthnFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 	return jwtAuthnFilter
 }
 
+// makeRbacFilter creates an RBAC filter with the deny rules, if any. The caller
+// allowlists are enforced by the per-route configs, which deny the same
+// requests since they replace the rules of the filter.
+func makeRbacFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
+	denyPermissions := makeDenyPermissions(serviceInfo)
+	needRbac := len(denyPermissions) > 0
+	for _, method := range serviceInfo.Methods {
+		if len(method.AllowedCallers) > 0 {
+			needRbac = true
+			break
+		}
+	}
+	if !needRbac {
+		return nil
+	}
+
+	rbacConfig := &rbacpb.RBAC{}
+	if len(denyPermissions) > 0 {
+		rbacConfig.Rules = makeDenyRulesRbac(denyPermissions)
+	}
+	rbac, _ := ptypes.MarshalAny(rbacConfig)
+	return &hcmpb.HttpFilter{
+		Name:       util.RBAC,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{TypedConfig: rbac},
+	}
+}
+
 func makeJwtRequirement(requirements []*confpb.AuthRequirement, allow_missing bool) *jwtpb.JwtRequirement {
 	// By default, if there are multi requirements, treat it as RequireAny.
 	requires := &jwtpb.JwtRequirement{
@@ -499,10 +1161,81 @@ func makeJwtRequirement(requirements []*confpb.AuthRequirement, allow_missing bo
 	return requires
 }
 
-func makeServiceControlCallingConfig(opts options.ConfigGeneratorOptions) *scpb.ServiceControlCallingConfig {
+// parseServiceControlLabels parses "LABEL=VALUE[,LABEL=VALUE...]" into ordered
+// label and value pairs.
+func parseServiceControlLabels(s string) ([][2]string, error) {
+	var labels [][2]string
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("label %q must be in the format LABEL=VALUE", entry)
+		}
+		labels = append(labels, [2]string{strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])})
+	}
+	return labels, nil
+}
+
+// parseReportRedaction parses "FIELD=ACTION[,FIELD=ACTION...]" into the
+// redaction of the service control Report.
+func parseReportRedaction(s string) (*scpb.ReportRedaction, error) {
+	redaction := &scpb.ReportRedaction{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("entry %q must be in the format FIELD=ACTION", entry)
+		}
+
+		field, actionName := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		action, ok := scpb.ReportRedaction_Action_value[strings.ToUpper(actionName)]
+		if !ok {
+			return nil, fmt.Errorf("unknown action %q in entry %q, must be one of keep, drop or hash", actionName, entry)
+		}
+
+		switch {
+		case field == "url_query":
+			redaction.UrlQuery = scpb.ReportRedaction_Action(action)
+		case field == "client_ip":
+			redaction.ClientIp = scpb.ReportRedaction_Action(action)
+		case field == "referer":
+			redaction.Referer = scpb.ReportRedaction_Action(action)
+		case strings.HasPrefix(field, "header:") && strings.TrimPrefix(field, "header:") != "":
+			if redaction.RequestHeaders == nil {
+				redaction.RequestHeaders = make(map[string]scpb.ReportRedaction_Action)
+			}
+			redaction.RequestHeaders[strings.ToLower(strings.TrimPrefix(field, "header:"))] = scpb.ReportRedaction_Action(action)
+		default:
+			return nil, fmt.Errorf("unknown field %q in entry %q, must be one of url_query, client_ip, referer or header:NAME", field, entry)
+		}
+	}
+	return redaction, nil
+}
+
+// makeServiceControlCallingConfig makes the service control calling config of
+// the options, with the timeout and retries of the service_control callout
+// policy, if any, as the default of the Check, Quota and Report ones.
+func makeServiceControlCallingConfig(opts options.ConfigGeneratorOptions, policy *sc.CalloutPolicy) *scpb.ServiceControlCallingConfig {
 	setting := &scpb.ServiceControlCallingConfig{}
 	setting.NetworkFailOpen = &wrapperspb.BoolValue{Value: opts.ServiceControlNetworkFailOpen}
 
+	if policy != nil {
+		if policy.Timeout > 0 {
+			timeoutMs := &wrapperspb.UInt32Value{Value: uint32(policy.Timeout / time.Millisecond)}
+			setting.CheckTimeoutMs, setting.QuotaTimeoutMs, setting.ReportTimeoutMs = timeoutMs, timeoutMs, timeoutMs
+		}
+		if policy.Retries > -1 {
+			retries := &wrapperspb.UInt32Value{Value: uint32(policy.Retries)}
+			setting.CheckRetries, setting.QuotaRetries, setting.ReportRetries = retries, retries, retries
+		}
+	}
+
 	if opts.ScCheckTimeoutMs > 0 {
 		setting.CheckTimeoutMs = &wrapperspb.UInt32Value{Value: uint32(opts.ScCheckTimeoutMs)}
 	}
@@ -522,9 +1255,61 @@ func makeServiceControlCallingConfig(opts options.ConfigGeneratorOptions) *scpb.
 	if opts.ScReportRetries > -1 {
 		setting.ReportRetries = &wrapperspb.UInt32Value{Value: uint32(opts.ScReportRetries)}
 	}
+
+	if opts.ScCheckCacheEntries > 0 {
+		setting.CheckCacheEntries = &wrapperspb.UInt32Value{Value: uint32(opts.ScCheckCacheEntries)}
+	}
+	if opts.ScCheckCacheExpirationMs > 0 {
+		setting.CheckCacheExpirationMs = &wrapperspb.UInt32Value{Value: uint32(opts.ScCheckCacheExpirationMs)}
+	}
+	if opts.ScApiKeyGracePeriodMs > 0 {
+		setting.ApiKeyGracePeriodMs = &wrapperspb.UInt32Value{Value: uint32(opts.ScApiKeyGracePeriodMs)}
+		setting.ApiKeyGraceCachePath = opts.ScApiKeyGraceCachePath
+	}
 	return setting
 }
 
+// makeGcpAttributes overrides the attributes of the metadata server with the
+// ones of --gcp_attributes_file, then with the ones of the flags.
+func makeGcpAttributes(serviceInfo *sc.ServiceInfo) (*scpb.GcpAttributes, error) {
+	var attrs *scpb.GcpAttributes
+	if serviceInfo.GcpAttributes != nil {
+		attrs = proto.Clone(serviceInfo.GcpAttributes).(*scpb.GcpAttributes)
+	}
+	override := func(projectId, zone, platform string) {
+		if projectId == "" && zone == "" && platform == "" {
+			return
+		}
+		if attrs == nil {
+			attrs = &scpb.GcpAttributes{}
+		}
+		if projectId != "" {
+			attrs.ProjectId = projectId
+		}
+		if zone != "" {
+			attrs.Zone = zone
+		}
+		if platform != "" {
+			attrs.Platform = platform
+		}
+	}
+
+	opts := serviceInfo.Options
+	if opts.GcpAttributesFile != "" {
+		data, err := ioutil.ReadFile(opts.GcpAttributesFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read gcp_attributes_file %s: %v", opts.GcpAttributesFile, err)
+		}
+		fileAttrs := &scpb.GcpAttributes{}
+		if err := jsonpb.UnmarshalString(string(data), fileAttrs); err != nil {
+			return nil, fmt.Errorf("fail to parse gcp_attributes_file %s: %v", opts.GcpAttributesFile, err)
+		}
+		override(fileAttrs.GetProjectId(), fileAttrs.GetZone(), fileAttrs.GetPlatform())
+	}
+	override(opts.GcpProjectIdOverride, opts.GcpZoneOverride, opts.ComputePlatformOverride)
+	return attrs, nil
+}
+
 func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
 	if serviceInfo == nil || serviceInfo.ServiceConfig().GetControl().GetEnvironment() == "" {
 		return nil, nil
@@ -547,6 +1332,7 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, e
 		ProducerProjectId: serviceInfo.ServiceConfig().GetProducerProjectId(),
 		ServiceConfig:     copyServiceConfigForReportMetrics(serviceInfo.ServiceConfig()),
 		BackendProtocol:   protocol,
+		RolloutConfigIds:  makeRolloutConfigIds(serviceInfo.RolloutPercentages),
 	}
 
 	if serviceInfo.Options.LogRequestHeaders != "" {
@@ -567,21 +1353,62 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, e
 			service.LogJwtPayloads[i] = strings.TrimSpace(service.LogJwtPayloads[i])
 		}
 	}
+	if serviceInfo.Options.ScCustomLabels != "" {
+		labels, err := parseServiceControlLabels(serviceInfo.Options.ScCustomLabels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --service_control_custom_labels: %v", err)
+		}
+		service.CustomLabels = make(map[string]string)
+		for _, l := range labels {
+			service.CustomLabels[l[0]] = l[1]
+		}
+	}
+	if serviceInfo.Options.ScHeaderLabels != "" {
+		labels, err := parseServiceControlLabels(serviceInfo.Options.ScHeaderLabels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --service_control_header_labels: %v", err)
+		}
+		for _, l := range labels {
+			service.HeaderLabels = append(service.HeaderLabels, &scpb.HeaderLabel{
+				Label:  l[0],
+				Header: strings.ToLower(l[1]),
+			})
+		}
+	}
+	if serviceInfo.Options.ScReportRedaction != "" {
+		redaction, err := parseReportRedaction(serviceInfo.Options.ScReportRedaction)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --service_control_report_redaction: %v", err)
+		}
+		service.ReportRedaction = redaction
+	}
 	if serviceInfo.Options.MinStreamReportIntervalMs != 0 {
 		service.MinStreamReportIntervalMs = serviceInfo.Options.MinStreamReportIntervalMs
 	}
 	service.JwtPayloadMetadataName = util.JwtPayloadMetadataName
 	filterConfig := &scpb.FilterConfig{
 		Services:        []*scpb.Service{service},
-		ScCallingConfig: makeServiceControlCallingConfig(serviceInfo.Options),
+		ScCallingConfig: makeServiceControlCallingConfig(serviceInfo.Options, serviceInfo.CalloutPolicies[sc.ServiceControlCallout]),
 		ServiceControlUri: &commonpb.HttpUri{
 			Uri:     serviceInfo.ServiceControlURI,
 			Cluster: util.ServiceControlClusterName,
-			Timeout: ptypes.DurationProto(serviceInfo.Options.HttpRequestTimeout),
+			Timeout: ptypes.DurationProto(serviceInfo.CalloutTimeout(sc.ServiceControlCallout)),
 		},
 		GeneratedHeaderPrefix: serviceInfo.Options.GeneratedHeaderPrefix,
 	}
 
+	consumerHeaders, err := parseBackendConsumerHeaders(serviceInfo.Options.BackendConsumerHeaders)
+	if err != nil {
+		return nil, err
+	}
+	filterConfig.ConsumerHeaders = consumerHeaders
+
+	consumerTiers, err := makeConsumerTiers(serviceInfo.Options)
+	if err != nil {
+		return nil, err
+	}
+	filterConfig.ConsumerTiers = consumerTiers
+
 	if serviceInfo.Options.ServiceControlCredentials != nil {
 		// Use access token fetched from Google Cloud IAM Server to talk to Service Controller
 		filterConfig.AccessToken = &scpb.FilterConfig_IamToken{
@@ -589,7 +1416,7 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, e
 				IamUri: &commonpb.HttpUri{
 					Uri:     fmt.Sprintf("%s%s", serviceInfo.Options.IamURL, util.IamAccessTokenPath(serviceInfo.Options.ServiceControlCredentials.ServiceAccountEmail)),
 					Cluster: util.IamServerClusterName,
-					Timeout: ptypes.DurationProto(serviceInfo.Options.HttpRequestTimeout),
+					Timeout: ptypes.DurationProto(serviceInfo.CalloutTimeout(sc.IamCallout)),
 				},
 				ServiceAccountEmail: serviceInfo.Options.ServiceControlCredentials.ServiceAccountEmail,
 				Delegates:           serviceInfo.Options.ServiceControlCredentials.Delegates,
@@ -603,15 +1430,11 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, e
 
 	}
 
-	if serviceInfo.GcpAttributes != nil {
-		filterConfig.GcpAttributes = serviceInfo.GcpAttributes
-	}
-	if serviceInfo.Options.ComputePlatformOverride != "" {
-		if filterConfig.GcpAttributes == nil {
-			filterConfig.GcpAttributes = &scpb.GcpAttributes{}
-		}
-		filterConfig.GcpAttributes.Platform = serviceInfo.Options.ComputePlatformOverride
+	gcpAttributes, err := makeGcpAttributes(serviceInfo)
+	if err != nil {
+		return nil, err
 	}
+	filterConfig.GcpAttributes = gcpAttributes
 
 	for _, operation := range serviceInfo.Operations {
 		method := serviceInfo.Methods[operation]
@@ -622,6 +1445,14 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, e
 			ApiVersion:         method.ApiVersion,
 			SkipServiceControl: method.SkipServiceControl,
 			MetricCosts:        method.MetricCosts,
+			ScCallingConfig:    method.ScCallingConfig,
+			SkipCheck:          method.SkipServiceControlCheck,
+			AuditMode:          method.AuditMode,
+			AuditJwtAuthn:      method.AuditMode && method.RequireAuth,
+		}
+
+		if method.IsStreaming && serviceInfo.Options.StreamIntermediateReports {
+			requirement.SendIntermediateReports = true
 		}
 
 		// For these OPTIONS methods, auth should be disabled and AllowWithoutApiKey
@@ -659,6 +1490,30 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, e
 	return filter, nil
 }
 
+// makeRolloutConfigIds sorts the config ids of a rollout in progress by id,
+// so the requests are assigned to them in the same order by all the proxies.
+// A single config id takes all the traffic, nothing is returned for it.
+func makeRolloutConfigIds(percentages map[string]float64) []*scpb.RolloutConfigId {
+	if len(percentages) < 2 {
+		return nil
+	}
+
+	var configIds []string
+	for configId := range percentages {
+		configIds = append(configIds, configId)
+	}
+	sort.Strings(configIds)
+
+	rolloutConfigIds := make([]*scpb.RolloutConfigId, 0, len(configIds))
+	for _, configId := range configIds {
+		rolloutConfigIds = append(rolloutConfigIds, &scpb.RolloutConfigId{
+			ServiceConfigId: configId,
+			TrafficPercent:  percentages[configId],
+		})
+	}
+	return rolloutConfigIds
+}
+
 func copyServiceConfigForReportMetrics(src *confpb.Service) *confpb.Service {
 	// Logs and metrics fields are needed by the Envoy HTTP filter
 	// to generate proper Metrics for Report calls.
@@ -672,52 +1527,127 @@ func copyServiceConfigForReportMetrics(src *confpb.Service) *confpb.Service {
 }
 
 func makeTranscoderFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
+	transcodeConfig := makeTranscoderConfig(serviceInfo)
+	if transcodeConfig == nil {
+		return nil
+	}
+
+	transcodeConfigStruct, _ := ptypes.MarshalAny(transcodeConfig)
+	transcodeFilter := &hcmpb.HttpFilter{
+		Name:       util.GRPCJSONTranscoder,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{transcodeConfigStruct},
+	}
+	return transcodeFilter
+}
+
+// makeTranscoderConfig returns the config of the grpc_json_transcoder filter
+// of all the transcoded methods, or nil if there is no proto descriptor to
+// transcode them with.
+func makeTranscoderConfig(serviceInfo *sc.ServiceInfo) *transcoderpb.GrpcJsonTranscoder {
+	configContent := transcoderProtoDescriptor(serviceInfo)
+	if configContent == nil {
+		// b/148605552: Previous versions of the `gcloud_build_image` script did not download the proto descriptor.
+		// We cannot ensure that users have the latest version of the script, so notify them via non-fatal logs.
+		// Log as error instead of warning because error logs will show up even if `--enable_debug` is false.
+		glog.Error("Unable to setup gRPC-JSON transcoding because no proto descriptor was found in the service config. " +
+			"Please use version 2020-01-29 (or later) of the `gcloud_build_image` script. " +
+			"https://github.com/GoogleCloudPlatform/esp-v2/blob/master/docker/serverless/gcloud_build_image")
+		return nil
+	}
+	if serviceInfo.Options.ApiBasePath != "" {
+		prefixed, err := prefixTranscoderHttpRules(configContent, serviceInfo.GrpcApiNames, serviceInfo.Options.ApiBasePath)
+		if err != nil {
+			glog.Errorf("Unable to setup gRPC-JSON transcoding under --api_base_path: %v", err)
+			return nil
+		}
+		configContent = prefixed
+	}
+
+	ignoredQueryParameterList := []string{}
+	for IgnoredQueryParameter := range serviceInfo.AllTranscodingIgnoredQueryParams {
+		ignoredQueryParameterList = append(ignoredQueryParameterList, IgnoredQueryParameter)
+
+	}
+	sort.Sort(sort.StringSlice(ignoredQueryParameterList))
+
+	// The transcoder binds query parameters to the request message: nested
+	// fields use the "obj.field=value" style and repeated fields use the
+	// "param=a&param=b" style. The "param[]=a" style is rewritten to the
+	// latter by Query Rewrite filter, with --transcoding_query_array_style.
+	transcodeConfig := &transcoderpb.GrpcJsonTranscoder{
+		DescriptorSet: &transcoderpb.GrpcJsonTranscoder_ProtoDescriptorBin{
+			ProtoDescriptorBin: configContent,
+		},
+		AutoMapping:                  true,
+		ConvertGrpcStatus:            true,
+		IgnoredQueryParameters:       ignoredQueryParameterList,
+		IgnoreUnknownQueryParameters: serviceInfo.Options.TranscodingIgnoreUnknownQueryParameters,
+		PrintOptions: &transcoderpb.GrpcJsonTranscoder_PrintOptions{
+			AlwaysPrintPrimitiveFields: serviceInfo.Options.TranscodingAlwaysPrintPrimitiveFields,
+			AlwaysPrintEnumsAsInts:     serviceInfo.Options.TranscodingAlwaysPrintEnumsAsInts,
+			PreserveProtoFieldNames:    serviceInfo.Options.TranscodingPreserveProtoFieldNames,
+		},
+	}
+
+	transcodeConfig.Services = append(transcodeConfig.Services, serviceInfo.GrpcApiNames...)
+	return transcodeConfig
+}
+
+// transcoderProtoDescriptor returns the proto descriptor specified by
+// --transcoding_proto_descriptor if any, otherwise the one in the service config.
+// With --transcoding_proto_descriptor_merge, the former is merged into the
+// latter.
+func transcoderProtoDescriptor(serviceInfo *sc.ServiceInfo) []byte {
+	var serviceConfigDescriptor []byte
 	for _, sourceFile := range serviceInfo.ServiceConfig().GetSourceInfo().GetSourceFiles() {
 		configFile := &smpb.ConfigFile{}
 		ptypes.UnmarshalAny(sourceFile, configFile)
 
 		if configFile.GetFileType() == smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO {
-			ignoredQueryParameterList := []string{}
-			for IgnoredQueryParameter := range serviceInfo.AllTranscodingIgnoredQueryParams {
-				ignoredQueryParameterList = append(ignoredQueryParameterList, IgnoredQueryParameter)
-
-			}
-			sort.Sort(sort.StringSlice(ignoredQueryParameterList))
+			serviceConfigDescriptor = configFile.GetFileContents()
+			break
+		}
+	}
 
-			configContent := configFile.GetFileContents()
-			transcodeConfig := &transcoderpb.GrpcJsonTranscoder{
-				DescriptorSet: &transcoderpb.GrpcJsonTranscoder_ProtoDescriptorBin{
-					ProtoDescriptorBin: configContent,
-				},
-				AutoMapping:                  true,
-				ConvertGrpcStatus:            true,
-				IgnoredQueryParameters:       ignoredQueryParameterList,
-				IgnoreUnknownQueryParameters: serviceInfo.Options.TranscodingIgnoreUnknownQueryParameters,
-				PrintOptions: &transcoderpb.GrpcJsonTranscoder_PrintOptions{
-					AlwaysPrintPrimitiveFields: serviceInfo.Options.TranscodingAlwaysPrintPrimitiveFields,
-					AlwaysPrintEnumsAsInts:     serviceInfo.Options.TranscodingAlwaysPrintEnumsAsInts,
-					PreserveProtoFieldNames:    serviceInfo.Options.TranscodingPreserveProtoFieldNames,
-				},
-			}
+	if len(serviceInfo.TranscodingProtoDescriptor) == 0 {
+		return serviceConfigDescriptor
+	}
+	if !serviceInfo.Options.TranscodingProtoDescriptorMerge || serviceConfigDescriptor == nil {
+		return serviceInfo.TranscodingProtoDescriptor
+	}
+	merged, err := mergeProtoDescriptors(serviceConfigDescriptor, serviceInfo.TranscodingProtoDescriptor)
+	if err != nil {
+		glog.Errorf("Unable to merge --transcoding_proto_descriptor into the proto descriptor of the service config, using it alone: %v", err)
+		return serviceInfo.TranscodingProtoDescriptor
+	}
+	return merged
+}
 
-			transcodeConfig.Services = append(transcodeConfig.Services, serviceInfo.ApiNames...)
+// mergeProtoDescriptors adds the files of the serialized FileDescriptorSet to
+// the base one. Its files replace the base files of the same name, so the
+// separately managed protos take precedence over the service config.
+func mergeProtoDescriptors(base, descriptor []byte) ([]byte, error) {
+	baseSet, descriptorSet := &descpb.FileDescriptorSet{}, &descpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(base, baseSet); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal the proto descriptor of the service config, %v", err)
+	}
+	if err := proto.Unmarshal(descriptor, descriptorSet); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal the proto descriptor, %v", err)
+	}
 
-			transcodeConfigStruct, _ := ptypes.MarshalAny(transcodeConfig)
-			transcodeFilter := &hcmpb.HttpFilter{
-				Name:       util.GRPCJSONTranscoder,
-				ConfigType: &hcmpb.HttpFilter_TypedConfig{transcodeConfigStruct},
-			}
-			return transcodeFilter
+	files := make(map[string]int)
+	for i, file := range baseSet.GetFile() {
+		files[file.GetName()] = i
+	}
+	for _, file := range descriptorSet.GetFile() {
+		if i, ok := files[file.GetName()]; ok {
+			baseSet.File[i] = file
+			continue
 		}
+		files[file.GetName()] = len(baseSet.File)
+		baseSet.File = append(baseSet.File, file)
 	}
-
-	// b/148605552: Previous versions of the `gcloud_build_image` script did not download the proto descriptor.
-	// We cannot ensure that users have the latest version of the script, so notify them via non-fatal logs.
-	// Log as error instead of warning because error logs will show up even if `--enable_debug` is false.
-	glog.Error("Unable to setup gRPC-JSON transcoding because no proto descriptor was found in the service config. " +
-		"Please use version 2020-01-29 (or later) of the `gcloud_build_image` script. " +
-		"https://github.com/GoogleCloudPlatform/esp-v2/blob/master/docker/serverless/gcloud_build_image")
-	return nil
+	return proto.Marshal(baseSet)
 }
 
 func makeBackendAuthFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
@@ -755,7 +1685,7 @@ func makeBackendAuthFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, erro
 				IamUri: &commonpb.HttpUri{
 					Uri:     fmt.Sprintf("%s%s", serviceInfo.Options.IamURL, util.IamIdentityTokenPath(serviceInfo.Options.BackendAuthCredentials.ServiceAccountEmail)),
 					Cluster: util.IamServerClusterName,
-					Timeout: ptypes.DurationProto(serviceInfo.Options.HttpRequestTimeout),
+					Timeout: ptypes.DurationProto(serviceInfo.CalloutTimeout(sc.IamCallout)),
 				},
 				// Currently only support fetching access token from instance metadata
 				// server, not by service account file.
@@ -763,12 +1693,22 @@ func makeBackendAuthFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, erro
 				ServiceAccountEmail: serviceInfo.Options.BackendAuthCredentials.ServiceAccountEmail,
 				Delegates:           serviceInfo.Options.BackendAuthCredentials.Delegates,
 			}}
+	} else if serviceInfo.Options.ImpersonateServiceAccount != "" {
+		// The token agent serves the identity tokens of the impersonated service
+		// account like the metadata server.
+		backendAuthConfig.IdTokenInfo = &bapb.FilterConfig_ImdsToken{
+			ImdsToken: &commonpb.HttpUri{
+				Uri:     fmt.Sprintf("http://%s:%v%s", util.LoopbackIPv4Addr, serviceInfo.Options.TokenAgentPort, util.TokenAgentIdentityTokenPath),
+				Cluster: util.TokenAgentClusterName,
+				Timeout: ptypes.DurationProto(serviceInfo.Options.HttpRequestTimeout),
+			},
+		}
 	} else {
 		backendAuthConfig.IdTokenInfo = &bapb.FilterConfig_ImdsToken{
 			ImdsToken: &commonpb.HttpUri{
 				Uri:     fmt.Sprintf("%s%s", serviceInfo.Options.MetadataURL, util.IdentityTokenPath),
 				Cluster: util.MetadataServerClusterName,
-				Timeout: ptypes.DurationProto(serviceInfo.Options.HttpRequestTimeout),
+				Timeout: ptypes.DurationProto(serviceInfo.CalloutTimeout(sc.ImdsCallout)),
 			},
 		}
 	}
@@ -785,6 +1725,11 @@ func makeBackendAuthFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, erro
 }
 
 func makeHealthCheckFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
+	backendAware, err := isBackendAwareHealthz(serviceInfo.Options)
+	if err != nil {
+		return nil, err
+	}
+
 	hcFilterConfig := &hcpb.HealthCheck{
 		PassThroughMode: &wrapperspb.BoolValue{Value: false},
 
@@ -797,6 +1742,13 @@ func makeHealthCheckFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, erro
 			},
 		},
 	}
+	if backendAware {
+		// Fail the health check while the local backend, which is actively
+		// health checked, has no healthy host.
+		hcFilterConfig.ClusterMinHealthyPercentages = map[string]*typepb.Percent{
+			serviceInfo.LocalBackendCluster.ClusterName: {Value: minHealthyBackendPercentage},
+		}
+	}
 	hcFilterConfigStruc, err := ptypes.MarshalAny(hcFilterConfig)
 	if err != nil {
 		return nil, err
@@ -820,6 +1772,28 @@ func makeRouterFilter(opts options.ConfigGeneratorOptions) *hcmpb.HttpFilter {
 	return routerFilter
 }
 
+// parseBackendConsumerHeaders parses the comma-separated consumer info
+// forwarded to the backend. The plan or tier of the consumer is not returned
+// by the v1 Check API, so it can't be forwarded.
+func parseBackendConsumerHeaders(stringVal string) (*scpb.ConsumerHeaders, error) {
+	if stringVal == "" {
+		return nil, nil
+	}
+	consumerHeaders := &scpb.ConsumerHeaders{}
+	for _, name := range strings.Split(stringVal, ",") {
+		switch strings.TrimSpace(name) {
+		case "project_number":
+			consumerHeaders.ProjectNumber = true
+		case "api_key_hash":
+			consumerHeaders.ApiKeyHash = true
+		case "":
+		default:
+			return nil, fmt.Errorf(`invalid --backend_consumer_headers %q, must be "project_number" or "api_key_hash"`, strings.TrimSpace(name))
+		}
+	}
+	return consumerHeaders, nil
+}
+
 func parseDepErrorBehavior(stringVal string) (commonpb.DependencyErrorBehavior, error) {
 	depErrorBehaviorInt, ok := commonpb.DependencyErrorBehavior_value[stringVal]
 	if !ok {
@@ -17,17 +17,24 @@ package configgenerator
 import (
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
 	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/common"
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
 	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	anypb "github.com/golang/protobuf/ptypes/any"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
@@ -55,6 +62,7 @@ func TestTranscoderFilter(t *testing.T) {
 		transcodingPreserveProtoFieldNames      bool
 		transcodingIgnoreQueryParameters        string
 		transcodingIgnoreUnknownQueryParameters bool
+		transcodingProtoDescriptor              []byte
 		wantTranscoderFilter                    string
 	}{
 		{
@@ -112,6 +120,11 @@ func TestTranscoderFilter(t *testing.T) {
 				Apis: []*apipb.Api{
 					{
 						Name: testApiName,
+						Methods: []*apipb.Method{
+							{
+								Name: "ListShelves",
+							},
+						},
 					},
 				},
 				SourceInfo: &confpb.SourceInfo{
@@ -230,6 +243,45 @@ func TestTranscoderFilter(t *testing.T) {
 }
       `, fakeProtoDescriptor, testApiName),
 		},
+		{
+			desc: "Success. Generate transcoder filter with the proto descriptor from --transcoding_proto_descriptor",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+						Methods: []*apipb.Method{
+							{
+								Name: "foo",
+							},
+						},
+					},
+				},
+				SourceInfo: &confpb.SourceInfo{
+					SourceFiles: []*anypb.Any{content},
+				},
+			},
+			transcodingProtoDescriptor: []byte("overrideDescriptor"),
+			wantTranscoderFilter: fmt.Sprintf(`
+{
+   "name":"envoy.filters.http.grpc_json_transcoder",
+   "typedConfig":{
+      "@type":"type.googleapis.com/envoy.extensions.filters.http.grpc_json_transcoder.v3.GrpcJsonTranscoder",
+      "autoMapping":true,
+      "convertGrpcStatus":true,
+      "ignoredQueryParameters":[
+         "api_key",
+         "key"
+      ],
+      "printOptions":{},
+      "protoDescriptorBin":"%s",
+      "services":[
+         "%s"
+      ]
+   }
+}
+      `, base64.StdEncoding.EncodeToString([]byte("overrideDescriptor")), testApiName),
+		},
 	}
 
 	for i, tc := range testData {
@@ -244,6 +296,7 @@ func TestTranscoderFilter(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		fakeServiceInfo.TranscodingProtoDescriptor = tc.transcodingProtoDescriptor
 
 		marshaler := &jsonpb.Marshaler{}
 		gotFilter, err := marshaler.MarshalToString(makeTranscoderFilter(fakeServiceInfo))
@@ -257,10 +310,102 @@ func TestTranscoderFilter(t *testing.T) {
 	}
 }
 
+func TestTranscoderProtoDescriptorMerge(t *testing.T) {
+	marshalDescriptor := func(files ...*descpb.FileDescriptorProto) []byte {
+		b, err := proto.Marshal(&descpb.FileDescriptorSet{File: files})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	file := func(name, pkg string) *descpb.FileDescriptorProto {
+		return &descpb.FileDescriptorProto{Name: proto.String(name), Package: proto.String(pkg)}
+	}
+	serviceConfigDescriptor := marshalDescriptor(file("bookstore.proto", "v1"), file("common.proto", "v1"))
+	descriptorFile, _ := ptypes.MarshalAny(&smpb.ConfigFile{
+		FilePath:     "api_descriptor.pb",
+		FileContents: serviceConfigDescriptor,
+		FileType:     smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO,
+	})
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+			},
+		},
+		SourceInfo: &confpb.SourceInfo{
+			SourceFiles: []*anypb.Any{descriptorFile},
+		},
+	}
+
+	testData := []struct {
+		desc                       string
+		transcodingProtoDescriptor []byte
+		merge                      bool
+		wantDescriptor             []byte
+	}{
+		{
+			desc:           "service config proto descriptor",
+			merge:          true,
+			wantDescriptor: serviceConfigDescriptor,
+		},
+		{
+			desc:                       "proto descriptor replaces the service config one",
+			transcodingProtoDescriptor: marshalDescriptor(file("bookstore.proto", "v2")),
+			wantDescriptor:             marshalDescriptor(file("bookstore.proto", "v2")),
+		},
+		{
+			desc:                       "proto descriptor merged into the service config one",
+			transcodingProtoDescriptor: marshalDescriptor(file("bookstore.proto", "v2"), file("shelf.proto", "v2")),
+			merge:                      true,
+			wantDescriptor:             marshalDescriptor(file("bookstore.proto", "v2"), file("common.proto", "v1"), file("shelf.proto", "v2")),
+		},
+		{
+			desc:                       "invalid proto descriptor is used alone",
+			transcodingProtoDescriptor: []byte("invalid"),
+			merge:                      true,
+			wantDescriptor:             []byte("invalid"),
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.0:80"
+			opts.TranscodingProtoDescriptorMerge = tc.merge
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fakeServiceInfo.TranscodingProtoDescriptor = tc.transcodingProtoDescriptor
+
+			got := transcoderProtoDescriptor(fakeServiceInfo)
+			if string(got) == string(tc.wantDescriptor) {
+				return
+			}
+			// The merged files may be serialized differently.
+			gotSet, wantSet := &descpb.FileDescriptorSet{}, &descpb.FileDescriptorSet{}
+			if err := proto.Unmarshal(got, gotSet); err != nil {
+				t.Fatal(err)
+			}
+			if err := proto.Unmarshal(tc.wantDescriptor, wantSet); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(gotSet, wantSet) {
+				t.Errorf("got proto descriptor: %v, want: %v", gotSet, wantSet)
+			}
+		})
+	}
+}
+
 func TestJwtAuthnFilter(t *testing.T) {
 	testData := []struct {
 		desc               string
 		fakeServiceConfig  *confpb.Service
+		cachedJwks         map[string]string
+		deferredProviders  map[string]bool
+		auditMode          bool
 		wantJwtAuthnFilter string
 	}{
 		{
@@ -342,6 +487,93 @@ func TestJwtAuthnFilter(t *testing.T) {
         }
     }
 }
+`,
+		},
+		{
+			desc: "Success. Generate jwt authn filter with a wildcard selector",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "testapi",
+						Methods: []*apipb.Method{
+							{
+								Name: "foo",
+							},
+							{
+								Name: "bar",
+							},
+						},
+					},
+				},
+				SourceInfo: &confpb.SourceInfo{
+					SourceFiles: []*anypb.Any{content},
+				},
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:      "auth_provider",
+							Issuer:  "issuer-0",
+							JwksUri: "https://fake-jwks.com",
+						},
+					},
+					Rules: []*confpb.AuthenticationRule{
+						{
+							Selector: "testapi.*",
+							Requirements: []*confpb.AuthRequirement{
+								{
+									ProviderId: "auth_provider",
+								},
+							},
+						},
+					},
+				},
+			},
+			wantJwtAuthnFilter: `{
+    "name": "envoy.filters.http.jwt_authn",
+    "typedConfig": {
+        "@type": "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.JwtAuthentication",
+        "providers": {
+            "auth_provider": {
+                "audiences": [
+                    "https://bookstore.endpoints.project123.cloud.goog"
+                ],
+                "forward": true,
+                "forwardPayloadHeader": "X-Endpoint-API-UserInfo",
+                "fromHeaders": [
+                    {
+                        "name": "Authorization",
+                        "valuePrefix": "Bearer "
+                    },
+                    {
+                        "name": "X-Goog-Iap-Jwt-Assertion"
+                    }
+                ],
+                "fromParams": [
+                    "access_token"
+                ],
+                "issuer": "issuer-0",
+                "payloadInMetadata": "jwt_payloads",
+                "remoteJwks": {
+                    "cacheDuration": "300s",
+                    "httpUri": {
+                        "cluster": "jwt-provider-cluster-fake-jwks.com:443",
+                        "timeout": "30s",
+                        "uri": "https://fake-jwks.com"
+                    }
+                }
+            }
+        },
+        "requirementMap": {
+            "testapi.bar": {
+                "providerName": "auth_provider"
+            },
+            "testapi.foo": {
+                "providerName": "auth_provider"
+            }
+        }
+    }
+}
 `,
 		},
 		{
@@ -444,40 +676,8 @@ func TestJwtAuthnFilter(t *testing.T) {
     }
 }`,
 		},
-	}
-
-	for i, tc := range testData {
-		opts := options.DefaultConfigGeneratorOptions()
-		opts.BackendAddress = "grpc://127.0.0.0:80"
-		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		marshaler := &jsonpb.Marshaler{}
-		gotFilter, err := marshaler.MarshalToString(makeJwtAuthnFilter(fakeServiceInfo))
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		if err := util.JsonEqual(tc.wantJwtAuthnFilter, gotFilter); err != nil {
-			t.Errorf("Test Desc(%d): %s, makeJwtAuthnFilter failed, %s", i, tc.desc, err)
-		}
-	}
-}
-
-func TestBackendAuthFilter(t *testing.T) {
-	testdata := []struct {
-		desc                  string
-		iamServiceAccount     string
-		fakeServiceConfig     *confpb.Service
-		delegates             []string
-		depErrorBehavior      string
-		wantBackendAuthFilter string
-		wantError             string
-	}{
 		{
-			desc: "Success, generate backend auth filter in general",
+			desc: "Success. Generate jwt authn filter with the cached jwks of an unavailable jwks_uri",
 			fakeServiceConfig: &confpb.Service{
 				Name: testProjectName,
 				Apis: []*apipb.Api{
@@ -487,60 +687,78 @@ func TestBackendAuthFilter(t *testing.T) {
 							{
 								Name: "foo",
 							},
-							{
-								Name: "bar",
-							},
 						},
 					},
 				},
-				Backend: &confpb.Backend{
-					Rules: []*confpb.BackendRule{
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
 						{
-							Selector:        "testapipb.foo",
-							Address:         "https://testapipb.com/foo",
-							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
-							Authentication: &confpb.BackendRule_JwtAudience{
-								JwtAudience: "foo.com",
-							},
+							Id:      "auth_provider",
+							Issuer:  "issuer-0",
+							JwksUri: "https://fake-jwks.com",
 						},
+					},
+					Rules: []*confpb.AuthenticationRule{
 						{
-							Selector:        "testapipb.bar",
-							Address:         "https://testapipb.com/foo",
-							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
-							Authentication: &confpb.BackendRule_JwtAudience{
-								JwtAudience: "bar.com",
+							Selector: "testapi.foo",
+							Requirements: []*confpb.AuthRequirement{
+								{
+									ProviderId: "auth_provider",
+								},
 							},
 						},
 					},
 				},
 			},
-			depErrorBehavior: commonpb.DependencyErrorBehavior_BLOCK_INIT_ON_ANY_ERROR.String(),
-			wantBackendAuthFilter: `
-{
-   "name":"com.google.espv2.filters.http.backend_auth",
-   "typedConfig":{
-      "@type":"type.googleapis.com/espv2.api.envoy.v9.http.backend_auth.FilterConfig",
-      "depErrorBehavior":"BLOCK_INIT_ON_ANY_ERROR",
-      "imdsToken":{
-          "cluster":"metadata-cluster",
-          "timeout":"30s",
-          "uri":"http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/identity"
-      },
-      "jwtAudienceList":["bar.com","foo.com"]
-   }
-}
-`,
-		},
-		{
-			desc: "Success, generate backend auth filter with allow Cors",
-			fakeServiceConfig: &confpb.Service{
-				Name: testProjectName,
-				Endpoints: []*confpb.Endpoint{
-					{
-						Name:      testProjectName,
-						AllowCors: true,
-					},
-				},
+			cachedJwks: map[string]string{
+				"auth_provider": `{"keys":[{"kid":"1"}]}`,
+			},
+			wantJwtAuthnFilter: `{
+    "name": "envoy.filters.http.jwt_authn",
+    "typedConfig": {
+        "@type": "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.JwtAuthentication",
+        "providers": {
+            "auth_provider": {
+                "audiences": [
+                    "https://bookstore.endpoints.project123.cloud.goog"
+                ],
+                "forward": true,
+                "forwardPayloadHeader": "X-Endpoint-API-UserInfo",
+                "fromHeaders": [
+                    {
+                        "name": "Authorization",
+                        "valuePrefix": "Bearer "
+                    },
+                    {
+                        "name": "X-Goog-Iap-Jwt-Assertion"
+                    }
+                ],
+                "fromParams": [
+                    "access_token"
+                ],
+                "issuer": "issuer-0",
+                "localJwks": {
+                    "inlineString": "{\"keys\":[{\"kid\":\"1\"}]}"
+                },
+                "payloadInMetadata": "jwt_payloads"
+            }
+        },
+        "requirementMap": {
+            "testapi.foo": {
+                "providerName": "auth_provider"
+            }
+        }
+    }
+}
+`,
+		},
+		{
+			desc: "Success. Generate jwt authn filter allowing failed tokens in audit mode",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Control: &confpb.Control{
+					Environment: "servicecontrol.googleapis.com",
+				},
 				Apis: []*apipb.Api{
 					{
 						Name: "testapi",
@@ -548,118 +766,424 @@ func TestBackendAuthFilter(t *testing.T) {
 							{
 								Name: "foo",
 							},
-							{
-								Name: "bar",
-							},
 						},
 					},
 				},
-				Http: &annotationspb.Http{
-					Rules: []*annotationspb.HttpRule{
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
 						{
-							Selector: "get_testapi.foo",
-							Pattern: &annotationspb.HttpRule_Get{
-								Get: "/foo",
-							},
+							Id:      "auth_provider",
+							Issuer:  "issuer-0",
+							JwksUri: "https://fake-jwks.com",
 						},
+					},
+					Rules: []*confpb.AuthenticationRule{
 						{
-							Selector: "get_testapi.bar",
-							Pattern: &annotationspb.HttpRule_Get{
-								Get: "/bar",
+							Selector: "testapi.foo",
+							Requirements: []*confpb.AuthRequirement{
+								{
+									ProviderId: "auth_provider",
+								},
 							},
 						},
 					},
 				},
-				Backend: &confpb.Backend{
-					Rules: []*confpb.BackendRule{
-						{
-							Selector:        "get_testapi.foo",
-							Address:         "https://testapipb.com/foo",
-							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
-							Authentication: &confpb.BackendRule_JwtAudience{
-								JwtAudience: "foo.com",
+			},
+			auditMode: true,
+			wantJwtAuthnFilter: `{
+    "name": "envoy.filters.http.jwt_authn",
+    "typedConfig": {
+        "@type": "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.JwtAuthentication",
+        "providers": {
+            "auth_provider": {
+                "audiences": [
+                    "https://bookstore.endpoints.project123.cloud.goog"
+                ],
+                "forward": true,
+                "forwardPayloadHeader": "X-Endpoint-API-UserInfo",
+                "fromHeaders": [
+                    {
+                        "name": "Authorization",
+                        "valuePrefix": "Bearer "
+                    },
+                    {
+                        "name": "X-Goog-Iap-Jwt-Assertion"
+                    }
+                ],
+                "fromParams": [
+                    "access_token"
+                ],
+                "issuer": "issuer-0",
+                "payloadInMetadata": "jwt_payloads",
+                "remoteJwks": {
+                    "cacheDuration": "300s",
+                    "httpUri": {
+                        "cluster": "jwt-provider-cluster-fake-jwks.com:443",
+                        "timeout": "30s",
+                        "uri": "https://fake-jwks.com"
+                    }
+                }
+            }
+        },
+        "requirementMap": {
+            "testapi.foo": {
+                "requiresAny": {
+                    "requirements": [
+                        {
+                            "providerName": "auth_provider"
+                        },
+                        {
+                            "allowMissingOrFailed": {}
+                        }
+                    ]
+                }
+            }
+        }
+    }
+}
+`,
+		},
+		{
+			desc: "Success. Generate jwt authn filter rejecting the tokens of a provider with a deferred OpenID Connect Discovery",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "testapi",
+						Methods: []*apipb.Method{
+							{
+								Name: "foo",
 							},
 						},
+					},
+				},
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:      "auth_provider",
+							Issuer:  "issuer-0",
+							JwksUri: "https://fake-jwks.com",
+						},
+					},
+					Rules: []*confpb.AuthenticationRule{
 						{
-							Selector:        "get_testapi.bar",
-							Address:         "https://testapipb.com/bar",
-							PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
-							Authentication: &confpb.BackendRule_JwtAudience{
-								JwtAudience: "bar.com",
+							Selector: "testapi.foo",
+							Requirements: []*confpb.AuthRequirement{
+								{
+									ProviderId: "auth_provider",
+								},
 							},
 						},
 					},
 				},
 			},
-			depErrorBehavior: commonpb.DependencyErrorBehavior_BLOCK_INIT_ON_ANY_ERROR.String(),
-			wantBackendAuthFilter: `{
-        "name":"com.google.espv2.filters.http.backend_auth",
-        "typedConfig":{
-          "@type":"type.googleapis.com/espv2.api.envoy.v9.http.backend_auth.FilterConfig",
-          "depErrorBehavior":"BLOCK_INIT_ON_ANY_ERROR",
-          "imdsToken":{
-            "cluster":"metadata-cluster",
-            "timeout":"30s",
-            "uri":"http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/identity"
-          },
-          "jwtAudienceList":["bar.com","foo.com"]
+			deferredProviders: map[string]bool{
+				"auth_provider": true,
+			},
+			wantJwtAuthnFilter: `{
+    "name": "envoy.filters.http.jwt_authn",
+    "typedConfig": {
+        "@type": "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.JwtAuthentication",
+        "providers": {
+            "auth_provider": {
+                "audiences": [
+                    "https://bookstore.endpoints.project123.cloud.goog"
+                ],
+                "forward": true,
+                "forwardPayloadHeader": "X-Endpoint-API-UserInfo",
+                "fromHeaders": [
+                    {
+                        "name": "Authorization",
+                        "valuePrefix": "Bearer "
+                    },
+                    {
+                        "name": "X-Goog-Iap-Jwt-Assertion"
+                    }
+                ],
+                "fromParams": [
+                    "access_token"
+                ],
+                "issuer": "issuer-0",
+                "localJwks": {
+                    "inlineString": "{\"keys\":[]}"
+                },
+                "payloadInMetadata": "jwt_payloads"
+            }
+        },
+        "requirementMap": {
+            "testapi.foo": {
+                "providerName": "auth_provider"
+            }
         }
-      }`,
+    }
+}
+`,
 		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.0:80"
+		opts.AuditMode = tc.auditMode
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fakeServiceInfo.CachedJwks = tc.cachedJwks
+		fakeServiceInfo.DeferredOpenIDProviders = tc.deferredProviders
+
+		marshaler := &jsonpb.Marshaler{}
+		gotFilter, err := marshaler.MarshalToString(makeJwtAuthnFilter(fakeServiceInfo))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := util.JsonEqual(tc.wantJwtAuthnFilter, gotFilter); err != nil {
+			t.Errorf("Test Desc(%d): %s, makeJwtAuthnFilter failed, %s", i, tc.desc, err)
+		}
+	}
+}
+
+func TestBackendAuthFilter(t *testing.T) {
+	testdata := []struct {
+		desc                      string
+		iamServiceAccount         string
+		impersonateServiceAccount string
+		fakeServiceConfig         *confpb.Service
+		delegates                 []string
+		depErrorBehavior          string
+		wantBackendAuthFilter     string
+		wantError                 string
+	}{
 		{
-			desc:              "Success, set iamIdToken when iam service account is set",
-			iamServiceAccount: "service-account@google.com",
-			delegates:         []string{"delegate_foo", "delegate_bar", "delegate_baz"},
-			depErrorBehavior:  commonpb.DependencyErrorBehavior_ALWAYS_INIT.String(),
+			desc:                      "Success, generate backend auth filter with identity tokens of the impersonated service account from the token agent",
+			impersonateServiceAccount: "proxy@project.iam.gserviceaccount.com",
 			fakeServiceConfig: &confpb.Service{
 				Name: testProjectName,
 				Apis: []*apipb.Api{
 					{
 						Name: "testapi",
+						Methods: []*apipb.Method{
+							{
+								Name: "foo",
+							},
+						},
 					},
 				},
 				Backend: &confpb.Backend{
 					Rules: []*confpb.BackendRule{
 						{
-							Selector:        "testapipb.bar",
+							Selector:        "testapipb.foo",
 							Address:         "https://testapipb.com/foo",
 							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
 							Authentication: &confpb.BackendRule_JwtAudience{
-								JwtAudience: "bar.com",
+								JwtAudience: "foo.com",
 							},
 						},
 					},
 				},
 			},
+			depErrorBehavior: commonpb.DependencyErrorBehavior_BLOCK_INIT_ON_ANY_ERROR.String(),
 			wantBackendAuthFilter: `
 {
    "name":"com.google.espv2.filters.http.backend_auth",
    "typedConfig":{
       "@type":"type.googleapis.com/espv2.api.envoy.v9.http.backend_auth.FilterConfig",
-			"depErrorBehavior":"ALWAYS_INIT",
-      "iamToken":{
-         "accessToken":{
-            "remoteToken":{
-               "cluster":"metadata-cluster",
-               "timeout":"30s",
-               "uri":"http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"
-            }
-         },
-         "iamUri":{
-            "cluster":"iam-cluster",
-            "timeout":"30s",
-            "uri":"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/service-account@google.com:generateIdToken"
-         },
-         "delegates":["delegate_foo","delegate_bar","delegate_baz"],
-         "serviceAccountEmail":"service-account@google.com"
+      "depErrorBehavior":"BLOCK_INIT_ON_ANY_ERROR",
+      "imdsToken":{
+          "cluster":"token-agent-cluster",
+          "timeout":"30s",
+          "uri":"http://127.0.0.1:8791/local/identity_token"
       },
-      "jwtAudienceList":["bar.com"]
+      "jwtAudienceList":["foo.com"]
    }
 }
 `,
 		},
 		{
-			desc:             "Fail when invalid dependency error behavior is provided",
+			desc: "Success, generate backend auth filter in general",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "testapi",
+						Methods: []*apipb.Method{
+							{
+								Name: "foo",
+							},
+							{
+								Name: "bar",
+							},
+						},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Selector:        "testapipb.foo",
+							Address:         "https://testapipb.com/foo",
+							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+							Authentication: &confpb.BackendRule_JwtAudience{
+								JwtAudience: "foo.com",
+							},
+						},
+						{
+							Selector:        "testapipb.bar",
+							Address:         "https://testapipb.com/foo",
+							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+							Authentication: &confpb.BackendRule_JwtAudience{
+								JwtAudience: "bar.com",
+							},
+						},
+					},
+				},
+			},
+			depErrorBehavior: commonpb.DependencyErrorBehavior_BLOCK_INIT_ON_ANY_ERROR.String(),
+			wantBackendAuthFilter: `
+{
+   "name":"com.google.espv2.filters.http.backend_auth",
+   "typedConfig":{
+      "@type":"type.googleapis.com/espv2.api.envoy.v9.http.backend_auth.FilterConfig",
+      "depErrorBehavior":"BLOCK_INIT_ON_ANY_ERROR",
+      "imdsToken":{
+          "cluster":"metadata-cluster",
+          "timeout":"30s",
+          "uri":"http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/identity"
+      },
+      "jwtAudienceList":["bar.com","foo.com"]
+   }
+}
+`,
+		},
+		{
+			desc: "Success, generate backend auth filter with allow Cors",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Endpoints: []*confpb.Endpoint{
+					{
+						Name:      testProjectName,
+						AllowCors: true,
+					},
+				},
+				Apis: []*apipb.Api{
+					{
+						Name: "testapi",
+						Methods: []*apipb.Method{
+							{
+								Name: "foo",
+							},
+							{
+								Name: "bar",
+							},
+						},
+					},
+				},
+				Http: &annotationspb.Http{
+					Rules: []*annotationspb.HttpRule{
+						{
+							Selector: "get_testapi.foo",
+							Pattern: &annotationspb.HttpRule_Get{
+								Get: "/foo",
+							},
+						},
+						{
+							Selector: "get_testapi.bar",
+							Pattern: &annotationspb.HttpRule_Get{
+								Get: "/bar",
+							},
+						},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Selector:        "get_testapi.foo",
+							Address:         "https://testapipb.com/foo",
+							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+							Authentication: &confpb.BackendRule_JwtAudience{
+								JwtAudience: "foo.com",
+							},
+						},
+						{
+							Selector:        "get_testapi.bar",
+							Address:         "https://testapipb.com/bar",
+							PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+							Authentication: &confpb.BackendRule_JwtAudience{
+								JwtAudience: "bar.com",
+							},
+						},
+					},
+				},
+			},
+			depErrorBehavior: commonpb.DependencyErrorBehavior_BLOCK_INIT_ON_ANY_ERROR.String(),
+			wantBackendAuthFilter: `{
+        "name":"com.google.espv2.filters.http.backend_auth",
+        "typedConfig":{
+          "@type":"type.googleapis.com/espv2.api.envoy.v9.http.backend_auth.FilterConfig",
+          "depErrorBehavior":"BLOCK_INIT_ON_ANY_ERROR",
+          "imdsToken":{
+            "cluster":"metadata-cluster",
+            "timeout":"30s",
+            "uri":"http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/identity"
+          },
+          "jwtAudienceList":["bar.com","foo.com"]
+        }
+      }`,
+		},
+		{
+			desc:              "Success, set iamIdToken when iam service account is set",
+			iamServiceAccount: "service-account@google.com",
+			delegates:         []string{"delegate_foo", "delegate_bar", "delegate_baz"},
+			depErrorBehavior:  commonpb.DependencyErrorBehavior_ALWAYS_INIT.String(),
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "testapi",
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Selector:        "testapipb.bar",
+							Address:         "https://testapipb.com/foo",
+							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+							Authentication: &confpb.BackendRule_JwtAudience{
+								JwtAudience: "bar.com",
+							},
+						},
+					},
+				},
+			},
+			wantBackendAuthFilter: `
+{
+   "name":"com.google.espv2.filters.http.backend_auth",
+   "typedConfig":{
+      "@type":"type.googleapis.com/espv2.api.envoy.v9.http.backend_auth.FilterConfig",
+			"depErrorBehavior":"ALWAYS_INIT",
+      "iamToken":{
+         "accessToken":{
+            "remoteToken":{
+               "cluster":"metadata-cluster",
+               "timeout":"30s",
+               "uri":"http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"
+            }
+         },
+         "iamUri":{
+            "cluster":"iam-cluster",
+            "timeout":"30s",
+            "uri":"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/service-account@google.com:generateIdToken"
+         },
+         "delegates":["delegate_foo","delegate_bar","delegate_baz"],
+         "serviceAccountEmail":"service-account@google.com"
+      },
+      "jwtAudienceList":["bar.com"]
+   }
+}
+`,
+		},
+		{
+			desc:             "Fail when invalid dependency error behavior is provided",
 			depErrorBehavior: "UNKNOWN_ERROR_BEHAVIOR",
 			fakeServiceConfig: &confpb.Service{
 				Name: testProjectName,
@@ -681,49 +1205,535 @@ func TestBackendAuthFilter(t *testing.T) {
 					},
 				},
 			},
-			wantError: `unknown value for DependencyErrorBehavior (UNKNOWN_ERROR_BEHAVIOR), accepted values are: ["ALWAYS_INIT" "BLOCK_INIT_ON_ANY_ERROR" "UNSPECIFIED"]`,
+			wantError: `unknown value for DependencyErrorBehavior (UNKNOWN_ERROR_BEHAVIOR), accepted values are: ["ALWAYS_INIT" "BLOCK_INIT_ON_ANY_ERROR" "UNSPECIFIED"]`,
+		},
+	}
+
+	for _, tc := range testdata {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.DependencyErrorBehavior = tc.depErrorBehavior
+			opts.ImpersonateServiceAccount = tc.impersonateServiceAccount
+			if tc.iamServiceAccount != "" {
+				opts.BackendAuthCredentials = &options.IAMCredentialsOptions{
+					ServiceAccountEmail: tc.iamServiceAccount,
+					TokenKind:           options.IDToken,
+					Delegates:           tc.delegates,
+				}
+			}
+
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filterConfig, err := makeBackendAuthFilter(fakeServiceInfo)
+			if err != nil {
+				if tc.wantError == "" || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("exepected err (%v), got err (%v)", tc.wantError, err)
+				}
+				return
+			}
+
+			marshaler := &jsonpb.Marshaler{}
+			gotFilter, err := marshaler.MarshalToString(filterConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(tc.wantBackendAuthFilter, gotFilter); err != nil {
+				t.Errorf("makeBackendAuthFilter failed,\n %v", err)
+			}
+		})
+	}
+}
+
+func TestRbacFilter(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Admin",
+					},
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer-0",
+					JwksUri: "https://fake-jwks.com",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: testApiName + ".Admin",
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "auth_provider",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testdata := []struct {
+		desc               string
+		jwtCallerAllowlist string
+		wantRbacFilter     string
+		wantRbacPerRoute   string
+	}{
+		{
+			desc: "No caller allowlist, no RBAC filter",
+		},
+		{
+			desc:               "Caller allowlist generates RBAC filter and per-route config",
+			jwtCallerAllowlist: testApiName + ".Admin=admin@project.iam.gserviceaccount.com",
+			wantRbacFilter: `{
+  "name": "envoy.filters.http.rbac",
+  "typedConfig": {
+    "@type": "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC"
+  }
+}`,
+			wantRbacPerRoute: `{
+  "rbac": {
+    "rules": {
+      "policies": {
+        "caller-allowlist": {
+          "permissions": [
+            {
+              "any": true
+            }
+          ],
+          "principals": [
+            {
+              "metadata": {
+                "filter": "envoy.filters.http.jwt_authn",
+                "path": [
+                  {
+                    "key": "jwt_payloads"
+                  },
+                  {
+                    "key": "azp"
+                  }
+                ],
+                "value": {
+                  "stringMatch": {
+                    "exact": "admin@project.iam.gserviceaccount.com"
+                  }
+                }
+              }
+            },
+            {
+              "metadata": {
+                "filter": "envoy.filters.http.jwt_authn",
+                "path": [
+                  {
+                    "key": "jwt_payloads"
+                  },
+                  {
+                    "key": "email"
+                  }
+                ],
+                "value": {
+                  "stringMatch": {
+                    "exact": "admin@project.iam.gserviceaccount.com"
+                  }
+                }
+              }
+            }
+          ]
+        }
+      }
+    }
+  }
+}`,
+		},
+	}
+
+	for _, tc := range testdata {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.JwtCallerAllowlist = tc.jwtCallerAllowlist
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filter := makeRbacFilter(fakeServiceInfo)
+		if tc.wantRbacFilter == "" {
+			if filter != nil {
+				t.Errorf("Test Desc: %s, expected no RBAC filter, got: %v", tc.desc, filter)
+			}
+			continue
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		gotFilter, err := marshaler.MarshalToString(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.wantRbacFilter, gotFilter); err != nil {
+			t.Errorf("Test Desc: %s, makeRbacFilter failed,\n%v", tc.desc, err)
+		}
+
+		method := fakeServiceInfo.Methods[testApiName+".Admin"]
+		gotPerRoute, err := marshaler.MarshalToString(makeCallerAllowlistRbac(method.AllowedCallers, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.wantRbacPerRoute, gotPerRoute); err != nil {
+			t.Errorf("Test Desc: %s, makeCallerAllowlistRbac failed,\n%v", tc.desc, err)
+		}
+	}
+}
+
+func TestServiceControl(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		Control: &confpb.Control{
+			Environment: statPrefix,
+		},
+	}
+	testData := []struct {
+		desc                            string
+		serviceControlCredentials       *options.IAMCredentialsOptions
+		serviceAccountKey               string
+		wantPartialServiceControlFilter string
+	}{
+		{
+			desc: "get access token from imds",
+			wantPartialServiceControlFilter: `
+    "imdsToken": {
+      "cluster": "metadata-cluster",
+      "timeout": "30s",
+      "uri": "http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"
+    },`,
+		},
+		{
+			desc: "get access token from iam",
+			serviceControlCredentials: &options.IAMCredentialsOptions{
+				ServiceAccountEmail: "ServiceControl@iam.com",
+				Delegates:           []string{"delegate_foo", "delegate_bar"},
+			},
+			wantPartialServiceControlFilter: `
+    "iamToken": {
+      "accessToken": {
+        "remoteToken": {
+          "cluster": "metadata-cluster",
+          "timeout": "30s",
+          "uri": "http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"
+        }
+      },
+      "delegates": [
+        "delegate_foo",
+        "delegate_bar"
+      ],
+      "iamUri": {
+        "cluster": "iam-cluster",
+        "timeout": "30s",
+        "uri": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/ServiceControl@iam.com:generateAccessToken"
+      },
+      "serviceAccountEmail": "ServiceControl@iam.com"
+    },`,
+		},
+		{
+			desc:              "get access token from the token agent server",
+			serviceAccountKey: "this-is-sa-cred",
+			wantPartialServiceControlFilter: `
+    "imdsToken": {
+      "cluster": "token-agent-cluster",
+      "timeout": "30s",
+      "uri": "http://127.0.0.1:8791/local/access_token"
+    },`,
+		},
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ServiceControlCredentials = tc.serviceControlCredentials
+			opts.ServiceAccountKey = tc.serviceAccountKey
+
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Error(err)
+			}
+
+			marshaler := &jsonpb.Marshaler{}
+			filter, err := makeServiceControlFilter(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotFilter, err := marshaler.MarshalToString(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := util.JsonContains(gotFilter, tc.wantPartialServiceControlFilter); err != nil {
+				t.Errorf("makeServiceControlFilter failed,\n%v", err)
+			}
+		})
+	}
+}
+
+func TestServiceControlLabels(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		Control: &confpb.Control{
+			Environment: statPrefix,
+		},
+	}
+	testData := []struct {
+		desc                            string
+		scCustomLabels                  string
+		scHeaderLabels                  string
+		wantPartialServiceControlFilter string
+		wantError                       string
+	}{
+		{
+			desc:           "static and header labels",
+			scCustomLabels: "env=prod, team = books",
+			scHeaderLabels: "tenant=X-Tenant-Id",
+			wantPartialServiceControlFilter: `
+        "customLabels": {
+          "env": "prod",
+          "team": "books"
+        },
+        "headerLabels": [
+          {
+            "header": "x-tenant-id",
+            "label": "tenant"
+          }
+        ],`,
+		},
+		{
+			desc:           "malformed static label",
+			scCustomLabels: "env",
+			wantError:      `invalid --service_control_custom_labels: label "env" must be in the format LABEL=VALUE`,
+		},
+		{
+			desc:           "header label without header",
+			scHeaderLabels: "tenant=",
+			wantError:      `invalid --service_control_header_labels: label "tenant=" must be in the format LABEL=VALUE`,
+		},
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ScCustomLabels = tc.scCustomLabels
+			opts.ScHeaderLabels = tc.scHeaderLabels
+
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filter, err := makeServiceControlFilter(fakeServiceInfo)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			marshaler := &jsonpb.Marshaler{}
+			gotFilter, err := marshaler.MarshalToString(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := util.JsonContains(gotFilter, tc.wantPartialServiceControlFilter); err != nil {
+				t.Errorf("makeServiceControlFilter failed,\n%v", err)
+			}
+		})
+	}
+}
+
+func TestServiceControlConsumerHeaders(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		Control: &confpb.Control{
+			Environment: statPrefix,
+		},
+	}
+	testData := []struct {
+		desc                            string
+		backendConsumerHeaders          string
+		wantPartialServiceControlFilter string
+		wantError                       string
+	}{
+		{
+			desc:                   "project number and api key hash",
+			backendConsumerHeaders: "project_number, api_key_hash",
+			wantPartialServiceControlFilter: `
+        "consumerHeaders": {
+          "apiKeyHash": true,
+          "projectNumber": true
+        },`,
+		},
+		{
+			desc:                   "project number only",
+			backendConsumerHeaders: "project_number",
+			wantPartialServiceControlFilter: `
+        "consumerHeaders": {
+          "projectNumber": true
+        },`,
+		},
+		{
+			desc:                   "plan is not returned by the Check API",
+			backendConsumerHeaders: "project_number,plan",
+			wantError:              `invalid --backend_consumer_headers "plan", must be "project_number" or "api_key_hash"`,
+		},
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendConsumerHeaders = tc.backendConsumerHeaders
+
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filter, err := makeServiceControlFilter(fakeServiceInfo)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			marshaler := &jsonpb.Marshaler{}
+			gotFilter, err := marshaler.MarshalToString(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := util.JsonContains(gotFilter, tc.wantPartialServiceControlFilter); err != nil {
+				t.Errorf("makeServiceControlFilter failed,\n%v", err)
+			}
+		})
+	}
+}
+
+func TestServiceControlIntermediateReports(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name:              "WatchShelves",
+						ResponseStreaming: true,
+					},
+				},
+			},
+		},
+		Control: &confpb.Control{
+			Environment: statPrefix,
 		},
 	}
-
-	for _, tc := range testdata {
+	testData := []struct {
+		desc                      string
+		streamIntermediateReports bool
+		wantRequirement           string
+	}{
+		{
+			desc: "intermediate reports disabled",
+			wantRequirement: `
+        {
+          "apiName": "endpoints.examples.bookstore.Bookstore",
+          "operationName": "endpoints.examples.bookstore.Bookstore.WatchShelves",
+          "serviceName": "bookstore.endpoints.project123.cloud.goog"
+        }`,
+		},
+		{
+			desc:                      "intermediate reports enabled for streaming method",
+			streamIntermediateReports: true,
+			wantRequirement: `
+        {
+          "apiName": "endpoints.examples.bookstore.Bookstore",
+          "operationName": "endpoints.examples.bookstore.Bookstore.WatchShelves",
+          "sendIntermediateReports": true,
+          "serviceName": "bookstore.endpoints.project123.cloud.goog"
+        }`,
+		},
+	}
+	for _, tc := range testData {
 		t.Run(tc.desc, func(t *testing.T) {
 			opts := options.DefaultConfigGeneratorOptions()
-			opts.BackendAddress = "grpc://127.0.0.1:80"
-			opts.DependencyErrorBehavior = tc.depErrorBehavior
-			if tc.iamServiceAccount != "" {
-				opts.BackendAuthCredentials = &options.IAMCredentialsOptions{
-					ServiceAccountEmail: tc.iamServiceAccount,
-					TokenKind:           options.IDToken,
-					Delegates:           tc.delegates,
-				}
-			}
+			opts.StreamIntermediateReports = tc.streamIntermediateReports
 
-			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			filterConfig, err := makeBackendAuthFilter(fakeServiceInfo)
+			filter, err := makeServiceControlFilter(fakeServiceInfo)
 			if err != nil {
-				if tc.wantError == "" || !strings.Contains(err.Error(), tc.wantError) {
-					t.Fatalf("exepected err (%v), got err (%v)", tc.wantError, err)
-				}
-				return
+				t.Fatal(err)
 			}
 
 			marshaler := &jsonpb.Marshaler{}
-			gotFilter, err := marshaler.MarshalToString(filterConfig)
+			gotFilter, err := marshaler.MarshalToString(filter)
 			if err != nil {
 				t.Fatal(err)
 			}
-			if err := util.JsonEqual(tc.wantBackendAuthFilter, gotFilter); err != nil {
-				t.Errorf("makeBackendAuthFilter failed,\n %v", err)
+
+			if err := util.JsonContains(gotFilter, tc.wantRequirement); err != nil {
+				t.Errorf("makeServiceControlFilter failed,\n%v", err)
 			}
 		})
 	}
 }
 
-func TestServiceControl(t *testing.T) {
+func TestServiceControlRolloutConfigIds(t *testing.T) {
 	fakeServiceConfig := &confpb.Service{
 		Name: testProjectName,
 		Apis: []*apipb.Api{
@@ -741,83 +1751,325 @@ func TestServiceControl(t *testing.T) {
 		},
 	}
 	testData := []struct {
-		desc                            string
-		serviceControlCredentials       *options.IAMCredentialsOptions
-		serviceAccountKey               string
-		wantPartialServiceControlFilter string
+		desc                 string
+		rolloutPercentages   map[string]float64
+		wantRolloutConfigIds string
 	}{
 		{
-			desc: "get access token from imds",
-			wantPartialServiceControlFilter: `
-    "imdsToken": {
-      "cluster": "metadata-cluster",
-      "timeout": "30s",
-      "uri": "http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"
-    },`,
+			desc: "no rollout in progress",
+			rolloutPercentages: map[string]float64{
+				testConfigID: 100,
+			},
 		},
 		{
-			desc: "get access token from iam",
-			serviceControlCredentials: &options.IAMCredentialsOptions{
-				ServiceAccountEmail: "ServiceControl@iam.com",
-				Delegates:           []string{"delegate_foo", "delegate_bar"},
+			desc: "config ids of the rollout in progress sorted by id",
+			rolloutPercentages: map[string]float64{
+				"2017-05-01r1": 70,
+				"2017-05-01r0": 30,
 			},
-			wantPartialServiceControlFilter: `
-    "iamToken": {
-      "accessToken": {
-        "remoteToken": {
-          "cluster": "metadata-cluster",
-          "timeout": "30s",
-          "uri": "http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"
-        }
-      },
-      "delegates": [
-        "delegate_foo",
-        "delegate_bar"
-      ],
-      "iamUri": {
-        "cluster": "iam-cluster",
-        "timeout": "30s",
-        "uri": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/ServiceControl@iam.com:generateAccessToken"
-      },
-      "serviceAccountEmail": "ServiceControl@iam.com"
-    },`,
+			wantRolloutConfigIds: `
+        "rolloutConfigIds": [
+          {
+            "serviceConfigId": "2017-05-01r0",
+            "trafficPercent": 30
+          },
+          {
+            "serviceConfigId": "2017-05-01r1",
+            "trafficPercent": 70
+          }
+        ]`,
+		},
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, options.DefaultConfigGeneratorOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			fakeServiceInfo.RolloutPercentages = tc.rolloutPercentages
+
+			filter, err := makeServiceControlFilter(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			marshaler := &jsonpb.Marshaler{}
+			gotFilter, err := marshaler.MarshalToString(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.wantRolloutConfigIds == "" {
+				if strings.Contains(gotFilter, "rolloutConfigIds") {
+					t.Errorf("makeServiceControlFilter failed, want no rollout config ids, get %s", gotFilter)
+				}
+				return
+			}
+			if err := util.JsonContains(gotFilter, tc.wantRolloutConfigIds); err != nil {
+				t.Errorf("makeServiceControlFilter failed,\n%v", err)
+			}
+		})
+	}
+}
+
+func TestParseReportRedaction(t *testing.T) {
+	testData := []struct {
+		desc          string
+		redaction     string
+		wantRedaction string
+		wantError     string
+	}{
+		{
+			desc:      "all fields",
+			redaction: "url_query=drop, client_ip=HASH, referer=keep, header:User-Agent=hash",
+			wantRedaction: `
+{
+  "clientIp": "HASH",
+  "requestHeaders": {
+    "user-agent": "HASH"
+  },
+  "urlQuery": "DROP"
+}`,
 		},
 		{
-			desc:              "get access token from the token agent server",
-			serviceAccountKey: "this-is-sa-cred",
-			wantPartialServiceControlFilter: `
-    "imdsToken": {
-      "cluster": "token-agent-cluster",
-      "timeout": "30s",
-      "uri": "http://127.0.0.1:8791/local/access_token"
-    },`,
+			desc:      "malformed entry",
+			redaction: "url_query",
+			wantError: `entry "url_query" must be in the format FIELD=ACTION`,
+		},
+		{
+			desc:      "unknown action",
+			redaction: "client_ip=mask",
+			wantError: `unknown action "mask" in entry "client_ip=mask", must be one of keep, drop or hash`,
+		},
+		{
+			desc:      "unknown field",
+			redaction: "user_agent=drop",
+			wantError: `unknown field "user_agent" in entry "user_agent=drop", must be one of url_query, client_ip, referer or header:NAME`,
+		},
+		{
+			desc:      "header without name",
+			redaction: "header:=drop",
+			wantError: `unknown field "header:" in entry "header:=drop", must be one of url_query, client_ip, referer or header:NAME`,
 		},
 	}
 	for _, tc := range testData {
 		t.Run(tc.desc, func(t *testing.T) {
+			redaction, err := parseReportRedaction(tc.redaction)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
 
-			opts := options.DefaultConfigGeneratorOptions()
-			opts.ServiceControlCredentials = tc.serviceControlCredentials
-			opts.ServiceAccountKey = tc.serviceAccountKey
-
-			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			marshaler := &jsonpb.Marshaler{}
+			gotRedaction, err := marshaler.MarshalToString(redaction)
 			if err != nil {
-				t.Error(err)
+				t.Fatal(err)
+			}
+
+			if err := util.JsonEqual(tc.wantRedaction, gotRedaction); err != nil {
+				t.Errorf("parseReportRedaction failed,\n%v", err)
+			}
+		})
+	}
+}
+
+func TestMakeServiceControlCallingConfig(t *testing.T) {
+	testData := []struct {
+		desc                     string
+		scCheckCacheEntries      int
+		scCheckCacheExpirationMs int
+		scApiKeyGracePeriodMs    int
+		scApiKeyGraceCachePath   string
+		scCheckRetries           int
+		calloutPolicy            *configinfo.CalloutPolicy
+		wantCallingConfig        string
+	}{
+		{
+			desc: "check cache and api key grace period not set",
+			wantCallingConfig: `
+{
+  "networkFailOpen": true
+}`,
+		},
+		{
+			desc:                     "check cache and api key grace period set",
+			scCheckCacheEntries:      500,
+			scCheckCacheExpirationMs: 60000,
+			scApiKeyGracePeriodMs:    3600000,
+			wantCallingConfig: `
+{
+  "apiKeyGracePeriodMs": 3600000,
+  "checkCacheEntries": 500,
+  "checkCacheExpirationMs": 60000,
+  "networkFailOpen": true
+}`,
+		},
+		{
+			desc:                   "api key grace cache path set",
+			scApiKeyGracePeriodMs:  60000,
+			scApiKeyGraceCachePath: "/var/lib/espv2/api_keys",
+			wantCallingConfig: `
+{
+  "apiKeyGraceCachePath": "/var/lib/espv2/api_keys",
+  "apiKeyGracePeriodMs": 60000,
+  "networkFailOpen": true
+}`,
+		},
+		{
+			desc:                   "api key grace cache path ignored without the grace period",
+			scApiKeyGraceCachePath: "/var/lib/espv2/api_keys",
+			wantCallingConfig: `
+{
+  "networkFailOpen": true
+}`,
+		},
+		{
+			desc: "callout policy as the default of the timeouts and retries",
+			calloutPolicy: &configinfo.CalloutPolicy{
+				Timeout: 2 * time.Second,
+				Retries: 1,
+			},
+			scCheckRetries: 3,
+			wantCallingConfig: `
+{
+  "checkRetries": 3,
+  "checkTimeoutMs": 2000,
+  "networkFailOpen": true,
+  "quotaRetries": 1,
+  "quotaTimeoutMs": 2000,
+  "reportRetries": 1,
+  "reportTimeoutMs": 2000
+}`,
+		},
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ScCheckCacheEntries = tc.scCheckCacheEntries
+			opts.ScCheckCacheExpirationMs = tc.scCheckCacheExpirationMs
+			opts.ScApiKeyGracePeriodMs = tc.scApiKeyGracePeriodMs
+			opts.ScApiKeyGraceCachePath = tc.scApiKeyGraceCachePath
+			if tc.scCheckRetries != 0 {
+				opts.ScCheckRetries = tc.scCheckRetries
 			}
 
 			marshaler := &jsonpb.Marshaler{}
-			filter, err := makeServiceControlFilter(fakeServiceInfo)
+			gotCallingConfig, err := marshaler.MarshalToString(makeServiceControlCallingConfig(opts, tc.calloutPolicy))
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			gotFilter, err := marshaler.MarshalToString(filter)
+			if err := util.JsonEqual(tc.wantCallingConfig, gotCallingConfig); err != nil {
+				t.Errorf("makeServiceControlCallingConfig failed,\n%v", err)
+			}
+		})
+	}
+}
+
+func TestMakeGcpAttributes(t *testing.T) {
+	testData := []struct {
+		desc                    string
+		metadataAttributes      *scpb.GcpAttributes
+		fileContent             string
+		gcpProjectIdOverride    string
+		gcpZoneOverride         string
+		computePlatformOverride string
+		wantAttributes          string
+		wantError               string
+	}{
+		{
+			desc:           "no attributes",
+			wantAttributes: `null`,
+		},
+		{
+			desc: "attributes of the metadata server",
+			metadataAttributes: &scpb.GcpAttributes{
+				ProjectId: "metadata-project",
+				Zone:      "us-central1-a",
+				Platform:  "GKE",
+			},
+			wantAttributes: `{"projectId": "metadata-project", "zone": "us-central1-a", "platform": "GKE"}`,
+		},
+		{
+			desc: "attributes of the file override the metadata server",
+			metadataAttributes: &scpb.GcpAttributes{
+				ProjectId: "metadata-project",
+				Zone:      "us-central1-a",
+				Platform:  "GKE",
+			},
+			fileContent:    `{"projectId": "onprem-project", "zone": "onprem-dc1"}`,
+			wantAttributes: `{"projectId": "onprem-project", "zone": "onprem-dc1", "platform": "GKE"}`,
+		},
+		{
+			desc:                    "flags override the file",
+			fileContent:             `{"projectId": "onprem-project", "zone": "onprem-dc1", "platform": "On-prem"}`,
+			gcpZoneOverride:         "onprem-dc2",
+			computePlatformOverride: "Anthos",
+			wantAttributes:          `{"projectId": "onprem-project", "zone": "onprem-dc2", "platform": "Anthos"}`,
+		},
+		{
+			desc:                 "flags without the metadata server",
+			gcpProjectIdOverride: "aws-project",
+			gcpZoneOverride:      "us-east-1",
+			wantAttributes:       `{"projectId": "aws-project", "zone": "us-east-1"}`,
+		},
+		{
+			desc:        "unknown field in the file",
+			fileContent: `{"project": "onprem-project"}`,
+			wantError:   "fail to parse gcp_attributes_file",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "gcp_attributes")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.GcpProjectIdOverride = tc.gcpProjectIdOverride
+			opts.GcpZoneOverride = tc.gcpZoneOverride
+			opts.ComputePlatformOverride = tc.computePlatformOverride
+			if tc.fileContent != "" {
+				opts.GcpAttributesFile = filepath.Join(dir, "gcp_attributes.json")
+				if err := ioutil.WriteFile(opts.GcpAttributesFile, []byte(tc.fileContent), 0644); err != nil {
+					t.Fatalf("fail to write gcp attributes file: %v", err)
+				}
+			}
+			serviceInfo := &configinfo.ServiceInfo{
+				Options:       opts,
+				GcpAttributes: tc.metadataAttributes,
+			}
+
+			gotAttributes, err := makeGcpAttributes(serviceInfo)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			if err := util.JsonContains(gotFilter, tc.wantPartialServiceControlFilter); err != nil {
-				t.Errorf("makeServiceControlFilter failed,\n%v", err)
+			gotJson := "null"
+			if gotAttributes != nil {
+				if gotJson, err = (&jsonpb.Marshaler{}).MarshalToString(gotAttributes); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := util.JsonEqual(tc.wantAttributes, gotJson); err != nil {
+				t.Errorf("makeGcpAttributes failed,\n%v", err)
+			}
+			if tc.metadataAttributes != nil && gotAttributes == tc.metadataAttributes {
+				t.Errorf("the attributes of the metadata server should not be modified")
 			}
 		})
 	}
@@ -828,8 +2080,10 @@ func TestHealthCheckFilter(t *testing.T) {
 		desc                  string
 		BackendAddress        string
 		healthz               string
+		healthzMode           string
 		fakeServiceConfig     *confpb.Service
 		wantHealthCheckFilter string
+		wantError             string
 	}{
 		{
 			desc:           "Success, generate health check filter for gRPC",
@@ -903,12 +2157,62 @@ func TestHealthCheckFilter(t *testing.T) {
         }
       }`,
 		},
+		{
+			desc:           "Success, generate backend aware health check filter",
+			BackendAddress: "grpc://127.0.0.1:80",
+			healthz:        "healthz",
+			healthzMode:    "backend_aware",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "endpoints.examples.bookstore.Bookstore",
+					},
+				},
+			},
+			wantHealthCheckFilter: `{
+        "name": "envoy.filters.http.health_check",
+        "typedConfig": {
+          "@type":"type.googleapis.com/envoy.extensions.filters.http.health_check.v3.HealthCheck",
+          "passThroughMode":false,
+          "headers": [
+            {
+              "exactMatch": "/healthz",
+              "name":":path"
+            }
+          ],
+          "clusterMinHealthyPercentages": {
+            "backend-cluster-bookstore.endpoints.project123.cloud.goog_local": {
+              "value": 100
+            }
+          }
+        }
+      }`,
+		},
+		{
+			desc:           "Failure, invalid healthz mode",
+			BackendAddress: "grpc://127.0.0.1:80",
+			healthz:        "healthz",
+			healthzMode:    "backend",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "endpoints.examples.bookstore.Bookstore",
+					},
+				},
+			},
+			wantError: `invalid --healthz_mode "backend", only proxy_only or backend_aware are valid`,
+		},
 	}
 
 	for i, tc := range testdata {
 		opts := options.DefaultConfigGeneratorOptions()
 		opts.BackendAddress = tc.BackendAddress
 		opts.Healthz = tc.healthz
+		if tc.healthzMode != "" {
+			opts.HealthzMode = tc.healthzMode
+		}
 		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
 		if err != nil {
 			t.Fatal(err)
@@ -916,6 +2220,12 @@ func TestHealthCheckFilter(t *testing.T) {
 
 		marshaler := &jsonpb.Marshaler{}
 		filter, err := makeHealthCheckFilter(fakeServiceInfo)
+		if tc.wantError != "" {
+			if err == nil || err.Error() != tc.wantError {
+				t.Errorf("Test Desc(%d): %s, want error: %s, get error: %v", i, tc.desc, tc.wantError, err)
+			}
+			continue
+		}
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1080,11 +2390,113 @@ func TestMakeListeners(t *testing.T) {
 	}
 }
 
+func TestMakeMetricsListener(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.PrometheusMetricsPort = 9090
+	opts.PrometheusStatsFilter = `^http\.ingress_http\.|server\.live`
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+			},
+		},
+	}, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := makeMetricsListener(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantListener := `
+{
+  "address":{
+    "socketAddress":{
+      "address":"127.0.0.1",
+      "portValue":9090
+    }
+  },
+  "filterChains":[
+    {
+      "filters":[
+        {
+          "name":"envoy.filters.network.http_connection_manager",
+          "typedConfig":{
+            "@type":"type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+            "httpFilters":[
+              {
+                "name":"envoy.filters.http.router",
+                "typedConfig":{
+                  "@type":"type.googleapis.com/envoy.extensions.filters.http.router.v3.Router",
+                  "suppressEnvoyHeaders":true
+                }
+              }
+            ],
+            "routeConfig":{
+              "name":"metrics_route",
+              "virtualHosts":[
+                {
+                  "domains":[
+                    "*"
+                  ],
+                  "name":"metrics",
+                  "routes":[
+                    {
+                      "match":{
+                        "headers":[
+                          {
+                            "exactMatch":"/metrics",
+                            "name":":path"
+                          }
+                        ],
+                        "path":"/metrics"
+                      },
+                      "route":{
+                        "cluster":"admin-cluster",
+                        "prefixRewrite":"/stats/prometheus?usedonly&filter=%5Ehttp%5C.ingress_http%5C.%7Cserver%5C.live"
+                      }
+                    },
+                    {
+                      "match":{
+                        "path":"/metrics"
+                      },
+                      "redirect":{
+                        "pathRedirect":"/metrics",
+                        "stripQuery":true
+                      }
+                    }
+                  ]
+                }
+              ]
+            },
+            "statPrefix":"metrics"
+          }
+        }
+      ]
+    }
+  ],
+  "name":"metrics_listener"
+}`
+
+	marshaler := &jsonpb.Marshaler{}
+	gotListener, err := marshaler.MarshalToString(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.JsonEqual(wantListener, gotListener); err != nil {
+		t.Errorf("makeMetricsListener failed, \n %v ", err)
+	}
+}
+
 func TestMakeHttpConMgr(t *testing.T) {
 	testdata := []struct {
 		desc            string
 		opts            options.ConfigGeneratorOptions
 		wantHttpConnMgr string
+		wantError       string
 	}{
 		{
 			desc: "Generate HttpConMgr with default options",
@@ -1116,6 +2528,77 @@ func TestMakeHttpConMgr(t *testing.T) {
 				"useRemoteAddress": false
 			}`,
 		},
+		{
+			desc: "Generate HttpConMgr with the routes served through RDS",
+			opts: options.ConfigGeneratorOptions{
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+				EnableRds: true,
+			},
+			wantHttpConnMgr: `
+			{
+				"commonHttpProtocolOptions": {
+					"headersWithUnderscoresAction": "REJECT_REQUEST"
+				},
+				"localReplyConfig": {
+					"bodyFormat": {
+						"jsonFormat": {
+							"code": "%RESPONSE_CODE%",
+							"message": "%LOCAL_REPLY_BODY%"
+						}
+					}
+				},
+				"rds": {
+					"configSource": {
+						"ads": {},
+						"resourceApiVersion": "V3"
+					},
+					"routeConfigName": "local_route"
+				},
+				"statPrefix": "ingress_http",
+				"upgradeConfigs": [
+					{
+						"upgradeType": "websocket"
+					}
+				],
+				"useRemoteAddress": false
+			}`,
+		},
+		{
+			desc: "Generate HttpConMgr with request id propagation",
+			opts: options.ConfigGeneratorOptions{
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+				PreserveExternalRequestId:    true,
+				AlwaysSetRequestIdInResponse: true,
+			},
+			wantHttpConnMgr: `
+			{
+				"alwaysSetRequestIdInResponse": true,
+				"commonHttpProtocolOptions": {
+					"headersWithUnderscoresAction": "REJECT_REQUEST"
+				},
+				"localReplyConfig": {
+					"bodyFormat": {
+						"jsonFormat": {
+							"code": "%RESPONSE_CODE%",
+							"message": "%LOCAL_REPLY_BODY%"
+						}
+					}
+				},
+				"preserveExternalRequestId": true,
+				"routeConfig": {},
+				"statPrefix": "ingress_http",
+				"upgradeConfigs": [
+					{
+						"upgradeType": "websocket"
+					}
+				],
+				"useRemoteAddress": false
+			}`,
+		},
 		{
 			desc: "Generate HttpConMgr when accessLog is defined",
 			opts: options.ConfigGeneratorOptions{
@@ -1159,6 +2642,146 @@ func TestMakeHttpConMgr(t *testing.T) {
 				}
 				`,
 		},
+		{
+			desc: "Generate HttpConMgr when accessLog is defined with JSON format and min status code",
+			opts: options.ConfigGeneratorOptions{
+				AccessLog:              "/dev/stdout",
+				AccessLogJsonFormat:    `{"status":"%RESPONSE_CODE%","path":"%REQ(:PATH)%"}`,
+				AccessLogMinStatusCode: 400,
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+			},
+			wantHttpConnMgr: `
+				{
+					"accessLog": [
+						{
+							"filter": {
+								"statusCodeFilter": {
+									"comparison": {
+										"op": "GE",
+										"value": {
+											"defaultValue": 400,
+											"runtimeKey": "access_log.min_status_code"
+										}
+									}
+								}
+							},
+							"name": "envoy.access_loggers.file",
+							"typedConfig": {
+								"@type": "type.googleapis.com/envoy.extensions.access_loggers.file.v3.FileAccessLog",
+								"path": "/dev/stdout",
+								"logFormat":{
+									"jsonFormat": {
+										"path": "%REQ(:PATH)%",
+										"status": "%RESPONSE_CODE%"
+									}
+								}
+							}
+						}
+					],
+					"commonHttpProtocolOptions": {
+						"headersWithUnderscoresAction": "REJECT_REQUEST"
+					},
+					"localReplyConfig": {
+						"bodyFormat": {
+							"jsonFormat": {
+								"code": "%RESPONSE_CODE%",
+								"message": "%LOCAL_REPLY_BODY%"
+							}
+						}
+					},
+					"routeConfig": {},
+					"statPrefix": "ingress_http",
+					"upgradeConfigs": [
+						{
+							"upgradeType": "websocket"
+						}
+					],
+					"useRemoteAddress": false
+				}
+				`,
+		},
+		{
+			desc: "Generate HttpConMgr when accessLogServiceAddress is defined",
+			opts: options.ConfigGeneratorOptions{
+				AccessLogServiceAddress:             "grpc://127.0.0.1:9001",
+				AccessLogServiceBufferSizeBytes:     4096,
+				AccessLogServiceBufferFlushInterval: 5 * time.Second,
+				AccessLogServiceRequestHeaders:      "x-request-id,user-agent",
+				AccessLogServiceResponseHeaders:     "content-type",
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+			},
+			wantHttpConnMgr: `
+				{
+					"accessLog": [
+						{
+							"name": "envoy.access_loggers.http_grpc",
+							"typedConfig": {
+								"@type": "type.googleapis.com/envoy.extensions.access_loggers.grpc.v3.HttpGrpcAccessLogConfig",
+								"additionalRequestHeadersToLog": ["x-request-id", "user-agent"],
+								"additionalResponseHeadersToLog": ["content-type"],
+								"commonConfig": {
+									"bufferFlushInterval": "5s",
+									"bufferSizeBytes": 4096,
+									"grpcService": {
+										"envoyGrpc": {
+											"clusterName": "access-log-service-cluster"
+										}
+									},
+									"logName": "ingress_http",
+									"transportApiVersion": "V3"
+								}
+							}
+						}
+					],
+					"commonHttpProtocolOptions": {
+						"headersWithUnderscoresAction": "REJECT_REQUEST"
+					},
+					"localReplyConfig": {
+						"bodyFormat": {
+							"jsonFormat": {
+								"code": "%RESPONSE_CODE%",
+								"message": "%LOCAL_REPLY_BODY%"
+							}
+						}
+					},
+					"routeConfig": {},
+					"statPrefix": "ingress_http",
+					"upgradeConfigs": [
+						{
+							"upgradeType": "websocket"
+						}
+					],
+					"useRemoteAddress": false
+				}
+				`,
+		},
+		{
+			desc: "Fail when accessLog has both text and JSON formats",
+			opts: options.ConfigGeneratorOptions{
+				AccessLog:           "/foo",
+				AccessLogFormat:     "/bar",
+				AccessLogJsonFormat: `{"status":"%RESPONSE_CODE%"}`,
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+			},
+			wantError: "cannot be both specified",
+		},
+		{
+			desc: "Fail when accessLog has an invalid min status code",
+			opts: options.ConfigGeneratorOptions{
+				AccessLog:              "/foo",
+				AccessLogMinStatusCode: 1000,
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+			},
+			wantError: "must be between 100 and 599",
+		},
 		{
 			desc: "Generate HttpConMgr when tracing is enabled",
 			opts: options.ConfigGeneratorOptions{
@@ -1269,11 +2892,80 @@ func TestMakeHttpConMgr(t *testing.T) {
 					"useRemoteAddress": false
 				}`,
 		},
+		{
+			desc: "Generate HttpConMgr when LocalReplyJsonFormat and LocalReplyIncludeDetails are defined",
+			opts: options.ConfigGeneratorOptions{
+				LocalReplyJsonFormat:     `{"error":{"status":"%RESPONSE_CODE%","message":"%LOCAL_REPLY_BODY%"}}`,
+				LocalReplyIncludeDetails: true,
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+			},
+			wantHttpConnMgr: `
+				{
+					"commonHttpProtocolOptions": {
+						"headersWithUnderscoresAction": "REJECT_REQUEST"
+					},
+					"localReplyConfig": {
+						"bodyFormat": {
+							"jsonFormat": {
+								"details": [
+									{
+										"@type": "type.googleapis.com/google.rpc.ErrorInfo",
+										"metadata": {
+											"response_code_details": "%RESPONSE_CODE_DETAILS%"
+										}
+									}
+								],
+								"error": {
+									"message": "%LOCAL_REPLY_BODY%",
+									"status": "%RESPONSE_CODE%"
+								}
+							}
+						}
+					},
+					"routeConfig": {},
+					"statPrefix": "ingress_http",
+					"upgradeConfigs": [
+						{
+							"upgradeType": "websocket"
+						}
+					],
+					"useRemoteAddress": false
+				}`,
+		},
+		{
+			desc: "Fail when LocalReplyJsonFormat is not a JSON object",
+			opts: options.ConfigGeneratorOptions{
+				LocalReplyJsonFormat: `["%RESPONSE_CODE%"]`,
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+			},
+			wantError: "must be a JSON object",
+		},
+		{
+			desc: "Fail when LocalReplyJsonFormat has the details field and LocalReplyIncludeDetails is defined",
+			opts: options.ConfigGeneratorOptions{
+				LocalReplyJsonFormat:     `{"details":"%RESPONSE_CODE_DETAILS%"}`,
+				LocalReplyIncludeDetails: true,
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+			},
+			wantError: `cannot have the field "details"`,
+		},
 	}
 
 	for _, tc := range testdata {
 		routeConfig := routepb.RouteConfiguration{}
 		hcm, err := makeHttpConMgr(&tc.opts, &routeConfig)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%v): expected err: %v, got: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
 		if err != nil {
 			t.Fatalf("Test (%v) failed with error: %v", tc.desc, err)
 		}
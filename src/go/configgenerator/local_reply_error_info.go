@@ -0,0 +1,169 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/golang/protobuf/proto"
+
+	acpb "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+const (
+	localReplyErrorInfoField = "error_info"
+	localReplyHelpField      = "help"
+
+	// The ErrorInfo reason of the local replies not matching any of
+	// localReplyErrorReasons.
+	localReplyDefaultErrorReason = "REQUEST_REJECTED"
+	// The ErrorInfo reason of the transcoded gRPC errors of the backends.
+	localReplyBackendErrorReason = "BACKEND_ERROR"
+	localReplyHelpDescription    = "Troubleshooting the errors of the API proxy"
+)
+
+// localReplyErrorReasons are the ErrorInfo reasons of the local replies with
+// the response flag or the status code, the first matching one wins.
+var localReplyErrorReasons = []struct {
+	responseFlag string
+	statusCode   uint32
+	reason       string
+}{
+	{responseFlag: "NR", reason: "ROUTE_NOT_FOUND"},
+	{statusCode: 401, reason: "UNAUTHENTICATED"},
+	{statusCode: 403, reason: "PERMISSION_DENIED"},
+	{statusCode: 429, reason: "RATE_LIMIT_EXCEEDED"},
+	{statusCode: 503, reason: "SERVICE_UNAVAILABLE"},
+}
+
+// addLocalReplyErrorInfo adds the google.rpc.ErrorInfo and google.rpc.Help
+// details to the body of the local replies, and returns the mappers setting
+// the ErrorInfo reason of each kind of local reply.
+func addLocalReplyErrorInfo(opts *options.ConfigGeneratorOptions, jsonFormat *structpb.Struct) ([]*hcmpb.ResponseMapper, error) {
+	if err := addErrorInfoFields(opts, jsonFormat, localReplyDefaultErrorReason); err != nil {
+		return nil, err
+	}
+	if opts.LocalReplyErrorInfoDomain == "" {
+		return nil, nil
+	}
+
+	var mappers []*hcmpb.ResponseMapper
+	for _, r := range localReplyErrorReasons {
+		reasonFormat := proto.Clone(jsonFormat).(*structpb.Struct)
+		reasonFormat.Fields[localReplyErrorInfoField].GetStructValue().Fields["reason"] = stringValue(r.reason)
+
+		mapper := &hcmpb.ResponseMapper{
+			BodyFormatOverride: &corepb.SubstitutionFormatString{
+				Format: &corepb.SubstitutionFormatString_JsonFormat{
+					JsonFormat: reasonFormat,
+				},
+			},
+		}
+		if r.responseFlag != "" {
+			mapper.Filter = &acpb.AccessLogFilter{
+				FilterSpecifier: &acpb.AccessLogFilter_ResponseFlagFilter{
+					ResponseFlagFilter: &acpb.ResponseFlagFilter{
+						Flags: []string{r.responseFlag},
+					},
+				},
+			}
+		} else {
+			mapper.Filter = &acpb.AccessLogFilter{
+				FilterSpecifier: &acpb.AccessLogFilter_StatusCodeFilter{
+					StatusCodeFilter: &acpb.StatusCodeFilter{
+						Comparison: &acpb.ComparisonFilter{
+							Op: acpb.ComparisonFilter_EQ,
+							Value: &corepb.RuntimeUInt32{
+								DefaultValue: r.statusCode,
+								RuntimeKey:   fmt.Sprintf("local_reply_error_info.status_code_%d", r.statusCode),
+							},
+						},
+					},
+				},
+			}
+		}
+		mappers = append(mappers, mapper)
+	}
+	return mappers, nil
+}
+
+// addErrorInfoFields adds the google.rpc.Help and the google.rpc.ErrorInfo
+// fields, with the reason, to the JSON format of the error responses.
+func addErrorInfoFields(opts *options.ConfigGeneratorOptions, jsonFormat *structpb.Struct, reason string) error {
+	if opts.LocalReplyErrorInfoDomain == "" && opts.LocalReplyErrorInfoMetadata != "" {
+		return fmt.Errorf("--local_reply_error_info_metadata requires --local_reply_error_info_domain")
+	}
+
+	if opts.LocalReplyHelpUrl != "" {
+		u, err := url.Parse(opts.LocalReplyHelpUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid --local_reply_help_url %q, must be an http or https URL", opts.LocalReplyHelpUrl)
+		}
+		if _, ok := jsonFormat.Fields[localReplyHelpField]; ok {
+			return fmt.Errorf("--local_reply_json_format cannot have the field %q when --local_reply_help_url is set", localReplyHelpField)
+		}
+		jsonFormat.Fields[localReplyHelpField] = structValue(map[string]*structpb.Value{
+			"@type":       stringValue("type.googleapis.com/google.rpc.Help.Link"),
+			"description": stringValue(localReplyHelpDescription),
+			"url":         stringValue(opts.LocalReplyHelpUrl),
+		})
+	}
+
+	if opts.LocalReplyErrorInfoDomain == "" {
+		return nil
+	}
+	if _, ok := jsonFormat.Fields[localReplyErrorInfoField]; ok {
+		return fmt.Errorf("--local_reply_json_format cannot have the field %q when --local_reply_error_info_domain is set", localReplyErrorInfoField)
+	}
+
+	// The response code details tell the missing or the invalid part of the
+	// request, e.g. "jwt_authn_access_denied{Jwt_is_missing}".
+	metadata := map[string]*structpb.Value{
+		"response_code_details": stringValue("%RESPONSE_CODE_DETAILS%"),
+	}
+	for _, entry := range strings.Split(opts.LocalReplyErrorInfoMetadata, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("invalid --local_reply_error_info_metadata entry %q, must be in the format KEY=VALUE", entry)
+		}
+		metadata[strings.TrimSpace(kv[0])] = stringValue(strings.TrimSpace(kv[1]))
+	}
+
+	jsonFormat.Fields[localReplyErrorInfoField] = structValue(map[string]*structpb.Value{
+		"@type":    stringValue("type.googleapis.com/google.rpc.ErrorInfo"),
+		"reason":   stringValue(reason),
+		"domain":   stringValue(opts.LocalReplyErrorInfoDomain),
+		"metadata": structValue(metadata),
+	})
+	return nil
+}
+
+func stringValue(s string) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: s}}
+}
+
+func structValue(fields map[string]*structpb.Value) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{Fields: fields}}}
+}
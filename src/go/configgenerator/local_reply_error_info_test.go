@@ -0,0 +1,144 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+func TestAddLocalReplyErrorInfo(t *testing.T) {
+	testData := []struct {
+		desc                 string
+		localReplyJsonFormat string
+		errorInfoDomain      string
+		errorInfoMetadata    string
+		helpUrl              string
+		wantJsonFormat       string
+		wantReasons          []string
+		wantError            string
+	}{
+		{
+			desc:           "no error info by default",
+			wantJsonFormat: `{"code":"%RESPONSE_CODE%","message":"%LOCAL_REPLY_BODY%"}`,
+		},
+		{
+			desc:              "error info with metadata and help link",
+			errorInfoDomain:   "bookstore.endpoints.project123.cloud.goog",
+			errorInfoMetadata: "host=%REQ(:AUTHORITY)%, service=bookstore",
+			helpUrl:           "https://example.com/errors",
+			wantJsonFormat: `{
+				"code": "%RESPONSE_CODE%",
+				"message": "%LOCAL_REPLY_BODY%",
+				"error_info": {
+					"@type": "type.googleapis.com/google.rpc.ErrorInfo",
+					"reason": "REQUEST_REJECTED",
+					"domain": "bookstore.endpoints.project123.cloud.goog",
+					"metadata": {
+						"response_code_details": "%RESPONSE_CODE_DETAILS%",
+						"host": "%REQ(:AUTHORITY)%",
+						"service": "bookstore"
+					}
+				},
+				"help": {
+					"@type": "type.googleapis.com/google.rpc.Help.Link",
+					"description": "Troubleshooting the errors of the API proxy",
+					"url": "https://example.com/errors"
+				}
+			}`,
+			wantReasons: []string{
+				"ROUTE_NOT_FOUND",
+				"UNAUTHENTICATED",
+				"PERMISSION_DENIED",
+				"RATE_LIMIT_EXCEEDED",
+				"SERVICE_UNAVAILABLE",
+			},
+		},
+		{
+			desc:           "help link only",
+			helpUrl:        "http://example.com/errors",
+			wantJsonFormat: `{"code":"%RESPONSE_CODE%","message":"%LOCAL_REPLY_BODY%","help":{"@type":"type.googleapis.com/google.rpc.Help.Link","description":"Troubleshooting the errors of the API proxy","url":"http://example.com/errors"}}`,
+		},
+		{
+			desc:              "metadata without domain",
+			errorInfoMetadata: "service=bookstore",
+			wantError:         "--local_reply_error_info_metadata requires --local_reply_error_info_domain",
+		},
+		{
+			desc:              "invalid metadata",
+			errorInfoDomain:   "bookstore.endpoints.project123.cloud.goog",
+			errorInfoMetadata: "bookstore",
+			wantError:         `invalid --local_reply_error_info_metadata entry "bookstore", must be in the format KEY=VALUE`,
+		},
+		{
+			desc:      "invalid help url",
+			helpUrl:   "example.com/errors",
+			wantError: `invalid --local_reply_help_url "example.com/errors", must be an http or https URL`,
+		},
+		{
+			desc:                 "json format has the error_info field",
+			localReplyJsonFormat: `{"error_info":"%LOCAL_REPLY_BODY%"}`,
+			errorInfoDomain:      "bookstore.endpoints.project123.cloud.goog",
+			wantError:            `--local_reply_json_format cannot have the field "error_info" when --local_reply_error_info_domain is set`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.LocalReplyJsonFormat = tc.localReplyJsonFormat
+			opts.LocalReplyErrorInfoDomain = tc.errorInfoDomain
+			opts.LocalReplyErrorInfoMetadata = tc.errorInfoMetadata
+			opts.LocalReplyHelpUrl = tc.helpUrl
+			jsonFormat, err := makeLocalReplyJsonFormat(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mappers, err := addLocalReplyErrorInfo(&opts, jsonFormat)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotJsonFormat, err := (&jsonpb.Marshaler{}).MarshalToString(jsonFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(tc.wantJsonFormat, gotJsonFormat); err != nil {
+				t.Errorf("json format mismatch: %v", err)
+			}
+
+			var gotReasons []string
+			for _, mapper := range mappers {
+				errorInfo := mapper.GetBodyFormatOverride().GetJsonFormat().GetFields()["error_info"].GetStructValue()
+				gotReasons = append(gotReasons, errorInfo.GetFields()["reason"].GetStringValue())
+			}
+			if !reflect.DeepEqual(gotReasons, tc.wantReasons) {
+				t.Errorf("got reasons: %v, want: %v", gotReasons, tc.wantReasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/backend_auth"
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	transcoderpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_json_transcoder/v3"
+	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// serviceDomains returns the domains of the virtual host of an additional
+// service: its name and the names of its endpoints, on any port.
+func serviceDomains(serviceInfo *sc.ServiceInfo) []string {
+	names := []string{serviceInfo.Name}
+	for _, endpoint := range serviceInfo.ServiceConfig().GetEndpoints() {
+		names = append(names, endpoint.GetName())
+		names = append(names, endpoint.GetAliases()...)
+	}
+
+	var domains []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		domains = append(domains, name, name+":*")
+	}
+	return domains
+}
+
+// checkAdditionalServices checks that the services served by the same
+// listener don't share operations or domains, as the filters look up their
+// requirements by operation and Envoy picks the virtual host by domain.
+func checkAdditionalServices(serviceInfo *sc.ServiceInfo) error {
+	operationServices := make(map[string]string)
+	for _, operation := range serviceInfo.Operations {
+		operationServices[operation] = serviceInfo.Name
+	}
+	domainServices := make(map[string]string)
+
+	for _, additionalService := range serviceInfo.AdditionalServices {
+		if additionalService.Name == serviceInfo.Name {
+			return fmt.Errorf("service %s is specified more than once", additionalService.Name)
+		}
+		for _, operation := range additionalService.Operations {
+			if service, ok := operationServices[operation]; ok {
+				return fmt.Errorf("operation %s of service %s is also served by service %s", operation, additionalService.Name, service)
+			}
+			operationServices[operation] = additionalService.Name
+		}
+		for _, domain := range serviceDomains(additionalService) {
+			if service, ok := domainServices[domain]; ok {
+				return fmt.Errorf("domain %s of service %s is also used by service %s", domain, additionalService.Name, service)
+			}
+			domainServices[domain] = additionalService.Name
+		}
+	}
+	return nil
+}
+
+// appendClusters appends the clusters not already in the list, by name.
+func appendClusters(clusters []*clusterpb.Cluster, additionalClusters []*clusterpb.Cluster) []*clusterpb.Cluster {
+	names := make(map[string]bool)
+	for _, cluster := range clusters {
+		names[cluster.GetName()] = true
+	}
+	for _, cluster := range additionalClusters {
+		if names[cluster.GetName()] {
+			continue
+		}
+		names[cluster.GetName()] = true
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// mergeHttpFilters merges the filters of an additional service into the ones
+// of the listener. Both lists follow the filter order of MakeHttpFilters, so a
+// filter missing from the listener is inserted after the one preceding it in
+// the additional list.
+func mergeHttpFilters(filters []*hcmpb.HttpFilter, additionalFilters []*hcmpb.HttpFilter) ([]*hcmpb.HttpFilter, error) {
+	merged := append([]*hcmpb.HttpFilter{}, filters...)
+	pos := -1
+	for _, filter := range additionalFilters {
+		idx := -1
+		for i, f := range merged {
+			if f.GetName() == filter.GetName() {
+				idx = i
+				break
+			}
+		}
+
+		if idx < 0 {
+			pos++
+			merged = append(merged[:pos], append([]*hcmpb.HttpFilter{filter}, merged[pos:]...)...)
+			continue
+		}
+
+		mergedFilter, err := mergeHttpFilter(merged[idx], filter)
+		if err != nil {
+			return nil, err
+		}
+		merged[idx] = mergedFilter
+		pos = idx
+	}
+	return merged, nil
+}
+
+// mergeHttpFilter merges two configs of the same filter. The filters keyed by
+// service or operation are merged, the others must have the same config. The
+// per-operation filters, e.g. RBAC or Idempotency, have their operation
+// configs on the routes and the same filter config for all the services, since
+// it only depends on the flags.
+func mergeHttpFilter(filter, additionalFilter *hcmpb.HttpFilter) (*hcmpb.HttpFilter, error) {
+	if proto.Equal(filter, additionalFilter) {
+		return filter, nil
+	}
+
+	var config proto.Message
+	var err error
+	switch filter.GetName() {
+	case util.ServiceControl:
+		config, err = mergeServiceControlConfigs(filter, additionalFilter)
+	case util.JwtAuthn:
+		config, err = mergeJwtAuthnConfigs(filter, additionalFilter)
+	case util.BackendAuth:
+		config, err = mergeBackendAuthConfigs(filter, additionalFilter)
+	case util.GRPCJSONTranscoder:
+		config, err = mergeTranscoderConfigs(filter, additionalFilter)
+	case util.RateLimit:
+		// The domain of the rate limit service is the name of the service,
+		// and the filter has a single one.
+		return nil, fmt.Errorf("--rate_limit_service_address is not supported with the additional services")
+	default:
+		return nil, fmt.Errorf("filter %s has different configs for the services", filter.GetName())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	typedConfig, err := ptypes.MarshalAny(config)
+	if err != nil {
+		return nil, err
+	}
+	return &hcmpb.HttpFilter{
+		Name:       filter.GetName(),
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{TypedConfig: typedConfig},
+	}, nil
+}
+
+func mergeServiceControlConfigs(filter, additionalFilter *hcmpb.HttpFilter) (proto.Message, error) {
+	config, additionalConfig := &scpb.FilterConfig{}, &scpb.FilterConfig{}
+	if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), config); err != nil {
+		return nil, err
+	}
+	if err := ptypes.UnmarshalAny(additionalFilter.GetTypedConfig(), additionalConfig); err != nil {
+		return nil, err
+	}
+
+	config.Services = append(config.Services, additionalConfig.GetServices()...)
+	config.Requirements = append(config.Requirements, additionalConfig.GetRequirements()...)
+	return config, nil
+}
+
+func mergeJwtAuthnConfigs(filter, additionalFilter *hcmpb.HttpFilter) (proto.Message, error) {
+	config, additionalConfig := &jwtpb.JwtAuthentication{}, &jwtpb.JwtAuthentication{}
+	if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), config); err != nil {
+		return nil, err
+	}
+	if err := ptypes.UnmarshalAny(additionalFilter.GetTypedConfig(), additionalConfig); err != nil {
+		return nil, err
+	}
+
+	for id, provider := range additionalConfig.GetProviders() {
+		if p, ok := config.Providers[id]; ok && !proto.Equal(p, provider) {
+			return nil, fmt.Errorf("jwt provider %s has different configs for the services", id)
+		}
+		config.Providers[id] = provider
+	}
+	if config.RequirementMap == nil {
+		config.RequirementMap = make(map[string]*jwtpb.JwtRequirement)
+	}
+	for selector, requirement := range additionalConfig.GetRequirementMap() {
+		config.RequirementMap[selector] = requirement
+	}
+	return config, nil
+}
+
+func mergeBackendAuthConfigs(filter, additionalFilter *hcmpb.HttpFilter) (proto.Message, error) {
+	config, additionalConfig := &bapb.FilterConfig{}, &bapb.FilterConfig{}
+	if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), config); err != nil {
+		return nil, err
+	}
+	if err := ptypes.UnmarshalAny(additionalFilter.GetTypedConfig(), additionalConfig); err != nil {
+		return nil, err
+	}
+
+	audiences := make(map[string]bool)
+	for _, aud := range config.GetJwtAudienceList() {
+		audiences[aud] = true
+	}
+	for _, aud := range additionalConfig.GetJwtAudienceList() {
+		if !audiences[aud] {
+			audiences[aud] = true
+			config.JwtAudienceList = append(config.JwtAudienceList, aud)
+		}
+	}
+	sort.Strings(config.JwtAudienceList)
+	return config, nil
+}
+
+// mergeTranscoderConfigs merges the proto descriptors and the transcoded apis
+// of the services. The files imported by several services, e.g. the
+// google/api ones, must be the same. The transcoder matches the HTTP rules of
+// all the services on any virtual host, the transcoded calls are then only
+// routed on the virtual host of their service.
+func mergeTranscoderConfigs(filter, additionalFilter *hcmpb.HttpFilter) (proto.Message, error) {
+	config, additionalConfig := &transcoderpb.GrpcJsonTranscoder{}, &transcoderpb.GrpcJsonTranscoder{}
+	if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), config); err != nil {
+		return nil, err
+	}
+	if err := ptypes.UnmarshalAny(additionalFilter.GetTypedConfig(), additionalConfig); err != nil {
+		return nil, err
+	}
+
+	descriptorSet, additionalDescriptorSet := &descpb.FileDescriptorSet{}, &descpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(config.GetProtoDescriptorBin(), descriptorSet); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal the proto descriptor, %v", err)
+	}
+	if err := proto.Unmarshal(additionalConfig.GetProtoDescriptorBin(), additionalDescriptorSet); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal the proto descriptor, %v", err)
+	}
+	files := make(map[string]*descpb.FileDescriptorProto)
+	for _, file := range descriptorSet.GetFile() {
+		files[file.GetName()] = file
+	}
+	for _, file := range additionalDescriptorSet.GetFile() {
+		if f, ok := files[file.GetName()]; ok {
+			if !proto.Equal(f, file) {
+				return nil, fmt.Errorf("proto file %s has different descriptors for the services", file.GetName())
+			}
+			continue
+		}
+		files[file.GetName()] = file
+		descriptorSet.File = append(descriptorSet.File, file)
+	}
+	descriptorBin, err := proto.Marshal(descriptorSet)
+	if err != nil {
+		return nil, err
+	}
+
+	config.DescriptorSet = &transcoderpb.GrpcJsonTranscoder_ProtoDescriptorBin{
+		ProtoDescriptorBin: descriptorBin,
+	}
+	config.Services = append(config.Services, additionalConfig.GetServices()...)
+	config.IgnoredQueryParameters = mergeSortedStrings(config.GetIgnoredQueryParameters(), additionalConfig.GetIgnoredQueryParameters())
+	return config, nil
+}
+
+// mergeSortedStrings returns the sorted union of the lists.
+func mergeSortedStrings(list, additionalList []string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, s := range append(append([]string{}, list...), additionalList...) {
+		if !seen[s] {
+			seen[s] = true
+			merged = append(merged, s)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
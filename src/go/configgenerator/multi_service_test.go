@@ -0,0 +1,388 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	transcoderpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_json_transcoder/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func makeTestMultiServiceInfo(t *testing.T, additionalConfigs ...*confpb.Service) *configinfo.ServiceInfo {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		Control: &confpb.Control{
+			Environment: statPrefix,
+		},
+	}, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, config := range additionalConfigs {
+		additionalService, err := configinfo.NewServiceInfoFromServiceConfig(config, config.GetId(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serviceInfo.AdditionalServices = append(serviceInfo.AdditionalServices, additionalService)
+	}
+	return serviceInfo
+}
+
+func TestMultiService(t *testing.T) {
+	serviceInfo := makeTestMultiServiceInfo(t, &confpb.Service{
+		Name: "echo.endpoints.project123.cloud.goog",
+		Id:   "2020-01-01r0",
+		Apis: []*apipb.Api{
+			{
+				Name: "echo.Echo",
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Endpoints: []*confpb.Endpoint{
+			{
+				Name: "echo.example.com",
+			},
+		},
+		Control: &confpb.Control{
+			Environment: statPrefix,
+		},
+	})
+
+	clusters, err := MakeClusters(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterNames := make(map[string]int)
+	for _, cluster := range clusters {
+		clusterNames[cluster.GetName()]++
+	}
+	for _, name := range []string{
+		"backend-cluster-bookstore.endpoints.project123.cloud.goog_local",
+		"backend-cluster-echo.endpoints.project123.cloud.goog_local",
+		util.ServiceControlClusterName,
+	} {
+		if clusterNames[name] != 1 {
+			t.Errorf("want 1 cluster %s, get %d in clusters %v", name, clusterNames[name], clusterNames)
+		}
+	}
+
+	routeConfig, err := MakeRouteConfig(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotHosts [][]string
+	for _, host := range routeConfig.GetVirtualHosts() {
+		gotHosts = append(gotHosts, append([]string{host.GetName()}, host.GetDomains()...))
+	}
+	wantHosts := [][]string{
+		{"backend", "*"},
+		{"echo.endpoints.project123.cloud.goog", "echo.endpoints.project123.cloud.goog", "echo.endpoints.project123.cloud.goog:*", "echo.example.com", "echo.example.com:*"},
+	}
+	if !reflect.DeepEqual(gotHosts, wantHosts) {
+		t.Errorf("want virtual hosts %v, get %v", wantHosts, gotHosts)
+	}
+
+	listener, err := makeListener(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpConMgr := &hcmpb.HttpConnectionManager{}
+	if err := ptypes.UnmarshalAny(listener.GetFilterChains()[0].GetFilters()[0].GetTypedConfig(), httpConMgr); err != nil {
+		t.Fatal(err)
+	}
+	var gotFilters []string
+	scConfig := &scpb.FilterConfig{}
+	for _, filter := range httpConMgr.GetHttpFilters() {
+		gotFilters = append(gotFilters, filter.GetName())
+		if filter.GetName() == util.ServiceControl {
+			if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), scConfig); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if wantFilters := []string{util.ServiceControl, util.GrpcMetadataScrubber, util.Router}; !reflect.DeepEqual(gotFilters, wantFilters) {
+		t.Errorf("want filters %v, get %v", wantFilters, gotFilters)
+	}
+
+	var gotServices, gotOperations []string
+	for _, service := range scConfig.GetServices() {
+		gotServices = append(gotServices, service.GetServiceName()+"/"+service.GetServiceConfigId())
+	}
+	for _, requirement := range scConfig.GetRequirements() {
+		gotOperations = append(gotOperations, requirement.GetServiceName()+"/"+requirement.GetOperationName())
+	}
+	wantServices := []string{testProjectName + "/" + testConfigID, "echo.endpoints.project123.cloud.goog/2020-01-01r0"}
+	if !reflect.DeepEqual(gotServices, wantServices) {
+		t.Errorf("want service control services %v, get %v", wantServices, gotServices)
+	}
+	wantOperations := []string{testProjectName + "/" + testApiName + ".ListShelves", "echo.endpoints.project123.cloud.goog/echo.Echo.Echo"}
+	if !reflect.DeepEqual(gotOperations, wantOperations) {
+		t.Errorf("want service control requirements %v, get %v", wantOperations, gotOperations)
+	}
+}
+
+func TestMultiServiceError(t *testing.T) {
+	testData := []struct {
+		desc              string
+		additionalConfigs []*confpb.Service
+		wantError         string
+	}{
+		{
+			desc: "the same service twice",
+			additionalConfigs: []*confpb.Service{
+				{
+					Name: testProjectName,
+					Apis: []*apipb.Api{{Name: "echo.Echo"}},
+				},
+			},
+			wantError: "service bookstore.endpoints.project123.cloud.goog is specified more than once",
+		},
+		{
+			desc: "operation served by two services",
+			additionalConfigs: []*confpb.Service{
+				{
+					Name: "echo.endpoints.project123.cloud.goog",
+					Apis: []*apipb.Api{
+						{
+							Name:    testApiName,
+							Methods: []*apipb.Method{{Name: "ListShelves"}},
+						},
+					},
+				},
+			},
+			wantError: "operation endpoints.examples.bookstore.Bookstore.ListShelves of service echo.endpoints.project123.cloud.goog is also served by service bookstore.endpoints.project123.cloud.goog",
+		},
+		{
+			desc: "domain used by two services",
+			additionalConfigs: []*confpb.Service{
+				{
+					Name:      "echo.endpoints.project123.cloud.goog",
+					Apis:      []*apipb.Api{{Name: "echo.Echo"}},
+					Endpoints: []*confpb.Endpoint{{Name: "api.example.com"}},
+				},
+				{
+					Name:      "echo2.endpoints.project123.cloud.goog",
+					Apis:      []*apipb.Api{{Name: "echo2.Echo"}},
+					Endpoints: []*confpb.Endpoint{{Name: "api.example.com"}},
+				},
+			},
+			wantError: "domain api.example.com of service echo2.endpoints.project123.cloud.goog is also used by service echo.endpoints.project123.cloud.goog",
+		},
+	}
+
+	for _, tc := range testData {
+		serviceInfo := makeTestMultiServiceInfo(t, tc.additionalConfigs...)
+		_, err := MakeRouteConfig(serviceInfo)
+		if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+			t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+		}
+	}
+}
+
+// makeTestGrpcServiceConfig returns the config of a gRPC service with the
+// proto descriptor of its api and of the files.
+func makeTestGrpcServiceConfig(t *testing.T, name, pkg string, files ...*descpb.FileDescriptorProto) *confpb.Service {
+	descriptorSet := &descpb.FileDescriptorSet{
+		File: append([]*descpb.FileDescriptorProto{
+			{
+				Name:    proto.String(pkg + ".proto"),
+				Package: proto.String(pkg),
+				Service: []*descpb.ServiceDescriptorProto{
+					{
+						Name:   proto.String("Echo"),
+						Method: []*descpb.MethodDescriptorProto{{Name: proto.String("Echo")}},
+					},
+				},
+			},
+		}, files...),
+	}
+	descriptorBin, err := proto.Marshal(descriptorSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceFile, err := ptypes.MarshalAny(&smpb.ConfigFile{
+		FilePath:     "api_descriptor.pb",
+		FileContents: descriptorBin,
+		FileType:     smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &confpb.Service{
+		Name: name,
+		Id:   "2020-01-01r0",
+		Apis: []*apipb.Api{
+			{
+				Name:    pkg + ".Echo",
+				Methods: []*apipb.Method{{Name: "Echo"}},
+			},
+		},
+		SourceInfo: &confpb.SourceInfo{
+			SourceFiles: []*anypb.Any{sourceFile},
+		},
+	}
+}
+
+func TestMultiServiceGrpc(t *testing.T) {
+	commonFile := &descpb.FileDescriptorProto{
+		Name:    proto.String("google/protobuf/empty.proto"),
+		Package: proto.String("google.protobuf"),
+	}
+	testData := []struct {
+		desc         string
+		configs      []*confpb.Service
+		setOptions   func(opts *options.ConfigGeneratorOptions)
+		wantFiles    []string
+		wantServices []string
+		wantError    string
+	}{
+		{
+			desc: "the transcoded apis and the proto files of the services are merged",
+			configs: []*confpb.Service{
+				makeTestGrpcServiceConfig(t, "echo.endpoints.project123.cloud.goog", "echo", commonFile),
+				makeTestGrpcServiceConfig(t, "echo2.endpoints.project123.cloud.goog", "echo2", commonFile),
+			},
+			wantFiles:    []string{"echo.proto", "google/protobuf/empty.proto", "echo2.proto"},
+			wantServices: []string{"echo.Echo", "echo2.Echo"},
+		},
+		{
+			desc: "the per-operation filters have the same config for the services",
+			configs: []*confpb.Service{
+				makeTestGrpcServiceConfig(t, "echo.endpoints.project123.cloud.goog", "echo"),
+				makeTestGrpcServiceConfig(t, "echo2.endpoints.project123.cloud.goog", "echo2"),
+			},
+			setOptions: func(opts *options.ConfigGeneratorOptions) {
+				opts.SpikeArrestRps = 100
+				opts.DenyUserAgents = "badbot"
+				opts.RateLimitTiers = "free=10/1m"
+			},
+			wantFiles:    []string{"echo.proto", "echo2.proto"},
+			wantServices: []string{"echo.Echo", "echo2.Echo"},
+		},
+		{
+			desc: "a proto file with different descriptors for the services",
+			configs: []*confpb.Service{
+				makeTestGrpcServiceConfig(t, "echo.endpoints.project123.cloud.goog", "echo", commonFile),
+				makeTestGrpcServiceConfig(t, "echo2.endpoints.project123.cloud.goog", "echo2", &descpb.FileDescriptorProto{
+					Name:    proto.String("google/protobuf/empty.proto"),
+					Package: proto.String("google.protobuf.other"),
+				}),
+			},
+			wantError: "proto file google/protobuf/empty.proto has different descriptors for the services",
+		},
+		{
+			desc: "the rate limit service with the additional services",
+			configs: []*confpb.Service{
+				makeTestGrpcServiceConfig(t, "echo.endpoints.project123.cloud.goog", "echo"),
+				makeTestGrpcServiceConfig(t, "echo2.endpoints.project123.cloud.goog", "echo2"),
+			},
+			setOptions: func(opts *options.ConfigGeneratorOptions) {
+				opts.RateLimitServiceAddress = "127.0.0.1:8081"
+			},
+			wantError: "--rate_limit_service_address is not supported with the additional services",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.1:8082"
+		opts.DisableTracing = true
+		if tc.setOptions != nil {
+			tc.setOptions(&opts)
+		}
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.configs[0], tc.configs[0].GetId(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, config := range tc.configs[1:] {
+			additionalService, err := configinfo.NewServiceInfoFromServiceConfig(config, config.GetId(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serviceInfo.AdditionalServices = append(serviceInfo.AdditionalServices, additionalService)
+		}
+
+		listener, err := makeListener(serviceInfo)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): got error: %v", tc.desc, err)
+		}
+
+		httpConMgr := &hcmpb.HttpConnectionManager{}
+		if err := ptypes.UnmarshalAny(listener.GetFilterChains()[0].GetFilters()[0].GetTypedConfig(), httpConMgr); err != nil {
+			t.Fatal(err)
+		}
+		transcoderConfig := &transcoderpb.GrpcJsonTranscoder{}
+		for _, filter := range httpConMgr.GetHttpFilters() {
+			if filter.GetName() == util.GRPCJSONTranscoder {
+				if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), transcoderConfig); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		descriptorSet := &descpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(transcoderConfig.GetProtoDescriptorBin(), descriptorSet); err != nil {
+			t.Fatal(err)
+		}
+		var gotFiles []string
+		for _, file := range descriptorSet.GetFile() {
+			gotFiles = append(gotFiles, file.GetName())
+		}
+		if !reflect.DeepEqual(gotFiles, tc.wantFiles) {
+			t.Errorf("Test (%s): want proto files %v, get %v", tc.desc, tc.wantFiles, gotFiles)
+		}
+		if !reflect.DeepEqual(transcoderConfig.GetServices(), tc.wantServices) {
+			t.Errorf("Test (%s): want transcoded apis %v, get %v", tc.desc, tc.wantServices, transcoderConfig.GetServices())
+		}
+	}
+}
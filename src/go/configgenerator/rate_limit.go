@@ -0,0 +1,190 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	rlpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/rate_limit"
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitconfpb "github.com/envoyproxy/go-control-plane/envoy/config/ratelimit/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	ratelimitpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ratelimit/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	metadatapb "github.com/envoyproxy/go-control-plane/envoy/type/metadata/v3"
+)
+
+// The keys of the dynamic metadata set by Service Control filter for rate
+// limiting, also used as the descriptor keys of the rate limit service.
+const (
+	consumerTierMetadataKey = "consumer_tier"
+	apiKeyHashMetadataKey   = "api_key_hash"
+)
+
+func rateLimitEnabled(opts options.ConfigGeneratorOptions) bool {
+	return opts.RateLimitTiers != "" || opts.RateLimitServiceAddress != ""
+}
+
+// makeConsumerTiers returns the consumer tiers of Service Control filter, set
+// in the dynamic metadata for the rate limit filters.
+func makeConsumerTiers(opts options.ConfigGeneratorOptions) (*scpb.ConsumerTiers, error) {
+	if !rateLimitEnabled(opts) {
+		return nil, nil
+	}
+
+	consumerTiers := &scpb.ConsumerTiers{
+		DefaultTier: opts.RateLimitDefaultTier,
+	}
+	for _, item := range strings.Split(opts.RateLimitConsumerTiers, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid --rate_limit_consumer_tiers %q, must be PROJECT_NUMBER=TIER", item)
+		}
+		if consumerTiers.ProjectNumberTiers == nil {
+			consumerTiers.ProjectNumberTiers = make(map[string]string)
+		}
+		consumerTiers.ProjectNumberTiers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return consumerTiers, nil
+}
+
+// parseRateLimitTiers parses the comma-separated TIER=REQUESTS/PERIOD limits
+// of the consumer tiers.
+func parseRateLimitTiers(stringVal string) (map[string]*rlpb.TierLimit, error) {
+	tierLimits := make(map[string]*rlpb.TierLimit)
+	for _, item := range strings.Split(stringVal, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid --rate_limit_tiers %q, must be TIER=REQUESTS/PERIOD", item)
+		}
+		limit := strings.SplitN(kv[1], "/", 2)
+		if len(limit) != 2 {
+			return nil, fmt.Errorf("invalid --rate_limit_tiers %q, must be TIER=REQUESTS/PERIOD", item)
+		}
+		requests, err := strconv.ParseUint(strings.TrimSpace(limit[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --rate_limit_tiers %q, the requests must be a non-negative integer: %v", item, err)
+		}
+		period, err := time.ParseDuration(strings.TrimSpace(limit[1]))
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid --rate_limit_tiers %q, the period must be a positive duration, e.g. 1m", item)
+		}
+		tierLimits[strings.TrimSpace(kv[0])] = &rlpb.TierLimit{
+			Requests: uint32(requests),
+			Period:   ptypes.DurationProto(period),
+		}
+	}
+	return tierLimits, nil
+}
+
+// makeRateLimitFilters returns the filters limiting the requests of each api
+// key by the tier of its consumer: the local filter of --rate_limit_tiers,
+// limiting each proxy, and the Envoy filter calling the global rate limit
+// service of --rate_limit_service_address.
+func makeRateLimitFilters(serviceInfo *configinfo.ServiceInfo) ([]*hcmpb.HttpFilter, error) {
+	var filters []*hcmpb.HttpFilter
+	if serviceInfo.Options.RateLimitTiers != "" {
+		tierLimits, err := parseRateLimitTiers(serviceInfo.Options.RateLimitTiers)
+		if err != nil {
+			return nil, err
+		}
+		localConfigAny, _ := ptypes.MarshalAny(&rlpb.FilterConfig{
+			TierLimits: tierLimits,
+		})
+		filters = append(filters, &hcmpb.HttpFilter{
+			Name: util.LocalRateLimit,
+			ConfigType: &hcmpb.HttpFilter_TypedConfig{
+				TypedConfig: localConfigAny,
+			},
+		})
+	}
+
+	if serviceInfo.Options.RateLimitServiceAddress != "" {
+		globalConfigAny, _ := ptypes.MarshalAny(&ratelimitpb.RateLimit{
+			Domain:  serviceInfo.Name,
+			Timeout: ptypes.DurationProto(serviceInfo.Options.HttpRequestTimeout),
+			RateLimitService: &ratelimitconfpb.RateLimitServiceConfig{
+				GrpcService: &corepb.GrpcService{
+					TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
+						EnvoyGrpc: &corepb.GrpcService_EnvoyGrpc{
+							ClusterName: util.RateLimitServiceClusterName,
+						},
+					},
+				},
+				TransportApiVersion: corepb.ApiVersion_V3,
+			},
+		})
+		filters = append(filters, &hcmpb.HttpFilter{
+			Name: util.RateLimit,
+			ConfigType: &hcmpb.HttpFilter_TypedConfig{
+				TypedConfig: globalConfigAny,
+			},
+		})
+	}
+	return filters, nil
+}
+
+// makeRateLimits returns the rate limits of the virtual hosts, sending the
+// consumer tier and the api key hash set by Service Control filter to the
+// global rate limit service. The requests without a consumer tier are not
+// sent.
+func makeRateLimits(opts options.ConfigGeneratorOptions) []*routepb.RateLimit {
+	if opts.RateLimitServiceAddress == "" {
+		return nil
+	}
+
+	var actions []*routepb.RateLimit_Action
+	for _, key := range []string{consumerTierMetadataKey, apiKeyHashMetadataKey} {
+		actions = append(actions, &routepb.RateLimit_Action{
+			ActionSpecifier: &routepb.RateLimit_Action_DynamicMetadata{
+				DynamicMetadata: &routepb.RateLimit_Action_DynamicMetaData{
+					DescriptorKey: key,
+					MetadataKey: &metadatapb.MetadataKey{
+						Key: util.ServiceControl,
+						Path: []*metadatapb.MetadataKey_PathSegment{
+							{
+								Segment: &metadatapb.MetadataKey_PathSegment_Key{
+									Key: key,
+								},
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+	return []*routepb.RateLimit{
+		{
+			Actions: actions,
+		},
+	}
+}
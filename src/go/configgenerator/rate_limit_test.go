@@ -0,0 +1,324 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	rlpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/rate_limit"
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	ratelimitpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ratelimit/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestParseRateLimitTiers(t *testing.T) {
+	testData := []struct {
+		desc           string
+		rateLimitTiers string
+		wantTierLimits map[string]*rlpb.TierLimit
+		wantError      string
+	}{
+		{
+			desc:           "tiers with limits",
+			rateLimitTiers: "free=10/1m, gold = 1000/1h ,",
+			wantTierLimits: map[string]*rlpb.TierLimit{
+				"free": {
+					Requests: 10,
+					Period:   ptypes.DurationProto(time.Minute),
+				},
+				"gold": {
+					Requests: 1000,
+					Period:   ptypes.DurationProto(time.Hour),
+				},
+			},
+		},
+		{
+			desc:           "tier denying all the requests",
+			rateLimitTiers: "blocked=0/1s",
+			wantTierLimits: map[string]*rlpb.TierLimit{
+				"blocked": {
+					Period: ptypes.DurationProto(time.Second),
+				},
+			},
+		},
+		{
+			desc:           "missing tier",
+			rateLimitTiers: "=10/1m",
+			wantError:      "must be TIER=REQUESTS/PERIOD",
+		},
+		{
+			desc:           "missing period",
+			rateLimitTiers: "free=10",
+			wantError:      "must be TIER=REQUESTS/PERIOD",
+		},
+		{
+			desc:           "negative requests",
+			rateLimitTiers: "free=-1/1m",
+			wantError:      "the requests must be a non-negative integer",
+		},
+		{
+			desc:           "period without unit",
+			rateLimitTiers: "free=10/60",
+			wantError:      "the period must be a positive duration",
+		},
+		{
+			desc:           "zero period",
+			rateLimitTiers: "free=10/0s",
+			wantError:      "the period must be a positive duration",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			gotTierLimits, err := parseRateLimitTiers(tc.rateLimitTiers)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("got error: %v, want error containing: %s", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(&rlpb.FilterConfig{TierLimits: gotTierLimits}, &rlpb.FilterConfig{TierLimits: tc.wantTierLimits}) {
+				t.Errorf("got tier limits: %v, want: %v", gotTierLimits, tc.wantTierLimits)
+			}
+		})
+	}
+}
+
+func TestMakeConsumerTiers(t *testing.T) {
+	testData := []struct {
+		desc                   string
+		rateLimitTiers         string
+		rateLimitConsumerTiers string
+		rateLimitDefaultTier   string
+		wantConsumerTiers      *scpb.ConsumerTiers
+		wantError              string
+	}{
+		{
+			desc:                   "no consumer tiers without rate limits",
+			rateLimitConsumerTiers: "123456=gold",
+		},
+		{
+			desc:                   "consumer tiers and default tier",
+			rateLimitTiers:         "gold=1000/1m",
+			rateLimitConsumerTiers: "123456=gold, 789=gold",
+			wantConsumerTiers: &scpb.ConsumerTiers{
+				ProjectNumberTiers: map[string]string{
+					"123456": "gold",
+					"789":    "gold",
+				},
+				DefaultTier: "default",
+			},
+		},
+		{
+			desc:                 "custom default tier",
+			rateLimitTiers:       "free=10/1m",
+			rateLimitDefaultTier: "free",
+			wantConsumerTiers: &scpb.ConsumerTiers{
+				DefaultTier: "free",
+			},
+		},
+		{
+			desc:                   "missing tier",
+			rateLimitTiers:         "gold=1000/1m",
+			rateLimitConsumerTiers: "123456",
+			wantError:              "must be PROJECT_NUMBER=TIER",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.RateLimitTiers = tc.rateLimitTiers
+			opts.RateLimitConsumerTiers = tc.rateLimitConsumerTiers
+			if tc.rateLimitDefaultTier != "" {
+				opts.RateLimitDefaultTier = tc.rateLimitDefaultTier
+			}
+
+			gotConsumerTiers, err := makeConsumerTiers(opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("got error: %v, want error containing: %s", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(gotConsumerTiers, tc.wantConsumerTiers) {
+				t.Errorf("got consumer tiers: %v, want: %v", gotConsumerTiers, tc.wantConsumerTiers)
+			}
+		})
+	}
+}
+
+func TestMakeRateLimitFilters(t *testing.T) {
+	testData := []struct {
+		desc                    string
+		rateLimitTiers          string
+		rateLimitServiceAddress string
+		wantLocalConfig         string
+		wantGlobalConfig        string
+		wantRateLimits          bool
+	}{
+		{
+			desc: "no rate limit filters without tiers and service",
+		},
+		{
+			desc:           "local rate limit filter",
+			rateLimitTiers: "gold=1000/1m",
+			wantLocalConfig: `{
+				"tierLimits": {
+					"gold": {
+						"requests": 1000,
+						"period": "60s"
+					}
+				}
+			}`,
+		},
+		{
+			desc:                    "global rate limit filter",
+			rateLimitServiceAddress: "grpc://127.0.0.1:8081",
+			wantGlobalConfig: `{
+				"domain": "bookstore.endpoints.project123.cloud.goog",
+				"timeout": "30s",
+				"rateLimitService": {
+					"grpcService": {
+						"envoyGrpc": {
+							"clusterName": "rate-limit-service-cluster"
+						}
+					},
+					"transportApiVersion": "V3"
+				}
+			}`,
+			wantRateLimits: true,
+		},
+		{
+			desc:                    "local and global rate limit filters",
+			rateLimitTiers:          "gold=1000/1m",
+			rateLimitServiceAddress: "grpc://127.0.0.1:8081",
+			wantLocalConfig: `{
+				"tierLimits": {
+					"gold": {
+						"requests": 1000,
+						"period": "60s"
+					}
+				}
+			}`,
+			wantGlobalConfig: `{
+				"domain": "bookstore.endpoints.project123.cloud.goog",
+				"timeout": "30s",
+				"rateLimitService": {
+					"grpcService": {
+						"envoyGrpc": {
+							"clusterName": "rate-limit-service-cluster"
+						}
+					},
+					"transportApiVersion": "V3"
+				}
+			}`,
+			wantRateLimits: true,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.RateLimitTiers = tc.rateLimitTiers
+			opts.RateLimitServiceAddress = tc.rateLimitServiceAddress
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			}, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filters, err := makeRateLimitFilters(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wantFilterNames []string
+			if tc.wantLocalConfig != "" {
+				wantFilterNames = append(wantFilterNames, util.LocalRateLimit)
+			}
+			if tc.wantGlobalConfig != "" {
+				wantFilterNames = append(wantFilterNames, util.RateLimit)
+			}
+			if len(filters) != len(wantFilterNames) {
+				t.Fatalf("got %d rate limit filters, want: %v", len(filters), wantFilterNames)
+			}
+
+			for i, filter := range filters {
+				if filter.GetName() != wantFilterNames[i] {
+					t.Errorf("got filter %d name: %s, want: %s", i, filter.GetName(), wantFilterNames[i])
+				}
+				var gotConfig, wantConfig proto.Message
+				switch filter.GetName() {
+				case util.LocalRateLimit:
+					gotConfig, wantConfig = &rlpb.FilterConfig{}, &rlpb.FilterConfig{}
+					if err := jsonpb.UnmarshalString(tc.wantLocalConfig, wantConfig); err != nil {
+						t.Fatal(err)
+					}
+				case util.RateLimit:
+					gotConfig, wantConfig = &ratelimitpb.RateLimit{}, &ratelimitpb.RateLimit{}
+					if err := jsonpb.UnmarshalString(tc.wantGlobalConfig, wantConfig); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), gotConfig); err != nil {
+					t.Fatal(err)
+				}
+				if !proto.Equal(gotConfig, wantConfig) {
+					t.Errorf("got filter %s config: %v, want: %v", filter.GetName(), gotConfig, wantConfig)
+				}
+			}
+
+			rateLimits := makeRateLimits(fakeServiceInfo.Options)
+			if gotRateLimits := rateLimits != nil; gotRateLimits != tc.wantRateLimits {
+				t.Fatalf("got rate limits: %v, want: %v", rateLimits, tc.wantRateLimits)
+			}
+			if tc.wantRateLimits {
+				var gotDescriptors []string
+				for _, action := range rateLimits[0].GetActions() {
+					dynamicMetadata := action.GetDynamicMetadata()
+					gotDescriptors = append(gotDescriptors, dynamicMetadata.GetDescriptorKey()+"="+
+						dynamicMetadata.GetMetadataKey().GetKey()+"."+dynamicMetadata.GetMetadataKey().GetPath()[0].GetKey())
+				}
+				wantDescriptors := "consumer_tier=com.google.espv2.filters.http.service_control.consumer_tier," +
+					"api_key_hash=com.google.espv2.filters.http.service_control.api_key_hash"
+				if strings.Join(gotDescriptors, ",") != wantDescriptors {
+					t.Errorf("got rate limit descriptors: %v, want: %s", gotDescriptors, wantDescriptors)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	ccpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/cache_control"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	cachepb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cache/v3alpha"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	descriptorpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	anypb "github.com/golang/protobuf/ptypes/any"
+)
+
+// simpleHttpCacheConfig is the config of the in-memory storage of the Envoy
+// cache filter. It has no fields and no published Go proto, so its type is
+// registered from a descriptor, for the filter config to marshal to JSON.
+var simpleHttpCacheConfig = func() protoreflect.MessageType {
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("source/extensions/filters/http/cache/simple_http_cache/config.proto"),
+		Package: proto.String("envoy.source.extensions.filters.http.cache"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("SimpleHttpCacheConfig"),
+			},
+		},
+		Syntax: proto.String("proto3"),
+	}, nil)
+	if err != nil {
+		glog.Fatalf("fail to build the SimpleHttpCacheConfig descriptor: %v", err)
+	}
+	mt := dynamicpb.NewMessageType(fd.Messages().Get(0))
+	if err := protoregistry.GlobalTypes.RegisterMessage(mt); err != nil {
+		glog.Fatalf("fail to register the SimpleHttpCacheConfig type: %v", err)
+	}
+	return mt
+}()
+
+// makeResponseCacheFilter caches the responses in memory, if any operation is
+// in --response_cache_selectors.
+//
+// The cache filter stores the cacheable responses of the GET requests for the
+// max-age of their Cache-Control. Cache Control filter sets it on the
+// responses of the selected operations whose backend sent none, so the other
+// operations are only cached if their backend marks their responses as
+// cacheable. The requests with an Authorization header, e.g. a JWT, are never
+// cached.
+func makeResponseCacheFilter(serviceInfo *configinfo.ServiceInfo) *hcmpb.HttpFilter {
+	if serviceInfo.Options.ResponseCacheSelectors == "" {
+		return nil
+	}
+
+	// The API keys are in the cache key, so the responses for an API key are
+	// never served to the callers of another one.
+	var keyHeaders, apiKeyQueryParams []string
+	seenHeaders := make(map[string]bool)
+	seenQueryParams := make(map[string]bool)
+	for _, method := range serviceInfo.Methods {
+		if method.ResponseCacheTtl <= 0 {
+			continue
+		}
+		for _, header := range method.ResponseCacheKeyHeaders {
+			if !seenHeaders[strings.ToLower(header)] {
+				seenHeaders[strings.ToLower(header)] = true
+				keyHeaders = append(keyHeaders, strings.ToLower(header))
+			}
+		}
+		for _, queryParam := range method.ResponseCacheApiKeyQueryParams {
+			if !seenQueryParams[queryParam] {
+				seenQueryParams[queryParam] = true
+				apiKeyQueryParams = append(apiKeyQueryParams, queryParam)
+			}
+		}
+	}
+	sort.Strings(keyHeaders)
+	sort.Strings(apiKeyQueryParams)
+
+	cacheConfig := &cachepb.CacheConfig{
+		TypedConfig: &anypb.Any{
+			TypeUrl: util.TypeUrlPrefix + string(simpleHttpCacheConfig.Descriptor().FullName()),
+		},
+	}
+	for _, header := range keyHeaders {
+		cacheConfig.AllowedVaryHeaders = append(cacheConfig.AllowedVaryHeaders, &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Exact{
+				Exact: header,
+			},
+			IgnoreCase: true,
+		})
+	}
+	// All the query parameters are in the cache key by default, the API keys
+	// included.
+	if queryParams := splitCommaSeparated(serviceInfo.Options.ResponseCacheKeyQueryParams); len(queryParams) > 0 {
+		cacheConfig.KeyCreatorParams = &cachepb.CacheConfig_KeyCreatorParams{}
+		included := make(map[string]bool)
+		for _, queryParam := range queryParams {
+			included[queryParam] = true
+		}
+		for _, queryParam := range apiKeyQueryParams {
+			if !included[queryParam] {
+				queryParams = append(queryParams, queryParam)
+			}
+		}
+		for _, queryParam := range queryParams {
+			cacheConfig.KeyCreatorParams.QueryParametersIncluded = append(cacheConfig.KeyCreatorParams.QueryParametersIncluded, &routepb.QueryParameterMatcher{
+				Name: queryParam,
+			})
+		}
+	}
+
+	cacheConfigAny, _ := ptypes.MarshalAny(cacheConfig)
+	return &hcmpb.HttpFilter{
+		Name: util.Cache,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{
+			TypedConfig: cacheConfigAny,
+		},
+	}
+}
+
+// makeCacheControlFilter makes Cache Control filter, which sets the default
+// Cache-Control header of the cached operations, and the Vary header of their
+// cache key.
+func makeCacheControlFilter() *hcmpb.HttpFilter {
+	ccAny, _ := ptypes.MarshalAny(&ccpb.FilterConfig{})
+	return &hcmpb.HttpFilter{
+		Name: util.CacheControl,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{
+			TypedConfig: ccAny,
+		},
+	}
+}
+
+func splitCommaSeparated(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	cachepb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cache/v3alpha"
+)
+
+func TestMakeResponseCacheFilter(t *testing.T) {
+	testData := []struct {
+		desc                        string
+		responseCacheSelectors      string
+		responseCacheKeyQueryParams string
+		methods                     map[string]*configinfo.MethodInfo
+		wantCacheConfig             string
+	}{
+		{
+			desc: "no cache filter without cached responses",
+		},
+		{
+			desc:                   "in-memory cache",
+			responseCacheSelectors: "endpoints.examples.bookstore.Bookstore.GetShelf",
+			methods: map[string]*configinfo.MethodInfo{
+				"endpoints.examples.bookstore.Bookstore.GetShelf": {
+					ResponseCacheTtl: time.Minute,
+				},
+			},
+			wantCacheConfig: `{
+				"typedConfig": {
+					"@type": "type.googleapis.com/envoy.source.extensions.filters.http.cache.SimpleHttpCacheConfig"
+				}
+			}`,
+		},
+		{
+			desc:                   "API keys in the default cache key",
+			responseCacheSelectors: "endpoints.examples.bookstore.Bookstore.GetShelf",
+			methods: map[string]*configinfo.MethodInfo{
+				"endpoints.examples.bookstore.Bookstore.GetShelf": {
+					ResponseCacheTtl:               time.Minute,
+					ResponseCacheKeyHeaders:        []string{"x-api-key"},
+					ResponseCacheApiKeyQueryParams: []string{"key", "api_key"},
+				},
+			},
+			wantCacheConfig: `{
+				"typedConfig": {
+					"@type": "type.googleapis.com/envoy.source.extensions.filters.http.cache.SimpleHttpCacheConfig"
+				},
+				"allowedVaryHeaders": [
+					{
+						"exact": "x-api-key",
+						"ignoreCase": true
+					}
+				]
+			}`,
+		},
+		{
+			desc:                        "in-memory cache with a cache key",
+			responseCacheSelectors:      "endpoints.examples.bookstore.Bookstore.GetShelf",
+			responseCacheKeyQueryParams: "page, view, key",
+			methods: map[string]*configinfo.MethodInfo{
+				"endpoints.examples.bookstore.Bookstore.GetShelf": {
+					ResponseCacheTtl:               time.Minute,
+					ResponseCacheKeyHeaders:        []string{"Accept-Language", "x-api-key"},
+					ResponseCacheApiKeyQueryParams: []string{"key", "api_key"},
+				},
+				"endpoints.examples.bookstore.Bookstore.CreateShelf": {
+					ResponseCacheKeyHeaders:        []string{"x-not-cached"},
+					ResponseCacheApiKeyQueryParams: []string{"not_cached"},
+				},
+			},
+			wantCacheConfig: `{
+				"typedConfig": {
+					"@type": "type.googleapis.com/envoy.source.extensions.filters.http.cache.SimpleHttpCacheConfig"
+				},
+				"allowedVaryHeaders": [
+					{
+						"exact": "accept-language",
+						"ignoreCase": true
+					},
+					{
+						"exact": "x-api-key",
+						"ignoreCase": true
+					}
+				],
+				"keyCreatorParams": {
+					"queryParametersIncluded": [
+						{
+							"name": "page"
+						},
+						{
+							"name": "view"
+						},
+						{
+							"name": "key"
+						},
+						{
+							"name": "api_key"
+						}
+					]
+				}
+			}`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ResponseCacheSelectors = tc.responseCacheSelectors
+			opts.ResponseCacheKeyQueryParams = tc.responseCacheKeyQueryParams
+
+			filter := makeResponseCacheFilter(&configinfo.ServiceInfo{
+				Options: opts,
+				Methods: tc.methods,
+			})
+			if tc.wantCacheConfig == "" {
+				if filter != nil {
+					t.Fatalf("got cache filter: %v, want none", filter)
+				}
+				return
+			}
+			if filter.GetName() != util.Cache {
+				t.Errorf("got filter name: %s, want: %s", filter.GetName(), util.Cache)
+			}
+			// The storage config has no published Go proto.
+			if _, err := util.ProtoToJson(filter); err != nil {
+				t.Errorf("fail to marshal the cache filter to JSON: %v", err)
+			}
+
+			gotCacheConfig := &cachepb.CacheConfig{}
+			if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), gotCacheConfig); err != nil {
+				t.Fatal(err)
+			}
+			wantCacheConfig := &cachepb.CacheConfig{}
+			if err := jsonpb.UnmarshalString(tc.wantCacheConfig, wantCacheConfig); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(gotCacheConfig, wantCacheConfig) {
+				t.Errorf("got cache config: %v, want: %v", gotCacheConfig, wantCacheConfig)
+			}
+		})
+	}
+}
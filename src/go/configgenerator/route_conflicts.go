@@ -0,0 +1,209 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
+)
+
+// The value of the wildcard segments in the sample paths of a uri template.
+const sampleSegment = "esp_sample"
+
+// checkDuplicateHttpPatterns returns an error if two operations have the same
+// http pattern, as only the first one would ever be routed to.
+func checkDuplicateHttpPatterns(methods *httppattern.MethodSlice) error {
+	seen := make(map[string]*httppattern.Method)
+	for _, method := range *methods {
+		if method.UriTemplate == nil {
+			continue
+		}
+		// Templates only differing by variable names match the same requests.
+		key := method.HttpMethod + " " + method.UriTemplate.Regex()
+		if other, ok := seen[key]; ok && other.Operation != method.Operation {
+			return fmt.Errorf("http pattern `%s %s` of selector %s duplicates `%s %s` of selector %s",
+				method.HttpMethod, method.UriTemplate.Origin, method.Operation,
+				other.HttpMethod, other.UriTemplate.Origin, other.Operation)
+		}
+		seen[key] = method
+	}
+	return nil
+}
+
+// findShadowedRoutes returns a message for each http pattern of the sorted
+// methods that can never match, because the routes of the earlier http
+// patterns of other operations match all its requests.
+func findShadowedRoutes(methods *httppattern.MethodSlice) []string {
+	routes := newRouteIndex()
+	var messages []string
+
+	for _, method := range *methods {
+		samples := samplePaths(method.UriTemplate)
+		var shadowedBy []string
+		for _, sample := range samples {
+			var matchedBy *indexedRoute
+			for _, earlier := range routes.candidates(sample) {
+				if earlier.method.Operation == method.Operation {
+					continue
+				}
+				if earlier.method.HttpMethod != httppattern.HttpMethodWildCard && earlier.method.HttpMethod != method.HttpMethod {
+					continue
+				}
+				if earlier.matches(sample) {
+					matchedBy = earlier
+					break
+				}
+			}
+			if matchedBy == nil {
+				shadowedBy = nil
+				break
+			}
+			shadowedBy = appendUnique(shadowedBy, matchedBy.method.Operation)
+		}
+		if len(shadowedBy) > 0 {
+			messages = append(messages, fmt.Sprintf("http pattern `%s %s` of selector %s is shadowed by the earlier routes of selector %s and never matches",
+				method.HttpMethod, method.UriTemplate.Origin, method.Operation, strings.Join(shadowedBy, ", ")))
+		}
+
+		routes.add(method)
+	}
+	return messages
+}
+
+type indexedRoute struct {
+	method *httppattern.Method
+	// The position of the route, to check the candidates in order.
+	position int
+
+	// The regex of the route, only compiled once it is a candidate.
+	regex    *regexp.Regexp
+	regexErr error
+}
+
+func (r *indexedRoute) matches(path string) bool {
+	if r.regex == nil && r.regexErr == nil {
+		// An invalid regex is reported when generating the route.
+		r.regex, r.regexErr = regexp.Compile(r.method.UriTemplate.Regex())
+	}
+	return r.regexErr == nil && r.regex.MatchString(path)
+}
+
+// routeIndex is a trie of the routes by the literal segments their uri
+// templates start with. Matching a path against all the earlier routes is
+// quadratic in the number of routes, while only the routes along the path of
+// its segments in the trie can match it.
+type routeIndex struct {
+	routes   []*indexedRoute
+	children map[string]*routeIndex
+	size     int
+}
+
+func newRouteIndex() *routeIndex {
+	return &routeIndex{children: make(map[string]*routeIndex)}
+}
+
+func (r *routeIndex) add(method *httppattern.Method) {
+	route := &indexedRoute{
+		method:   method,
+		position: r.size,
+	}
+	r.size++
+
+	node := r
+	for _, segment := range literalPrefix(method.UriTemplate) {
+		child, ok := node.children[segment]
+		if !ok {
+			child = newRouteIndex()
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.routes = append(node.routes, route)
+}
+
+// candidates returns the routes that may match the path, in order.
+func (r *routeIndex) candidates(path string) []*indexedRoute {
+	candidates := append([]*indexedRoute(nil), r.routes...)
+	node := r
+	for _, segment := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		child, ok := node.children[segment]
+		if !ok {
+			break
+		}
+		node = child
+		candidates = append(candidates, node.routes...)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].position < candidates[j].position
+	})
+	return candidates
+}
+
+// literalPrefix returns the segments of the uri template before its first
+// wildcard, which all the paths it matches start with. The last segment is
+// left out, since a verb follows it in the paths, and so are the segments
+// with regex metacharacters, which the route regex doesn't match literally.
+func literalPrefix(uriTemplate *httppattern.UriTemplate) []string {
+	var prefix []string
+	for i, segment := range uriTemplate.Segments {
+		if i == len(uriTemplate.Segments)-1 || segment == httppattern.SingleWildCardKey || segment == httppattern.DoubleWildCardKey ||
+			regexp.QuoteMeta(segment) != segment {
+			break
+		}
+		prefix = append(prefix, segment)
+	}
+	return prefix
+}
+
+// samplePaths returns paths matched by the uri template, with a wildcard
+// segment matching one segment, and a double wildcard one or more segments.
+func samplePaths(uriTemplate *httppattern.UriTemplate) []string {
+	var paths []string
+	for _, doubleWildcard := range []string{sampleSegment, sampleSegment + "/" + sampleSegment} {
+		var b strings.Builder
+		for _, segment := range uriTemplate.Segments {
+			b.WriteByte('/')
+			switch segment {
+			case httppattern.SingleWildCardKey:
+				b.WriteString(sampleSegment)
+			case httppattern.DoubleWildCardKey:
+				b.WriteString(doubleWildcard)
+			default:
+				b.WriteString(segment)
+			}
+		}
+		if len(uriTemplate.Segments) == 0 {
+			b.WriteByte('/')
+		}
+		if uriTemplate.Verb != "" {
+			b.WriteString(":" + uriTemplate.Verb)
+		}
+		paths = appendUnique(paths, b.String())
+	}
+	return paths
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
+)
+
+type testHttpPattern struct {
+	httpMethod  string
+	uriTemplate string
+	operation   string
+}
+
+func makeTestMethodSlice(t *testing.T, patterns []testHttpPattern) *httppattern.MethodSlice {
+	methods := &httppattern.MethodSlice{}
+	for _, p := range patterns {
+		uriTemplate, err := httppattern.ParseUriTemplate(p.uriTemplate)
+		if err != nil {
+			t.Fatalf("fail to parse uri template %s: %v", p.uriTemplate, err)
+		}
+		methods.AppendMethod(&httppattern.Method{
+			Pattern: &httppattern.Pattern{
+				HttpMethod:  p.httpMethod,
+				UriTemplate: uriTemplate,
+			},
+			Operation: p.operation,
+		})
+	}
+	return methods
+}
+
+func TestCheckDuplicateHttpPatterns(t *testing.T) {
+	testData := []struct {
+		desc      string
+		patterns  []testHttpPattern
+		wantError string
+	}{
+		{
+			desc: "different http patterns",
+			patterns: []testHttpPattern{
+				{"GET", "/v1/shelves/{shelf}", "Get"},
+				{"DELETE", "/v1/shelves/{shelf}", "Delete"},
+				{"GET", "/v1/shelves", "List"},
+			},
+		},
+		{
+			desc: "same http pattern of the same selector is left for the sort",
+			patterns: []testHttpPattern{
+				{"GET", "/v1/shelves", "List"},
+				{"GET", "/v1/shelves", "List"},
+			},
+		},
+		{
+			desc: "same http pattern of different selectors",
+			patterns: []testHttpPattern{
+				{"GET", "/v1/shelves", "List"},
+				{"GET", "/v1/shelves", "ListAgain"},
+			},
+			wantError: "http pattern `GET /v1/shelves` of selector ListAgain duplicates `GET /v1/shelves` of selector List",
+		},
+		{
+			desc: "templates only differing by variable names are duplicates",
+			patterns: []testHttpPattern{
+				{"GET", "/v1/shelves/{shelf}", "Get"},
+				{"GET", "/v1/shelves/{id=*}", "GetById"},
+			},
+			wantError: "http pattern `GET /v1/shelves/{id=*}` of selector GetById duplicates `GET /v1/shelves/{shelf}` of selector Get",
+		},
+	}
+
+	for _, tc := range testData {
+		err := checkDuplicateHttpPatterns(makeTestMethodSlice(t, tc.patterns))
+		if err == nil {
+			if tc.wantError != "" {
+				t.Errorf("Test (%s): want error %s, got no error", tc.desc, tc.wantError)
+			}
+			continue
+		}
+		if err.Error() != tc.wantError {
+			t.Errorf("Test (%s): want error %s, got error %v", tc.desc, tc.wantError, err)
+		}
+	}
+}
+
+func TestFindShadowedRoutes(t *testing.T) {
+	testData := []struct {
+		desc         string
+		patterns     []testHttpPattern
+		wantMessages []string
+	}{
+		{
+			desc: "exact matches are routed before wildcards",
+			patterns: []testHttpPattern{
+				{"GET", "/v1/{name=**}", "Wildcard"},
+				{"*", "/v1/shelves/*", "AnyMethod"},
+				{"GET", "/v1/shelves/special", "Special"},
+			},
+		},
+		{
+			desc: "custom verb is shadowed by the earlier single wildcard of any http method",
+			patterns: []testHttpPattern{
+				{"GET", "/v1/shelves/{shelf}:cancel", "Cancel"},
+				{"*", "/v1/shelves/*", "AnyMethod"},
+			},
+			wantMessages: []string{
+				"http pattern `GET /v1/shelves/{shelf}:cancel` of selector Cancel is shadowed by the earlier routes of selector AnyMethod and never matches",
+			},
+		},
+		{
+			desc: "double wildcard suffix is shadowed by the earlier single wildcard prefix",
+			patterns: []testHttpPattern{
+				{"GET", "/*/**", "Prefix"},
+				{"GET", "/**/books", "Suffix"},
+			},
+			wantMessages: []string{
+				"http pattern `GET /**/books` of selector Suffix is shadowed by the earlier routes of selector Prefix and never matches",
+			},
+		},
+		{
+			desc: "earlier route of another http method does not shadow",
+			patterns: []testHttpPattern{
+				{"POST", "/*/**", "Prefix"},
+				{"GET", "/**/books", "Suffix"},
+			},
+		},
+		{
+			desc: "earlier route of the same selector does not shadow",
+			patterns: []testHttpPattern{
+				{"GET", "/*/**", "Books"},
+				{"GET", "/**/books", "Books"},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		methods := makeTestMethodSlice(t, tc.patterns)
+		if err := httppattern.Sort(methods); err != nil {
+			t.Fatalf("Test (%s): fail to sort: %v", tc.desc, err)
+		}
+		got := findShadowedRoutes(methods)
+		if !reflect.DeepEqual(got, tc.wantMessages) {
+			t.Errorf("Test (%s): want messages %q, got %q", tc.desc, tc.wantMessages, got)
+		}
+	}
+}
+
+func BenchmarkFindShadowedRoutes(b *testing.B) {
+	methods := &httppattern.MethodSlice{}
+	for i := 0; i < 5000; i++ {
+		uriTemplate, err := httppattern.ParseUriTemplate(fmt.Sprintf("/v1/resources%d/{resource}/items/{item=**}", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		methods.AppendMethod(&httppattern.Method{
+			Pattern: &httppattern.Pattern{
+				HttpMethod:  "GET",
+				UriTemplate: uriTemplate,
+			},
+			Operation: fmt.Sprintf("Operation%d", i),
+		})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		findShadowedRoutes(methods)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+)
+
+// RouteExplanation describes the generated route matching a request.
+type RouteExplanation struct {
+	// The index of the route in the virtual host, in matching order.
+	RouteIndex int `json:"routeIndex"`
+	// The route match, as JSON.
+	Match string `json:"match"`
+	// The operation selector the route belongs to, empty for the CORS route.
+	Operation string `json:"operation,omitempty"`
+	Cluster   string `json:"cluster,omitempty"`
+	// The http filters with a per-route config on the route.
+	PerRouteFilters []string `json:"perRouteFilters,omitempty"`
+}
+
+// ExplainRoute reports the route generated by MakeRouteConfig that Envoy would
+// match for a request with the http method, path and headers. It returns nil
+// if no route matches, in which case Envoy responds 404.
+func ExplainRoute(serviceInfo *configinfo.ServiceInfo, httpMethod, path string, headers map[string]string) (*RouteExplanation, error) {
+	routeConfig, err := MakeRouteConfig(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Envoy matches the path without the query string, and the query
+	// parameters on their own.
+	if i := strings.Index(path, "#"); i >= 0 {
+		path = path[:i]
+	}
+	queryParams := make(map[string]string)
+	if i := strings.Index(path, "?"); i >= 0 {
+		queryParams = parseQueryParams(path[i+1:])
+		path = path[:i]
+	}
+	requestHeaders := map[string]string{
+		":method": strings.ToUpper(httpMethod),
+		":path":   path,
+	}
+	for name, value := range headers {
+		requestHeaders[strings.ToLower(name)] = value
+	}
+
+	for _, host := range routeConfig.GetVirtualHosts() {
+		for i, route := range host.GetRoutes() {
+			matched, err := routeMatches(route.GetMatch(), path, requestHeaders, queryParams)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+			return explainRoute(i, route)
+		}
+	}
+	return nil, nil
+}
+
+func explainRoute(index int, route *routepb.Route) (*RouteExplanation, error) {
+	match, err := util.ProtoToJson(route.GetMatch())
+	if err != nil {
+		return nil, err
+	}
+	explanation := &RouteExplanation{
+		RouteIndex: index,
+		Match:      match,
+		Cluster:    route.GetRoute().GetCluster(),
+	}
+
+	for name := range route.GetTypedPerFilterConfig() {
+		explanation.PerRouteFilters = append(explanation.PerRouteFilters, name)
+	}
+	sort.Strings(explanation.PerRouteFilters)
+
+	if scAny, ok := route.GetTypedPerFilterConfig()[util.ServiceControl]; ok {
+		scPerRoute := &scpb.PerRouteFilterConfig{}
+		if err := ptypes.UnmarshalAny(scAny, scPerRoute); err != nil {
+			return nil, err
+		}
+		explanation.Operation = scPerRoute.GetOperationName()
+	}
+	return explanation, nil
+}
+
+// parseQueryParams parses the query string like Envoy: the values are not
+// decoded, and the first one of a repeated parameter is kept.
+func parseQueryParams(query string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Split(query, "&") {
+		if param == "" {
+			continue
+		}
+		kv := strings.SplitN(param, "=", 2)
+		if _, ok := params[kv[0]]; ok {
+			continue
+		}
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		} else {
+			params[kv[0]] = ""
+		}
+	}
+	return params
+}
+
+// routeMatches evaluates the route match like Envoy for the path specifiers,
+// header matchers and query parameter matchers used by the generated routes.
+func routeMatches(match *routepb.RouteMatch, path string, headers map[string]string, queryParams map[string]string) (bool, error) {
+	switch specifier := match.GetPathSpecifier().(type) {
+	case *routepb.RouteMatch_Path:
+		if specifier.Path != path {
+			return false, nil
+		}
+	case *routepb.RouteMatch_Prefix:
+		if !strings.HasPrefix(path, specifier.Prefix) {
+			return false, nil
+		}
+	case *routepb.RouteMatch_SafeRegex:
+		matched, err := fullMatch(specifier.SafeRegex.GetRegex(), path)
+		if err != nil || !matched {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("unsupported route path specifier %T", specifier)
+	}
+
+	for _, headerMatcher := range match.GetHeaders() {
+		matched, err := headerMatches(headerMatcher, headers)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	for _, queryParamMatcher := range match.GetQueryParameters() {
+		matched, err := queryParamMatches(queryParamMatcher, queryParams)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func queryParamMatches(queryParamMatcher *routepb.QueryParameterMatcher, queryParams map[string]string) (bool, error) {
+	value, present := queryParams[queryParamMatcher.GetName()]
+	switch specifier := queryParamMatcher.GetQueryParameterMatchSpecifier().(type) {
+	case *routepb.QueryParameterMatcher_PresentMatch:
+		return present == specifier.PresentMatch, nil
+	case *routepb.QueryParameterMatcher_StringMatch:
+		exact, ok := specifier.StringMatch.GetMatchPattern().(*matcher.StringMatcher_Exact)
+		if !ok {
+			return false, fmt.Errorf("unsupported query parameter string matcher %T", specifier.StringMatch.GetMatchPattern())
+		}
+		return present && value == exact.Exact, nil
+	default:
+		return false, fmt.Errorf("unsupported query parameter matcher %T", specifier)
+	}
+}
+
+func headerMatches(headerMatcher *routepb.HeaderMatcher, headers map[string]string) (bool, error) {
+	value, present := headers[strings.ToLower(headerMatcher.GetName())]
+
+	var matched bool
+	switch specifier := headerMatcher.GetHeaderMatchSpecifier().(type) {
+	case *routepb.HeaderMatcher_ExactMatch:
+		matched = present && value == specifier.ExactMatch
+	case *routepb.HeaderMatcher_PresentMatch:
+		matched = present == specifier.PresentMatch
+	case *routepb.HeaderMatcher_PrefixMatch:
+		matched = present && strings.HasPrefix(value, specifier.PrefixMatch)
+	case *routepb.HeaderMatcher_SuffixMatch:
+		matched = present && strings.HasSuffix(value, specifier.SuffixMatch)
+	case *routepb.HeaderMatcher_SafeRegexMatch:
+		if present {
+			var err error
+			if matched, err = fullMatch(specifier.SafeRegexMatch.GetRegex(), value); err != nil {
+				return false, err
+			}
+		}
+	default:
+		return false, fmt.Errorf("unsupported header matcher %T", specifier)
+	}
+
+	if headerMatcher.GetInvertMatch() {
+		return !matched, nil
+	}
+	return matched, nil
+}
+
+// fullMatch matches the whole value against the RE2 regex, as Envoy does.
+func fullMatch(regex, value string) (bool, error) {
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return false, fmt.Errorf("fail to compile regex %q: %v", regex, err)
+	}
+	return re.MatchString(value), nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestExplainRoute(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "GetShelf",
+					},
+					{
+						Name: "GetSpecialShelf",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.GetShelf",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/v1/shelves/{shelf}",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.GetSpecialShelf",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/v1/shelves/special",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/v1/shelves",
+				},
+			},
+		}},
+	}
+
+	testData := []struct {
+		desc          string
+		httpMethod    string
+		path          string
+		headers       map[string]string
+		wantOperation string
+		wantFilters   []string
+		wantNoMatch   bool
+	}{
+		{
+			desc:          "exact path wins over the variable binding",
+			httpMethod:    "GET",
+			path:          "/v1/shelves/special",
+			wantOperation: "endpoints.examples.bookstore.Bookstore.GetSpecialShelf",
+			wantFilters:   []string{"com.google.espv2.filters.http.service_control"},
+		},
+		{
+			desc:          "variable binding matches, ignoring the query",
+			httpMethod:    "get",
+			path:          "/v1/shelves/123?view=full",
+			wantOperation: "endpoints.examples.bookstore.Bookstore.GetShelf",
+			wantFilters:   []string{"com.google.espv2.filters.http.service_control"},
+		},
+		{
+			desc:          "trailing slash matches",
+			httpMethod:    "POST",
+			path:          "/v1/shelves/",
+			wantOperation: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+			wantFilters:   []string{"com.google.espv2.filters.http.service_control"},
+		},
+		{
+			desc:        "no route for the http method",
+			httpMethod:  "DELETE",
+			path:        "/v1/shelves/123",
+			wantNoMatch: true,
+		},
+		{
+			desc:        "no route for the path",
+			httpMethod:  "GET",
+			path:        "/v1/books",
+			wantNoMatch: true,
+		},
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "grpc://127.0.0.1:80"
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := ExplainRoute(fakeServiceInfo, tc.httpMethod, tc.path, tc.headers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantNoMatch {
+				if got != nil {
+					t.Errorf("got route: %+v, want no route", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("got no route, want operation %s", tc.wantOperation)
+			}
+			if got.Operation != tc.wantOperation {
+				t.Errorf("got operation: %s, want: %s", got.Operation, tc.wantOperation)
+			}
+			if got.Cluster != "backend-cluster-bookstore.endpoints.project123.cloud.goog_local" {
+				t.Errorf("got cluster: %s", got.Cluster)
+			}
+			if !reflect.DeepEqual(got.PerRouteFilters, tc.wantFilters) {
+				t.Errorf("got per-route filters: %v, want: %v", got.PerRouteFilters, tc.wantFilters)
+			}
+		})
+	}
+}
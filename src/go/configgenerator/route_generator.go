@@ -16,22 +16,41 @@ package configgenerator
 
 import (
 	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/tracing"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 
 	aupb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/backend_auth"
+	bvpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/body_validation"
+	ccpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/cache_control"
+	clpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/concurrency_limit"
+	etagpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/etag"
+	gsmpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/grpc_status_mapping"
+	idpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/idempotency"
 	prpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/path_rewrite"
+	qrpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/query_rewrite"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	sfpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/stream_format"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	rbacconfigpb "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
 	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	rbacpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	anypb "github.com/golang/protobuf/ptypes/any"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 )
@@ -39,13 +58,72 @@ import (
 const (
 	routeName       = "local_route"
 	virtualHostName = "backend"
+	requestIdHeader = "x-request-id"
 )
 
+// MakeRoutes provides the route configs served through RDS, which are only
+// used with --enable_rds.
+func MakeRoutes(serviceInfo *configinfo.ServiceInfo) ([]*routepb.RouteConfiguration, error) {
+	if !serviceInfo.Options.EnableRds {
+		return nil, nil
+	}
+	route, err := MakeRouteConfig(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	return []*routepb.RouteConfiguration{route}, nil
+}
+
+// MakeRouteConfig makes the route config of the service and its additional
+// services, inlined in the listener or served through RDS.
 func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfiguration, error) {
-	var virtualHosts []*routepb.VirtualHost
-	host := routepb.VirtualHost{
-		Name:    virtualHostName,
-		Domains: []string{"*"},
+	if err := checkAdditionalServices(serviceInfo); err != nil {
+		return nil, err
+	}
+
+	host, err := makeVirtualHost(serviceInfo, virtualHostName, []string{"*"})
+	if err != nil {
+		return nil, err
+	}
+
+	// The spike arrest only limits the catch-all virtual host.
+	spikeArrestConfig, err := makeSpikeArrestConfig(serviceInfo.Options)
+	if err != nil {
+		return nil, err
+	}
+	if spikeArrestConfig != nil {
+		host.TypedPerFilterConfig = map[string]*anypb.Any{
+			util.EnvoyLocalRateLimit: spikeArrestConfig,
+		}
+	}
+	virtualHosts := []*routepb.VirtualHost{host}
+
+	// The additional services are served on the virtual hosts of their
+	// domains, the service is the default one.
+	for _, additionalService := range serviceInfo.AdditionalServices {
+		additionalHost, err := makeVirtualHost(additionalService, additionalService.Name, serviceDomains(additionalService))
+		if err != nil {
+			return nil, fmt.Errorf("fail to make the virtual host of service %s: %v", additionalService.Name, err)
+		}
+		virtualHosts = append(virtualHosts, additionalHost)
+	}
+
+	routeConfig := &routepb.RouteConfiguration{
+		Name:         routeName,
+		VirtualHosts: virtualHosts,
+	}
+
+	if err := addRequestIdHeader(routeConfig, serviceInfo); err != nil {
+		return nil, err
+	}
+	return routeConfig, nil
+}
+
+func makeVirtualHost(serviceInfo *configinfo.ServiceInfo, name string, domains []string) (*routepb.VirtualHost, error) {
+	host := &routepb.VirtualHost{
+		Name:       name,
+		Domains:    domains,
+		RateLimits: makeRateLimits(serviceInfo.Options),
 	}
 
 	// Per-selector routes for both local and remote backends.
@@ -54,6 +132,11 @@ func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfigu
 		return nil, err
 	}
 	host.Routes = brRoutes
+	if serviceInfo.Options.EnableOperationVirtualClusters {
+		if host.VirtualClusters, err = makeVirtualClusters(serviceInfo); err != nil {
+			return nil, err
+		}
+	}
 
 	switch serviceInfo.Options.CorsPreset {
 	case "basic":
@@ -61,14 +144,12 @@ func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfigu
 		if org == "" {
 			return nil, fmt.Errorf("cors_allow_origin cannot be empty when cors_preset=basic")
 		}
+		originMatchers, err := makeCorsOriginMatchers(org)
+		if err != nil {
+			return nil, err
+		}
 		host.Cors = &routepb.CorsPolicy{
-			AllowOriginStringMatch: []*matcher.StringMatcher{
-				{
-					MatchPattern: &matcher.StringMatcher_Exact{
-						Exact: org,
-					},
-				},
-			},
+			AllowOriginStringMatch: originMatchers,
 		}
 	case "cors_with_regex":
 		orgReg := serviceInfo.Options.CorsAllowOriginRegex
@@ -94,7 +175,14 @@ func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfigu
 		}
 	case "":
 		if serviceInfo.Options.CorsAllowMethods != "" || serviceInfo.Options.CorsAllowHeaders != "" ||
-			serviceInfo.Options.CorsExposeHeaders != "" || serviceInfo.Options.CorsAllowCredentials {
+			serviceInfo.Options.CorsExposeHeaders != "" || serviceInfo.Options.CorsAllowCredentials ||
+			serviceInfo.Options.CorsAllowPrivateNetwork || serviceInfo.Options.CorsReflectRequestHeaders ||
+			serviceInfo.Options.CorsPreflightDirectResponse {
+			// The allow_cors of the endpoints only routes the preflight requests to
+			// the backend, which answers them on its own.
+			if serviceInfo.AllowCors {
+				return nil, fmt.Errorf("cors_preset must be set in order to enable CORS support, allow_cors of the service config endpoints only forwards the preflight requests to the backend")
+			}
 			return nil, fmt.Errorf("cors_preset must be set in order to enable CORS support")
 		}
 	default:
@@ -102,10 +190,32 @@ func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfigu
 	}
 
 	if host.GetCors() != nil {
-		host.GetCors().AllowMethods = serviceInfo.Options.CorsAllowMethods
+		host.GetCors().AllowMethods = makeCorsAllowMethods(serviceInfo)
 		host.GetCors().AllowHeaders = serviceInfo.Options.CorsAllowHeaders
 		host.GetCors().ExposeHeaders = serviceInfo.Options.CorsExposeHeaders
 		host.GetCors().AllowCredentials = &wrapperspb.BoolValue{Value: serviceInfo.Options.CorsAllowCredentials}
+		if maxAge := serviceInfo.Options.CorsMaxAge; maxAge > 0 {
+			host.GetCors().MaxAge = strconv.Itoa(int(math.Ceil(maxAge.Seconds())))
+		}
+
+		// The Envoy CORS filter can't reflect the request headers nor allow the
+		// private network access, and needs the OPTIONS requests routed to the
+		// local backend. So the preflight requests are answered by a route ahead
+		// of the others instead.
+		if serviceInfo.Options.CorsAllowPrivateNetwork || serviceInfo.Options.CorsReflectRequestHeaders ||
+			serviceInfo.Options.CorsPreflightDirectResponse {
+			if serviceInfo.Options.CorsReflectRequestHeaders && serviceInfo.Options.CorsAllowHeaders != "" {
+				return nil, fmt.Errorf("cors_allow_headers cannot be set when cors_reflect_request_headers is enabled")
+			}
+			var preflightRoutes []*routepb.Route
+			for _, origin := range host.GetCors().GetAllowOriginStringMatch() {
+				preflightRoute := makeCorsPreflightRoute(host.GetCors(), origin, serviceInfo.Options.CorsAllowPrivateNetwork, serviceInfo.Options.CorsReflectRequestHeaders)
+				preflightRoute.Decorator = makeDecorator(serviceInfo.Options, serviceInfo.Options.TracingSpanNamePrefix)
+				preflightRoutes = append(preflightRoutes, preflightRoute)
+				logConfig("cors preflight route", preflightRoute)
+			}
+			host.Routes = append(preflightRoutes, host.Routes...)
+		}
 
 		// In order apply Envoy cors policy, need to have a route rule
 		// to route OPTIONS request to this host
@@ -130,21 +240,227 @@ func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfigu
 					},
 				},
 			},
-			Decorator: &routepb.Decorator{
-				Operation: util.SpanNamePrefix,
-			},
+			Decorator: makeDecorator(serviceInfo.Options, serviceInfo.Options.TracingSpanNamePrefix),
+		}
+		// The preflight route answers the allowed origins, the other OPTIONS
+		// requests get an empty response without the CORS headers.
+		if serviceInfo.Options.CorsPreflightDirectResponse {
+			corsRoute.Action = &routepb.Route_DirectResponse{
+				DirectResponse: &routepb.DirectResponseAction{
+					Status: http.StatusNoContent,
+				},
+			}
 		}
 		host.Routes = append(host.Routes, corsRoute)
+		logConfig("cors route", corsRoute)
+	}
+
+	return host, nil
+}
 
-		jsonStr, _ := util.ProtoToJson(corsRoute)
-		glog.Infof("adding cors route configuration: %v", jsonStr)
+// makeCorsAllowMethods returns --cors_allow_methods with the custom http
+// methods of the http rules, e.g. "REPORT", which the browsers only send after
+// a preflight allowing them.
+func makeCorsAllowMethods(serviceInfo *configinfo.ServiceInfo) string {
+	allowMethods := serviceInfo.Options.CorsAllowMethods
+	if allowMethods == "" || strings.TrimSpace(allowMethods) == "*" {
+		return allowMethods
 	}
 
-	virtualHosts = append(virtualHosts, &host)
-	return &routepb.RouteConfiguration{
-		Name:         routeName,
-		VirtualHosts: virtualHosts,
-	}, nil
+	allowed := map[string]bool{
+		util.GET:                       true,
+		util.PUT:                       true,
+		util.POST:                      true,
+		util.DELETE:                    true,
+		util.PATCH:                     true,
+		util.OPTIONS:                   true,
+		"HEAD":                         true,
+		httppattern.HttpMethodWildCard: true,
+	}
+	for _, method := range strings.Split(allowMethods, ",") {
+		allowed[strings.TrimSpace(method)] = true
+	}
+	for _, operation := range serviceInfo.Operations {
+		for _, httpRule := range serviceInfo.Methods[operation].HttpRule {
+			if !allowed[httpRule.HttpMethod] {
+				allowed[httpRule.HttpMethod] = true
+				allowMethods = fmt.Sprintf("%s, %s", allowMethods, httpRule.HttpMethod)
+			}
+		}
+	}
+	return allowMethods
+}
+
+// makeCorsOriginMatchers matches the comma-separated origins of
+// --cors_allow_origin. An origin is either exact, "*" for all of them, or has
+// a wildcard for its subdomains, e.g. https://*.example.com.
+func makeCorsOriginMatchers(origins string) ([]*matcher.StringMatcher, error) {
+	var originMatchers []*matcher.StringMatcher
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			return nil, fmt.Errorf("invalid cors_allow_origin %q: empty origin", origins)
+		}
+		if origin == "*" || !strings.Contains(origin, "*") {
+			originMatchers = append(originMatchers, &matcher.StringMatcher{
+				MatchPattern: &matcher.StringMatcher_Exact{
+					Exact: origin,
+				},
+			})
+			continue
+		}
+
+		schemeEnd := strings.Index(origin, "://")
+		if schemeEnd <= 0 || !strings.HasPrefix(origin[schemeEnd+len("://"):], "*.") || strings.Count(origin, "*") != 1 {
+			return nil, fmt.Errorf("invalid cors_allow_origin %q: the wildcard must be the first label of the host, e.g. https://*.example.com", origin)
+		}
+		scheme, domain := origin[:schemeEnd+len("://")], origin[schemeEnd+len("://*"):]
+		originRegex := fmt.Sprintf("^%s[^/]+%s$", regexp.QuoteMeta(scheme), regexp.QuoteMeta(domain))
+		if err := util.ValidateRegexProgramSize(originRegex, util.GoogleRE2MaxProgramSize); err != nil {
+			return nil, fmt.Errorf("invalid cors_allow_origin %q: %v", origin, err)
+		}
+		originMatchers = append(originMatchers, &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_SafeRegex{
+				SafeRegex: &matcher.RegexMatcher{
+					EngineType: &matcher.RegexMatcher_GoogleRe2{
+						GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+					},
+					Regex: originRegex,
+				},
+			},
+		})
+	}
+	return originMatchers, nil
+}
+
+// makeCorsPreflightRoute answers the CORS preflight requests of an allowed
+// origin with the headers of the CORS policy. The Envoy CORS filter skips the
+// direct response routes, so it leaves them to this one.
+func makeCorsPreflightRoute(cors *routepb.CorsPolicy, origin *matcher.StringMatcher, allowPrivateNetwork, reflectRequestHeaders bool) *routepb.Route {
+	headers := map[string]string{
+		util.AccessControlAllowOrigin:  "%REQ(origin)%",
+		util.AccessControlAllowMethods: cors.GetAllowMethods(),
+		util.AccessControlAllowHeaders: cors.GetAllowHeaders(),
+		util.AccessControlMaxAge:       cors.GetMaxAge(),
+	}
+	if reflectRequestHeaders {
+		headers[util.AccessControlAllowHeaders] = "%REQ(access-control-request-headers)%"
+	}
+	if cors.GetAllowCredentials().GetValue() {
+		headers[util.AccessControlAllowCredentials] = "true"
+	}
+	if allowPrivateNetwork {
+		headers[util.AccessControlAllowPrivateNetwork] = "true"
+	}
+
+	var responseHeaders []*corepb.HeaderValueOption
+	for _, key := range []string{
+		util.AccessControlAllowOrigin,
+		util.AccessControlAllowMethods,
+		util.AccessControlAllowHeaders,
+		util.AccessControlMaxAge,
+		util.AccessControlAllowCredentials,
+		util.AccessControlAllowPrivateNetwork,
+	} {
+		if headers[key] == "" {
+			continue
+		}
+		responseHeaders = append(responseHeaders, &corepb.HeaderValueOption{
+			Header: &corepb.HeaderValue{
+				Key:   key,
+				Value: headers[key],
+			},
+			Append: &wrapperspb.BoolValue{Value: false},
+		})
+	}
+
+	return &routepb.Route{
+		Match: &routepb.RouteMatch{
+			PathSpecifier: &routepb.RouteMatch_Prefix{
+				Prefix: "/",
+			},
+			Headers: []*routepb.HeaderMatcher{
+				{
+					Name: ":method",
+					HeaderMatchSpecifier: &routepb.HeaderMatcher_ExactMatch{
+						ExactMatch: "OPTIONS",
+					},
+				},
+				makeOriginHeaderMatcher(origin),
+				{
+					Name: util.AccessControlRequestMethod,
+					HeaderMatchSpecifier: &routepb.HeaderMatcher_PresentMatch{
+						PresentMatch: true,
+					},
+				},
+			},
+		},
+		Action: &routepb.Route_DirectResponse{
+			DirectResponse: &routepb.DirectResponseAction{
+				Status: http.StatusNoContent,
+			},
+		},
+		ResponseHeadersToAdd: responseHeaders,
+	}
+}
+
+// makeOriginHeaderMatcher matches the origin header of the requests with the
+// allowed origin of the CORS policy. A "*" origin matches all of them.
+func makeOriginHeaderMatcher(origin *matcher.StringMatcher) *routepb.HeaderMatcher {
+	if origin.GetExact() == "*" {
+		return &routepb.HeaderMatcher{
+			Name: "origin",
+			HeaderMatchSpecifier: &routepb.HeaderMatcher_PresentMatch{
+				PresentMatch: true,
+			},
+		}
+	}
+	if origin.GetSafeRegex() != nil {
+		return &routepb.HeaderMatcher{
+			Name: "origin",
+			HeaderMatchSpecifier: &routepb.HeaderMatcher_SafeRegexMatch{
+				SafeRegexMatch: origin.GetSafeRegex(),
+			},
+		}
+	}
+	return &routepb.HeaderMatcher{
+		Name: "origin",
+		HeaderMatchSpecifier: &routepb.HeaderMatcher_ExactMatch{
+			ExactMatch: origin.GetExact(),
+		},
+	}
+}
+
+// addRequestIdHeader copies the request ID generated or preserved by Envoy in
+// x-request-id to the custom request ID header, for the backends and, if
+// enabled, the clients. With --preserve_external_request_id, a custom request
+// ID header sent by the client is kept instead.
+func addRequestIdHeader(routeConfig *routepb.RouteConfiguration, serviceInfo *configinfo.ServiceInfo) error {
+	opts := serviceInfo.Options
+	header := strings.ToLower(opts.RequestIdHeader)
+	if header == "" || header == requestIdHeader {
+		return nil
+	}
+	if strings.HasPrefix(header, ":") || strings.ContainsAny(header, " \t%") {
+		return fmt.Errorf("invalid request id header %q", opts.RequestIdHeader)
+	}
+
+	value := fmt.Sprintf("%%REQ(%s)%%", requestIdHeader)
+	if opts.PreserveExternalRequestId {
+		value = fmt.Sprintf("%%REQ(%s?%s)%%", header, requestIdHeader)
+	}
+	headerValue := &corepb.HeaderValueOption{
+		Header: &corepb.HeaderValue{
+			Key:   header,
+			Value: value,
+		},
+		Append: &wrapperspb.BoolValue{Value: false},
+	}
+	routeConfig.RequestHeadersToAdd = append(routeConfig.RequestHeadersToAdd, headerValue)
+	if opts.AlwaysSetRequestIdInResponse {
+		routeConfig.ResponseHeadersToAdd = append(routeConfig.ResponseHeadersToAdd, headerValue)
+	}
+	return nil
 }
 
 func MakePathRewriteConfig(method *configinfo.MethodInfo, httpRule *httppattern.Pattern) *prpb.PerRouteFilterConfig {
@@ -163,7 +479,9 @@ func MakePathRewriteConfig(method *configinfo.MethodInfo, httpRule *httppattern.
 	}
 	if method.BackendInfo.TranslationType == confpb.BackendRule_CONSTANT_ADDRESS {
 		constPath := &prpb.ConstantPath{
-			Path: method.BackendInfo.Path,
+			Path:               method.BackendInfo.Path,
+			QueryParams:        prpb.ConstantPath_QueryParams(prpb.ConstantPath_QueryParams_value[strings.ToUpper(method.BackendInfo.QueryParams)]),
+			OriginalPathHeader: method.BackendInfo.OriginalPathHeader,
 		}
 
 		if uriTemplate := httpRule.UriTemplate; uriTemplate != nil && len(uriTemplate.Variables) > 0 {
@@ -178,7 +496,92 @@ func MakePathRewriteConfig(method *configinfo.MethodInfo, httpRule *httppattern.
 	return nil
 }
 
-func makePerRouteFilterConfig(operation string, method *configinfo.MethodInfo, httpRule *httppattern.Pattern) (map[string]*anypb.Any, error) {
+// makePerRouteFilterConfig makes the per-route filter configs of an http
+// pattern of the operation, adding the ones of the http pattern to the
+// operationConfig shared by all the routes of the operation.
+func makePerRouteFilterConfig(method *configinfo.MethodInfo, httpRule *httppattern.Pattern, operationConfig map[string]*anypb.Any) (map[string]*anypb.Any, error) {
+	perFilterConfig := make(map[string]*anypb.Any, len(operationConfig)+1)
+	for name, config := range operationConfig {
+		perFilterConfig[name] = config
+	}
+
+	// add PathRewrite PerRouteConfig if needed. Without it, the filter
+	// passes the request through.
+	if pr := MakePathRewriteConfig(method, httpRule); pr != nil && !method.DisabledFilters[util.PathRewrite] {
+		prAny, err := ptypes.MarshalAny(pr)
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling path_rewrite per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.PathRewrite] = prAny
+	}
+
+	// add Etag PerRouteConfig to the GET routes of the operations with ETags.
+	// Without it, the filter passes the response through.
+	if method.EnableEtag && httpRule.HttpMethod == util.GET {
+		etagAny, err := ptypes.MarshalAny(&etagpb.PerRouteFilterConfig{})
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling etag per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.Etag] = etagAny
+	}
+
+	// add CacheControl PerRouteConfig to the GET routes of the cached
+	// operations. Without it, the filter passes the response through.
+	if method.ResponseCacheTtl > 0 && httpRule.HttpMethod == util.GET {
+		ccAny, err := ptypes.MarshalAny(&ccpb.PerRouteFilterConfig{
+			MaxAge:      uint32(math.Ceil(method.ResponseCacheTtl.Seconds())),
+			VaryHeaders: method.ResponseCacheKeyHeaders,
+		})
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling cache_control per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.CacheControl] = ccAny
+	}
+
+	// add Idempotency PerRouteConfig to the mutating routes of the operations
+	// deduplicating their requests. Without it, the filter passes the request
+	// through.
+	if method.EnableIdempotency && httpRule.HttpMethod != util.GET {
+		idAny, err := ptypes.MarshalAny(&idpb.PerRouteFilterConfig{
+			OperationName: method.Operation(),
+		})
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling idempotency per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.Idempotency] = idAny
+	}
+
+	// add QueryRewrite PerRouteConfig to the routes of the transcoded
+	// operations taking the "param[]=a" query style. Without it, the filter
+	// passes the request through.
+	if method.StripQueryArrayBrackets {
+		qrAny, err := ptypes.MarshalAny(&qrpb.PerRouteFilterConfig{})
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling query_rewrite per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.QueryRewrite] = qrAny
+	}
+
+	// add BodyValidation PerRouteConfig to the routes of the http rules with a
+	// validated JSON body. Without it, the filter passes the request through.
+	if validation := method.RequestBodyValidations[httpRule]; validation != nil {
+		bvAny, err := ptypes.MarshalAny(&bvpb.PerRouteFilterConfig{
+			BodyType:            validation.BodyType,
+			BoundFields:         validation.BoundFields,
+			ValidateFields:      validation.ValidateFields,
+			RejectUnknownFields: validation.RejectUnknownFields,
+		})
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling body_validation per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.BodyValidation] = bvAny
+	}
+	return perFilterConfig, nil
+}
+
+// makeOperationFilterConfig makes the per-route filter configs of all the
+// routes of the operation.
+func makeOperationFilterConfig(operation string, method *configinfo.MethodInfo, denyPermissions []*rbacconfigpb.Permission) (map[string]*anypb.Any, error) {
 	perFilterConfig := make(map[string]*anypb.Any)
 
 	// Always add ServiceControl PerRouteConfig
@@ -192,8 +595,9 @@ func makePerRouteFilterConfig(operation string, method *configinfo.MethodInfo, h
 
 	perFilterConfig[util.ServiceControl] = scpr
 
-	// add BackendAuth PerRouteConfig if needed
-	if method.BackendInfo != nil && method.BackendInfo.JwtAudience != "" {
+	// add BackendAuth PerRouteConfig if needed. Without it, the filter
+	// passes the request through.
+	if method.BackendInfo != nil && method.BackendInfo.JwtAudience != "" && !method.DisabledFilters[util.BackendAuth] {
 		auPerRoute := &aupb.PerRouteFilterConfig{
 			JwtAudience: method.BackendInfo.JwtAudience,
 		}
@@ -204,22 +608,18 @@ func makePerRouteFilterConfig(operation string, method *configinfo.MethodInfo, h
 		perFilterConfig[util.BackendAuth] = aupr
 	}
 
-	// add PathRewrite PerRouteConfig if needed
-	if pr := MakePathRewriteConfig(method, httpRule); pr != nil {
-		prAny, err := ptypes.MarshalAny(pr)
-		if err != nil {
-			return perFilterConfig, fmt.Errorf("error marshaling path_rewrite per-route config to Any: %v", err)
-		}
-		perFilterConfig[util.PathRewrite] = prAny
-	}
-
 	// add JwtAuthn PerRouteConfig
-	if method.RequireAuth {
+	if method.RequireAuth || method.DisabledFilters[util.JwtAuthn] {
 		jwtPerRoute := &jwtpb.PerRouteConfig{
 			RequirementSpecifier: &jwtpb.PerRouteConfig_RequirementName{
 				RequirementName: operation,
 			},
 		}
+		if method.DisabledFilters[util.JwtAuthn] {
+			jwtPerRoute.RequirementSpecifier = &jwtpb.PerRouteConfig_Disabled{
+				Disabled: true,
+			}
+		}
 		jwt, err := ptypes.MarshalAny(jwtPerRoute)
 		if err != nil {
 			return perFilterConfig, fmt.Errorf("error marshaling jwt_authn per-route config to Any: %v", err)
@@ -227,92 +627,636 @@ func makePerRouteFilterConfig(operation string, method *configinfo.MethodInfo, h
 		perFilterConfig[util.JwtAuthn] = jwt
 	}
 
+	// add RBAC PerRouteConfig if the callers are restricted. An empty one
+	// disables the filter.
+	if method.DisabledFilters[util.RBAC] {
+		rbac, err := ptypes.MarshalAny(&rbacpb.RBACPerRoute{})
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling rbac per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.RBAC] = rbac
+	} else if len(method.AllowedCallers) > 0 {
+		rbac, err := ptypes.MarshalAny(makeCallerAllowlistRbac(method.AllowedCallers, denyPermissions))
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling rbac per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.RBAC] = rbac
+	}
+
+	// add ConcurrencyLimit PerRouteConfig if the concurrent requests are
+	// limited. Without it, the filter passes the request through.
+	if method.MaxConcurrentRequests > 0 {
+		clAny, err := ptypes.MarshalAny(&clpb.PerRouteFilterConfig{
+			OperationName:         operation,
+			MaxConcurrentRequests: method.MaxConcurrentRequests,
+		})
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling concurrency_limit per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.ConcurrencyLimit] = clAny
+	}
+
+	// add GrpcStatusMapping PerRouteConfig if the transcoded gRPC errors have
+	// their own HTTP status codes or are formatted. Without it, the filter
+	// passes the response through.
+	if len(method.GrpcStatusHttpCodes) > 0 || method.FormatGrpcErrorBody {
+		gsmAny, err := ptypes.MarshalAny(&gsmpb.PerRouteFilterConfig{
+			HttpStatusCodes: method.GrpcStatusHttpCodes,
+		})
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling grpc_status_mapping per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.GrpcStatusMapping] = gsmAny
+	}
+
+	// add StreamFormat PerRouteConfig if the server stream is not a JSON
+	// array. Without it, the filter passes the response through.
+	if method.StreamFormat != "" {
+		format := sfpb.PerRouteFilterConfig_NDJSON
+		if method.StreamFormat == util.StreamFormatSse {
+			format = sfpb.PerRouteFilterConfig_SSE
+		}
+		sfAny, err := ptypes.MarshalAny(&sfpb.PerRouteFilterConfig{
+			Format: format,
+		})
+		if err != nil {
+			return perFilterConfig, fmt.Errorf("error marshaling stream_format per-route config to Any: %v", err)
+		}
+		perFilterConfig[util.StreamFormat] = sfAny
+	}
+
 	return perFilterConfig, nil
 }
 
+// makeCallerAllowlistRbac only allows requests whose JWT payload has an "azp"
+// or "email" claim matching one of the callers, and not matching any of the
+// deny permissions.
+func makeCallerAllowlistRbac(callers []string, denyPermissions []*rbacconfigpb.Permission) *rbacpb.RBACPerRoute {
+	var principals []*rbacconfigpb.Principal
+	for _, caller := range callers {
+		for _, claim := range []string{"azp", "email"} {
+			principals = append(principals, &rbacconfigpb.Principal{
+				Identifier: &rbacconfigpb.Principal_Metadata{
+					Metadata: &matcher.MetadataMatcher{
+						Filter: util.JwtAuthn,
+						Path: []*matcher.MetadataMatcher_PathSegment{
+							{
+								Segment: &matcher.MetadataMatcher_PathSegment_Key{
+									Key: util.JwtPayloadMetadataName,
+								},
+							},
+							{
+								Segment: &matcher.MetadataMatcher_PathSegment_Key{
+									Key: claim,
+								},
+							},
+						},
+						Value: &matcher.ValueMatcher{
+							MatchPattern: &matcher.ValueMatcher_StringMatch{
+								StringMatch: &matcher.StringMatcher{
+									MatchPattern: &matcher.StringMatcher_Exact{
+										Exact: caller,
+									},
+								},
+							},
+						},
+					},
+				},
+			})
+		}
+	}
+
+	permission := &rbacconfigpb.Permission{
+		Rule: &rbacconfigpb.Permission_Any{
+			Any: true,
+		},
+	}
+	if len(denyPermissions) > 0 {
+		permission = &rbacconfigpb.Permission{
+			Rule: &rbacconfigpb.Permission_NotRule{
+				NotRule: &rbacconfigpb.Permission{
+					Rule: &rbacconfigpb.Permission_OrRules{
+						OrRules: &rbacconfigpb.Permission_Set{
+							Rules: denyPermissions,
+						},
+					},
+				},
+			},
+		}
+	}
+
+	return &rbacpb.RBACPerRoute{
+		Rbac: &rbacpb.RBAC{
+			Rules: &rbacconfigpb.RBAC{
+				Action: rbacconfigpb.RBAC_ALLOW,
+				Policies: map[string]*rbacconfigpb.Policy{
+					"caller-allowlist": {
+						Permissions: []*rbacconfigpb.Permission{permission},
+						Principals:  principals,
+					},
+				},
+			},
+		},
+	}
+}
+
 func makeRouteTable(serviceInfo *configinfo.ServiceInfo) ([]*routepb.Route, error) {
-	var backendRoutes []*routepb.Route
-	httpPatternMethods, err := getSortMethodsByHttpPattern(serviceInfo)
+	httpPatternMethods, versionedMethods, queryParamVariants, err := getSortMethodsByHttpPattern(serviceInfo)
 	if err != nil {
 		return nil, fmt.Errorf("fail to sort route match, %v", err)
 	}
+	for _, shadowed := range findShadowedRoutes(httpPatternMethods) {
+		glog.Warningf("%s", shadowed)
+	}
 
+	// The per-route filter configs only depending on the operation are
+	// marshaled once and shared by all its routes.
+	var operations []string
+	operationConfigs := make(map[string]map[string]*anypb.Any)
 	for _, httpPatternMethod := range *httpPatternMethods {
-		operation := httpPatternMethod.Operation
-		method := serviceInfo.Methods[operation]
-		httpRule := &httppattern.Pattern{
-			UriTemplate: httpPatternMethod.UriTemplate,
-			HttpMethod:  httpPatternMethod.HttpMethod,
+		var grouped []*httppattern.Method
+		grouped = append(grouped, queryParamVariants[httpPatternMethod]...)
+		grouped = append(grouped, httpPatternMethod)
+		for _, m := range append(grouped, versionedMethods[httpPatternMethod]...) {
+			if _, ok := operationConfigs[m.Operation]; !ok {
+				operationConfigs[m.Operation] = nil
+				operations = append(operations, m.Operation)
+			}
 		}
+	}
+	denyPermissions := makeDenyPermissions(serviceInfo)
+	configs := make([]map[string]*anypb.Any, len(operations))
+	if err := util.ForEachIndex(len(operations), func(i int) error {
+		var err error
+		configs[i], err = makeOperationFilterConfig(operations[i], serviceInfo.Methods[operations[i]], denyPermissions)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("fail to make per-route filter config, %v", err)
+	}
+	for i, operation := range operations {
+		operationConfigs[operation] = configs[i]
+	}
 
-		// Response timeouts are not compatible with streaming methods (documented in Envoy).
-		// If this method is non-unary gRPC, explicitly set 0s to disable the timeout.
-		// This even applies for routes with gRPC-JSON transcoding where only the upstream is streaming.
-		var respTimeout time.Duration
-		if method.IsStreaming {
-			respTimeout = 0 * time.Second
-		} else {
-			respTimeout = method.BackendInfo.Deadline
+	// The routes of the http patterns are made in parallel, and appended in
+	// the order of the http patterns.
+	patternRoutes := make([][]*routepb.Route, len(*httpPatternMethods))
+	if err := util.ForEachIndex(len(*httpPatternMethods), func(i int) error {
+		httpPatternMethod := (*httpPatternMethods)[i]
+		// The variants only matching some query parameters are ahead.
+		for _, variant := range queryParamVariants[httpPatternMethod] {
+			routes, err := makeHttpPatternRoutes(serviceInfo, variant, "", operationConfigs)
+			if err != nil {
+				return err
+			}
+			patternRoutes[i] = append(patternRoutes[i], routes...)
 		}
+		routes, err := makeVersionedHttpPatternRoutes(serviceInfo, httpPatternMethod, versionedMethods[httpPatternMethod], operationConfigs)
+		patternRoutes[i] = append(patternRoutes[i], routes...)
+		return err
+	}); err != nil {
+		return nil, err
+	}
 
-		var routeMatchers []*routepb.RouteMatch
-		var err error
-		if routeMatchers, err = makeHttpRouteMatchers(httpRule); err != nil {
-			return nil, fmt.Errorf("error making HTTP route matcher for selector (%v): %v", operation, err)
+	var backendRoutes []*routepb.Route
+	for _, routes := range patternRoutes {
+		for _, r := range routes {
+			backendRoutes = append(backendRoutes, r)
+
+			// Large services have thousands of routes, only log them at
+			// verbosity 1.
+			if glog.V(1) {
+				jsonStr, _ := util.ProtoToJson(r)
+				glog.Infof("adding route: %v", jsonStr)
+			}
 		}
+	}
+	glog.Infof("adding %d routes of service %s", len(backendRoutes), serviceInfo.Name)
+	return backendRoutes, nil
+}
+
+// makeVirtualClusters makes a virtual cluster per http pattern, in the order of
+// the routes, named after its operation. Envoy counts a request in the first
+// virtual cluster it matches, so the http patterns of the other api versions
+// are ahead of the one they are routed with. The http patterns only matching
+// some query parameters are counted with the one they are routed ahead of.
+func makeVirtualClusters(serviceInfo *configinfo.ServiceInfo) ([]*routepb.VirtualCluster, error) {
+	httpPatternMethods, versionedMethods, _, err := getSortMethodsByHttpPattern(serviceInfo)
+	if err != nil {
+		return nil, fmt.Errorf("fail to sort virtual clusters, %v", err)
+	}
+
+	var virtualClusters []*routepb.VirtualCluster
+	for _, httpPatternMethod := range *httpPatternMethods {
+		var versions []*httppattern.Method
+		if len(versionedMethods[httpPatternMethod]) > 0 {
+			versions = append([]*httppattern.Method{httpPatternMethod}, versionedMethods[httpPatternMethod]...)
+		}
+		for _, m := range versions {
+			apiVersion := serviceInfo.Methods[m.Operation].ApiVersion
+			if apiVersion == "" {
+				continue
+			}
+			virtualCluster := makeVirtualCluster(m)
+			virtualCluster.Headers = append(virtualCluster.Headers, &routepb.HeaderMatcher{
+				Name: strings.ToLower(serviceInfo.Options.ApiVersionHeader),
+				HeaderMatchSpecifier: &routepb.HeaderMatcher_ExactMatch{
+					ExactMatch: apiVersion,
+				},
+			})
+			virtualClusters = append(virtualClusters, virtualCluster)
+		}
+		virtualClusters = append(virtualClusters, makeVirtualCluster(httpPatternMethod))
+	}
+	return virtualClusters, nil
+}
+
+// makeVirtualCluster matches the http method and the uri template of an http
+// pattern. Unlike the route matchers, the :path header of the virtual clusters
+// includes the query string. The dots of the operation are replaced, as Envoy
+// takes the virtual cluster name up to the first dot as the stats tag.
+func makeVirtualCluster(httpPatternMethod *httppattern.Method) *routepb.VirtualCluster {
+	var headers []*routepb.HeaderMatcher
+	if httpPatternMethod.HttpMethod != httppattern.HttpMethodWildCard {
+		headers = append(headers, &routepb.HeaderMatcher{
+			Name: ":method",
+			HeaderMatchSpecifier: &routepb.HeaderMatcher_ExactMatch{
+				ExactMatch: httpPatternMethod.HttpMethod,
+			},
+		})
+	}
+	headers = append(headers, &routepb.HeaderMatcher{
+		Name: ":path",
+		HeaderMatchSpecifier: &routepb.HeaderMatcher_SafeRegexMatch{
+			SafeRegexMatch: &matcher.RegexMatcher{
+				EngineType: &matcher.RegexMatcher_GoogleRe2{
+					GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+				},
+				Regex: strings.TrimSuffix(httpPatternMethod.UriTemplate.Regex(), "$") + `(\?.*)?$`,
+			},
+		},
+	})
+	return &routepb.VirtualCluster{
+		Name:    strings.ReplaceAll(httpPatternMethod.Operation, ".", "_"),
+		Headers: headers,
+	}
+}
+
+// makeVersionedHttpPatternRoutes makes the routes of an http pattern shared by
+// the operations of several api versions: the routes matching the api version
+// header of each version, then the routes of the api listed first for the
+// requests without a known version.
+func makeVersionedHttpPatternRoutes(serviceInfo *configinfo.ServiceInfo, httpPatternMethod *httppattern.Method, versions []*httppattern.Method, operationConfigs map[string]map[string]*anypb.Any) ([]*routepb.Route, error) {
+	if len(versions) == 0 {
+		return makeHttpPatternRoutes(serviceInfo, httpPatternMethod, "", operationConfigs)
+	}
+
+	var routes []*routepb.Route
+	for _, m := range append([]*httppattern.Method{httpPatternMethod}, versions...) {
+		apiVersion := serviceInfo.Methods[m.Operation].ApiVersion
+		if apiVersion == "" {
+			continue
+		}
+		versionRoutes, err := makeHttpPatternRoutes(serviceInfo, m, apiVersion, operationConfigs)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, versionRoutes...)
+	}
+	defaultRoutes, err := makeHttpPatternRoutes(serviceInfo, httpPatternMethod, "", operationConfigs)
+	if err != nil {
+		return nil, err
+	}
+	return append(routes, defaultRoutes...), nil
+}
+
+// makeHttpPatternRoutes makes the routes of an http pattern of an operation,
+// one per route matcher of the pattern. If apiVersion is set, the routes only
+// match the requests with this version in the api version header.
+func makeHttpPatternRoutes(serviceInfo *configinfo.ServiceInfo, httpPatternMethod *httppattern.Method, apiVersion string, operationConfigs map[string]map[string]*anypb.Any) ([]*routepb.Route, error) {
+	var routes []*routepb.Route
+	operation := httpPatternMethod.Operation
+	method := serviceInfo.Methods[operation]
+	httpRule := httpPatternMethod.Pattern
+
+	// Response timeouts are not compatible with streaming methods (documented in Envoy).
+	// If this method is non-unary gRPC, explicitly set 0s to disable the timeout.
+	// This even applies for routes with gRPC-JSON transcoding where only the upstream is streaming.
+	var respTimeout time.Duration
+	if method.IsStreaming {
+		respTimeout = 0 * time.Second
+	} else {
+		respTimeout = method.BackendInfo.Deadline
+	}
 
+	routeMatchers, err := makeHttpRouteMatchers(httpRule, serviceInfo.Options.ForceRegexRouteMatch)
+	if err != nil {
+		return nil, fmt.Errorf("error making HTTP route matcher for selector (%v): %v", operation, err)
+	}
+	if apiVersion != "" {
 		for _, routeMatcher := range routeMatchers {
-			r := routepb.Route{
-				Match: routeMatcher,
-				Action: &routepb.Route_Route{
-					Route: &routepb.RouteAction{
-						ClusterSpecifier: &routepb.RouteAction_Cluster{
-							Cluster: method.BackendInfo.ClusterName,
-						},
-						Timeout: ptypes.DurationProto(respTimeout),
-						RetryPolicy: &routepb.RetryPolicy{
-							RetryOn: method.BackendInfo.RetryOns,
-							NumRetries: &wrapperspb.UInt32Value{
-								Value: uint32(method.BackendInfo.RetryNum),
-							},
+			routeMatcher.Headers = append(routeMatcher.Headers, &routepb.HeaderMatcher{
+				Name: strings.ToLower(serviceInfo.Options.ApiVersionHeader),
+				HeaderMatchSpecifier: &routepb.HeaderMatcher_ExactMatch{
+					ExactMatch: apiVersion,
+				},
+			})
+		}
+	}
+	for _, routeMatcher := range routeMatchers {
+		routeMatcher.QueryParameters = makeQueryParamMatchers(method.QueryParamMatchers)
+	}
+
+	// The routes of the http pattern share their per-route filter configs.
+	perFilterConfig, err := makePerRouteFilterConfig(method, httpRule, operationConfigs[operation])
+	if err != nil {
+		return nil, fmt.Errorf("fail to make per-route filter config, %v", err)
+	}
+
+	for _, routeMatcher := range routeMatchers {
+		r := routepb.Route{
+			Match:                routeMatcher,
+			TypedPerFilterConfig: perFilterConfig,
+			Action: &routepb.Route_Route{
+				Route: &routepb.RouteAction{
+					ClusterSpecifier: &routepb.RouteAction_Cluster{
+						Cluster: method.BackendInfo.ClusterName,
+					},
+					Timeout: ptypes.DurationProto(respTimeout),
+					RetryPolicy: &routepb.RetryPolicy{
+						RetryOn: method.BackendInfo.RetryOns,
+						NumRetries: &wrapperspb.UInt32Value{
+							Value: uint32(method.BackendInfo.RetryNum),
 						},
 					},
 				},
-				Decorator: &routepb.Decorator{
-					// Note we don't add ApiName to reduce the length of the span name.
-					Operation: fmt.Sprintf("%s %s", util.SpanNamePrefix, method.ShortName),
-				},
+			},
+			Decorator: makeDecorator(serviceInfo.Options, makeSpanName(serviceInfo.Options, method, httpRule.HttpMethod)),
+		}
+
+		if serviceInfo.Options.HonorGrpcTimeoutHeader {
+			// The stream duration is bounded by the route timeout too, so the
+			// header can only shorten the deadline. Envoy only reads it in the
+			// requests with a gRPC content type, the transcoded ones included.
+			r.GetRoute().MaxStreamDuration = &routepb.RouteAction_MaxStreamDuration{
+				GrpcTimeoutHeaderMax: ptypes.DurationProto(respTimeout),
 			}
+		}
 
-			r.TypedPerFilterConfig, err = makePerRouteFilterConfig(operation, method, httpRule)
+		// Remote backends get their own host, the local backend the one of
+		// --backend_host_rewrite, if any.
+		hostRewrite := method.BackendInfo.Hostname
+		if hostRewrite == "" && method.BackendInfo.ClusterName == serviceInfo.LocalBackendCluster.ClusterName {
+			hostRewrite = serviceInfo.LocalBackendCluster.HostRewrite
+		}
+		if hostRewrite != "" {
+			r.GetRoute().HostRewriteSpecifier = &routepb.RouteAction_HostRewriteLiteral{
+				HostRewriteLiteral: hostRewrite,
+			}
+		}
+		if method.UnderApiBasePath {
+			r.GetRoute().RegexRewrite = makeApiBasePathRewrite(serviceInfo.Options.ApiBasePath, method)
+		}
+
+		if method.TracingSampleRate != nil && !serviceInfo.Options.DisableTracing {
+			percentSampleRate, err := tracing.SampleRateToFractionalPercent(*method.TracingSampleRate)
 			if err != nil {
-				return nil, fmt.Errorf("fail to make per-route filter config, %v", err)
+				return nil, fmt.Errorf("invalid trace sampling rate for selector (%v): %v", operation, err)
+			}
+			r.Tracing = &routepb.Tracing{
+				ClientSampling: &typepb.FractionalPercent{
+					Numerator: 0,
+				},
+				RandomSampling:  percentSampleRate,
+				OverallSampling: percentSampleRate,
 			}
+		}
 
-			if method.BackendInfo.Hostname != "" {
-				// For routing to remote backends.
-				r.GetRoute().HostRewriteSpecifier = &routepb.RouteAction_HostRewriteLiteral{
-					HostRewriteLiteral: method.BackendInfo.Hostname,
-				}
+		if method.IsHttpBody && serviceInfo.Options.HttpBodyBufferLimitBytes > 0 {
+			// The transcoder buffers the raw request bytes of google.api.HttpBody
+			// methods. A 0 limit would reject every request with a body, so it is
+			// unset like a negative one.
+			r.PerRequestBufferLimitBytes = &wrapperspb.UInt32Value{
+				Value: uint32(serviceInfo.Options.HttpBodyBufferLimitBytes),
 			}
+		}
 
-			if serviceInfo.Options.EnableHSTS {
-				r.ResponseHeadersToAdd = []*corepb.HeaderValueOption{
-					{
-						Header: &corepb.HeaderValue{
-							Key:   util.HSTSHeaderKey,
-							Value: util.HSTSHeaderValue,
-						},
+		if serviceInfo.Options.EnableHSTS {
+			r.ResponseHeadersToAdd = []*corepb.HeaderValueOption{
+				{
+					Header: &corepb.HeaderValue{
+						Key:   util.HSTSHeaderKey,
+						Value: util.HSTSHeaderValue,
 					},
-				}
+				},
+			}
+		}
+		if serviceInfo.Options.EnableRouteDebugHeaders {
+			r.ResponseHeadersToAdd = append(r.ResponseHeadersToAdd, makeRouteDebugHeaders(operation, method.BackendInfo.ClusterName)...)
+		}
+		if hostRewrite != "" {
+			r.RequestHeadersToAdd = makeOriginalRequestHeaders(serviceInfo.Options, MakePathRewriteConfig(method, httpRule) != nil)
+		}
+		if method.InMaintenance {
+			// The route keeps its per-route filter configs, so the
+			// responses are still authenticated and reported.
+			r.Action = makeMaintenanceAction(serviceInfo.Options.MaintenanceStatusCode)
+			if retryAfter := serviceInfo.Options.MaintenanceRetryAfter; retryAfter > 0 {
+				r.ResponseHeadersToAdd = append(r.ResponseHeadersToAdd, &corepb.HeaderValueOption{
+					Header: &corepb.HeaderValue{
+						Key:   util.RetryAfterHeaderKey,
+						Value: strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10),
+					},
+					Append: &wrapperspb.BoolValue{Value: false},
+				})
+			}
+		}
+		if method.UploadSizeThreshold > 0 && !method.InMaintenance {
+			routes = append(routes, makeUploadRoute(&r, serviceInfo, method.UploadSizeThreshold))
+		}
+		routes = append(routes, &r)
+	}
+	return routes, nil
+}
+
+// makeQueryParamMatchers matches the query parameters of the operation, with
+// their exact value if set.
+func makeQueryParamMatchers(queryParamMatchers []*configinfo.QueryParamMatcher) []*routepb.QueryParameterMatcher {
+	var matchers []*routepb.QueryParameterMatcher
+	for _, queryParamMatcher := range queryParamMatchers {
+		if queryParamMatcher.Value == "" {
+			matchers = append(matchers, &routepb.QueryParameterMatcher{
+				Name: queryParamMatcher.Name,
+				QueryParameterMatchSpecifier: &routepb.QueryParameterMatcher_PresentMatch{
+					PresentMatch: true,
+				},
+			})
+			continue
+		}
+		matchers = append(matchers, &routepb.QueryParameterMatcher{
+			Name: queryParamMatcher.Name,
+			QueryParameterMatchSpecifier: &routepb.QueryParameterMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{
+						Exact: queryParamMatcher.Value,
+					},
+				},
+			},
+		})
+	}
+	return matchers
+}
+
+// makeSpanName formats the span name of the operation. By default, it doesn't
+// have the ApiName to reduce the length of the span name.
+//
+// It is called for every route, so the placeholders are expanded in a single
+// pass instead of building a strings.Replacer each time.
+func makeSpanName(opts options.ConfigGeneratorOptions, method *configinfo.MethodInfo, httpMethod string) string {
+	placeholders := [...][2]string{
+		{"{PREFIX}", opts.TracingSpanNamePrefix},
+		{"{API}", method.ApiName},
+		{"{METHOD}", method.ShortName},
+		{"{HTTP_METHOD}", httpMethod},
+	}
+
+	format := opts.TracingSpanNameFormat
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(format, '{')
+		if i < 0 {
+			b.WriteString(format)
+			return b.String()
+		}
+		b.WriteString(format[:i])
+		format = format[i:]
+
+		expanded := false
+		for _, p := range placeholders {
+			if strings.HasPrefix(format, p[0]) {
+				b.WriteString(p[1])
+				format = format[len(p[0]):]
+				expanded = true
+				break
 			}
-			backendRoutes = append(backendRoutes, &r)
+		}
+		if !expanded {
+			b.WriteByte('{')
+			format = format[1:]
+		}
+	}
+}
 
-			jsonStr, _ := util.ProtoToJson(&r)
-			glog.Infof("adding route: %v", jsonStr)
+// makeDecorator names the spans of the route, unless the decorators are
+// disabled. Envoy refuses an empty span name.
+func makeDecorator(opts options.ConfigGeneratorOptions, spanName string) *routepb.Decorator {
+	if opts.TracingDisableDecorators || strings.TrimSpace(spanName) == "" {
+		return nil
+	}
+	return &routepb.Decorator{
+		Operation: spanName,
+	}
+}
+
+// makeUploadRoute copies the route of an operation to only match the requests
+// with a Content-Length above the threshold, and route them to the upload
+// backend instead. It must be ahead of the route. Like the local backend, the
+// upload backend has no backend rule, so the route drops the backend auth and
+// the path rewrite configs of the backend rule of the operation.
+func makeUploadRoute(r *routepb.Route, serviceInfo *configinfo.ServiceInfo, threshold int64) *routepb.Route {
+	uploadRoute := proto.Clone(r).(*routepb.Route)
+	delete(uploadRoute.TypedPerFilterConfig, util.BackendAuth)
+	delete(uploadRoute.TypedPerFilterConfig, util.PathRewrite)
+	uploadRoute.Match.Headers = append(uploadRoute.Match.Headers, &routepb.HeaderMatcher{
+		Name: "content-length",
+		HeaderMatchSpecifier: &routepb.HeaderMatcher_RangeMatch{
+			RangeMatch: &typepb.Int64Range{
+				Start: threshold + 1,
+				End:   math.MaxInt64,
+			},
+		},
+	})
+
+	clusterName := serviceInfo.UploadBackendCluster.ClusterName
+	uploadRoute.GetRoute().ClusterSpecifier = &routepb.RouteAction_Cluster{
+		Cluster: clusterName,
+	}
+	uploadRoute.GetRoute().HostRewriteSpecifier = nil
+	for _, header := range uploadRoute.GetResponseHeadersToAdd() {
+		if header.GetHeader().GetKey() == util.RouteDebugClusterHeaderKey {
+			header.GetHeader().Value = clusterName
 		}
 	}
-	return backendRoutes, nil
+	return uploadRoute
+}
+
+// makeMaintenanceAction returns the direct response of the routes of an
+// operation in maintenance.
+func makeMaintenanceAction(statusCode int) *routepb.Route_DirectResponse {
+	return &routepb.Route_DirectResponse{
+		DirectResponse: &routepb.DirectResponseAction{
+			Status: uint32(statusCode),
+			Body: &corepb.DataSource{
+				Specifier: &corepb.DataSource_InlineString{
+					InlineString: "The operation is under maintenance, please retry later.",
+				},
+			},
+		},
+	}
+}
+
+// makeRouteDebugHeaders returns the response headers identifying the matched
+// route, replacing the ones of the backend.
+func makeRouteDebugHeaders(operation, clusterName string) []*corepb.HeaderValueOption {
+	return []*corepb.HeaderValueOption{
+		{
+			Header: &corepb.HeaderValue{
+				Key:   util.RouteDebugOperationHeaderKey,
+				Value: operation,
+			},
+			Append: &wrapperspb.BoolValue{Value: false},
+		},
+		{
+			Header: &corepb.HeaderValue{
+				Key:   util.RouteDebugClusterHeaderKey,
+				Value: clusterName,
+			},
+			Append: &wrapperspb.BoolValue{Value: false},
+		},
+	}
+}
+
+// makeOriginalRequestHeaders sends the original path, host and HTTP method of
+// the requests to the remote backends, which rewrite the host and maybe the
+// path.
+func makeOriginalRequestHeaders(opts options.ConfigGeneratorOptions, hasPathRewrite bool) []*corepb.HeaderValueOption {
+	var headers []*corepb.HeaderValueOption
+	addHeader := func(key, value string) {
+		headers = append(headers, &corepb.HeaderValueOption{
+			Header: &corepb.HeaderValue{
+				Key:   key,
+				Value: value,
+			},
+			Append: &wrapperspb.BoolValue{Value: false},
+		})
+	}
+
+	// Path Rewrite filter already sets the original path of the rewritten
+	// paths, and the route only sees the rewritten one.
+	if opts.ForwardOriginalPath && !hasPathRewrite {
+		addHeader(util.OriginalPathHeaderKey, "%REQ(:PATH)%")
+	}
+	// The host is rewritten after the headers are added.
+	if opts.ForwardOriginalHost {
+		addHeader(util.OriginalHostHeaderKey, "%REQ(:AUTHORITY)%")
+	}
+	// Service Control filter keeps the method overridden by
+	// x-http-method-override in the dynamic metadata. An empty value doesn't
+	// replace the header.
+	if opts.ForwardOriginalMethod {
+		addHeader(util.OriginalMethodHeaderKey, "%REQ(:METHOD)%")
+		addHeader(util.OriginalMethodHeaderKey, fmt.Sprintf(`%%DYNAMIC_METADATA(["%s", "original_method"])%%`, util.ServiceControl))
+	}
+	return headers
 }
 
 func makeHttpExactPathRouteMatcher(path string) *routepb.RouteMatch {
@@ -323,7 +1267,11 @@ func makeHttpExactPathRouteMatcher(path string) *routepb.RouteMatch {
 	}
 }
 
-func makeHttpRouteMatchers(httpRule *httppattern.Pattern) ([]*routepb.RouteMatch, error) {
+// makeHttpRouteMatchers matches the uri template by exact paths if it has no
+// wildcard, by a path prefix if its only wildcard is a trailing "**" and
+// forceRegex is false, and otherwise by a regex. The prefix saves a RE2 program
+// per route for the common prefix passthrough templates.
+func makeHttpRouteMatchers(httpRule *httppattern.Pattern, forceRegex bool) ([]*routepb.RouteMatch, error) {
 	if httpRule == nil {
 		return nil, fmt.Errorf("httpRule is nil")
 	}
@@ -337,6 +1285,14 @@ func makeHttpRouteMatchers(httpRule *httppattern.Pattern) ([]*routepb.RouteMatch
 		if pathWithTrailingSlash != pathNoTrailingSlash {
 			routeMatchers = append(routeMatchers, makeHttpExactPathRouteMatcher(pathWithTrailingSlash))
 		}
+	} else if httpRule.UriTemplate.IsPrefixMatch() && !forceRegex {
+		routeMatchers = []*routepb.RouteMatch{
+			{
+				PathSpecifier: &routepb.RouteMatch_Prefix{
+					Prefix: httpRule.UriTemplate.PrefixMatchString(),
+				},
+			},
+		}
 	} else {
 		routeMatchers = []*routepb.RouteMatch{
 			{
@@ -367,7 +1323,13 @@ func makeHttpRouteMatchers(httpRule *httppattern.Pattern) ([]*routepb.RouteMatch
 	return routeMatchers, nil
 }
 
-func getSortMethodsByHttpPattern(serviceInfo *configinfo.ServiceInfo) (*httppattern.MethodSlice, error) {
+// getSortMethodsByHttpPattern returns the http patterns of the operations in
+// matching order. With --api_version_header, the http patterns of the other
+// api versions are not sorted but returned by the http pattern of the api
+// listed first, which they are routed with. Likewise, the http patterns only
+// matching some query parameters are returned by the http pattern they are
+// routed ahead of.
+func getSortMethodsByHttpPattern(serviceInfo *configinfo.ServiceInfo) (*httppattern.MethodSlice, map[*httppattern.Method][]*httppattern.Method, map[*httppattern.Method][]*httppattern.Method, error) {
 	httpPatternMethods := &httppattern.MethodSlice{}
 	for _, operation := range serviceInfo.Operations {
 		method := serviceInfo.Methods[operation]
@@ -379,9 +1341,142 @@ func getSortMethodsByHttpPattern(serviceInfo *configinfo.ServiceInfo) (*httppatt
 		}
 	}
 
+	queryParamVariants, err := groupQueryParamVariants(serviceInfo, httpPatternMethods)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	versionedMethods, err := groupApiVersions(serviceInfo, httpPatternMethods)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkDuplicateHttpPatterns(httpPatternMethods); err != nil {
+		return nil, nil, nil, err
+	}
 	if err := httppattern.Sort(httpPatternMethods); err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	return httpPatternMethods, nil
+	return httpPatternMethods, versionedMethods, queryParamVariants, nil
+}
+
+// groupQueryParamVariants removes the http patterns duplicating the ones of
+// other operations, whose routes only match the requests with some query
+// parameters, and returns them by the http pattern they are routed ahead of:
+// the one of the operation without query param matchers, if any. Like in
+// groupApiVersions, the gRPC methods can't be grouped.
+func groupQueryParamVariants(serviceInfo *configinfo.ServiceInfo, methods *httppattern.MethodSlice) (map[*httppattern.Method][]*httppattern.Method, error) {
+	if serviceInfo.Options.QueryParamMatchers == "" {
+		return nil, nil
+	}
+
+	// Templates only differing by variable names match the same requests.
+	sameRequests := make(map[string][]*httppattern.Method)
+	for _, method := range *methods {
+		if method.UriTemplate != nil {
+			key := method.HttpMethod + " " + method.UriTemplate.Regex()
+			sameRequests[key] = append(sameRequests[key], method)
+		}
+	}
+
+	variants := make(map[*httppattern.Method][]*httppattern.Method)
+	grouped := make(map[*httppattern.Method]bool)
+	for _, method := range *methods {
+		if method.UriTemplate == nil {
+			continue
+		}
+		same := sameRequests[method.HttpMethod+" "+method.UriTemplate.Regex()]
+		if len(same) < 2 || same[0] != method {
+			continue
+		}
+
+		primary := same[0]
+		for _, m := range same {
+			if len(serviceInfo.Methods[m.Operation].QueryParamMatchers) == 0 {
+				primary = m
+				break
+			}
+		}
+		for _, m := range same {
+			if m != primary && len(serviceInfo.Methods[m.Operation].QueryParamMatchers) > 0 {
+				if err := checkTranscodedGrouping(serviceInfo, primary, m, "--query_param_matchers"); err != nil {
+					return nil, err
+				}
+				variants[primary] = append(variants[primary], m)
+				grouped[m] = true
+			}
+		}
+	}
+
+	var kept httppattern.MethodSlice
+	for _, method := range *methods {
+		if !grouped[method] {
+			kept = append(kept, method)
+		}
+	}
+	*methods = kept
+	return variants, nil
+}
+
+// groupApiVersions removes the http patterns duplicating the ones of an
+// earlier operation with another api version, and returns them by the
+// earlier http pattern. Nothing is grouped without --api_version_header. The
+// gRPC methods can't be grouped, since the transcoder would get the same http
+// binding for each of them.
+func groupApiVersions(serviceInfo *configinfo.ServiceInfo, methods *httppattern.MethodSlice) (map[*httppattern.Method][]*httppattern.Method, error) {
+	if serviceInfo.Options.ApiVersionHeader == "" {
+		return nil, nil
+	}
+
+	versionedMethods := make(map[*httppattern.Method][]*httppattern.Method)
+	first := make(map[string]*httppattern.Method)
+	var kept httppattern.MethodSlice
+	for _, method := range *methods {
+		if method.UriTemplate == nil {
+			kept = append(kept, method)
+			continue
+		}
+		// Templates only differing by variable names match the same requests.
+		key := method.HttpMethod + " " + method.UriTemplate.Regex()
+		earlier, ok := first[key]
+		if !ok {
+			first[key] = method
+			kept = append(kept, method)
+			continue
+		}
+
+		version := serviceInfo.Methods[method.Operation].ApiVersion
+		grouped := version != ""
+		for _, other := range append([]*httppattern.Method{earlier}, versionedMethods[earlier]...) {
+			if serviceInfo.Methods[other.Operation].ApiVersion == version {
+				grouped = false
+			}
+		}
+		if !grouped {
+			// Left for checkDuplicateHttpPatterns to report.
+			kept = append(kept, method)
+			continue
+		}
+		if err := checkTranscodedGrouping(serviceInfo, earlier, method, "--api_version_header"); err != nil {
+			return nil, err
+		}
+		versionedMethods[earlier] = append(versionedMethods[earlier], method)
+	}
+	*methods = kept
+	return versionedMethods, nil
+}
+
+// checkTranscodedGrouping rejects the grouping of two http patterns by a flag
+// if either is of a gRPC method. The transcoder binds the http rules of the
+// proto descriptor with no api version or query parameter matcher, so the
+// same http pattern twice is a duplicate binding and the listener is rejected.
+func checkTranscodedGrouping(serviceInfo *configinfo.ServiceInfo, method, other *httppattern.Method, flag string) error {
+	for _, m := range []*httppattern.Method{method, other} {
+		for _, apiName := range serviceInfo.GrpcApiNames {
+			if serviceInfo.Methods[m.Operation].ApiName == apiName {
+				return fmt.Errorf("%s is not supported for the gRPC method %s: operations %s and %s have the same http pattern %s %s, which the gRPC-JSON transcoder can only bind once",
+					flag, m.Operation, method.Operation, other.Operation, method.HttpMethod, method.UriTemplate)
+			}
+		}
+	}
+	return nil
 }
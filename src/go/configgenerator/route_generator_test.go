@@ -16,17 +16,33 @@ package configgenerator
 
 import (
 	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 
+	ccpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/cache_control"
+	clpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/concurrency_limit"
+	etagpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/etag"
+	gsmpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/grpc_status_mapping"
+	prpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/path_rewrite"
+	sfpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/stream_format"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	anypb "github.com/golang/protobuf/ptypes/any"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
@@ -2094,10 +2110,7 @@ func TestMakeRouteConfig(t *testing.T) {
                 "name": ":method"
               }
             ],
-            "safeRegex": {
-              "googleRe2": {},
-              "regex": "^/foo/.*\\/?$"
-            }
+            "prefix": "/foo/"
           },
           "responseHeadersToAdd": [
             {
@@ -2195,139 +2208,3213 @@ func TestMakeRouteConfig(t *testing.T) {
 	}
 }
 
-func TestMakeRouteConfigForCors(t *testing.T) {
+func TestMakeRouteTableForHttpBody(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name:            "Upload",
+						RequestTypeUrl:  "type.googleapis.com/google.api.HttpBody",
+						ResponseTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.Book",
+					},
+					{
+						Name:            "Download",
+						RequestTypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.GetBookRequest",
+						ResponseTypeUrl: "type.googleapis.com/google.api.HttpBody",
+					},
+					{
+						Name:            "Echo",
+						RequestTypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.EchoRequest",
+						ResponseTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.EchoResponse",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Upload",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/upload",
+				},
+				Body: "*",
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Download",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/download",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+				Body: "*",
+			},
+		}},
+	}
 	testData := []struct {
-		desc string
-		// Test parameters, in the order of "cors_preset", "cors_allow_origin"
-		// "cors_allow_origin_regex", "cors_allow_methods", "cors_allow_headers"
-		// "cors_expose_headers"
-		params           []string
-		allowCredentials bool
-		wantedError      string
-		wantCorsPolicy   *routepb.CorsPolicy
+		desc                     string
+		httpBodyBufferLimitBytes int
+		wantBufferLimits         map[string]*wrapperspb.UInt32Value
 	}{
 		{
-			desc:           "No Cors",
-			wantCorsPolicy: nil,
+			desc:                     "buffer limit not set by default",
+			httpBodyBufferLimitBytes: -1,
+			wantBufferLimits:         map[string]*wrapperspb.UInt32Value{},
 		},
 		{
-			desc:        "Incorrect configured basic Cors",
-			params:      []string{"basic", "", `^https?://.+\\.example\\.com\/?$`, "", "", ""},
-			wantedError: "cors_allow_origin cannot be empty when cors_preset=basic",
+			desc:                     "0 buffer limit is not set",
+			httpBodyBufferLimitBytes: 0,
+			wantBufferLimits:         map[string]*wrapperspb.UInt32Value{},
 		},
 		{
-			desc:        "Incorrect configured  Cors",
-			params:      []string{"", "", "", "GET", "", ""},
-			wantedError: "cors_preset must be set in order to enable CORS support",
+			desc:                     "buffer limit set for HttpBody methods",
+			httpBodyBufferLimitBytes: 10485760,
+			wantBufferLimits: map[string]*wrapperspb.UInt32Value{
+				"ingress Upload":   {Value: 10485760},
+				"ingress Download": {Value: 10485760},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.HttpBodyBufferLimitBytes = tc.httpBodyBufferLimitBytes
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotBufferLimits := make(map[string]*wrapperspb.UInt32Value)
+			for _, route := range routes {
+				if route.PerRequestBufferLimitBytes != nil {
+					gotBufferLimits[route.GetDecorator().GetOperation()] = route.PerRequestBufferLimitBytes
+				}
+			}
+			if len(gotBufferLimits) != len(tc.wantBufferLimits) {
+				t.Fatalf("got buffer limits: %v, want: %v", gotBufferLimits, tc.wantBufferLimits)
+			}
+			for operation, want := range tc.wantBufferLimits {
+				if !proto.Equal(gotBufferLimits[operation], want) {
+					t.Errorf("operation %s: got buffer limit: %v, want: %v", operation, gotBufferLimits[operation], want)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForRouteDebugHeaders(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+				},
+			},
 		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                    string
+		enableRouteDebugHeaders bool
+		enableHSTS              bool
+		wantHeaders             []string
+	}{
 		{
-			desc:        "Incorrect configured regex Cors",
-			params:      []string{"cors_with_regexs", "", `^https?://.+\\.example\\.com\/?$`, "", "", ""},
-			wantedError: `cors_preset must be either "basic" or "cors_with_regex"`,
+			desc: "no debug headers by default",
 		},
 		{
-			desc:        "Oversize cors origin regex",
-			params:      []string{"cors_with_regex", "", getOverSizeRegexForTest(), "", "Origin,Content-Type,Accept", ""},
-			wantedError: `invalid cors origin regex: regex program size(1001) is larger than the max expected(1000)`,
+			desc:                    "debug headers of the matched route",
+			enableRouteDebugHeaders: true,
+			wantHeaders: []string{
+				"x-espv2-debug-operation: endpoints.examples.bookstore.Bookstore.Echo",
+				"x-espv2-debug-cluster: backend-cluster-bookstore.endpoints.project123.cloud.goog_local",
+			},
 		},
 		{
-			desc:   "Correct configured basic Cors, with allow methods",
-			params: []string{"basic", "http://example.com", "", "GET,POST,PUT,OPTIONS", "", ""},
-			wantCorsPolicy: &routepb.CorsPolicy{
-				AllowOriginStringMatch: []*matcher.StringMatcher{
+			desc:                    "debug headers after HSTS",
+			enableRouteDebugHeaders: true,
+			enableHSTS:              true,
+			wantHeaders: []string{
+				"Strict-Transport-Security: max-age=31536000; includeSubdomains",
+				"x-espv2-debug-operation: endpoints.examples.bookstore.Bookstore.Echo",
+				"x-espv2-debug-cluster: backend-cluster-bookstore.endpoints.project123.cloud.goog_local",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.EnableRouteDebugHeaders = tc.enableRouteDebugHeaders
+			opts.EnableHSTS = tc.enableHSTS
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, route := range routes {
+				var gotHeaders []string
+				for _, header := range route.GetResponseHeadersToAdd() {
+					gotHeaders = append(gotHeaders, header.GetHeader().GetKey()+": "+header.GetHeader().GetValue())
+				}
+				if !reflect.DeepEqual(gotHeaders, tc.wantHeaders) {
+					t.Errorf("got response headers: %v, want: %v", gotHeaders, tc.wantHeaders)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForMaintenance(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
 					{
-						MatchPattern: &matcher.StringMatcher_Exact{
-							Exact: "http://example.com",
-						},
+						Name: "Echo",
+					},
+					{
+						Name: "Ping",
 					},
 				},
-				AllowMethods:     "GET,POST,PUT,OPTIONS",
-				AllowCredentials: &wrapperspb.BoolValue{Value: false},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Ping",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/ping",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                  string
+		maintenanceSelectors  string
+		maintenanceStatusCode int
+		maintenanceRetryAfter time.Duration
+		// The direct response status of the route of each operation, 0 for
+		// the routes to the backend.
+		wantStatus  map[string]uint32
+		wantHeaders map[string][]string
+		wantError   string
+	}{
+		{
+			desc: "no operation in maintenance",
+			wantStatus: map[string]uint32{
+				"endpoints.examples.bookstore.Bookstore.Echo": 0,
+				"endpoints.examples.bookstore.Bookstore.Ping": 0,
 			},
 		},
 		{
-			desc:   "Correct configured regex Cors, with allow headers",
-			params: []string{"cors_with_regex", "", `^https?://.+\\.example\\.com\/?$`, "", "Origin,Content-Type,Accept", ""},
-			wantCorsPolicy: &routepb.CorsPolicy{
-				AllowOriginStringMatch: []*matcher.StringMatcher{
+			desc:                  "operation in maintenance with Retry-After",
+			maintenanceSelectors:  "endpoints.examples.bookstore.Bookstore.Echo",
+			maintenanceStatusCode: 503,
+			maintenanceRetryAfter: 90500 * time.Millisecond,
+			wantStatus: map[string]uint32{
+				"endpoints.examples.bookstore.Bookstore.Echo": 503,
+				"endpoints.examples.bookstore.Bookstore.Ping": 0,
+			},
+			wantHeaders: map[string][]string{
+				"endpoints.examples.bookstore.Bookstore.Echo": {"Retry-After: 91"},
+			},
+		},
+		{
+			desc:                  "operations locked without Retry-After",
+			maintenanceSelectors:  "endpoints.examples.bookstore.Bookstore.Echo, endpoints.examples.bookstore.Bookstore.Ping",
+			maintenanceStatusCode: 423,
+			wantStatus: map[string]uint32{
+				"endpoints.examples.bookstore.Bookstore.Echo": 423,
+				"endpoints.examples.bookstore.Bookstore.Ping": 423,
+			},
+		},
+		{
+			desc:                  "invalid maintenance status code",
+			maintenanceSelectors:  "endpoints.examples.bookstore.Bookstore.Echo",
+			maintenanceStatusCode: 500,
+			wantError:             "invalid maintenance status code 500, must be 503 or 423",
+		},
+		{
+			desc:                  "unknown operation in maintenance",
+			maintenanceSelectors:  "endpoints.examples.bookstore.Bookstore.Delete",
+			maintenanceStatusCode: 503,
+			wantError:             "selector endpoints.examples.bookstore.Bookstore.Delete in --maintenance_selectors is not defined",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.MaintenanceSelectors = tc.maintenanceSelectors
+			opts.MaintenanceStatusCode = tc.maintenanceStatusCode
+			opts.MaintenanceRetryAfter = tc.maintenanceRetryAfter
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotStatus := make(map[string]uint32)
+			gotHeaders := make(map[string][]string)
+			for _, route := range routes {
+				operation := strings.TrimPrefix(route.GetDecorator().GetOperation(), util.SpanNamePrefix+" ")
+				operation = "endpoints.examples.bookstore.Bookstore." + operation
+				gotStatus[operation] = route.GetDirectResponse().GetStatus()
+				if route.GetDirectResponse() != nil && route.GetRoute() != nil {
+					t.Errorf("route of %s has both a direct response and a route action", operation)
+				}
+				if route.GetDirectResponse() != nil && route.GetTypedPerFilterConfig()[util.ServiceControl] == nil {
+					t.Errorf("route of %s in maintenance lost its service control config", operation)
+				}
+				var headers []string
+				for _, header := range route.GetResponseHeadersToAdd() {
+					headers = append(headers, header.GetHeader().GetKey()+": "+header.GetHeader().GetValue())
+				}
+				if headers != nil {
+					gotHeaders[operation] = headers
+				}
+			}
+			if !reflect.DeepEqual(gotStatus, tc.wantStatus) {
+				t.Errorf("got direct response status: %v, want: %v", gotStatus, tc.wantStatus)
+			}
+			if len(tc.wantHeaders) == 0 {
+				tc.wantHeaders = map[string][]string{}
+			}
+			if !reflect.DeepEqual(gotHeaders, tc.wantHeaders) {
+				t.Errorf("got response headers: %v, want: %v", gotHeaders, tc.wantHeaders)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForResponseCache(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
 					{
-						MatchPattern: &matcher.StringMatcher_SafeRegex{
-							SafeRegex: &matcher.RegexMatcher{
-								EngineType: &matcher.RegexMatcher_GoogleRe2{
-									GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
-								},
-								Regex: `^https?://.+\\.example\\.com\/?$`,
-							},
-						},
+						Name: "Echo",
+					},
+					{
+						Name: "Ping",
 					},
 				},
-				AllowHeaders:     "Origin,Content-Type,Accept",
-				AllowCredentials: &wrapperspb.BoolValue{Value: false},
 			},
 		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Ping",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/ping",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                    string
+		responseCacheSelectors  string
+		responseCacheKeyHeaders string
+		wantCacheControls       map[string]*ccpb.PerRouteFilterConfig
+	}{
 		{
-			desc:             "Correct configured regex Cors, with expose headers",
-			params:           []string{"cors_with_regex", "", `^https?://.+\\.example\\.com\/?$`, "", "", "Content-Length"},
-			allowCredentials: true,
-			wantCorsPolicy: &routepb.CorsPolicy{
-				AllowOriginStringMatch: []*matcher.StringMatcher{
-					{
-						MatchPattern: &matcher.StringMatcher_SafeRegex{
-							SafeRegex: &matcher.RegexMatcher{
-								EngineType: &matcher.RegexMatcher_GoogleRe2{
-									GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
-								},
-								Regex: `^https?://.+\\.example\\.com\/?$`,
-							},
-						},
-					},
+			desc:              "no cached responses",
+			wantCacheControls: map[string]*ccpb.PerRouteFilterConfig{},
+		},
+		{
+			desc:                   "cached responses varying on the API key header",
+			responseCacheSelectors: "endpoints.examples.bookstore.Bookstore.Ping=90500ms",
+			wantCacheControls: map[string]*ccpb.PerRouteFilterConfig{
+				"Ping": {
+					MaxAge:      91,
+					VaryHeaders: []string{"x-api-key"},
+				},
+			},
+		},
+		{
+			desc:                    "cached responses varying on request headers",
+			responseCacheSelectors:  "endpoints.examples.bookstore.Bookstore.Ping",
+			responseCacheKeyHeaders: "Accept-Language, x-tenant",
+			wantCacheControls: map[string]*ccpb.PerRouteFilterConfig{
+				"Ping": {
+					MaxAge:      60,
+					VaryHeaders: []string{"Accept-Language", "x-tenant", "x-api-key"},
 				},
-				ExposeHeaders:    "Content-Length",
-				AllowCredentials: &wrapperspb.BoolValue{Value: true},
 			},
 		},
 	}
 
 	for _, tc := range testData {
-		opts := options.DefaultConfigGeneratorOptions()
-		if tc.params != nil {
-			opts.CorsPreset = tc.params[0]
-			opts.CorsAllowOrigin = tc.params[1]
-			opts.CorsAllowOriginRegex = tc.params[2]
-			opts.CorsAllowMethods = tc.params[3]
-			opts.CorsAllowHeaders = tc.params[4]
-			opts.CorsExposeHeaders = tc.params[5]
-		}
-		opts.CorsAllowCredentials = tc.allowCredentials
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ResponseCacheSelectors = tc.responseCacheSelectors
+			opts.ResponseCacheKeyHeaders = tc.responseCacheKeyHeaders
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-		gotRoute, err := MakeRouteConfig(&configinfo.ServiceInfo{
-			Name:    "test-api",
-			Options: opts,
-		})
-		if tc.wantedError != "" {
-			if err == nil || !strings.Contains(err.Error(), tc.wantedError) {
-				t.Errorf("Test (%s): expected err: %v, got: %v", tc.desc, tc.wantedError, err)
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
 			}
-			continue
-		}
 
-		gotHost := gotRoute.GetVirtualHosts()
-		if len(gotHost) != 1 {
-			t.Errorf("Test (%v): got expected number of virtual host", tc.desc)
-		}
-		gotCors := gotHost[0].GetCors()
-		if !proto.Equal(gotCors, tc.wantCorsPolicy) {
-			t.Errorf("Test (%v): makeRouteConfig failed, got Cors: %v, want: %v", tc.desc, gotCors, tc.wantCorsPolicy)
-		}
+			gotCacheControls := make(map[string]*ccpb.PerRouteFilterConfig)
+			for _, route := range routes {
+				// The backend's Cache-Control is not overridden by the route.
+				if headers := route.GetResponseHeadersToAdd(); len(headers) != 0 {
+					t.Errorf("got response headers: %v, want none", headers)
+				}
+				ccAny, ok := route.GetTypedPerFilterConfig()[util.CacheControl]
+				if !ok {
+					continue
+				}
+				cacheControl := &ccpb.PerRouteFilterConfig{}
+				if err := ptypes.UnmarshalAny(ccAny, cacheControl); err != nil {
+					t.Fatal(err)
+				}
+				operation := strings.TrimPrefix(route.GetDecorator().GetOperation(), util.SpanNamePrefix+" ")
+				gotCacheControls[operation] = cacheControl
+			}
+			if len(gotCacheControls) != len(tc.wantCacheControls) {
+				t.Errorf("got cache control configs: %v, want: %v", gotCacheControls, tc.wantCacheControls)
+			}
+			for operation, want := range tc.wantCacheControls {
+				if got := gotCacheControls[operation]; !proto.Equal(got, want) {
+					t.Errorf("got cache control config of %s: %v, want: %v", operation, got, want)
+				}
+			}
+		})
 	}
 }
 
-// Used to generate a oversize cors origin regex or a oversize wildcard uri template.
-func getOverSizeRegexForTest() string {
-	overSizeRegex := ""
-	for i := 0; i < 333; i += 1 {
-		// Use "/**" as it is a replacement token for wildcard uri template.
-		overSizeRegex += "/**"
-	}
-	return overSizeRegex
+func TestMakeRouteTableForEtag(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+					{
+						Name: "Ping",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Ping",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/ping",
+				},
+				AdditionalBindings: []*annotationspb.HttpRule{
+					{
+						Pattern: &annotationspb.HttpRule_Post{
+							Post: "/ping",
+						},
+					},
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                   string
+		etagSelectors          string
+		responseCacheSelectors string
+		// The routes with an etag per-route config, as "operation method".
+		wantEtagRoutes []string
+		// The filters from Etag filter to gRPC Transcoder filter.
+		wantFilters []string
+	}{
+		{
+			desc: "no etag",
+		},
+		{
+			desc:           "etag on the GET routes of the operation",
+			etagSelectors:  "endpoints.examples.bookstore.Bookstore.Ping",
+			wantEtagRoutes: []string{"Ping GET", "Ping GET"},
+			wantFilters:    []string{util.Etag, util.GRPCWeb},
+		},
+		{
+			desc:                   "etag ahead of the response cache",
+			etagSelectors:          "endpoints.examples.bookstore.Bookstore.Ping",
+			responseCacheSelectors: "endpoints.examples.bookstore.Bookstore.Ping",
+			wantEtagRoutes:         []string{"Ping GET", "Ping GET"},
+			wantFilters:            []string{util.Etag, util.Cache, util.CacheControl, util.GRPCWeb},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.EtagSelectors = tc.etagSelectors
+			opts.ResponseCacheSelectors = tc.responseCacheSelectors
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotEtagRoutes []string
+			for _, route := range routes {
+				if _, ok := route.GetTypedPerFilterConfig()[util.Etag]; !ok {
+					continue
+				}
+				operation := strings.TrimPrefix(route.GetDecorator().GetOperation(), util.SpanNamePrefix+" ")
+				for _, header := range route.GetMatch().GetHeaders() {
+					if header.GetName() == ":method" {
+						gotEtagRoutes = append(gotEtagRoutes, operation+" "+header.GetExactMatch())
+					}
+				}
+			}
+			if !reflect.DeepEqual(gotEtagRoutes, tc.wantEtagRoutes) {
+				t.Errorf("got etag routes: %v, want: %v", gotEtagRoutes, tc.wantEtagRoutes)
+			}
+
+			filters, err := MakeHttpFilters(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotFilters []string
+			for _, filter := range filters {
+				if filter.GetName() == util.Etag {
+					etagConfig := &etagpb.FilterConfig{}
+					if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), etagConfig); err != nil {
+						t.Fatal(err)
+					}
+					if etagConfig.GetMaxBodyBytes() != 1<<20 {
+						t.Errorf("got etag max body bytes: %d, want: %d", etagConfig.GetMaxBodyBytes(), 1<<20)
+					}
+				}
+				if filter.GetName() == util.Etag || gotFilters != nil {
+					gotFilters = append(gotFilters, filter.GetName())
+				}
+				if filter.GetName() == util.GRPCWeb {
+					break
+				}
+			}
+			if !reflect.DeepEqual(gotFilters, tc.wantFilters) {
+				t.Errorf("got filters: %v, want: %v", gotFilters, tc.wantFilters)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForConcurrencyLimit(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+					{
+						Name: "Ping",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Ping",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/ping",
+				},
+				AdditionalBindings: []*annotationspb.HttpRule{
+					{
+						Pattern: &annotationspb.HttpRule_Post{
+							Post: "/ping",
+						},
+					},
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc              string
+		concurrencyLimits string
+		// The routes with a concurrency limit per-route config, as
+		// "operation method limit". Each pattern has a route with and without
+		// a trailing slash.
+		wantRoutes []string
+		wantFilter bool
+	}{
+		{
+			desc: "no concurrency limit",
+		},
+		{
+			desc:              "concurrency limit on all the routes of the operation",
+			concurrencyLimits: "endpoints.examples.bookstore.Bookstore.Ping=5",
+			wantRoutes: []string{
+				"endpoints.examples.bookstore.Bookstore.Ping GET 5",
+				"endpoints.examples.bookstore.Bookstore.Ping GET 5",
+				"endpoints.examples.bookstore.Bookstore.Ping POST 5",
+				"endpoints.examples.bookstore.Bookstore.Ping POST 5",
+			},
+			wantFilter: true,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ConcurrencyLimits = tc.concurrencyLimits
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotRoutes []string
+			for _, route := range routes {
+				perRouteAny, ok := route.GetTypedPerFilterConfig()[util.ConcurrencyLimit]
+				if !ok {
+					continue
+				}
+				perRoute := &clpb.PerRouteFilterConfig{}
+				if err := ptypes.UnmarshalAny(perRouteAny, perRoute); err != nil {
+					t.Fatal(err)
+				}
+				for _, header := range route.GetMatch().GetHeaders() {
+					if header.GetName() == ":method" {
+						gotRoutes = append(gotRoutes, fmt.Sprintf("%s %s %d", perRoute.GetOperationName(), header.GetExactMatch(), perRoute.GetMaxConcurrentRequests()))
+					}
+				}
+			}
+			sort.Strings(gotRoutes)
+			if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+				t.Errorf("got concurrency limit routes: %v, want: %v", gotRoutes, tc.wantRoutes)
+			}
+
+			filters, err := MakeHttpFilters(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotFilter := false
+			for _, filter := range filters {
+				gotFilter = gotFilter || filter.GetName() == util.ConcurrencyLimit
+			}
+			if gotFilter != tc.wantFilter {
+				t.Errorf("got concurrency limit filter: %v, want: %v", gotFilter, tc.wantFilter)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForUploadSizeThreshold(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Upload",
+					},
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Upload",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/upload",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                 string
+		uploadSizeThresholds string
+		// The routes as "path cluster min-content-length", in order.
+		wantRoutes []string
+	}{
+		{
+			desc: "no upload routes",
+			wantRoutes: []string{
+				"/echo backend-cluster-bookstore.endpoints.project123.cloud.goog_local 0",
+				"/echo/ backend-cluster-bookstore.endpoints.project123.cloud.goog_local 0",
+				"/upload backend-cluster-bookstore.endpoints.project123.cloud.goog_local 0",
+				"/upload/ backend-cluster-bookstore.endpoints.project123.cloud.goog_local 0",
+			},
+		},
+		{
+			desc:                 "upload routes ahead of the routes of the operation",
+			uploadSizeThresholds: "endpoints.examples.bookstore.Bookstore.Upload=1024",
+			wantRoutes: []string{
+				"/echo backend-cluster-bookstore.endpoints.project123.cloud.goog_local 0",
+				"/echo/ backend-cluster-bookstore.endpoints.project123.cloud.goog_local 0",
+				"/upload backend-cluster-bookstore.endpoints.project123.cloud.goog_upload 1025",
+				"/upload backend-cluster-bookstore.endpoints.project123.cloud.goog_local 0",
+				"/upload/ backend-cluster-bookstore.endpoints.project123.cloud.goog_upload 1025",
+				"/upload/ backend-cluster-bookstore.endpoints.project123.cloud.goog_local 0",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.UploadSizeThresholds = tc.uploadSizeThresholds
+			if tc.uploadSizeThresholds != "" {
+				opts.UploadBackendAddress = "http://127.0.0.1:8090"
+			}
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotRoutes []string
+			for _, route := range routes {
+				var minContentLength int64
+				for _, header := range route.GetMatch().GetHeaders() {
+					if header.GetName() == "content-length" {
+						minContentLength = header.GetRangeMatch().GetStart()
+					}
+				}
+				gotRoutes = append(gotRoutes, fmt.Sprintf("%s %s %d", route.GetMatch().GetPath(), route.GetRoute().GetCluster(), minContentLength))
+			}
+			if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+				t.Errorf("got routes: %v, want: %v", gotRoutes, tc.wantRoutes)
+			}
+		})
+	}
+}
+
+func TestMakeUploadRoute(t *testing.T) {
+	route := &routepb.Route{
+		Match: &routepb.RouteMatch{
+			PathSpecifier: &routepb.RouteMatch_Path{Path: "/upload"},
+		},
+		Action: &routepb.Route_Route{
+			Route: &routepb.RouteAction{
+				ClusterSpecifier: &routepb.RouteAction_Cluster{Cluster: "backend-cluster-remote"},
+			},
+		},
+		TypedPerFilterConfig: map[string]*anypb.Any{
+			util.BackendAuth:    {TypeUrl: "backend_auth"},
+			util.PathRewrite:    {TypeUrl: "path_rewrite"},
+			util.ServiceControl: {TypeUrl: "service_control"},
+		},
+	}
+	serviceInfo := &configinfo.ServiceInfo{
+		UploadBackendCluster: &configinfo.BackendRoutingCluster{
+			ClusterName: "backend-cluster-upload",
+		},
+	}
+
+	uploadRoute := makeUploadRoute(route, serviceInfo, 1024)
+	if got := uploadRoute.GetRoute().GetCluster(); got != "backend-cluster-upload" {
+		t.Errorf("got cluster: %s, want: backend-cluster-upload", got)
+	}
+	var gotFilters []string
+	for name := range uploadRoute.GetTypedPerFilterConfig() {
+		gotFilters = append(gotFilters, name)
+	}
+	if want := []string{util.ServiceControl}; !reflect.DeepEqual(gotFilters, want) {
+		t.Errorf("got per-route filter configs: %v, want: %v", gotFilters, want)
+	}
+	if len(route.GetTypedPerFilterConfig()) != 3 {
+		t.Errorf("the per-route filter configs of the original route are modified: %v", route.GetTypedPerFilterConfig())
+	}
+}
+
+func TestMakeRouteTableForGrpcTimeoutHeader(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+					{
+						Name:             "EchoStream",
+						RequestStreaming: true,
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.EchoStream",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo-stream",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                   string
+		honorGrpcTimeoutHeader bool
+		// The routes as "path grpc-timeout-header-max", "-" if the header is
+		// not honored.
+		wantRoutes []string
+	}{
+		{
+			desc: "grpc-timeout header not honored",
+			wantRoutes: []string{
+				"/echo -",
+				"/echo/ -",
+				"/echo-stream -",
+				"/echo-stream/ -",
+			},
+		},
+		{
+			desc:                   "grpc-timeout header bounded by the deadline",
+			honorGrpcTimeoutHeader: true,
+			wantRoutes: []string{
+				"/echo 15s",
+				"/echo/ 15s",
+				"/echo-stream 0s",
+				"/echo-stream/ 0s",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.HonorGrpcTimeoutHeader = tc.honorGrpcTimeoutHeader
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotRoutes []string
+			for _, route := range routes {
+				headerMax := "-"
+				if maxStreamDuration := route.GetRoute().GetMaxStreamDuration(); maxStreamDuration != nil {
+					d, err := ptypes.Duration(maxStreamDuration.GetGrpcTimeoutHeaderMax())
+					if err != nil {
+						t.Fatal(err)
+					}
+					headerMax = d.String()
+				}
+				gotRoutes = append(gotRoutes, fmt.Sprintf("%s %s", route.GetMatch().GetPath(), headerMax))
+			}
+			if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+				t.Errorf("got routes: %v, want: %v", gotRoutes, tc.wantRoutes)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForGrpcStatusMapping(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+					{
+						Name: "Ping",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Ping",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/ping",
+				},
+			},
+		}},
+		SourceInfo: &confpb.SourceInfo{
+			SourceFiles: []*anypb.Any{content},
+		},
+	}
+	testData := []struct {
+		desc                   string
+		grpcStatusHttpCodes    string
+		operationGrpcStatusMap string
+		// The routes with a grpc status mapping per-route config, as
+		// "path codes". Each pattern has a route with and without a trailing
+		// slash, and the gRPC path of the operation has its routes too.
+		wantRoutes []string
+		wantFilter bool
+		// The filter config of the filter, empty if it has none.
+		localReplyJsonFormat      string
+		localReplyIncludeDetails  bool
+		localReplyErrorInfoDomain string
+		localReplyHelpUrl         string
+		wantFilterConfig          string
+	}{
+		{
+			desc: "no grpc status mapping",
+		},
+		{
+			desc:                   "grpc status mapping of the operation",
+			operationGrpcStatusMap: "endpoints.examples.bookstore.Bookstore.Ping=NOT_FOUND:410",
+			wantRoutes: []string{
+				"/endpoints.examples.bookstore.Bookstore/Ping map[5:410]",
+				"/endpoints.examples.bookstore.Bookstore/Ping/ map[5:410]",
+				"/ping map[5:410]",
+				"/ping/ map[5:410]",
+			},
+			wantFilter: true,
+		},
+		{
+			desc:                   "default grpc status mapping with operation override",
+			grpcStatusHttpCodes:    "NOT_FOUND:410",
+			operationGrpcStatusMap: "endpoints.examples.bookstore.Bookstore.Ping=UNAVAILABLE:502",
+			wantRoutes: []string{
+				"/echo map[5:410]",
+				"/echo/ map[5:410]",
+				"/endpoints.examples.bookstore.Bookstore/Echo map[5:410]",
+				"/endpoints.examples.bookstore.Bookstore/Echo/ map[5:410]",
+				"/endpoints.examples.bookstore.Bookstore/Ping map[5:410 14:502]",
+				"/endpoints.examples.bookstore.Bookstore/Ping/ map[5:410 14:502]",
+				"/ping map[5:410 14:502]",
+				"/ping/ map[5:410 14:502]",
+			},
+			wantFilter: true,
+		},
+		{
+			desc:                 "formatted error body",
+			localReplyJsonFormat: `{"error":{"status":"%RESPONSE_CODE%","message":"%LOCAL_REPLY_BODY%"}}`,
+			wantRoutes: []string{
+				"/echo map[]",
+				"/echo/ map[]",
+				"/endpoints.examples.bookstore.Bookstore/Echo map[]",
+				"/endpoints.examples.bookstore.Bookstore/Echo/ map[]",
+				"/endpoints.examples.bookstore.Bookstore/Ping map[]",
+				"/endpoints.examples.bookstore.Bookstore/Ping/ map[]",
+				"/ping map[]",
+				"/ping/ map[]",
+			},
+			wantFilter:       true,
+			wantFilterConfig: `{"errorBodyFormat":{"error":{"message":"%LOCAL_REPLY_BODY%","status":"%RESPONSE_CODE%"}}}`,
+		},
+		{
+			desc:                     "default error body format with details and grpc status mapping",
+			operationGrpcStatusMap:   "endpoints.examples.bookstore.Bookstore.Ping=NOT_FOUND:410",
+			localReplyIncludeDetails: true,
+			wantRoutes: []string{
+				"/echo map[]",
+				"/echo/ map[]",
+				"/endpoints.examples.bookstore.Bookstore/Echo map[]",
+				"/endpoints.examples.bookstore.Bookstore/Echo/ map[]",
+				"/endpoints.examples.bookstore.Bookstore/Ping map[5:410]",
+				"/endpoints.examples.bookstore.Bookstore/Ping/ map[5:410]",
+				"/ping map[5:410]",
+				"/ping/ map[5:410]",
+			},
+			wantFilter:       true,
+			wantFilterConfig: `{"errorBodyFormat":{"code":"%RESPONSE_CODE%","message":"%LOCAL_REPLY_BODY%"},"includeDetails":true}`,
+		},
+		{
+			desc:                      "error body format with the error info and help of the local replies",
+			localReplyIncludeDetails:  true,
+			localReplyErrorInfoDomain: "bookstore.endpoints.cloud.goog",
+			localReplyHelpUrl:         "https://example.com/errors",
+			wantRoutes: []string{
+				"/echo map[]",
+				"/echo/ map[]",
+				"/endpoints.examples.bookstore.Bookstore/Echo map[]",
+				"/endpoints.examples.bookstore.Bookstore/Echo/ map[]",
+				"/endpoints.examples.bookstore.Bookstore/Ping map[]",
+				"/endpoints.examples.bookstore.Bookstore/Ping/ map[]",
+				"/ping map[]",
+				"/ping/ map[]",
+			},
+			wantFilter:       true,
+			wantFilterConfig: `{"errorBodyFormat":{"code":"%RESPONSE_CODE%","error_info":{"@type":"type.googleapis.com/google.rpc.ErrorInfo","domain":"bookstore.endpoints.cloud.goog","metadata":{"response_code_details":"%RESPONSE_CODE_DETAILS%"},"reason":"BACKEND_ERROR"},"help":{"@type":"type.googleapis.com/google.rpc.Help.Link","description":"Troubleshooting the errors of the API proxy","url":"https://example.com/errors"},"message":"%LOCAL_REPLY_BODY%"},"includeDetails":true}`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:8082"
+			opts.TranscodingGrpcStatusHttpCodes = tc.grpcStatusHttpCodes
+			opts.TranscodingOperationGrpcStatusHttpCodes = tc.operationGrpcStatusMap
+			opts.LocalReplyJsonFormat = tc.localReplyJsonFormat
+			opts.LocalReplyIncludeDetails = tc.localReplyIncludeDetails
+			opts.LocalReplyErrorInfoDomain = tc.localReplyErrorInfoDomain
+			opts.LocalReplyHelpUrl = tc.localReplyHelpUrl
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotRoutes []string
+			for _, route := range routes {
+				perRouteAny, ok := route.GetTypedPerFilterConfig()[util.GrpcStatusMapping]
+				if !ok {
+					continue
+				}
+				perRoute := &gsmpb.PerRouteFilterConfig{}
+				if err := ptypes.UnmarshalAny(perRouteAny, perRoute); err != nil {
+					t.Fatal(err)
+				}
+				gotRoutes = append(gotRoutes, fmt.Sprintf("%s %v", route.GetMatch().GetPath(), perRoute.GetHttpStatusCodes()))
+			}
+			sort.Strings(gotRoutes)
+			if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+				t.Errorf("got grpc status mapping routes: %v, want: %v", gotRoutes, tc.wantRoutes)
+			}
+
+			filters, err := MakeHttpFilters(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotFilter := false
+			for i, filter := range filters {
+				if filter.GetName() != util.GrpcStatusMapping {
+					continue
+				}
+				gotFilter = true
+				// It must be ahead of gRPC Transcoder filter.
+				if i+2 >= len(filters) || filters[i+2].GetName() != util.GRPCJSONTranscoder {
+					t.Errorf("grpc status mapping filter is not ahead of transcoder filter: %v", filters)
+				}
+
+				gotFilterConfig := ""
+				if filter.GetTypedConfig() != nil {
+					filterConfig := &gsmpb.FilterConfig{}
+					if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), filterConfig); err != nil {
+						t.Fatal(err)
+					}
+					gotFilterConfig, err = (&jsonpb.Marshaler{}).MarshalToString(filterConfig)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if gotFilterConfig != tc.wantFilterConfig {
+					t.Errorf("got grpc status mapping filter config: %s, want: %s", gotFilterConfig, tc.wantFilterConfig)
+				}
+			}
+			if gotFilter != tc.wantFilter {
+				t.Errorf("got grpc status mapping filter: %v, want: %v", gotFilter, tc.wantFilter)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForStreamFormat(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+					{
+						Name:              "ListBooks",
+						ResponseStreaming: true,
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.ListBooks",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/books",
+				},
+			},
+		}},
+		SourceInfo: &confpb.SourceInfo{
+			SourceFiles: []*anypb.Any{content},
+		},
+	}
+	testData := []struct {
+		desc          string
+		streamFormats string
+		// The routes with a stream format per-route config, as
+		// "path format timeout".
+		wantRoutes []string
+		wantFilter bool
+	}{
+		{
+			desc: "no stream format",
+		},
+		{
+			desc:          "ndjson stream format",
+			streamFormats: "endpoints.examples.bookstore.Bookstore.ListBooks=ndjson",
+			wantRoutes: []string{
+				"/books NDJSON 0s",
+				"/books/ NDJSON 0s",
+				"/endpoints.examples.bookstore.Bookstore/ListBooks NDJSON 0s",
+				"/endpoints.examples.bookstore.Bookstore/ListBooks/ NDJSON 0s",
+			},
+			wantFilter: true,
+		},
+		{
+			desc:          "sse stream format",
+			streamFormats: "endpoints.examples.bookstore.Bookstore.ListBooks=sse",
+			wantRoutes: []string{
+				"/books SSE 0s",
+				"/books/ SSE 0s",
+				"/endpoints.examples.bookstore.Bookstore/ListBooks SSE 0s",
+				"/endpoints.examples.bookstore.Bookstore/ListBooks/ SSE 0s",
+			},
+			wantFilter: true,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:8082"
+			opts.TranscodingStreamFormats = tc.streamFormats
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotRoutes []string
+			for _, route := range routes {
+				perRouteAny, ok := route.GetTypedPerFilterConfig()[util.StreamFormat]
+				if !ok {
+					continue
+				}
+				perRoute := &sfpb.PerRouteFilterConfig{}
+				if err := ptypes.UnmarshalAny(perRouteAny, perRoute); err != nil {
+					t.Fatal(err)
+				}
+				// The streams are not cut by the route timeout.
+				timeout, err := ptypes.Duration(route.GetRoute().GetTimeout())
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotRoutes = append(gotRoutes, fmt.Sprintf("%s %v %v", route.GetMatch().GetPath(), perRoute.GetFormat(), timeout))
+			}
+			sort.Strings(gotRoutes)
+			if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+				t.Errorf("got stream format routes: %v, want: %v", gotRoutes, tc.wantRoutes)
+			}
+
+			filters, err := MakeHttpFilters(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotFilter := false
+			for i, filter := range filters {
+				if filter.GetName() != util.StreamFormat {
+					continue
+				}
+				gotFilter = true
+				// It must be ahead of gRPC Transcoder filter.
+				if i+2 >= len(filters) || filters[i+2].GetName() != util.GRPCJSONTranscoder {
+					t.Errorf("stream format filter is not ahead of transcoder filter: %v", filters)
+				}
+			}
+			if gotFilter != tc.wantFilter {
+				t.Errorf("got stream format filter: %v, want: %v", gotFilter, tc.wantFilter)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForQueryArrayStyle(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListBooks",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.ListBooks",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/books",
+				},
+			},
+		}},
+		SourceInfo: &confpb.SourceInfo{
+			SourceFiles: []*anypb.Any{content},
+		},
+	}
+	testData := []struct {
+		desc            string
+		backendAddress  string
+		queryArrayStyle string
+		// The paths of the routes with a query rewrite per-route config.
+		wantRoutes []string
+		wantFilter bool
+	}{
+		{
+			desc:            "repeat style",
+			backendAddress:  "grpc://127.0.0.1:8082",
+			queryArrayStyle: util.QueryArrayStyleRepeat,
+		},
+		{
+			desc:            "brackets style",
+			backendAddress:  "grpc://127.0.0.1:8082",
+			queryArrayStyle: util.QueryArrayStyleBrackets,
+			wantRoutes: []string{
+				"/books",
+				"/books/",
+				"/endpoints.examples.bookstore.Bookstore/ListBooks",
+				"/endpoints.examples.bookstore.Bookstore/ListBooks/",
+			},
+			wantFilter: true,
+		},
+		{
+			desc:            "brackets style without transcoding",
+			backendAddress:  "http://127.0.0.1:8082",
+			queryArrayStyle: util.QueryArrayStyleBrackets,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = tc.backendAddress
+			opts.TranscodingQueryArrayStyle = tc.queryArrayStyle
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotRoutes []string
+			for _, route := range routes {
+				if _, ok := route.GetTypedPerFilterConfig()[util.QueryRewrite]; ok {
+					gotRoutes = append(gotRoutes, route.GetMatch().GetPath())
+				}
+			}
+			sort.Strings(gotRoutes)
+			if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+				t.Errorf("got query rewrite routes: %v, want: %v", gotRoutes, tc.wantRoutes)
+			}
+
+			filters, err := MakeHttpFilters(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotFilter := false
+			for i, filter := range filters {
+				if filter.GetName() != util.QueryRewrite {
+					continue
+				}
+				gotFilter = true
+				// It must be ahead of gRPC Transcoder filter.
+				if i+1 >= len(filters) || filters[i+1].GetName() != util.GRPCJSONTranscoder {
+					t.Errorf("query rewrite filter is not ahead of transcoder filter: %v", filters)
+				}
+			}
+			if gotFilter != tc.wantFilter {
+				t.Errorf("got query rewrite filter: %v, want: %v", gotFilter, tc.wantFilter)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForPathRewriteOptions(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Foo",
+					},
+					{
+						Name: "Bar",
+					},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector:        "endpoints.examples.bookstore.Bookstore.Foo",
+					Address:         "https://testapipb.com/foo",
+					PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+				},
+				{
+					Selector:        "endpoints.examples.bookstore.Bookstore.Bar",
+					Address:         "https://testapipb.com/bar",
+					PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Foo",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/foo/{id}",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Bar",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/bar",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                          string
+		pathRewriteQueryParams        string
+		pathRewriteOriginalPathHeader string
+		wantConfigs                   map[string]*prpb.PerRouteFilterConfig
+	}{
+		{
+			desc: "query params preserved by default",
+			wantConfigs: map[string]*prpb.PerRouteFilterConfig{
+				"endpoints.examples.bookstore.Bookstore.Foo": {
+					PathTranslationSpecifier: &prpb.PerRouteFilterConfig_ConstantPath{
+						ConstantPath: &prpb.ConstantPath{
+							Path:        "/foo",
+							UrlTemplate: "/foo/{id=*}",
+						},
+					},
+				},
+				"endpoints.examples.bookstore.Bookstore.Bar": {
+					PathTranslationSpecifier: &prpb.PerRouteFilterConfig_PathPrefix{
+						PathPrefix: "/bar",
+					},
+				},
+			},
+		},
+		{
+			desc:                          "query params merged and original path header for constant address only",
+			pathRewriteQueryParams:        "merge",
+			pathRewriteOriginalPathHeader: "x-original-path",
+			wantConfigs: map[string]*prpb.PerRouteFilterConfig{
+				"endpoints.examples.bookstore.Bookstore.Foo": {
+					PathTranslationSpecifier: &prpb.PerRouteFilterConfig_ConstantPath{
+						ConstantPath: &prpb.ConstantPath{
+							Path:               "/foo",
+							UrlTemplate:        "/foo/{id=*}",
+							QueryParams:        prpb.ConstantPath_MERGE,
+							OriginalPathHeader: "x-original-path",
+						},
+					},
+				},
+				"endpoints.examples.bookstore.Bookstore.Bar": {
+					PathTranslationSpecifier: &prpb.PerRouteFilterConfig_PathPrefix{
+						PathPrefix: "/bar",
+					},
+				},
+			},
+		},
+		{
+			desc:                   "query params dropped",
+			pathRewriteQueryParams: "drop",
+			wantConfigs: map[string]*prpb.PerRouteFilterConfig{
+				"endpoints.examples.bookstore.Bookstore.Foo": {
+					PathTranslationSpecifier: &prpb.PerRouteFilterConfig_ConstantPath{
+						ConstantPath: &prpb.ConstantPath{
+							Path:        "/foo",
+							UrlTemplate: "/foo/{id=*}",
+							QueryParams: prpb.ConstantPath_DROP,
+						},
+					},
+				},
+				"endpoints.examples.bookstore.Bookstore.Bar": {
+					PathTranslationSpecifier: &prpb.PerRouteFilterConfig_PathPrefix{
+						PathPrefix: "/bar",
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			if tc.pathRewriteQueryParams != "" {
+				opts.PathRewriteQueryParams = tc.pathRewriteQueryParams
+			}
+			opts.PathRewriteOriginalPathHeader = tc.pathRewriteOriginalPathHeader
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for selector, want := range tc.wantConfigs {
+				method := fakeServiceInfo.Methods[selector]
+				got := MakePathRewriteConfig(method, method.HttpRule[0])
+				if !proto.Equal(got, want) {
+					t.Errorf("selector %s: got path rewrite config: %v, want: %v", selector, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForOriginalRequestHeaders(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Foo",
+					},
+					{
+						Name: "Bar",
+					},
+					{
+						Name: "Baz",
+					},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector:        "endpoints.examples.bookstore.Bookstore.Foo",
+					Address:         "https://testapipb.com/foo",
+					PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+				},
+				{
+					Selector:        "endpoints.examples.bookstore.Bookstore.Bar",
+					Address:         "https://testapipb.com",
+					PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Foo",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/foo",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Bar",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/bar",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Baz",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/baz",
+				},
+			},
+		}},
+	}
+	methodHeaders := []string{
+		"x-envoy-original-method: %REQ(:METHOD)%",
+		`x-envoy-original-method: %DYNAMIC_METADATA(["com.google.espv2.filters.http.service_control", "original_method"])%`,
+	}
+	testData := []struct {
+		desc                  string
+		forwardOriginalPath   bool
+		forwardOriginalHost   bool
+		forwardOriginalMethod bool
+		wantHeaders           map[string][]string
+	}{
+		{
+			desc:        "no original request headers by default",
+			wantHeaders: map[string][]string{},
+		},
+		{
+			desc:                  "original request headers for remote backends",
+			forwardOriginalPath:   true,
+			forwardOriginalHost:   true,
+			forwardOriginalMethod: true,
+			wantHeaders: map[string][]string{
+				// Path Rewrite filter sets the original path of Foo.
+				"ingress Foo": append([]string{
+					"x-forwarded-host: %REQ(:AUTHORITY)%",
+				}, methodHeaders...),
+				"ingress Bar": append([]string{
+					"x-envoy-original-path: %REQ(:PATH)%",
+					"x-forwarded-host: %REQ(:AUTHORITY)%",
+				}, methodHeaders...),
+			},
+		},
+		{
+			desc:                "original path only",
+			forwardOriginalPath: true,
+			wantHeaders: map[string][]string{
+				"ingress Bar": {
+					"x-envoy-original-path: %REQ(:PATH)%",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ForwardOriginalPath = tc.forwardOriginalPath
+			opts.ForwardOriginalHost = tc.forwardOriginalHost
+			opts.ForwardOriginalMethod = tc.forwardOriginalMethod
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotHeaders := make(map[string][]string)
+			for _, route := range routes {
+				for _, header := range route.RequestHeadersToAdd {
+					if header.GetAppend().GetValue() {
+						t.Errorf("route %v: header %s should not be appended", route.GetDecorator().GetOperation(), header.GetHeader().GetKey())
+					}
+				}
+				if len(route.RequestHeadersToAdd) == 0 {
+					continue
+				}
+				var headers []string
+				for _, header := range route.RequestHeadersToAdd {
+					headers = append(headers, fmt.Sprintf("%s: %s", header.GetHeader().GetKey(), header.GetHeader().GetValue()))
+				}
+				gotHeaders[route.GetDecorator().GetOperation()] = headers
+			}
+			if !reflect.DeepEqual(gotHeaders, tc.wantHeaders) {
+				t.Errorf("got original request headers: %v, want: %v", gotHeaders, tc.wantHeaders)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForLocalBackendHostRewrite(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Foo",
+					},
+					{
+						Name: "Bar",
+					},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector:        "endpoints.examples.bookstore.Bookstore.Bar",
+					Address:         "https://testapipb.com",
+					PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Foo",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/foo",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Bar",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/bar",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                string
+		hostRewrite         string
+		hostRewriteLiteral  string
+		forwardOriginalHost bool
+		wantHosts           map[string]string
+		wantForwardedHost   map[string]bool
+	}{
+		{
+			desc: "Host of the local backend is preserved by default",
+			wantHosts: map[string]string{
+				"ingress Bar": "testapipb.com",
+			},
+		},
+		{
+			desc:        "Host of the local backend address",
+			hostRewrite: "backend_address",
+			wantHosts: map[string]string{
+				"ingress Foo": "127.0.0.1:8082",
+				"ingress Bar": "testapipb.com",
+			},
+		},
+		{
+			desc:                "Literal host of the local backend with the original host forwarded",
+			hostRewrite:         "literal",
+			hostRewriteLiteral:  "api.example.com",
+			forwardOriginalHost: true,
+			wantHosts: map[string]string{
+				"ingress Foo": "api.example.com",
+				"ingress Bar": "testapipb.com",
+			},
+			wantForwardedHost: map[string]bool{
+				"ingress Foo": true,
+				"ingress Bar": true,
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "http://127.0.0.1:8082"
+			if tc.hostRewrite != "" {
+				opts.BackendHostRewrite = tc.hostRewrite
+			}
+			opts.BackendHostRewriteLiteral = tc.hostRewriteLiteral
+			opts.ForwardOriginalHost = tc.forwardOriginalHost
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotHosts := make(map[string]string)
+			gotForwardedHost := make(map[string]bool)
+			for _, route := range routes {
+				operation := route.GetDecorator().GetOperation()
+				if host := route.GetRoute().GetHostRewriteLiteral(); host != "" {
+					gotHosts[operation] = host
+				}
+				for _, header := range route.RequestHeadersToAdd {
+					if header.GetHeader().GetKey() == "x-forwarded-host" {
+						gotForwardedHost[operation] = true
+					}
+				}
+			}
+			if tc.wantForwardedHost == nil {
+				tc.wantForwardedHost = map[string]bool{}
+			}
+			if !reflect.DeepEqual(gotHosts, tc.wantHosts) {
+				t.Errorf("got host rewrites: %v, want: %v", gotHosts, tc.wantHosts)
+			}
+			if !reflect.DeepEqual(gotForwardedHost, tc.wantForwardedHost) {
+				t.Errorf("got forwarded hosts: %v, want: %v", gotForwardedHost, tc.wantForwardedHost)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForApiVersionHeader(t *testing.T) {
+	makeServiceConfig := func(v2Version string) *confpb.Service {
+		return &confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name:    "endpoints.examples.bookstore.v1.Bookstore",
+					Version: "v1",
+					Methods: []*apipb.Method{
+						{
+							Name: "GetShelf",
+						},
+					},
+				},
+				{
+					Name:    "endpoints.examples.bookstore.v2.Bookstore",
+					Version: v2Version,
+					Methods: []*apipb.Method{
+						{
+							Name: "GetShelf",
+						},
+					},
+				},
+			},
+			Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.v1.Bookstore.GetShelf",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves/{shelf}",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.v2.Bookstore.GetShelf",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves/{id}",
+					},
+				},
+			}},
+		}
+	}
+
+	testData := []struct {
+		desc             string
+		v2Version        string
+		apiVersionHeader string
+		backendAddress   string
+		// The operation routed to by the request headers.
+		wantOperations map[string]string
+		wantError      string
+	}{
+		{
+			desc:             "routed by the api version header",
+			v2Version:        "v2",
+			apiVersionHeader: "Accept-Version",
+			wantOperations: map[string]string{
+				"accept-version: v1": "endpoints.examples.bookstore.v1.Bookstore.GetShelf",
+				"accept-version: v2": "endpoints.examples.bookstore.v2.Bookstore.GetShelf",
+				"accept-version: v3": "endpoints.examples.bookstore.v1.Bookstore.GetShelf",
+				"":                   "endpoints.examples.bookstore.v1.Bookstore.GetShelf",
+			},
+		},
+		{
+			desc:      "duplicate http patterns without the api version header",
+			v2Version: "v2",
+			wantError: "http pattern `GET /shelves/{id}` of selector endpoints.examples.bookstore.v2.Bookstore.GetShelf duplicates",
+		},
+		{
+			desc:             "duplicate http patterns of the same api version",
+			v2Version:        "v1",
+			apiVersionHeader: "Accept-Version",
+			wantError:        "http pattern `GET /shelves/{id}` of selector endpoints.examples.bookstore.v2.Bookstore.GetShelf duplicates",
+		},
+		{
+			desc:             "api versions of a gRPC backend",
+			v2Version:        "v2",
+			apiVersionHeader: "Accept-Version",
+			backendAddress:   "grpc://127.0.0.1:8082",
+			wantError:        "--api_version_header is not supported for the gRPC method endpoints.examples.bookstore.v1.Bookstore.GetShelf",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ApiVersionHeader = tc.apiVersionHeader
+			if tc.backendAddress != "" {
+				opts.BackendAddress = tc.backendAddress
+			}
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(makeServiceConfig(tc.v2Version), testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = makeRouteTable(fakeServiceInfo)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for header, wantOperation := range tc.wantOperations {
+				headers := make(map[string]string)
+				if kv := strings.SplitN(header, ": ", 2); len(kv) == 2 {
+					headers[kv[0]] = kv[1]
+				}
+				explanation, err := ExplainRoute(fakeServiceInfo, "GET", "/shelves/123", headers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if explanation == nil {
+					t.Fatalf("no route for headers %q", header)
+				}
+				if explanation.Operation != wantOperation {
+					t.Errorf("headers %q got operation: %s, want: %s", header, explanation.Operation, wantOperation)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForQueryParamMatchers(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "GetBookContent",
+					},
+					{
+						Name: "GetBook",
+					},
+					{
+						Name: "ExportBook",
+					},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.GetBookContent",
+					Address:  "https://media.example.com",
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.GetBookContent",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/books/{name}",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.GetBook",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/books/{id}",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.ExportBook",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/books/{id}",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc               string
+		queryParamMatchers string
+		backendAddress     string
+		// The operation routed to by the request path.
+		wantOperations map[string]string
+		wantError      string
+	}{
+		{
+			desc:               "routed by the query params",
+			queryParamMatchers: "endpoints.examples.bookstore.Bookstore.GetBookContent=alt:media;endpoints.examples.bookstore.Bookstore.ExportBook=export",
+			wantOperations: map[string]string{
+				"/books/123?alt=media":         "endpoints.examples.bookstore.Bookstore.GetBookContent",
+				"/books/123?export&alt=media":  "endpoints.examples.bookstore.Bookstore.GetBookContent",
+				"/books/123?alt=json&export=1": "endpoints.examples.bookstore.Bookstore.ExportBook",
+				"/books/123?alt=json":          "endpoints.examples.bookstore.Bookstore.GetBook",
+				"/books/123":                   "endpoints.examples.bookstore.Bookstore.GetBook",
+			},
+		},
+		{
+			desc:      "duplicate http patterns without query params",
+			wantError: "http pattern `GET /books/{id}` of selector endpoints.examples.bookstore.Bookstore.GetBook duplicates",
+		},
+		{
+			desc:               "duplicate http patterns without query params of the other operations",
+			queryParamMatchers: "endpoints.examples.bookstore.Bookstore.GetBookContent=alt:media",
+			wantError:          "http pattern `GET /books/{id}` of selector endpoints.examples.bookstore.Bookstore.ExportBook duplicates",
+		},
+		{
+			desc:               "query params of a gRPC backend",
+			queryParamMatchers: "endpoints.examples.bookstore.Bookstore.GetBookContent=alt:media;endpoints.examples.bookstore.Bookstore.ExportBook=export",
+			backendAddress:     "grpc://127.0.0.1:8082",
+			wantError:          "--query_param_matchers is not supported for the gRPC method endpoints.examples.bookstore.Bookstore.GetBook",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.QueryParamMatchers = tc.queryParamMatchers
+			if tc.backendAddress != "" {
+				opts.BackendAddress = tc.backendAddress
+			}
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = makeRouteTable(fakeServiceInfo)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for path, wantOperation := range tc.wantOperations {
+				explanation, err := ExplainRoute(fakeServiceInfo, "GET", path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if explanation == nil {
+					t.Fatalf("no route for path %s", path)
+				}
+				if explanation.Operation != wantOperation {
+					t.Errorf("path %s got operation: %s, want: %s", path, explanation.Operation, wantOperation)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForPrefixMatch(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Download",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Download",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/v1/files/**",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                 string
+		forceRegexRouteMatch bool
+		wantMatch            string
+	}{
+		{
+			desc:      "prefix match for a trailing wildcard",
+			wantMatch: `{"prefix":"/v1/files/","headers":[{"name":":method","exactMatch":"GET"}]}`,
+		},
+		{
+			desc:                 "regex match forced",
+			forceRegexRouteMatch: true,
+			wantMatch:            `{"safeRegex":{"googleRe2":{},"regex":"^/v1/files/.*\\/?$"},"headers":[{"name":":method","exactMatch":"GET"}]}`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ForceRegexRouteMatch = tc.forceRegexRouteMatch
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotMatch, err := util.ProtoToJson(routes[0].GetMatch())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(tc.wantMatch, gotMatch); err != nil {
+				t.Errorf("route match mismatch: %v", err)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForTracingSampleRates(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Health",
+					},
+					{
+						Name: "Pay",
+					},
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Health",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/health",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Pay",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/pay",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                        string
+		disableTracing              bool
+		tracingOperationSampleRates string
+		wantTracing                 map[string]*routepb.Tracing
+	}{
+		{
+			desc:        "route tracing not set by default",
+			wantTracing: map[string]*routepb.Tracing{},
+		},
+		{
+			desc:                        "route tracing set for the overridden operations",
+			tracingOperationSampleRates: "endpoints.examples.bookstore.Bookstore.Health=0,endpoints.examples.bookstore.Bookstore.Pay=1.0",
+			wantTracing: map[string]*routepb.Tracing{
+				"ingress Health": {
+					ClientSampling:  &typepb.FractionalPercent{},
+					RandomSampling:  &typepb.FractionalPercent{Denominator: typepb.FractionalPercent_MILLION},
+					OverallSampling: &typepb.FractionalPercent{Denominator: typepb.FractionalPercent_MILLION},
+				},
+				"ingress Pay": {
+					ClientSampling:  &typepb.FractionalPercent{},
+					RandomSampling:  &typepb.FractionalPercent{Numerator: 1000000, Denominator: typepb.FractionalPercent_MILLION},
+					OverallSampling: &typepb.FractionalPercent{Numerator: 1000000, Denominator: typepb.FractionalPercent_MILLION},
+				},
+			},
+		},
+		{
+			desc:                        "route tracing not set when tracing is disabled",
+			disableTracing:              true,
+			tracingOperationSampleRates: "endpoints.examples.bookstore.Bookstore.Pay=1.0",
+			wantTracing:                 map[string]*routepb.Tracing{},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.DisableTracing = tc.disableTracing
+			opts.TracingOperationSampleRates = tc.tracingOperationSampleRates
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotTracing := make(map[string]*routepb.Tracing)
+			for _, route := range routes {
+				if route.Tracing != nil {
+					gotTracing[route.GetDecorator().GetOperation()] = route.Tracing
+				}
+			}
+			if len(gotTracing) != len(tc.wantTracing) {
+				t.Fatalf("got route tracing: %v, want: %v", gotTracing, tc.wantTracing)
+			}
+			for operation, want := range tc.wantTracing {
+				if !proto.Equal(gotTracing[operation], want) {
+					t.Errorf("operation %s: got route tracing: %v, want: %v", operation, gotTracing[operation], want)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableForTracingSpanNames(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                     string
+		tracingSpanNamePrefix    string
+		tracingSpanNameFormat    string
+		tracingDisableDecorators bool
+		// The span names of the routes, keyed by path.
+		wantSpanNames map[string]string
+	}{
+		{
+			desc: "span names of the operations by default",
+			wantSpanNames: map[string]string{
+				"/echo":  "ingress Echo",
+				"/echo/": "ingress Echo",
+			},
+		},
+		{
+			desc:                  "span names with api name, http method and custom prefix",
+			tracingSpanNamePrefix: "bookstore",
+			tracingSpanNameFormat: "{PREFIX} {HTTP_METHOD} {API}.{METHOD}",
+			wantSpanNames: map[string]string{
+				"/echo":  "bookstore POST endpoints.examples.bookstore.Bookstore.Echo",
+				"/echo/": "bookstore POST endpoints.examples.bookstore.Bookstore.Echo",
+			},
+		},
+		{
+			desc:                     "no span names when the decorators are disabled",
+			tracingDisableDecorators: true,
+			wantSpanNames:            map[string]string{},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			if tc.tracingSpanNamePrefix != "" {
+				opts.TracingSpanNamePrefix = tc.tracingSpanNamePrefix
+			}
+			if tc.tracingSpanNameFormat != "" {
+				opts.TracingSpanNameFormat = tc.tracingSpanNameFormat
+			}
+			opts.TracingDisableDecorators = tc.tracingDisableDecorators
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotSpanNames := make(map[string]string)
+			for _, route := range routes {
+				if route.GetDecorator() != nil {
+					gotSpanNames[route.GetMatch().GetPath()] = route.GetDecorator().GetOperation()
+				}
+			}
+			if !reflect.DeepEqual(gotSpanNames, tc.wantSpanNames) {
+				t.Errorf("got span names: %v, want: %v", gotSpanNames, tc.wantSpanNames)
+			}
+		})
+	}
+}
+
+func TestMakeRouteConfigForRequestIdHeader(t *testing.T) {
+	correlationIdHeader := &corepb.HeaderValueOption{
+		Header: &corepb.HeaderValue{
+			Key:   "x-correlation-id",
+			Value: "%REQ(x-request-id)%",
+		},
+		Append: &wrapperspb.BoolValue{Value: false},
+	}
+	preservedCorrelationIdHeader := &corepb.HeaderValueOption{
+		Header: &corepb.HeaderValue{
+			Key:   "x-correlation-id",
+			Value: "%REQ(x-correlation-id?x-request-id)%",
+		},
+		Append: &wrapperspb.BoolValue{Value: false},
+	}
+	testData := []struct {
+		desc                         string
+		requestIdHeader              string
+		preserveExternalRequestId    bool
+		alwaysSetRequestIdInResponse bool
+		wantRequestHeaders           []*corepb.HeaderValueOption
+		wantResponseHeaders          []*corepb.HeaderValueOption
+		wantError                    string
+	}{
+		{
+			desc: "no header added by default",
+		},
+		{
+			desc:            "no header added for x-request-id",
+			requestIdHeader: "X-Request-Id",
+		},
+		{
+			desc:               "request id copied to the backend request",
+			requestIdHeader:    "X-Correlation-Id",
+			wantRequestHeaders: []*corepb.HeaderValueOption{correlationIdHeader},
+		},
+		{
+			desc:                         "request id copied to the backend request and the response",
+			requestIdHeader:              "x-correlation-id",
+			alwaysSetRequestIdInResponse: true,
+			wantRequestHeaders:           []*corepb.HeaderValueOption{correlationIdHeader},
+			wantResponseHeaders:          []*corepb.HeaderValueOption{correlationIdHeader},
+		},
+		{
+			desc:                         "request id header of the client preserved",
+			requestIdHeader:              "x-correlation-id",
+			preserveExternalRequestId:    true,
+			alwaysSetRequestIdInResponse: true,
+			wantRequestHeaders:           []*corepb.HeaderValueOption{preservedCorrelationIdHeader},
+			wantResponseHeaders:          []*corepb.HeaderValueOption{preservedCorrelationIdHeader},
+		},
+		{
+			desc:            "invalid request id header",
+			requestIdHeader: ":path",
+			wantError:       `invalid request id header ":path"`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.RequestIdHeader = tc.requestIdHeader
+			opts.PreserveExternalRequestId = tc.preserveExternalRequestId
+			opts.AlwaysSetRequestIdInResponse = tc.alwaysSetRequestIdInResponse
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			}, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+			if err != nil {
+				if err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want error: %v", err, tc.wantError)
+				}
+				return
+			}
+			if tc.wantError != "" {
+				t.Fatalf("got no error, want error: %v", tc.wantError)
+			}
+
+			want := &routepb.RouteConfiguration{
+				RequestHeadersToAdd:  tc.wantRequestHeaders,
+				ResponseHeadersToAdd: tc.wantResponseHeaders,
+			}
+			got := &routepb.RouteConfiguration{
+				RequestHeadersToAdd:  gotRoute.RequestHeadersToAdd,
+				ResponseHeadersToAdd: gotRoute.ResponseHeadersToAdd,
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("got headers to add: %v, want: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMakeRoutes(t *testing.T) {
+	testData := []struct {
+		desc           string
+		enableRds      bool
+		wantRouteNames []string
+	}{
+		{
+			desc: "no routes served through RDS by default",
+		},
+		{
+			desc:           "route config served through RDS",
+			enableRds:      true,
+			wantRouteNames: []string{"local_route"},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.EnableRds = tc.enableRds
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		routes, err := MakeRoutes(fakeServiceInfo)
+		if err != nil {
+			t.Fatalf("Test (%s): got error: %v", tc.desc, err)
+		}
+		var gotRouteNames []string
+		for _, route := range routes {
+			gotRouteNames = append(gotRouteNames, route.Name)
+		}
+		if !reflect.DeepEqual(gotRouteNames, tc.wantRouteNames) {
+			t.Errorf("Test (%s): got route names %v, want %v", tc.desc, gotRouteNames, tc.wantRouteNames)
+		}
+	}
+}
+
+func TestMakeRouteConfigForCors(t *testing.T) {
+	testData := []struct {
+		desc string
+		// Test parameters, in the order of "cors_preset", "cors_allow_origin"
+		// "cors_allow_origin_regex", "cors_allow_methods", "cors_allow_headers"
+		// "cors_expose_headers"
+		params           []string
+		allowCredentials bool
+		wantedError      string
+		wantCorsPolicy   *routepb.CorsPolicy
+	}{
+		{
+			desc:           "No Cors",
+			wantCorsPolicy: nil,
+		},
+		{
+			desc:        "Incorrect configured basic Cors",
+			params:      []string{"basic", "", `^https?://.+\\.example\\.com\/?$`, "", "", ""},
+			wantedError: "cors_allow_origin cannot be empty when cors_preset=basic",
+		},
+		{
+			desc:        "Incorrect configured  Cors",
+			params:      []string{"", "", "", "GET", "", ""},
+			wantedError: "cors_preset must be set in order to enable CORS support",
+		},
+		{
+			desc:        "Incorrect configured regex Cors",
+			params:      []string{"cors_with_regexs", "", `^https?://.+\\.example\\.com\/?$`, "", "", ""},
+			wantedError: `cors_preset must be either "basic" or "cors_with_regex"`,
+		},
+		{
+			desc:        "Oversize cors origin regex",
+			params:      []string{"cors_with_regex", "", getOverSizeRegexForTest(), "", "Origin,Content-Type,Accept", ""},
+			wantedError: `invalid cors origin regex: regex program size(1001) is larger than the max expected(1000)`,
+		},
+		{
+			desc:   "Correct configured basic Cors, with allow methods",
+			params: []string{"basic", "http://example.com", "", "GET,POST,PUT,OPTIONS", "", ""},
+			wantCorsPolicy: &routepb.CorsPolicy{
+				AllowOriginStringMatch: []*matcher.StringMatcher{
+					{
+						MatchPattern: &matcher.StringMatcher_Exact{
+							Exact: "http://example.com",
+						},
+					},
+				},
+				AllowMethods:     "GET,POST,PUT,OPTIONS",
+				MaxAge:           "1728000",
+				AllowCredentials: &wrapperspb.BoolValue{Value: false},
+			},
+		},
+		{
+			desc:   "Correct configured basic Cors, with multiple origins and a wildcard",
+			params: []string{"basic", "http://example.com, https://*.example.org", "", "", "", ""},
+			wantCorsPolicy: &routepb.CorsPolicy{
+				AllowOriginStringMatch: []*matcher.StringMatcher{
+					{
+						MatchPattern: &matcher.StringMatcher_Exact{
+							Exact: "http://example.com",
+						},
+					},
+					{
+						MatchPattern: &matcher.StringMatcher_SafeRegex{
+							SafeRegex: &matcher.RegexMatcher{
+								EngineType: &matcher.RegexMatcher_GoogleRe2{
+									GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+								},
+								Regex: `^https://[^/]+\.example\.org$`,
+							},
+						},
+					},
+				},
+				MaxAge:           "1728000",
+				AllowCredentials: &wrapperspb.BoolValue{Value: false},
+			},
+		},
+		{
+			desc:        "Incorrect configured basic Cors, with a wildcard in the middle of the host",
+			params:      []string{"basic", "https://api.*.example.com", "", "", "", ""},
+			wantedError: `invalid cors_allow_origin "https://api.*.example.com": the wildcard must be the first label of the host`,
+		},
+		{
+			desc:        "Incorrect configured basic Cors, with an empty origin",
+			params:      []string{"basic", "http://example.com,", "", "", "", ""},
+			wantedError: `invalid cors_allow_origin "http://example.com,": empty origin`,
+		},
+		{
+			desc:   "Correct configured regex Cors, with allow headers",
+			params: []string{"cors_with_regex", "", `^https?://.+\\.example\\.com\/?$`, "", "Origin,Content-Type,Accept", ""},
+			wantCorsPolicy: &routepb.CorsPolicy{
+				AllowOriginStringMatch: []*matcher.StringMatcher{
+					{
+						MatchPattern: &matcher.StringMatcher_SafeRegex{
+							SafeRegex: &matcher.RegexMatcher{
+								EngineType: &matcher.RegexMatcher_GoogleRe2{
+									GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+								},
+								Regex: `^https?://.+\\.example\\.com\/?$`,
+							},
+						},
+					},
+				},
+				AllowHeaders:     "Origin,Content-Type,Accept",
+				MaxAge:           "1728000",
+				AllowCredentials: &wrapperspb.BoolValue{Value: false},
+			},
+		},
+		{
+			desc:             "Correct configured regex Cors, with expose headers",
+			params:           []string{"cors_with_regex", "", `^https?://.+\\.example\\.com\/?$`, "", "", "Content-Length"},
+			allowCredentials: true,
+			wantCorsPolicy: &routepb.CorsPolicy{
+				AllowOriginStringMatch: []*matcher.StringMatcher{
+					{
+						MatchPattern: &matcher.StringMatcher_SafeRegex{
+							SafeRegex: &matcher.RegexMatcher{
+								EngineType: &matcher.RegexMatcher_GoogleRe2{
+									GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+								},
+								Regex: `^https?://.+\\.example\\.com\/?$`,
+							},
+						},
+					},
+				},
+				ExposeHeaders:    "Content-Length",
+				MaxAge:           "1728000",
+				AllowCredentials: &wrapperspb.BoolValue{Value: true},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		if tc.params != nil {
+			opts.CorsPreset = tc.params[0]
+			opts.CorsAllowOrigin = tc.params[1]
+			opts.CorsAllowOriginRegex = tc.params[2]
+			opts.CorsAllowMethods = tc.params[3]
+			opts.CorsAllowHeaders = tc.params[4]
+			opts.CorsExposeHeaders = tc.params[5]
+		}
+		opts.CorsAllowCredentials = tc.allowCredentials
+
+		gotRoute, err := MakeRouteConfig(&configinfo.ServiceInfo{
+			Name:    "test-api",
+			Options: opts,
+		})
+		if tc.wantedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantedError) {
+				t.Errorf("Test (%s): expected err: %v, got: %v", tc.desc, tc.wantedError, err)
+			}
+			continue
+		}
+
+		gotHost := gotRoute.GetVirtualHosts()
+		if len(gotHost) != 1 {
+			t.Errorf("Test (%v): got expected number of virtual host", tc.desc)
+		}
+		gotCors := gotHost[0].GetCors()
+		if !proto.Equal(gotCors, tc.wantCorsPolicy) {
+			t.Errorf("Test (%v): makeRouteConfig failed, got Cors: %v, want: %v", tc.desc, gotCors, tc.wantCorsPolicy)
+		}
+	}
+}
+
+func TestMakeRouteConfigForCustomHttpMethods(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "testapi",
+				Methods: []*apipb.Method{
+					{
+						Name: "Report",
+					},
+					{
+						Name: "Get",
+					},
+					{
+						Name: "Call",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "testapi.Report",
+				Pattern: &annotationspb.HttpRule_Custom{
+					Custom: &annotationspb.CustomHttpPattern{
+						Kind: "REPORT",
+						Path: "/dav/{name}",
+					},
+				},
+				AdditionalBindings: []*annotationspb.HttpRule{
+					{
+						Pattern: &annotationspb.HttpRule_Custom{
+							Custom: &annotationspb.CustomHttpPattern{
+								Kind: "PROPFIND",
+								Path: "/dav/{name}",
+							},
+						},
+					},
+				},
+			},
+			{
+				Selector: "testapi.Get",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/dav/{name}",
+				},
+			},
+			{
+				Selector: "testapi.Call",
+				Pattern: &annotationspb.HttpRule_Custom{
+					Custom: &annotationspb.CustomHttpPattern{
+						Kind: "*",
+						Path: "/rpc/{method}",
+					},
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc             string
+		corsAllowMethods string
+		wantRoutes       []string
+		wantAllowMethods string
+	}{
+		{
+			desc: "custom http methods without cors_allow_methods",
+			wantRoutes: []string{
+				`GET ^/dav/[^\/]+\/?$ ingress Get`,
+				`OPTIONS ^/dav/[^\/]+\/?$ ingress ESPv2_Autogenerated_CORS_Report`,
+				`PROPFIND ^/dav/[^\/]+\/?$ ingress Report`,
+				`REPORT ^/dav/[^\/]+\/?$ ingress Report`,
+				`OPTIONS ^/rpc/[^\/]+\/?$ ingress ESPv2_Autogenerated_CORS_Call`,
+				`* ^/rpc/[^\/]+\/?$ ingress Call`,
+				`OPTIONS / ingress`,
+			},
+		},
+		{
+			desc:             "custom http methods added to cors_allow_methods",
+			corsAllowMethods: "GET, OPTIONS, REPORT",
+			wantRoutes: []string{
+				`GET ^/dav/[^\/]+\/?$ ingress Get`,
+				`OPTIONS ^/dav/[^\/]+\/?$ ingress ESPv2_Autogenerated_CORS_Report`,
+				`PROPFIND ^/dav/[^\/]+\/?$ ingress Report`,
+				`REPORT ^/dav/[^\/]+\/?$ ingress Report`,
+				`OPTIONS ^/rpc/[^\/]+\/?$ ingress ESPv2_Autogenerated_CORS_Call`,
+				`* ^/rpc/[^\/]+\/?$ ingress Call`,
+				`OPTIONS / ingress`,
+			},
+			wantAllowMethods: "GET, OPTIONS, REPORT, PROPFIND",
+		},
+		{
+			desc:             "all methods allowed by cors_allow_methods",
+			corsAllowMethods: "*",
+			wantRoutes: []string{
+				`GET ^/dav/[^\/]+\/?$ ingress Get`,
+				`OPTIONS ^/dav/[^\/]+\/?$ ingress ESPv2_Autogenerated_CORS_Report`,
+				`PROPFIND ^/dav/[^\/]+\/?$ ingress Report`,
+				`REPORT ^/dav/[^\/]+\/?$ ingress Report`,
+				`OPTIONS ^/rpc/[^\/]+\/?$ ingress ESPv2_Autogenerated_CORS_Call`,
+				`* ^/rpc/[^\/]+\/?$ ingress Call`,
+				`OPTIONS / ingress`,
+			},
+			wantAllowMethods: "*",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			serviceConfig := proto.Clone(fakeServiceConfig).(*confpb.Service)
+			serviceConfig.Endpoints = []*confpb.Endpoint{
+				{
+					Name:      testProjectName,
+					AllowCors: true,
+				},
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.CorsPreset = "basic"
+			opts.CorsAllowOrigin = "*"
+			opts.CorsAllowMethods = tc.corsAllowMethods
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotRouteConfig, err := MakeRouteConfig(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			host := gotRouteConfig.GetVirtualHosts()[0]
+
+			var gotRoutes []string
+			for _, route := range host.GetRoutes() {
+				method := "*"
+				for _, header := range route.GetMatch().GetHeaders() {
+					if header.GetName() == ":method" {
+						method = header.GetExactMatch()
+					}
+				}
+				path := route.GetMatch().GetSafeRegex().GetRegex() + route.GetMatch().GetPrefix()
+				gotRoutes = append(gotRoutes, fmt.Sprintf("%s %s %s", method, path, route.GetDecorator().GetOperation()))
+			}
+			if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+				t.Errorf("got routes:\n%s,\nwant:\n%s", strings.Join(gotRoutes, "\n"), strings.Join(tc.wantRoutes, "\n"))
+			}
+			if got := host.GetCors().GetAllowMethods(); got != tc.wantAllowMethods {
+				t.Errorf("got cors allow methods: %q, want: %q", got, tc.wantAllowMethods)
+			}
+		})
+	}
+}
+
+func TestMakeRouteConfigForVirtualClusters(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name:    "endpoints.examples.bookstore.v1.Bookstore",
+				Version: "v1",
+				Methods: []*apipb.Method{
+					{
+						Name: "GetShelf",
+					},
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+			{
+				Name:    "endpoints.examples.bookstore.v2.Bookstore",
+				Version: "v2",
+				Methods: []*apipb.Method{
+					{
+						Name: "GetShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.v1.Bookstore.GetShelf",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/shelves/{shelf}",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.v1.Bookstore.ListShelves",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/shelves",
+				},
+			},
+			{
+				Selector: "endpoints.examples.bookstore.v2.Bookstore.GetShelf",
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/shelves/{id}",
+				},
+			},
+		}},
+	}
+	testData := []struct {
+		desc                           string
+		enableOperationVirtualClusters bool
+		apiVersionHeader               string
+		wantVirtualClusters            []string
+		// The virtual cluster counting the requests by path and version.
+		wantMatches map[string]string
+	}{
+		{
+			desc:             "no virtual clusters by default",
+			apiVersionHeader: "Accept-Version",
+		},
+		{
+			desc:                           "virtual clusters by operation",
+			enableOperationVirtualClusters: true,
+			apiVersionHeader:               "Accept-Version",
+			wantVirtualClusters: []string{
+				`endpoints_examples_bookstore_v1_Bookstore_ListShelves GET ^/shelves\/?(\?.*)?$`,
+				`endpoints_examples_bookstore_v1_Bookstore_GetShelf GET ^/shelves/[^\/]+\/?(\?.*)?$ accept-version=v1`,
+				`endpoints_examples_bookstore_v2_Bookstore_GetShelf GET ^/shelves/[^\/]+\/?(\?.*)?$ accept-version=v2`,
+				`endpoints_examples_bookstore_v1_Bookstore_GetShelf GET ^/shelves/[^\/]+\/?(\?.*)?$`,
+			},
+			wantMatches: map[string]string{
+				"/shelves":                 "endpoints_examples_bookstore_v1_Bookstore_ListShelves",
+				"/shelves?pageSize=10":     "endpoints_examples_bookstore_v1_Bookstore_ListShelves",
+				"/shelves/123 v2":          "endpoints_examples_bookstore_v2_Bookstore_GetShelf",
+				"/shelves/123?view=full":   "endpoints_examples_bookstore_v1_Bookstore_GetShelf",
+				"/shelves/123/?view=full":  "endpoints_examples_bookstore_v1_Bookstore_GetShelf",
+				"/shelves/123/books":       "",
+				"/shelves/123/books?x=/ab": "",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.EnableOperationVirtualClusters = tc.enableOperationVirtualClusters
+			opts.ApiVersionHeader = tc.apiVersionHeader
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotRouteConfig, err := MakeRouteConfig(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			virtualClusters := gotRouteConfig.GetVirtualHosts()[0].GetVirtualClusters()
+
+			var gotVirtualClusters []string
+			for _, vc := range virtualClusters {
+				got := vc.GetName()
+				for _, header := range vc.GetHeaders() {
+					switch header.GetName() {
+					case ":method":
+						got += " " + header.GetExactMatch()
+					case ":path":
+						got += " " + header.GetSafeRegexMatch().GetRegex()
+					default:
+						got += fmt.Sprintf(" %s=%s", header.GetName(), header.GetExactMatch())
+					}
+				}
+				gotVirtualClusters = append(gotVirtualClusters, got)
+			}
+			if !reflect.DeepEqual(gotVirtualClusters, tc.wantVirtualClusters) {
+				t.Errorf("got virtual clusters:\n%s,\nwant:\n%s", strings.Join(gotVirtualClusters, "\n"), strings.Join(tc.wantVirtualClusters, "\n"))
+			}
+
+			// Envoy counts a request in the first matching virtual cluster.
+			for request, wantMatch := range tc.wantMatches {
+				path, version := request, ""
+				if i := strings.Index(request, " "); i >= 0 {
+					path, version = request[:i], request[i+1:]
+				}
+				var gotMatch string
+				for _, vc := range virtualClusters {
+					matched := true
+					for _, header := range vc.GetHeaders() {
+						switch header.GetName() {
+						case ":method":
+							matched = matched && header.GetExactMatch() == "GET"
+						case ":path":
+							matched = matched && regexp.MustCompile(header.GetSafeRegexMatch().GetRegex()).MatchString(path)
+						default:
+							matched = matched && header.GetExactMatch() == version
+						}
+					}
+					if matched {
+						gotMatch = vc.GetName()
+						break
+					}
+				}
+				if gotMatch != wantMatch {
+					t.Errorf("request %q got virtual cluster: %q, want: %q", request, gotMatch, wantMatch)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeRouteConfigForCorsPreflight(t *testing.T) {
+	testData := []struct {
+		desc                      string
+		corsPreset                string
+		corsAllowOrigin           string
+		corsAllowOriginRegex      string
+		corsAllowHeaders          string
+		corsAllowCredentials      bool
+		corsMaxAge                time.Duration
+		corsAllowPrivateNetwork   bool
+		corsReflectRequestHeaders bool
+		// Whether the OPTIONS requests never reach the local backend.
+		corsPreflightDirectResponse bool
+		allowCors                   bool
+		// The origin header matcher and the response headers of the preflight
+		// route, empty if the Envoy CORS filter answers the preflight requests.
+		wantOriginMatcher   *routepb.HeaderMatcher
+		wantResponseHeaders []string
+		wantMaxAge          string
+		wantError           string
+	}{
+		{
+			desc:            "the Envoy CORS filter answers the preflight requests by default",
+			corsPreset:      "basic",
+			corsAllowOrigin: "http://example.com",
+			corsMaxAge:      480 * time.Hour,
+			wantMaxAge:      "1728000",
+		},
+		{
+			desc:            "no max age",
+			corsPreset:      "basic",
+			corsAllowOrigin: "http://example.com",
+		},
+		{
+			desc:                    "private network access",
+			corsPreset:              "basic",
+			corsAllowOrigin:         "http://example.com",
+			corsAllowCredentials:    true,
+			corsMaxAge:              90 * time.Second,
+			corsAllowPrivateNetwork: true,
+			wantOriginMatcher: &routepb.HeaderMatcher{
+				Name: "origin",
+				HeaderMatchSpecifier: &routepb.HeaderMatcher_ExactMatch{
+					ExactMatch: "http://example.com",
+				},
+			},
+			wantResponseHeaders: []string{
+				"access-control-allow-origin: %REQ(origin)%",
+				"access-control-max-age: 90",
+				"access-control-allow-credentials: true",
+				"access-control-allow-private-network: true",
+			},
+			wantMaxAge: "90",
+		},
+		{
+			desc:                      "reflected request headers for all the origins",
+			corsPreset:                "basic",
+			corsAllowOrigin:           "*",
+			corsReflectRequestHeaders: true,
+			wantOriginMatcher: &routepb.HeaderMatcher{
+				Name: "origin",
+				HeaderMatchSpecifier: &routepb.HeaderMatcher_PresentMatch{
+					PresentMatch: true,
+				},
+			},
+			wantResponseHeaders: []string{
+				"access-control-allow-origin: %REQ(origin)%",
+				"access-control-allow-headers: %REQ(access-control-request-headers)%",
+			},
+		},
+		{
+			desc:                    "private network access with an origin regex",
+			corsPreset:              "cors_with_regex",
+			corsAllowOriginRegex:    `^https?://.+\.example\.com$`,
+			corsAllowHeaders:        "Authorization",
+			corsAllowPrivateNetwork: true,
+			wantOriginMatcher: &routepb.HeaderMatcher{
+				Name: "origin",
+				HeaderMatchSpecifier: &routepb.HeaderMatcher_SafeRegexMatch{
+					SafeRegexMatch: &matcher.RegexMatcher{
+						EngineType: &matcher.RegexMatcher_GoogleRe2{
+							GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+						},
+						Regex: `^https?://.+\.example\.com$`,
+					},
+				},
+			},
+			wantResponseHeaders: []string{
+				"access-control-allow-origin: %REQ(origin)%",
+				"access-control-allow-headers: Authorization",
+				"access-control-allow-private-network: true",
+			},
+		},
+		{
+			desc:                        "preflight direct response",
+			corsPreset:                  "basic",
+			corsAllowOrigin:             "http://example.com",
+			corsPreflightDirectResponse: true,
+			wantOriginMatcher: &routepb.HeaderMatcher{
+				Name: "origin",
+				HeaderMatchSpecifier: &routepb.HeaderMatcher_ExactMatch{
+					ExactMatch: "http://example.com",
+				},
+			},
+			wantResponseHeaders: []string{
+				"access-control-allow-origin: %REQ(origin)%",
+			},
+		},
+		{
+			desc:                        "preflight direct response without cors preset",
+			corsPreflightDirectResponse: true,
+			wantError:                   "cors_preset must be set in order to enable CORS support",
+		},
+		{
+			desc:                      "reflected request headers with allow headers",
+			corsPreset:                "basic",
+			corsAllowOrigin:           "*",
+			corsAllowHeaders:          "Authorization",
+			corsReflectRequestHeaders: true,
+			wantError:                 "cors_allow_headers cannot be set when cors_reflect_request_headers is enabled",
+		},
+		{
+			desc:                    "private network access without cors preset",
+			corsAllowPrivateNetwork: true,
+			wantError:               "cors_preset must be set in order to enable CORS support",
+		},
+		{
+			desc:                      "reflected request headers without cors preset but with allow_cors",
+			corsReflectRequestHeaders: true,
+			allowCors:                 true,
+			wantError:                 "allow_cors of the service config endpoints only forwards the preflight requests to the backend",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.CorsPreset = tc.corsPreset
+			opts.CorsAllowOrigin = tc.corsAllowOrigin
+			opts.CorsAllowOriginRegex = tc.corsAllowOriginRegex
+			opts.CorsAllowHeaders = tc.corsAllowHeaders
+			opts.CorsAllowCredentials = tc.corsAllowCredentials
+			opts.CorsMaxAge = tc.corsMaxAge
+			opts.CorsAllowPrivateNetwork = tc.corsAllowPrivateNetwork
+			opts.CorsReflectRequestHeaders = tc.corsReflectRequestHeaders
+			opts.CorsPreflightDirectResponse = tc.corsPreflightDirectResponse
+
+			gotRoute, err := MakeRouteConfig(&configinfo.ServiceInfo{
+				Name:      "test-api",
+				Options:   opts,
+				AllowCors: tc.allowCors,
+			})
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			host := gotRoute.GetVirtualHosts()[0]
+			if got := host.GetCors().GetMaxAge(); got != tc.wantMaxAge {
+				t.Errorf("got max age: %q, want: %q", got, tc.wantMaxAge)
+			}
+			corsRoute := host.GetRoutes()[len(host.GetRoutes())-1]
+			if got := corsRoute.GetDirectResponse() != nil; got != tc.corsPreflightDirectResponse {
+				t.Errorf("got the OPTIONS requests answered by Envoy: %v, want: %v", got, tc.corsPreflightDirectResponse)
+			}
+
+			preflightRoute := host.GetRoutes()[0]
+			if preflightRoute.GetDirectResponse() == nil {
+				if tc.wantOriginMatcher != nil {
+					t.Fatalf("no preflight route, got first route: %v", preflightRoute)
+				}
+				return
+			}
+			if got := preflightRoute.GetDirectResponse().GetStatus(); got != http.StatusNoContent {
+				t.Errorf("got preflight status: %d", got)
+			}
+			var gotOriginMatcher *routepb.HeaderMatcher
+			for _, header := range preflightRoute.GetMatch().GetHeaders() {
+				if header.GetName() == "origin" {
+					gotOriginMatcher = header
+				}
+			}
+			if !proto.Equal(gotOriginMatcher, tc.wantOriginMatcher) {
+				t.Errorf("got origin matcher: %s, want: %s", gotOriginMatcher, tc.wantOriginMatcher)
+			}
+			var gotResponseHeaders []string
+			for _, header := range preflightRoute.GetResponseHeadersToAdd() {
+				gotResponseHeaders = append(gotResponseHeaders, header.GetHeader().GetKey()+": "+header.GetHeader().GetValue())
+			}
+			if !reflect.DeepEqual(gotResponseHeaders, tc.wantResponseHeaders) {
+				t.Errorf("got response headers: %v, want: %v", gotResponseHeaders, tc.wantResponseHeaders)
+			}
+		})
+	}
+}
+
+// Used to generate a oversize cors origin regex or a oversize wildcard uri template.
+func getOverSizeRegexForTest() string {
+	overSizeRegex := ""
+	for i := 0; i < 333; i += 1 {
+		// Use "/**" as it is a replacement token for wildcard uri template.
+		overSizeRegex += "/**"
+	}
+	return overSizeRegex
+}
+
+func TestMakeRouteTableForDisabledFilters(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+				Pattern: &annotationspb.HttpRule_Post{
+					Post: "/echo",
+				},
+			},
+		}},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer-0",
+					JwksUri: "https://fake-jwks.com",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "auth_provider",
+						},
+					},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector:        "endpoints.examples.bookstore.Bookstore.Echo",
+					Address:         "https://mybackend.com/api",
+					PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+					Authentication: &confpb.BackendRule_JwtAudience{
+						JwtAudience: "bar.com",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                   string
+		disabledFilters        string
+		wantPerFilterConfigs   []string
+		wantJwtAuthnDisabled   bool
+		wantSkipServiceControl bool
+	}{
+		{
+			desc:                 "no disabled filters",
+			wantPerFilterConfigs: []string{util.BackendAuth, util.PathRewrite, util.ServiceControl, util.JwtAuthn},
+		},
+		{
+			desc:                 "backend auth and path rewrite disabled",
+			disabledFilters:      "endpoints.examples.bookstore.Bookstore.Echo=" + util.BackendAuth + "," + util.PathRewrite,
+			wantPerFilterConfigs: []string{util.ServiceControl, util.JwtAuthn},
+		},
+		{
+			desc:                 "jwt authn and rbac disabled",
+			disabledFilters:      "endpoints.examples.bookstore.Bookstore.Echo=" + util.JwtAuthn + "," + util.RBAC,
+			wantPerFilterConfigs: []string{util.BackendAuth, util.PathRewrite, util.ServiceControl, util.JwtAuthn, util.RBAC},
+			wantJwtAuthnDisabled: true,
+		},
+		{
+			desc:                   "service control disabled",
+			disabledFilters:        "endpoints.examples.bookstore.Bookstore.Echo=" + util.ServiceControl,
+			wantPerFilterConfigs:   []string{util.BackendAuth, util.PathRewrite, util.ServiceControl, util.JwtAuthn},
+			wantSkipServiceControl: true,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.DisabledFilters = tc.disabledFilters
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := makeRouteTable(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			perFilterConfig := routes[0].GetTypedPerFilterConfig()
+			for _, filter := range tc.wantPerFilterConfigs {
+				if _, ok := perFilterConfig[filter]; !ok {
+					t.Errorf("want the per-route config of filter %s, get %v", filter, perFilterConfig)
+				}
+			}
+			if len(perFilterConfig) != len(tc.wantPerFilterConfigs) {
+				t.Errorf("want the per-route configs of filters %v, get %v", tc.wantPerFilterConfigs, perFilterConfig)
+			}
+
+			jwtPerRoute := &jwtpb.PerRouteConfig{}
+			if err := ptypes.UnmarshalAny(perFilterConfig[util.JwtAuthn], jwtPerRoute); err != nil {
+				t.Fatal(err)
+			}
+			if jwtPerRoute.GetDisabled() != tc.wantJwtAuthnDisabled {
+				t.Errorf("want jwt_authn disabled: %v, get per-route config %v", tc.wantJwtAuthnDisabled, jwtPerRoute)
+			}
+			if got := fakeServiceInfo.Methods["endpoints.examples.bookstore.Bookstore.Echo"].SkipServiceControl; got != tc.wantSkipServiceControl {
+				t.Errorf("want SkipServiceControl: %v, get %v", tc.wantSkipServiceControl, got)
+			}
+		})
+	}
+}
+
+func TestMakeSpanName(t *testing.T) {
+	method := &configinfo.MethodInfo{
+		ApiName:   "echo.v1.Echo",
+		ShortName: "Echo",
+	}
+	testData := []struct {
+		desc     string
+		format   string
+		wantName string
+	}{
+		{
+			desc:     "default format",
+			format:   options.DefaultTracingSpanNameFormat,
+			wantName: "ingress Echo",
+		},
+		{
+			desc:     "all the placeholders",
+			format:   "{PREFIX}/{API}.{METHOD} {HTTP_METHOD}",
+			wantName: "ingress/echo.v1.Echo.Echo GET",
+		},
+		{
+			desc:     "unknown placeholders and braces are kept",
+			format:   "{ {UNKNOWN} {METHOD}{",
+			wantName: "{ {UNKNOWN} Echo{",
+		},
+		{
+			desc:     "no placeholders",
+			format:   "operation",
+			wantName: "operation",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.TracingSpanNamePrefix = "ingress"
+		opts.TracingSpanNameFormat = tc.format
+		if got := makeSpanName(opts, method, "GET"); got != tc.wantName {
+			t.Errorf("Test (%s): want span name %q, get %q", tc.desc, tc.wantName, got)
+		}
+	}
 }
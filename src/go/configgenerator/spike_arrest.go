@@ -0,0 +1,116 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	lrlpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+)
+
+const (
+	spikeArrestStatPrefix = "spike_arrest"
+	// Envoy refuses the token buckets refilled more often.
+	minSpikeArrestFillInterval = 50 * time.Millisecond
+)
+
+// makeSpikeArrestFilter adds Envoy local rate limit filter if
+// --spike_arrest_rps is set. The filter itself has no token bucket, it only
+// limits the virtual host with the spike arrest config.
+func makeSpikeArrestFilter(serviceInfo *configinfo.ServiceInfo) *hcmpb.HttpFilter {
+	if serviceInfo.Options.SpikeArrestRps <= 0 {
+		return nil
+	}
+
+	filterConfigAny, _ := ptypes.MarshalAny(&lrlpb.LocalRateLimit{
+		StatPrefix: spikeArrestStatPrefix,
+	})
+	return &hcmpb.HttpFilter{
+		Name: util.EnvoyLocalRateLimit,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{
+			TypedConfig: filterConfigAny,
+		},
+	}
+}
+
+// makeSpikeArrestConfig makes the per-virtual host local rate limit config
+// allowing at most --spike_arrest_rps requests per rolling second, shared by
+// all the routes of the virtual host.
+//
+// The tokens are refilled as often as Envoy allows, so the requests are spread
+// over the second instead of all passing at its start. The bucket holds up to
+// --spike_arrest_burst tokens, for the short bursts.
+func makeSpikeArrestConfig(opts options.ConfigGeneratorOptions) (*anypb.Any, error) {
+	if opts.SpikeArrestRps < 0 {
+		return nil, fmt.Errorf("invalid --spike_arrest_rps %d, must not be negative", opts.SpikeArrestRps)
+	}
+	if opts.SpikeArrestBurst < 0 {
+		return nil, fmt.Errorf("invalid --spike_arrest_burst %d, must not be negative", opts.SpikeArrestBurst)
+	}
+	if opts.SpikeArrestRps == 0 {
+		return nil, nil
+	}
+
+	// Refill the fewest tokens at a time, at the fill interval they last.
+	rps := int64(opts.SpikeArrestRps)
+	tokensPerFill := (rps*int64(minSpikeArrestFillInterval) + int64(time.Second) - 1) / int64(time.Second)
+	fillInterval := time.Duration(tokensPerFill * int64(time.Second) / rps)
+	maxTokens := tokensPerFill
+	if int64(opts.SpikeArrestBurst) > maxTokens {
+		maxTokens = int64(opts.SpikeArrestBurst)
+	}
+
+	return ptypes.MarshalAny(&lrlpb.LocalRateLimit{
+		StatPrefix: spikeArrestStatPrefix,
+		TokenBucket: &typepb.TokenBucket{
+			MaxTokens:     uint32(maxTokens),
+			TokensPerFill: &wrapperspb.UInt32Value{Value: uint32(tokensPerFill)},
+			FillInterval:  ptypes.DurationProto(fillInterval),
+		},
+		FilterEnabled: &corepb.RuntimeFractionalPercent{
+			DefaultValue: &typepb.FractionalPercent{
+				Numerator:   100,
+				Denominator: typepb.FractionalPercent_HUNDRED,
+			},
+			RuntimeKey: spikeArrestStatPrefix + "_enabled",
+		},
+		FilterEnforced: &corepb.RuntimeFractionalPercent{
+			DefaultValue: &typepb.FractionalPercent{
+				Numerator:   100,
+				Denominator: typepb.FractionalPercent_HUNDRED,
+			},
+			RuntimeKey: spikeArrestStatPrefix + "_enforced",
+		},
+		ResponseHeadersToAdd: []*corepb.HeaderValueOption{
+			{
+				Header: &corepb.HeaderValue{
+					Key:   "retry-after",
+					Value: "1",
+				},
+			},
+		},
+	})
+}
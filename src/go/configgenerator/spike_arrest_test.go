@@ -0,0 +1,185 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	lrlpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+)
+
+func TestMakeSpikeArrestConfig(t *testing.T) {
+	testData := []struct {
+		desc             string
+		spikeArrestRps   int
+		spikeArrestBurst int
+		wantConfig       string
+		wantError        string
+	}{
+		{
+			desc: "no spike arrest by default",
+		},
+		{
+			desc:           "requests refilled every 50ms",
+			spikeArrestRps: 100,
+			wantConfig: `{
+				"statPrefix": "spike_arrest",
+				"tokenBucket": {
+					"maxTokens": 5,
+					"tokensPerFill": 5,
+					"fillInterval": "0.050s"
+				},
+				"filterEnabled": {
+					"defaultValue": {
+						"numerator": 100
+					},
+					"runtimeKey": "spike_arrest_enabled"
+				},
+				"filterEnforced": {
+					"defaultValue": {
+						"numerator": 100
+					},
+					"runtimeKey": "spike_arrest_enforced"
+				},
+				"responseHeadersToAdd": [
+					{
+						"header": {
+							"key": "retry-after",
+							"value": "1"
+						}
+					}
+				]
+			}`,
+		},
+		{
+			desc:           "single request refilled at a time",
+			spikeArrestRps: 4,
+			wantConfig: `{
+				"statPrefix": "spike_arrest",
+				"tokenBucket": {
+					"maxTokens": 1,
+					"tokensPerFill": 1,
+					"fillInterval": "0.250s"
+				},
+				"filterEnabled": {
+					"defaultValue": {
+						"numerator": 100
+					},
+					"runtimeKey": "spike_arrest_enabled"
+				},
+				"filterEnforced": {
+					"defaultValue": {
+						"numerator": 100
+					},
+					"runtimeKey": "spike_arrest_enforced"
+				},
+				"responseHeadersToAdd": [
+					{
+						"header": {
+							"key": "retry-after",
+							"value": "1"
+						}
+					}
+				]
+			}`,
+		},
+		{
+			desc:             "burst above the refilled requests",
+			spikeArrestRps:   100,
+			spikeArrestBurst: 20,
+			wantConfig: `{
+				"statPrefix": "spike_arrest",
+				"tokenBucket": {
+					"maxTokens": 20,
+					"tokensPerFill": 5,
+					"fillInterval": "0.050s"
+				},
+				"filterEnabled": {
+					"defaultValue": {
+						"numerator": 100
+					},
+					"runtimeKey": "spike_arrest_enabled"
+				},
+				"filterEnforced": {
+					"defaultValue": {
+						"numerator": 100
+					},
+					"runtimeKey": "spike_arrest_enforced"
+				},
+				"responseHeadersToAdd": [
+					{
+						"header": {
+							"key": "retry-after",
+							"value": "1"
+						}
+					}
+				]
+			}`,
+		},
+		{
+			desc:           "negative requests per second",
+			spikeArrestRps: -1,
+			wantError:      "invalid --spike_arrest_rps -1",
+		},
+		{
+			desc:             "negative burst",
+			spikeArrestRps:   100,
+			spikeArrestBurst: -1,
+			wantError:        "invalid --spike_arrest_burst -1",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.SpikeArrestRps = tc.spikeArrestRps
+			opts.SpikeArrestBurst = tc.spikeArrestBurst
+
+			gotConfigAny, err := makeSpikeArrestConfig(opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("got error: %v, want error containing: %s", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantConfig == "" {
+				if gotConfigAny != nil {
+					t.Errorf("got spike arrest config: %v, want: nil", gotConfigAny)
+				}
+				return
+			}
+
+			gotConfig, wantConfig := &lrlpb.LocalRateLimit{}, &lrlpb.LocalRateLimit{}
+			if err := ptypes.UnmarshalAny(gotConfigAny, gotConfig); err != nil {
+				t.Fatal(err)
+			}
+			if err := jsonpb.UnmarshalString(tc.wantConfig, wantConfig); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(gotConfig, wantConfig) {
+				t.Errorf("got spike arrest config: %v, want: %v", gotConfig, wantConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	transcoderpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_json_transcoder/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+)
+
+// makeTranscoderPrintOptionsFilters returns a grpc_json_transcoder filter per
+// distinct set of print options in --transcoding_operation_print_options, in
+// the order of their first operation. The transcoder filter in the supported
+// Envoy version has no per-route config, so each filter only keeps the http
+// rules of its operations.
+func makeTranscoderPrintOptionsFilters(serviceInfo *configinfo.ServiceInfo) ([]*hcmpb.HttpFilter, error) {
+	var printOptionsList []configinfo.TranscodingPrintOptions
+	selectors := make(map[configinfo.TranscodingPrintOptions]map[string]bool)
+	for _, operation := range serviceInfo.Operations {
+		method := serviceInfo.Methods[operation]
+		if method.TranscodingPrintOptions == nil {
+			continue
+		}
+		printOptions := *method.TranscodingPrintOptions
+		if selectors[printOptions] == nil {
+			printOptionsList = append(printOptionsList, printOptions)
+			selectors[printOptions] = make(map[string]bool)
+		}
+		selectors[printOptions][operation] = true
+	}
+	if len(printOptionsList) == 0 {
+		return nil, nil
+	}
+
+	baseConfig := makeTranscoderConfig(serviceInfo)
+	if baseConfig == nil {
+		return nil, nil
+	}
+
+	var filters []*hcmpb.HttpFilter
+	for _, printOptions := range printOptionsList {
+		descriptorBin, err := restrictTranscoderHttpRules(baseConfig.GetProtoDescriptorBin(), serviceInfo.GrpcApiNames, selectors[printOptions])
+		if err != nil {
+			return nil, fmt.Errorf("fail to make the transcoder filter of --transcoding_operation_print_options: %v", err)
+		}
+
+		transcodeConfig := proto.Clone(baseConfig).(*transcoderpb.GrpcJsonTranscoder)
+		transcodeConfig.DescriptorSet = &transcoderpb.GrpcJsonTranscoder_ProtoDescriptorBin{
+			ProtoDescriptorBin: descriptorBin,
+		}
+		// The auto mapping would transcode the other methods of the apis too.
+		// The paths it maps are bound in the descriptor instead.
+		transcodeConfig.AutoMapping = false
+		transcodeConfig.PrintOptions = &transcoderpb.GrpcJsonTranscoder_PrintOptions{
+			AlwaysPrintPrimitiveFields: printOptions.AlwaysPrintPrimitiveFields,
+			AlwaysPrintEnumsAsInts:     printOptions.AlwaysPrintEnumsAsInts,
+			PreserveProtoFieldNames:    printOptions.PreserveProtoFieldNames,
+		}
+
+		transcodeConfigStruct, _ := ptypes.MarshalAny(transcodeConfig)
+		filters = append(filters, &hcmpb.HttpFilter{
+			Name:       util.GRPCJSONTranscoder,
+			ConfigType: &hcmpb.HttpFilter_TypedConfig{TypedConfig: transcodeConfigStruct},
+		})
+	}
+	return filters, nil
+}
+
+// restrictTranscoderHttpRules removes the google.api.http options of the
+// methods of the transcoded apis in the proto descriptor, except the ones of
+// the selectors. Those get the "POST /package.Service/Method" binding of the
+// auto mapping too.
+func restrictTranscoderHttpRules(descriptorBin []byte, apiNames []string, selectors map[string]bool) ([]byte, error) {
+	descriptorSet := &descpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(descriptorBin, descriptorSet); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal the proto descriptor, %v", err)
+	}
+
+	transcoded := make(map[string]bool)
+	for _, apiName := range apiNames {
+		transcoded[apiName] = true
+	}
+	for _, file := range descriptorSet.GetFile() {
+		for _, service := range file.GetService() {
+			apiName := service.GetName()
+			if file.GetPackage() != "" {
+				apiName = file.GetPackage() + "." + apiName
+			}
+			if !transcoded[apiName] {
+				continue
+			}
+
+			for _, method := range service.GetMethod() {
+				selector := fmt.Sprintf("%s.%s", apiName, method.GetName())
+				hasRule := method.GetOptions() != nil && proto.HasExtension(method.GetOptions(), annotationspb.E_Http)
+				if !selectors[selector] {
+					if hasRule {
+						proto.ClearExtension(method.GetOptions(), annotationspb.E_Http)
+					}
+					continue
+				}
+
+				autoMapping := &annotationspb.HttpRule{
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: fmt.Sprintf("/%s/%s", apiName, method.GetName()),
+					},
+					Body: "*",
+				}
+				if !hasRule {
+					if method.Options == nil {
+						method.Options = &descpb.MethodOptions{}
+					}
+					if err := proto.SetExtension(method.GetOptions(), annotationspb.E_Http, autoMapping); err != nil {
+						return nil, fmt.Errorf("fail to set the http rule of method %s, %v", selector, err)
+					}
+					continue
+				}
+
+				ext, err := proto.GetExtension(method.GetOptions(), annotationspb.E_Http)
+				if err != nil {
+					return nil, fmt.Errorf("fail to read the http rule of method %s, %v", selector, err)
+				}
+				rule, ok := ext.(*annotationspb.HttpRule)
+				if !ok {
+					return nil, fmt.Errorf("unexpected type %T of the http rule of method %s", ext, selector)
+				}
+				rule = proto.Clone(rule).(*annotationspb.HttpRule)
+				rule.AdditionalBindings = append(rule.AdditionalBindings, autoMapping)
+				if err := proto.SetExtension(method.GetOptions(), annotationspb.E_Http, rule); err != nil {
+					return nil, fmt.Errorf("fail to set the http rule of method %s, %v", selector, err)
+				}
+			}
+		}
+	}
+	return proto.Marshal(descriptorSet)
+}
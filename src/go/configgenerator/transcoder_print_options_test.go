@@ -0,0 +1,212 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	transcoderpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_json_transcoder/v3"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestMakeTranscoderPrintOptionsFilters(t *testing.T) {
+	makeMethod := func(name string, rule *annotationspb.HttpRule) *descpb.MethodDescriptorProto {
+		method := &descpb.MethodDescriptorProto{
+			Name: proto.String(name),
+		}
+		if rule != nil {
+			method.Options = &descpb.MethodOptions{}
+			if err := proto.SetExtension(method.Options, annotationspb.E_Http, rule); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return method
+	}
+	getRule := func(path string) *annotationspb.HttpRule {
+		return &annotationspb.HttpRule{
+			Pattern: &annotationspb.HttpRule_Get{
+				Get: path,
+			},
+		}
+	}
+	autoMappingRule := func(method string) *annotationspb.HttpRule {
+		return &annotationspb.HttpRule{
+			Pattern: &annotationspb.HttpRule_Post{
+				Post: "/endpoints.examples.bookstore.Bookstore/" + method,
+			},
+			Body: "*",
+		}
+	}
+	descriptorBin, err := proto.Marshal(&descpb.FileDescriptorSet{
+		File: []*descpb.FileDescriptorProto{
+			{
+				Name:    proto.String("bookstore.proto"),
+				Package: proto.String("endpoints.examples.bookstore"),
+				Service: []*descpb.ServiceDescriptorProto{
+					{
+						Name: proto.String("Bookstore"),
+						Method: []*descpb.MethodDescriptorProto{
+							makeMethod("GetBook", getRule("/v1/books/{book}")),
+							makeMethod("ListBooks", nil),
+							makeMethod("ListShelves", getRule("/v1/shelves")),
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptorFile, err := ptypes.MarshalAny(&smpb.ConfigFile{
+		FilePath:     "api_descriptor.pb",
+		FileContents: descriptorBin,
+		FileType:     smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "GetBook",
+					},
+					{
+						Name: "ListBooks",
+					},
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		SourceInfo: &confpb.SourceInfo{
+			SourceFiles: []*anypb.Any{descriptorFile},
+		},
+	}
+
+	testData := []struct {
+		desc                  string
+		operationPrintOptions string
+		wantPrintOptions      []*transcoderpb.GrpcJsonTranscoder_PrintOptions
+		// The http rules of the methods in the descriptor of each filter.
+		wantHttpRules []map[string]*annotationspb.HttpRule
+	}{
+		{
+			desc: "no filter without operation print options",
+		},
+		{
+			desc:                  "a filter per distinct set of print options, in the order of their first operation",
+			operationPrintOptions: "endpoints.examples.bookstore.Bookstore.ListShelves=preserve_proto_field_names:true;endpoints.examples.bookstore.Bookstore.GetBook=always_print_primitive_fields:true;endpoints.examples.bookstore.Bookstore.ListBooks=always_print_primitive_fields:true",
+			wantPrintOptions: []*transcoderpb.GrpcJsonTranscoder_PrintOptions{
+				{
+					AlwaysPrintPrimitiveFields: true,
+				},
+				{
+					PreserveProtoFieldNames: true,
+				},
+			},
+			wantHttpRules: []map[string]*annotationspb.HttpRule{
+				{
+					"GetBook": &annotationspb.HttpRule{
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: "/v1/books/{book}",
+						},
+						AdditionalBindings: []*annotationspb.HttpRule{autoMappingRule("GetBook")},
+					},
+					"ListBooks": autoMappingRule("ListBooks"),
+				},
+				{
+					"ListShelves": &annotationspb.HttpRule{
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: "/v1/shelves",
+						},
+						AdditionalBindings: []*annotationspb.HttpRule{autoMappingRule("ListShelves")},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:8082"
+			opts.TranscodingOperationPrintOptions = tc.operationPrintOptions
+			serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filters, err := makeTranscoderPrintOptionsFilters(serviceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(filters) != len(tc.wantPrintOptions) {
+				t.Fatalf("got %d filters, want %d", len(filters), len(tc.wantPrintOptions))
+			}
+			for i, filter := range filters {
+				config := &transcoderpb.GrpcJsonTranscoder{}
+				if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), config); err != nil {
+					t.Fatal(err)
+				}
+				if config.GetAutoMapping() {
+					t.Errorf("filter %d: want no auto mapping", i)
+				}
+				if !proto.Equal(tc.wantPrintOptions[i], config.GetPrintOptions()) {
+					t.Errorf("filter %d: got print options %v, want %v", i, config.GetPrintOptions(), tc.wantPrintOptions[i])
+				}
+
+				descriptorSet := &descpb.FileDescriptorSet{}
+				if err := proto.Unmarshal(config.GetProtoDescriptorBin(), descriptorSet); err != nil {
+					t.Fatal(err)
+				}
+				gotHttpRules := map[string]*annotationspb.HttpRule{}
+				for _, method := range descriptorSet.GetFile()[0].GetService()[0].GetMethod() {
+					if method.GetOptions() == nil || !proto.HasExtension(method.GetOptions(), annotationspb.E_Http) {
+						continue
+					}
+					ext, err := proto.GetExtension(method.GetOptions(), annotationspb.E_Http)
+					if err != nil {
+						t.Fatal(err)
+					}
+					gotHttpRules[method.GetName()] = ext.(*annotationspb.HttpRule)
+				}
+				if len(gotHttpRules) != len(tc.wantHttpRules[i]) {
+					t.Errorf("filter %d: got http rules of %d methods, want %d", i, len(gotHttpRules), len(tc.wantHttpRules[i]))
+				}
+				for name, wantRule := range tc.wantHttpRules[i] {
+					if !proto.Equal(wantRule, gotHttpRules[name]) {
+						t.Errorf("filter %d: got http rule %v of method %s, want %v", i, gotHttpRules[name], name, wantRule)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
+	"github.com/golang/protobuf/proto"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// Severities of the diagnostics.
+const (
+	SeverityWarning = "WARNING"
+	SeverityError   = "ERROR"
+)
+
+// Diagnostic is a problem found in the service config by ValidateServiceConfig.
+type Diagnostic struct {
+	Severity string
+	// The rule of the service config with the problem, e.g. "http.rules[2]",
+	// empty if the problem is not located.
+	Location string
+	Message  string
+}
+
+func (d *Diagnostic) String() string {
+	if d.Location == "" {
+		return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", d.Severity, d.Location, d.Message)
+}
+
+// HasErrors returns true if any of the diagnostics is an error.
+func HasErrors(diagnostics []*Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateServiceConfig lints the service config and runs the config
+// generation with the options, reporting the problems found.
+func ValidateServiceConfig(serviceConfig *confpb.Service, opts options.ConfigGeneratorOptions) []*Diagnostic {
+	// The config generation fills in the service config, lint a copy.
+	serviceConfig = proto.Clone(serviceConfig).(*confpb.Service)
+
+	diagnostics := lintSelectors(serviceConfig, opts)
+	diagnostics = append(diagnostics, lintHttpRules(serviceConfig)...)
+	diagnostics = append(diagnostics, lintAuthProviders(serviceConfig, opts)...)
+	if HasErrors(diagnostics) {
+		return diagnostics
+	}
+
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.GetId(), opts)
+	if err != nil {
+		return append(diagnostics, &Diagnostic{Severity: SeverityError, Message: err.Error()})
+	}
+	if httpPatternMethods, _, _, err := getSortMethodsByHttpPattern(serviceInfo); err == nil {
+		for _, shadowed := range findShadowedRoutes(httpPatternMethods) {
+			diagnostics = append(diagnostics, &Diagnostic{Severity: SeverityWarning, Message: shadowed})
+		}
+	}
+	if _, err := MakeClusters(serviceInfo); err != nil {
+		diagnostics = append(diagnostics, &Diagnostic{Severity: SeverityError, Message: fmt.Sprintf("fail to make clusters: %v", err)})
+	}
+	if _, err := MakeListeners(serviceInfo); err != nil {
+		diagnostics = append(diagnostics, &Diagnostic{Severity: SeverityError, Message: fmt.Sprintf("fail to make listeners: %v", err)})
+	}
+	return diagnostics
+}
+
+// lintSelectors reports the rules whose selector is not a method of the apis.
+// Such rules are ignored by ESPv2, or rejected with
+// --strict_selector_validation for the rules creating a method.
+func lintSelectors(serviceConfig *confpb.Service, opts options.ConfigGeneratorOptions) []*Diagnostic {
+	selectors := make(map[string]bool)
+	for _, api := range serviceConfig.GetApis() {
+		// The rules with an API name selector apply to all its methods.
+		selectors[api.GetName()] = true
+		for _, method := range api.GetMethods() {
+			selectors[fmt.Sprintf("%s.%s", api.GetName(), method.GetName())] = true
+		}
+	}
+
+	var diagnostics []*Diagnostic
+	check := func(location, selector string, strict bool) {
+		// Wildcard selectors match any number of methods, including none.
+		if strings.Contains(selector, "*") || selectors[selector] {
+			return
+		}
+		if strict && opts.StrictSelectorValidation {
+			diagnostics = append(diagnostics, &Diagnostic{
+				Severity: SeverityError,
+				Location: location,
+				Message:  fmt.Sprintf("selector %s is not defined in apis.methods", selector),
+			})
+			return
+		}
+		diagnostics = append(diagnostics, &Diagnostic{
+			Severity: SeverityWarning,
+			Location: location,
+			Message:  fmt.Sprintf("selector %s is not defined in apis.methods, the rule is ignored", selector),
+		})
+	}
+
+	for i, rule := range serviceConfig.GetHttp().GetRules() {
+		check(fmt.Sprintf("http.rules[%d]", i), rule.GetSelector(), false)
+	}
+	for i, rule := range serviceConfig.GetAuthentication().GetRules() {
+		check(fmt.Sprintf("authentication.rules[%d]", i), rule.GetSelector(), true)
+	}
+	for i, rule := range serviceConfig.GetBackend().GetRules() {
+		check(fmt.Sprintf("backend.rules[%d]", i), rule.GetSelector(), true)
+	}
+	for i, rule := range serviceConfig.GetUsage().GetRules() {
+		check(fmt.Sprintf("usage.rules[%d]", i), rule.GetSelector(), true)
+	}
+	for i, rule := range serviceConfig.GetQuota().GetMetricRules() {
+		check(fmt.Sprintf("quota.metric_rules[%d]", i), rule.GetSelector(), false)
+	}
+	for i, rule := range serviceConfig.GetSystemParameters().GetRules() {
+		check(fmt.Sprintf("system_parameters.rules[%d]", i), rule.GetSelector(), true)
+	}
+	return diagnostics
+}
+
+// lintHttpRules reports the http rules that cannot be parsed, that conflict
+// with another rule, or whose route regex is too large for Envoy.
+func lintHttpRules(serviceConfig *confpb.Service) []*Diagnostic {
+	var diagnostics []*Diagnostic
+	seen := make(map[string]string)
+
+	var rules []*httpRuleLocation
+	for i, rule := range serviceConfig.GetHttp().GetRules() {
+		location := fmt.Sprintf("http.rules[%d]", i)
+		rules = append(rules, &httpRuleLocation{location: location, rule: rule})
+		for j, binding := range rule.GetAdditionalBindings() {
+			rules = append(rules, &httpRuleLocation{
+				location: fmt.Sprintf("%s.additional_bindings[%d]", location, j),
+				rule:     binding,
+			})
+		}
+	}
+
+	for _, r := range rules {
+		httpMethod, path := httpRulePattern(r.rule)
+		if path == "" {
+			continue
+		}
+		uriTemplate, err := httppattern.ParseUriTemplate(path)
+		if err != nil {
+			diagnostics = append(diagnostics, &Diagnostic{
+				Severity: SeverityError,
+				Location: r.location,
+				Message:  err.Error(),
+			})
+			continue
+		}
+
+		// Templates only differing by variable names match the same requests.
+		key := httpMethod + " " + uriTemplate.Regex()
+		if other, ok := seen[key]; ok {
+			diagnostics = append(diagnostics, &Diagnostic{
+				Severity: SeverityError,
+				Location: r.location,
+				Message:  fmt.Sprintf("http pattern `%s %s` conflicts with %s", httpMethod, path, other),
+			})
+			continue
+		}
+		seen[key] = r.location
+
+		if uriTemplate.IsExactMatch() {
+			continue
+		}
+		if err := util.ValidateRegexProgramSize(uriTemplate.Regex(), util.GoogleRE2MaxProgramSize); err != nil {
+			diagnostics = append(diagnostics, &Diagnostic{
+				Severity: SeverityError,
+				Location: r.location,
+				Message:  fmt.Sprintf("the route regex of uri template %s is too large: %v", path, err),
+			})
+		}
+	}
+	return diagnostics
+}
+
+type httpRuleLocation struct {
+	location string
+	rule     *annotationspb.HttpRule
+}
+
+func httpRulePattern(rule *annotationspb.HttpRule) (string, string) {
+	switch {
+	case rule.GetGet() != "":
+		return util.GET, rule.GetGet()
+	case rule.GetPut() != "":
+		return util.PUT, rule.GetPut()
+	case rule.GetPost() != "":
+		return util.POST, rule.GetPost()
+	case rule.GetDelete() != "":
+		return util.DELETE, rule.GetDelete()
+	case rule.GetPatch() != "":
+		return util.PATCH, rule.GetPatch()
+	case rule.GetCustom() != nil:
+		return rule.GetCustom().GetKind(), rule.GetCustom().GetPath()
+	}
+	return "", ""
+}
+
+// lintAuthProviders reports the providers without jwks_uri, which is then
+// resolved with OpenID Connect Discovery at config generation.
+func lintAuthProviders(serviceConfig *confpb.Service, opts options.ConfigGeneratorOptions) []*Diagnostic {
+	var diagnostics []*Diagnostic
+	for i, provider := range serviceConfig.GetAuthentication().GetProviders() {
+		if provider.GetJwksUri() != "" {
+			continue
+		}
+		location := fmt.Sprintf("authentication.providers[%d]", i)
+		if opts.DisableOidcDiscovery {
+			diagnostics = append(diagnostics, &Diagnostic{
+				Severity: SeverityError,
+				Location: location,
+				Message:  fmt.Sprintf("jwks_uri is empty for provider %s and OpenID Connect Discovery is disabled", provider.GetId()),
+			})
+			continue
+		}
+		diagnostics = append(diagnostics, &Diagnostic{
+			Severity: SeverityWarning,
+			Location: location,
+			Message:  fmt.Sprintf("jwks_uri is empty for provider %s, it is resolved with OpenID Connect Discovery from issuer %s", provider.GetId(), provider.GetIssuer()),
+		})
+	}
+	return diagnostics
+}
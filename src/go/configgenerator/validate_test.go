@@ -0,0 +1,206 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestValidateServiceConfig(t *testing.T) {
+	apis := []*apipb.Api{
+		{
+			Name: testApiName,
+			Methods: []*apipb.Method{
+				{
+					Name: "ListShelves",
+				},
+				{
+					Name: "CreateShelf",
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                     string
+		http                     *annotationspb.Http
+		authentication           *confpb.Authentication
+		backend                  *confpb.Backend
+		disableOidcDiscovery     bool
+		corsPreset               string
+		strictSelectorValidation bool
+		wantDiagnostics          []string
+	}{
+		{
+			desc: "Valid service config",
+			http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+				},
+			}},
+		},
+		{
+			desc: "Warning for unknown selectors",
+			http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.DeleteShelf",
+					Pattern:  &annotationspb.HttpRule_Delete{Delete: "/v1/shelves/{shelf}"},
+				},
+			}},
+			authentication: &confpb.Authentication{
+				Rules: []*confpb.AuthenticationRule{
+					{
+						Selector: "endpoints.examples.bookstore.Bookstore.*",
+					},
+				},
+			},
+			backend: &confpb.Backend{
+				Rules: []*confpb.BackendRule{
+					{
+						Selector: "endpoints.examples.bookstore.Bookstore",
+						Address:  "https://bookstore.run.app",
+					},
+				},
+			},
+			wantDiagnostics: []string{
+				"WARNING http.rules[1]: selector endpoints.examples.bookstore.Bookstore.DeleteShelf is not defined in apis.methods, the rule is ignored",
+			},
+		},
+		{
+			desc: "Error for unknown selectors with strict selector validation",
+			http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.DeleteShelf",
+					Pattern:  &annotationspb.HttpRule_Delete{Delete: "/v1/shelves/{shelf}"},
+				},
+			}},
+			backend: &confpb.Backend{
+				Rules: []*confpb.BackendRule{
+					{
+						Selector: "endpoints.examples.bookstore.Bookstore.ListShelfs",
+						Address:  "https://bookstore.run.app",
+					},
+				},
+			},
+			strictSelectorValidation: true,
+			wantDiagnostics: []string{
+				"WARNING http.rules[1]: selector endpoints.examples.bookstore.Bookstore.DeleteShelf is not defined in apis.methods, the rule is ignored",
+				"ERROR backend.rules[0]: selector endpoints.examples.bookstore.Bookstore.ListShelfs is not defined in apis.methods",
+			},
+		},
+		{
+			desc: "Error for conflicting and invalid http rules",
+			http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves/{shelf}"},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+					Pattern:  &annotationspb.HttpRule_Post{Post: "/v1/shelves"},
+					AdditionalBindings: []*annotationspb.HttpRule{
+						{
+							Pattern: &annotationspb.HttpRule_Get{Get: "/v1/shelves/{id}"},
+						},
+						{
+							Pattern: &annotationspb.HttpRule_Get{Get: "/v1/shelves/{id"},
+						},
+					},
+				},
+			}},
+			wantDiagnostics: []string{
+				"ERROR http.rules[1].additional_bindings[0]: http pattern `GET /v1/shelves/{id}` conflicts with http.rules[0]",
+				"ERROR http.rules[1].additional_bindings[1]: invalid uri template /v1/shelves/{id",
+			},
+		},
+		{
+			desc: "Error for missing jwks_uri with OpenID Connect Discovery disabled",
+			http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+				},
+			}},
+			authentication: &confpb.Authentication{
+				Providers: []*confpb.AuthProvider{
+					{
+						Id:     "auth_provider",
+						Issuer: "issuer",
+					},
+				},
+			},
+			disableOidcDiscovery: true,
+			wantDiagnostics: []string{
+				"ERROR authentication.providers[0]: jwks_uri is empty for provider auth_provider and OpenID Connect Discovery is disabled",
+			},
+		},
+		{
+			desc: "Error from the config generation",
+			http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+				},
+			}},
+			corsPreset: "invalid",
+			wantDiagnostics: []string{
+				`ERROR: fail to make listeners: makeHttpConnectionManagerRouteConfig got err: cors_preset must be either "basic" or "cors_with_regex"`,
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.DisableTracing = true
+			opts.DisableOidcDiscovery = tc.disableOidcDiscovery
+			opts.CorsPreset = tc.corsPreset
+			opts.StrictSelectorValidation = tc.strictSelectorValidation
+
+			diagnostics := ValidateServiceConfig(&confpb.Service{
+				Name:           testProjectName,
+				Apis:           apis,
+				Http:           tc.http,
+				Authentication: tc.authentication,
+				Backend:        tc.backend,
+			}, opts)
+
+			var got []string
+			for _, d := range diagnostics {
+				got = append(got, d.String())
+			}
+			if !reflect.DeepEqual(got, tc.wantDiagnostics) {
+				t.Errorf("got diagnostics:\n%q,\nwant:\n%q", got, tc.wantDiagnostics)
+			}
+		})
+	}
+}
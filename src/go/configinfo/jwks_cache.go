@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	openIDCacheKind = "openid"
+	jwksCacheKind   = "jwks"
+)
+
+// jwksCache persists the JWKS documents and the OpenID discovery results
+// fetched by the config manager in --jwks_cache_dir, so a restarted proxy can
+// still validate tokens while the identity providers are unavailable. The
+// entries older than the TTL are not used.
+type jwksCache struct {
+	dir string
+	ttl time.Duration
+}
+
+func newJwksCache(dir string, ttl time.Duration) *jwksCache {
+	if dir == "" {
+		return nil
+	}
+	return &jwksCache{
+		dir: dir,
+		ttl: ttl,
+	}
+}
+
+func (c *jwksCache) path(kind, key string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%s-%x.json", kind, sha256.Sum256([]byte(key))))
+}
+
+// get returns the cached entry of a key, unless it is missing or expired.
+func (c *jwksCache) get(kind, key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	path := c.path(kind, key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if age := time.Since(info.ModTime()); age > c.ttl {
+		glog.Infof("the cached %s of %s expired %v ago", kind, key, age-c.ttl)
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		glog.Warningf("fail to read the cached %s of %s: %v", kind, key, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// put caches the entry of a key. The entry is renamed into place, so the
+// readers never see a partial one. The cache is best effort, so the failures
+// are only logged.
+func (c *jwksCache) put(kind, key string, data []byte) {
+	if c == nil {
+		return
+	}
+	if err := c.write(c.path(kind, key), data); err != nil {
+		glog.Warningf("fail to cache the %s of %s in %s: %v", kind, key, c.dir, err)
+	}
+}
+
+func (c *jwksCache) write(path string, data []byte) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+func newTestJwksCache(t *testing.T) (*jwksCache, func()) {
+	dir, err := ioutil.TempDir("", "jwks_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newJwksCache(dir, time.Hour), func() { os.RemoveAll(dir) }
+}
+
+// ageEntry makes a cached entry look fetched the given time ago.
+func ageEntry(t *testing.T, c *jwksCache, kind, key string, age time.Duration) {
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(c.path(kind, key), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJwksCache(t *testing.T) {
+	testData := []struct {
+		desc     string
+		put      string
+		age      time.Duration
+		wantData string
+		wantOk   bool
+	}{
+		{
+			desc:   "missing entry",
+			wantOk: false,
+		},
+		{
+			desc:     "fresh entry",
+			put:      `{"keys":[]}`,
+			wantData: `{"keys":[]}`,
+			wantOk:   true,
+		},
+		{
+			desc:     "entry within the ttl",
+			put:      `{"keys":[]}`,
+			age:      59 * time.Minute,
+			wantData: `{"keys":[]}`,
+			wantOk:   true,
+		},
+		{
+			desc:   "expired entry",
+			put:    `{"keys":[]}`,
+			age:    61 * time.Minute,
+			wantOk: false,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			cache, cleanup := newTestJwksCache(t)
+			defer cleanup()
+
+			if tc.put != "" {
+				cache.put(jwksCacheKind, "https://issuer/jwks", []byte(tc.put))
+				ageEntry(t, cache, jwksCacheKind, "https://issuer/jwks", tc.age)
+			}
+			data, ok := cache.get(jwksCacheKind, "https://issuer/jwks")
+			if ok != tc.wantOk || string(data) != tc.wantData {
+				t.Errorf("want (%q, %v), got (%q, %v)", tc.wantData, tc.wantOk, data, ok)
+			}
+		})
+	}
+}
+
+func TestResolveJwksUriUsingOpenIDReadsThroughCache(t *testing.T) {
+	available := true
+	openIDServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		jwksUriEntry, _ := json.Marshal(map[string]string{"jwks_uri": "this-is-jwksUri"})
+		_, _ = w.Write(jwksUriEntry)
+	}))
+	defer openIDServer.Close()
+
+	cache, cleanup := newTestJwksCache(t)
+	defer cleanup()
+	serviceInfo := &ServiceInfo{
+		Options:   options.DefaultConfigGeneratorOptions(),
+		jwksCache: cache,
+	}
+
+	if jwksUri, err := serviceInfo.resolveJwksUriUsingOpenID(openIDServer.URL); err != nil || jwksUri != "this-is-jwksUri" {
+		t.Fatalf("want jwks uri this-is-jwksUri, got: %q, err: %v", jwksUri, err)
+	}
+
+	available = false
+	if jwksUri, err := serviceInfo.resolveJwksUriUsingOpenID(openIDServer.URL); err != nil || jwksUri != "this-is-jwksUri" {
+		t.Errorf("want the cached jwks uri this-is-jwksUri, got: %q, err: %v", jwksUri, err)
+	}
+
+	ageEntry(t, cache, openIDCacheKind, openIDServer.URL, 2*time.Hour)
+	if _, err := serviceInfo.resolveJwksUriUsingOpenID(openIDServer.URL); err == nil {
+		t.Errorf("want an error once the cached jwks uri expired, got none")
+	}
+}
+
+func TestProcessJwksCache(t *testing.T) {
+	available := true
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"keys":[{"kid":"1"}]}`))
+	}))
+	defer jwksServer.Close()
+
+	testData := []struct {
+		desc           string
+		cached         bool
+		available      bool
+		age            time.Duration
+		wantCachedJwks map[string]string
+	}{
+		{
+			desc:      "jwks_uri available",
+			available: true,
+		},
+		{
+			desc:           "jwks_uri unavailable, cached jwks used",
+			cached:         true,
+			wantCachedJwks: map[string]string{"auth_provider": `{"keys":[{"kid":"1"}]}`},
+		},
+		{
+			desc:   "jwks_uri unavailable, cached jwks expired",
+			cached: true,
+			age:    2 * time.Hour,
+		},
+		{
+			desc: "jwks_uri unavailable, nothing cached",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			cache, cleanup := newTestJwksCache(t)
+			defer cleanup()
+			serviceInfo := &ServiceInfo{
+				Options:   options.DefaultConfigGeneratorOptions(),
+				jwksCache: cache,
+				serviceConfig: &confpb.Service{
+					Authentication: &confpb.Authentication{
+						Providers: []*confpb.AuthProvider{
+							{
+								Id:      "auth_provider",
+								JwksUri: jwksServer.URL,
+							},
+						},
+					},
+				},
+			}
+
+			if tc.cached {
+				available = true
+				serviceInfo.processJwksCache()
+				ageEntry(t, cache, jwksCacheKind, jwksServer.URL, tc.age)
+			}
+			available = tc.available
+			serviceInfo.processJwksCache()
+
+			if len(serviceInfo.CachedJwks) != len(tc.wantCachedJwks) {
+				t.Fatalf("want cached jwks %v, got %v", tc.wantCachedJwks, serviceInfo.CachedJwks)
+			}
+			for id, jwks := range tc.wantCachedJwks {
+				if serviceInfo.CachedJwks[id] != jwks {
+					t.Errorf("want cached jwks %q of %s, got %q", jwks, id, serviceInfo.CachedJwks[id])
+				}
+			}
+		})
+	}
+}
@@ -34,11 +34,74 @@ type MethodInfo struct {
 	// Method that is generated by ESPv2.
 	IsGenerated        bool
 	SkipServiceControl bool
-	RequireAuth        bool
-	ApiKeyLocations    []*scpb.ApiKeyLocation
-	MetricCosts        []*scpb.MetricCost
+	// Skip the service control Check call, but still send the Report.
+	SkipServiceControlCheck bool
+	// Only log and report the JWT authentication, API key and quota failures.
+	AuditMode       bool
+	RequireAuth     bool
+	ApiKeyLocations []*scpb.ApiKeyLocation
+	MetricCosts     []*scpb.MetricCost
+	// Identities allowed to call the method, matched against the azp/email JWT claims.
+	// If empty, any caller with a valid JWT is allowed.
+	AllowedCallers []string
+	// The http filters disabled for the method by their per-route configs.
+	DisabledFilters map[string]bool
+	// Overrides of the service control calling config for the method.
+	ScCallingConfig *scpb.OperationCallingConfig
 	// All non-unary gRPC methods are considered streaming.
 	IsStreaming bool
+	// The request or response type is google.api.HttpBody, so the raw bytes
+	// pass through the transcoder with their own content type.
+	IsHttpBody bool
+	// Overrides the trace sampling rate of the method, if set.
+	TracingSampleRate *float64
+	// The method is in maintenance, its routes respond without reaching the
+	// backend.
+	InMaintenance bool
+	// The http rules of the method are prefixed by --api_base_path, which is
+	// stripped from the path forwarded to the backend.
+	UnderApiBasePath bool
+
+	// The time the responses of the method are cached by Envoy, not cached if
+	// 0.
+	ResponseCacheTtl time.Duration
+	// The request headers in the cache key of the cached responses: the ones
+	// of --response_cache_key_headers and the ones carrying the API keys.
+	ResponseCacheKeyHeaders []string
+	// The query parameters carrying the API keys, in the cache key even if
+	// --response_cache_key_query_params omits them.
+	ResponseCacheApiKeyQueryParams []string
+	// The JSON responses of the method get an ETag computed by Envoy.
+	EnableEtag bool
+	// The duplicate requests of the method with the same idempotency key are
+	// deduplicated by Envoy.
+	EnableIdempotency bool
+	// The max number of requests of the method in flight at a time, not
+	// limited if 0.
+	MaxConcurrentRequests uint32
+	// The requests of the method with a larger content-length are routed to
+	// the upload backend, not routed to it if 0.
+	UploadSizeThreshold int64
+	// The HTTP status codes of the transcoded gRPC errors of the method, by
+	// their gRPC status code.
+	GrpcStatusHttpCodes map[uint32]uint32
+	// The body of the transcoded gRPC errors of the method is replaced by the
+	// JSON format of the local replies.
+	FormatGrpcErrorBody bool
+	// The query parameters the routes of the method match.
+	QueryParamMatchers []*QueryParamMatcher
+	// The validation of the JSON request bodies of the http rules of the
+	// method, by http rule. The http rules without a body are not validated.
+	RequestBodyValidations map[*httppattern.Pattern]*RequestBodyValidation
+	// The server stream of the method is streamed as "ndjson" or "sse"
+	// instead of a JSON array, if set.
+	StreamFormat string
+	// The print options of the transcoded responses of the method, if they
+	// override the ones of the deployment.
+	TranscodingPrintOptions *TranscodingPrintOptions
+	// The "[]" suffix is stripped from the names of the query parameters of
+	// the transcoded requests of the method.
+	StripQueryArrayBrackets bool
 
 	// The request type name (not the entire type URL).
 	RequestTypeName string
@@ -48,6 +111,36 @@ type MethodInfo struct {
 	GeneratedCorsMethod *MethodInfo
 }
 
+// QueryParamMatcher matches the requests with the query parameter, and with the
+// value if not empty.
+type QueryParamMatcher struct {
+	Name  string
+	Value string
+}
+
+// RequestBodyValidation is the validation of the JSON request body of an http
+// rule.
+type RequestBodyValidation struct {
+	// The full name of the message type of the body.
+	BodyType string
+	// The paths of the fields of the body type bound by the uri template, e.g.
+	// "book.name".
+	BoundFields []string
+	// Validates the JSON type of the values, the required fields, the enum
+	// values and the range of the integers.
+	ValidateFields bool
+	// Rejects the fields not in their message type, at any depth.
+	RejectUnknownFields bool
+}
+
+// TranscodingPrintOptions are the print options of the JSON responses
+// transcoded from gRPC.
+type TranscodingPrintOptions struct {
+	AlwaysPrintPrimitiveFields bool
+	AlwaysPrintEnumsAsInts     bool
+	PreserveProtoFieldNames    bool
+}
+
 // backendInfo stores information from Backend rule for backend rerouting.
 type backendInfo struct {
 	ClusterName     string
@@ -55,6 +148,11 @@ type backendInfo struct {
 	Hostname        string
 	TranslationType confpb.BackendRule_PathTranslation
 
+	// For CONSTANT_ADDRESS, how the query parameters of the original request
+	// are kept, and the header with the original path.
+	QueryParams        string
+	OriginalPathHeader string
+
 	// Audience to use when creating a JWT for backend auth.
 	// If empty, backend auth should be disabled for the method.
 	JwtAudience string
@@ -17,19 +17,28 @@ package configinfo
 import (
 	"fmt"
 	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
 	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/common"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	codepb "google.golang.org/genproto/googleapis/rpc/code"
 	typepb "google.golang.org/genproto/protobuf/ptype"
 )
 
@@ -40,6 +49,9 @@ type ServiceInfo struct {
 
 	// An array to store all the api names
 	ApiNames []string
+	// The api names with methods served by gRPC backends, which are transcoded
+	// by the grpc-json transcoder.
+	GrpcApiNames []string
 
 	// A ordered slice of operation names. Follows the same order as the `apis.methods` in service config.
 	// All functions that output order-dependent configs should use this ordering.
@@ -59,6 +71,18 @@ type ServiceInfo struct {
 	AllowCors         bool
 	ServiceControlURI string
 	GcpAttributes     *scpb.GcpAttributes
+	// The traffic percentages of the config ids of the managed rollout in
+	// progress, keyed by config id. If set, Service Control checks and reports
+	// each request with the config id it's assigned to by the percentages.
+	RolloutPercentages map[string]float64
+	// The server certificate issued through ACME, and the key authorizations
+	// of the pending HTTP-01 challenges by token, set by the config manager
+	// with --acme_domains.
+	AcmeCertificate    *AcmeCertificate
+	AcmeHttpChallenges map[string]string
+	// The serialized FileDescriptorSet used for transcoding instead of the one
+	// in the service config, or merged into it, if set.
+	TranscodingProtoDescriptor []byte
 	// Keep a pointer to original service config. Should always process rules
 	// inside ServiceInfo.
 	serviceConfig *confpb.Service
@@ -69,6 +93,63 @@ type ServiceInfo struct {
 	GrpcSupportRequired   bool
 	LocalBackendCluster   *BackendRoutingCluster
 	RemoteBackendClusters []*BackendRoutingCluster
+
+	// The other services served by the same listener, each on the virtual host
+	// of its own domains.
+	AdditionalServices []*ServiceInfo
+
+	// The case-insensitive substrings of the user agents and of the paths of
+	// the requests denied ahead of the backends, e.g. of bots and scanners.
+	DenyUserAgents []string
+	DenyPaths      []string
+
+	// The backend of the large requests of --upload_size_thresholds, if any.
+	UploadBackendCluster *BackendRoutingCluster
+
+	// The timeouts and retries of --callout_policies by callout.
+	CalloutPolicies map[string]*CalloutPolicy
+
+	// The cached JWKS documents inlined for the providers whose jwks_uri was
+	// unavailable, by provider id.
+	CachedJwks map[string]string
+	jwksCache  *jwksCache
+
+	// The providers whose OpenID Connect Discovery failed with
+	// --defer_openid_discovery. Their tokens are rejected until the discovery
+	// succeeds.
+	DeferredOpenIDProviders map[string]bool
+
+	// The bodies of the http rules of the service config, by http rule, kept
+	// for the request body validation.
+	httpRuleBodies map[*httppattern.Pattern]string
+}
+
+// The control-plane dependencies called by Envoy and the config manager.
+const (
+	ImdsCallout            = "imds"
+	IamCallout             = "iam"
+	JwksCallout            = "jwks"
+	OpenIDDiscoveryCallout = "openid_discovery"
+	ServiceControlCallout  = "service_control"
+
+	defaultCalloutRetryBackoff = time.Second
+
+	// The OpenID Connect Discoveries run at the same time at config generation.
+	maxConcurrentOpenIDDiscoveries = 8
+)
+
+// CalloutPolicy is the timeout and retries of the calls to a control-plane
+// dependency. Retries is -1 if not set.
+type CalloutPolicy struct {
+	Timeout      time.Duration
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+// AcmeCertificate is a certificate chain and its private key, PEM encoded.
+type AcmeCertificate struct {
+	CertificateChain []byte
+	PrivateKey       []byte
 }
 
 type BackendRoutingCluster struct {
@@ -77,6 +158,8 @@ type BackendRoutingCluster struct {
 	Port        uint32
 	UseTLS      bool
 	Protocol    util.BackendProtocol
+	// The Host header of the requests routed to the cluster, kept if empty.
+	HostRewrite string
 }
 
 // NewServiceInfoFromServiceConfig returns an instance of ServiceInfo.
@@ -95,6 +178,11 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 		Options:                          opts,
 		Methods:                          make(map[string]*MethodInfo),
 		AllTranscodingIgnoredQueryParams: make(map[string]bool),
+		jwksCache:                        newJwksCache(opts.JwksCacheDir, opts.JwksCacheTtl),
+	}
+
+	if err := serviceInfo.processCalloutPolicies(); err != nil {
+		return nil, err
 	}
 
 	// Calling order is required due to following variable usage
@@ -115,7 +203,9 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 	}
 	serviceInfo.processEndpoints()
 	serviceInfo.processApis()
-	serviceInfo.processQuota()
+	if err := serviceInfo.processQuota(); err != nil {
+		return nil, err
+	}
 	if err := serviceInfo.processBackendRule(); err != nil {
 		return nil, err
 	}
@@ -127,12 +217,24 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 	}
 
 	serviceInfo.processAccessToken()
+	if err := serviceInfo.checkImpersonation(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.checkNonGCP(); err != nil {
+		return nil, err
+	}
 	if err := serviceInfo.processTypes(); err != nil {
 		return nil, err
 	}
 	if err := serviceInfo.addGrpcHttpRules(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.processGrpcHealthPassthrough(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processApiBasePath(); err != nil {
+		return nil, err
+	}
 	if err := serviceInfo.processTranscodingIgnoredQueryParams(); err != nil {
 		return nil, err
 	}
@@ -143,12 +245,69 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 	if err := serviceInfo.processEmptyJwksUriByOpenID(); err != nil {
 		return nil, err
 	}
+	serviceInfo.processJwksCache()
 	if err := serviceInfo.processLocalBackendOperations(); err != nil {
 		return nil, err
 	}
+	serviceInfo.processGrpcApis()
 	if err := serviceInfo.processAuthRequirement(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.processJwtCallerAllowlist(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processAuditMode(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processDisabledFilters(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processScOperationOverrides(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processTracingSampleRates(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processTracingSpanNameFormat(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processMaintenanceSelectors(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processResponseCacheSelectors(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processEtagSelectors(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processIdempotencySelectors(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processConcurrencyLimits(); err != nil {
+		return nil, err
+	}
+	serviceInfo.processDenyRules()
+	if err := serviceInfo.processUploadSizeThresholds(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processGrpcStatusHttpCodes(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processQueryParamMatchers(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processRequestBodyValidation(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processStreamFormats(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processTranscodingOperationPrintOptions(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processTranscodingQueryArrayStyle(); err != nil {
+		return nil, err
+	}
 
 	return serviceInfo, nil
 }
@@ -176,36 +335,259 @@ func (s *ServiceInfo) buildLocalBackend() error {
 		Hostname:    hostname,
 		Port:        port,
 	}
+
+	switch s.Options.BackendHostRewrite {
+	case "", "preserve":
+	case "backend_address":
+		s.LocalBackendCluster.HostRewrite = hostHeader(hostname, port, tls)
+	case "literal":
+		if s.Options.BackendHostRewriteLiteral == "" {
+			return fmt.Errorf("--backend_host_rewrite=literal requires --backend_host_rewrite_literal")
+		}
+		if strings.ContainsAny(s.Options.BackendHostRewriteLiteral, " /?#\r\n") {
+			return fmt.Errorf("invalid --backend_host_rewrite_literal %q, must be a host with an optional port", s.Options.BackendHostRewriteLiteral)
+		}
+		s.LocalBackendCluster.HostRewrite = s.Options.BackendHostRewriteLiteral
+	default:
+		return fmt.Errorf(`invalid --backend_host_rewrite %q, must be one of "preserve", "backend_address" or "literal"`, s.Options.BackendHostRewrite)
+	}
 	return nil
 }
 
+// hostHeader returns the Host header of a backend, with its port unless it's
+// the default one of the scheme.
+func hostHeader(hostname string, port uint32, tls bool) string {
+	if (tls && port == 443) || (!tls && port == 80) {
+		if strings.Contains(hostname, ":") {
+			// An IPv6 address.
+			return "[" + hostname + "]"
+		}
+		return hostname
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(int(port)))
+}
+
 // Returns the pointer of the ServiceConfig that this API belongs to.
 func (s *ServiceInfo) ServiceConfig() *confpb.Service {
 	return s.serviceConfig
 }
 
 func (s *ServiceInfo) processEmptyJwksUriByOpenID() error {
-	authn := s.serviceConfig.GetAuthentication()
-	for _, provider := range authn.GetProviders() {
-		jwksUri := provider.GetJwksUri()
-
+	// The providers with an empty jwks_uri by issuer, so each issuer is only
+	// discovered once.
+	var issuers []string
+	providersByIssuer := make(map[string][]*confpb.AuthProvider)
+	for _, provider := range s.serviceConfig.GetAuthentication().GetProviders() {
 		// Note: When jwksUri is empty, proxy will try to find jwksUri using the
 		// OpenID Connect Discovery protocol.
-		if jwksUri == "" {
-			if s.Options.DisableOidcDiscovery {
-				return fmt.Errorf("jwks_uri is empty for provider (%v), but OpenID Connect Discovery is disabled. "+
-					"Consider specifying the jwks_uri in the provider config", provider.Id)
+		if provider.GetJwksUri() != "" {
+			continue
+		}
+		if s.Options.DisableOidcDiscovery {
+			return fmt.Errorf("jwks_uri is empty for provider (%v), but OpenID Connect Discovery is disabled. "+
+				"Consider specifying the jwks_uri in the provider config", provider.Id)
+		}
+
+		glog.Infof("jwks_uri is empty for provider (%v), using OpenID Connect Discovery protocol", provider.Id)
+		issuer := provider.GetIssuer()
+		if _, ok := providersByIssuer[issuer]; !ok {
+			issuers = append(issuers, issuer)
+		}
+		providersByIssuer[issuer] = append(providersByIssuer[issuer], provider)
+	}
+
+	jwksUris, errs := s.resolveJwksUrisUsingOpenID(issuers)
+	var failures []string
+	for i, issuer := range issuers {
+		for _, provider := range providersByIssuer[issuer] {
+			if errs[i] == nil {
+				provider.JwksUri = jwksUris[i]
+				continue
+			}
+			if s.Options.DeferOpenIDDiscovery {
+				glog.Warningf("failed OpenID Connect Discovery protocol for provider (%v), rejecting its tokens until it succeeds: %v", provider.Id, errs[i])
+				if s.DeferredOpenIDProviders == nil {
+					s.DeferredOpenIDProviders = make(map[string]bool)
+				}
+				s.DeferredOpenIDProviders[provider.Id] = true
+				continue
 			}
+			failures = append(failures, fmt.Sprintf("provider (%v): %v", provider.Id, errs[i]))
+		}
+	}
+	if len(failures) != 0 {
+		return fmt.Errorf("failed OpenID Connect Discovery protocol: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
 
-			glog.Infof("jwks_uri is empty for provider (%v), using OpenID Connect Discovery protocol", provider.Id)
-			jwksUriByOpenID, err := util.ResolveJwksUriUsingOpenID(provider.GetIssuer())
-			if err != nil {
-				return fmt.Errorf("failed OpenID Connect Discovery protocol: %v", err)
-			} else {
-				jwksUri = jwksUriByOpenID
+// resolveJwksUrisUsingOpenID runs the OpenID Connect Discovery of the issuers
+// concurrently, at most maxConcurrentOpenIDDiscoveries at a time, so the
+// startup time is not proportional to the number of slow issuers.
+func (s *ServiceInfo) resolveJwksUrisUsingOpenID(issuers []string) ([]string, []error) {
+	jwksUris := make([]string, len(issuers))
+	errs := make([]error, len(issuers))
+	sem := make(chan struct{}, maxConcurrentOpenIDDiscoveries)
+	var wg sync.WaitGroup
+	for i, issuer := range issuers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, issuer string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			jwksUris[i], errs[i] = s.resolveJwksUriUsingOpenID(issuer)
+		}(i, issuer)
+	}
+	wg.Wait()
+	return jwksUris, errs
+}
+
+// resolveJwksUriUsingOpenID runs the OpenID Connect Discovery with the
+// timeout and retries of the openid_discovery callout, within
+// --openid_discovery_budget, reading through the JWKS cache.
+func (s *ServiceInfo) resolveJwksUriUsingOpenID(issuer string) (string, error) {
+	if cached, ok := s.jwksCache.get(openIDCacheKind, issuer); ok {
+		glog.Infof("using the cached jwks_uri %s of issuer %s", cached, issuer)
+		return string(cached), nil
+	}
+
+	policy := s.CalloutPolicies[OpenIDDiscoveryCallout]
+	if policy == nil {
+		policy = &CalloutPolicy{Retries: -1}
+	}
+	backoff := policy.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultCalloutRetryBackoff
+	}
+
+	start := time.Now()
+	for retry := 0; ; retry++ {
+		jwksUri, err := util.ResolveJwksUriUsingOpenID(issuer, s.CalloutTimeout(OpenIDDiscoveryCallout))
+		if err == nil {
+			s.jwksCache.put(openIDCacheKind, issuer, []byte(jwksUri))
+			return jwksUri, nil
+		}
+		if retry >= policy.Retries {
+			return "", err
+		}
+		if budget := s.Options.OpenIDDiscoveryBudget; budget > 0 && time.Since(start)+backoff > budget {
+			return "", fmt.Errorf("%v, retries stopped after %v by the budget of %v", err, time.Since(start), budget)
+		}
+		glog.Warningf("OpenID Connect Discovery of %s failed, retrying in %v: %v", issuer, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// processJwksCache refreshes the cached JWKS documents of the providers, and
+// inlines the cached ones of the providers whose jwks_uri is unavailable.
+func (s *ServiceInfo) processJwksCache() {
+	if s.jwksCache == nil {
+		return
+	}
+	for _, provider := range s.serviceConfig.GetAuthentication().GetProviders() {
+		if s.DeferredOpenIDProviders[provider.GetId()] {
+			continue
+		}
+		jwksUri := provider.GetJwksUri()
+		jwks, err := util.FetchJwks(jwksUri, s.CalloutTimeout(JwksCallout))
+		if err == nil {
+			s.jwksCache.put(jwksCacheKind, jwksUri, jwks)
+			continue
+		}
+
+		cached, ok := s.jwksCache.get(jwksCacheKind, jwksUri)
+		if !ok {
+			glog.Warningf("fail to fetch the JWKS of provider %s, and it is not cached: %v", provider.GetId(), err)
+			continue
+		}
+		glog.Warningf("fail to fetch the JWKS of provider %s, using the cached one: %v", provider.GetId(), err)
+		if s.CachedJwks == nil {
+			s.CachedJwks = make(map[string]string)
+		}
+		s.CachedJwks[provider.GetId()] = string(cached)
+	}
+}
+
+// CalloutTimeout returns the timeout of the calls to a control-plane
+// dependency, --http_request_timeout_s unless overridden by --callout_policies.
+func (s *ServiceInfo) CalloutTimeout(callout string) time.Duration {
+	if policy := s.CalloutPolicies[callout]; policy != nil && policy.Timeout > 0 {
+		return policy.Timeout
+	}
+	return s.Options.HttpRequestTimeout
+}
+
+func (s *ServiceInfo) processCalloutPolicies() error {
+	if s.Options.CalloutPolicies == "" {
+		return nil
+	}
+
+	s.CalloutPolicies = make(map[string]*CalloutPolicy)
+	for _, rule := range strings.Split(s.Options.CalloutPolicies, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid callout policy %q, must be in the format CALLOUT=KEY:VALUE[,KEY:VALUE...]", rule)
+		}
+		callout := strings.TrimSpace(parts[0])
+		switch callout {
+		case ImdsCallout, IamCallout, JwksCallout, OpenIDDiscoveryCallout, ServiceControlCallout:
+		default:
+			return fmt.Errorf("unknown callout %q in callout policy %q, must be one of imds, iam, jwks, openid_discovery or service_control", callout, rule)
+		}
+		if _, ok := s.CalloutPolicies[callout]; ok {
+			return fmt.Errorf("duplicate callout policy for %s", callout)
+		}
+
+		policy := &CalloutPolicy{Retries: -1}
+		for _, setting := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(setting), ":", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid setting %q in callout policy %q, must be in the format KEY:VALUE", setting, rule)
+			}
+
+			key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			switch key {
+			case "timeout":
+				d, err := time.ParseDuration(value)
+				if err != nil || d <= 0 {
+					return fmt.Errorf("invalid timeout %q in callout policy %q, must be a duration > 0", value, rule)
+				}
+				policy.Timeout = d
+			case "retries":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return fmt.Errorf("invalid retries %q in callout policy %q, must be >= 0", value, rule)
+				}
+				policy.Retries = n
+			case "retry_backoff":
+				d, err := time.ParseDuration(value)
+				if err != nil || d <= 0 {
+					return fmt.Errorf("invalid retry_backoff %q in callout policy %q, must be a duration > 0", value, rule)
+				}
+				policy.RetryBackoff = d
+			default:
+				return fmt.Errorf("unknown key %q in callout policy %q, must be one of timeout, retries or retry_backoff", key, rule)
+			}
+		}
+
+		switch callout {
+		case ImdsCallout, IamCallout, JwksCallout:
+			// Envoy retries the failed token and JWKS fetches on its own schedule.
+			if policy.Retries != -1 || policy.RetryBackoff != 0 {
+				return fmt.Errorf("only the timeout of the %s callout can be set, in callout policy %q", callout, rule)
+			}
+		case ServiceControlCallout:
+			if policy.RetryBackoff != 0 {
+				return fmt.Errorf("retry_backoff is not supported by the service_control callout, in callout policy %q", rule)
 			}
-			provider.JwksUri = jwksUri
 		}
+		s.CalloutPolicies[callout] = policy
 	}
 	return nil
 }
@@ -231,6 +613,11 @@ func (s *ServiceInfo) processApis() {
 			} else {
 				glog.Warningf("For operation (%v), request type name (%v) is in an unexpected format", selector, method.RequestTypeUrl)
 			}
+
+			if method.RequestTypeUrl == util.TypeUrlPrefix+util.HttpBodyTypeName ||
+				method.ResponseTypeUrl == util.TypeUrlPrefix+util.HttpBodyTypeName {
+				mi.IsHttpBody = true
+			}
 		}
 	}
 }
@@ -264,8 +651,107 @@ func (s *ServiceInfo) addGrpcHttpRules() error {
 	return nil
 }
 
+// processGrpcHealthPassthrough adds the method routing the Check calls of the
+// gRPC health checking protocol to the local backend, unless the service
+// config defines it.
+func (s *ServiceInfo) processGrpcHealthPassthrough() error {
+	if !s.Options.EnableGrpcHealthPassthrough {
+		return nil
+	}
+	if s.LocalBackendCluster.Protocol != util.GRPC {
+		return fmt.Errorf("--enable_grpc_health_passthrough requires a grpc:// or grpcs:// --backend_address")
+	}
+	if _, ok := s.Methods[util.GrpcHealthCheckSelector]; ok {
+		return nil
+	}
+
+	method, err := s.getOrCreateMethod(util.GrpcHealthCheckSelector)
+	if err != nil {
+		return err
+	}
+	uriTemplate, err := httppattern.ParseUriTemplate(util.GrpcHealthCheckPath)
+	if err != nil {
+		return err
+	}
+	method.HttpRule = append(method.HttpRule, &httppattern.Pattern{
+		UriTemplate: uriTemplate,
+		HttpMethod:  util.POST,
+	})
+	method.SkipServiceControl = true
+	method.IsGenerated = true
+	return nil
+}
+
+// apiBasePathRegex matches the literal path prefixes, e.g. "/gateway/v1",
+// without a trailing slash, wildcards, variables or a verb.
+var apiBasePathRegex = regexp.MustCompile(`^(/[^/*{}:?#\s]+)+$`)
+
+// processApiBasePath prepends --api_base_path to the http rules of the
+// operations. The health checks of the proxy keep their paths, they are sent
+// to the instances directly.
+func (s *ServiceInfo) processApiBasePath() error {
+	if s.Options.ApiBasePath == "" {
+		return nil
+	}
+	if !apiBasePathRegex.MatchString(s.Options.ApiBasePath) {
+		return fmt.Errorf("invalid --api_base_path %q, it must be a path prefix like /gateway/v1, without wildcards, variables or a trailing slash", s.Options.ApiBasePath)
+	}
+
+	healthCheckOperation := fmt.Sprintf("%s.%s_HealthCheck", util.EspOperation, util.AutogeneratedOperationPrefix)
+	for _, operation := range s.Operations {
+		if operation == healthCheckOperation || operation == util.GrpcHealthCheckSelector {
+			continue
+		}
+		method := s.Methods[operation]
+		for _, httpRule := range method.HttpRule {
+			httpRule.UriTemplate.AddPrefix(s.Options.ApiBasePath)
+		}
+		method.UnderApiBasePath = true
+	}
+	return nil
+}
+
+// checkNonGCP fails the config generation if --non_gcp is set but Service
+// Control or IAM would be called with the access tokens of the metadata
+// server, whose cluster is not generated. Otherwise the requests fail at
+// runtime. The project id of Cloud Trace is checked by the tracing config.
+func (s *ServiceInfo) checkNonGCP() error {
+	if !s.Options.NonGCP {
+		return nil
+	}
+
+	var missing []string
+	// An impersonated service account still needs a source access token.
+	if s.Options.ServiceAccountKey == "" && util.IsGCPMetadataProvider(s.Options.MetadataProvider) {
+		if env := s.serviceConfig.GetControl().GetEnvironment(); env != "" && !s.Options.SkipServiceControlFilter {
+			missing = append(missing, fmt.Sprintf("Service Control %s needs an access token from --service_account_key or a non-GCP --metadata_provider", env))
+		}
+		if s.Options.ServiceControlCredentials != nil || s.Options.BackendAuthCredentials != nil {
+			missing = append(missing, fmt.Sprintf("IAM %s needs an access token from --service_account_key or a non-GCP --metadata_provider", s.Options.IamURL))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the metadata server is not used with --non_gcp: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// checkImpersonation fails the config generation if the impersonated service
+// account would also be the source of the IAM calls of Envoy.
+func (s *ServiceInfo) checkImpersonation() error {
+	if s.Options.ImpersonateServiceAccount == "" {
+		return nil
+	}
+	if s.Options.ServiceControlCredentials != nil || s.Options.BackendAuthCredentials != nil {
+		return fmt.Errorf("--impersonate_service_account cannot be used together with --service_control_iam_service_account or --backend_auth_iam_service_account")
+	}
+	return nil
+}
+
 func (s *ServiceInfo) processAccessToken() {
-	if s.Options.ServiceAccountKey != "" {
+	// Service account keys, impersonated service accounts and non-GCP metadata
+	// providers serve access tokens through the token agent.
+	if s.Options.UsesTokenAgent() {
 		s.AccessToken = &commonpb.AccessToken{
 			TokenType: &commonpb.AccessToken_RemoteToken{
 				RemoteToken: &commonpb.HttpUri{
@@ -285,14 +771,14 @@ func (s *ServiceInfo) processAccessToken() {
 			RemoteToken: &commonpb.HttpUri{
 				Uri:     fmt.Sprintf("%s%s", s.Options.MetadataURL, util.AccessTokenPath),
 				Cluster: util.MetadataServerClusterName,
-				Timeout: ptypes.DurationProto(s.Options.HttpRequestTimeout),
+				Timeout: ptypes.DurationProto(s.CalloutTimeout(ImdsCallout)),
 			},
 		},
 	}
 
 }
 
-func (s *ServiceInfo) processQuota() {
+func (s *ServiceInfo) processQuota() error {
 	for _, metricRule := range s.ServiceConfig().GetQuota().GetMetricRules() {
 		var metricCosts []*scpb.MetricCost
 		for name, cost := range metricRule.GetMetricCosts() {
@@ -301,8 +787,61 @@ func (s *ServiceInfo) processQuota() {
 				Cost: cost,
 			})
 		}
+		if s.Options.DeterministicOutput {
+			// The metric costs are a map in the service config.
+			sort.Slice(metricCosts, func(i, j int) bool {
+				return metricCosts[i].GetName() < metricCosts[j].GetName()
+			})
+		}
 		s.Methods[metricRule.GetSelector()].MetricCosts = metricCosts
 	}
+	return s.processQuotaCostHeaders()
+}
+
+// processQuotaCostHeaders derives the metric costs from request headers, e.g. to
+// meter batch requests by the number of items.
+func (s *ServiceInfo) processQuotaCostHeaders() error {
+	if s.Options.QuotaCostHeaders == "" {
+		return nil
+	}
+
+	for _, rule := range strings.Split(s.Options.QuotaCostHeaders, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid quota cost header rule %q, must be in the format SELECTOR=METRIC:HEADER[,METRIC:HEADER...]", rule)
+		}
+
+		selector := strings.TrimSpace(parts[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("quota cost header selector %s is not defined in Api.method or Http.rule", selector)
+		}
+
+		for _, setting := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(setting), ":", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+				return fmt.Errorf("invalid setting %q in quota cost header rule %q, must be in the format METRIC:HEADER", setting, rule)
+			}
+
+			metric, header := strings.TrimSpace(kv[0]), strings.ToLower(strings.TrimSpace(kv[1]))
+			found := false
+			for _, metricCost := range method.MetricCosts {
+				if metricCost.GetName() == metric {
+					metricCost.CostHeader = header
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("metric %s in quota cost header rule %q is not defined in the quota metric rules of %s", metric, rule, selector)
+			}
+		}
+	}
+	return nil
 }
 
 func (s *ServiceInfo) processEndpoints() {
@@ -313,42 +852,27 @@ func (s *ServiceInfo) processEndpoints() {
 	}
 }
 
-func addHttpRule(method *MethodInfo, r *annotationspb.HttpRule, addedRouteMatchWithOptionsSet map[string]bool) error {
-	var path string
-	var uriTemplate *httppattern.UriTemplate
-	var parseError error
-	var httpMethod string
-	switch r.GetPattern().(type) {
-	case *annotationspb.HttpRule_Get:
-		path = r.GetGet()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.GET
-	case *annotationspb.HttpRule_Put:
-		path = r.GetPut()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.PUT
-	case *annotationspb.HttpRule_Post:
-		path = r.GetPost()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.POST
-	case *annotationspb.HttpRule_Delete:
-		path = r.GetDelete()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.DELETE
-	case *annotationspb.HttpRule_Patch:
-		path = r.GetPatch()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.PATCH
-	case *annotationspb.HttpRule_Custom:
-		path = r.GetCustom().GetPath()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = r.GetCustom().GetKind()
-	default:
+// addHttpRule adds the http rule to the method. The uri templates are parsed
+// once per path, the parsed ones are cloned from uriTemplates.
+func addHttpRule(method *MethodInfo, r *annotationspb.HttpRule, addedRouteMatchWithOptionsSet map[string]bool, uriTemplates map[string]*httppattern.UriTemplate) error {
+	path, httpMethod, ok := httpRulePattern(r)
+	if !ok {
 		return fmt.Errorf("operation(%s): unsupported http method %T", method.Operation(), r.GetPattern())
 	}
+	// The custom http method "*" matches all the http methods.
+	if httpMethod != httppattern.HttpMethodWildCard && !customHttpMethodRegex.MatchString(httpMethod) {
+		return fmt.Errorf("operation(%s): invalid custom http method %q", method.Operation(), r.GetCustom().GetKind())
+	}
 
-	if parseError != nil {
-		return fmt.Errorf("operation(%s): %v", method.Operation(), parseError)
+	uriTemplate, ok := uriTemplates[path]
+	if ok {
+		uriTemplate = uriTemplate.Clone()
+	} else {
+		var err error
+		if uriTemplate, err = httppattern.ParseUriTemplate(path); err != nil {
+			return fmt.Errorf("operation(%s): %v", method.Operation(), err)
+		}
+		uriTemplates[path] = uriTemplate.Clone()
 	}
 
 	if httpMethod == util.OPTIONS {
@@ -365,28 +889,89 @@ func addHttpRule(method *MethodInfo, r *annotationspb.HttpRule, addedRouteMatchW
 	return nil
 }
 
+// httpRulePattern returns the path and the http method of the http rule.
+func httpRulePattern(r *annotationspb.HttpRule) (string, string, bool) {
+	switch r.GetPattern().(type) {
+	case *annotationspb.HttpRule_Get:
+		return r.GetGet(), util.GET, true
+	case *annotationspb.HttpRule_Put:
+		return r.GetPut(), util.PUT, true
+	case *annotationspb.HttpRule_Post:
+		return r.GetPost(), util.POST, true
+	case *annotationspb.HttpRule_Delete:
+		return r.GetDelete(), util.DELETE, true
+	case *annotationspb.HttpRule_Patch:
+		return r.GetPatch(), util.PATCH, true
+	case *annotationspb.HttpRule_Custom:
+		return r.GetCustom().GetPath(), r.GetCustom().GetKind(), true
+	default:
+		return "", "", false
+	}
+}
+
+// customHttpMethodRegex matches the HTTP method tokens of RFC 7230, e.g.
+// "REPORT" or "PROPFIND". The methods are case-sensitive.
+var customHttpMethodRegex = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// parseUriTemplates parses the paths of the http rules in parallel. The paths
+// failing to parse are left out, to be reported with their operation when
+// adding the http rules in order.
+func parseUriTemplates(rules []*annotationspb.HttpRule) map[string]*httppattern.UriTemplate {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		for _, r := range append([]*annotationspb.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+			if path, _, ok := httpRulePattern(r); ok && !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	parsed := make([]*httppattern.UriTemplate, len(paths))
+	_ = util.ForEachIndex(len(paths), func(i int) error {
+		if uriTemplate, err := httppattern.ParseUriTemplate(paths[i]); err == nil {
+			parsed[i] = uriTemplate
+		}
+		return nil
+	})
+
+	uriTemplates := make(map[string]*httppattern.UriTemplate, len(paths))
+	for i, path := range paths {
+		if parsed[i] != nil {
+			uriTemplates[path] = parsed[i]
+		}
+	}
+	return uriTemplates
+}
+
 func (s *ServiceInfo) processHttpRule() error {
 	// An temporary map to record added route match with Options set,
 	// to avoid duplication.
 	addedRouteMatchWithOptionsSet := make(map[string]bool)
+	// The parsed uri templates by path, shared by the methods bound to the
+	// same path.
+	uriTemplates := parseUriTemplates(s.ServiceConfig().GetHttp().GetRules())
 
 	for _, rule := range s.ServiceConfig().GetHttp().GetRules() {
 		method, err := s.getOrCreateMethod(rule.GetSelector())
 		if err != nil {
 			return err
 		}
-		if err := addHttpRule(method, rule, addedRouteMatchWithOptionsSet); err != nil {
+		if err := addHttpRule(method, rule, addedRouteMatchWithOptionsSet, uriTemplates); err != nil {
 			return err
 		}
+		s.keepHttpRuleBody(method, rule)
 
 		// additional_bindings cannot be nested inside themselves according to
 		// https://aip.dev/127. Service Management will enforce this restriction
 		// when interpret the httprules from the descriptor. Therefore, no need to
 		// check for nested additional_bindings.
 		for _, additionalRule := range rule.AdditionalBindings {
-			if err := addHttpRule(method, additionalRule, addedRouteMatchWithOptionsSet); err != nil {
+			if err := addHttpRule(method, additionalRule, addedRouteMatchWithOptionsSet, uriTemplates); err != nil {
 				return err
 			}
+			s.keepHttpRuleBody(method, additionalRule)
 		}
 	}
 
@@ -397,10 +982,9 @@ func (s *ServiceInfo) processHttpRule() error {
 			method := s.Methods[r.GetSelector()]
 			for _, httpRule := range method.HttpRule {
 				if httpRule.HttpMethod != util.OPTIONS {
-					uriTemplate, _ := httppattern.ParseUriTemplate(httpRule.UriTemplate.Origin)
 					newHttpRule := &httppattern.Pattern{
 						HttpMethod:  util.OPTIONS,
-						UriTemplate: uriTemplate,
+						UriTemplate: httpRule.UriTemplate.Clone(),
 					}
 					routeMatch := httpRule.UriTemplate.Regex()
 
@@ -441,6 +1025,18 @@ func (s *ServiceInfo) processHttpRule() error {
 	return nil
 }
 
+// keepHttpRuleBody keeps the body of the http rule last added to the method,
+// if the request bodies are validated.
+func (s *ServiceInfo) keepHttpRuleBody(method *MethodInfo, r *annotationspb.HttpRule) {
+	if (!s.Options.TranscodingValidateRequestBody && !s.Options.TranscodingRejectUnknownBodyFields) || r.GetBody() == "" {
+		return
+	}
+	if s.httpRuleBodies == nil {
+		s.httpRuleBodies = make(map[*httppattern.Pattern]string)
+	}
+	s.httpRuleBodies[method.HttpRule[len(method.HttpRule)-1]] = r.GetBody()
+}
+
 func (s *ServiceInfo) addOptionMethod(originalMethod *MethodInfo, httpRule *httppattern.Pattern) error {
 	if httpRule.HttpMethod != util.OPTIONS {
 		return fmt.Errorf("find `%s %s` when adding OPTIONS method for operation(%s)", httpRule.HttpMethod, httpRule.Origin, originalMethod.Operation())
@@ -464,9 +1060,18 @@ func (s *ServiceInfo) addOptionMethod(originalMethod *MethodInfo, httpRule *http
 }
 
 func (s *ServiceInfo) processBackendRule() error {
-	backendRoutingClustersMap := make(map[string]string)
+	switch s.Options.PathRewriteQueryParams {
+	case "", "preserve", "merge", "drop":
+	default:
+		return fmt.Errorf(`invalid --path_rewrite_query_params %q, must be one of "preserve", "merge" or "drop"`, s.Options.PathRewriteQueryParams)
+	}
+	if strings.ContainsAny(s.Options.PathRewriteOriginalPathHeader, " :\r\n") {
+		return fmt.Errorf("invalid --path_rewrite_original_path_header %q, must be a header name", s.Options.PathRewriteOriginalPathHeader)
+	}
+
+	backendRoutingClustersMap := make(map[string]string)
 
-	for _, r := range s.ServiceConfig().Backend.GetRules() {
+	for _, r := range s.expandBackendRules(s.ServiceConfig().Backend.GetRules()) {
 
 		if r.Address == "" {
 			// Processing a backend rule associated with the local backend.
@@ -513,8 +1118,101 @@ func (s *ServiceInfo) processBackendRule() error {
 	return nil
 }
 
+// expandBackendRules replaces the backend rules with a wildcard or API name
+// selector by one rule for each matching method.
+func (s *ServiceInfo) expandBackendRules(rules []*confpb.BackendRule) []*confpb.BackendRule {
+	var selectors []string
+	for _, r := range rules {
+		selectors = append(selectors, r.GetSelector())
+	}
+
+	var expanded []*confpb.BackendRule
+	for _, rs := range s.expandSelectors(selectors) {
+		rule := rules[rs.index]
+		if rule.GetSelector() != rs.selector {
+			rule = proto.Clone(rule).(*confpb.BackendRule)
+			rule.Selector = rs.selector
+		}
+		expanded = append(expanded, rule)
+	}
+	return expanded
+}
+
+// ruleSelector is a method selector and the index of the rule applying to it.
+type ruleSelector struct {
+	selector string
+	index    int
+}
+
+// expandSelectors returns the method selectors of the rules with the given
+// selectors. A wildcard selector, e.g. "library.v1.*", or an API name selector
+// applies to each method of the matching APIs, unless a rule with the method
+// selector or with a longer prefix overrides it. The first rule wins the ties.
+// The other selectors are kept as is.
+func (s *ServiceInfo) expandSelectors(selectors []string) []ruleSelector {
+	var expanded []ruleSelector
+	methodSelectors := make(map[string]bool)
+	inherited := make(map[string]int)
+	inheritedPrefixes := make(map[string]string)
+
+	for i, selector := range selectors {
+		prefix, ok := s.selectorPrefix(selector)
+		if !ok {
+			expanded = append(expanded, ruleSelector{selector: selector, index: i})
+			methodSelectors[selector] = true
+			continue
+		}
+
+		matched := false
+		for _, operation := range s.Operations {
+			if !strings.HasPrefix(operation, prefix) {
+				continue
+			}
+			matched = true
+			if _, exist := inherited[operation]; !exist || len(prefix) > len(inheritedPrefixes[operation]) {
+				inherited[operation] = i
+				inheritedPrefixes[operation] = prefix
+			}
+		}
+		if !matched {
+			glog.Warningf("rule with selector %q does not match any method, it is ignored", selector)
+		}
+	}
+
+	for _, operation := range s.Operations {
+		i, exist := inherited[operation]
+		if !exist || methodSelectors[operation] {
+			continue
+		}
+		expanded = append(expanded, ruleSelector{selector: operation, index: i})
+	}
+	return expanded
+}
+
+// selectorPrefix returns the prefix of the method selectors matched by a
+// wildcard or API name selector.
+func (s *ServiceInfo) selectorPrefix(selector string) (string, bool) {
+	if selector == "*" {
+		return "", true
+	}
+	if strings.HasSuffix(selector, ".*") {
+		return strings.TrimSuffix(selector, "*"), true
+	}
+	for _, apiName := range s.ApiNames {
+		if selector == apiName {
+			return selector + ".", true
+		}
+	}
+	return "", false
+}
+
 func (s *ServiceInfo) addBackendInfoToMethod(r *confpb.BackendRule, scheme string, hostname string, path string, backendClusterName string) error {
-	method, err := s.getOrCreateMethod(r.GetSelector())
+	method, err := s.getOrCreateRuleMethod("backend", r.GetSelector())
+	if err != nil {
+		return err
+	}
+
+	jwtAud, err := s.determineBackendAuthJwtAud(r, scheme, hostname, path)
 	if err != nil {
 		return err
 	}
@@ -550,9 +1248,13 @@ func (s *ServiceInfo) addBackendInfoToMethod(r *confpb.BackendRule, scheme strin
 		RetryOns:        s.Options.BackendRetryOns,
 		RetryNum:        s.Options.BackendRetryNum,
 	}
+	if r.PathTranslation == confpb.BackendRule_CONSTANT_ADDRESS {
+		method.BackendInfo.QueryParams = s.Options.PathRewriteQueryParams
+		method.BackendInfo.OriginalPathHeader = s.Options.PathRewriteOriginalPathHeader
+	}
 
-	jwtAud := s.determineBackendAuthJwtAud(r, scheme, hostname)
-	if jwtAud != "" && s.Options.CommonOptions.NonGCP {
+	// The impersonated service account gets its identity tokens from IAM.
+	if jwtAud != "" && s.Options.ImpersonateServiceAccount == "" && (s.Options.CommonOptions.NonGCP || !util.IsGCPMetadataProvider(s.Options.MetadataProvider)) {
 		glog.Warningf("Backend authentication is enabled for method %v, "+
 			"but ESPv2 is running on non-GCP. To prevent contacting GCP services, "+
 			"backend authentication is automatically being disabled for this method.",
@@ -564,22 +1266,70 @@ func (s *ServiceInfo) addBackendInfoToMethod(r *confpb.BackendRule, scheme strin
 	return nil
 }
 
-func (s *ServiceInfo) determineBackendAuthJwtAud(r *confpb.BackendRule, scheme string, hostname string) string {
+func (s *ServiceInfo) determineBackendAuthJwtAud(r *confpb.BackendRule, scheme string, hostname string, path string) (string, error) {
 	//TODO(taoxuy): b/149334660 Check if the scopes for IAM include the path prefix
+	aud := s.Options.BackendAuthJwtAudienceTemplate
 	switch r.GetAuthentication().(type) {
 	case *confpb.BackendRule_JwtAudience:
-		return r.GetJwtAudience()
+		// An explicit empty audience keeps backend auth off.
+		if aud = r.GetJwtAudience(); aud == "" {
+			return "", nil
+		}
 	case *confpb.BackendRule_DisableAuth:
 		if r.GetDisableAuth() {
-			return ""
+			return "", nil
 		}
-		return getJwtAudienceFromBackendAddr(scheme, hostname)
 	default:
 		if r.Address == "" {
-			return ""
+			return "", nil
+		}
+	}
+
+	if aud == "" {
+		return getJwtAudienceFromBackendAddr(scheme, hostname), nil
+	}
+
+	aud, err := s.expandJwtAudienceTemplate(aud, scheme, hostname, path)
+	if err != nil {
+		return "", fmt.Errorf("invalid jwt audience for backend rule %v: %v", r.GetSelector(), err)
+	}
+	return aud, nil
+}
+
+// Expands the placeholders in a jwt audience template.
+// Audiences without placeholders are returned unchanged.
+func (s *ServiceInfo) expandJwtAudienceTemplate(template, scheme, hostname, path string) (string, error) {
+	if !strings.Contains(template, "{") {
+		return template, nil
+	}
+
+	// Same as getJwtAudienceFromBackendAddr, grpc/grpcs is changed to http/https.
+	_, tls, _ := util.ParseBackendProtocol(scheme, "")
+	audScheme := "http"
+	if tls {
+		audScheme = "https"
+	}
+
+	var unknown []string
+	aud := jwtAudiencePlaceholderRegex.ReplaceAllStringFunc(template, func(placeholder string) string {
+		switch placeholder {
+		case "{scheme}":
+			return audScheme
+		case "{hostname}":
+			return hostname
+		case "{path}":
+			return path
+		case "{service_name}":
+			return s.Name
+		default:
+			unknown = append(unknown, placeholder)
+			return placeholder
 		}
-		return getJwtAudienceFromBackendAddr(scheme, hostname)
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown placeholders %v in template %q", unknown, template)
 	}
+	return aud, nil
 }
 
 // For methods that are not associated with any backend rules, create one
@@ -603,15 +1353,68 @@ func (s *ServiceInfo) processLocalBackendOperations() error {
 	return nil
 }
 
+// processGrpcApis collects the apis with methods routed to gRPC backends, local
+// or remote, so that the apis served by HTTP backends are not transcoded.
+// An api without methods follows the local backend.
+func (s *ServiceInfo) processGrpcApis() {
+	grpcClusters := make(map[string]bool)
+	for _, cluster := range append([]*BackendRoutingCluster{s.LocalBackendCluster}, s.RemoteBackendClusters...) {
+		if cluster.Protocol == util.GRPC {
+			grpcClusters[cluster.ClusterName] = true
+		}
+	}
+
+	grpcApis := make(map[string]bool)
+	hasMethods := make(map[string]bool)
+	for _, method := range s.Methods {
+		if method.IsGenerated || method.BackendInfo == nil {
+			continue
+		}
+		hasMethods[method.ApiName] = true
+		if grpcClusters[method.BackendInfo.ClusterName] {
+			grpcApis[method.ApiName] = true
+		}
+	}
+
+	for _, apiName := range s.ApiNames {
+		if grpcApis[apiName] || (!hasMethods[apiName] && s.LocalBackendCluster.Protocol == util.GRPC) {
+			s.GrpcApiNames = append(s.GrpcApiNames, apiName)
+		}
+	}
+}
+
 func (s *ServiceInfo) processUsageRule() error {
-	for _, r := range s.ServiceConfig().GetUsage().GetRules() {
-		method, err := s.getOrCreateMethod(r.GetSelector())
+	rules := s.ServiceConfig().GetUsage().GetRules()
+	var selectors []string
+	for _, r := range rules {
+		selectors = append(selectors, r.GetSelector())
+	}
+	for _, rs := range s.expandSelectors(selectors) {
+		r := rules[rs.index]
+		method, err := s.getOrCreateRuleMethod("usage", rs.selector)
 		if err != nil {
 			return err
 		}
 		method.AllowUnregisteredCalls = r.GetAllowUnregisteredCalls()
 		method.SkipServiceControl = r.GetSkipServiceControl()
 	}
+
+	if s.Options.ScSkipCheck {
+		for _, method := range s.Methods {
+			method.SkipServiceControlCheck = true
+		}
+	}
+	for _, selector := range strings.Split(s.Options.ScSkipCheckSelectors, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --service_control_skip_check_selectors is not defined in Api.method or Http.rule", selector)
+		}
+		method.SkipServiceControlCheck = true
+	}
 	return nil
 }
 
@@ -653,7 +1456,18 @@ func (s *ServiceInfo) processTranscodingIgnoredQueryParams() error {
 }
 
 func (s *ServiceInfo) processApiKeyLocations() error {
-	for _, rule := range s.ServiceConfig().GetSystemParameters().GetRules() {
+	extraLocations, err := s.parseApiKeyLocationsOption()
+	if err != nil {
+		return err
+	}
+
+	rules := s.ServiceConfig().GetSystemParameters().GetRules()
+	var selectors []string
+	for _, rule := range rules {
+		selectors = append(selectors, rule.GetSelector())
+	}
+	for _, rs := range s.expandSelectors(selectors) {
+		rule := rules[rs.index]
 		apiKeyLocationParameters := []*confpb.SystemParameter{}
 
 		for _, parameter := range rule.GetParameters() {
@@ -662,7 +1476,7 @@ func (s *ServiceInfo) processApiKeyLocations() error {
 			}
 		}
 
-		method, err := s.getOrCreateMethod(rule.GetSelector())
+		method, err := s.getOrCreateRuleMethod("system parameter", rs.selector)
 		if err != nil {
 			return err
 		}
@@ -677,13 +1491,87 @@ func (s *ServiceInfo) processApiKeyLocations() error {
 		if len(method.ApiKeyLocations) == 0 {
 			s.AllTranscodingIgnoredQueryParams[util.DefaultApiKeyQueryParamKey] = true
 			s.AllTranscodingIgnoredQueryParams[util.DefaultApiKeyQueryParamApiKey] = true
-		}
 
+			// The default locations only apply when no locations are set, so
+			// keep them explicitly before the additional locations.
+			if len(extraLocations) > 0 {
+				method.ApiKeyLocations = defaultApiKeyLocations()
+			}
+		}
+		method.ApiKeyLocations = append(method.ApiKeyLocations, extraLocations...)
 	}
 
 	return nil
 }
 
+// parseApiKeyLocationsOption parses the additional API key locations from
+// options, e.g. "query=key,header=Authorization:ApiKey,cookie=api_key".
+func (s *ServiceInfo) parseApiKeyLocationsOption() ([]*scpb.ApiKeyLocation, error) {
+	var locations []*scpb.ApiKeyLocation
+	for _, location := range strings.Split(s.Options.ApiKeyLocations, ",") {
+		location = strings.TrimSpace(location)
+		if location == "" {
+			continue
+		}
+
+		parts := strings.SplitN(location, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid api key location %q, must be one of query=NAME, header=NAME, header=NAME:PREFIX or cookie=NAME", location)
+		}
+
+		switch kind, name := parts[0], parts[1]; kind {
+		case "query":
+			locations = append(locations, &scpb.ApiKeyLocation{
+				Key: &scpb.ApiKeyLocation_Query{
+					Query: name,
+				},
+			})
+			s.AllTranscodingIgnoredQueryParams[name] = true
+		case "header":
+			// Header names cannot contain ':', the rest is the value prefix.
+			headerParts := strings.SplitN(name, ":", 2)
+			apiKeyLocation := &scpb.ApiKeyLocation{
+				Key: &scpb.ApiKeyLocation_Header{
+					Header: headerParts[0],
+				},
+			}
+			if len(headerParts) == 2 {
+				apiKeyLocation.ValuePrefix = headerParts[1]
+			}
+			locations = append(locations, apiKeyLocation)
+		case "cookie":
+			locations = append(locations, &scpb.ApiKeyLocation{
+				Key: &scpb.ApiKeyLocation_Cookie{
+					Cookie: name,
+				},
+			})
+		default:
+			return nil, fmt.Errorf("invalid api key location %q, must be one of query=NAME, header=NAME, header=NAME:PREFIX or cookie=NAME", location)
+		}
+	}
+	return locations, nil
+}
+
+func defaultApiKeyLocations() []*scpb.ApiKeyLocation {
+	return []*scpb.ApiKeyLocation{
+		{
+			Key: &scpb.ApiKeyLocation_Query{
+				Query: util.DefaultApiKeyQueryParamKey,
+			},
+		},
+		{
+			Key: &scpb.ApiKeyLocation_Query{
+				Query: util.DefaultApiKeyQueryParamApiKey,
+			},
+		},
+		{
+			Key: &scpb.ApiKeyLocation_Header{
+				Header: util.DefaultApiKeyHeader,
+			},
+		},
+	}
+}
+
 func (s *ServiceInfo) extractApiKeyLocations(method *MethodInfo, parameters []*confpb.SystemParameter) {
 	var urlQueryNames, headerNames []*scpb.ApiKeyLocation
 	for _, parameter := range parameters {
@@ -792,13 +1680,61 @@ func (s *ServiceInfo) getOrCreateMethod(name string) (*MethodInfo, error) {
 	return s.Methods[name], nil
 }
 
+// getOrCreateRuleMethod returns the method of a rule selector. With
+// --strict_selector_validation, the selector must be a method of the apis.
+func (s *ServiceInfo) getOrCreateRuleMethod(ruleKind, selector string) (*MethodInfo, error) {
+	if s.Options.StrictSelectorValidation && !s.isApiMethod(selector) {
+		return nil, fmt.Errorf("%s rule selector %s is not defined in apis.methods", ruleKind, selector)
+	}
+	return s.getOrCreateMethod(selector)
+}
+
+func (s *ServiceInfo) isApiMethod(selector string) bool {
+	for _, api := range s.serviceConfig.GetApis() {
+		for _, method := range api.GetMethods() {
+			if selector == fmt.Sprintf("%s.%s", api.GetName(), method.GetName()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s *ServiceInfo) LocalBackendClusterName() string {
 	return util.BackendClusterName(fmt.Sprintf("%s_local", s.Name))
 }
 
+func (s *ServiceInfo) UploadBackendClusterName() string {
+	return util.BackendClusterName(fmt.Sprintf("%s_upload", s.Name))
+}
+
+// AuthenticationRules returns the authentication rules with a method selector,
+// the rules with a wildcard or API name selector are expanded to the matching
+// methods.
+func (s *ServiceInfo) AuthenticationRules() []*confpb.AuthenticationRule {
+	rules := s.serviceConfig.GetAuthentication().GetRules()
+	var selectors []string
+	for _, rule := range rules {
+		selectors = append(selectors, rule.GetSelector())
+	}
+
+	var expanded []*confpb.AuthenticationRule
+	for _, rs := range s.expandSelectors(selectors) {
+		rule := rules[rs.index]
+		if rule.GetSelector() != rs.selector {
+			rule = proto.Clone(rule).(*confpb.AuthenticationRule)
+			rule.Selector = rs.selector
+		}
+		expanded = append(expanded, rule)
+	}
+	return expanded
+}
+
 func (s *ServiceInfo) processAuthRequirement() error {
-	auth := s.serviceConfig.GetAuthentication()
-	for _, rule := range auth.GetRules() {
+	for _, rule := range s.AuthenticationRules() {
+		if s.Options.StrictSelectorValidation && !s.isApiMethod(rule.GetSelector()) {
+			return fmt.Errorf("authentication rule selector %s is not defined in apis.methods", rule.GetSelector())
+		}
 		if len(rule.GetRequirements()) > 0 {
 			if s.Methods[rule.GetSelector()] == nil {
 				return fmt.Errorf("Authentication selector %s is not defined in Api.method or Http.rule", rule.GetSelector())
@@ -809,6 +1745,923 @@ func (s *ServiceInfo) processAuthRequirement() error {
 	return nil
 }
 
+var jwtAudiencePlaceholderRegex = regexp.MustCompile(`\{[^{}]*\}`)
+
+func (s *ServiceInfo) processJwtCallerAllowlist() error {
+	if s.Options.JwtCallerAllowlist == "" {
+		return nil
+	}
+
+	for _, rule := range strings.Split(s.Options.JwtCallerAllowlist, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid jwt caller allowlist rule %q, must be in the format SELECTOR=CALLER[,CALLER...]", rule)
+		}
+
+		selector := strings.TrimSpace(parts[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("jwt caller allowlist selector %s is not defined in Api.method or Http.rule", selector)
+		}
+		if !method.RequireAuth {
+			return fmt.Errorf("jwt caller allowlist selector %s has no authentication requirement", selector)
+		}
+
+		for _, caller := range strings.Split(parts[1], ",") {
+			if caller = strings.TrimSpace(caller); caller != "" {
+				method.AllowedCallers = append(method.AllowedCallers, caller)
+			}
+		}
+		if len(method.AllowedCallers) == 0 {
+			return fmt.Errorf("jwt caller allowlist rule %q has no callers", rule)
+		}
+	}
+	return nil
+}
+
+// The filters that can be disabled per operation. The filters without a
+// per-route config, like the transcoder, apply to all the operations.
+var perOperationFilters = map[string]bool{
+	util.JwtAuthn:       true,
+	util.RBAC:           true,
+	util.BackendAuth:    true,
+	util.PathRewrite:    true,
+	util.ServiceControl: true,
+}
+
+// processDisabledFilters parses the filters disabled per operation in the
+// format "SELECTOR=FILTER[,FILTER...][;SELECTOR=...]".
+func (s *ServiceInfo) processDisabledFilters() error {
+	for _, rule := range strings.Split(s.Options.DisabledFilters, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid disabled filters rule %q, must be in the format SELECTOR=FILTER[,FILTER...]", rule)
+		}
+
+		selector := strings.TrimSpace(parts[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("disabled filters selector %s is not defined in Api.method or Http.rule", selector)
+		}
+
+		for _, filter := range strings.Split(parts[1], ",") {
+			filter = strings.TrimSpace(filter)
+			if filter == "" {
+				continue
+			}
+			if filter == util.GRPCJSONTranscoder {
+				return fmt.Errorf("filter %s of selector %s cannot be disabled: the transcoder has no per-route config, it transcodes the requests matching the HTTP rules of the proto descriptor on all the routes", filter, selector)
+			}
+			if !perOperationFilters[filter] {
+				return fmt.Errorf("filter %s of selector %s cannot be disabled per operation", filter, selector)
+			}
+			if method.DisabledFilters == nil {
+				method.DisabledFilters = make(map[string]bool)
+			}
+			method.DisabledFilters[filter] = true
+		}
+		if len(method.DisabledFilters) == 0 {
+			return fmt.Errorf("disabled filters rule %q has no filters", rule)
+		}
+
+		// The caller allowlist checks the JWT payload, which is only there
+		// once the JWT is validated.
+		if method.DisabledFilters[util.JwtAuthn] && !method.DisabledFilters[util.RBAC] && len(method.AllowedCallers) > 0 {
+			return fmt.Errorf("filter %s of selector %s cannot be disabled with a jwt caller allowlist, unless %s is disabled too", util.JwtAuthn, selector, util.RBAC)
+		}
+		if method.DisabledFilters[util.ServiceControl] {
+			if method.AuditMode {
+				return fmt.Errorf("filter %s of selector %s cannot be disabled in audit mode, it logs the failures", util.ServiceControl, selector)
+			}
+			method.SkipServiceControl = true
+		}
+	}
+	return nil
+}
+
+// processTracingSampleRates parses the per-operation trace sampling rates in
+// the format "SELECTOR=RATE[,SELECTOR=RATE...]".
+func (s *ServiceInfo) processTracingSampleRates() error {
+	for _, entry := range strings.Split(s.Options.TracingOperationSampleRates, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("invalid trace sampling rate override %q, must be in the format SELECTOR=RATE", entry)
+		}
+
+		selector := strings.TrimSpace(kv[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("trace sampling rate override selector %s is not defined in Api.method or Http.rule", selector)
+		}
+
+		rate, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || rate < 0.0 || rate > 1.0 {
+			return fmt.Errorf("invalid trace sampling rate %q for selector %s, must be >= 0.0 and <= 1.0", strings.TrimSpace(kv[1]), selector)
+		}
+		method.TracingSampleRate = &rate
+	}
+	return nil
+}
+
+var tracingSpanNamePlaceholderRegex = regexp.MustCompile(`\{[^{}]*\}`)
+
+var tracingSpanNamePlaceholders = map[string]bool{
+	"{PREFIX}":      true,
+	"{API}":         true,
+	"{METHOD}":      true,
+	"{HTTP_METHOD}": true,
+}
+
+// processTracingSpanNameFormat checks the placeholders of the span name
+// format of the operations.
+func (s *ServiceInfo) processTracingSpanNameFormat() error {
+	if s.Options.TracingDisableDecorators {
+		return nil
+	}
+	if strings.TrimSpace(s.Options.TracingSpanNameFormat) == "" {
+		return fmt.Errorf("--tracing_span_name_format cannot be empty unless --tracing_disable_decorators is set")
+	}
+	for _, placeholder := range tracingSpanNamePlaceholderRegex.FindAllString(s.Options.TracingSpanNameFormat, -1) {
+		if !tracingSpanNamePlaceholders[placeholder] {
+			return fmt.Errorf("invalid --tracing_span_name_format %q, unknown placeholder %s", s.Options.TracingSpanNameFormat, placeholder)
+		}
+	}
+	return nil
+}
+
+// processAuditMode marks the methods in audit mode, whose JWT authentication,
+// API key and quota failures are logged and reported instead of rejecting the
+// requests.
+func (s *ServiceInfo) processAuditMode() error {
+	if s.Options.AuditMode {
+		for _, method := range s.Methods {
+			method.AuditMode = true
+		}
+	}
+	for _, selector := range strings.Split(s.Options.AuditModeSelectors, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --audit_mode_selectors is not defined in Api.method or Http.rule", selector)
+		}
+		method.AuditMode = true
+	}
+
+	// The failures are only logged by the service control filter, JWT Authn
+	// filter lets them through silently.
+	for _, method := range s.Methods {
+		if method.AuditMode && (s.ServiceConfig().GetControl().GetEnvironment() == "" || s.Options.SkipServiceControlFilter) {
+			return fmt.Errorf("audit mode requires the service control filter, which logs the failures, but the service config has no control environment or the filter is skipped")
+		}
+	}
+	return nil
+}
+
+// processMaintenanceSelectors marks the operations in maintenance, which
+// respond with the maintenance status code instead of reaching the backend.
+func (s *ServiceInfo) processMaintenanceSelectors() error {
+	if s.Options.MaintenanceSelectors == "" {
+		return nil
+	}
+	if code := s.Options.MaintenanceStatusCode; code != http.StatusServiceUnavailable && code != http.StatusLocked {
+		return fmt.Errorf("invalid maintenance status code %d, must be %d or %d", code, http.StatusServiceUnavailable, http.StatusLocked)
+	}
+	if s.Options.MaintenanceRetryAfter < 0 {
+		return fmt.Errorf("invalid maintenance retry after %v, must not be negative", s.Options.MaintenanceRetryAfter)
+	}
+
+	for _, selector := range strings.Split(s.Options.MaintenanceSelectors, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --maintenance_selectors is not defined in Api.method or Http.rule", selector)
+		}
+		method.InMaintenance = true
+	}
+	return nil
+}
+
+// processResponseCacheSelectors sets the time the responses of the GET
+// operations in --response_cache_selectors are cached.
+func (s *ServiceInfo) processResponseCacheSelectors() error {
+	if s.Options.ResponseCacheSelectors == "" {
+		return nil
+	}
+	if s.Options.ResponseCacheTtl <= 0 {
+		return fmt.Errorf("invalid response cache ttl %v, must be positive", s.Options.ResponseCacheTtl)
+	}
+
+	for _, entry := range strings.Split(s.Options.ResponseCacheSelectors, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		selector := strings.TrimSpace(kv[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --response_cache_selectors is not defined in Api.method or Http.rule", selector)
+		}
+		isGet := false
+		for _, httpRule := range method.HttpRule {
+			isGet = isGet || httpRule.HttpMethod == util.GET
+		}
+		if !isGet {
+			return fmt.Errorf("selector %s in --response_cache_selectors is not a GET operation", selector)
+		}
+
+		ttl := s.Options.ResponseCacheTtl
+		if len(kv) == 2 {
+			var err error
+			if ttl, err = time.ParseDuration(strings.TrimSpace(kv[1])); err != nil || ttl <= 0 {
+				return fmt.Errorf("invalid response cache ttl %q for selector %s, must be a positive duration", strings.TrimSpace(kv[1]), selector)
+			}
+		}
+		method.ResponseCacheTtl = ttl
+		method.ResponseCacheKeyHeaders, method.ResponseCacheApiKeyQueryParams = responseCacheKey(s.Options.ResponseCacheKeyHeaders, method.ApiKeyLocations)
+	}
+	return nil
+}
+
+// responseCacheKey returns the request headers of the cache key, and the query
+// parameters carrying the API keys, so the responses for an API key are never
+// served to the callers of another one.
+func responseCacheKey(keyHeaders string, apiKeyLocations []*scpb.ApiKeyLocation) ([]string, []string) {
+	if len(apiKeyLocations) == 0 {
+		apiKeyLocations = defaultApiKeyLocations()
+	}
+	var headers, queryParams []string
+	seen := make(map[string]bool)
+	add := func(header string) {
+		if header != "" && !seen[strings.ToLower(header)] {
+			seen[strings.ToLower(header)] = true
+			headers = append(headers, header)
+		}
+	}
+	for _, header := range strings.Split(keyHeaders, ",") {
+		add(strings.TrimSpace(header))
+	}
+	for _, location := range apiKeyLocations {
+		add(location.GetHeader())
+		if location.GetCookie() != "" {
+			add("cookie")
+		}
+		if location.GetQuery() != "" {
+			queryParams = append(queryParams, location.GetQuery())
+		}
+	}
+	return headers, queryParams
+}
+
+// processEtagSelectors enables the ETags of the GET operations in
+// --etag_selectors.
+func (s *ServiceInfo) processEtagSelectors() error {
+	for _, selector := range strings.Split(s.Options.EtagSelectors, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --etag_selectors is not defined in Api.method or Http.rule", selector)
+		}
+		isGet := false
+		for _, httpRule := range method.HttpRule {
+			isGet = isGet || httpRule.HttpMethod == util.GET
+		}
+		if !isGet {
+			return fmt.Errorf("selector %s in --etag_selectors is not a GET operation", selector)
+		}
+		method.EnableEtag = true
+	}
+	return nil
+}
+
+// processIdempotencySelectors enables the request deduplication of the
+// mutating operations in --idempotency_selectors.
+func (s *ServiceInfo) processIdempotencySelectors() error {
+	if s.Options.IdempotencySelectors == "" {
+		return nil
+	}
+	if s.Options.IdempotencyKeyHeader == "" {
+		return fmt.Errorf("--idempotency_key_header cannot be empty with --idempotency_selectors")
+	}
+	if s.Options.IdempotencyTtl <= 0 {
+		return fmt.Errorf("invalid idempotency ttl %v, must be positive", s.Options.IdempotencyTtl)
+	}
+
+	for _, selector := range strings.Split(s.Options.IdempotencySelectors, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --idempotency_selectors is not defined in Api.method or Http.rule", selector)
+		}
+		isMutating := false
+		for _, httpRule := range method.HttpRule {
+			isMutating = isMutating || httpRule.HttpMethod != util.GET
+		}
+		if !isMutating {
+			return fmt.Errorf("selector %s in --idempotency_selectors is not a mutating operation", selector)
+		}
+		method.EnableIdempotency = true
+	}
+	return nil
+}
+
+// processConcurrencyLimits sets the max concurrent requests of the operations
+// in --concurrency_limits.
+func (s *ServiceInfo) processConcurrencyLimits() error {
+	for _, entry := range strings.Split(s.Options.ConcurrencyLimits, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid concurrency limit %q, must be in the format SELECTOR=N", entry)
+		}
+		selector := strings.TrimSpace(kv[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --concurrency_limits is not defined in Api.method or Http.rule", selector)
+		}
+		limit, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 32)
+		if err != nil || limit == 0 {
+			return fmt.Errorf("invalid concurrency limit %q for selector %s, must be a positive integer", strings.TrimSpace(kv[1]), selector)
+		}
+		method.MaxConcurrentRequests = uint32(limit)
+	}
+	return nil
+}
+
+// processDenyRules splits the comma-separated user agents and paths of
+// --deny_user_agents and --deny_paths.
+func (s *ServiceInfo) processDenyRules() {
+	splitPatterns := func(patterns string) []string {
+		var out []string
+		for _, pattern := range strings.Split(patterns, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				out = append(out, pattern)
+			}
+		}
+		return out
+	}
+	s.DenyUserAgents = splitPatterns(s.Options.DenyUserAgents)
+	s.DenyPaths = splitPatterns(s.Options.DenyPaths)
+}
+
+// processGrpcStatusHttpCodes sets the HTTP status codes of the transcoded gRPC
+// errors of the methods of the gRPC apis, from
+// --transcoding_grpc_status_http_codes and their overrides in
+// --transcoding_operation_grpc_status_http_codes. Their body is formatted like
+// the local replies if --local_reply_json_format or
+// --local_reply_include_details is set.
+func (s *ServiceInfo) processGrpcStatusHttpCodes() error {
+	defaultCodes, err := parseGrpcStatusHttpCodes(s.Options.TranscodingGrpcStatusHttpCodes)
+	if err != nil {
+		return err
+	}
+
+	grpcApis := make(map[string]bool)
+	for _, apiName := range s.GrpcApiNames {
+		grpcApis[apiName] = true
+	}
+	if s.Options.LocalReplyJsonFormat != "" || s.Options.LocalReplyIncludeDetails {
+		for _, method := range s.Methods {
+			if grpcApis[method.ApiName] && !method.IsGenerated {
+				method.FormatGrpcErrorBody = true
+			}
+		}
+	}
+	if len(defaultCodes) > 0 {
+		for _, method := range s.Methods {
+			if !grpcApis[method.ApiName] || method.IsGenerated {
+				continue
+			}
+			method.GrpcStatusHttpCodes = make(map[uint32]uint32, len(defaultCodes))
+			for grpcCode, httpCode := range defaultCodes {
+				method.GrpcStatusHttpCodes[grpcCode] = httpCode
+			}
+		}
+	}
+
+	for _, rule := range strings.Split(s.Options.TranscodingOperationGrpcStatusHttpCodes, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid operation grpc status http codes %q, must be in the format SELECTOR=CODE:STATUS[,CODE:STATUS...]", rule)
+		}
+		selector := strings.TrimSpace(parts[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --transcoding_operation_grpc_status_http_codes is not defined in Api.method or Http.rule", selector)
+		}
+		if !grpcApis[method.ApiName] {
+			return fmt.Errorf("selector %s in --transcoding_operation_grpc_status_http_codes is not served by a gRPC backend", selector)
+		}
+
+		codes, err := parseGrpcStatusHttpCodes(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid grpc status http codes of selector %s: %v", selector, err)
+		}
+		if method.GrpcStatusHttpCodes == nil {
+			method.GrpcStatusHttpCodes = make(map[uint32]uint32, len(codes))
+		}
+		for grpcCode, httpCode := range codes {
+			method.GrpcStatusHttpCodes[grpcCode] = httpCode
+		}
+	}
+	return nil
+}
+
+// parseGrpcStatusHttpCodes parses the comma-separated CODE:STATUS, where CODE
+// is the name or the number of a gRPC status code other than OK.
+func parseGrpcStatusHttpCodes(entries string) (map[uint32]uint32, error) {
+	codes := make(map[uint32]uint32)
+	for _, entry := range strings.Split(entries, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid grpc status http code %q, must be in the format CODE:STATUS", entry)
+		}
+		name := strings.TrimSpace(kv[0])
+		grpcCode, ok := codepb.Code_value[strings.ToUpper(name)]
+		if !ok {
+			n, err := strconv.ParseInt(name, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid grpc status code %q, must be the name or the number of a gRPC status code", name)
+			}
+			grpcCode = int32(n)
+		}
+		if _, ok := codepb.Code_name[grpcCode]; !ok || grpcCode == int32(codepb.Code_OK) {
+			return nil, fmt.Errorf("invalid grpc status code %q, must be the name or the number of a gRPC status code other than OK", name)
+		}
+
+		httpCode, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 32)
+		if err != nil || httpCode < 200 || httpCode > 599 {
+			return nil, fmt.Errorf("invalid http status code %q of grpc status code %s, must be between 200 and 599", strings.TrimSpace(kv[1]), name)
+		}
+		codes[uint32(grpcCode)] = uint32(httpCode)
+	}
+	return codes, nil
+}
+
+// processQueryParamMatchers sets the query parameters matched by the routes of
+// the operations in --query_param_matchers.
+func (s *ServiceInfo) processQueryParamMatchers() error {
+	for _, rule := range strings.Split(s.Options.QueryParamMatchers, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid query param matcher rule %q, must be in the format SELECTOR=PARAM[:VALUE][,PARAM[:VALUE]...]", rule)
+		}
+
+		selector := strings.TrimSpace(parts[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("query param matcher selector %s is not defined in Api.method or Http.rule", selector)
+		}
+		if len(method.QueryParamMatchers) > 0 {
+			return fmt.Errorf("duplicate query param matcher rule for selector %s", selector)
+		}
+
+		seen := make(map[string]bool)
+		for _, param := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(param), ":", 2)
+			name := strings.TrimSpace(kv[0])
+			if name == "" {
+				return fmt.Errorf("invalid query param %q in query param matcher rule %q, must be in the format PARAM[:VALUE]", param, rule)
+			}
+			if seen[name] {
+				return fmt.Errorf("duplicate query param %s in query param matcher rule %q", name, rule)
+			}
+			seen[name] = true
+
+			matcher := &QueryParamMatcher{Name: name}
+			if len(kv) == 2 {
+				if matcher.Value = strings.TrimSpace(kv[1]); matcher.Value == "" {
+					return fmt.Errorf("invalid query param %q in query param matcher rule %q, the value cannot be empty", param, rule)
+				}
+			}
+			method.QueryParamMatchers = append(method.QueryParamMatchers, matcher)
+		}
+	}
+	return nil
+}
+
+// processUploadSizeThresholds sets the upload size thresholds of the
+// operations in --upload_size_thresholds, and the cluster of
+// --upload_backend_address they are routed to.
+func (s *ServiceInfo) processUploadSizeThresholds() error {
+	hasThreshold := false
+	for _, entry := range strings.Split(s.Options.UploadSizeThresholds, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid upload size threshold %q, must be in the format SELECTOR=BYTES", entry)
+		}
+		selector := strings.TrimSpace(kv[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --upload_size_thresholds is not defined in Api.method or Http.rule", selector)
+		}
+		threshold, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil || threshold <= 0 {
+			return fmt.Errorf("invalid upload size threshold %q for selector %s, must be a positive integer", strings.TrimSpace(kv[1]), selector)
+		}
+		method.UploadSizeThreshold = threshold
+		hasThreshold = true
+	}
+
+	if !hasThreshold {
+		if s.Options.UploadBackendAddress != "" {
+			return fmt.Errorf("--upload_backend_address requires --upload_size_thresholds")
+		}
+		return nil
+	}
+	if s.Options.UploadBackendAddress == "" {
+		return fmt.Errorf("--upload_size_thresholds requires --upload_backend_address")
+	}
+
+	scheme, hostname, port, _, err := util.ParseURI(s.Options.UploadBackendAddress)
+	if err != nil {
+		return fmt.Errorf("error parsing upload backend uri: %v", err)
+	}
+	protocol, tls, err := util.ParseBackendProtocol(scheme, "")
+	if err != nil {
+		return err
+	}
+	s.UploadBackendCluster = &BackendRoutingCluster{
+		UseTLS:      tls,
+		Protocol:    protocol,
+		ClusterName: s.UploadBackendClusterName(),
+		Hostname:    hostname,
+		Port:        port,
+	}
+	return nil
+}
+
+func (s *ServiceInfo) processScOperationOverrides() error {
+	if s.Options.ScOperationOverrides == "" {
+		return nil
+	}
+
+	for _, rule := range strings.Split(s.Options.ScOperationOverrides, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid service control operation override %q, must be in the format SELECTOR=KEY:VALUE[,KEY:VALUE...]", rule)
+		}
+
+		selector := strings.TrimSpace(parts[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("service control operation override selector %s is not defined in Api.method or Http.rule", selector)
+		}
+
+		config := &scpb.OperationCallingConfig{}
+		for _, setting := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(setting), ":", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid setting %q in service control operation override %q, must be in the format KEY:VALUE", setting, rule)
+			}
+
+			key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			switch key {
+			case "network_fail_open":
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("invalid network_fail_open %q in service control operation override %q: %v", value, rule, err)
+				}
+				config.NetworkFailOpen = &wrapperspb.BoolValue{Value: b}
+			case "check_timeout_ms":
+				n, err := strconv.ParseUint(value, 10, 32)
+				if err != nil || n == 0 {
+					return fmt.Errorf("invalid check_timeout_ms %q in service control operation override %q, must be > 0", value, rule)
+				}
+				config.CheckTimeoutMs = &wrapperspb.UInt32Value{Value: uint32(n)}
+			case "check_retries":
+				n, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return fmt.Errorf("invalid check_retries %q in service control operation override %q, must be >= 0", value, rule)
+				}
+				config.CheckRetries = &wrapperspb.UInt32Value{Value: uint32(n)}
+			default:
+				return fmt.Errorf("unknown key %q in service control operation override %q, must be one of network_fail_open, check_timeout_ms or check_retries", key, rule)
+			}
+		}
+		method.ScCallingConfig = config
+	}
+	return nil
+}
+
+// processRequestBodyValidation sets the validation of the JSON request bodies
+// of the http rules of the methods of the gRPC apis with
+// --transcoding_validate_request_body and
+// --transcoding_reject_unknown_body_fields, except the methods in
+// --transcoding_body_validation_opt_out_selectors. The streaming methods and
+// the google.api.HttpBody requests are not validated, their bodies are not a
+// single JSON message.
+func (s *ServiceInfo) processRequestBodyValidation() error {
+	if !s.Options.TranscodingValidateRequestBody && !s.Options.TranscodingRejectUnknownBodyFields {
+		if s.Options.TranscodingBodyValidationOptOutSelectors != "" {
+			return fmt.Errorf("--transcoding_body_validation_opt_out_selectors requires --transcoding_validate_request_body or --transcoding_reject_unknown_body_fields")
+		}
+		return nil
+	}
+
+	optOuts := make(map[string]bool)
+	for _, selector := range strings.Split(s.Options.TranscodingBodyValidationOptOutSelectors, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		if _, ok := s.Methods[selector]; !ok {
+			return fmt.Errorf("selector %s in --transcoding_body_validation_opt_out_selectors is not defined in Api.method or Http.rule", selector)
+		}
+		optOuts[selector] = true
+	}
+
+	grpcApis := make(map[string]bool)
+	for _, apiName := range s.GrpcApiNames {
+		grpcApis[apiName] = true
+	}
+	typesByTypeName := make(map[string]*typepb.Type)
+	for _, t := range s.ServiceConfig().GetTypes() {
+		typesByTypeName[t.GetName()] = t
+	}
+
+	for operation, method := range s.Methods {
+		if !grpcApis[method.ApiName] || method.IsGenerated || method.IsStreaming || method.IsHttpBody || optOuts[operation] {
+			continue
+		}
+		requestType, ok := typesByTypeName[method.RequestTypeName]
+		if !ok {
+			continue
+		}
+		for _, httpRule := range method.HttpRule {
+			body, ok := s.httpRuleBodies[httpRule]
+			if !ok {
+				continue
+			}
+			validation := makeRequestBodyValidation(requestType, body, httpRule.UriTemplate)
+			if validation == nil {
+				continue
+			}
+			validation.ValidateFields = s.Options.TranscodingValidateRequestBody
+			validation.RejectUnknownFields = s.Options.TranscodingRejectUnknownBodyFields
+			if method.RequestBodyValidations == nil {
+				method.RequestBodyValidations = make(map[*httppattern.Pattern]*RequestBodyValidation)
+			}
+			method.RequestBodyValidations[httpRule] = validation
+		}
+	}
+	return nil
+}
+
+// makeRequestBodyValidation returns the validation of the body of an http rule
+// of the request type: the request type itself for "*", or the type of the
+// body field. It returns nil if the body is not a message, e.g. a repeated or
+// a scalar field, or is a well-known type, which has its own JSON mapping.
+func makeRequestBodyValidation(requestType *typepb.Type, body string, uriTemplate *httppattern.UriTemplate) *RequestBodyValidation {
+	bodyType := requestType.GetName()
+	var bodyField *typepb.Field
+	if body != "*" {
+		for _, field := range requestType.GetFields() {
+			if field.GetName() == body {
+				bodyField = field
+			}
+		}
+		if bodyField == nil || bodyField.GetKind() != typepb.Field_TYPE_MESSAGE || bodyField.GetCardinality() == typepb.Field_CARDINALITY_REPEATED {
+			return nil
+		}
+		bodyType = strings.TrimPrefix(bodyField.GetTypeUrl(), util.TypeUrlPrefix)
+	}
+	if strings.HasPrefix(bodyType, util.WellKnownTypePrefix) {
+		return nil
+	}
+
+	validation := &RequestBodyValidation{
+		BodyType: bodyType,
+	}
+	for _, variable := range uriTemplate.Variables {
+		fieldPath := variable.FieldPath
+		if bodyField != nil {
+			// Only the fields inside the body field are in the body.
+			if len(fieldPath) < 2 || (fieldPath[0] != bodyField.GetName() && fieldPath[0] != bodyField.GetJsonName()) {
+				continue
+			}
+			fieldPath = fieldPath[1:]
+		}
+		validation.BoundFields = append(validation.BoundFields, strings.Join(fieldPath, "."))
+	}
+	return validation
+}
+
+// processStreamFormats sets the formats of the server streams of the
+// operations in --transcoding_stream_formats. Only the server-streaming
+// methods of the gRPC apis are transcoded into a JSON array the formats apply
+// to.
+func (s *ServiceInfo) processStreamFormats() error {
+	if s.Options.TranscodingStreamFormats == "" {
+		return nil
+	}
+
+	grpcApis := make(map[string]bool)
+	for _, apiName := range s.GrpcApiNames {
+		grpcApis[apiName] = true
+	}
+	serverStreaming := make(map[string]bool)
+	for _, api := range s.serviceConfig.GetApis() {
+		for _, method := range api.GetMethods() {
+			if method.GetResponseStreaming() {
+				serverStreaming[fmt.Sprintf("%s.%s", api.GetName(), method.GetName())] = true
+			}
+		}
+	}
+
+	for _, entry := range strings.Split(s.Options.TranscodingStreamFormats, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid stream format %q, must be in the format SELECTOR=ndjson|sse", entry)
+		}
+		selector := strings.TrimSpace(parts[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --transcoding_stream_formats is not defined in Api.method or Http.rule", selector)
+		}
+		if !grpcApis[method.ApiName] {
+			return fmt.Errorf("selector %s in --transcoding_stream_formats is not served by a gRPC backend", selector)
+		}
+		if !serverStreaming[selector] || method.IsHttpBody {
+			return fmt.Errorf("selector %s in --transcoding_stream_formats is not a server-streaming method transcoded into JSON", selector)
+		}
+
+		format := strings.ToLower(strings.TrimSpace(parts[1]))
+		if format != util.StreamFormatNdjson && format != util.StreamFormatSse {
+			return fmt.Errorf("invalid stream format %q of selector %s, must be ndjson or sse", parts[1], selector)
+		}
+		method.StreamFormat = format
+	}
+	return nil
+}
+
+// processTranscodingOperationPrintOptions sets the print options of the
+// transcoded responses of the operations in
+// --transcoding_operation_print_options, overriding the deployment-wide ones.
+func (s *ServiceInfo) processTranscodingOperationPrintOptions() error {
+	if s.Options.TranscodingOperationPrintOptions == "" {
+		return nil
+	}
+
+	defaultPrintOptions := TranscodingPrintOptions{
+		AlwaysPrintPrimitiveFields: s.Options.TranscodingAlwaysPrintPrimitiveFields,
+		AlwaysPrintEnumsAsInts:     s.Options.TranscodingAlwaysPrintEnumsAsInts,
+		PreserveProtoFieldNames:    s.Options.TranscodingPreserveProtoFieldNames,
+	}
+	grpcApis := make(map[string]bool)
+	for _, apiName := range s.GrpcApiNames {
+		grpcApis[apiName] = true
+	}
+
+	for _, rule := range strings.Split(s.Options.TranscodingOperationPrintOptions, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid operation print options %q, must be in the format SELECTOR=OPTION:BOOL[,OPTION:BOOL...]", rule)
+		}
+		selector := strings.TrimSpace(parts[0])
+		method, ok := s.Methods[selector]
+		if !ok {
+			return fmt.Errorf("selector %s in --transcoding_operation_print_options is not defined in Api.method or Http.rule", selector)
+		}
+		if !grpcApis[method.ApiName] || method.IsGenerated {
+			return fmt.Errorf("selector %s in --transcoding_operation_print_options is not served by a gRPC backend", selector)
+		}
+
+		printOptions := defaultPrintOptions
+		if method.TranscodingPrintOptions != nil {
+			printOptions = *method.TranscodingPrintOptions
+		}
+		for _, entry := range strings.Split(parts[1], ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			kv := strings.SplitN(entry, ":", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid print option %q of selector %s, must be in the format OPTION:BOOL", entry, selector)
+			}
+			value, err := strconv.ParseBool(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return fmt.Errorf("invalid value %q of print option %s of selector %s, must be true or false", strings.TrimSpace(kv[1]), strings.TrimSpace(kv[0]), selector)
+			}
+			switch option := strings.TrimSpace(kv[0]); option {
+			case "always_print_primitive_fields":
+				printOptions.AlwaysPrintPrimitiveFields = value
+			case "always_print_enums_as_ints":
+				printOptions.AlwaysPrintEnumsAsInts = value
+			case "preserve_proto_field_names":
+				printOptions.PreserveProtoFieldNames = value
+			default:
+				return fmt.Errorf("invalid print option %q of selector %s, must be one of always_print_primitive_fields, always_print_enums_as_ints or preserve_proto_field_names", option, selector)
+			}
+		}
+		method.TranscodingPrintOptions = &printOptions
+	}
+
+	// The overrides equal to the deployment-wide print options need no
+	// transcoder of their own.
+	for _, method := range s.Methods {
+		if method.TranscodingPrintOptions != nil && *method.TranscodingPrintOptions == defaultPrintOptions {
+			method.TranscodingPrintOptions = nil
+		}
+	}
+	return nil
+}
+
+// processTranscodingQueryArrayStyle strips the "[]" suffix from the names of
+// the query parameters of the transcoded gRPC methods with the "brackets"
+// style of --transcoding_query_array_style.
+func (s *ServiceInfo) processTranscodingQueryArrayStyle() error {
+	switch s.Options.TranscodingQueryArrayStyle {
+	case util.QueryArrayStyleRepeat:
+		return nil
+	case util.QueryArrayStyleBrackets:
+	default:
+		return fmt.Errorf("invalid --transcoding_query_array_style %q, must be %s or %s", s.Options.TranscodingQueryArrayStyle, util.QueryArrayStyleRepeat, util.QueryArrayStyleBrackets)
+	}
+
+	grpcApis := make(map[string]bool)
+	for _, apiName := range s.GrpcApiNames {
+		grpcApis[apiName] = true
+	}
+	for _, method := range s.Methods {
+		if grpcApis[method.ApiName] && !method.IsGenerated {
+			method.StripQueryArrayBrackets = true
+		}
+	}
+	return nil
+}
+
 // If the backend address's scheme is grpc/grpcs, it should be changed it http or https.
 func getJwtAudienceFromBackendAddr(scheme, hostname string) string {
 	_, tls, _ := util.ParseBackendProtocol(scheme, "")
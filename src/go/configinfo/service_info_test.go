@@ -22,6 +22,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,6 +36,7 @@ import (
 
 	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/common"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	apipb "google.golang.org/genproto/protobuf/api"
@@ -137,10 +139,126 @@ func TestProcessApiKeyLocations(t *testing.T) {
 	testData := []struct {
 		desc                                   string
 		fakeServiceConfig                      *confpb.Service
+		apiKeyLocationsFlag                    string
 		wantedSystemParameters                 map[string][]*confpb.SystemParameter
 		wantedAllTranscodingIgnoredQueryParams map[string]bool
 		wantMethods                            map[string]*MethodInfo
 	}{
+		{
+			desc: "Succeed, additional locations from flag",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: "1.echo_api_endpoints_cloudesf_testing_cloud_goog",
+						Methods: []*apipb.Method{
+							{
+								Name: "echo",
+							},
+							{
+								Name: "baz",
+							},
+						},
+					},
+				},
+				SystemParameters: &confpb.SystemParameters{
+					Rules: []*confpb.SystemParameterRule{
+						{
+							Selector: "1.echo_api_endpoints_cloudesf_testing_cloud_goog.echo",
+							Parameters: []*confpb.SystemParameter{
+								{
+									Name:       "api_key",
+									HttpHeader: "header_name",
+								},
+							},
+						},
+					},
+				},
+			},
+			apiKeyLocationsFlag: "cookie=api_key_cookie, header=Authorization:ApiKey,query=apikey",
+			wantedAllTranscodingIgnoredQueryParams: map[string]bool{
+				"key":     true,
+				"api_key": true,
+				"apikey":  true,
+			},
+			wantMethods: map[string]*MethodInfo{
+				"1.echo_api_endpoints_cloudesf_testing_cloud_goog.echo": {
+					ShortName: "echo",
+					ApiName:   "1.echo_api_endpoints_cloudesf_testing_cloud_goog",
+					HttpRule: []*httppattern.Pattern{
+						{
+							HttpMethod:  util.POST,
+							UriTemplate: parseUriTemplate("/1.echo_api_endpoints_cloudesf_testing_cloud_goog/echo"),
+						},
+					},
+					ApiKeyLocations: []*scpb.ApiKeyLocation{
+						{
+							Key: &scpb.ApiKeyLocation_Header{
+								Header: "header_name",
+							},
+						},
+						{
+							Key: &scpb.ApiKeyLocation_Cookie{
+								Cookie: "api_key_cookie",
+							},
+						},
+						{
+							Key: &scpb.ApiKeyLocation_Header{
+								Header: "Authorization",
+							},
+							ValuePrefix: "ApiKey",
+						},
+						{
+							Key: &scpb.ApiKeyLocation_Query{
+								Query: "apikey",
+							},
+						},
+					},
+				},
+				"1.echo_api_endpoints_cloudesf_testing_cloud_goog.baz": {
+					ShortName: "baz",
+					ApiName:   "1.echo_api_endpoints_cloudesf_testing_cloud_goog",
+					HttpRule: []*httppattern.Pattern{
+						{
+							HttpMethod:  util.POST,
+							UriTemplate: parseUriTemplate("/1.echo_api_endpoints_cloudesf_testing_cloud_goog/baz"),
+						},
+					},
+					ApiKeyLocations: []*scpb.ApiKeyLocation{
+						{
+							Key: &scpb.ApiKeyLocation_Query{
+								Query: "key",
+							},
+						},
+						{
+							Key: &scpb.ApiKeyLocation_Query{
+								Query: "api_key",
+							},
+						},
+						{
+							Key: &scpb.ApiKeyLocation_Header{
+								Header: "x-api-key",
+							},
+						},
+						{
+							Key: &scpb.ApiKeyLocation_Cookie{
+								Cookie: "api_key_cookie",
+							},
+						},
+						{
+							Key: &scpb.ApiKeyLocation_Header{
+								Header: "Authorization",
+							},
+							ValuePrefix: "ApiKey",
+						},
+						{
+							Key: &scpb.ApiKeyLocation_Query{
+								Query: "apikey",
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			desc: "Succeed, only header",
 			fakeServiceConfig: &confpb.Service{
@@ -465,6 +583,7 @@ func TestProcessApiKeyLocations(t *testing.T) {
 		t.Run(tc.desc, func(t *testing.T) {
 			opts := options.DefaultConfigGeneratorOptions()
 			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.ApiKeyLocations = tc.apiKeyLocationsFlag
 			serviceInfo, err := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
 			if err != nil {
 				t.Fatal(err)
@@ -490,6 +609,25 @@ func TestProcessApiKeyLocations(t *testing.T) {
 	}
 }
 
+func TestProcessApiKeyLocationsWithInvalidFlag(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+			},
+		},
+	}
+
+	for _, apiKeyLocations := range []string{"cookie", "cookie=", "body=api_key"} {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.ApiKeyLocations = apiKeyLocations
+		_, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err == nil || !strings.Contains(err.Error(), "invalid api key location") {
+			t.Errorf("api key locations %q: expected invalid api key location error, got: %v", apiKeyLocations, err)
+		}
+	}
+}
+
 func TestProcessTranscodingIgnoredQueryParams(t *testing.T) {
 	testData := []struct {
 		desc                                   string
@@ -1490,6 +1628,37 @@ func TestMethods(t *testing.T) {
 			BackendAddress: "http://127.0.0.1:80",
 			wantError:      "operation(1.echo_api_endpoints_cloudesf_testing_cloud_goog.Echo): invalid uri template invalid-uri-template",
 		},
+		{
+			desc: "Fail for invalid custom http method",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "1.echo_api_endpoints_cloudesf_testing_cloud_goog",
+						Methods: []*apipb.Method{
+							{
+								Name: "Echo",
+							},
+						},
+					},
+				},
+				Http: &annotationspb.Http{
+					Rules: []*annotationspb.HttpRule{
+						{
+							Selector: "1.echo_api_endpoints_cloudesf_testing_cloud_goog.Echo",
+							Pattern: &annotationspb.HttpRule_Custom{
+								Custom: &annotationspb.CustomHttpPattern{
+									Kind: "VERSION CONTROL",
+									Path: "/echo",
+								},
+							},
+						},
+					},
+				},
+			},
+			BackendAddress: "http://127.0.0.1:80",
+			wantError:      `operation(1.echo_api_endpoints_cloudesf_testing_cloud_goog.Echo): invalid custom http method "VERSION CONTROL"`,
+		},
 		{
 			desc: "Succeed for multiple url Pattern",
 			fakeServiceConfig: &confpb.Service{
@@ -1864,6 +2033,164 @@ func TestProcessBackendRuleForProtocol(t *testing.T) {
 	}
 }
 
+func TestProcessBackendRuleForPathRewriteOptions(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Foo",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                          string
+		pathRewriteQueryParams        string
+		pathRewriteOriginalPathHeader string
+		wantError                     string
+	}{
+		{
+			desc:                          "valid options",
+			pathRewriteQueryParams:        "drop",
+			pathRewriteOriginalPathHeader: "x-original-path",
+		},
+		{
+			desc:                   "unknown query params action",
+			pathRewriteQueryParams: "append",
+			wantError:              `invalid --path_rewrite_query_params "append", must be one of "preserve", "merge" or "drop"`,
+		},
+		{
+			desc:                          "invalid header name",
+			pathRewriteQueryParams:        "preserve",
+			pathRewriteOriginalPathHeader: "x original path",
+			wantError:                     `invalid --path_rewrite_original_path_header "x original path", must be a header name`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.PathRewriteQueryParams = tc.pathRewriteQueryParams
+			opts.PathRewriteOriginalPathHeader = tc.pathRewriteOriginalPathHeader
+			_, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestProcessGrpcApis(t *testing.T) {
+	testData := []struct {
+		desc              string
+		backendAddress    string
+		fakeServiceConfig *confpb.Service
+		wantGrpcApiNames  []string
+	}{
+		{
+			desc:           "All apis are served by the local gRPC backend",
+			backendAddress: "grpc://127.0.0.1:80",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name:    "api.foo",
+						Methods: []*apipb.Method{{Name: "Get"}},
+					},
+					{
+						Name: "api.bar",
+					},
+				},
+			},
+			wantGrpcApiNames: []string{"api.foo", "api.bar"},
+		},
+		{
+			desc:           "Only the api routed to the remote gRPC backend is transcoded",
+			backendAddress: "http://127.0.0.1:80",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name:    "api.foo",
+						Methods: []*apipb.Method{{Name: "Get"}},
+					},
+					{
+						Name:    "api.bar",
+						Methods: []*apipb.Method{{Name: "Get"}},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Address:  "grpcs://grpc.example.com",
+							Selector: "api.bar.Get",
+						},
+					},
+				},
+			},
+			wantGrpcApiNames: []string{"api.bar"},
+		},
+		{
+			desc:           "The api routed to the remote HTTP backend is not transcoded",
+			backendAddress: "grpc://127.0.0.1:80",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name:    "api.foo",
+						Methods: []*apipb.Method{{Name: "Get"}},
+					},
+					{
+						Name:    "api.bar",
+						Methods: []*apipb.Method{{Name: "Get"}},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Address:  "https://http.example.com/api",
+							Selector: "api.foo.Get",
+						},
+					},
+				},
+			},
+			wantGrpcApiNames: []string{"api.bar"},
+		},
+		{
+			desc:           "No gRPC backends",
+			backendAddress: "http://127.0.0.1:80",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name:    "api.foo",
+						Methods: []*apipb.Method{{Name: "Get"}},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = tc.backendAddress
+		s, err := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatalf("Test Desc(%s): error not expected, got: %v", tc.desc, err)
+		}
+
+		if !reflect.DeepEqual(s.GrpcApiNames, tc.wantGrpcApiNames) {
+			t.Errorf("Test Desc(%s): GrpcApiNames got: %v, want: %v", tc.desc, s.GrpcApiNames, tc.wantGrpcApiNames)
+		}
+	}
+}
+
 func TestProcessBackendRuleForClusterName(t *testing.T) {
 	testData := []struct {
 		desc        string
@@ -1986,28 +2313,450 @@ func TestProcessBackendRuleForClusterName(t *testing.T) {
 	}
 }
 
-func TestProcessBackendRuleForJwtAudience(t *testing.T) {
-	testData := []struct {
-		desc              string
-		fakeServiceConfig *confpb.Service
-		nonGcp            bool
-		wantedJwtAudience map[string]string
-	}{
-
+func TestProcessBackendRuleForSelectorPrefix(t *testing.T) {
+	apis := []*apipb.Api{
 		{
-			desc: "DisableAuth is set to true",
-			fakeServiceConfig: &confpb.Service{
-				Apis: []*apipb.Api{
-					{
-						Name: testApiName,
-					},
+			Name: "library.v1.Library",
+			Methods: []*apipb.Method{
+				{
+					Name: "GetBook",
 				},
-				Backend: &confpb.Backend{
-					Rules: []*confpb.BackendRule{
-
-						{
-							Address:        "grpc://abc.com/api",
-							Selector:       "abc.com.api",
+				{
+					Name: "DeleteBook",
+				},
+			},
+		},
+		{
+			Name: "library.v1.Admin",
+			Methods: []*apipb.Method{
+				{
+					Name: "Reset",
+				},
+			},
+		},
+		{
+			Name: "health.Health",
+			Methods: []*apipb.Method{
+				{
+					Name: "Check",
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc          string
+		rules         []*confpb.BackendRule
+		wantHostnames map[string]string
+	}{
+		{
+			desc: "wildcard selector applies to all methods",
+			rules: []*confpb.BackendRule{
+				{
+					Selector: "*",
+					Address:  "https://default.run.app",
+				},
+			},
+			wantHostnames: map[string]string{
+				"library.v1.Library.GetBook":    "default.run.app",
+				"library.v1.Library.DeleteBook": "default.run.app",
+				"library.v1.Admin.Reset":        "default.run.app",
+				"health.Health.Check":           "default.run.app",
+			},
+		},
+		{
+			desc: "more specific selectors override the wildcard selectors",
+			rules: []*confpb.BackendRule{
+				{
+					Selector: "library.v1.Library.DeleteBook",
+					Address:  "https://delete.run.app",
+				},
+				{
+					Selector: "library.v1.Admin",
+					Address:  "https://admin.run.app",
+				},
+				{
+					Selector: "library.v1.*",
+					Address:  "https://library.run.app",
+				},
+				{
+					Selector: "*",
+					Address:  "https://default.run.app",
+				},
+			},
+			wantHostnames: map[string]string{
+				"library.v1.Library.GetBook":    "library.run.app",
+				"library.v1.Library.DeleteBook": "delete.run.app",
+				"library.v1.Admin.Reset":        "admin.run.app",
+				"health.Health.Check":           "default.run.app",
+			},
+		},
+		{
+			desc: "wildcard selector matching no methods is ignored",
+			rules: []*confpb.BackendRule{
+				{
+					Selector: "library.v2.*",
+					Address:  "https://library.run.app",
+				},
+				{
+					Selector: "health.Health",
+					Address:  "https://health.run.app",
+				},
+			},
+			wantHostnames: map[string]string{
+				"library.v1.Library.GetBook":    "",
+				"library.v1.Library.DeleteBook": "",
+				"library.v1.Admin.Reset":        "",
+				"health.Health.Check":           "health.run.app",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			fakeServiceConfig := &confpb.Service{
+				Name: testProjectName,
+				Apis: apis,
+				Backend: &confpb.Backend{
+					Rules: tc.rules,
+				},
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(s.Methods) != len(tc.wantHostnames) {
+				t.Errorf("got %d methods, want: %d", len(s.Methods), len(tc.wantHostnames))
+			}
+			for selector, wantHostname := range tc.wantHostnames {
+				method, ok := s.Methods[selector]
+				if !ok {
+					t.Errorf("method %s not found", selector)
+					continue
+				}
+				if got := method.BackendInfo.Hostname; got != wantHostname {
+					t.Errorf("method %s: got backend hostname: %q, want: %q", selector, got, wantHostname)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessRulesForSelectorPrefix(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "library.v1.Library",
+				Methods: []*apipb.Method{
+					{
+						Name: "GetBook",
+					},
+					{
+						Name: "DeleteBook",
+					},
+				},
+			},
+			{
+				Name: "library.v1.Admin",
+				Methods: []*apipb.Method{
+					{
+						Name: "Reset",
+					},
+				},
+			},
+		},
+		Usage: &confpb.Usage{
+			Rules: []*confpb.UsageRule{
+				{
+					Selector:               "library.v1.*",
+					AllowUnregisteredCalls: true,
+				},
+				{
+					Selector:               "library.v1.Library.DeleteBook",
+					AllowUnregisteredCalls: false,
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer",
+					JwksUri: "https://fake-jwks.com",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: "library.v1.Admin",
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "auth_provider",
+						},
+					},
+				},
+			},
+		},
+		SystemParameters: &confpb.SystemParameters{
+			Rules: []*confpb.SystemParameterRule{
+				{
+					Selector: "*",
+					Parameters: []*confpb.SystemParameter{
+						{
+							Name:       "api_key",
+							HttpHeader: "x-api-key",
+						},
+					},
+				},
+				{
+					Selector: "library.v1.Library",
+					Parameters: []*confpb.SystemParameter{
+						{
+							Name:       "api_key",
+							HttpHeader: "x-library-api-key",
+						},
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		selector                   string
+		wantAllowUnregisteredCalls bool
+		wantRequireAuth            bool
+		wantApiKeyHeader           string
+	}{
+		{
+			selector:                   "library.v1.Library.GetBook",
+			wantAllowUnregisteredCalls: true,
+			wantApiKeyHeader:           "x-library-api-key",
+		},
+		{
+			selector:         "library.v1.Library.DeleteBook",
+			wantApiKeyHeader: "x-library-api-key",
+		},
+		{
+			selector:                   "library.v1.Admin.Reset",
+			wantAllowUnregisteredCalls: true,
+			wantRequireAuth:            true,
+			wantApiKeyHeader:           "x-api-key",
+		},
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Methods) != len(testData) {
+		t.Errorf("got %d methods, want: %d", len(s.Methods), len(testData))
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.selector, func(t *testing.T) {
+			method, ok := s.Methods[tc.selector]
+			if !ok {
+				t.Fatalf("method %s not found", tc.selector)
+			}
+			if method.AllowUnregisteredCalls != tc.wantAllowUnregisteredCalls {
+				t.Errorf("got AllowUnregisteredCalls: %v, want: %v", method.AllowUnregisteredCalls, tc.wantAllowUnregisteredCalls)
+			}
+			if method.RequireAuth != tc.wantRequireAuth {
+				t.Errorf("got RequireAuth: %v, want: %v", method.RequireAuth, tc.wantRequireAuth)
+			}
+			if len(method.ApiKeyLocations) != 1 || method.ApiKeyLocations[0].GetHeader() != tc.wantApiKeyHeader {
+				t.Errorf("got ApiKeyLocations: %v, want header: %s", method.ApiKeyLocations, tc.wantApiKeyHeader)
+			}
+		})
+	}
+}
+
+func TestProcessStrictSelectorValidation(t *testing.T) {
+	testData := []struct {
+		desc                     string
+		fakeServiceConfig        *confpb.Service
+		strictSelectorValidation bool
+		wantError                string
+	}{
+		{
+			desc: "unknown usage rule selector creates a method by default",
+			fakeServiceConfig: &confpb.Service{
+				Usage: &confpb.Usage{
+					Rules: []*confpb.UsageRule{
+						{
+							Selector:               "library.v1.Library.GetBok",
+							AllowUnregisteredCalls: true,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "known and wildcard selectors with strict selector validation",
+			fakeServiceConfig: &confpb.Service{
+				Usage: &confpb.Usage{
+					Rules: []*confpb.UsageRule{
+						{
+							Selector:               "library.v1.*",
+							AllowUnregisteredCalls: true,
+						},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Selector: "library.v1.Library.GetBook",
+							Address:  "https://library.run.app",
+						},
+					},
+				},
+			},
+			strictSelectorValidation: true,
+		},
+		{
+			desc: "unknown usage rule selector with strict selector validation",
+			fakeServiceConfig: &confpb.Service{
+				Usage: &confpb.Usage{
+					Rules: []*confpb.UsageRule{
+						{
+							Selector:               "library.v1.Library.GetBok",
+							AllowUnregisteredCalls: true,
+						},
+					},
+				},
+			},
+			strictSelectorValidation: true,
+			wantError:                "usage rule selector library.v1.Library.GetBok is not defined in apis.methods",
+		},
+		{
+			desc: "unknown backend rule selector with strict selector validation",
+			fakeServiceConfig: &confpb.Service{
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Selector: "library.v1.Library.GetBok",
+							Address:  "https://library.run.app",
+						},
+					},
+				},
+			},
+			strictSelectorValidation: true,
+			wantError:                "backend rule selector library.v1.Library.GetBok is not defined in apis.methods",
+		},
+		{
+			desc: "unknown authentication rule selector with strict selector validation",
+			fakeServiceConfig: &confpb.Service{
+				Authentication: &confpb.Authentication{
+					Rules: []*confpb.AuthenticationRule{
+						{
+							Selector:               "library.v1.Library.GetBok",
+							AllowWithoutCredential: true,
+						},
+					},
+				},
+			},
+			strictSelectorValidation: true,
+			wantError:                "authentication rule selector library.v1.Library.GetBok is not defined in apis.methods",
+		},
+		{
+			desc: "unknown system parameter rule selector with strict selector validation",
+			fakeServiceConfig: &confpb.Service{
+				SystemParameters: &confpb.SystemParameters{
+					Rules: []*confpb.SystemParameterRule{
+						{
+							Selector: "library.v1.Library.GetBok",
+							Parameters: []*confpb.SystemParameter{
+								{
+									Name:       "api_key",
+									HttpHeader: "x-api-key",
+								},
+							},
+						},
+					},
+				},
+			},
+			strictSelectorValidation: true,
+			wantError:                "system parameter rule selector library.v1.Library.GetBok is not defined in apis.methods",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			tc.fakeServiceConfig.Name = testProjectName
+			tc.fakeServiceConfig.Apis = []*apipb.Api{
+				{
+					Name: "library.v1.Library",
+					Methods: []*apipb.Method{
+						{
+							Name: "GetBook",
+						},
+					},
+				},
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.StrictSelectorValidation = tc.strictSelectorValidation
+			_, err := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+			if tc.wantError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantError {
+				t.Errorf("got error: %v, want: %s", err, tc.wantError)
+			}
+		})
+	}
+}
+
+func TestProcessBackendRuleForJwtAudience(t *testing.T) {
+	testData := []struct {
+		desc                      string
+		fakeServiceConfig         *confpb.Service
+		nonGcp                    bool
+		impersonateServiceAccount string
+		wantedJwtAudience         map[string]string
+	}{
+		{
+			desc: "Backend auth is kept on non-GCP for an impersonated service account",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Address:        "https://abc.com/api",
+							Selector:       "abc.com.api",
+							Authentication: &confpb.BackendRule_JwtAudience{JwtAudience: "audience-foo"},
+						},
+					},
+				},
+			},
+			nonGcp:                    true,
+			impersonateServiceAccount: "proxy@project.iam.gserviceaccount.com",
+			wantedJwtAudience: map[string]string{
+				"abc.com.api": "audience-foo",
+			},
+		},
+
+		{
+			desc: "DisableAuth is set to true",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+
+						{
+							Address:        "grpc://abc.com/api",
+							Selector:       "abc.com.api",
 							Deadline:       10.5,
 							Authentication: &confpb.BackendRule_DisableAuth{DisableAuth: true},
 						},
@@ -2191,6 +2940,7 @@ func TestProcessBackendRuleForJwtAudience(t *testing.T) {
 		t.Run(tc.desc, func(t *testing.T) {
 			opts := options.DefaultConfigGeneratorOptions()
 			opts.NonGCP = tc.nonGcp
+			opts.ImpersonateServiceAccount = tc.impersonateServiceAccount
 			s, err := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
 
 			if err != nil {
@@ -2209,11 +2959,442 @@ func TestProcessBackendRuleForJwtAudience(t *testing.T) {
 	}
 }
 
-func TestProcessQuota(t *testing.T) {
+func TestProcessBackendRuleForJwtAudienceTemplate(t *testing.T) {
 	testData := []struct {
 		desc              string
-		fakeServiceConfig *confpb.Service
-		wantMethods       map[string]*MethodInfo
+		backendRules      []*confpb.BackendRule
+		audienceTemplate  string
+		wantedJwtAudience map[string]string
+		wantedError       string
+	}{
+		{
+			desc: "JwtAudience placeholders are expanded",
+			backendRules: []*confpb.BackendRule{
+				{
+					Address:        "grpcs://abc.com/api/v1",
+					Selector:       "abc.com.api",
+					Authentication: &confpb.BackendRule_JwtAudience{JwtAudience: "{scheme}://{hostname}{path}?svc={service_name}"},
+				},
+			},
+			wantedJwtAudience: map[string]string{
+				"abc.com.api": "https://abc.com/api/v1?svc=bookstore.endpoints.project123.cloud.goog",
+			},
+		},
+		{
+			desc:             "Default template gives different audiences for paths on the same hostname",
+			audienceTemplate: "https://{hostname}{path}",
+			backendRules: []*confpb.BackendRule{
+				{
+					Address:  "https://abc.com/foo",
+					Selector: "abc.com.foo",
+				},
+				{
+					Address:  "https://abc.com/bar",
+					Selector: "abc.com.bar",
+				},
+				{
+					Address:        "https://abc.com/baz",
+					Selector:       "abc.com.baz",
+					Authentication: &confpb.BackendRule_JwtAudience{JwtAudience: "audience-baz"},
+				},
+				{
+					Address:        "https://abc.com/qux",
+					Selector:       "abc.com.qux",
+					Authentication: &confpb.BackendRule_DisableAuth{DisableAuth: true},
+				},
+				{
+					Address:        "https://abc.com/quux",
+					Selector:       "abc.com.quux",
+					Authentication: &confpb.BackendRule_JwtAudience{JwtAudience: ""},
+				},
+			},
+			wantedJwtAudience: map[string]string{
+				"abc.com.foo":  "https://abc.com/foo",
+				"abc.com.bar":  "https://abc.com/bar",
+				"abc.com.baz":  "audience-baz",
+				"abc.com.qux":  "",
+				"abc.com.quux": "",
+			},
+		},
+		{
+			desc: "Unknown placeholder",
+			backendRules: []*confpb.BackendRule{
+				{
+					Address:        "https://abc.com/api",
+					Selector:       "abc.com.api",
+					Authentication: &confpb.BackendRule_JwtAudience{JwtAudience: "https://{host}"},
+				},
+			},
+			wantedError: `invalid jwt audience for backend rule abc.com.api: unknown placeholders [{host}] in template "https://{host}"`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			fakeServiceConfig := &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: tc.backendRules,
+				},
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAuthJwtAudienceTemplate = tc.audienceTemplate
+			s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantedError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error not expected, got: %v", err)
+			}
+
+			for _, rule := range tc.backendRules {
+				gotJwtAudience := s.Methods[rule.Selector].BackendInfo.JwtAudience
+				wantedJwtAudience := tc.wantedJwtAudience[rule.Selector]
+
+				if wantedJwtAudience != gotJwtAudience {
+					t.Errorf("JwtAudience mismatch, got: %v, want: %v", gotJwtAudience, wantedJwtAudience)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessJwtCallerAllowlist(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Admin",
+					},
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer-0",
+					JwksUri: "https://fake-jwks.com",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: testApiName + ".Admin",
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "auth_provider",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc               string
+		jwtCallerAllowlist string
+		wantAllowedCallers map[string][]string
+		wantError          string
+	}{
+		{
+			desc:               "Multiple callers",
+			jwtCallerAllowlist: testApiName + ".Admin= a@x.com, b@y.com ;",
+			wantAllowedCallers: map[string][]string{
+				testApiName + ".Admin": {"a@x.com", "b@y.com"},
+				testApiName + ".Echo":  nil,
+			},
+		},
+		{
+			desc:               "Malformed rule",
+			jwtCallerAllowlist: testApiName + ".Admin",
+			wantError:          "must be in the format SELECTOR=CALLER[,CALLER...]",
+		},
+		{
+			desc:               "Unknown selector",
+			jwtCallerAllowlist: testApiName + ".Unknown=a@x.com",
+			wantError:          "selector endpoints.examples.bookstore.Bookstore.Unknown is not defined",
+		},
+		{
+			desc:               "Selector without authentication requirement",
+			jwtCallerAllowlist: testApiName + ".Echo=a@x.com",
+			wantError:          "selector endpoints.examples.bookstore.Bookstore.Echo has no authentication requirement",
+		},
+		{
+			desc:               "Rule without callers",
+			jwtCallerAllowlist: testApiName + ".Admin= ,",
+			wantError:          "has no callers",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.JwtCallerAllowlist = tc.jwtCallerAllowlist
+			s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error not expected, got: %v", err)
+			}
+
+			for selector, wantCallers := range tc.wantAllowedCallers {
+				if got := s.Methods[selector].AllowedCallers; !reflect.DeepEqual(got, wantCallers) {
+					t.Errorf("AllowedCallers mismatch for %s, got: %v, want: %v", selector, got, wantCallers)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessDisabledFilters(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Admin",
+					},
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer-0",
+					JwksUri: "https://fake-jwks.com",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: testApiName + ".Admin",
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "auth_provider",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                string
+		disabledFilters     string
+		jwtCallerAllowlist  string
+		wantDisabledFilters map[string]map[string]bool
+		wantError           string
+	}{
+		{
+			desc:            "Filters of several selectors",
+			disabledFilters: testApiName + ".Admin= envoy.filters.http.jwt_authn ; " + testApiName + ".Echo=com.google.espv2.filters.http.backend_auth,com.google.espv2.filters.http.path_rewrite",
+			wantDisabledFilters: map[string]map[string]bool{
+				testApiName + ".Admin": {"envoy.filters.http.jwt_authn": true},
+				testApiName + ".Echo":  {"com.google.espv2.filters.http.backend_auth": true, "com.google.espv2.filters.http.path_rewrite": true},
+			},
+		},
+		{
+			desc:                "Jwt authn and rbac disabled with a caller allowlist",
+			disabledFilters:     testApiName + ".Admin=envoy.filters.http.jwt_authn,envoy.filters.http.rbac",
+			jwtCallerAllowlist:  testApiName + ".Admin=a@x.com",
+			wantDisabledFilters: map[string]map[string]bool{testApiName + ".Admin": {"envoy.filters.http.jwt_authn": true, "envoy.filters.http.rbac": true}},
+		},
+		{
+			desc:               "Jwt authn disabled with a caller allowlist",
+			disabledFilters:    testApiName + ".Admin=envoy.filters.http.jwt_authn",
+			jwtCallerAllowlist: testApiName + ".Admin=a@x.com",
+			wantError:          "cannot be disabled with a jwt caller allowlist",
+		},
+		{
+			desc:            "Malformed rule",
+			disabledFilters: testApiName + ".Admin",
+			wantError:       "must be in the format SELECTOR=FILTER[,FILTER...]",
+		},
+		{
+			desc:            "Unknown selector",
+			disabledFilters: testApiName + ".Unknown=envoy.filters.http.jwt_authn",
+			wantError:       "selector endpoints.examples.bookstore.Bookstore.Unknown is not defined",
+		},
+		{
+			desc:            "Transcoder",
+			disabledFilters: testApiName + ".Echo=envoy.filters.http.grpc_json_transcoder",
+			wantError:       "filter envoy.filters.http.grpc_json_transcoder of selector endpoints.examples.bookstore.Bookstore.Echo cannot be disabled: the transcoder has no per-route config",
+		},
+		{
+			desc:            "Filter without per-route config",
+			disabledFilters: testApiName + ".Echo=envoy.filters.http.cors",
+			wantError:       "filter envoy.filters.http.cors of selector endpoints.examples.bookstore.Bookstore.Echo cannot be disabled per operation",
+		},
+		{
+			desc:            "Rule without filters",
+			disabledFilters: testApiName + ".Echo= ,",
+			wantError:       "has no filters",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.DisabledFilters = tc.disabledFilters
+			opts.JwtCallerAllowlist = tc.jwtCallerAllowlist
+			s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error not expected, got: %v", err)
+			}
+
+			for selector, wantFilters := range tc.wantDisabledFilters {
+				if got := s.Methods[selector].DisabledFilters; !reflect.DeepEqual(got, wantFilters) {
+					t.Errorf("DisabledFilters mismatch for %s, got: %v, want: %v", selector, got, wantFilters)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessScOperationOverrides(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+					{
+						Name: "Health",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                 string
+		scOperationOverrides string
+		wantScCallingConfigs map[string]*scpb.OperationCallingConfig
+		wantError            string
+	}{
+		{
+			desc:                 "All settings overridden",
+			scOperationOverrides: testApiName + ".Echo= network_fail_open:false, check_timeout_ms:500, check_retries:0 ;",
+			wantScCallingConfigs: map[string]*scpb.OperationCallingConfig{
+				testApiName + ".Echo": {
+					NetworkFailOpen: &wrapperspb.BoolValue{Value: false},
+					CheckTimeoutMs:  &wrapperspb.UInt32Value{Value: 500},
+					CheckRetries:    &wrapperspb.UInt32Value{Value: 0},
+				},
+				testApiName + ".Health": nil,
+			},
+		},
+		{
+			desc:                 "Multiple operations",
+			scOperationOverrides: testApiName + ".Echo=network_fail_open:false;" + testApiName + ".Health=check_retries:5",
+			wantScCallingConfigs: map[string]*scpb.OperationCallingConfig{
+				testApiName + ".Echo": {
+					NetworkFailOpen: &wrapperspb.BoolValue{Value: false},
+				},
+				testApiName + ".Health": {
+					CheckRetries: &wrapperspb.UInt32Value{Value: 5},
+				},
+			},
+		},
+		{
+			desc:                 "Malformed rule",
+			scOperationOverrides: testApiName + ".Echo",
+			wantError:            "must be in the format SELECTOR=KEY:VALUE[,KEY:VALUE...]",
+		},
+		{
+			desc:                 "Unknown selector",
+			scOperationOverrides: testApiName + ".Unknown=check_retries:1",
+			wantError:            "selector endpoints.examples.bookstore.Bookstore.Unknown is not defined",
+		},
+		{
+			desc:                 "Malformed setting",
+			scOperationOverrides: testApiName + ".Echo=check_retries",
+			wantError:            "must be in the format KEY:VALUE",
+		},
+		{
+			desc:                 "Unknown key",
+			scOperationOverrides: testApiName + ".Echo=quota_retries:1",
+			wantError:            `unknown key "quota_retries"`,
+		},
+		{
+			desc:                 "Invalid fail policy",
+			scOperationOverrides: testApiName + ".Echo=network_fail_open:maybe",
+			wantError:            `invalid network_fail_open "maybe"`,
+		},
+		{
+			desc:                 "Zero check timeout",
+			scOperationOverrides: testApiName + ".Echo=check_timeout_ms:0",
+			wantError:            `invalid check_timeout_ms "0"`,
+		},
+		{
+			desc:                 "Negative check retries",
+			scOperationOverrides: testApiName + ".Echo=check_retries:-1",
+			wantError:            `invalid check_retries "-1"`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ScOperationOverrides = tc.scOperationOverrides
+			s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error not expected, got: %v", err)
+			}
+
+			for selector, wantConfig := range tc.wantScCallingConfigs {
+				if got := s.Methods[selector].ScCallingConfig; !proto.Equal(got, wantConfig) {
+					t.Errorf("ScCallingConfig mismatch for %s, got: %v, want: %v", selector, got, wantConfig)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessQuota(t *testing.T) {
+	testData := []struct {
+		desc                string
+		fakeServiceConfig   *confpb.Service
+		deterministicOutput bool
+		wantMethods         map[string]*MethodInfo
 	}{
 		{
 			desc: "Succeed, simple case",
@@ -2260,75 +3441,1867 @@ func TestProcessQuota(t *testing.T) {
 							Cost: 1,
 						},
 					},
-				},
-			},
-		},
-		{
-			desc: "Succeed, two metric cost items",
-			fakeServiceConfig: &confpb.Service{
-				Apis: []*apipb.Api{
+				},
+			},
+		},
+		{
+			desc: "Succeed, two metric cost items",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+						Methods: []*apipb.Method{
+							{
+								Name: "ListShelves",
+							},
+						},
+					},
+				},
+				Quota: &confpb.Quota{
+					MetricRules: []*confpb.MetricRule{
+						{
+							Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+							MetricCosts: map[string]int64{
+								"metric_c": 2,
+								"metric_a": 3,
+							},
+						},
+					},
+				},
+			},
+			wantMethods: map[string]*MethodInfo{
+				fmt.Sprintf("%s.%s", testApiName, "ListShelves"): &MethodInfo{
+					ShortName: "ListShelves",
+					ApiName:   testApiName,
+					HttpRule: []*httppattern.Pattern{
+						{
+							UriTemplate: parseUriTemplate(fmt.Sprintf("/%s/%s", testApiName, "ListShelves")),
+							HttpMethod:  util.POST,
+						},
+					},
+					MetricCosts: []*scpb.MetricCost{
+						{
+							Name: "metric_a",
+							Cost: 3,
+						},
+						{
+							Name: "metric_c",
+							Cost: 2,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "Succeed, metric costs sorted by name with deterministic output",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+						Methods: []*apipb.Method{
+							{
+								Name: "ListShelves",
+							},
+						},
+					},
+				},
+				Quota: &confpb.Quota{
+					MetricRules: []*confpb.MetricRule{
+						{
+							Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+							MetricCosts: map[string]int64{
+								"metric_e": 5,
+								"metric_c": 3,
+								"metric_a": 1,
+								"metric_d": 4,
+								"metric_b": 2,
+							},
+						},
+					},
+				},
+			},
+			deterministicOutput: true,
+			wantMethods: map[string]*MethodInfo{
+				fmt.Sprintf("%s.%s", testApiName, "ListShelves"): &MethodInfo{
+					ShortName: "ListShelves",
+					ApiName:   testApiName,
+					HttpRule: []*httppattern.Pattern{
+						{
+							UriTemplate: parseUriTemplate(fmt.Sprintf("/%s/%s", testApiName, "ListShelves")),
+							HttpMethod:  util.POST,
+						},
+					},
+					MetricCosts: []*scpb.MetricCost{
+						{
+							Name: "metric_a",
+							Cost: 1,
+						},
+						{
+							Name: "metric_b",
+							Cost: 2,
+						},
+						{
+							Name: "metric_c",
+							Cost: 3,
+						},
+						{
+							Name: "metric_d",
+							Cost: 4,
+						},
+						{
+							Name: "metric_e",
+							Cost: 5,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.DeterministicOutput = tc.deterministicOutput
+			serviceInfo, _ := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+
+			for key, gotMethod := range serviceInfo.Methods {
+				wantMethod := tc.wantMethods[key]
+
+				// We're not testing backend info here.
+				gotMethod.BackendInfo = nil
+
+				if !tc.deterministicOutput {
+					sort.Slice(gotMethod.MetricCosts, func(i, j int) bool { return gotMethod.MetricCosts[i].Name < gotMethod.MetricCosts[j].Name })
+				}
+				if eq := cmp.Equal(gotMethod, wantMethod, cmp.Comparer(proto.Equal)); !eq {
+					t.Errorf("Method mismatch \ngot : %+v,\nwant: %+v", gotMethod, wantMethod)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessQuotaCostHeaders(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "BatchCreateBooks",
+					},
+				},
+			},
+		},
+		Quota: &confpb.Quota{
+			MetricRules: []*confpb.MetricRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.BatchCreateBooks",
+					MetricCosts: map[string]int64{
+						"metric_a": 2,
+						"metric_b": 1,
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc             string
+		quotaCostHeaders string
+		wantMetricCosts  []*scpb.MetricCost
+		wantError        string
+	}{
+		{
+			desc:             "cost header for one metric",
+			quotaCostHeaders: "endpoints.examples.bookstore.Bookstore.BatchCreateBooks=metric_a:X-Batch-Size",
+			wantMetricCosts: []*scpb.MetricCost{
+				{
+					Name:       "metric_a",
+					Cost:       2,
+					CostHeader: "x-batch-size",
+				},
+				{
+					Name: "metric_b",
+					Cost: 1,
+				},
+			},
+		},
+		{
+			desc:             "cost headers for all metrics",
+			quotaCostHeaders: " endpoints.examples.bookstore.Bookstore.BatchCreateBooks = metric_a:x-batch-size, metric_b:x-item-count ;",
+			wantMetricCosts: []*scpb.MetricCost{
+				{
+					Name:       "metric_a",
+					Cost:       2,
+					CostHeader: "x-batch-size",
+				},
+				{
+					Name:       "metric_b",
+					Cost:       1,
+					CostHeader: "x-item-count",
+				},
+			},
+		},
+		{
+			desc:             "missing selector",
+			quotaCostHeaders: "metric_a:x-batch-size",
+			wantError:        `invalid quota cost header rule "metric_a:x-batch-size", must be in the format SELECTOR=METRIC:HEADER[,METRIC:HEADER...]`,
+		},
+		{
+			desc:             "unknown selector",
+			quotaCostHeaders: "endpoints.examples.bookstore.Bookstore.Unknown=metric_a:x-batch-size",
+			wantError:        "quota cost header selector endpoints.examples.bookstore.Bookstore.Unknown is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:             "missing header",
+			quotaCostHeaders: "endpoints.examples.bookstore.Bookstore.BatchCreateBooks=metric_a",
+			wantError:        `invalid setting "metric_a" in quota cost header rule "endpoints.examples.bookstore.Bookstore.BatchCreateBooks=metric_a", must be in the format METRIC:HEADER`,
+		},
+		{
+			desc:             "metric not in the quota metric rule",
+			quotaCostHeaders: "endpoints.examples.bookstore.Bookstore.BatchCreateBooks=metric_c:x-batch-size",
+			wantError:        `metric metric_c in quota cost header rule "endpoints.examples.bookstore.Bookstore.BatchCreateBooks=metric_c:x-batch-size" is not defined in the quota metric rules of endpoints.examples.bookstore.Bookstore.BatchCreateBooks`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.QuotaCostHeaders = tc.quotaCostHeaders
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotMetricCosts := serviceInfo.Methods["endpoints.examples.bookstore.Bookstore.BatchCreateBooks"].MetricCosts
+			sort.Slice(gotMetricCosts, func(i, j int) bool { return gotMetricCosts[i].Name < gotMetricCosts[j].Name })
+			if diff := cmp.Diff(tc.wantMetricCosts, gotMetricCosts, cmp.Comparer(proto.Equal)); diff != "" {
+				t.Errorf("MetricCosts mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessSkipServiceControlCheck(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                 string
+		skipCheck            bool
+		skipCheckSelectors   string
+		wantSkipCheckMethods []string
+		wantError            string
+	}{
+		{
+			desc: "check is not skipped by default",
+		},
+		{
+			desc:                 "skip check for all methods",
+			skipCheck:            true,
+			wantSkipCheckMethods: []string{"CreateShelf", "ListShelves"},
+		},
+		{
+			desc:                 "skip check for selectors",
+			skipCheckSelectors:   " endpoints.examples.bookstore.Bookstore.ListShelves ,",
+			wantSkipCheckMethods: []string{"ListShelves"},
+		},
+		{
+			desc:               "unknown selector",
+			skipCheckSelectors: "endpoints.examples.bookstore.Bookstore.Unknown",
+			wantError:          "selector endpoints.examples.bookstore.Bookstore.Unknown in --service_control_skip_check_selectors is not defined in Api.method or Http.rule",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.ScSkipCheck = tc.skipCheck
+			opts.ScSkipCheckSelectors = tc.skipCheckSelectors
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotSkipCheckMethods []string
+			for _, method := range serviceInfo.Methods {
+				if method.SkipServiceControlCheck {
+					gotSkipCheckMethods = append(gotSkipCheckMethods, method.ShortName)
+				}
+			}
+			sort.Strings(gotSkipCheckMethods)
+			if diff := cmp.Diff(tc.wantSkipCheckMethods, gotSkipCheckMethods); diff != "" {
+				t.Errorf("methods skipping check mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessAuditMode(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Control: &confpb.Control{
+			Environment: "servicecontrol.googleapis.com",
+		},
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                     string
+		auditMode                bool
+		auditModeSelectors       string
+		skipServiceControlFilter bool
+		disabledFilters          string
+		wantAuditedMethods       []string
+		wantError                string
+	}{
+		{
+			desc: "requests are enforced by default",
+		},
+		{
+			desc:               "audit mode for all methods",
+			auditMode:          true,
+			wantAuditedMethods: []string{"CreateShelf", "ListShelves"},
+		},
+		{
+			desc:               "audit mode for selectors",
+			auditModeSelectors: " endpoints.examples.bookstore.Bookstore.CreateShelf ,",
+			wantAuditedMethods: []string{"CreateShelf"},
+		},
+		{
+			desc:               "unknown selector",
+			auditModeSelectors: "endpoints.examples.bookstore.Bookstore.Unknown",
+			wantError:          "selector endpoints.examples.bookstore.Bookstore.Unknown in --audit_mode_selectors is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:                     "audit mode without the service control filter",
+			auditMode:                true,
+			skipServiceControlFilter: true,
+			wantError:                "audit mode requires the service control filter, which logs the failures, but the service config has no control environment or the filter is skipped",
+		},
+		{
+			desc:            "service control filter disabled in audit mode",
+			auditMode:       true,
+			disabledFilters: "endpoints.examples.bookstore.Bookstore.CreateShelf=com.google.espv2.filters.http.service_control",
+			wantError:       "filter com.google.espv2.filters.http.service_control of selector endpoints.examples.bookstore.Bookstore.CreateShelf cannot be disabled in audit mode, it logs the failures",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.AuditMode = tc.auditMode
+			opts.AuditModeSelectors = tc.auditModeSelectors
+			opts.SkipServiceControlFilter = tc.skipServiceControlFilter
+			opts.DisabledFilters = tc.disabledFilters
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotAuditedMethods []string
+			for _, method := range serviceInfo.Methods {
+				if method.AuditMode {
+					gotAuditedMethods = append(gotAuditedMethods, method.ShortName)
+				}
+			}
+			sort.Strings(gotAuditedMethods)
+			if diff := cmp.Diff(tc.wantAuditedMethods, gotAuditedMethods); diff != "" {
+				t.Errorf("methods in audit mode mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessTracingSampleRates(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                        string
+		tracingOperationSampleRates string
+		wantSampleRates             map[string]float64
+		wantError                   string
+	}{
+		{
+			desc:            "no overrides by default",
+			wantSampleRates: map[string]float64{},
+		},
+		{
+			desc:                        "overrides for selectors",
+			tracingOperationSampleRates: " endpoints.examples.bookstore.Bookstore.ListShelves = 0.5 ,endpoints.examples.bookstore.Bookstore.CreateShelf=0",
+			wantSampleRates: map[string]float64{
+				"ListShelves": 0.5,
+				"CreateShelf": 0,
+			},
+		},
+		{
+			desc:                        "unknown selector",
+			tracingOperationSampleRates: "endpoints.examples.bookstore.Bookstore.Unknown=0.5",
+			wantError:                   "trace sampling rate override selector endpoints.examples.bookstore.Bookstore.Unknown is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:                        "invalid rate",
+			tracingOperationSampleRates: "endpoints.examples.bookstore.Bookstore.ListShelves=1.5",
+			wantError:                   `invalid trace sampling rate "1.5" for selector endpoints.examples.bookstore.Bookstore.ListShelves, must be >= 0.0 and <= 1.0`,
+		},
+		{
+			desc:                        "invalid format",
+			tracingOperationSampleRates: "endpoints.examples.bookstore.Bookstore.ListShelves",
+			wantError:                   `invalid trace sampling rate override "endpoints.examples.bookstore.Bookstore.ListShelves", must be in the format SELECTOR=RATE`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.TracingOperationSampleRates = tc.tracingOperationSampleRates
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotSampleRates := make(map[string]float64)
+			for _, method := range serviceInfo.Methods {
+				if method.TracingSampleRate != nil {
+					gotSampleRates[method.ShortName] = *method.TracingSampleRate
+				}
+			}
+			if diff := cmp.Diff(tc.wantSampleRates, gotSampleRates); diff != "" {
+				t.Errorf("trace sampling rates mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessTracingSpanNameFormat(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                     string
+		tracingSpanNameFormat    string
+		tracingDisableDecorators bool
+		wantError                string
+	}{
+		{
+			desc:                  "all the placeholders",
+			tracingSpanNameFormat: "{PREFIX} {HTTP_METHOD} {API}.{METHOD}",
+		},
+		{
+			desc:                  "unknown placeholder",
+			tracingSpanNameFormat: "{PREFIX} {SELECTOR}",
+			wantError:             `invalid --tracing_span_name_format "{PREFIX} {SELECTOR}", unknown placeholder {SELECTOR}`,
+		},
+		{
+			desc:      "empty format",
+			wantError: "--tracing_span_name_format cannot be empty unless --tracing_disable_decorators is set",
+		},
+		{
+			desc:                     "empty format without decorators",
+			tracingDisableDecorators: true,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.TracingSpanNameFormat = tc.tracingSpanNameFormat
+			opts.TracingDisableDecorators = tc.tracingDisableDecorators
+			_, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestProcessResponseCacheSelectors(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "GetShelf",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.GetShelf",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves/{shelf}",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/shelves",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                    string
+		responseCacheSelectors  string
+		responseCacheTtl        time.Duration
+		responseCacheKeyHeaders string
+		apiKeyLocations         string
+		wantTtls                map[string]time.Duration
+		wantKeyHeaders          map[string][]string
+		wantApiKeyQueryParams   map[string][]string
+		wantError               string
+	}{
+		{
+			desc:     "no cached responses by default",
+			wantTtls: map[string]time.Duration{},
+		},
+		{
+			desc:                   "selectors with and without ttl",
+			responseCacheSelectors: " endpoints.examples.bookstore.Bookstore.ListShelves ,endpoints.examples.bookstore.Bookstore.GetShelf=5m",
+			wantTtls: map[string]time.Duration{
+				"ListShelves": time.Minute,
+				"GetShelf":    5 * time.Minute,
+			},
+			wantKeyHeaders: map[string][]string{
+				"ListShelves": {"x-api-key"},
+				"GetShelf":    {"x-api-key"},
+			},
+			wantApiKeyQueryParams: map[string][]string{
+				"ListShelves": {"key", "api_key"},
+				"GetShelf":    {"key", "api_key"},
+			},
+		},
+		{
+			desc:                    "cache key with the request headers and the API keys",
+			responseCacheSelectors:  "endpoints.examples.bookstore.Bookstore.GetShelf",
+			responseCacheKeyHeaders: "Accept-Language, X-Api-Key",
+			apiKeyLocations:         "header=Authorization:ApiKey,cookie=api_key,query=token",
+			wantTtls: map[string]time.Duration{
+				"GetShelf": time.Minute,
+			},
+			wantKeyHeaders: map[string][]string{
+				"GetShelf": {"Accept-Language", "X-Api-Key", "Authorization", "cookie"},
+			},
+			wantApiKeyQueryParams: map[string][]string{
+				"GetShelf": {"key", "api_key", "token"},
+			},
+		},
+		{
+			desc:                   "unknown selector",
+			responseCacheSelectors: "endpoints.examples.bookstore.Bookstore.Unknown",
+			wantError:              "selector endpoints.examples.bookstore.Bookstore.Unknown in --response_cache_selectors is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:                   "not a GET operation",
+			responseCacheSelectors: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+			wantError:              "selector endpoints.examples.bookstore.Bookstore.CreateShelf in --response_cache_selectors is not a GET operation",
+		},
+		{
+			desc:                   "invalid ttl",
+			responseCacheSelectors: "endpoints.examples.bookstore.Bookstore.GetShelf=0s",
+			wantError:              `invalid response cache ttl "0s" for selector endpoints.examples.bookstore.Bookstore.GetShelf, must be a positive duration`,
+		},
+		{
+			desc:                   "invalid default ttl",
+			responseCacheSelectors: "endpoints.examples.bookstore.Bookstore.GetShelf",
+			responseCacheTtl:       -time.Second,
+			wantError:              "invalid response cache ttl -1s, must be positive",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.ResponseCacheSelectors = tc.responseCacheSelectors
+			opts.ResponseCacheKeyHeaders = tc.responseCacheKeyHeaders
+			opts.ApiKeyLocations = tc.apiKeyLocations
+			if tc.responseCacheTtl != 0 {
+				opts.ResponseCacheTtl = tc.responseCacheTtl
+			}
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotTtls := make(map[string]time.Duration)
+			gotKeyHeaders := make(map[string][]string)
+			gotApiKeyQueryParams := make(map[string][]string)
+			for _, method := range serviceInfo.Methods {
+				if method.ResponseCacheTtl > 0 {
+					gotTtls[method.ShortName] = method.ResponseCacheTtl
+					gotKeyHeaders[method.ShortName] = method.ResponseCacheKeyHeaders
+					gotApiKeyQueryParams[method.ShortName] = method.ResponseCacheApiKeyQueryParams
+				}
+			}
+			if diff := cmp.Diff(tc.wantTtls, gotTtls); diff != "" {
+				t.Errorf("response cache ttls mismatch (-want +got):\n%s", diff)
+			}
+			if tc.wantKeyHeaders != nil {
+				if diff := cmp.Diff(tc.wantKeyHeaders, gotKeyHeaders); diff != "" {
+					t.Errorf("response cache key headers mismatch (-want +got):\n%s", diff)
+				}
+				if diff := cmp.Diff(tc.wantApiKeyQueryParams, gotApiKeyQueryParams); diff != "" {
+					t.Errorf("response cache api key query params mismatch (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessEtagSelectors(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "GetShelf",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.GetShelf",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves/{shelf}",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/shelves",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc          string
+		etagSelectors string
+		wantMethods   []string
+		wantError     string
+	}{
+		{
+			desc: "no etag by default",
+		},
+		{
+			desc:          "etag selectors",
+			etagSelectors: " endpoints.examples.bookstore.Bookstore.GetShelf ,endpoints.examples.bookstore.Bookstore.ListShelves",
+			wantMethods:   []string{"GetShelf", "ListShelves"},
+		},
+		{
+			desc:          "unknown selector",
+			etagSelectors: "endpoints.examples.bookstore.Bookstore.Unknown",
+			wantError:     "selector endpoints.examples.bookstore.Bookstore.Unknown in --etag_selectors is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:          "not a GET operation",
+			etagSelectors: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+			wantError:     "selector endpoints.examples.bookstore.Bookstore.CreateShelf in --etag_selectors is not a GET operation",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:80"
+			opts.EtagSelectors = tc.etagSelectors
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotMethods []string
+			for _, method := range serviceInfo.Methods {
+				if method.EnableEtag {
+					gotMethods = append(gotMethods, method.ShortName)
+				}
+			}
+			sort.Strings(gotMethods)
+			if diff := cmp.Diff(tc.wantMethods, gotMethods); diff != "" {
+				t.Errorf("etag methods mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessIdempotencySelectors(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "GetShelf",
+					},
+					{
+						Name: "CreateShelf",
+					},
+					{
+						Name: "DeleteShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.GetShelf",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves/{shelf}",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/shelves",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.DeleteShelf",
+					Pattern: &annotationspb.HttpRule_Delete{
+						Delete: "/shelves/{shelf}",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                 string
+		idempotencySelectors string
+		idempotencyTtl       time.Duration
+		wantMethods          []string
+		wantError            string
+	}{
+		{
+			desc: "no deduplication by default",
+		},
+		{
+			desc:                 "idempotency selectors",
+			idempotencySelectors: "endpoints.examples.bookstore.Bookstore.CreateShelf, endpoints.examples.bookstore.Bookstore.DeleteShelf",
+			wantMethods:          []string{"CreateShelf", "DeleteShelf"},
+		},
+		{
+			desc:                 "unknown selector",
+			idempotencySelectors: "endpoints.examples.bookstore.Bookstore.Unknown",
+			wantError:            "selector endpoints.examples.bookstore.Bookstore.Unknown in --idempotency_selectors is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:                 "not a mutating operation",
+			idempotencySelectors: "endpoints.examples.bookstore.Bookstore.GetShelf",
+			wantError:            "selector endpoints.examples.bookstore.Bookstore.GetShelf in --idempotency_selectors is not a mutating operation",
+		},
+		{
+			desc:                 "invalid ttl",
+			idempotencySelectors: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+			idempotencyTtl:       -time.Second,
+			wantError:            "invalid idempotency ttl -1s, must be positive",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.IdempotencySelectors = tc.idempotencySelectors
+			if tc.idempotencyTtl != 0 {
+				opts.IdempotencyTtl = tc.idempotencyTtl
+			}
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotMethods []string
+			for _, method := range serviceInfo.Methods {
+				if method.EnableIdempotency {
+					gotMethods = append(gotMethods, method.ShortName)
+				}
+			}
+			sort.Strings(gotMethods)
+			if diff := cmp.Diff(tc.wantMethods, gotMethods); diff != "" {
+				t.Errorf("idempotency methods mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessConcurrencyLimits(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "GetShelf",
+					},
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc              string
+		concurrencyLimits string
+		wantLimits        map[string]uint32
+		wantError         string
+	}{
+		{
+			desc:       "no limits by default",
+			wantLimits: map[string]uint32{},
+		},
+		{
+			desc:              "concurrency limits",
+			concurrencyLimits: "endpoints.examples.bookstore.Bookstore.GetShelf=10, endpoints.examples.bookstore.Bookstore.ListShelves = 2",
+			wantLimits: map[string]uint32{
+				"GetShelf":    10,
+				"ListShelves": 2,
+			},
+		},
+		{
+			desc:              "missing limit",
+			concurrencyLimits: "endpoints.examples.bookstore.Bookstore.GetShelf",
+			wantError:         `invalid concurrency limit "endpoints.examples.bookstore.Bookstore.GetShelf", must be in the format SELECTOR=N`,
+		},
+		{
+			desc:              "unknown selector",
+			concurrencyLimits: "endpoints.examples.bookstore.Bookstore.Unknown=10",
+			wantError:         "selector endpoints.examples.bookstore.Bookstore.Unknown in --concurrency_limits is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:              "zero limit",
+			concurrencyLimits: "endpoints.examples.bookstore.Bookstore.GetShelf=0",
+			wantError:         `invalid concurrency limit "0" for selector endpoints.examples.bookstore.Bookstore.GetShelf, must be a positive integer`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ConcurrencyLimits = tc.concurrencyLimits
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotLimits := map[string]uint32{}
+			for _, method := range serviceInfo.Methods {
+				if method.MaxConcurrentRequests > 0 {
+					gotLimits[method.ShortName] = method.MaxConcurrentRequests
+				}
+			}
+			if diff := cmp.Diff(tc.wantLimits, gotLimits); diff != "" {
+				t.Errorf("concurrency limits mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessUploadSizeThresholds(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "CreateBook",
+					},
+					{
+						Name: "GetBook",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                     string
+		uploadBackendAddress     string
+		uploadSizeThresholds     string
+		wantThresholds           map[string]int64
+		wantUploadBackendCluster *BackendRoutingCluster
+		wantError                string
+	}{
+		{
+			desc:           "no upload routing by default",
+			wantThresholds: map[string]int64{},
+		},
+		{
+			desc:                 "upload size thresholds",
+			uploadBackendAddress: "https://upload.example.com:8443",
+			uploadSizeThresholds: "endpoints.examples.bookstore.Bookstore.CreateBook = 1048576,",
+			wantThresholds: map[string]int64{
+				"CreateBook": 1048576,
+			},
+			wantUploadBackendCluster: &BackendRoutingCluster{
+				ClusterName: "backend-cluster-bookstore.endpoints.project123.cloud.goog_upload",
+				Hostname:    "upload.example.com",
+				Port:        8443,
+				UseTLS:      true,
+				Protocol:    util.HTTP1,
+			},
+		},
+		{
+			desc:                 "missing upload backend",
+			uploadSizeThresholds: "endpoints.examples.bookstore.Bookstore.CreateBook=1048576",
+			wantError:            "--upload_size_thresholds requires --upload_backend_address",
+		},
+		{
+			desc:                 "missing upload size thresholds",
+			uploadBackendAddress: "http://127.0.0.1:8090",
+			wantError:            "--upload_backend_address requires --upload_size_thresholds",
+		},
+		{
+			desc:                 "unknown selector",
+			uploadBackendAddress: "http://127.0.0.1:8090",
+			uploadSizeThresholds: "endpoints.examples.bookstore.Bookstore.Unknown=1048576",
+			wantError:            "selector endpoints.examples.bookstore.Bookstore.Unknown in --upload_size_thresholds is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:                 "negative threshold",
+			uploadBackendAddress: "http://127.0.0.1:8090",
+			uploadSizeThresholds: "endpoints.examples.bookstore.Bookstore.CreateBook=-1",
+			wantError:            `invalid upload size threshold "-1" for selector endpoints.examples.bookstore.Bookstore.CreateBook, must be a positive integer`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.UploadBackendAddress = tc.uploadBackendAddress
+			opts.UploadSizeThresholds = tc.uploadSizeThresholds
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotThresholds := map[string]int64{}
+			for _, method := range serviceInfo.Methods {
+				if method.UploadSizeThreshold > 0 {
+					gotThresholds[method.ShortName] = method.UploadSizeThreshold
+				}
+			}
+			if diff := cmp.Diff(tc.wantThresholds, gotThresholds); diff != "" {
+				t.Errorf("upload size thresholds mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantUploadBackendCluster, serviceInfo.UploadBackendCluster); diff != "" {
+				t.Errorf("upload backend cluster mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessQueryParamMatchers(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "GetBook",
+					},
+					{
+						Name: "GetBookContent",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc               string
+		queryParamMatchers string
+		wantMatchers       map[string][]*QueryParamMatcher
+		wantError          string
+	}{
+		{
+			desc:         "no query param matchers by default",
+			wantMatchers: map[string][]*QueryParamMatcher{},
+		},
+		{
+			desc:               "query param matchers with and without value",
+			queryParamMatchers: "endpoints.examples.bookstore.Bookstore.GetBookContent = alt:media, download; endpoints.examples.bookstore.Bookstore.GetBook=fields",
+			wantMatchers: map[string][]*QueryParamMatcher{
+				"GetBookContent": {
+					{
+						Name:  "alt",
+						Value: "media",
+					},
+					{
+						Name: "download",
+					},
+				},
+				"GetBook": {
+					{
+						Name: "fields",
+					},
+				},
+			},
+		},
+		{
+			desc:               "unknown selector",
+			queryParamMatchers: "endpoints.examples.bookstore.Bookstore.Unknown=alt:media",
+			wantError:          "query param matcher selector endpoints.examples.bookstore.Bookstore.Unknown is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:               "missing query params",
+			queryParamMatchers: "endpoints.examples.bookstore.Bookstore.GetBookContent",
+			wantError:          `invalid query param matcher rule "endpoints.examples.bookstore.Bookstore.GetBookContent", must be in the format SELECTOR=PARAM[:VALUE][,PARAM[:VALUE]...]`,
+		},
+		{
+			desc:               "empty value",
+			queryParamMatchers: "endpoints.examples.bookstore.Bookstore.GetBookContent=alt:",
+			wantError:          `invalid query param "alt:" in query param matcher rule "endpoints.examples.bookstore.Bookstore.GetBookContent=alt:", the value cannot be empty`,
+		},
+		{
+			desc:               "duplicate query param",
+			queryParamMatchers: "endpoints.examples.bookstore.Bookstore.GetBookContent=alt:media,alt:json",
+			wantError:          `duplicate query param alt in query param matcher rule "endpoints.examples.bookstore.Bookstore.GetBookContent=alt:media,alt:json"`,
+		},
+		{
+			desc:               "duplicate selector",
+			queryParamMatchers: "endpoints.examples.bookstore.Bookstore.GetBookContent=alt:media;endpoints.examples.bookstore.Bookstore.GetBookContent=download",
+			wantError:          "duplicate query param matcher rule for selector endpoints.examples.bookstore.Bookstore.GetBookContent",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.QueryParamMatchers = tc.queryParamMatchers
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotMatchers := map[string][]*QueryParamMatcher{}
+			for _, method := range serviceInfo.Methods {
+				if len(method.QueryParamMatchers) > 0 {
+					gotMatchers[method.ShortName] = method.QueryParamMatchers
+				}
+			}
+			if diff := cmp.Diff(tc.wantMatchers, gotMatchers); diff != "" {
+				t.Errorf("query param matchers mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessGrpcStatusHttpCodes(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "CreateBook",
+					},
+					{
+						Name: "GetBook",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                   string
+		backendAddress         string
+		grpcStatusHttpCodes    string
+		operationGrpcStatusMap string
+		wantCodes              map[string]map[uint32]uint32
+		wantError              string
+	}{
+		{
+			desc:           "no grpc status http codes by default",
+			backendAddress: "grpc://127.0.0.1:8082",
+			wantCodes:      map[string]map[uint32]uint32{},
+		},
+		{
+			desc:                "default grpc status http codes apply to all operations",
+			backendAddress:      "grpc://127.0.0.1:8082",
+			grpcStatusHttpCodes: "NOT_FOUND:410, unavailable:502",
+			wantCodes: map[string]map[uint32]uint32{
+				"CreateBook": {5: 410, 14: 502},
+				"GetBook":    {5: 410, 14: 502},
+			},
+		},
+		{
+			desc:                   "operation grpc status http codes override the defaults",
+			backendAddress:         "grpc://127.0.0.1:8082",
+			grpcStatusHttpCodes:    "NOT_FOUND:410",
+			operationGrpcStatusMap: "endpoints.examples.bookstore.Bookstore.GetBook=NOT_FOUND:404,9:409",
+			wantCodes: map[string]map[uint32]uint32{
+				"CreateBook": {5: 410},
+				"GetBook":    {5: 404, 9: 409},
+			},
+		},
+		{
+			desc:                "defaults do not apply to http backends",
+			backendAddress:      "http://127.0.0.1:8082",
+			grpcStatusHttpCodes: "NOT_FOUND:410",
+			wantCodes:           map[string]map[uint32]uint32{},
+		},
+		{
+			desc:                   "operation of http backend",
+			backendAddress:         "http://127.0.0.1:8082",
+			operationGrpcStatusMap: "endpoints.examples.bookstore.Bookstore.GetBook=NOT_FOUND:404",
+			wantError:              "selector endpoints.examples.bookstore.Bookstore.GetBook in --transcoding_operation_grpc_status_http_codes is not served by a gRPC backend",
+		},
+		{
+			desc:                   "unknown selector",
+			backendAddress:         "grpc://127.0.0.1:8082",
+			operationGrpcStatusMap: "endpoints.examples.bookstore.Bookstore.Unknown=NOT_FOUND:404",
+			wantError:              "selector endpoints.examples.bookstore.Bookstore.Unknown in --transcoding_operation_grpc_status_http_codes is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:                "OK is not mapped",
+			backendAddress:      "grpc://127.0.0.1:8082",
+			grpcStatusHttpCodes: "OK:200",
+			wantError:           `invalid grpc status code "OK", must be the name or the number of a gRPC status code other than OK`,
+		},
+		{
+			desc:                "unknown grpc status code",
+			backendAddress:      "grpc://127.0.0.1:8082",
+			grpcStatusHttpCodes: "NOT_A_CODE:404",
+			wantError:           `invalid grpc status code "NOT_A_CODE", must be the name or the number of a gRPC status code`,
+		},
+		{
+			desc:                "http status code out of range",
+			backendAddress:      "grpc://127.0.0.1:8082",
+			grpcStatusHttpCodes: "NOT_FOUND:700",
+			wantError:           `invalid http status code "700" of grpc status code NOT_FOUND, must be between 200 and 599`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = tc.backendAddress
+			opts.TranscodingGrpcStatusHttpCodes = tc.grpcStatusHttpCodes
+			opts.TranscodingOperationGrpcStatusHttpCodes = tc.operationGrpcStatusMap
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotCodes := map[string]map[uint32]uint32{}
+			for _, method := range serviceInfo.Methods {
+				if len(method.GrpcStatusHttpCodes) > 0 {
+					gotCodes[method.ShortName] = method.GrpcStatusHttpCodes
+				}
+			}
+			if diff := cmp.Diff(tc.wantCodes, gotCodes); diff != "" {
+				t.Errorf("grpc status http codes mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessRequestBodyValidation(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name:           "CreateBook",
+						RequestTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.CreateBookRequest",
+					},
+					{
+						Name:           "UpdateBook",
+						RequestTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.UpdateBookRequest",
+					},
+					{
+						Name:           "GetBook",
+						RequestTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.GetBookRequest",
+					},
+					{
+						Name:             "StreamBooks",
+						RequestTypeUrl:   "type.googleapis.com/endpoints.examples.bookstore.CreateBookRequest",
+						RequestStreaming: true,
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.CreateBook",
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/v1/shelves/{shelf}/books",
+					},
+					Body: "book",
+					AdditionalBindings: []*annotationspb.HttpRule{
+						{
+							Pattern: &annotationspb.HttpRule_Put{
+								Put: "/v1/{book.name=shelves/*/books/*}",
+							},
+							Body: "book",
+						},
+						{
+							Pattern: &annotationspb.HttpRule_Post{
+								Post: "/v1/shelves/{shelf}/books:count",
+							},
+							Body: "shelf",
+						},
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.UpdateBook",
+					Pattern: &annotationspb.HttpRule_Patch{
+						Patch: "/v1/{book.name=shelves/*/books/*}",
+					},
+					Body: "*",
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.GetBook",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/{name=shelves/*/books/*}",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.StreamBooks",
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/v1/books:stream",
+					},
+					Body: "*",
+				},
+			},
+		},
+		Types: []*ptypepb.Type{
+			{
+				Name: "endpoints.examples.bookstore.CreateBookRequest",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "shelf",
+						JsonName: "shelf",
+						Kind:     ptypepb.Field_TYPE_INT64,
+					},
+					{
+						Name:     "book",
+						JsonName: "book",
+						Kind:     ptypepb.Field_TYPE_MESSAGE,
+						TypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.Book",
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.UpdateBookRequest",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "book",
+						JsonName: "book",
+						Kind:     ptypepb.Field_TYPE_MESSAGE,
+						TypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.Book",
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.GetBookRequest",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "name",
+						JsonName: "name",
+						Kind:     ptypepb.Field_TYPE_STRING,
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc                string
+		backendAddress      string
+		validateBody        bool
+		rejectUnknownFields bool
+		optOutSelectors     string
+		wantValidations     map[string][]*RequestBodyValidation
+		wantError           string
+	}{
+		{
+			desc:            "no request body validation by default",
+			backendAddress:  "grpc://127.0.0.1:8082",
+			wantValidations: map[string][]*RequestBodyValidation{},
+		},
+		{
+			desc:           "request bodies of the http rules with a message body are validated",
+			backendAddress: "grpc://127.0.0.1:8082",
+			validateBody:   true,
+			wantValidations: map[string][]*RequestBodyValidation{
+				"CreateBook": {
+					{
+						BodyType:       "endpoints.examples.bookstore.Book",
+						ValidateFields: true,
+					},
+					{
+						BodyType:       "endpoints.examples.bookstore.Book",
+						BoundFields:    []string{"name"},
+						ValidateFields: true,
+					},
+				},
+				"UpdateBook": {
+					{
+						BodyType:       "endpoints.examples.bookstore.UpdateBookRequest",
+						BoundFields:    []string{"book.name"},
+						ValidateFields: true,
+					},
+				},
+			},
+		},
+		{
+			desc:            "opted out operations are not validated",
+			backendAddress:  "grpc://127.0.0.1:8082",
+			validateBody:    true,
+			optOutSelectors: "endpoints.examples.bookstore.Bookstore.CreateBook",
+			wantValidations: map[string][]*RequestBodyValidation{
+				"UpdateBook": {
+					{
+						BodyType:       "endpoints.examples.bookstore.UpdateBookRequest",
+						BoundFields:    []string{"book.name"},
+						ValidateFields: true,
+					},
+				},
+			},
+		},
+		{
+			desc:                "unknown fields are rejected without validating the fields",
+			backendAddress:      "grpc://127.0.0.1:8082",
+			rejectUnknownFields: true,
+			optOutSelectors:     "endpoints.examples.bookstore.Bookstore.CreateBook",
+			wantValidations: map[string][]*RequestBodyValidation{
+				"UpdateBook": {
+					{
+						BodyType:            "endpoints.examples.bookstore.UpdateBookRequest",
+						BoundFields:         []string{"book.name"},
+						RejectUnknownFields: true,
+					},
+				},
+			},
+		},
+		{
+			desc:            "request bodies of http backends are not validated",
+			backendAddress:  "http://127.0.0.1:8082",
+			validateBody:    true,
+			wantValidations: map[string][]*RequestBodyValidation{},
+		},
+		{
+			desc:            "unknown opt out selector",
+			backendAddress:  "grpc://127.0.0.1:8082",
+			validateBody:    true,
+			optOutSelectors: "endpoints.examples.bookstore.Bookstore.Unknown",
+			wantError:       "selector endpoints.examples.bookstore.Bookstore.Unknown in --transcoding_body_validation_opt_out_selectors is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:            "opt out selectors without request body validation",
+			backendAddress:  "grpc://127.0.0.1:8082",
+			optOutSelectors: "endpoints.examples.bookstore.Bookstore.CreateBook",
+			wantError:       "--transcoding_body_validation_opt_out_selectors requires --transcoding_validate_request_body or --transcoding_reject_unknown_body_fields",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = tc.backendAddress
+			opts.TranscodingValidateRequestBody = tc.validateBody
+			opts.TranscodingRejectUnknownBodyFields = tc.rejectUnknownFields
+			opts.TranscodingBodyValidationOptOutSelectors = tc.optOutSelectors
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotValidations := map[string][]*RequestBodyValidation{}
+			for _, method := range serviceInfo.Methods {
+				for _, httpRule := range method.HttpRule {
+					if validation, ok := method.RequestBodyValidations[httpRule]; ok {
+						gotValidations[method.ShortName] = append(gotValidations[method.ShortName], validation)
+					}
+				}
+			}
+			if diff := cmp.Diff(tc.wantValidations, gotValidations); diff != "" {
+				t.Errorf("request body validations mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessStreamFormats(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "GetBook",
+					},
+					{
+						Name:              "ListBooks",
+						ResponseStreaming: true,
+					},
+					{
+						Name:              "WatchShelves",
+						ResponseStreaming: true,
+					},
+					{
+						Name:             "CreateBooks",
+						RequestStreaming: true,
+					},
+					{
+						Name:              "DownloadBook",
+						ResponseStreaming: true,
+						ResponseTypeUrl:   "type.googleapis.com/google.api.HttpBody",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc           string
+		backendAddress string
+		streamFormats  string
+		wantFormats    map[string]string
+		wantError      string
+	}{
+		{
+			desc:           "server streams are JSON arrays by default",
+			backendAddress: "grpc://127.0.0.1:8082",
+			wantFormats:    map[string]string{},
+		},
+		{
+			desc:           "stream formats of the server-streaming methods",
+			backendAddress: "grpc://127.0.0.1:8082",
+			streamFormats:  "endpoints.examples.bookstore.Bookstore.ListBooks=ndjson, endpoints.examples.bookstore.Bookstore.WatchShelves=SSE",
+			wantFormats: map[string]string{
+				"ListBooks":    "ndjson",
+				"WatchShelves": "sse",
+			},
+		},
+		{
+			desc:           "unknown selector",
+			backendAddress: "grpc://127.0.0.1:8082",
+			streamFormats:  "endpoints.examples.bookstore.Bookstore.Unknown=sse",
+			wantError:      "selector endpoints.examples.bookstore.Bookstore.Unknown in --transcoding_stream_formats is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:           "operation of http backend",
+			backendAddress: "http://127.0.0.1:8082",
+			streamFormats:  "endpoints.examples.bookstore.Bookstore.ListBooks=sse",
+			wantError:      "selector endpoints.examples.bookstore.Bookstore.ListBooks in --transcoding_stream_formats is not served by a gRPC backend",
+		},
+		{
+			desc:           "unary method",
+			backendAddress: "grpc://127.0.0.1:8082",
+			streamFormats:  "endpoints.examples.bookstore.Bookstore.GetBook=sse",
+			wantError:      "selector endpoints.examples.bookstore.Bookstore.GetBook in --transcoding_stream_formats is not a server-streaming method transcoded into JSON",
+		},
+		{
+			desc:           "client-streaming method",
+			backendAddress: "grpc://127.0.0.1:8082",
+			streamFormats:  "endpoints.examples.bookstore.Bookstore.CreateBooks=ndjson",
+			wantError:      "selector endpoints.examples.bookstore.Bookstore.CreateBooks in --transcoding_stream_formats is not a server-streaming method transcoded into JSON",
+		},
+		{
+			desc:           "google.api.HttpBody server stream",
+			backendAddress: "grpc://127.0.0.1:8082",
+			streamFormats:  "endpoints.examples.bookstore.Bookstore.DownloadBook=ndjson",
+			wantError:      "selector endpoints.examples.bookstore.Bookstore.DownloadBook in --transcoding_stream_formats is not a server-streaming method transcoded into JSON",
+		},
+		{
+			desc:           "unknown format",
+			backendAddress: "grpc://127.0.0.1:8082",
+			streamFormats:  "endpoints.examples.bookstore.Bookstore.ListBooks=jsonl",
+			wantError:      `invalid stream format "jsonl" of selector endpoints.examples.bookstore.Bookstore.ListBooks, must be ndjson or sse`,
+		},
+		{
+			desc:           "missing format",
+			backendAddress: "grpc://127.0.0.1:8082",
+			streamFormats:  "endpoints.examples.bookstore.Bookstore.ListBooks",
+			wantError:      `invalid stream format "endpoints.examples.bookstore.Bookstore.ListBooks", must be in the format SELECTOR=ndjson|sse`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = tc.backendAddress
+			opts.TranscodingStreamFormats = tc.streamFormats
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotFormats := map[string]string{}
+			for _, method := range serviceInfo.Methods {
+				if method.StreamFormat != "" {
+					gotFormats[method.ShortName] = method.StreamFormat
+				}
+			}
+			if diff := cmp.Diff(tc.wantFormats, gotFormats); diff != "" {
+				t.Errorf("stream formats mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessTranscodingOperationPrintOptions(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "GetBook",
+					},
 					{
-						Name: testApiName,
-						Methods: []*apipb.Method{
-							{
-								Name: "ListShelves",
-							},
-						},
+						Name: "ListBooks",
 					},
-				},
-				Quota: &confpb.Quota{
-					MetricRules: []*confpb.MetricRule{
-						{
-							Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
-							MetricCosts: map[string]int64{
-								"metric_c": 2,
-								"metric_a": 3,
-							},
-						},
+					{
+						Name: "ListShelves",
 					},
 				},
 			},
-			wantMethods: map[string]*MethodInfo{
-				fmt.Sprintf("%s.%s", testApiName, "ListShelves"): &MethodInfo{
-					ShortName: "ListShelves",
-					ApiName:   testApiName,
-					HttpRule: []*httppattern.Pattern{
-						{
-							UriTemplate: parseUriTemplate(fmt.Sprintf("/%s/%s", testApiName, "ListShelves")),
-							HttpMethod:  util.POST,
-						},
-					},
-					MetricCosts: []*scpb.MetricCost{
-						{
-							Name: "metric_a",
-							Cost: 3,
-						},
-						{
-							Name: "metric_c",
-							Cost: 2,
-						},
-					},
+		},
+	}
+	testData := []struct {
+		desc                   string
+		backendAddress         string
+		alwaysPrintEnumsAsInts bool
+		operationPrintOptions  string
+		wantPrintOptions       map[string]TranscodingPrintOptions
+		wantError              string
+	}{
+		{
+			desc:             "no operation overrides the print options by default",
+			backendAddress:   "grpc://127.0.0.1:8082",
+			wantPrintOptions: map[string]TranscodingPrintOptions{},
+		},
+		{
+			desc:                   "overrides start from the deployment-wide print options",
+			backendAddress:         "grpc://127.0.0.1:8082",
+			alwaysPrintEnumsAsInts: true,
+			operationPrintOptions:  "endpoints.examples.bookstore.Bookstore.GetBook=always_print_primitive_fields:true, preserve_proto_field_names:TRUE; endpoints.examples.bookstore.Bookstore.ListBooks=always_print_enums_as_ints:false",
+			wantPrintOptions: map[string]TranscodingPrintOptions{
+				"GetBook": {
+					AlwaysPrintPrimitiveFields: true,
+					AlwaysPrintEnumsAsInts:     true,
+					PreserveProtoFieldNames:    true,
+				},
+				"ListBooks": {},
+			},
+		},
+		{
+			desc:                   "overrides equal to the deployment-wide print options are dropped",
+			backendAddress:         "grpc://127.0.0.1:8082",
+			alwaysPrintEnumsAsInts: true,
+			operationPrintOptions:  "endpoints.examples.bookstore.Bookstore.GetBook=always_print_enums_as_ints:true;endpoints.examples.bookstore.Bookstore.ListShelves=preserve_proto_field_names:1",
+			wantPrintOptions: map[string]TranscodingPrintOptions{
+				"ListShelves": {
+					AlwaysPrintEnumsAsInts:  true,
+					PreserveProtoFieldNames: true,
 				},
 			},
 		},
+		{
+			desc:                  "unknown selector",
+			backendAddress:        "grpc://127.0.0.1:8082",
+			operationPrintOptions: "endpoints.examples.bookstore.Bookstore.Unknown=always_print_primitive_fields:true",
+			wantError:             "selector endpoints.examples.bookstore.Bookstore.Unknown in --transcoding_operation_print_options is not defined in Api.method or Http.rule",
+		},
+		{
+			desc:                  "operation of http backend",
+			backendAddress:        "http://127.0.0.1:8082",
+			operationPrintOptions: "endpoints.examples.bookstore.Bookstore.GetBook=always_print_primitive_fields:true",
+			wantError:             "selector endpoints.examples.bookstore.Bookstore.GetBook in --transcoding_operation_print_options is not served by a gRPC backend",
+		},
+		{
+			desc:                  "unknown option",
+			backendAddress:        "grpc://127.0.0.1:8082",
+			operationPrintOptions: "endpoints.examples.bookstore.Bookstore.GetBook=stream_newline_delimited:true",
+			wantError:             `invalid print option "stream_newline_delimited" of selector endpoints.examples.bookstore.Bookstore.GetBook, must be one of always_print_primitive_fields, always_print_enums_as_ints or preserve_proto_field_names`,
+		},
+		{
+			desc:                  "invalid value",
+			backendAddress:        "grpc://127.0.0.1:8082",
+			operationPrintOptions: "endpoints.examples.bookstore.Bookstore.GetBook=always_print_primitive_fields:yes",
+			wantError:             `invalid value "yes" of print option always_print_primitive_fields of selector endpoints.examples.bookstore.Bookstore.GetBook, must be true or false`,
+		},
+		{
+			desc:                  "missing value",
+			backendAddress:        "grpc://127.0.0.1:8082",
+			operationPrintOptions: "endpoints.examples.bookstore.Bookstore.GetBook=always_print_primitive_fields",
+			wantError:             `invalid print option "always_print_primitive_fields" of selector endpoints.examples.bookstore.Bookstore.GetBook, must be in the format OPTION:BOOL`,
+		},
+		{
+			desc:                  "missing options",
+			backendAddress:        "grpc://127.0.0.1:8082",
+			operationPrintOptions: "endpoints.examples.bookstore.Bookstore.GetBook",
+			wantError:             `invalid operation print options "endpoints.examples.bookstore.Bookstore.GetBook", must be in the format SELECTOR=OPTION:BOOL[,OPTION:BOOL...]`,
+		},
 	}
 
 	for _, tc := range testData {
 		t.Run(tc.desc, func(t *testing.T) {
 			opts := options.DefaultConfigGeneratorOptions()
-			opts.BackendAddress = "grpc://127.0.0.1:80"
-			serviceInfo, _ := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+			opts.BackendAddress = tc.backendAddress
+			opts.TranscodingAlwaysPrintEnumsAsInts = tc.alwaysPrintEnumsAsInts
+			opts.TranscodingOperationPrintOptions = tc.operationPrintOptions
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
 
-			for key, gotMethod := range serviceInfo.Methods {
-				wantMethod := tc.wantMethods[key]
+			gotPrintOptions := map[string]TranscodingPrintOptions{}
+			for _, method := range serviceInfo.Methods {
+				if method.TranscodingPrintOptions != nil {
+					gotPrintOptions[method.ShortName] = *method.TranscodingPrintOptions
+				}
+			}
+			if diff := cmp.Diff(tc.wantPrintOptions, gotPrintOptions); diff != "" {
+				t.Errorf("print options mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
 
-				// We're not testing backend info here.
-				gotMethod.BackendInfo = nil
+func TestProcessTranscodingQueryArrayStyle(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListBooks",
+					},
+				},
+			},
+		},
+	}
+	testData := []struct {
+		desc            string
+		backendAddress  string
+		queryArrayStyle string
+		wantStrip       bool
+		wantError       string
+	}{
+		{
+			desc:            "repeat style",
+			backendAddress:  "grpc://127.0.0.1:8082",
+			queryArrayStyle: "repeat",
+		},
+		{
+			desc:            "brackets style",
+			backendAddress:  "grpc://127.0.0.1:8082",
+			queryArrayStyle: "brackets",
+			wantStrip:       true,
+		},
+		{
+			desc:            "brackets style of http backend",
+			backendAddress:  "http://127.0.0.1:8082",
+			queryArrayStyle: "brackets",
+		},
+		{
+			desc:            "unknown style",
+			backendAddress:  "grpc://127.0.0.1:8082",
+			queryArrayStyle: "comma",
+			wantError:       `invalid --transcoding_query_array_style "comma", must be repeat or brackets`,
+		},
+	}
 
-				sort.Slice(gotMethod.MetricCosts, func(i, j int) bool { return gotMethod.MetricCosts[i].Name < gotMethod.MetricCosts[j].Name })
-				if eq := cmp.Equal(gotMethod, wantMethod, cmp.Comparer(proto.Equal)); !eq {
-					t.Errorf("Method mismatch \ngot : %+v,\nwant: %+v", gotMethod, wantMethod)
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = tc.backendAddress
+			opts.TranscodingQueryArrayStyle = tc.queryArrayStyle
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want: %v", err, tc.wantError)
 				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := serviceInfo.Methods[testApiName+".ListBooks"].StripQueryArrayBrackets; got != tc.wantStrip {
+				t.Errorf("got StripQueryArrayBrackets: %v, want: %v", got, tc.wantStrip)
 			}
 		})
 	}
@@ -2347,7 +5320,9 @@ func TestProcessEmptyJwksUriByOpenID(t *testing.T) {
 		desc                 string
 		fakeServiceConfig    *confpb.Service
 		disableOidcDiscovery bool
+		deferOpenIDDiscovery bool
 		wantedJwksUri        string
+		wantDeferred         bool
 		wantErr              bool
 	}{
 		{
@@ -2408,11 +5383,32 @@ func TestProcessEmptyJwksUriByOpenID(t *testing.T) {
 			disableOidcDiscovery: true,
 			wantErr:              true,
 		},
+		{
+			desc: "Success, empty JWKS URI and Open ID Connect Discovery failed, but it is deferred.",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:     "auth_provider",
+							Issuer: "aaaaa.bbbbbb.ccccc/inaccessible_uri/",
+						},
+					},
+				},
+			},
+			deferOpenIDDiscovery: true,
+			wantDeferred:         true,
+		},
 	}
 
 	for i, tc := range testData {
 		opts := options.DefaultConfigGeneratorOptions()
 		opts.DisableOidcDiscovery = tc.disableOidcDiscovery
+		opts.DeferOpenIDDiscovery = tc.deferOpenIDDiscovery
 		serviceInfo, err := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
 
 		if tc.wantErr {
@@ -2423,7 +5419,283 @@ func TestProcessEmptyJwksUriByOpenID(t *testing.T) {
 			t.Errorf("Test Desc(%d): %s, process jwksUri got: %v, but expected no err", i, tc.desc, err)
 		} else if jwksUri := serviceInfo.serviceConfig.Authentication.Providers[0].JwksUri; jwksUri != tc.wantedJwksUri {
 			t.Errorf("Test Desc(%d): %s, process jwksUri got: %v, want: %v", i, tc.desc, jwksUri, tc.wantedJwksUri)
+		} else if deferred := serviceInfo.DeferredOpenIDProviders["auth_provider"]; deferred != tc.wantDeferred {
+			t.Errorf("Test Desc(%d): %s, deferred got: %v, want: %v", i, tc.desc, deferred, tc.wantDeferred)
+		}
+	}
+}
+
+func TestProcessCalloutPolicies(t *testing.T) {
+	testData := []struct {
+		desc                string
+		calloutPolicies     string
+		wantCalloutPolicies map[string]*CalloutPolicy
+		wantError           string
+	}{
+		{
+			desc: "no callout policies",
+		},
+		{
+			desc:            "callout policies of all callouts",
+			calloutPolicies: "imds=timeout:1s; iam=timeout:2s;jwks=timeout:5s;openid_discovery=timeout:2s,retries:3,retry_backoff:500ms;service_control=timeout:1500ms,retries:2",
+			wantCalloutPolicies: map[string]*CalloutPolicy{
+				ImdsCallout:            {Timeout: time.Second, Retries: -1},
+				IamCallout:             {Timeout: 2 * time.Second, Retries: -1},
+				JwksCallout:            {Timeout: 5 * time.Second, Retries: -1},
+				OpenIDDiscoveryCallout: {Timeout: 2 * time.Second, Retries: 3, RetryBackoff: 500 * time.Millisecond},
+				ServiceControlCallout:  {Timeout: 1500 * time.Millisecond, Retries: 2},
+			},
+		},
+		{
+			desc:            "unknown callout",
+			calloutPolicies: "backend=timeout:1s",
+			wantError:       `unknown callout "backend" in callout policy "backend=timeout:1s", must be one of imds, iam, jwks, openid_discovery or service_control`,
+		},
+		{
+			desc:            "duplicate callout",
+			calloutPolicies: "jwks=timeout:1s;jwks=timeout:2s",
+			wantError:       "duplicate callout policy for jwks",
+		},
+		{
+			desc:            "invalid timeout",
+			calloutPolicies: "jwks=timeout:5",
+			wantError:       `invalid timeout "5" in callout policy "jwks=timeout:5", must be a duration > 0`,
+		},
+		{
+			desc:            "unknown key",
+			calloutPolicies: "jwks=deadline:5s",
+			wantError:       `unknown key "deadline" in callout policy "jwks=deadline:5s", must be one of timeout, retries or retry_backoff`,
+		},
+		{
+			desc:            "retries of a callout retried by Envoy",
+			calloutPolicies: "imds=timeout:1s,retries:2",
+			wantError:       `only the timeout of the imds callout can be set, in callout policy "imds=timeout:1s,retries:2"`,
+		},
+		{
+			desc:            "retry backoff of service control",
+			calloutPolicies: "service_control=retries:2,retry_backoff:1s",
+			wantError:       `retry_backoff is not supported by the service_control callout, in callout policy "service_control=retries:2,retry_backoff:1s"`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			fakeServiceConfig := &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.CalloutPolicies = tc.calloutPolicies
+
+			serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("want error: %s, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(serviceInfo.CalloutPolicies, tc.wantCalloutPolicies) {
+				t.Errorf("want callout policies: %v, got: %v", tc.wantCalloutPolicies, serviceInfo.CalloutPolicies)
+			}
+			if got, want := serviceInfo.CalloutTimeout(JwksCallout), opts.HttpRequestTimeout; tc.calloutPolicies == "" && got != want {
+				t.Errorf("want the jwks timeout to default to %v, got: %v", want, got)
+			}
+		})
+	}
+}
+
+func TestResolveJwksUriUsingOpenIDRetries(t *testing.T) {
+	jwksUriEntry, _ := json.Marshal(map[string]string{"jwks_uri": "this-is-jwksUri"})
+	failures := 0
+	openIDServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(jwksUriEntry)
+	}))
+	defer openIDServer.Close()
+
+	testData := []struct {
+		desc            string
+		failures        int
+		calloutPolicies string
+		budget          time.Duration
+		wantedJwksUri   string
+		wantErr         string
+	}{
+		{
+			desc:     "no retries by default",
+			failures: 1,
+			wantErr:  "503 Service Unavailable",
+		},
+		{
+			desc:            "retried until the discovery succeeds",
+			failures:        2,
+			calloutPolicies: "openid_discovery=retries:2,retry_backoff:1ms",
+			wantedJwksUri:   "this-is-jwksUri",
+		},
+		{
+			desc:            "retries exhausted",
+			failures:        3,
+			calloutPolicies: "openid_discovery=retries:2,retry_backoff:1ms",
+			wantErr:         "503 Service Unavailable",
+		},
+		{
+			desc:            "retries stopped by the budget",
+			failures:        5,
+			calloutPolicies: "openid_discovery=retries:5,retry_backoff:50ms",
+			budget:          120 * time.Millisecond,
+			wantErr:         "by the budget of 120ms",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			failures = tc.failures
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.CalloutPolicies = tc.calloutPolicies
+			opts.OpenIDDiscoveryBudget = tc.budget
+			serviceInfo := &ServiceInfo{
+				Options: opts,
+			}
+			if err := serviceInfo.processCalloutPolicies(); err != nil {
+				t.Fatal(err)
+			}
+
+			jwksUri, err := serviceInfo.resolveJwksUriUsingOpenID(openIDServer.URL)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("want error containing %q, got: %v", tc.wantErr, err)
+				}
+			} else if err != nil || jwksUri != tc.wantedJwksUri {
+				t.Errorf("want jwks uri %q, got: %q, err: %v", tc.wantedJwksUri, jwksUri, err)
+			}
+		})
+	}
+}
+
+func TestProcessEmptyJwksUrisByOpenIDConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	requests := make(map[string]int)
+	openIDServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		requests[r.URL.Path]++
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/unavailable") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		jwksUriEntry, _ := json.Marshal(map[string]string{"jwks_uri": "https://jwks" + strings.TrimSuffix(r.URL.Path, util.OpenIDDiscoveryCfgURLSuffix)})
+		_, _ = w.Write(jwksUriEntry)
+	}))
+	defer openIDServer.Close()
+
+	makeServiceConfig := func(issuerPaths ...string) *confpb.Service {
+		serviceConfig := &confpb.Service{
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+			Authentication: &confpb.Authentication{},
 		}
+		for i, path := range issuerPaths {
+			serviceConfig.Authentication.Providers = append(serviceConfig.Authentication.Providers, &confpb.AuthProvider{
+				Id:     fmt.Sprintf("auth_provider_%d", i),
+				Issuer: openIDServer.URL + path,
+			})
+		}
+		return serviceConfig
+	}
+
+	testData := []struct {
+		desc              string
+		issuerPaths       []string
+		wantJwksUris      []string
+		wantRequests      int
+		wantMaxInFlight   int
+		wantErrContaining []string
+	}{
+		{
+			desc:            "issuers discovered concurrently, within the limit",
+			issuerPaths:     []string{"/0", "/1", "/2", "/3", "/4", "/5", "/6", "/7", "/8", "/9"},
+			wantJwksUris:    []string{"https://jwks/0", "https://jwks/1", "https://jwks/2", "https://jwks/3", "https://jwks/4", "https://jwks/5", "https://jwks/6", "https://jwks/7", "https://jwks/8", "https://jwks/9"},
+			wantRequests:    10,
+			wantMaxInFlight: maxConcurrentOpenIDDiscoveries,
+		},
+		{
+			desc:            "issuer shared by providers discovered once",
+			issuerPaths:     []string{"/0", "/0", "/1"},
+			wantJwksUris:    []string{"https://jwks/0", "https://jwks/0", "https://jwks/1"},
+			wantRequests:    2,
+			wantMaxInFlight: 2,
+		},
+		{
+			desc:              "errors of all the failed providers aggregated",
+			issuerPaths:       []string{"/unavailable/0", "/1", "/unavailable/2"},
+			wantRequests:      3,
+			wantMaxInFlight:   3,
+			wantErrContaining: []string{"provider (auth_provider_0)", "provider (auth_provider_2)"},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			inFlight, maxInFlight = 0, 0
+			requests = make(map[string]int)
+			serviceConfig := makeServiceConfig(tc.issuerPaths...)
+			_, err := NewServiceInfoFromServiceConfig(serviceConfig, testConfigID, options.DefaultConfigGeneratorOptions())
+
+			if len(tc.wantErrContaining) != 0 {
+				if err == nil {
+					t.Fatalf("want error, got none")
+				}
+				for _, want := range tc.wantErrContaining {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("want error containing %q, got: %v", want, err)
+					}
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tc.wantJwksUris {
+				if got := serviceConfig.Authentication.Providers[i].JwksUri; got != want {
+					t.Errorf("want jwks_uri %q of provider %d, got %q", want, i, got)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			total := 0
+			for _, n := range requests {
+				total += n
+			}
+			if total != tc.wantRequests {
+				t.Errorf("want %d discovery requests, got %d: %v", tc.wantRequests, total, requests)
+			}
+			if maxInFlight != tc.wantMaxInFlight {
+				t.Errorf("want %d concurrent discoveries, got %d", tc.wantMaxInFlight, maxInFlight)
+			}
+		})
 	}
 }
 
@@ -2939,9 +6211,11 @@ func TestProcessAccessToken(t *testing.T) {
 		},
 	}
 	testCases := []struct {
-		desc              string
-		serviceAccountKey string
-		wantAccessToken   *commonpb.AccessToken
+		desc                      string
+		serviceAccountKey         string
+		metadataProvider          string
+		impersonateServiceAccount string
+		wantAccessToken           *commonpb.AccessToken
 	}{
 		{
 			desc: "get access token from imds",
@@ -2968,11 +6242,41 @@ func TestProcessAccessToken(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc:             "get access token from token agent for non-GCP metadata provider",
+			metadataProvider: "aws",
+			wantAccessToken: &commonpb.AccessToken{
+				TokenType: &commonpb.AccessToken_RemoteToken{
+					RemoteToken: &commonpb.HttpUri{
+						Uri:     "http://127.0.0.1:8791/local/access_token",
+						Cluster: "token-agent-cluster",
+						Timeout: ptypes.DurationProto(30 * time.Second),
+					},
+				},
+			},
+		},
+		{
+			desc:                      "get access token from token agent for impersonated service account",
+			impersonateServiceAccount: "proxy@project.iam.gserviceaccount.com",
+			wantAccessToken: &commonpb.AccessToken{
+				TokenType: &commonpb.AccessToken_RemoteToken{
+					RemoteToken: &commonpb.HttpUri{
+						Uri:     "http://127.0.0.1:8791/local/access_token",
+						Cluster: "token-agent-cluster",
+						Timeout: ptypes.DurationProto(30 * time.Second),
+					},
+				},
+			},
+		},
 	}
 
 	for _, tc := range testCases {
 		opts := options.DefaultConfigGeneratorOptions()
 		opts.ServiceAccountKey = tc.serviceAccountKey
+		opts.ImpersonateServiceAccount = tc.impersonateServiceAccount
+		if tc.metadataProvider != "" {
+			opts.MetadataProvider = tc.metadataProvider
+		}
 		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, "ConfigID", opts)
 		if err != nil {
 			t.Fatal(err)
@@ -2986,7 +6290,439 @@ func TestProcessAccessToken(t *testing.T) {
 
 }
 
+func TestCheckNonGCP(t *testing.T) {
+	testCases := []struct {
+		desc                      string
+		controlEnvironment        string
+		serviceAccountKey         string
+		metadataProvider          string
+		skipServiceControlFilter  bool
+		serviceControlCredentials *options.IAMCredentialsOptions
+		wantError                 string
+	}{
+		{
+			desc: "no GCP services called",
+		},
+		{
+			desc:               "service control without access token",
+			controlEnvironment: "servicecontrol.googleapis.com",
+			wantError:          "the metadata server is not used with --non_gcp: Service Control servicecontrol.googleapis.com needs an access token from --service_account_key or a non-GCP --metadata_provider",
+		},
+		{
+			desc:               "service control with service account key",
+			controlEnvironment: "servicecontrol.googleapis.com",
+			serviceAccountKey:  "this-is-service-account-key",
+		},
+		{
+			desc:               "service control with non-GCP metadata provider",
+			controlEnvironment: "servicecontrol.googleapis.com",
+			metadataProvider:   "aws",
+		},
+		{
+			desc:                     "service control filter skipped",
+			controlEnvironment:       "servicecontrol.googleapis.com",
+			skipServiceControlFilter: true,
+		},
+		{
+			desc:               "service control and iam without access token",
+			controlEnvironment: "servicecontrol.googleapis.com",
+			serviceControlCredentials: &options.IAMCredentialsOptions{
+				ServiceAccountEmail: "sa@project.iam.gserviceaccount.com",
+			},
+			wantError: "the metadata server is not used with --non_gcp: Service Control servicecontrol.googleapis.com needs an access token from --service_account_key or a non-GCP --metadata_provider; IAM https://iamcredentials.googleapis.com needs an access token from --service_account_key or a non-GCP --metadata_provider",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fakeServiceConfig := &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+				Control: &confpb.Control{
+					Environment: tc.controlEnvironment,
+				},
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.NonGCP = true
+			opts.DisableTracing = true
+			opts.ServiceAccountKey = tc.serviceAccountKey
+			if tc.metadataProvider != "" {
+				opts.MetadataProvider = tc.metadataProvider
+			}
+			opts.SkipServiceControlFilter = tc.skipServiceControlFilter
+			opts.ServiceControlCredentials = tc.serviceControlCredentials
+
+			_, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, "ConfigID", opts)
+			if tc.wantError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || err.Error() != tc.wantError {
+				t.Errorf("want error: %s, got: %v", tc.wantError, err)
+			}
+		})
+	}
+}
+
+func TestCheckImpersonation(t *testing.T) {
+	testCases := []struct {
+		desc                      string
+		impersonateServiceAccount string
+		serviceControlCredentials *options.IAMCredentialsOptions
+		backendAuthCredentials    *options.IAMCredentialsOptions
+		wantError                 string
+	}{
+		{
+			desc: "no impersonation",
+			serviceControlCredentials: &options.IAMCredentialsOptions{
+				ServiceAccountEmail: "sa@project.iam.gserviceaccount.com",
+			},
+		},
+		{
+			desc:                      "impersonation alone",
+			impersonateServiceAccount: "proxy@project.iam.gserviceaccount.com",
+		},
+		{
+			desc:                      "impersonation with the service control iam service account",
+			impersonateServiceAccount: "proxy@project.iam.gserviceaccount.com",
+			serviceControlCredentials: &options.IAMCredentialsOptions{
+				ServiceAccountEmail: "sa@project.iam.gserviceaccount.com",
+			},
+			wantError: "--impersonate_service_account cannot be used together with --service_control_iam_service_account or --backend_auth_iam_service_account",
+		},
+		{
+			desc:                      "impersonation with the backend auth iam service account",
+			impersonateServiceAccount: "proxy@project.iam.gserviceaccount.com",
+			backendAuthCredentials: &options.IAMCredentialsOptions{
+				ServiceAccountEmail: "sa@project.iam.gserviceaccount.com",
+				TokenKind:           options.IDToken,
+			},
+			wantError: "--impersonate_service_account cannot be used together with --service_control_iam_service_account or --backend_auth_iam_service_account",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fakeServiceConfig := &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ImpersonateServiceAccount = tc.impersonateServiceAccount
+			opts.ServiceControlCredentials = tc.serviceControlCredentials
+			opts.BackendAuthCredentials = tc.backendAuthCredentials
+
+			_, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, "ConfigID", opts)
+			if tc.wantError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || err.Error() != tc.wantError {
+				t.Errorf("want error: %s, got: %v", tc.wantError, err)
+			}
+		})
+	}
+}
+
 func parseUriTemplate(input string) *httppattern.UriTemplate {
 	u, _ := httppattern.ParseUriTemplate(input)
 	return u
 }
+
+func TestProcessGrpcHealthPassthrough(t *testing.T) {
+	testData := []struct {
+		desc               string
+		fakeServiceConfig  *confpb.Service
+		backendAddress     string
+		wantGeneratedRoute bool
+		wantError          string
+	}{
+		{
+			desc: "Health check method is added for a gRPC backend",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+						Methods: []*apipb.Method{
+							{
+								Name: "Echo",
+							},
+						},
+					},
+				},
+			},
+			backendAddress:     "grpc://127.0.0.1:80",
+			wantGeneratedRoute: true,
+		},
+		{
+			desc: "Health check method defined by the service config is kept",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+						Methods: []*apipb.Method{
+							{
+								Name: "Echo",
+							},
+						},
+					},
+					{
+						Name: "grpc.health.v1.Health",
+						Methods: []*apipb.Method{
+							{
+								Name: "Check",
+							},
+						},
+					},
+				},
+			},
+			backendAddress:     "grpc://127.0.0.1:80",
+			wantGeneratedRoute: false,
+		},
+		{
+			desc: "Failed with an http backend",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			},
+			backendAddress: "http://127.0.0.1:80",
+			wantError:      "--enable_grpc_health_passthrough requires a grpc:// or grpcs:// --backend_address",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = tc.backendAddress
+			opts.EnableGrpcHealthPassthrough = true
+			s, err := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error not expected, got: %v", err)
+			}
+
+			method, ok := s.Methods[util.GrpcHealthCheckSelector]
+			if !ok {
+				t.Fatalf("method %s not found", util.GrpcHealthCheckSelector)
+			}
+			if method.IsGenerated != tc.wantGeneratedRoute {
+				t.Errorf("IsGenerated mismatch, got: %v, want: %v", method.IsGenerated, tc.wantGeneratedRoute)
+			}
+			if !tc.wantGeneratedRoute {
+				return
+			}
+			if !method.SkipServiceControl {
+				t.Errorf("SkipServiceControl should be set for the generated health check method")
+			}
+			var gotPaths []string
+			for _, rule := range method.HttpRule {
+				gotPaths = append(gotPaths, rule.HttpMethod+" "+rule.UriTemplate.String())
+			}
+			wantPaths := []string{util.POST + " " + util.GrpcHealthCheckPath}
+			if !reflect.DeepEqual(gotPaths, wantPaths) {
+				t.Errorf("HttpRule mismatch, got: %v, want: %v", gotPaths, wantPaths)
+			}
+		})
+	}
+}
+
+func TestProcessApiBasePath(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.Echo", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/echo/{id}",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc           string
+		apiBasePath    string
+		wantEchoPath   string
+		wantHealthPath string
+		wantError      string
+	}{
+		{
+			desc:           "no api base path",
+			wantEchoPath:   "/echo/{id=*}",
+			wantHealthPath: "/healthz",
+		},
+		{
+			desc:           "http rules prefixed, health check kept",
+			apiBasePath:    "/gateway/v1",
+			wantEchoPath:   "/gateway/v1/echo/{id=*}",
+			wantHealthPath: "/healthz",
+		},
+		{
+			desc:        "failure with a trailing slash",
+			apiBasePath: "/gateway/v1/",
+			wantError:   `invalid --api_base_path "/gateway/v1/"`,
+		},
+		{
+			desc:        "failure with a wildcard",
+			apiBasePath: "/gateway/*",
+			wantError:   `invalid --api_base_path "/gateway/*"`,
+		},
+		{
+			desc:        "failure without a leading slash",
+			apiBasePath: "gateway",
+			wantError:   `invalid --api_base_path "gateway"`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.ApiBasePath = tc.apiBasePath
+			opts.Healthz = "/healthz"
+			s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error not expected, got: %v", err)
+			}
+
+			echo := s.Methods[fmt.Sprintf("%s.Echo", testApiName)]
+			if got := echo.HttpRule[0].UriTemplate.String(); got != tc.wantEchoPath {
+				t.Errorf("want http rule %s, got %s", tc.wantEchoPath, got)
+			}
+			if echo.UnderApiBasePath != (tc.apiBasePath != "") {
+				t.Errorf("want UnderApiBasePath %v, got %v", tc.apiBasePath != "", echo.UnderApiBasePath)
+			}
+
+			healthz := s.Methods[fmt.Sprintf("%s.%s_HealthCheck", util.EspOperation, util.AutogeneratedOperationPrefix)]
+			if got := healthz.HttpRule[0].UriTemplate.String(); got != tc.wantHealthPath {
+				t.Errorf("want health check path %s, got %s", tc.wantHealthPath, got)
+			}
+		})
+	}
+}
+
+func TestProcessBackendHostRewrite(t *testing.T) {
+	testData := []struct {
+		desc               string
+		backendAddress     string
+		hostRewrite        string
+		hostRewriteLiteral string
+		wantHostRewrite    string
+		wantError          string
+	}{
+		{
+			desc:           "Host is preserved by default",
+			backendAddress: "http://backend.example.com:8080",
+		},
+		{
+			desc:            "Host of the backend address with a non-default port",
+			backendAddress:  "http://backend.example.com:8080",
+			hostRewrite:     "backend_address",
+			wantHostRewrite: "backend.example.com:8080",
+		},
+		{
+			desc:            "Host of the backend address with the default https port",
+			backendAddress:  "https://backend.example.com",
+			hostRewrite:     "backend_address",
+			wantHostRewrite: "backend.example.com",
+		},
+		{
+			desc:            "Host of an IPv6 backend address",
+			backendAddress:  "http://[::1]:8080",
+			hostRewrite:     "backend_address",
+			wantHostRewrite: "[::1]:8080",
+		},
+		{
+			desc:               "Literal host",
+			backendAddress:     "http://127.0.0.1:8080",
+			hostRewrite:        "literal",
+			hostRewriteLiteral: "api.example.com",
+			wantHostRewrite:    "api.example.com",
+		},
+		{
+			desc:           "Failed with a literal host missing",
+			backendAddress: "http://127.0.0.1:8080",
+			hostRewrite:    "literal",
+			wantError:      "--backend_host_rewrite=literal requires --backend_host_rewrite_literal",
+		},
+		{
+			desc:               "Failed with an invalid literal host",
+			backendAddress:     "http://127.0.0.1:8080",
+			hostRewrite:        "literal",
+			hostRewriteLiteral: "api.example.com/foo",
+			wantError:          `invalid --backend_host_rewrite_literal "api.example.com/foo"`,
+		},
+		{
+			desc:           "Failed with an unknown mode",
+			backendAddress: "http://127.0.0.1:8080",
+			hostRewrite:    "backend",
+			wantError:      `invalid --backend_host_rewrite "backend"`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			fakeServiceConfig := &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = tc.backendAddress
+			if tc.hostRewrite != "" {
+				opts.BackendHostRewrite = tc.hostRewrite
+			}
+			opts.BackendHostRewriteLiteral = tc.hostRewriteLiteral
+			s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error not expected, got: %v", err)
+			}
+			if got := s.LocalBackendCluster.HostRewrite; got != tc.wantHostRewrite {
+				t.Errorf("HostRewrite mismatch, got: %q, want: %q", got, tc.wantHostRewrite)
+			}
+		})
+	}
+}
@@ -0,0 +1,622 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	acmeHttp01 = "http-01"
+	acmeDns01  = "dns-01"
+
+	// The files of the ACME account key and of the issued certificate in
+	// --acme_cache_dir.
+	acmeAccountKeyFile  = "account.key"
+	acmeCertificateFile = "cert.pem"
+	acmeCertKeyFile     = "cert.key"
+)
+
+var (
+	// How long an HTTP-01 challenge is checked to be served by Envoy before
+	// it's accepted, and how often.
+	acmeChallengeCheckTimeout  = 30 * time.Second
+	acmeChallengeCheckInterval = time.Second
+	// How long an order is given to complete, and the backoff of the retries
+	// of the failed ones.
+	acmeOrderTimeout     = 10 * time.Minute
+	acmeMinRetryInterval = time.Minute
+	acmeMaxRetryInterval = time.Hour
+)
+
+// acmeClient is the part of the RFC 8555 client of golang.org/x/crypto/acme
+// used to order the certificates.
+type acmeClient interface {
+	Register(ctx context.Context, acct *acme.Account, prompt func(tosURL string) bool) (*acme.Account, error)
+	AuthorizeOrder(ctx context.Context, id []acme.AuthzID, opt ...acme.OrderOption) (*acme.Order, error)
+	GetAuthorization(ctx context.Context, url string) (*acme.Authorization, error)
+	Accept(ctx context.Context, chal *acme.Challenge) (*acme.Challenge, error)
+	WaitAuthorization(ctx context.Context, url string) (*acme.Authorization, error)
+	WaitOrder(ctx context.Context, url string) (*acme.Order, error)
+	CreateOrderCert(ctx context.Context, url string, csr []byte, bundle bool) (der [][]byte, certURL string, err error)
+	HTTP01ChallengeResponse(token string) (string, error)
+	DNS01ChallengeRecord(token string) (string, error)
+}
+
+// acmeDNSProvider publishes the TXT records of the DNS-01 challenges.
+type acmeDNSProvider interface {
+	// present adds the value to the TXT record of the name.
+	present(ctx context.Context, name, value string) error
+	// cleanUp removes the value from the TXT record of the name.
+	cleanUp(ctx context.Context, name, value string) error
+}
+
+// acmeManager obtains the server certificate of --acme_domains from an ACME
+// CA, and renews it ahead of its expiration. The certificate is kept in
+// --acme_cache_dir, if set, so a restarted proxy doesn't order a new one.
+type acmeManager struct {
+	domains     []string
+	challenge   string
+	cacheDir    string
+	email       string
+	renewBefore time.Duration
+
+	client acmeClient
+	dns    acmeDNSProvider
+	// The URL of the plain HTTP listener of Envoy, where the pending HTTP-01
+	// challenges are checked before they are accepted.
+	challengeURL string
+	// Applies the certificate and the pending HTTP-01 challenges to Envoy.
+	onChange func()
+	logger   *structuredLogger
+
+	registered bool
+
+	mu         sync.Mutex
+	cert       *configinfo.AcmeCertificate
+	notAfter   time.Time
+	challenges map[string]string
+}
+
+// newAcmeManager makes the manager of --acme_domains, and loads the cached
+// certificate. The client and the DNS provider are set by the caller.
+func newAcmeManager(opts options.ConfigGeneratorOptions, logger *structuredLogger) (*acmeManager, error) {
+	domains, err := parseAcmeDomains(opts.AcmeDomains)
+	if err != nil {
+		return nil, err
+	}
+	if !*AcmeAcceptTos {
+		return nil, fmt.Errorf("--acme_domains requires --acme_accept_tos, to agree to the terms of service of the ACME CA")
+	}
+	if *AcmeRenewBefore <= 0 {
+		return nil, fmt.Errorf("--acme_renew_before must be positive")
+	}
+
+	a := &acmeManager{
+		domains:     domains,
+		challenge:   *AcmeChallenge,
+		cacheDir:    *AcmeCacheDir,
+		email:       *AcmeEmail,
+		renewBefore: *AcmeRenewBefore,
+		logger:      logger,
+		challenges:  make(map[string]string),
+	}
+	switch a.challenge {
+	case acmeHttp01:
+		if opts.AcmeHttpPort == 0 {
+			return nil, fmt.Errorf("--acme_challenge=%s requires --acme_http_port", acmeHttp01)
+		}
+		for _, domain := range domains {
+			if strings.HasPrefix(domain, "*.") {
+				return nil, fmt.Errorf("the wildcard domain %s of --acme_domains requires --acme_challenge=%s", domain, acmeDns01)
+			}
+		}
+		host := opts.ListenerAddress
+		switch host {
+		case "", "0.0.0.0":
+			host = "127.0.0.1"
+		case "::":
+			host = "::1"
+		}
+		a.challengeURL = "http://" + net.JoinHostPort(host, strconv.Itoa(opts.AcmeHttpPort))
+	case acmeDns01:
+		if *AcmeDnsProject == "" || *AcmeDnsManagedZone == "" {
+			return nil, fmt.Errorf("--acme_challenge=%s requires --acme_dns_project and --acme_dns_managed_zone", acmeDns01)
+		}
+	default:
+		return nil, fmt.Errorf(`invalid --acme_challenge %q, must be either "%s" or "%s"`, a.challenge, acmeHttp01, acmeDns01)
+	}
+
+	if err := a.loadCachedCertificate(); err != nil {
+		// A corrupted cache only costs a new order.
+		logger.Errorf("fail to load the cached ACME certificate, %v", err)
+	}
+	return a, nil
+}
+
+// parseAcmeDomains parses the comma separated domains of --acme_domains.
+func parseAcmeDomains(s string) ([]string, error) {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, domain := range strings.Split(s, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		name := strings.TrimPrefix(domain, "*.")
+		if net.ParseIP(name) != nil || !strings.Contains(name, ".") || strings.ContainsAny(name, "*/:_ ") {
+			return nil, fmt.Errorf("invalid domain %q in --acme_domains", domain)
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("--acme_domains has no domain")
+	}
+	return domains, nil
+}
+
+// newAcmeClient returns the client of --acme_directory_url, with the account
+// key of --acme_cache_dir, generated if missing.
+func newAcmeClient(cacheDir string) (*acme.Client, error) {
+	var key crypto.Signer
+	keyFile := filepath.Join(cacheDir, acmeAccountKeyFile)
+	if cacheDir != "" {
+		if keyPEM, err := ioutil.ReadFile(keyFile); err == nil {
+			if key, err = parsePrivateKey(keyPEM); err != nil {
+				return nil, fmt.Errorf("invalid ACME account key %s, %v", keyFile, err)
+			}
+		}
+	}
+	if key == nil {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key = ecKey
+		if cacheDir != "" {
+			keyPEM, err := encodePrivateKey(ecKey)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeCacheFile(keyFile, keyPEM); err != nil {
+				return nil, fmt.Errorf("fail to save the ACME account key, %v", err)
+			}
+		}
+	}
+	return &acme.Client{
+		Key:          key,
+		DirectoryURL: *AcmeDirectoryURL,
+		UserAgent:    "ESPv2",
+	}, nil
+}
+
+// state returns the certificate and the pending HTTP-01 challenges to serve.
+func (a *acmeManager) state() (*configinfo.AcmeCertificate, map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	challenges := make(map[string]string, len(a.challenges))
+	for token, keyAuth := range a.challenges {
+		challenges[token] = keyAuth
+	}
+	return a.cert, challenges
+}
+
+// renewalTime returns when the certificate has to be renewed, the zero time
+// if there is none.
+func (a *acmeManager) renewalTime() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cert == nil {
+		return time.Time{}
+	}
+	return a.notAfter.Add(-a.renewBefore)
+}
+
+// run obtains the certificate when it's missing or due for renewal, until the
+// context is done. The failed orders are retried with a backoff.
+func (a *acmeManager) run(ctx context.Context) {
+	retryInterval := acmeMinRetryInterval
+	for {
+		wait := time.Until(a.renewalTime())
+		if wait <= 0 {
+			if err := a.obtainCertificate(ctx); err != nil {
+				a.logger.Event(severityError, "acme_order_failed", "fail to obtain the certificate from the ACME CA", map[string]interface{}{
+					"domains":     strings.Join(a.domains, ","),
+					"retry_after": retryInterval.String(),
+					"error":       err,
+				})
+				wait = retryInterval
+				if retryInterval *= 2; retryInterval > acmeMaxRetryInterval {
+					retryInterval = acmeMaxRetryInterval
+				}
+			} else {
+				retryInterval = acmeMinRetryInterval
+				continue
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// obtainCertificate orders a certificate of the domains, fulfills the
+// challenges of its authorizations, and applies the issued certificate.
+func (a *acmeManager) obtainCertificate(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, acmeOrderTimeout)
+	defer cancel()
+
+	if !a.registered {
+		account := &acme.Account{}
+		if a.email != "" {
+			account.Contact = []string{"mailto:" + a.email}
+		}
+		if _, err := a.client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+			return fmt.Errorf("fail to register the ACME account, %v", err)
+		}
+		a.registered = true
+	}
+
+	order, err := a.client.AuthorizeOrder(ctx, acme.DomainIDs(a.domains...))
+	if err != nil {
+		return fmt.Errorf("fail to create the order, %v", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := a.authorize(ctx, authzURL); err != nil {
+			return err
+		}
+	}
+	if order, err = a.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("fail to wait for the order, %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: a.domains[0]},
+		DNSNames: a.domains,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("fail to create the certificate request, %v", err)
+	}
+	der, _, err := a.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("fail to finalize the order, %v", err)
+	}
+	if len(der) == 0 {
+		return fmt.Errorf("the CA returned no certificate")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return fmt.Errorf("invalid certificate issued by the CA, %v", err)
+	}
+
+	var chainPEM []byte
+	for _, cert := range der {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if a.cacheDir != "" {
+		if err := writeCacheFile(filepath.Join(a.cacheDir, acmeCertKeyFile), keyPEM); err != nil {
+			a.logger.Errorf("fail to cache the ACME certificate, %v", err)
+		} else if err := writeCacheFile(filepath.Join(a.cacheDir, acmeCertificateFile), chainPEM); err != nil {
+			a.logger.Errorf("fail to cache the ACME certificate, %v", err)
+		}
+	}
+
+	a.mu.Lock()
+	a.cert = &configinfo.AcmeCertificate{
+		CertificateChain: chainPEM,
+		PrivateKey:       keyPEM,
+	}
+	a.notAfter = leaf.NotAfter
+	a.mu.Unlock()
+	a.onChange()
+
+	a.logger.Event(severityInfo, "acme_certificate_issued", "obtained the certificate from the ACME CA", map[string]interface{}{
+		"domains":   strings.Join(a.domains, ","),
+		"not_after": leaf.NotAfter.Format(time.RFC3339),
+	})
+	return nil
+}
+
+// authorize fulfills the challenge of --acme_challenge of a pending
+// authorization, and waits for the CA to validate it.
+func (a *acmeManager) authorize(ctx context.Context, authzURL string) error {
+	authz, err := a.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("fail to get the authorization, %v", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	domain := authz.Identifier.Value
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == a.challenge {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("the CA offers no %s challenge for %s", a.challenge, domain)
+	}
+
+	switch a.challenge {
+	case acmeHttp01:
+		keyAuth, err := a.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return err
+		}
+		a.setHttpChallenge(challenge.Token, keyAuth)
+		defer a.setHttpChallenge(challenge.Token, "")
+		if err := a.waitForHttpChallenge(ctx, domain, challenge.Token, keyAuth); err != nil {
+			return err
+		}
+	case acmeDns01:
+		record, err := a.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		name := "_acme-challenge." + strings.TrimPrefix(domain, "*.")
+		if err := a.dns.present(ctx, name, record); err != nil {
+			return fmt.Errorf("fail to publish the TXT record of %s, %v", name, err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), acmeChallengeCheckTimeout)
+			defer cancel()
+			if err := a.dns.cleanUp(ctx, name, record); err != nil {
+				a.logger.Errorf("fail to remove the TXT record of %s, %v", name, err)
+			}
+		}()
+	}
+
+	if _, err := a.client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("fail to accept the %s challenge of %s, %v", a.challenge, domain, err)
+	}
+	if _, err := a.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("fail to authorize %s, %v", domain, err)
+	}
+	return nil
+}
+
+// setHttpChallenge adds the key authorization of a pending HTTP-01
+// challenge, or removes it if empty, and applies it to Envoy.
+func (a *acmeManager) setHttpChallenge(token, keyAuth string) {
+	a.mu.Lock()
+	if keyAuth == "" {
+		delete(a.challenges, token)
+	} else {
+		a.challenges[token] = keyAuth
+	}
+	a.mu.Unlock()
+	a.onChange()
+}
+
+// waitForHttpChallenge checks the HTTP-01 challenge is served by Envoy before
+// the CA is asked to validate it, which it only tries once.
+func (a *acmeManager) waitForHttpChallenge(ctx context.Context, domain, token, keyAuth string) error {
+	deadline := time.Now().Add(acmeChallengeCheckTimeout)
+	var lastErr error
+	for {
+		req, err := http.NewRequest(http.MethodGet, a.challengeURL+util.AcmeHttpChallengePathPrefix+token, nil)
+		if err != nil {
+			return err
+		}
+		req.Host = domain
+		resp, err := adminClient.Do(req.WithContext(ctx))
+		if err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK && strings.TrimSpace(string(body)) == keyAuth {
+				return nil
+			}
+			err = fmt.Errorf("got status %d", resp.StatusCode)
+		}
+		lastErr = err
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("the %s challenge of %s isn't served on --acme_http_port, %v", acmeHttp01, domain, lastErr)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(acmeChallengeCheckInterval):
+		}
+	}
+}
+
+// loadCachedCertificate loads the certificate of --acme_cache_dir, unless it
+// doesn't cover all the domains.
+func (a *acmeManager) loadCachedCertificate() error {
+	if a.cacheDir == "" {
+		return nil
+	}
+	chainPEM, err := ioutil.ReadFile(filepath.Join(a.cacheDir, acmeCertificateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(a.cacheDir, acmeCertKeyFile))
+	if err != nil {
+		return err
+	}
+	if _, err := parsePrivateKey(keyPEM); err != nil {
+		return err
+	}
+	block, _ := pem.Decode(chainPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("no certificate in %s", acmeCertificateFile)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	for _, domain := range a.domains {
+		if !certificateCovers(leaf, domain) {
+			a.logger.Infof("the cached ACME certificate doesn't cover %s, ordering a new one", domain)
+			return nil
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cert = &configinfo.AcmeCertificate{
+		CertificateChain: chainPEM,
+		PrivateKey:       keyPEM,
+	}
+	a.notAfter = leaf.NotAfter
+	return nil
+}
+
+// certificateCovers returns whether the domain is one of the DNS names of the
+// certificate, compared as names, so a wildcard only covers itself.
+func certificateCovers(cert *x509.Certificate, domain string) bool {
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func encodePrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// writeCacheFile writes the file of --acme_cache_dir atomically, readable by
+// its owner only.
+func writeCacheFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// initAcme makes the ACME manager of --acme_domains, with the client of
+// --acme_directory_url and the Cloud DNS provider of the DNS-01 challenges.
+func (m *ConfigManager) initAcme(accessToken func() (string, time.Duration, error)) error {
+	if m.envoyConfigOptions.SslServerCertPath != "" {
+		return fmt.Errorf("--acme_domains cannot be used together with --ssl_server_cert_path")
+	}
+	a, err := newAcmeManager(m.envoyConfigOptions, m.logger)
+	if err != nil {
+		return err
+	}
+	if a.client, err = newAcmeClient(a.cacheDir); err != nil {
+		return err
+	}
+	if a.challenge == acmeDns01 {
+		if a.dns, err = newCloudDNSProvider(*AcmeDnsProject, *AcmeDnsManagedZone, "", accessToken); err != nil {
+			return fmt.Errorf("fail to init the Cloud DNS client, %v", err)
+		}
+	}
+	a.onChange = m.applyAcmeState
+	m.acme = a
+	return nil
+}
+
+// RunAcme obtains and renews the certificate of --acme_domains until the
+// context is done.
+func (m *ConfigManager) RunAcme(ctx context.Context) {
+	if m.acme == nil {
+		return
+	}
+	m.acme.run(ctx)
+}
+
+// applyAcmeState applies the current service config again, with the
+// certificate and the pending HTTP-01 challenges of the ACME manager.
+func (m *ConfigManager) applyAcmeState() {
+	m.configMu.Lock()
+	serviceConfig := m.curServiceConfig
+	m.configMu.Unlock()
+	if serviceConfig == nil {
+		return
+	}
+	if err := m.applyServiceConfig(serviceConfig); err != nil {
+		m.logger.Event(severityError, "acme_apply_failed", "fail to apply the service config with the ACME certificate and challenges", map[string]interface{}{
+			"service": m.serviceName,
+			"error":   err,
+		})
+	}
+}
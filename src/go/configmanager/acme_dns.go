@@ -0,0 +1,150 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	dnspb "google.golang.org/api/dns/v1"
+)
+
+var (
+	// The TTL of the TXT records of the DNS-01 challenges.
+	acmeDnsRecordTTL int64 = 60
+	// How often a change of Cloud DNS is checked until it's done.
+	acmeDnsChangeCheckInterval = 2 * time.Second
+)
+
+// cloudDNSProvider publishes the TXT records of the DNS-01 challenges in the
+// managed zone of Cloud DNS of --acme_dns_project and --acme_dns_managed_zone.
+type cloudDNSProvider struct {
+	service     *dnspb.Service
+	project     string
+	managedZone string
+}
+
+func newCloudDNSProvider(project, managedZone, basePath string, accessToken func() (string, time.Duration, error)) (*cloudDNSProvider, error) {
+	service, err := dnspb.New(&http.Client{
+		Transport: &bearerTokenTransport{accessToken: accessToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if basePath != "" {
+		service.BasePath = basePath
+	}
+	return &cloudDNSProvider{
+		service:     service,
+		project:     project,
+		managedZone: managedZone,
+	}, nil
+}
+
+func (p *cloudDNSProvider) present(ctx context.Context, name, value string) error {
+	return p.updateTXT(ctx, name, func(values []string) []string {
+		for _, v := range values {
+			if v == strconv.Quote(value) {
+				return values
+			}
+		}
+		return append(values, strconv.Quote(value))
+	})
+}
+
+func (p *cloudDNSProvider) cleanUp(ctx context.Context, name, value string) error {
+	return p.updateTXT(ctx, name, func(values []string) []string {
+		var kept []string
+		for _, v := range values {
+			if v != strconv.Quote(value) {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	})
+}
+
+// updateTXT replaces the TXT record set of the name with the updated values,
+// and waits for the change to be done. The record set is deleted if there
+// are no values left.
+func (p *cloudDNSProvider) updateTXT(ctx context.Context, name string, update func(values []string) []string) error {
+	fqdn := name + "."
+	list, err := p.service.ResourceRecordSets.List(p.project, p.managedZone).Name(fqdn).Type("TXT").Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	change := &dnspb.Change{}
+	var values []string
+	for _, rrset := range list.Rrsets {
+		change.Deletions = append(change.Deletions, rrset)
+		values = append(values, rrset.Rrdatas...)
+	}
+	if updated := update(values); len(updated) > 0 {
+		change.Additions = []*dnspb.ResourceRecordSet{
+			{
+				Name:    fqdn,
+				Type:    "TXT",
+				Ttl:     acmeDnsRecordTTL,
+				Rrdatas: updated,
+			},
+		}
+	}
+	if len(change.Additions) == 0 && len(change.Deletions) == 0 {
+		return nil
+	}
+
+	change, err = p.service.Changes.Create(p.project, p.managedZone, change).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	for change.Status != "done" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(acmeDnsChangeCheckInterval):
+		}
+		got, err := p.service.Changes.Get(p.project, p.managedZone, change.Id).Context(ctx).Do()
+		if err != nil {
+			if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code >= http.StatusInternalServerError {
+				continue
+			}
+			return err
+		}
+		change = got
+	}
+	return nil
+}
+
+// bearerTokenTransport authorizes the requests with the access tokens of the
+// config manager.
+type bearerTokenTransport struct {
+	accessToken func() (string, time.Duration, error)
+}
+
+func (t *bearerTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, _, err := t.accessToken()
+	if err != nil {
+		return nil, fmt.Errorf("fail to get the access token, %v", err)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(req)
+}
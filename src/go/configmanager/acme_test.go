@@ -0,0 +1,634 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"golang.org/x/crypto/acme"
+
+	dnspb "google.golang.org/api/dns/v1"
+)
+
+func TestParseAcmeDomains(t *testing.T) {
+	testData := []struct {
+		desc        string
+		domains     string
+		wantDomains []string
+		wantError   string
+	}{
+		{
+			desc:        "Domains are trimmed, lowercased and deduplicated",
+			domains:     " API.example.com,www.example.com,,api.example.com",
+			wantDomains: []string{"api.example.com", "www.example.com"},
+		},
+		{
+			desc:        "Wildcard domain",
+			domains:     "*.example.com,example.com",
+			wantDomains: []string{"*.example.com", "example.com"},
+		},
+		{
+			desc:      "Failed with an IP address",
+			domains:   "10.0.0.1",
+			wantError: `invalid domain "10.0.0.1" in --acme_domains`,
+		},
+		{
+			desc:      "Failed with a nested wildcard",
+			domains:   "*.*.example.com",
+			wantError: `invalid domain "*.*.example.com" in --acme_domains`,
+		},
+		{
+			desc:      "Failed with a single label",
+			domains:   "localhost",
+			wantError: `invalid domain "localhost" in --acme_domains`,
+		},
+		{
+			desc:      "Failed with no domain",
+			domains:   " , ",
+			wantError: "--acme_domains has no domain",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			domains, err := parseAcmeDomains(tc.domains)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(domains, tc.wantDomains) {
+				t.Errorf("got domains: %v, want: %v", domains, tc.wantDomains)
+			}
+		})
+	}
+}
+
+// setAcmeFlags sets the ACME flags of the config manager, and returns a
+// function restoring their defaults.
+func setAcmeFlags(acceptTos bool, challenge, dnsProject, dnsManagedZone, cacheDir string) func() {
+	*AcmeAcceptTos = acceptTos
+	*AcmeChallenge = challenge
+	*AcmeDnsProject = dnsProject
+	*AcmeDnsManagedZone = dnsManagedZone
+	*AcmeCacheDir = cacheDir
+	return func() {
+		*AcmeAcceptTos = false
+		*AcmeChallenge = acmeHttp01
+		*AcmeDnsProject = ""
+		*AcmeDnsManagedZone = ""
+		*AcmeCacheDir = ""
+	}
+}
+
+func TestNewAcmeManager(t *testing.T) {
+	testData := []struct {
+		desc             string
+		domains          string
+		acceptTos        bool
+		httpPort         int
+		challenge        string
+		dnsProject       string
+		dnsManagedZone   string
+		wantChallengeURL string
+		wantError        string
+	}{
+		{
+			desc:             "HTTP-01 challenges checked on the HTTP listener",
+			domains:          "api.example.com",
+			acceptTos:        true,
+			httpPort:         8080,
+			challenge:        acmeHttp01,
+			wantChallengeURL: "http://127.0.0.1:8080",
+		},
+		{
+			desc:           "DNS-01 challenges for a wildcard domain",
+			domains:        "*.example.com",
+			acceptTos:      true,
+			challenge:      acmeDns01,
+			dnsProject:     "project",
+			dnsManagedZone: "zone",
+		},
+		{
+			desc:      "Failed without accepting the terms of service",
+			domains:   "api.example.com",
+			httpPort:  8080,
+			challenge: acmeHttp01,
+			wantError: "--acme_domains requires --acme_accept_tos",
+		},
+		{
+			desc:      "Failed with HTTP-01 challenges without the HTTP listener",
+			domains:   "api.example.com",
+			acceptTos: true,
+			challenge: acmeHttp01,
+			wantError: "--acme_challenge=http-01 requires --acme_http_port",
+		},
+		{
+			desc:      "Failed with HTTP-01 challenges for a wildcard domain",
+			domains:   "*.example.com",
+			acceptTos: true,
+			httpPort:  8080,
+			challenge: acmeHttp01,
+			wantError: "the wildcard domain *.example.com of --acme_domains requires --acme_challenge=dns-01",
+		},
+		{
+			desc:      "Failed with DNS-01 challenges without the managed zone",
+			domains:   "api.example.com",
+			acceptTos: true,
+			challenge: acmeDns01,
+			wantError: "--acme_challenge=dns-01 requires --acme_dns_project and --acme_dns_managed_zone",
+		},
+		{
+			desc:      "Failed with an unknown challenge",
+			domains:   "api.example.com",
+			acceptTos: true,
+			challenge: "tls-alpn-01",
+			wantError: `invalid --acme_challenge "tls-alpn-01"`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			defer setAcmeFlags(tc.acceptTos, tc.challenge, tc.dnsProject, tc.dnsManagedZone, "")()
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.AcmeDomains = tc.domains
+			opts.AcmeHttpPort = tc.httpPort
+			logger, err := newStructuredLogger(opts.LogFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			a, err := newAcmeManager(opts, logger)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("expected err: %v, got: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.challengeURL != tc.wantChallengeURL {
+				t.Errorf("got challenge url: %q, want: %q", a.challengeURL, tc.wantChallengeURL)
+			}
+		})
+	}
+}
+
+// fakeAcmeClient is a CA with one pending authorization per domain, which
+// issues certificates valid for 90 days.
+type fakeAcmeClient struct {
+	t       *testing.T
+	domains []string
+	// Checks a challenge when it's accepted, e.g. that it's served.
+	checkChallenge func(domain string, challenge *acme.Challenge) error
+
+	mu       sync.Mutex
+	accepted []string
+}
+
+func (c *fakeAcmeClient) Register(ctx context.Context, acct *acme.Account, prompt func(tosURL string) bool) (*acme.Account, error) {
+	return acct, nil
+}
+
+func (c *fakeAcmeClient) AuthorizeOrder(ctx context.Context, id []acme.AuthzID, opt ...acme.OrderOption) (*acme.Order, error) {
+	order := &acme.Order{URI: "order", FinalizeURL: "finalize"}
+	for _, authzID := range id {
+		order.AuthzURLs = append(order.AuthzURLs, authzID.Value)
+	}
+	return order, nil
+}
+
+func (c *fakeAcmeClient) GetAuthorization(ctx context.Context, url string) (*acme.Authorization, error) {
+	return &acme.Authorization{
+		URI:        url,
+		Status:     acme.StatusPending,
+		Identifier: acme.AuthzID{Type: "dns", Value: url},
+		Challenges: []*acme.Challenge{
+			{Type: acmeHttp01, Token: "http-token-" + strings.TrimPrefix(url, "*.")},
+			{Type: acmeDns01, Token: "dns-token-" + url},
+		},
+	}, nil
+}
+
+func (c *fakeAcmeClient) Accept(ctx context.Context, challenge *acme.Challenge) (*acme.Challenge, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, domain := range c.domains {
+		if strings.HasSuffix(challenge.Token, "-"+domain) || strings.HasSuffix(challenge.Token, "-"+strings.TrimPrefix(domain, "*.")) {
+			if err := c.checkChallenge(domain, challenge); err != nil {
+				return nil, err
+			}
+			c.accepted = append(c.accepted, challenge.Token)
+			return challenge, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown challenge %s", challenge.Token)
+}
+
+func (c *fakeAcmeClient) WaitAuthorization(ctx context.Context, url string) (*acme.Authorization, error) {
+	return &acme.Authorization{URI: url, Status: acme.StatusValid}, nil
+}
+
+func (c *fakeAcmeClient) WaitOrder(ctx context.Context, url string) (*acme.Order, error) {
+	return &acme.Order{URI: url, Status: acme.StatusReady, FinalizeURL: "finalize"}, nil
+}
+
+func (c *fakeAcmeClient) CreateOrderCert(ctx context.Context, url string, csrDER []byte, bundle bool) ([][]byte, string, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, "", err
+	}
+	if !reflect.DeepEqual(csr.DNSNames, c.domains) {
+		c.t.Errorf("got CSR domains: %v, want: %v", csr.DNSNames, c.domains)
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(2)}, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return [][]byte{der}, "cert", nil
+}
+
+func (c *fakeAcmeClient) HTTP01ChallengeResponse(token string) (string, error) {
+	return token + ".thumbprint", nil
+}
+
+func (c *fakeAcmeClient) DNS01ChallengeRecord(token string) (string, error) {
+	return token + ".digest", nil
+}
+
+// fakeDNSProvider keeps the TXT records in memory.
+type fakeDNSProvider struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (p *fakeDNSProvider) present(ctx context.Context, name, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.records[name] = append(p.records[name], value)
+	return nil
+}
+
+func (p *fakeDNSProvider) cleanUp(ctx context.Context, name, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var kept []string
+	for _, v := range p.records[name] {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		delete(p.records, name)
+	} else {
+		p.records[name] = kept
+	}
+	return nil
+}
+
+func (p *fakeDNSProvider) lookup(name string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.records[name]
+}
+
+func TestAcmeObtainCertificate(t *testing.T) {
+	oldInterval := acmeChallengeCheckInterval
+	acmeChallengeCheckInterval = 10 * time.Millisecond
+	defer func() { acmeChallengeCheckInterval = oldInterval }()
+
+	testData := []struct {
+		desc         string
+		domains      string
+		challenge    string
+		wantAccepted []string
+	}{
+		{
+			desc:         "HTTP-01 challenges served by Envoy",
+			domains:      "api.example.com,www.example.com",
+			challenge:    acmeHttp01,
+			wantAccepted: []string{"http-token-api.example.com", "http-token-www.example.com"},
+		},
+		{
+			desc:         "DNS-01 challenges published in the managed zone",
+			domains:      "*.example.com,example.com",
+			challenge:    acmeDns01,
+			wantAccepted: []string{"dns-token-*.example.com", "dns-token-example.com"},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			cacheDir, err := ioutil.TempDir("", "acme")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(cacheDir)
+			defer setAcmeFlags(true, tc.challenge, "project", "zone", cacheDir)()
+
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.AcmeDomains = tc.domains
+			opts.AcmeHttpPort = 8080
+			logger, err := newStructuredLogger(opts.LogFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := newAcmeManager(opts, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Envoy serving the challenges applied by onChange.
+			var envoyMu sync.Mutex
+			envoyChallenges := map[string]string{}
+			changes := 0
+			a.onChange = func() {
+				envoyMu.Lock()
+				defer envoyMu.Unlock()
+				_, envoyChallenges = a.state()
+				changes++
+			}
+			envoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				envoyMu.Lock()
+				defer envoyMu.Unlock()
+				keyAuth, ok := envoyChallenges[strings.TrimPrefix(r.URL.Path, util.AcmeHttpChallengePathPrefix)]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				fmt.Fprint(w, keyAuth)
+			}))
+			defer envoy.Close()
+			a.challengeURL = envoy.URL
+
+			dns := &fakeDNSProvider{records: map[string][]string{}}
+			a.dns = dns
+			client := &fakeAcmeClient{
+				t:       t,
+				domains: a.domains,
+				checkChallenge: func(domain string, challenge *acme.Challenge) error {
+					if challenge.Type == acmeHttp01 {
+						resp, err := http.Get(envoy.URL + util.AcmeHttpChallengePathPrefix + challenge.Token)
+						if err != nil {
+							return err
+						}
+						defer resp.Body.Close()
+						if resp.StatusCode != http.StatusOK {
+							return fmt.Errorf("challenge %s is not served", challenge.Token)
+						}
+						return nil
+					}
+					name := "_acme-challenge." + strings.TrimPrefix(domain, "*.")
+					if records := dns.lookup(name); len(records) == 0 {
+						return fmt.Errorf("no TXT record of %s", name)
+					}
+					return nil
+				},
+			}
+			a.client = client
+
+			if err := a.obtainCertificate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(client.accepted, tc.wantAccepted) {
+				t.Errorf("got accepted challenges: %v, want: %v", client.accepted, tc.wantAccepted)
+			}
+			cert, challenges := a.state()
+			if cert == nil {
+				t.Fatalf("no certificate after the order")
+			}
+			if len(challenges) != 0 {
+				t.Errorf("challenges are left after the order: %v", challenges)
+			}
+			if len(dns.records) != 0 {
+				t.Errorf("TXT records are left after the order: %v", dns.records)
+			}
+			if changes == 0 {
+				t.Errorf("the certificate wasn't applied")
+			}
+			block, _ := pem.Decode(cert.CertificateChain)
+			if block == nil || block.Type != "CERTIFICATE" {
+				t.Fatalf("invalid certificate chain: %s", cert.CertificateChain)
+			}
+			if _, err := parsePrivateKey(cert.PrivateKey); err != nil {
+				t.Errorf("invalid private key: %v", err)
+			}
+			if wait := time.Until(a.renewalTime()); wait < 59*24*time.Hour || wait > 60*24*time.Hour {
+				t.Errorf("got renewal in %v, want in 60 days", wait)
+			}
+
+			// A restarted manager loads the cached certificate.
+			restarted, err := newAcmeManager(opts, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotCert, _ := restarted.state(); !reflect.DeepEqual(gotCert, cert) {
+				t.Errorf("the cached certificate wasn't loaded")
+			}
+
+			// Unless it doesn't cover the domains anymore.
+			opts.AcmeDomains = tc.domains + ",new.example.com"
+			restarted, err = newAcmeManager(opts, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotCert, _ := restarted.state(); gotCert != nil {
+				t.Errorf("the cached certificate of other domains was loaded")
+			}
+		})
+	}
+}
+
+func TestAcmeHttpChallengeNotServed(t *testing.T) {
+	oldTimeout, oldInterval := acmeChallengeCheckTimeout, acmeChallengeCheckInterval
+	acmeChallengeCheckTimeout, acmeChallengeCheckInterval = 50*time.Millisecond, 10*time.Millisecond
+	defer func() { acmeChallengeCheckTimeout, acmeChallengeCheckInterval = oldTimeout, oldInterval }()
+	defer setAcmeFlags(true, acmeHttp01, "", "", "")()
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.AcmeDomains = "api.example.com"
+	opts.AcmeHttpPort = 8080
+	logger, err := newStructuredLogger(opts.LogFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAcmeManager(opts, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envoy := httptest.NewServer(http.NotFoundHandler())
+	defer envoy.Close()
+	a.challengeURL = envoy.URL
+	a.onChange = func() {}
+	client := &fakeAcmeClient{
+		t:       t,
+		domains: a.domains,
+		checkChallenge: func(string, *acme.Challenge) error {
+			return nil
+		},
+	}
+	a.client = client
+
+	err = a.obtainCertificate(context.Background())
+	wantError := "the http-01 challenge of api.example.com isn't served on --acme_http_port"
+	if err == nil || !strings.Contains(err.Error(), wantError) {
+		t.Fatalf("expected err: %v, got: %v", wantError, err)
+	}
+	if len(client.accepted) != 0 {
+		t.Errorf("the challenge not served was accepted: %v", client.accepted)
+	}
+	if _, challenges := a.state(); len(challenges) != 0 {
+		t.Errorf("challenges are left after the failed order: %v", challenges)
+	}
+}
+
+func TestCloudDNSProvider(t *testing.T) {
+	oldInterval := acmeDnsChangeCheckInterval
+	acmeDnsChangeCheckInterval = 10 * time.Millisecond
+	defer func() { acmeDnsChangeCheckInterval = oldInterval }()
+
+	testData := []struct {
+		desc          string
+		existing      []string
+		cleanUp       bool
+		wantDeletions []string
+		wantAdditions []string
+	}{
+		{
+			desc:          "Value added to a new record",
+			wantAdditions: []string{`"digest"`},
+		},
+		{
+			desc:          "Value added to the existing record",
+			existing:      []string{`"other"`},
+			wantDeletions: []string{`"other"`},
+			wantAdditions: []string{`"other"`, `"digest"`},
+		},
+		{
+			desc:          "Record deleted with its last value",
+			existing:      []string{`"digest"`},
+			cleanUp:       true,
+			wantDeletions: []string{`"digest"`},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			var gotChange *dnspb.Change
+			gets := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer token" {
+					t.Errorf("got authorization: %q", got)
+				}
+				switch {
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/projects/project/managedZones/zone/rrsets"):
+					if name := r.URL.Query().Get("name"); name != "_acme-challenge.example.com." {
+						t.Errorf("got record set name: %q", name)
+					}
+					list := &dnspb.ResourceRecordSetsListResponse{}
+					if tc.existing != nil {
+						list.Rrsets = []*dnspb.ResourceRecordSet{
+							{Name: "_acme-challenge.example.com.", Type: "TXT", Ttl: 300, Rrdatas: tc.existing},
+						}
+					}
+					_ = json.NewEncoder(w).Encode(list)
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/projects/project/managedZones/zone/changes"):
+					gotChange = &dnspb.Change{}
+					_ = json.NewDecoder(r.Body).Decode(gotChange)
+					_ = json.NewEncoder(w).Encode(&dnspb.Change{Id: "1", Status: "pending"})
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/projects/project/managedZones/zone/changes/1"):
+					status := "pending"
+					if gets++; gets > 1 {
+						status = "done"
+					}
+					_ = json.NewEncoder(w).Encode(&dnspb.Change{Id: "1", Status: status})
+				default:
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			p, err := newCloudDNSProvider("project", "zone", server.URL+"/projects/", func() (string, time.Duration, error) {
+				return "token", time.Hour, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.cleanUp {
+				err = p.cleanUp(context.Background(), "_acme-challenge.example.com", "digest")
+			} else {
+				err = p.present(context.Background(), "_acme-challenge.example.com", "digest")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gets != 2 {
+				t.Errorf("the change was checked %d times, want until done", gets)
+			}
+
+			var gotDeletions, gotAdditions []string
+			for _, rrset := range gotChange.Deletions {
+				gotDeletions = append(gotDeletions, rrset.Rrdatas...)
+			}
+			for _, rrset := range gotChange.Additions {
+				if rrset.Name != "_acme-challenge.example.com." || rrset.Type != "TXT" || rrset.Ttl != acmeDnsRecordTTL {
+					t.Errorf("got addition: %+v", rrset)
+				}
+				gotAdditions = append(gotAdditions, rrset.Rrdatas...)
+			}
+			if !reflect.DeepEqual(gotDeletions, tc.wantDeletions) {
+				t.Errorf("got deletions: %v, want: %v", gotDeletions, tc.wantDeletions)
+			}
+			if !reflect.DeepEqual(gotAdditions, tc.wantAdditions) {
+				t.Errorf("got additions: %v, want: %v", gotAdditions, tc.wantAdditions)
+			}
+		})
+	}
+}
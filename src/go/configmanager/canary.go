@@ -0,0 +1,205 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the stats of Envoy are checked during a canary bake.
+var canaryCheckInterval = 10 * time.Second
+
+// trafficStats sums the requests served by the HTTP connection managers of
+// Envoy, excluding the admin one.
+type trafficStats struct {
+	requests uint64
+	errors   uint64
+	// The highest P99 latency over the last stats flush interval, 0 if there
+	// were no requests.
+	p99Latency time.Duration
+}
+
+// The interval value of the P99 quantile of a histogram in the /stats output,
+// e.g. "P99(1.05,2.5)".
+var p99Regexp = regexp.MustCompile(`P99\(([^,]+),`)
+
+func fetchTrafficStats(adminURL string) (*trafficStats, error) {
+	resp, err := adminClient.Get(adminURL + "/stats?filter=" + url.QueryEscape(`downstream_rq_(completed|5xx|time)$`))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/stats returns status %d", resp.StatusCode)
+	}
+
+	stats := &trafficStats{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, value := splitStat(scanner.Text())
+		if !strings.HasPrefix(name, "http.") || strings.HasPrefix(name, "http.admin.") {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, ".downstream_rq_completed"), strings.HasSuffix(name, ".downstream_rq_5xx"):
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of stat %s: %v", name, err)
+			}
+			if strings.HasSuffix(name, ".downstream_rq_5xx") {
+				stats.errors += n
+			} else {
+				stats.requests += n
+			}
+		case strings.HasSuffix(name, ".downstream_rq_time"):
+			match := p99Regexp.FindStringSubmatch(value)
+			if match == nil {
+				continue
+			}
+			ms, err := strconv.ParseFloat(match[1], 64)
+			if err != nil || math.IsNaN(ms) {
+				continue
+			}
+			if latency := time.Duration(ms * float64(time.Millisecond)); latency > stats.p99Latency {
+				stats.p99Latency = latency
+			}
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// canaryBreach reports how the requests served since the baseline breach the
+// canary thresholds, or "" if they don't.
+func canaryBreach(baseline, current *trafficStats) string {
+	if *CanaryMaxLatency > 0 && current.p99Latency > *CanaryMaxLatency {
+		return fmt.Sprintf("the P99 latency %v is above %v", current.p99Latency, *CanaryMaxLatency)
+	}
+
+	// The counters are reset if Envoy restarted.
+	requests, errors := current.requests, current.errors
+	if requests >= baseline.requests && errors >= baseline.errors {
+		requests -= baseline.requests
+		errors -= baseline.errors
+	}
+	if requests == 0 || requests < uint64(*CanaryMinRequests) {
+		return ""
+	}
+	if rate := float64(errors) / float64(requests); rate > *CanaryMaxErrorRate {
+		return fmt.Sprintf("the error rate %.3f of %d requests is above %.3f", rate, requests, *CanaryMaxErrorRate)
+	}
+	return ""
+}
+
+// startCanary bakes a new service config accepted by Envoy with
+// --canary_bake_period, unless there is no previous config to roll back to.
+// It is called with configMu held.
+func (m *ConfigManager) startCanary(config, previous *appliedConfig) {
+	if *CanaryBakePeriod <= 0 || previous == nil || previous.serviceConfig.GetId() == config.serviceConfig.GetId() {
+		return
+	}
+	go m.bakeCanary(config, previous)
+}
+
+// bakeCanary checks the stats of Envoy until the bake period elapsed, and
+// rolls back to the previous config if they breach the thresholds. It stops
+// if another config is applied in the meantime.
+func (m *ConfigManager) bakeCanary(config, previous *appliedConfig) {
+	adminURL := m.envoyAdminURL()
+	baseline, err := fetchTrafficStats(adminURL)
+	if err != nil {
+		m.logger.Event(severityError, "canary_skipped", "fail to fetch the stats of envoy to bake the service config", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": config.serviceConfig.GetId(),
+			"error":     err,
+		})
+		return
+	}
+	m.logger.Event(severityInfo, "canary_started", "baking the service config", map[string]interface{}{
+		"service":     m.serviceName,
+		"config_id":   config.serviceConfig.GetId(),
+		"bake_period": CanaryBakePeriod.String(),
+	})
+
+	deadline := time.Now().Add(*CanaryBakePeriod)
+	ticker := time.NewTicker(canaryCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !m.isApplied(config) {
+			return
+		}
+		current, err := fetchTrafficStats(adminURL)
+		if err != nil {
+			m.logger.Errorf("fail to fetch the stats of envoy to bake service config %s, %v", config.serviceConfig.GetId(), err)
+		} else if reason := canaryBreach(baseline, current); reason != "" {
+			m.rollbackCanary(config, previous, reason)
+			return
+		}
+		if time.Now().After(deadline) {
+			m.logger.Event(severityInfo, "canary_passed", "the service config passed its bake", map[string]interface{}{
+				"service":   m.serviceName,
+				"config_id": config.serviceConfig.GetId(),
+			})
+			return
+		}
+	}
+}
+
+func (m *ConfigManager) isApplied(config *appliedConfig) bool {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	return m.appliedSnapshot == config.snapshot
+}
+
+// rollbackCanary restores the previous config, unless another config was
+// applied in the meantime. The baked config isn't applied again until the
+// rollout is resumed.
+func (m *ConfigManager) rollbackCanary(config, previous *appliedConfig, reason string) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+
+	if m.appliedSnapshot != config.snapshot {
+		return
+	}
+	m.rejectedConfigId = config.serviceConfig.GetId()
+	m.rejectedReason = "the service config was rolled back after its canary bake"
+	m.logger.Event(severityError, "canary_failed", "the service config failed its bake", map[string]interface{}{
+		"service":   m.serviceName,
+		"config_id": m.rejectedConfigId,
+		"reason":    reason,
+	})
+
+	if err := m.restoreConfig(previous); err != nil {
+		m.logger.Event(severityError, "config_rollback_failed", "fail to roll back to the service config before the canary", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": previous.serviceConfig.GetId(),
+			"error":     err,
+		})
+		return
+	}
+	m.ackedConfig = previous
+	m.logger.Event(severityWarning, "config_rolled_back", "rolled back to the service config before the canary", map[string]interface{}{
+		"service":            m.serviceName,
+		"config_id":          m.curConfigId(),
+		"rejected_config_id": m.rejectedConfigId,
+	})
+}
@@ -0,0 +1,253 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func makeStatsOutput(requests, errors int, p99 string) string {
+	return fmt.Sprintf(`http.admin.downstream_rq_completed: 1000
+http.admin.downstream_rq_5xx: 1000
+http.ingress_http.downstream_rq_completed: %d
+http.ingress_http.downstream_rq_5xx: %d
+http.ingress_http.downstream_rq_time: P0(nan,1) P25(nan,1) P50(nan,1) P75(nan,1) P90(nan,1) P95(nan,1) P99(%s,2) P99.5(nan,2) P99.9(nan,2) P100(nan,2)
+`, requests, errors, p99)
+}
+
+func TestFetchTrafficStats(t *testing.T) {
+	testData := []struct {
+		desc      string
+		stats     string
+		wantStats trafficStats
+		wantErr   string
+	}{
+		{
+			desc:      "no requests in the last flush interval",
+			stats:     makeStatsOutput(200, 3, "nan"),
+			wantStats: trafficStats{requests: 200, errors: 3},
+		},
+		{
+			desc:      "p99 latency of the last flush interval",
+			stats:     makeStatsOutput(200, 3, "12.5"),
+			wantStats: trafficStats{requests: 200, errors: 3, p99Latency: 12500 * time.Microsecond},
+		},
+		{
+			desc:    "invalid counter",
+			stats:   "http.ingress_http.downstream_rq_5xx: x\n",
+			wantErr: "invalid value of stat http.ingress_http.downstream_rq_5xx",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tc.stats)
+			}))
+			defer admin.Close()
+
+			stats, err := fetchTrafficStats(admin.URL)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("want error containing %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *stats != tc.wantStats {
+				t.Errorf("want stats %+v, got %+v", tc.wantStats, *stats)
+			}
+		})
+	}
+}
+
+func TestCanaryBreach(t *testing.T) {
+	defer func() { *CanaryMaxLatency = 0 }()
+	*CanaryMaxLatency = 100 * time.Millisecond
+
+	testData := []struct {
+		desc       string
+		baseline   trafficStats
+		current    trafficStats
+		wantReason string
+	}{
+		{
+			desc:     "healthy",
+			baseline: trafficStats{requests: 1000, errors: 100},
+			current:  trafficStats{requests: 1200, errors: 105, p99Latency: 50 * time.Millisecond},
+		},
+		{
+			desc:     "too few requests to judge the error rate",
+			baseline: trafficStats{requests: 1000},
+			current:  trafficStats{requests: 1050, errors: 50},
+		},
+		{
+			desc:       "error rate above the threshold",
+			baseline:   trafficStats{requests: 1000, errors: 100},
+			current:    trafficStats{requests: 1200, errors: 120},
+			wantReason: "the error rate 0.100 of 200 requests is above 0.050",
+		},
+		{
+			desc:       "counters reset by an envoy restart",
+			baseline:   trafficStats{requests: 1000, errors: 10},
+			current:    trafficStats{requests: 100, errors: 50},
+			wantReason: "the error rate 0.500 of 100 requests is above 0.050",
+		},
+		{
+			desc:       "latency above the threshold",
+			baseline:   trafficStats{requests: 1000},
+			current:    trafficStats{requests: 1001, p99Latency: 150 * time.Millisecond},
+			wantReason: "the P99 latency 150ms is above 100ms",
+		},
+	}
+
+	for _, tc := range testData {
+		if got := canaryBreach(&tc.baseline, &tc.current); got != tc.wantReason {
+			t.Errorf("Test (%s): want reason %q, got %q", tc.desc, tc.wantReason, got)
+		}
+	}
+}
+
+func TestCanaryRollback(t *testing.T) {
+	canaryCheckInterval = time.Millisecond
+	defer func() {
+		canaryCheckInterval = 10 * time.Second
+		*CanaryBakePeriod = 0
+	}()
+	*CanaryBakePeriod = 100 * time.Millisecond
+
+	testEndpointName := "endpoints.examples.bookstore.Bookstore"
+	makeServiceConfig := func(id, path string) *confpb.Service {
+		return &confpb.Service{
+			Name: "bookstore.endpoints.project123.cloud.goog",
+			Id:   id,
+			Apis: []*apipb.Api{
+				{
+					Name:    testEndpointName,
+					Methods: []*apipb.Method{{Name: "Echo"}},
+				},
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: testEndpointName + ".Echo",
+						Pattern:  &annotationspb.HttpRule_Get{Get: path},
+					},
+				},
+			},
+		}
+	}
+
+	testData := []struct {
+		desc              string
+		statsAfter        string
+		wantConfigId      string
+		wantSkipNewConfig bool
+	}{
+		{
+			desc:         "healthy canary is kept",
+			statsAfter:   makeStatsOutput(1200, 101, "nan"),
+			wantConfigId: "2018-12-05r1",
+		},
+		{
+			desc:              "canary with an error rate regression is rolled back",
+			statsAfter:        makeStatsOutput(1200, 150, "nan"),
+			wantConfigId:      "2018-12-05r0",
+			wantSkipNewConfig: true,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			var mu sync.Mutex
+			statsCalls := 0
+			admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				// The first call is the baseline of the canary.
+				if statsCalls++; statsCalls == 1 {
+					fmt.Fprint(w, makeStatsOutput(1000, 100, "nan"))
+					return
+				}
+				fmt.Fprint(w, tc.statsAfter)
+			}))
+			defer admin.Close()
+
+			host, port, _ := net.SplitHostPort(strings.TrimPrefix(admin.URL, "http://"))
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "http://127.0.0.1:8082"
+			opts.DisableTracing = true
+			opts.AdminAddress = host
+			opts.AdminPort, _ = strconv.Atoi(port)
+			logger, err := newStructuredLogger(opts.LogFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &ConfigManager{
+				envoyConfigOptions: opts,
+				logger:             logger,
+			}
+			m.cache = cache.NewSnapshotCache(true, m, m)
+			callbacks := xdsCallbacks{m: m}
+			applyAndAck := func(serviceConfig *confpb.Service) {
+				if err := m.applyServiceConfig(serviceConfig); err != nil {
+					t.Fatal(err)
+				}
+				for _, typeUrl := range []string{resource.ClusterType, resource.ListenerType} {
+					if err := callbacks.OnStreamRequest(1, &discoverypb.DiscoveryRequest{
+						TypeUrl:       typeUrl,
+						VersionInfo:   m.appliedSnapshot.GetVersion(typeUrl),
+						ResponseNonce: "1",
+					}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			applyAndAck(makeServiceConfig("2018-12-05r0", "/v1/echo"))
+			applyAndAck(makeServiceConfig("2018-12-05r1", "/v2/echo"))
+			time.Sleep(3 * *CanaryBakePeriod)
+
+			m.configMu.Lock()
+			gotConfigId := m.curConfigId()
+			m.configMu.Unlock()
+			if gotConfigId != tc.wantConfigId {
+				t.Errorf("want config id %s, got %s", tc.wantConfigId, gotConfigId)
+			}
+			if gotSkip := m.skipConfig("2018-12-05r1") != ""; gotSkip != tc.wantSkipNewConfig {
+				t.Errorf("want the canary config skipped: %v, got: %v", tc.wantSkipNewConfig, gotSkip)
+			}
+		})
+	}
+}
@@ -22,6 +22,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
@@ -31,11 +36,13 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
-	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/acme"
 
 	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 )
 
@@ -50,7 +57,64 @@ var (
 					When this flag is used, fixed rollout_strategy will be used,
 					GCP metadata server will not be called to fetch access token, and
 					following flags will be ignored; --service_config_id, --service,
-					--rollout_strategy`)
+					--rollout_strategy. The file is in JSON, or in the proto text format if its
+					extension is .textproto, .prototxt or .pbtxt. An OpenAPI 3 document in JSON is
+					converted to the service config`)
+	ServiceJsonWatchInterval = flag.Duration("service_json_watch_interval", 0, `if not 0, check the file of --service_json_path for changes at this interval,
+					and apply the modified service config`)
+	ServiceConfigURL = flag.String("service_config_url", "", `the gs://BUCKET/OBJECT uri or the signed https url of the endpoint service config.
+					Like --service_json_path, the fixed rollout_strategy will be used and following
+					flags will be ignored; --service_config_id, --service, --rollout_strategy`)
+	HaltRolloutOnNack = flag.Bool("halt_rollout_on_nack", false, `when Envoy rejects a service config, which is rolled back to the last accepted one,
+					stop applying new rollouts until resumed with a POST to /debug/resume_rollout`)
+	AdditionalServices = flag.String("additional_services", "", `comma separated NAME:CONFIG_ID list of the other services served by the proxy,
+					each on the virtual host of its name and endpoint names. Their configs are fetched from
+					Service Management at startup. The services share the flags and the filters of the listener,
+					the transcoder matches the HTTP rules of all their gRPC apis, and --rate_limit_service_address
+					is not supported with them`)
+	AdditionalServiceJsonPaths = flag.String("additional_service_json_paths", "", `comma separated file paths to the service configs of the other services served
+					by the proxy, each on the virtual host of its name and endpoint names. The same limitations
+					as --additional_services apply`)
+	ServiceConfigURLPollInterval = flag.Duration("service_config_url_poll_interval", 0, `if not 0, fetch the service config of --service_config_url again at this interval,
+					and apply it if its ETag changed`)
+	RolloutTrafficSplit = flag.Bool("rollout_traffic_split", false, `with the managed rollout strategy, pick the config of the instance by the traffic
+					percentages of the latest rollout instead of the one with the highest traffic, so the
+					instances of the service split the traffic between the configs of a rollout in progress`)
+	RolloutInstanceKey = flag.String("rollout_instance_key", "", `the key of the instance hashed to pick its config with --rollout_traffic_split,
+					defaults to the hostname`)
+	RolloutDualServing = flag.Bool("rollout_dual_serving", false, `with the managed rollout strategy, apply the config with the highest traffic of the
+					latest rollout, but check and report each request to Service Control with the config id
+					it's assigned to by the traffic percentages of the rollout`)
+	FallbackToManagedRollout = flag.Bool("fallback_to_managed_rollout", false, `with the fixed rollout strategy, fall back to the config of the latest rollout if
+					the one of --service_config_id fails to be fetched and applied at startup`)
+	GrpcReflection = flag.Bool("grpc_reflection", false, `synthesize the service config of the gRPC backend of --backend_address from its server
+					reflection service at startup, for development and internal services without a published
+					service config. --service names the service, defaults to the backend host`)
+	GrpcReflectionTimeout = flag.Duration("grpc_reflection_timeout", 30*time.Second, `with --grpc_reflection, how long to retry the reflection service of the backend at startup`)
+	DrainTimeout          = flag.Duration("drain_timeout", 0, `if not 0, on SIGTERM drain the listeners of Envoy through its admin interface and
+					wait up to this timeout for the in-flight requests and streams to complete, then flush the Service Control
+					reports and wait up to 5s for them to be sent before exiting`)
+	CanaryBakePeriod = flag.Duration("canary_bake_period", 0, `if not 0, watch the requests served by Envoy through its admin interface for this period
+					after it accepts a new service config, and roll back to the previous one if they breach
+					--canary_max_error_rate or --canary_max_latency. The rolled back config isn't applied again`)
+	CanaryMaxErrorRate = flag.Float64("canary_max_error_rate", 0.05, `with --canary_bake_period, the highest fraction of 5xx responses of the requests
+					served during the bake`)
+	CanaryMinRequests = flag.Int("canary_min_requests", 100, `with --canary_bake_period, the requests served during the bake before their error rate
+					is checked`)
+	CanaryMaxLatency = flag.Duration("canary_max_latency", 0, `with --canary_bake_period, if not 0, the highest P99 latency of the requests over a
+					stats flush interval of Envoy during the bake`)
+	AcmeDirectoryURL = flag.String("acme_directory_url", acme.LetsEncryptURL, `with --acme_domains, the directory URL of the ACME CA issuing the certificate`)
+	AcmeAcceptTos    = flag.Bool("acme_accept_tos", false, `with --acme_domains, agree to the terms of service of the ACME CA`)
+	AcmeEmail        = flag.String("acme_email", "", `with --acme_domains, the contact email of the ACME account, notified by the CA about
+					the certificates expiring without renewal`)
+	AcmeChallenge = flag.String("acme_challenge", "http-01", `with --acme_domains, how the domains are validated by the ACME CA, either "http-01"
+					on the listener of --acme_http_port, or "dns-01" with the TXT records published in Cloud DNS,
+					required for the wildcard domains`)
+	AcmeDnsProject     = flag.String("acme_dns_project", "", `with --acme_challenge=dns-01, the project of the Cloud DNS managed zone of the domains`)
+	AcmeDnsManagedZone = flag.String("acme_dns_managed_zone", "", `with --acme_challenge=dns-01, the Cloud DNS managed zone of the domains`)
+	AcmeCacheDir       = flag.String("acme_cache_dir", "", `with --acme_domains, if set, the directory keeping the ACME account key and the
+					certificate across restarts, which otherwise order a new one`)
+	AcmeRenewBefore = flag.Duration("acme_renew_before", 30*24*time.Hour, `with --acme_domains, how long before its expiration the certificate is renewed`)
 )
 
 // Config Manager handles service configuration fetching and updating.
@@ -61,46 +125,228 @@ type ConfigManager struct {
 	serviceInfo        *configinfo.ServiceInfo
 	cache              cache.SnapshotCache
 
-	metadataFetcher         *metadata.MetadataFetcher
+	metadataProvider        metadata.Provider
 	serviceConfigFetcher    *sc.ServiceConfigFetcher
 	rolloutIdChangeDetector *sc.RolloutIdChangeDetector
 
 	curServiceConfig *confpb.Service
+	// The configs of the other services served by the proxy, set if
+	// --additional_services or --additional_service_json_paths is specified.
+	additionalServiceConfigs []*confpb.Service
+	// The snapshot last set in the cache.
+	appliedSnapshot *cache.Snapshot
+	// Distinguishes the versions of the changed resources of a service config
+	// applied again with the same config id.
+	configRevision int
+	// Guards the applied config against the rollbacks on Envoy NACKs.
+	configMu sync.Mutex
+	// The versions accepted by Envoy by type url, the last applied config they
+	// all match, and the config id rejected by Envoy or rolled back after its
+	// canary bake, and why.
+	ackedVersions    map[string]string
+	ackedConfig      *appliedConfig
+	rejectedConfigId string
+	rejectedReason   string
+	rolloutHalted    bool
+	// Set once the operations in maintenance are changed on the debug
+	// endpoint, so the ones missing from a new service config are dropped.
+	runtimeMaintenance bool
+	// The traffic percentages of the latest rollout by config id, fetched
+	// with --rollout_dual_serving.
+	rolloutPercentages map[string]float64
+	// When the applied snapshot was set in the cache.
+	appliedTime time.Time
+	// Closed and replaced when a snapshot is set in the cache, to notify the
+	// incremental ADS streams.
+	snapshotMu     sync.Mutex
+	snapshotUpdate chan struct{}
+
+	logger *structuredLogger
+	// The metrics of the config translation, served on the readiness
+	// endpoint.
+	metrics configMetrics
+
+	// The applied serviceInfo and its JSON view, as []byte, read by the debug
+	// endpoints.
+	appliedServiceInfo atomic.Value
+	serviceInfoDump    atomic.Value
+
+	// Loads the proto descriptor for transcoding, set if
+	// --transcoding_proto_descriptor is specified.
+	protoDescriptorLoader func() ([]byte, error)
+
+	// Checks the source of the service config for a new one right away, set
+	// with the managed rollout strategy, --service_json_path or
+	// --service_config_url.
+	pollServiceConfig func() error
+
+	// Retries the deferred OpenID Connect Discovery of the applied service
+	// config, with --defer_openid_discovery, and its current backoff.
+	deferredDiscovery        *time.Timer
+	deferredDiscoveryBackoff time.Duration
+
+	// Obtains and renews the certificate of the listener, set if
+	// --acme_domains is specified.
+	acme *acmeManager
 }
 
 // NewConfigManager creates new instance of Config Manager.
 // mf is set to nil on non-gcp deployments
 func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGeneratorOptions) (*ConfigManager, error) {
+	logger, err := newStructuredLogger(opts.LogFormat)
+	if err != nil {
+		return nil, err
+	}
 	m := &ConfigManager{
-		metadataFetcher:    mf,
 		envoyConfigOptions: opts,
+		logger:             logger,
 	}
 	m.cache = cache.NewSnapshotCache(true, m, m)
 
+	// Instance attributes and access tokens come from the GCP metadata server
+	// unless a non-GCP metadata provider is selected.
+	if mf != nil {
+		m.metadataProvider = mf
+	} else if !util.IsGCPMetadataProvider(opts.MetadataProvider) {
+		p, err := metadata.NewProvider(opts.CommonOptions)
+		if err != nil {
+			return nil, fmt.Errorf("fail to initialize metadata provider: %v", err)
+		}
+		m.metadataProvider = p
+	}
+
+	accessToken := func() (string, time.Duration, error) {
+		if opts.ServiceAccountKey != "" {
+			return tokengenerator.GenerateAccessTokenFromFile(opts.ServiceAccountKey)
+		}
+		if m.metadataProvider == nil {
+			return "", 0, fmt.Errorf("no access token source, --service_account_key has to be specified")
+		}
+		return m.metadataProvider.FetchAccessToken()
+	}
+	// The impersonated service account fetches the service config too.
+	if opts.ImpersonateServiceAccount != "" {
+		if accessToken, _, err = tokengenerator.MakeTokenFuncs(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// The https client is only made for the fetches, so the deployments with
+	// local files don't need --ssl_sidestream_client_root_certs_path.
+	var client *http.Client
+	getClient := func() (*http.Client, error) {
+		if client == nil {
+			c, err := httpsClient(opts)
+			if err != nil {
+				return nil, fmt.Errorf("fail to init httpsClient: %v", err)
+			}
+			client = c
+		}
+		return client, nil
+	}
+
+	if opts.AcmeDomains != "" {
+		if err := m.initAcme(accessToken); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.TranscodingProtoDescriptor != "" {
+		var descriptorClient *http.Client
+		if strings.HasPrefix(opts.TranscodingProtoDescriptor, util.GcsURIPrefix) {
+			if descriptorClient, err = getClient(); err != nil {
+				return nil, err
+			}
+		}
+		m.protoDescriptorLoader = func() ([]byte, error) {
+			return loadProtoDescriptor(descriptorClient, opts.TranscodingProtoDescriptor, accessToken)
+		}
+	}
+
+	if err := m.loadAdditionalServiceConfigs(getClient, accessToken); err != nil {
+		return nil, err
+	}
+
+	if *GrpcReflection && (*ServicePath != "" || *ServiceConfigURL != "") {
+		return nil, fmt.Errorf("--grpc_reflection cannot be used with --service_json_path or --service_config_url")
+	}
+
 	// If service config is provided as a file, just use it and disable managed rollout
 	if *ServicePath != "" {
 		// Following flags will not be used
 		if *ServiceName != "" {
-			glog.Infof("flag --service is ignored when --service_json_path is specified.")
+			m.logger.Infof("flag --service is ignored when --service_json_path is specified.")
 		}
 		if *ServiceConfigId != "" {
-			glog.Infof("flag --service_config_id is ignored when --service_json_path is specified.")
+			m.logger.Infof("flag --service_config_id is ignored when --service_json_path is specified.")
 		}
 		if *RolloutStrategy != "fixed" {
-			glog.Infof("flag --rollout_strategy will be fixed when --service_json_path is specified.")
+			m.logger.Infof("flag --rollout_strategy will be fixed when --service_json_path is specified.")
 		}
 
 		if err := m.readAndApplyServiceConfig(*ServicePath); err != nil {
 			return nil, err
 		}
+		m.pollServiceConfig = func() error {
+			return m.readAndApplyServiceConfig(*ServicePath)
+		}
+		if *ServiceJsonWatchInterval > 0 {
+			m.watchServiceConfigFile(*ServicePath, *ServiceJsonWatchInterval)
+		}
+
+		m.logger.Event(severityInfo, "config_manager_started", "create new Config Manager from static service config json file", map[string]interface{}{
+			"service":           m.serviceName,
+			"config_id":         m.curConfigId(),
+			"service_json_path": *ServicePath,
+		})
+		return m, nil
+	}
+
+	// If service config is provided as a url, fetch it and disable managed rollout
+	if *ServiceConfigURL != "" {
+		if client, err = getClient(); err != nil {
+			return nil, err
+		}
+		fetcher, err := sc.NewURLServiceConfigFetcher(client, *ServiceConfigURL, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.fetchAndApplyServiceConfigFromURL(fetcher); err != nil {
+			return nil, err
+		}
+		m.pollServiceConfig = func() error {
+			return m.fetchAndApplyServiceConfigFromURL(fetcher)
+		}
+		if *ServiceConfigURLPollInterval > 0 {
+			m.pollServiceConfigURL(fetcher, *ServiceConfigURLPollInterval)
+		}
 
-		glog.Infof("create new Config Manager from static service config json file at %v", *ServicePath)
+		m.logger.Event(severityInfo, "config_manager_started", "create new Config Manager from service config url", map[string]interface{}{
+			"service":            m.serviceName,
+			"config_id":          m.curConfigId(),
+			"service_config_url": *ServiceConfigURL,
+		})
+		return m, nil
+	}
+
+	if *GrpcReflection {
+		if err := m.fetchAndApplyServiceConfigFromReflection(*GrpcReflectionTimeout); err != nil {
+			return nil, err
+		}
+		m.pollServiceConfig = func() error {
+			return m.fetchAndApplyServiceConfigFromReflection(*GrpcReflectionTimeout)
+		}
+
+		m.logger.Event(severityInfo, "config_manager_started", "create new Config Manager from the gRPC backend reflection service", map[string]interface{}{
+			"service":         m.serviceName,
+			"config_id":       m.curConfigId(),
+			"backend_address": opts.BackendAddress,
+		})
 		return m, nil
 	}
 
 	m.serviceName = *ServiceName
 	checkMetadata := *CheckMetadata
-	var err error
 
 	if m.serviceName == "" && checkMetadata && mf != nil {
 		m.serviceName, err = mf.FetchServiceName()
@@ -123,27 +369,22 @@ func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGenerator
 	if !(rolloutStrategy == util.FixedRolloutStrategy || rolloutStrategy == util.ManagedRolloutStrategy) {
 		return nil, fmt.Errorf(`failed to set rollout strategy. It must be either "managed" or "fixed"`)
 	}
+	if *RolloutDualServing && *RolloutTrafficSplit {
+		return nil, fmt.Errorf("--rollout_dual_serving can't be used together with --rollout_traffic_split")
+	}
 
 	// when --non_gcp  is set, instance metadata server(imds) is not defined. So
 	// accessToken is unavailable from imds and --service_account_key must be
 	// set to generate accessToken.
 	// The inverse is not true. We can still use IMDS on GCP when service account key is specified.
-	if mf == nil && opts.ServiceAccountKey == "" {
+	// A non-GCP metadata provider can supply the accessToken instead.
+	if m.metadataProvider == nil && opts.ServiceAccountKey == "" {
 		return nil, fmt.Errorf("If --non_gcp is specified, --service_account_key has to be specified.")
 	}
 
-	accessToken := func() (string, time.Duration, error) {
-		if opts.ServiceAccountKey != "" {
-			return tokengenerator.GenerateAccessTokenFromFile(opts.ServiceAccountKey)
-		}
-		return mf.FetchAccessToken()
-	}
-
-	client, err := httpsClient(opts)
-	if err != nil {
-		return nil, fmt.Errorf("fail to init httpsClient: %v", err)
+	if client, err = getClient(); err != nil {
+		return nil, err
 	}
-
 	m.serviceConfigFetcher = sc.NewServiceConfigFetcher(client, opts.ServiceManagementURL,
 		m.serviceName, accessToken)
 
@@ -165,39 +406,151 @@ func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGenerator
 			}
 		}
 	} else if rolloutStrategy == util.ManagedRolloutStrategy {
-		configId, err = m.serviceConfigFetcher.LoadConfigIdFromRollouts()
+		configId, err = m.loadConfigIdFromRollouts()
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if err = m.fetchAndApplyServiceConfig(configId); err != nil {
-		return nil, fmt.Errorf("fail to fetch and apply the startup service config, %v", err)
+		if rolloutStrategy != util.FixedRolloutStrategy || !*FallbackToManagedRollout {
+			return nil, fmt.Errorf("fail to fetch and apply the startup service config, %v", err)
+		}
+
+		m.logger.Event(severityWarning, "pinned_config_fallback", "fail to apply the pinned service config, falling back to the latest rollout", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": configId,
+			"error":     err,
+		})
+		configId, err = m.loadConfigIdFromRollouts()
+		if err != nil {
+			return nil, fmt.Errorf("fail to fall back to the latest rollout, %v", err)
+		}
+		if err = m.fetchAndApplyServiceConfig(configId); err != nil {
+			return nil, fmt.Errorf("fail to fetch and apply the fallback service config, %v", err)
+		}
 	}
 
 	if rolloutStrategy == util.ManagedRolloutStrategy {
 		m.rolloutIdChangeDetector = sc.NewRolloutIdChangeDetector(client, opts.ServiceControlURL, m.serviceName, accessToken)
 		m.rolloutIdChangeDetector.SetDetectRolloutIdChangeTimer(*checkNewRolloutInterval, func() {
-			latestConfigId, err := m.serviceConfigFetcher.LoadConfigIdFromRollouts()
-			if err != nil {
-				glog.Errorf("error occurred when getting configId by fetching rollout, %v", err)
-				return
-			}
-
-			if err = m.fetchAndApplyServiceConfig(latestConfigId); err != nil {
-				glog.Errorf("error occurred when fetching and applying new service config, %v", err)
-			}
+			_ = m.applyLatestRollout()
 		})
+		m.pollServiceConfig = m.applyLatestRollout
 	}
 
-	glog.Infof("create new Config Manager for service (%v) with configuration id (%v), %v rollout strategy",
-		m.serviceName, m.curConfigId(), rolloutStrategy)
+	m.logger.Event(severityInfo, "config_manager_started", "create new Config Manager", map[string]interface{}{
+		"service":          m.serviceName,
+		"config_id":        m.curConfigId(),
+		"rollout_strategy": rolloutStrategy,
+	})
 	return m, nil
 }
 
+// applyLatestRollout fetches and applies the config of the latest rollout.
+func (m *ConfigManager) applyLatestRollout() error {
+	latestConfigId, err := m.loadConfigIdFromRollouts()
+	if err != nil {
+		m.metrics.pollFailed()
+		m.logger.Event(severityError, "rollout_fetch_failed", "error occurred when getting configId by fetching rollout", map[string]interface{}{
+			"service": m.serviceName,
+			"error":   err,
+		})
+		return err
+	}
+
+	if latestConfigId != m.curConfigId() {
+		m.logger.Event(severityInfo, "rollout_detected", "new rollout detected", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": latestConfigId,
+		})
+	}
+	if serviceConfig := m.rolloutPercentagesChanged(latestConfigId); serviceConfig != nil {
+		m.logger.Event(severityInfo, "rollout_percentages_changed", "traffic percentages of the rollout changed", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": latestConfigId,
+		})
+		if err = m.applyServiceConfig(serviceConfig); err != nil {
+			m.metrics.pollFailed()
+			m.logger.Event(severityError, "config_apply_failed", "error occurred when applying the traffic percentages of the rollout", map[string]interface{}{
+				"service":   m.serviceName,
+				"config_id": latestConfigId,
+				"error":     err,
+			})
+		}
+		return err
+	}
+	if err = m.fetchAndApplyServiceConfig(latestConfigId); err != nil {
+		m.metrics.pollFailed()
+		m.logger.Event(severityError, "config_apply_failed", "error occurred when fetching and applying new service config", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": latestConfigId,
+			"error":     err,
+		})
+		return err
+	}
+	return nil
+}
+
+// loadConfigIdFromRollouts picks the config id of the latest rollout, the one
+// with the highest traffic, or the one of the instance with
+// --rollout_traffic_split. With --rollout_dual_serving, it also keeps the
+// traffic percentages of the rollout for the next applied config.
+func (m *ConfigManager) loadConfigIdFromRollouts() (string, error) {
+	if *RolloutDualServing {
+		configId, percentages, err := m.serviceConfigFetcher.LoadConfigIdAndPercentagesFromRollouts()
+		if err != nil {
+			return "", err
+		}
+		m.configMu.Lock()
+		m.rolloutPercentages = percentages
+		m.configMu.Unlock()
+		return configId, nil
+	}
+	if !*RolloutTrafficSplit {
+		return m.serviceConfigFetcher.LoadConfigIdFromRollouts()
+	}
+
+	instanceKey := *RolloutInstanceKey
+	if instanceKey == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("fail to get the hostname as the rollout instance key, %v", err)
+		}
+		instanceKey = hostname
+	}
+	return m.serviceConfigFetcher.LoadConfigIdFromRolloutsForInstance(instanceKey)
+}
+
+// rolloutPercentagesChanged returns the applied service config if it's still
+// the one of the latest rollout, but the traffic percentages of the rollout
+// have changed since it was applied.
+func (m *ConfigManager) rolloutPercentagesChanged(latestConfigId string) *confpb.Service {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	if !*RolloutDualServing || m.serviceInfo == nil || latestConfigId != m.curConfigId() {
+		return nil
+	}
+	if reflect.DeepEqual(m.rolloutPercentages, m.serviceInfo.RolloutPercentages) {
+		return nil
+	}
+	return m.curServiceConfig
+}
+
 func (m *ConfigManager) fetchAndApplyServiceConfig(latestConfigId string) error {
 	if latestConfigId == m.curConfigId() {
-		glog.Infof("no new configuration to load for service %v, current configuration Id %v", m.serviceName, m.curConfigId())
+		m.logger.Event(severityInfo, "config_unchanged", "no new configuration to load", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": m.curConfigId(),
+		})
+		return nil
+	}
+	if reason := m.skipConfig(latestConfigId); reason != "" {
+		m.logger.Event(severityWarning, "config_skipped", "skipped the new service config", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": latestConfigId,
+			"reason":    reason,
+		})
 		return nil
 	}
 
@@ -205,17 +558,89 @@ func (m *ConfigManager) fetchAndApplyServiceConfig(latestConfigId string) error
 	if err != nil {
 		return err
 	}
+	m.logger.Event(severityInfo, "config_fetched", "fetched service config", map[string]interface{}{
+		"service":   m.serviceName,
+		"config_id": latestConfigId,
+	})
 
 	return m.applyServiceConfig(serviceConfig)
 }
 
+// loadAdditionalServiceConfigs fetches the configs of --additional_services
+// and reads the ones of --additional_service_json_paths. They are pinned, only
+// the config of the service follows its rollouts.
+func (m *ConfigManager) loadAdditionalServiceConfigs(getClient func() (*http.Client, error), accessToken util.GetAccessTokenFunc) error {
+	services, err := parseAdditionalServices(*AdditionalServices)
+	if err != nil {
+		return fmt.Errorf("invalid --additional_services: %v", err)
+	}
+	for _, service := range services {
+		client, err := getClient()
+		if err != nil {
+			return err
+		}
+		fetcher := sc.NewServiceConfigFetcher(client, m.envoyConfigOptions.ServiceManagementURL, service[0], accessToken)
+		config, err := fetcher.FetchConfig(service[1])
+		if err != nil {
+			return fmt.Errorf("fail to fetch the config %s of service %s, %v", service[1], service[0], err)
+		}
+		m.additionalServiceConfigs = append(m.additionalServiceConfigs, config)
+	}
+
+	for _, path := range strings.Split(*AdditionalServiceJsonPaths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("fail to read service config file: %s, error: %s", path, err)
+		}
+		config, err := util.UnmarshalServiceConfigFile(path, data)
+		if err != nil {
+			return fmt.Errorf("fail to unmarshal service config file: %s, error: %s", path, err)
+		}
+		m.additionalServiceConfigs = append(m.additionalServiceConfigs, config)
+	}
+
+	for _, config := range m.additionalServiceConfigs {
+		m.logger.Event(severityInfo, "additional_service_loaded", "loaded the config of an additional service", map[string]interface{}{
+			"service":   config.GetName(),
+			"config_id": config.GetId(),
+		})
+	}
+	return nil
+}
+
+// parseAdditionalServices parses "NAME:CONFIG_ID[,NAME:CONFIG_ID...]" into
+// ordered service name and config id pairs.
+func parseAdditionalServices(s string) ([][2]string, error) {
+	var services [][2]string
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("%q should be in the format NAME:CONFIG_ID", entry)
+		}
+		services = append(services, [2]string{entry[:i], entry[i+1:]})
+	}
+	return services, nil
+}
+
 func (m *ConfigManager) readAndApplyServiceConfig(servicePath string) error {
 	config, err := ioutil.ReadFile(servicePath)
 	if err != nil {
 		return fmt.Errorf("fail to read service config file: %s, error: %s", servicePath, err)
 	}
 
-	serviceConfig, err := util.UnmarshalServiceConfig(bytes.NewReader(config))
+	return m.applyServiceConfigFile(servicePath, config)
+}
+
+func (m *ConfigManager) applyServiceConfigFile(servicePath string, config []byte) error {
+	serviceConfig, err := util.UnmarshalServiceConfigFile(servicePath, config)
 	if err != nil {
 		return fmt.Errorf("fail to unmarshal service config: %v, error: %s", config, err)
 	}
@@ -224,58 +649,259 @@ func (m *ConfigManager) readAndApplyServiceConfig(servicePath string) error {
 	return m.applyServiceConfig(serviceConfig)
 }
 
-func (m *ConfigManager) applyServiceConfig(serviceConfig *confpb.Service) error {
+// watchServiceConfigFile checks the service config file for changes every
+// interval, and applies the modified one.
+func (m *ConfigManager) watchServiceConfigFile(servicePath string, interval time.Duration) {
+	lastConfig, _ := ioutil.ReadFile(servicePath)
+	go func() {
+		m.logger.Infof("start watching service config file %s every %v", servicePath, interval)
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			config, err := ioutil.ReadFile(servicePath)
+			if err != nil {
+				m.metrics.pollFailed()
+				m.logger.Event(severityError, "config_file_read_failed", "error occurred when reading the watched service config file", map[string]interface{}{
+					"service_json_path": servicePath,
+					"error":             err,
+				})
+				continue
+			}
+			if bytes.Equal(config, lastConfig) {
+				continue
+			}
+			lastConfig = config
+
+			m.logger.Event(severityInfo, "config_file_changed", "watched service config file changed", map[string]interface{}{
+				"service_json_path": servicePath,
+			})
+			if err := m.applyServiceConfigFile(servicePath, config); err != nil {
+				m.metrics.pollFailed()
+				m.logger.Event(severityError, "config_apply_failed", "error occurred when applying the modified service config file", map[string]interface{}{
+					"service_json_path": servicePath,
+					"error":             err,
+				})
+			}
+		}
+	}()
+}
+
+func (m *ConfigManager) fetchAndApplyServiceConfigFromURL(fetcher *sc.URLServiceConfigFetcher) error {
+	serviceConfig, err := fetcher.FetchConfig()
+	if err != nil {
+		return fmt.Errorf("fail to fetch service config from %s, %v", *ServiceConfigURL, err)
+	}
+	if serviceConfig == nil {
+		return nil
+	}
+
+	m.serviceName = serviceConfig.GetName()
+	return m.applyServiceConfig(serviceConfig)
+}
+
+// pollServiceConfigURL fetches the service config from the url every
+// interval, and applies it unless the server reports it unmodified.
+func (m *ConfigManager) pollServiceConfigURL(fetcher *sc.URLServiceConfigFetcher, interval time.Duration) {
+	go func() {
+		m.logger.Infof("start polling service config url %s every %v", *ServiceConfigURL, interval)
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if err := m.fetchAndApplyServiceConfigFromURL(fetcher); err != nil {
+				m.metrics.pollFailed()
+				m.logger.Event(severityError, "config_apply_failed", "error occurred when fetching and applying the service config url", map[string]interface{}{
+					"service_config_url": *ServiceConfigURL,
+					"error":              err,
+				})
+			}
+		}
+	}()
+}
+
+func (m *ConfigManager) applyServiceConfig(serviceConfig *confpb.Service) (err error) {
 	if serviceConfig == nil {
 		return fmt.Errorf("applid service config is empty")
 	}
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	defer func() {
+		if err != nil {
+			m.metrics.generationFailed()
+		}
+	}()
 
-	var err error
+	start := time.Now()
 	m.curServiceConfig = serviceConfig
+	if m.runtimeMaintenance {
+		m.dropUnknownMaintenanceSelectors(serviceConfig)
+	}
 	m.serviceInfo, err = configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.Id, m.envoyConfigOptions)
 	if err != nil {
 		return fmt.Errorf("fail to initialize ServiceInfo, %s", err)
 	}
 
-	if m.metadataFetcher != nil {
-		attrs, err := m.metadataFetcher.FetchGCPAttributes()
+	if m.protoDescriptorLoader != nil {
+		descriptor, err := m.protoDescriptorLoader()
+		if err != nil {
+			return fmt.Errorf("fail to load the proto descriptor for transcoding, %v", err)
+		}
+		m.serviceInfo.TranscodingProtoDescriptor = descriptor
+	}
+
+	if m.metadataProvider != nil {
+		attrs, err := m.metadataProvider.FetchGCPAttributes()
 		if err != nil {
-			m.Infof("metadata server was not reached, skipping GCP Attributes")
+			m.logger.Infof("metadata server was not reached, skipping GCP Attributes")
 		} else {
 			m.serviceInfo.GcpAttributes = attrs
 		}
 	}
 
-	snapshot, err := m.makeSnapshot()
+	// The percentages only apply to the config of the rollout they were
+	// fetched with, not to a pinned or rolled back one.
+	if _, ok := m.rolloutPercentages[serviceConfig.GetId()]; ok {
+		m.serviceInfo.RolloutPercentages = m.rolloutPercentages
+	}
+
+	if m.acme != nil {
+		m.serviceInfo.AcmeCertificate, m.serviceInfo.AcmeHttpChallenges = m.acme.state()
+	}
+
+	for _, config := range m.additionalServiceConfigs {
+		additionalService, err := configinfo.NewServiceInfoFromServiceConfig(config, config.GetId(), m.envoyConfigOptions)
+		if err != nil {
+			return fmt.Errorf("fail to initialize ServiceInfo of service %s, %s", config.GetName(), err)
+		}
+		additionalService.GcpAttributes = m.serviceInfo.GcpAttributes
+		m.serviceInfo.AdditionalServices = append(m.serviceInfo.AdditionalServices, additionalService)
+	}
+
+	snapshot, resources, err := m.makeSnapshot()
 	if err != nil {
 		return fmt.Errorf("fail to make a snapshot, %s", err)
 	}
-	return m.cache.SetSnapshot(m.envoyConfigOptions.Node, *snapshot)
+	if err := m.cache.SetSnapshot(m.envoyConfigOptions.Node, *snapshot); err != nil {
+		return err
+	}
+	operations := len(m.serviceInfo.Operations)
+	for _, additionalService := range m.serviceInfo.AdditionalServices {
+		operations += len(additionalService.Operations)
+	}
+	m.metrics.recordGeneration(operations, resources, time.Since(start))
+	m.appliedSnapshot = snapshot
+	m.appliedTime = time.Now()
+	m.notifySnapshotUpdated()
+	m.scheduleDeferredOpenIDDiscovery(serviceConfig)
+	if err := m.setDebugServiceInfo(m.serviceInfo); err != nil {
+		m.logger.Errorf("fail to dump ServiceInfo for the debug endpoint, %v", err)
+	}
+
+	m.logger.Event(severityInfo, "config_applied", "applied service config", map[string]interface{}{
+		"service":   serviceConfig.GetName(),
+		"config_id": serviceConfig.GetId(),
+	})
+	return nil
 }
 
-func (m *ConfigManager) makeSnapshot() (*cache.Snapshot, error) {
-	m.Infof("making configuration for api: %v", m.serviceInfo.Name)
+func (m *ConfigManager) makeSnapshot() (*cache.Snapshot, *gen.Resources, error) {
+	m.logger.Infof("making configuration for api: %v", m.serviceInfo.Name)
 
-	var clusterResources, endpoints, secrets, runtimes, routes, listenerResources []types.Resource
-	clusters, err := gen.MakeClusters(m.serviceInfo)
+	var endpoints, secrets, runtimes []types.Resource
+	resources, err := gen.MakeResources(m.serviceInfo)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	clusterResources := make([]types.Resource, 0, len(resources.Clusters))
+	listenerResources := make([]types.Resource, 0, len(resources.Listeners))
+	routes := make([]types.Resource, 0, len(resources.Routes))
+	for _, cluster := range resources.Clusters {
+		clusterResources = append(clusterResources, cluster)
+	}
+	for _, lis := range resources.Listeners {
+		listenerResources = append(listenerResources, lis)
+	}
+	for _, route := range resources.Routes {
+		routes = append(routes, route)
+	}
+	for _, secret := range resources.Secrets {
+		secrets = append(secrets, secret)
+	}
+
+	snapshot := &cache.Snapshot{}
+	for typ, items := range map[types.ResponseType][]types.Resource{
+		types.Endpoint: endpoints,
+		types.Cluster:  clusterResources,
+		types.Route:    routes,
+		types.Listener: listenerResources,
+		types.Runtime:  runtimes,
+		types.Secret:   secrets,
+	} {
+		snapshot.Resources[typ] = m.makeResources(typ, items)
+	}
+	m.logger.Infof("Envoy Dynamic Configuration is cached for service: %v", m.serviceName)
+	return snapshot, resources, nil
+}
+
+// makeResources versions the resources with the current config id, unless they
+// are the same as the applied ones. The cache only pushes the resource types
+// with a new version to Envoy, so e.g. a rollout only changing the routes
+// doesn't rebuild the clusters.
+func (m *ConfigManager) makeResources(typ types.ResponseType, items []types.Resource) cache.Resources {
+	resources := cache.NewResources(m.curConfigId(), items)
+	if m.appliedSnapshot == nil {
+		return resources
 	}
-	for i := range clusters {
-		clusterResources = append(clusterResources, clusters[i])
+
+	applied := m.appliedSnapshot.Resources[typ]
+	if sameResources(applied.Items, resources.Items) {
+		resources.Version = applied.Version
+	} else if resources.Version == applied.Version {
+		// A modified service config file may keep its config id.
+		m.configRevision++
+		resources.Version = fmt.Sprintf("%s.%d", resources.Version, m.configRevision)
+	}
+	return resources
+}
+
+func sameResources(a, b map[string]types.Resource) bool {
+	if len(a) != len(b) {
+		return false
 	}
+	for name, item := range b {
+		if aItem, ok := a[name]; !ok || !sameResource(aItem, item) {
+			return false
+		}
+	}
+	return true
+}
 
-	m.Infof("adding Listeners configuration for api: %v", m.serviceInfo.Name)
-	listeners, err := gen.MakeListeners(m.serviceInfo)
+func sameResource(a, b types.Resource) bool {
+	aVersion, err := resourceVersion(a)
 	if err != nil {
-		return nil, err
+		return false
 	}
-	for _, lis := range listeners {
-		listenerResources = append(listenerResources, lis)
+	bVersion, err := resourceVersion(b)
+	if err != nil {
+		return false
 	}
+	return aVersion == bVersion
+}
 
-	snapshot := cache.NewSnapshot(m.curConfigId(), endpoints, clusterResources, routes, listenerResources, runtimes, secrets)
-	m.Infof("Envoy Dynamic Configuration is cached for service: %v", m.serviceName)
-	return &snapshot, nil
+// snapshotUpdated returns a channel closed when the next snapshot is set.
+func (m *ConfigManager) snapshotUpdated() <-chan struct{} {
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
+	if m.snapshotUpdate == nil {
+		m.snapshotUpdate = make(chan struct{})
+	}
+	return m.snapshotUpdate
+}
+
+func (m *ConfigManager) notifySnapshotUpdated() {
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
+	if m.snapshotUpdate != nil {
+		close(m.snapshotUpdate)
+	}
+	m.snapshotUpdate = make(chan struct{})
 }
 
 func (m *ConfigManager) curConfigId() string {
@@ -291,25 +917,57 @@ func (m *ConfigManager) ID(node *corepb.Node) string {
 
 // Infof implements the Infof method for Log interface.
 func (m *ConfigManager) Infof(format string, args ...interface{}) {
-	glog.Infof(format, args...)
+	m.logger.log(severityInfo, componentXdsCache, "", fmt.Sprintf(format, args...), nil)
 }
 
 // Debugf implements the Debugf method for Log interface.
 func (m *ConfigManager) Debugf(format string, args ...interface{}) {
-	glog.Infof(format, args...)
+	m.logger.log(severityDebug, componentXdsCache, "", fmt.Sprintf(format, args...), nil)
 }
 
 // Warnf implements the Warnf method for Log interface.
 func (m *ConfigManager) Warnf(format string, args ...interface{}) {
-	glog.Infof(format, args...)
+	m.logger.log(severityWarning, componentXdsCache, "", fmt.Sprintf(format, args...), nil)
 }
 
 // Errorf implements the Errorf method for Log interface.
-func (m *ConfigManager) Errorf(format string, args ...interface{}) { glog.Errorf(format, args...) }
+func (m *ConfigManager) Errorf(format string, args ...interface{}) {
+	m.logger.log(severityError, componentXdsCache, "", fmt.Sprintf(format, args...), nil)
+}
 
 // Cache returns snapshot cache.
 func (m *ConfigManager) Cache() cache.Cache { return m.cache }
 
+// FetchServiceConfig reads the service config from --service_json_path, or
+// fetches the one of --service and --service_config_id from Service
+// Management, authenticated with --service_account_key or the metadata server.
+// It is used to generate the Envoy config offline.
+func FetchServiceConfig(opts options.ConfigGeneratorOptions) (*confpb.Service, error) {
+	if *ServicePath != "" {
+		config, err := ioutil.ReadFile(*ServicePath)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read service config file: %s, error: %s", *ServicePath, err)
+		}
+		return util.UnmarshalServiceConfigFile(*ServicePath, config)
+	}
+
+	if *ServiceName == "" || *ServiceConfigId == "" {
+		return nil, fmt.Errorf("either --service_json_path, or both --service and --service_config_id have to be specified")
+	}
+
+	client, err := httpsClient(opts)
+	if err != nil {
+		return nil, fmt.Errorf("fail to init httpsClient: %v", err)
+	}
+	accessToken, _, err := tokengenerator.MakeTokenFuncs(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher := sc.NewServiceConfigFetcher(client, opts.ServiceManagementURL, *ServiceName, accessToken)
+	return fetcher.FetchConfig(*ServiceConfigId)
+}
+
 func httpsClient(opts options.ConfigGeneratorOptions) (*http.Client, error) {
 	caCert, err := ioutil.ReadFile(opts.SslSidestreamClientRootCertsPath)
 	if err != nil {
@@ -326,3 +984,31 @@ func httpsClient(opts options.ConfigGeneratorOptions) (*http.Client, error) {
 		Timeout: opts.HttpRequestTimeout,
 	}, nil
 }
+
+// loadProtoDescriptor reads a serialized FileDescriptorSet from a local file
+// or from a gs://BUCKET/OBJECT uri.
+func loadProtoDescriptor(client *http.Client, path string, accessToken util.GetAccessTokenFunc) ([]byte, error) {
+	descriptor := &descpb.FileDescriptorSet{}
+	if strings.HasPrefix(path, util.GcsURIPrefix) {
+		bucket, object, err := util.ParseGcsURI(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := util.CallGoogleapis(client, util.FetchGcsObjectURL(bucket, object), util.GET, accessToken, nil, descriptor); err != nil {
+			return nil, fmt.Errorf("fail to fetch proto descriptor %s: %v", path, err)
+		}
+	} else {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read proto descriptor %s: %v", path, err)
+		}
+		if err := proto.Unmarshal(content, descriptor); err != nil {
+			return nil, fmt.Errorf("fail to unmarshal proto descriptor %s: %v", path, err)
+		}
+	}
+
+	if len(descriptor.GetFile()) == 0 {
+		return nil, fmt.Errorf("proto descriptor %s has no files", path)
+	}
+	return proto.Marshal(descriptor)
+}
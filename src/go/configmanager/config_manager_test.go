@@ -17,8 +17,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
@@ -31,6 +35,7 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/golang/protobuf/jsonpb"
@@ -41,9 +46,11 @@ import (
 	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	servicecontrolpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
 	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	apipb "google.golang.org/genproto/protobuf/api"
 )
 
 func TestFetchListeners(t *testing.T) {
@@ -506,6 +513,9 @@ func TestServiceConfigAutoUpdate(t *testing.T) {
                         "methods":[
                             {
                                 "name": "Simplegetcors"
+                            },
+                            {
+                                "name": "Echo"
                             }
                         ]
                     }
@@ -712,6 +722,84 @@ func genProtoBinary(input string, msg proto.Message, dest *safeData) error {
 	return nil
 }
 
+func TestFetchServiceConfig(t *testing.T) {
+	testData := []struct {
+		desc            string
+		serviceJsonPath string
+		service         string
+		serviceConfigId string
+		wantName        string
+		wantError       string
+	}{
+		{
+			desc:            "Success, read the service config from --service_json_path",
+			serviceJsonPath: platform.GetFilePath(platform.FixedDrServiceConfig),
+			wantName:        "echo-api.endpoints.cloudesf-testing.cloud.goog",
+		},
+		{
+			desc:      "Failure, no service config is specified",
+			service:   "bookstore.endpoints.project123.cloud.goog",
+			wantError: "either --service_json_path, or both --service and --service_config_id have to be specified",
+		},
+	}
+
+	for _, tc := range testData {
+		setFlags(tc.service, tc.serviceConfigId, "fixed", "1m", tc.serviceJsonPath)
+
+		got, err := FetchServiceConfig(options.DefaultConfigGeneratorOptions())
+		if err != nil {
+			if tc.wantError == "" || err.Error() != tc.wantError {
+				t.Errorf("Test(%s): got error: %v, want error: %v", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if tc.wantError != "" {
+			t.Errorf("Test(%s): got no error, want error: %v", tc.desc, tc.wantError)
+			continue
+		}
+		if got.GetName() != tc.wantName {
+			t.Errorf("Test(%s): got service name: %s, want: %s", tc.desc, got.GetName(), tc.wantName)
+		}
+	}
+	setFlags("", "", "fixed", "1m", "")
+}
+
+func TestNewConfigManagerWithoutSidestreamRootCerts(t *testing.T) {
+	testData := []struct {
+		desc                       string
+		transcodingProtoDescriptor string
+		wantError                  string
+	}{
+		{
+			desc: "Success, the service config file needs no https client",
+		},
+		{
+			desc:                       "Failure, the gs:// proto descriptor needs the https client",
+			transcodingProtoDescriptor: "gs://bucket/descriptor.pb",
+			wantError:                  "fail to init httpsClient",
+		},
+	}
+
+	for _, tc := range testData {
+		setFlags("", "", "fixed", "1m", platform.GetFilePath(platform.FixedDrServiceConfig))
+
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "http://127.0.0.1:8082"
+		opts.DisableTracing = true
+		opts.SslSidestreamClientRootCertsPath = "/non-existent/roots.pem"
+		opts.TranscodingProtoDescriptor = tc.transcodingProtoDescriptor
+		_, err := NewConfigManager(nil, opts)
+		if tc.wantError == "" {
+			if err != nil {
+				t.Errorf("Test(%s): got error: %v", tc.desc, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+			t.Errorf("Test(%s): got error: %v, want error: %v", tc.desc, err, tc.wantError)
+		}
+	}
+	setFlags("", "", "fixed", "1m", "")
+}
+
 func setFlags(service, serviceConfigId, rolloutStrategy, checkRolloutInterval, serviceJsonPath string) {
 	_ = flag.Set("service", service)
 	_ = flag.Set("service_config_id", serviceConfigId)
@@ -719,3 +807,346 @@ func setFlags(service, serviceConfigId, rolloutStrategy, checkRolloutInterval, s
 	_ = flag.Set("check_rollout_interval", checkRolloutInterval)
 	_ = flag.Set("service_json_path", serviceJsonPath)
 }
+
+func TestApplyServiceConfigKeepsUnchangedVersions(t *testing.T) {
+	testProjectName := "bookstore.endpoints.project123.cloud.goog"
+	testEndpointName := "endpoints.examples.bookstore.Bookstore"
+	makeServiceConfig := func(id, path string) *confpb.Service {
+		return &confpb.Service{
+			Name: testProjectName,
+			Id:   id,
+			Apis: []*apipb.Api{
+				{
+					Name: testEndpointName,
+					Methods: []*apipb.Method{
+						{
+							Name: "Echo",
+						},
+					},
+				},
+			},
+			Control: &confpb.Control{
+				Environment: "servicecontrol.googleapis.com",
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: testEndpointName + ".Echo",
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: path,
+						},
+					},
+				},
+			},
+		}
+	}
+	oldConfigID, newConfigID := "2018-12-05r0", "2018-12-05r1"
+
+	testData := []struct {
+		desc                     string
+		enableRds                bool
+		skipServiceControlFilter bool
+		wantVersions             map[types.ResponseType]string
+	}{
+		{
+			desc:                     "only the listeners are updated for a route change",
+			skipServiceControlFilter: true,
+			wantVersions: map[types.ResponseType]string{
+				types.Cluster:  oldConfigID,
+				types.Route:    oldConfigID,
+				types.Listener: newConfigID,
+			},
+		},
+		{
+			desc:                     "only the routes are updated for a route change with RDS",
+			enableRds:                true,
+			skipServiceControlFilter: true,
+			wantVersions: map[types.ResponseType]string{
+				types.Cluster:  oldConfigID,
+				types.Route:    newConfigID,
+				types.Listener: oldConfigID,
+			},
+		},
+		{
+			desc:      "the listeners are updated with the config id of the service control filter",
+			enableRds: true,
+			wantVersions: map[types.ResponseType]string{
+				types.Cluster:  oldConfigID,
+				types.Route:    newConfigID,
+				types.Listener: newConfigID,
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "http://127.0.0.1:8082"
+		opts.DisableTracing = true
+		opts.EnableRds = tc.enableRds
+		opts.SkipServiceControlFilter = tc.skipServiceControlFilter
+
+		logger, err := newStructuredLogger(opts.LogFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &ConfigManager{
+			envoyConfigOptions: opts,
+			logger:             logger,
+		}
+		m.cache = cache.NewSnapshotCache(true, m, m)
+
+		if err := m.applyServiceConfig(makeServiceConfig(oldConfigID, "/v1/echo")); err != nil {
+			t.Fatalf("Test (%s): fail to apply the old service config: %v", tc.desc, err)
+		}
+		if err := m.applyServiceConfig(makeServiceConfig(newConfigID, "/v2/echo")); err != nil {
+			t.Fatalf("Test (%s): fail to apply the new service config: %v", tc.desc, err)
+		}
+
+		for typ, wantVersion := range tc.wantVersions {
+			if gotVersion := m.appliedSnapshot.Resources[typ].Version; gotVersion != wantVersion {
+				t.Errorf("Test (%s): got version %s for resource type %v, want %s", tc.desc, gotVersion, typ, wantVersion)
+			}
+		}
+	}
+}
+
+func TestWatchServiceConfigFile(t *testing.T) {
+	serviceConfig := `{
+		"name": "bookstore.endpoints.project123.cloud.goog",
+		"id": "2018-12-05r0",
+		"apis": [
+			{
+				"name": "endpoints.examples.bookstore.Bookstore",
+				"methods": [
+					{
+						"name": "Echo"
+					}
+				]
+			}
+		],
+		"http": {
+			"rules": [
+				{
+					"selector": "endpoints.examples.bookstore.Bookstore.Echo",
+					"get": "%s"
+				}
+			]
+		}
+	}`
+	dir, err := ioutil.TempDir("", "service_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	servicePath := filepath.Join(dir, "service.json")
+	if err := ioutil.WriteFile(servicePath, []byte(fmt.Sprintf(serviceConfig, "/v1/echo")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+	logger, err := newStructuredLogger(opts.LogFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &ConfigManager{
+		envoyConfigOptions: opts,
+		logger:             logger,
+	}
+	m.cache = cache.NewSnapshotCache(true, m, m)
+	if err := m.readAndApplyServiceConfig(servicePath); err != nil {
+		t.Fatal(err)
+	}
+	m.watchServiceConfigFile(servicePath, 10*time.Millisecond)
+
+	// The modified file keeps its config id, so the changed listeners get a
+	// new revision of it.
+	if err := ioutil.WriteFile(servicePath, []byte(fmt.Sprintf(serviceConfig, "/v2/echo")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wantVersion := "2018-12-05r0.1"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snapshot, err := m.cache.GetSnapshot(opts.Node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotVersion := snapshot.GetVersion(resource.ListenerType)
+		if gotVersion == wantVersion {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got listener version %s, want %s after modifying the service config file", gotVersion, wantVersion)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestApplyServiceConfigWithAdditionalServices(t *testing.T) {
+	makeServiceConfig := func(name, apiName string) *confpb.Service {
+		return &confpb.Service{
+			Name: name,
+			Id:   "2018-12-05r0",
+			Apis: []*apipb.Api{
+				{
+					Name: apiName,
+					Methods: []*apipb.Method{
+						{
+							Name: "Echo",
+						},
+					},
+				},
+			},
+		}
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+	logger, err := newStructuredLogger(opts.LogFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &ConfigManager{
+		envoyConfigOptions: opts,
+		logger:             logger,
+		additionalServiceConfigs: []*confpb.Service{
+			makeServiceConfig("echo.endpoints.project123.cloud.goog", "endpoints.examples.echo.Echo"),
+		},
+	}
+	m.cache = cache.NewSnapshotCache(true, m, m)
+	if err := m.applyServiceConfig(makeServiceConfig("bookstore.endpoints.project123.cloud.goog", "endpoints.examples.bookstore.Bookstore")); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := m.cache.GetSnapshot(opts.Node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters := snapshot.GetResources(resource.ClusterType)
+	for _, name := range []string{
+		"backend-cluster-bookstore.endpoints.project123.cloud.goog_local",
+		"backend-cluster-echo.endpoints.project123.cloud.goog_local",
+	} {
+		if _, ok := clusters[name]; !ok {
+			t.Errorf("cluster %s is missing from the snapshot", name)
+		}
+	}
+	if got := len(m.serviceInfo.AdditionalServices); got != 1 {
+		t.Errorf("want 1 additional service, get %d", got)
+	}
+}
+
+func TestApplyServiceConfigWithRolloutPercentages(t *testing.T) {
+	serviceConfig := &confpb.Service{
+		Name: "bookstore.endpoints.project123.cloud.goog",
+		Id:   "2018-12-05r1",
+		Apis: []*apipb.Api{
+			{
+				Name: "endpoints.examples.bookstore.Bookstore",
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                   string
+		rolloutPercentages     map[string]float64
+		wantRolloutPercentages map[string]float64
+	}{
+		{
+			desc: "the applied config is in the rollout",
+			rolloutPercentages: map[string]float64{
+				"2018-12-05r0": 40,
+				"2018-12-05r1": 60,
+			},
+			wantRolloutPercentages: map[string]float64{
+				"2018-12-05r0": 40,
+				"2018-12-05r1": 60,
+			},
+		},
+		{
+			desc: "the applied config isn't in the rollout",
+			rolloutPercentages: map[string]float64{
+				"2018-12-05r0": 40,
+				"2018-12-05r2": 60,
+			},
+		},
+		{
+			desc: "no rollout percentages",
+		},
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "http://127.0.0.1:8082"
+			opts.DisableTracing = true
+			logger, err := newStructuredLogger(opts.LogFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &ConfigManager{
+				envoyConfigOptions: opts,
+				logger:             logger,
+				rolloutPercentages: tc.rolloutPercentages,
+			}
+			m.cache = cache.NewSnapshotCache(true, m, m)
+			if err := m.applyServiceConfig(serviceConfig); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(m.serviceInfo.RolloutPercentages, tc.wantRolloutPercentages) {
+				t.Errorf("want rollout percentages %v, get %v", tc.wantRolloutPercentages, m.serviceInfo.RolloutPercentages)
+			}
+		})
+	}
+}
+
+func TestParseAdditionalServices(t *testing.T) {
+	testData := []struct {
+		desc         string
+		services     string
+		wantServices [][2]string
+		wantError    string
+	}{
+		{
+			desc:     "services with config ids",
+			services: "echo.endpoints.project123.cloud.goog:2018-12-05r0, bookstore.endpoints.project123.cloud.goog:2019-01-01r1",
+			wantServices: [][2]string{
+				{"echo.endpoints.project123.cloud.goog", "2018-12-05r0"},
+				{"bookstore.endpoints.project123.cloud.goog", "2019-01-01r1"},
+			},
+		},
+		{
+			desc:      "service without config id",
+			services:  "echo.endpoints.project123.cloud.goog",
+			wantError: `"echo.endpoints.project123.cloud.goog" should be in the format NAME:CONFIG_ID`,
+		},
+		{
+			desc:      "config id without service",
+			services:  ":2018-12-05r0",
+			wantError: `":2018-12-05r0" should be in the format NAME:CONFIG_ID`,
+		},
+	}
+
+	for _, tc := range testData {
+		gotServices, err := parseAdditionalServices(tc.services)
+		if tc.wantError != "" {
+			if err == nil || err.Error() != tc.wantError {
+				t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): got error: %v", tc.desc, err)
+		}
+		if !reflect.DeepEqual(gotServices, tc.wantServices) {
+			t.Errorf("Test (%s): want services %v, get %v", tc.desc, tc.wantServices, gotServices)
+		}
+	}
+}
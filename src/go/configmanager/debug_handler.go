@@ -0,0 +1,336 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+)
+
+const (
+	serviceInfoDebugPath  = "/debug/service_info"
+	routeExplainDebugPath = "/debug/route_explain"
+	resumeRolloutPath     = "/debug/resume_rollout"
+	logLevelPath          = "/debug/log_level"
+	routeDebugHeadersPath = "/debug/route_debug_headers"
+	pollPath              = "/debug/poll"
+	maintenancePath       = "/debug/maintenance"
+)
+
+// The JSON view of the processed ServiceInfo, served on the debug endpoint.
+type serviceInfoView struct {
+	Name                  string           `json:"name"`
+	ConfigID              string           `json:"configId"`
+	ApiNames              []string         `json:"apiNames"`
+	GrpcApiNames          []string         `json:"grpcApiNames,omitempty"`
+	Operations            []*operationView `json:"operations"`
+	LocalBackendCluster   *clusterView     `json:"localBackendCluster,omitempty"`
+	RemoteBackendClusters []*clusterView   `json:"remoteBackendClusters,omitempty"`
+}
+
+type clusterView struct {
+	ClusterName string `json:"clusterName"`
+	Hostname    string `json:"hostname"`
+	Port        uint32 `json:"port"`
+	UseTLS      bool   `json:"useTls"`
+	Protocol    string `json:"protocol"`
+}
+
+type operationView struct {
+	Selector               string          `json:"selector"`
+	ApiVersion             string          `json:"apiVersion,omitempty"`
+	HttpRules              []*httpRuleView `json:"httpRules"`
+	Backend                *backendView    `json:"backend,omitempty"`
+	RequireAuth            bool            `json:"requireAuth"`
+	AllowedCallers         []string        `json:"allowedCallers,omitempty"`
+	DisabledFilters        []string        `json:"disabledFilters,omitempty"`
+	AllowUnregisteredCalls bool            `json:"allowUnregisteredCalls"`
+	ApiKeyLocations        []string        `json:"apiKeyLocations,omitempty"`
+	SkipServiceControl     bool            `json:"skipServiceControl"`
+	IsGenerated            bool            `json:"isGenerated,omitempty"`
+	IsStreaming            bool            `json:"isStreaming,omitempty"`
+}
+
+type httpRuleView struct {
+	HttpMethod string `json:"httpMethod"`
+	// The uri template after the snake_case to jsonName replacement.
+	UriTemplate string `json:"uriTemplate"`
+}
+
+type backendView struct {
+	ClusterName     string `json:"clusterName"`
+	Path            string `json:"path,omitempty"`
+	Hostname        string `json:"hostname,omitempty"`
+	TranslationType string `json:"translationType,omitempty"`
+	JwtAudience     string `json:"jwtAudience,omitempty"`
+	Deadline        string `json:"deadline,omitempty"`
+}
+
+// makeServiceInfoView converts the ServiceInfo to its JSON view, ordered by
+// the operations.
+func makeServiceInfoView(serviceInfo *configinfo.ServiceInfo) *serviceInfoView {
+	view := &serviceInfoView{
+		Name:         serviceInfo.Name,
+		ConfigID:     serviceInfo.ConfigID,
+		ApiNames:     serviceInfo.ApiNames,
+		GrpcApiNames: serviceInfo.GrpcApiNames,
+	}
+	if serviceInfo.LocalBackendCluster != nil {
+		view.LocalBackendCluster = makeClusterView(serviceInfo.LocalBackendCluster)
+	}
+	for _, cluster := range serviceInfo.RemoteBackendClusters {
+		view.RemoteBackendClusters = append(view.RemoteBackendClusters, makeClusterView(cluster))
+	}
+
+	for _, operation := range serviceInfo.Operations {
+		method := serviceInfo.Methods[operation]
+		if method == nil {
+			continue
+		}
+
+		op := &operationView{
+			Selector:               operation,
+			ApiVersion:             method.ApiVersion,
+			RequireAuth:            method.RequireAuth,
+			AllowedCallers:         method.AllowedCallers,
+			AllowUnregisteredCalls: method.AllowUnregisteredCalls,
+			SkipServiceControl:     method.SkipServiceControl,
+			IsGenerated:            method.IsGenerated,
+			IsStreaming:            method.IsStreaming,
+		}
+		for filter := range method.DisabledFilters {
+			op.DisabledFilters = append(op.DisabledFilters, filter)
+		}
+		sort.Strings(op.DisabledFilters)
+		for _, httpRule := range method.HttpRule {
+			op.HttpRules = append(op.HttpRules, &httpRuleView{
+				HttpMethod:  httpRule.HttpMethod,
+				UriTemplate: httpRule.UriTemplate.String(),
+			})
+		}
+		for _, location := range method.ApiKeyLocations {
+			op.ApiKeyLocations = append(op.ApiKeyLocations, apiKeyLocationString(location))
+		}
+		if backend := method.BackendInfo; backend != nil {
+			op.Backend = &backendView{
+				ClusterName:     backend.ClusterName,
+				Path:            backend.Path,
+				Hostname:        backend.Hostname,
+				TranslationType: backend.TranslationType.String(),
+				JwtAudience:     backend.JwtAudience,
+			}
+			if backend.Deadline != 0 {
+				op.Backend.Deadline = backend.Deadline.String()
+			}
+		}
+		view.Operations = append(view.Operations, op)
+	}
+	return view
+}
+
+func makeClusterView(cluster *configinfo.BackendRoutingCluster) *clusterView {
+	protocol := "unknown"
+	switch cluster.Protocol {
+	case util.HTTP1:
+		protocol = "http1"
+	case util.HTTP2:
+		protocol = "http2"
+	case util.GRPC:
+		protocol = "grpc"
+	}
+	return &clusterView{
+		ClusterName: cluster.ClusterName,
+		Hostname:    cluster.Hostname,
+		Port:        cluster.Port,
+		UseTLS:      cluster.UseTLS,
+		Protocol:    protocol,
+	}
+}
+
+func apiKeyLocationString(location *scpb.ApiKeyLocation) string {
+	switch {
+	case location.GetQuery() != "":
+		return "query=" + location.GetQuery()
+	case location.GetHeader() != "":
+		return "header=" + location.GetHeader()
+	case location.GetCookie() != "":
+		return "cookie=" + location.GetCookie()
+	}
+	return location.String()
+}
+
+// setDebugServiceInfo keeps the applied ServiceInfo and its JSON view for the
+// debug endpoints.
+func (m *ConfigManager) setDebugServiceInfo(serviceInfo *configinfo.ServiceInfo) error {
+	dump, err := json.MarshalIndent(makeServiceInfoView(serviceInfo), "", "  ")
+	if err != nil {
+		return err
+	}
+	m.serviceInfoDump.Store(dump)
+	m.appliedServiceInfo.Store(serviceInfo)
+	return nil
+}
+
+// DebugHandler returns the handler of the debug endpoints:
+//   - /debug/service_info serves the processed ServiceInfo of the applied
+//     service config as JSON.
+//   - /debug/route_explain?method=GET&path=/v1/foo&header=NAME:VALUE serves
+//     the generated route matching the request, with its operation and
+//     per-route filter configs.
+//   - POST /debug/resume_rollout resumes the rollout halted or skipping the
+//     config after Envoy rejected it.
+//   - /debug/log_level serves the glog verbosity, changed with a POST of
+//     ?verbosity=N.
+//   - /debug/route_debug_headers serves whether the responses carry the
+//     operation and cluster of their route, toggled with a POST of
+//     ?enabled=true|false.
+//   - POST /debug/poll checks for a new service config right away.
+//   - /debug/maintenance serves the operations in maintenance, replaced with
+//     a POST of ?selectors=SELECTOR,... and cleared with an empty one. The
+//     ones missing from a later service config are dropped when it is applied.
+func (m *ConfigManager) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(serviceInfoDebugPath, func(w http.ResponseWriter, r *http.Request) {
+		dump, ok := m.serviceInfoDump.Load().([]byte)
+		if !ok {
+			http.Error(w, "no service config is applied", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(dump)
+	})
+	mux.HandleFunc(routeExplainDebugPath, func(w http.ResponseWriter, r *http.Request) {
+		serviceInfo, ok := m.appliedServiceInfo.Load().(*configinfo.ServiceInfo)
+		if !ok {
+			http.Error(w, "no service config is applied", http.StatusServiceUnavailable)
+			return
+		}
+
+		query := r.URL.Query()
+		method, path := query.Get("method"), query.Get("path")
+		if method == "" || path == "" {
+			http.Error(w, "query parameters method and path are required", http.StatusBadRequest)
+			return
+		}
+		headers := make(map[string]string)
+		for _, header := range query["header"] {
+			kv := strings.SplitN(header, ":", 2)
+			if len(kv) != 2 {
+				http.Error(w, fmt.Sprintf("invalid header %q, must be NAME:VALUE", header), http.StatusBadRequest)
+				return
+			}
+			headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+
+		explanation, err := gen.ExplainRoute(serviceInfo, method, path, headers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if explanation == nil {
+			http.Error(w, "no route matches the request, it is rejected with 404", http.StatusNotFound)
+			return
+		}
+
+		body, err := json.MarshalIndent(explanation, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	})
+	mux.HandleFunc(resumeRolloutPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		m.resumeRollout()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(logLevelPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			verbosity, err := strconv.Atoi(r.URL.Query().Get("verbosity"))
+			if err != nil {
+				http.Error(w, "query parameter verbosity must be an integer", http.StatusBadRequest)
+				return
+			}
+			if err := m.setLogVerbosity(verbosity); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeDebugJSON(w, &logLevelView{Verbosity: logVerbosity()})
+	})
+	mux.HandleFunc(routeDebugHeadersPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(w, "query parameter enabled must be true or false", http.StatusBadRequest)
+				return
+			}
+			if err := m.setRouteDebugHeaders(enabled); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		writeDebugJSON(w, &routeDebugHeadersView{Enabled: m.routeDebugHeadersEnabled()})
+	})
+	mux.HandleFunc(pollPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if m.pollServiceConfig == nil {
+			http.Error(w, "no service config source to poll with the fixed rollout strategy", http.StatusBadRequest)
+			return
+		}
+		if err := m.pollNow(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeDebugJSON(w, &pollView{Service: m.serviceName, ConfigID: m.curConfigId()})
+	})
+	mux.HandleFunc(maintenancePath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if err := m.setMaintenanceSelectors(r.URL.Query().Get("selectors")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeDebugJSON(w, m.maintenance())
+	})
+	return mux
+}
+
+func writeDebugJSON(w http.ResponseWriter, view interface{}) {
+	body, err := json.MarshalIndent(view, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
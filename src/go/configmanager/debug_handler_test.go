@@ -0,0 +1,168 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestDebugHandler(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "grpc://127.0.0.1:8082"
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+		Name: "bookstore.endpoints.project123.cloud.goog",
+		Apis: []*apipb.Api{
+			{
+				Name: "endpoints.examples.bookstore.Bookstore",
+				Methods: []*apipb.Method{
+					{
+						Name: "GetShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.GetShelf",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves/{shelf}",
+					},
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.GetShelf",
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "auth_provider",
+						},
+					},
+				},
+			},
+		},
+	}, "2017-05-01r0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &ConfigManager{}
+	handler := m.DebugHandler()
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, serviceInfoDebugPath, nil))
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d before the service config is applied, want %d", resp.Code, http.StatusServiceUnavailable)
+	}
+
+	if err := m.setDebugServiceInfo(serviceInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, serviceInfoDebugPath, nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	want := `{
+  "name": "bookstore.endpoints.project123.cloud.goog",
+  "configId": "2017-05-01r0",
+  "apiNames": ["endpoints.examples.bookstore.Bookstore"],
+  "grpcApiNames": ["endpoints.examples.bookstore.Bookstore"],
+  "operations": [
+    {
+      "selector": "endpoints.examples.bookstore.Bookstore.GetShelf",
+      "httpRules": [
+        {
+          "httpMethod": "GET",
+          "uriTemplate": "/v1/shelves/{shelf=*}"
+        },
+        {
+          "httpMethod": "POST",
+          "uriTemplate": "/endpoints.examples.bookstore.Bookstore/GetShelf"
+        }
+      ],
+      "backend": {
+        "clusterName": "backend-cluster-bookstore.endpoints.project123.cloud.goog_local",
+        "translationType": "PATH_TRANSLATION_UNSPECIFIED",
+        "deadline": "15s"
+      },
+      "requireAuth": true,
+      "allowUnregisteredCalls": false,
+      "skipServiceControl": false
+    }
+  ],
+  "localBackendCluster": {
+    "clusterName": "backend-cluster-bookstore.endpoints.project123.cloud.goog_local",
+    "hostname": "127.0.0.1",
+    "port": 8082,
+    "useTls": false,
+    "protocol": "grpc"
+  }
+}`
+	if err := util.JsonEqual(want, string(body)); err != nil {
+		t.Errorf("got unexpected service info dump: %v", err)
+	}
+
+	for _, tc := range []struct {
+		url           string
+		wantStatus    int
+		wantOperation string
+	}{
+		{
+			url:           routeExplainDebugPath + "?method=GET&path=/v1/shelves/1",
+			wantStatus:    http.StatusOK,
+			wantOperation: "endpoints.examples.bookstore.Bookstore.GetShelf",
+		},
+		{
+			url:        routeExplainDebugPath + "?method=DELETE&path=/v1/shelves/1",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			url:        routeExplainDebugPath + "?method=GET",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			url:        routeExplainDebugPath + "?method=GET&path=/v1/shelves/1&header=foo",
+			wantStatus: http.StatusBadRequest,
+		},
+	} {
+		resp = httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if resp.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.url, resp.Code, tc.wantStatus)
+			continue
+		}
+		if tc.wantOperation != "" && !strings.Contains(resp.Body.String(), `"operation": "`+tc.wantOperation+`"`) {
+			t.Errorf("%s: got %s, want operation %s", tc.url, resp.Body.String(), tc.wantOperation)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
+
+	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+)
+
+// adsServer serves the snapshots of the config manager on both the state of
+// the world and the incremental variants of ADS. The xDS server of
+// go-control-plane doesn't implement the incremental one, where only the
+// resources changed since the last response of the stream are sent.
+type adsServer struct {
+	xds.Server
+	m     *ConfigManager
+	nonce int64
+}
+
+// deltaSubscription keeps the resources of a type subscribed by a stream, and
+// the versions of the ones sent to it.
+type deltaSubscription struct {
+	typeUrl string
+	// Envoy subscribes to all the listeners and clusters, without names.
+	wildcard bool
+	names    map[string]bool
+	versions map[string]string
+	// The snapshot versions of the responses by nonce, until acknowledged, and
+	// the last version accepted by Envoy.
+	nonces       map[string]string
+	ackedVersion string
+}
+
+// NewAdsServer creates the ADS server serving the snapshots of the config
+// manager.
+func (m *ConfigManager) NewAdsServer(ctx context.Context) discoverypb.AggregatedDiscoveryServiceServer {
+	return &adsServer{
+		Server: xds.NewServer(ctx, m.cache, xdsCallbacks{m: m}),
+		m:      m,
+	}
+}
+
+// DeltaAggregatedResources implements the incremental variant of ADS.
+func (s *adsServer) DeltaAggregatedResources(stream discoverypb.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	reqCh := make(chan *discoverypb.DeltaDiscoveryRequest)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case reqCh <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	var nodeId string
+	subscriptions := make(map[string]*deltaSubscription)
+	updated := s.m.snapshotUpdated()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case err := <-errCh:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case req := <-reqCh:
+			// The node is only set on the first request of the stream.
+			if req.GetNode() != nil {
+				nodeId = s.m.ID(req.GetNode())
+			}
+
+			sub, ok := subscriptions[req.GetTypeUrl()]
+			if ok && req.GetResponseNonce() != "" {
+				version := sub.nonces[req.GetResponseNonce()]
+				delete(sub.nonces, req.GetResponseNonce())
+				if req.GetErrorDetail() != nil {
+					s.m.onNack(req.GetTypeUrl(), sub.ackedVersion, req.GetErrorDetail().GetMessage())
+				} else {
+					sub.ackedVersion = version
+					s.m.onAck(req.GetTypeUrl(), version)
+				}
+			}
+			if !ok {
+				sub = newDeltaSubscription(req)
+				subscriptions[req.GetTypeUrl()] = sub
+			} else if len(req.GetResourceNamesSubscribe()) == 0 && len(req.GetResourceNamesUnsubscribe()) == 0 {
+				// An ACK or a NACK of a response.
+				continue
+			} else {
+				sub.update(req)
+			}
+			if err := s.respond(stream, nodeId, sub, !ok); err != nil {
+				return err
+			}
+		case <-updated:
+			updated = s.m.snapshotUpdated()
+			// Respond in the order of the type urls, for a deterministic stream.
+			var typeUrls []string
+			for typeUrl := range subscriptions {
+				typeUrls = append(typeUrls, typeUrl)
+			}
+			sort.Strings(typeUrls)
+			for _, typeUrl := range typeUrls {
+				if err := s.respond(stream, nodeId, subscriptions[typeUrl], false); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// respond sends the subscribed resources changed since the last response, and
+// the names of the removed ones. An empty response is only sent if forced,
+// e.g. for the initial request of a resource type.
+func (s *adsServer) respond(stream discoverypb.AggregatedDiscoveryService_DeltaAggregatedResourcesServer, nodeId string, sub *deltaSubscription, force bool) error {
+	snapshot, err := s.m.cache.GetSnapshot(nodeId)
+	if err != nil {
+		// Responded once the first snapshot is set.
+		return nil
+	}
+
+	resources := snapshot.GetResources(sub.typeUrl)
+	resp := &discoverypb.DeltaDiscoveryResponse{
+		SystemVersionInfo: snapshot.GetVersion(sub.typeUrl),
+		TypeUrl:           sub.typeUrl,
+	}
+	for name, resource := range resources {
+		if !sub.subscribed(name) {
+			continue
+		}
+		version, err := resourceVersion(resource)
+		if err != nil {
+			return err
+		}
+		if sub.versions[name] == version {
+			continue
+		}
+		resourceAny, err := ptypes.MarshalAny(resource)
+		if err != nil {
+			return err
+		}
+		resp.Resources = append(resp.Resources, &discoverypb.Resource{
+			Name:     name,
+			Version:  version,
+			Resource: resourceAny,
+		})
+		sub.versions[name] = version
+	}
+	for name := range sub.versions {
+		if _, ok := resources[name]; !ok || !sub.subscribed(name) {
+			resp.RemovedResources = append(resp.RemovedResources, name)
+			delete(sub.versions, name)
+		}
+	}
+
+	if len(resp.Resources) == 0 && len(resp.RemovedResources) == 0 && !force {
+		return nil
+	}
+	sort.Slice(resp.Resources, func(i, j int) bool {
+		return resp.Resources[i].Name < resp.Resources[j].Name
+	})
+	sort.Strings(resp.RemovedResources)
+	resp.Nonce = strconv.FormatInt(atomic.AddInt64(&s.nonce, 1), 10)
+	sub.nonces[resp.Nonce] = resp.SystemVersionInfo
+	return stream.Send(resp)
+}
+
+func newDeltaSubscription(req *discoverypb.DeltaDiscoveryRequest) *deltaSubscription {
+	sub := &deltaSubscription{
+		typeUrl:  req.GetTypeUrl(),
+		wildcard: len(req.GetResourceNamesSubscribe()) == 0,
+		names:    make(map[string]bool),
+		versions: make(map[string]string),
+		nonces:   make(map[string]string),
+	}
+	for name, version := range req.GetInitialResourceVersions() {
+		sub.versions[name] = version
+	}
+	sub.update(req)
+	return sub
+}
+
+func (sub *deltaSubscription) update(req *discoverypb.DeltaDiscoveryRequest) {
+	for _, name := range req.GetResourceNamesSubscribe() {
+		sub.names[name] = true
+	}
+	for _, name := range req.GetResourceNamesUnsubscribe() {
+		delete(sub.names, name)
+		// Envoy drops the unsubscribed resources itself.
+		delete(sub.versions, name)
+	}
+}
+
+func (sub *deltaSubscription) subscribed(name string) bool {
+	return sub.wildcard || sub.names[name]
+}
+
+// resourceVersion versions a resource by the hash of its JSON, as the binary
+// encoding of the map fields in its filter configs is not deterministic. The
+// JSON is hashed as it is written, instead of being held as a string.
+func resourceVersion(resource types.Resource) (string, error) {
+	hash := sha256.New()
+	if err := (&jsonpb.Marshaler{}).Marshal(hash, resource); err != nil {
+		return "", fmt.Errorf("fail to marshal resource %s: %v", cache.GetResourceName(resource), err)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
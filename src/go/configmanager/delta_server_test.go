@@ -0,0 +1,249 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/grpc"
+
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+type fakeDeltaStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	reqs  chan *discoverypb.DeltaDiscoveryRequest
+	resps chan *discoverypb.DeltaDiscoveryResponse
+}
+
+func (s *fakeDeltaStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeDeltaStream) Recv() (*discoverypb.DeltaDiscoveryRequest, error) {
+	select {
+	case req := <-s.reqs:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *fakeDeltaStream) Send(resp *discoverypb.DeltaDiscoveryResponse) error {
+	s.resps <- resp
+	return nil
+}
+
+func (s *fakeDeltaStream) recvResponse(t *testing.T) *discoverypb.DeltaDiscoveryResponse {
+	select {
+	case resp := <-s.resps:
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the delta discovery response")
+		return nil
+	}
+}
+
+func resourceNames(resp *discoverypb.DeltaDiscoveryResponse) []string {
+	var names []string
+	for _, r := range resp.GetResources() {
+		names = append(names, r.GetName())
+	}
+	return names
+}
+
+func TestDeltaAggregatedResources(t *testing.T) {
+	testEndpointName := "endpoints.examples.bookstore.Bookstore"
+	makeServiceConfig := func(id, path string) *confpb.Service {
+		return &confpb.Service{
+			Name: "bookstore.endpoints.project123.cloud.goog",
+			Id:   id,
+			Apis: []*apipb.Api{
+				{
+					Name: testEndpointName,
+					Methods: []*apipb.Method{
+						{
+							Name: "Echo",
+						},
+					},
+				},
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: testEndpointName + ".Echo",
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: path,
+						},
+					},
+				},
+			},
+		}
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+	opts.EnableRds = true
+	logger, err := newStructuredLogger(opts.LogFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &ConfigManager{
+		envoyConfigOptions: opts,
+		logger:             logger,
+	}
+	m.cache = cache.NewSnapshotCache(true, m, m)
+	if err := m.applyServiceConfig(makeServiceConfig("2018-12-05r0", "/v1/echo")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fakeDeltaStream{
+		ctx:   ctx,
+		reqs:  make(chan *discoverypb.DeltaDiscoveryRequest),
+		resps: make(chan *discoverypb.DeltaDiscoveryResponse, 10),
+	}
+	server := m.NewAdsServer(ctx)
+	go server.DeltaAggregatedResources(stream)
+
+	// All the clusters are sent for the wildcard subscription.
+	stream.reqs <- &discoverypb.DeltaDiscoveryRequest{
+		Node: &corepb.Node{
+			Id: opts.Node,
+		},
+		TypeUrl: resource.ClusterType,
+	}
+	resp := stream.recvResponse(t)
+	if resp.GetTypeUrl() != resource.ClusterType || len(resp.GetResources()) == 0 {
+		t.Fatalf("got response %v, want the clusters", resp)
+	}
+	stream.reqs <- &discoverypb.DeltaDiscoveryRequest{
+		TypeUrl:       resource.ClusterType,
+		ResponseNonce: resp.GetNonce(),
+	}
+
+	// Only the subscribed route config is sent.
+	stream.reqs <- &discoverypb.DeltaDiscoveryRequest{
+		TypeUrl:                resource.RouteType,
+		ResourceNamesSubscribe: []string{"local_route"},
+	}
+	resp = stream.recvResponse(t)
+	if got, want := resourceNames(resp), []string{"local_route"}; resp.GetTypeUrl() != resource.RouteType || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %s resources %v, want route config %v", resp.GetTypeUrl(), got, want)
+	}
+	oldRouteVersion := resp.GetResources()[0].GetVersion()
+
+	// Only the changed route config is sent on a rollout, as the clusters are
+	// sent before the routes if changed.
+	if err := m.applyServiceConfig(makeServiceConfig("2018-12-05r1", "/v2/echo")); err != nil {
+		t.Fatal(err)
+	}
+	resp = stream.recvResponse(t)
+	if got, want := resourceNames(resp), []string{"local_route"}; resp.GetTypeUrl() != resource.RouteType || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %s resources %v after the rollout, want route config %v", resp.GetTypeUrl(), got, want)
+	}
+	if resp.GetResources()[0].GetVersion() == oldRouteVersion {
+		t.Errorf("got the same route config version %s after the rollout", oldRouteVersion)
+	}
+	if resp.GetSystemVersionInfo() != "2018-12-05r1" {
+		t.Errorf("got system version %s, want 2018-12-05r1", resp.GetSystemVersionInfo())
+	}
+
+	// The unsubscribed route config is no longer sent, nor removed.
+	stream.reqs <- &discoverypb.DeltaDiscoveryRequest{
+		TypeUrl:                  resource.RouteType,
+		ResourceNamesUnsubscribe: []string{"local_route"},
+	}
+	select {
+	case resp := <-stream.resps:
+		t.Errorf("got response %v for the unsubscribed route config", resp)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeltaAggregatedResourcesInitialVersions(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+	logger, err := newStructuredLogger(opts.LogFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &ConfigManager{
+		envoyConfigOptions: opts,
+		logger:             logger,
+	}
+	m.cache = cache.NewSnapshotCache(true, m, m)
+	if err := m.applyServiceConfig(&confpb.Service{
+		Name: "bookstore.endpoints.project123.cloud.goog",
+		Id:   "2018-12-05r0",
+		Apis: []*apipb.Api{
+			{
+				Name: "endpoints.examples.bookstore.Bookstore",
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	initialVersions := make(map[string]string)
+	for name, cluster := range m.appliedSnapshot.GetResources(resource.ClusterType) {
+		version, err := resourceVersion(cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		initialVersions[name] = version
+	}
+	initialVersions["removed-cluster"] = "1"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fakeDeltaStream{
+		ctx:   ctx,
+		reqs:  make(chan *discoverypb.DeltaDiscoveryRequest),
+		resps: make(chan *discoverypb.DeltaDiscoveryResponse, 10),
+	}
+	go m.NewAdsServer(ctx).DeltaAggregatedResources(stream)
+
+	// A reconnecting Envoy only receives the clusters it doesn't have.
+	stream.reqs <- &discoverypb.DeltaDiscoveryRequest{
+		Node: &corepb.Node{
+			Id: opts.Node,
+		},
+		TypeUrl:                 resource.ClusterType,
+		InitialResourceVersions: initialVersions,
+	}
+	resp := stream.recvResponse(t)
+	if len(resp.GetResources()) != 0 {
+		t.Errorf("got clusters %v, want none", resourceNames(resp))
+	}
+	if got, want := resp.GetRemovedResources(), []string{"removed-cluster"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got removed clusters %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flags
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ConfigFile = flag.String("config_file", "", `path to a JSON file setting the flags of the config manager, e.g.
+	{"backend_address": "grpc://127.0.0.1:8082", "listener_port": 8080, "cors_preset": "basic"}.
+	Lists are joined with commas. $VAR and ${VAR} are expanded from the environment, $$ is a literal $.
+	The flags set on the command line or by their ESPv2_ environment variables override the file`)
+)
+
+// ApplyConfigFile sets the flags not set on the command line or by their
+// environment variables from --config_file. It must be called after
+// commonflags.ApplyEnvironment.
+func ApplyConfigFile() error {
+	if *ConfigFile == "" {
+		return nil
+	}
+	return applyConfigFile(flag.CommandLine, *ConfigFile)
+}
+
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return fmt.Errorf("config file %s: only JSON is supported, which is also valid YAML", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("fail to read config file %s: %v", path, err)
+	}
+	data = []byte(os.Expand(string(data), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
+	}))
+
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Keep the numbers as written, e.g. for the integer flags.
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("fail to parse config file %s: %v", path, err)
+	}
+
+	setOnCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config_file" || fs.Lookup(name) == nil {
+			return fmt.Errorf("config file %s: unknown flag %q", path, name)
+		}
+		if setOnCommandLine[name] {
+			continue
+		}
+		value, err := configFileValueString(values[name])
+		if err != nil {
+			return fmt.Errorf("config file %s: invalid value of flag %q: %v", path, name, err)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config file %s: invalid value of flag %q: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// configFileValueString converts a JSON value to the string of a flag value.
+func configFileValueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			s, err := configFileValueString(item)
+			if err != nil {
+				return "", err
+			}
+			if _, ok := item.([]interface{}); ok {
+				return "", fmt.Errorf("nested lists are not supported")
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v, must be a string, number, boolean or list", value)
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flags
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("TEST_CONFIG_FILE_BACKEND_PORT", "8082")
+	defer os.Unsetenv("TEST_CONFIG_FILE_BACKEND_PORT")
+
+	testData := []struct {
+		desc       string
+		fileName   string
+		config     string
+		args       []string
+		wantValues map[string]string
+		wantError  string
+	}{
+		{
+			desc:     "flags set from the file",
+			fileName: "config.json",
+			config: `{
+				"backend_address": "grpc://127.0.0.1:${TEST_CONFIG_FILE_BACKEND_PORT}",
+				"listener_port": 9000,
+				"enable_tracing": true,
+				"http_request_timeout": "30s",
+				"log_request_headers": ["x-foo", "x-bar"],
+				"cors_allow_origin": "$$foo"
+			}`,
+			wantValues: map[string]string{
+				"backend_address":      "grpc://127.0.0.1:8082",
+				"listener_port":        "9000",
+				"enable_tracing":       "true",
+				"http_request_timeout": "30s",
+				"log_request_headers":  "x-foo,x-bar",
+				"cors_allow_origin":    "$foo",
+			},
+		},
+		{
+			desc:     "flags on the command line override the file",
+			fileName: "config.json",
+			config:   `{"backend_address": "grpc://127.0.0.1:8082", "listener_port": 9000}`,
+			args:     []string{"--listener_port=8000"},
+			wantValues: map[string]string{
+				"backend_address": "grpc://127.0.0.1:8082",
+				"listener_port":   "8000",
+			},
+		},
+		{
+			desc:      "unknown flag",
+			fileName:  "config.json",
+			config:    `{"backend_adress": "grpc://127.0.0.1:8082"}`,
+			wantError: `unknown flag "backend_adress"`,
+		},
+		{
+			desc:      "invalid flag value",
+			fileName:  "config.json",
+			config:    `{"listener_port": "eighty"}`,
+			wantError: `invalid value of flag "listener_port"`,
+		},
+		{
+			desc:      "unsupported object value",
+			fileName:  "config.json",
+			config:    `{"backend_address": {"host": "127.0.0.1"}}`,
+			wantError: `invalid value of flag "backend_address": unsupported value`,
+		},
+		{
+			desc:      "yaml file",
+			fileName:  "config.yaml",
+			config:    `backend_address: grpc://127.0.0.1:8082`,
+			wantError: "only JSON is supported",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.String("backend_address", "http://127.0.0.1:8082", "")
+			fs.Int("listener_port", 8080, "")
+			fs.Bool("enable_tracing", false, "")
+			fs.Duration("http_request_timeout", 5*time.Second, "")
+			fs.String("log_request_headers", "", "")
+			fs.String("cors_allow_origin", "", "")
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, tc.fileName)
+			if err := ioutil.WriteFile(path, []byte(tc.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := applyConfigFile(fs, path)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Errorf("want error: %s, get error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotValues := make(map[string]string)
+			for name := range tc.wantValues {
+				gotValues[name] = fs.Lookup(name).Value.String()
+			}
+			if !reflect.DeepEqual(gotValues, tc.wantValues) {
+				t.Errorf("want flag values %v, get %v", tc.wantValues, gotValues)
+			}
+		})
+	}
+}
@@ -18,6 +18,7 @@ package flags
 
 import (
 	"flag"
+	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/commonflags"
@@ -35,12 +36,19 @@ var (
 	// Cors related configurations.
 	CorsAllowCredentials = flag.Bool("cors_allow_credentials", false, "whether include the Access-Control-Allow-Credentials header with the value true in responses or not")
 	CorsAllowHeaders     = flag.String("cors_allow_headers", "", "set Access-Control-Allow-Headers to the specified HTTP headers")
-	CorsAllowMethods     = flag.String("cors_allow_methods", "", "set Access-Control-Allow-Methods to the specified HTTP methods")
-	CorsAllowOrigin      = flag.String("cors_allow_origin", "", "set Access-Control-Allow-Origin to a specific origin")
+	CorsAllowMethods     = flag.String("cors_allow_methods", "", "set Access-Control-Allow-Methods to the specified HTTP methods, the custom HTTP methods of the http rules are added to them")
+	CorsAllowOrigin      = flag.String("cors_allow_origin", "", "set Access-Control-Allow-Origin to a specific origin, or a comma-separated list of them. An origin can have a wildcard for its subdomains, e.g. https://*.example.com")
 	CorsAllowOriginRegex = flag.String("cors_allow_origin_regex", "", "set Access-Control-Allow-Origin to a regular expression")
 	CorsExposeHeaders    = flag.String("cors_expose_headers", "", "set Access-Control-Expose-Headers to the specified headers")
 	CorsPreset           = flag.String("cors_preset", "", `enable CORS support, must be either "basic" or "cors_with_regex"`)
 
+	CorsMaxAge                = flag.Duration("cors_max_age", 480*time.Hour, "set Access-Control-Max-Age to the specified duration, the browsers cache the preflight responses for it. Not sent if 0")
+	CorsAllowPrivateNetwork   = flag.Bool("cors_allow_private_network", false, "whether answer the preflight requests with the Access-Control-Allow-Private-Network header with the value true or not")
+	CorsReflectRequestHeaders = flag.Bool("cors_reflect_request_headers", false, "set Access-Control-Allow-Headers to the Access-Control-Request-Headers of the preflight requests, cannot be used with --cors_allow_headers")
+
+	// Answers the OPTIONS requests without reaching the local backend.
+	CorsPreflightDirectResponse = flag.Bool("cors_preflight_direct_response", false, "whether answer the OPTIONS requests with direct responses from Envoy without reaching the local backend or not, for the setups with only remote backends")
+
 	// Backend routing configurations.
 	BackendDnsLookupFamily = flag.String("backend_dns_lookup_family", "auto", `Define the dns lookup family for all backends. The options are "auto", "v4only" and "v6only". The default is "auto".`)
 
@@ -48,13 +56,23 @@ var (
 	ClusterConnectTimeout = flag.Duration("cluster_connect_timeout", 20*time.Second, "cluster connect timeout in seconds")
 
 	// Network related configurations.
-	BackendAddress       = flag.String("backend_address", "http://127.0.0.1:8082", `The application server URI to which ESPv2 proxies requests.`)
-	ListenerAddress      = flag.String("listener_address", "0.0.0.0", "listener socket ip address")
-	ServiceManagementURL = flag.String("service_management_url", "https://servicemanagement.googleapis.com", "url of service management server")
-	ServiceControlURL    = flag.String("service_control_url", "https://servicecontrol.googleapis.com", "url of service control server")
+	BackendAddress         = flag.String("backend_address", "http://127.0.0.1:8082", `The application server URI to which ESPv2 proxies requests.`)
+	ListenerAddress        = flag.String("listener_address", "0.0.0.0", "listener socket ip address")
+	ServiceManagementURL   = flag.String("service_management_url", "https://servicemanagement.googleapis.com", "url of service management server")
+	ServiceControlURL      = flag.String("service_control_url", "https://servicecontrol.googleapis.com", "url of service control server")
+	BackendConsumerHeaders = flag.String("backend_consumer_headers", "", `Comma-separated consumer info of the Service Control Check responses forwarded to the backend in the request
+	headers, in addition to the consumer type and number: "project_number" in X-Endpoint-API-Consumer-Project-Number and
+	"api_key_hash" in X-Endpoint-API-Key-Hash, the SHA-256 of the api key. The headers sent by the clients are removed.`)
 
 	ListenerPort = flag.Int("listener_port", 8080, "listener port")
 	Healthz      = flag.String("healthz", "", "path for health check of ESPv2 proxy itself")
+	HealthzMode  = flag.String("healthz_mode", "proxy_only", `The health check on the --healthz path, "proxy_only" or "backend_aware". With "proxy_only", it returns 200
+	while the proxy is up. With "backend_aware", the local backend is actively health checked, with the gRPC health checking
+	protocol for gRPC backends and by connecting for the others, and it returns 503 while the backend has no healthy host.`)
+	HealthzGrpcService = flag.String("healthz_grpc_service", "", `The service name in the gRPC health checks of the backend with --healthz_mode=backend_aware.
+	The --healthz path returns 200 while the backend reports the service SERVING, and 503 otherwise. Empty checks the whole server.`)
+	EnableGrpcHealthPassthrough = flag.Bool("enable_grpc_health_passthrough", false, `If true, the `+"`grpc.health.v1.Health/Check`"+` calls are routed
+	to the gRPC backend without authentication nor service control, even if the service config doesn't define the health api.`)
 
 	SslServerCertPath                = flag.String("ssl_server_cert_path", "", "Path to the certificate and key that ESPv2 uses to act as a HTTPS server")
 	SslServerCipherSuites            = flag.String("ssl_server_cipher_suites", "", "Cipher suites to use for downstream connections as a comma-separated list.")
@@ -67,39 +85,239 @@ var (
 	EnableHSTS                       = flag.Bool("enable_strict_transport_security", false, "Enable HSTS (HTTP Strict Transport Security).")
 	DnsResolverAddresses             = flag.String("dns_resolver_addresses", "", `The addresses of dns resolvers. Each address should be in format of either IP_ADDR or IP_ADDR:PORT and they are separated by ';'.`)
 
+	AcmeDomains = flag.String("acme_domains", "", `If set, the comma separated domains of the server certificate that ESPv2 obtains and renews
+		through ACME, e.g. from Let's Encrypt, and serves on its listener instead of the one of --ssl_server_cert_path.
+		The listener doesn't accept connections until the first certificate is issued.`)
+	AcmeHttpPort = flag.Int("acme_http_port", 0, `If not 0, serve the ACME HTTP-01 challenges on a plain HTTP listener at this port, which
+		redirects the other requests to HTTPS. The CA validates the challenges on port 80, which must be forwarded to it.`)
+
 	// Flags for non_gcp deployment.
 	ServiceAccountKey = flag.String("service_account_key", "", `Use the service account key JSON file to access the service control and the
 	service management.  You can also set {creds_key} environment variable to the location of the service account credentials JSON file. If the option is
-  omitted, the proxy contacts the metadata service to fetch an access token`)
-	TokenAgentPort = flag.Uint("token_agent_port", 8791, "Port that configmanager use to setup server to provide envoy with access token using service account credential, for accessing servicecontrol.")
+  omitted, the proxy contacts the metadata service to fetch an access token. The file can also hold the refresh token of a user ("authorized_user")
+  or an external account of the workload identity federation ("external_account")`)
+	ImpersonateServiceAccount = flag.String("impersonate_service_account", "", `In the form of EMAIL[,DELEGATE...]. The access tokens of Service Control and Service Management
+	and the identity tokens of backend auth are minted for the service account EMAIL through the IAM Credentials API, with the credentials of
+	--service_account_key or of the metadata server and through the comma-separated chain of delegates. It cannot be used together with
+	--service_control_iam_service_account or --backend_auth_iam_service_account.`)
+
+	TokenAgentPort         = flag.Uint("token_agent_port", 8791, "Port that configmanager use to setup server to provide envoy with access token using service account credential, for accessing servicecontrol.")
+	ConfigManagerDebugPort = flag.Uint("config_manager_debug_port", 0, `If not 0, configmanager serves the processed service config, e.g. the operations, http rules, backends and
+	auth requirements, as JSON on http://localhost:PORT/debug/service_info, and explains which route matches a request on
+	http://localhost:PORT/debug/route_explain?method=GET&path=/v1/foo&header=NAME:VALUE. It also changes the log verbosity on
+	/debug/log_level?verbosity=N, toggles the route debug headers on /debug/route_debug_headers?enabled=true, sets the
+	operations in maintenance on /debug/maintenance?selectors=SELECTOR,... and checks for a new service config on
+	/debug/poll, all with a POST.`)
+	ConfigManagerReadinessPort = flag.Uint("config_manager_readiness_port", 0, `If not 0, configmanager serves http://0.0.0.0:PORT/ready for readiness probes. It responds 503 until Envoy
+	accepted the first generated config, then 200, with the service name and config id as JSON. It also serves the operations,
+	routes, clusters, snapshot size, generation duration and poll failures of the config translation on /metrics in the
+	Prometheus text format.`)
+	EnableRouteDebugHeaders = flag.Bool("enable_route_debug_headers", false, `If true, the responses carry the operation and the backend cluster of the matched route in the
+	x-espv2-debug-operation and x-espv2-debug-cluster headers. It can also be toggled at runtime on the debug port.`)
+	EnableOperationVirtualClusters = flag.Bool("enable_operation_virtual_clusters", false, `If true, Envoy breaks down the request counts and latencies by operation in the
+	vhost.backend.vcluster.OPERATION stats, with the dots of the operation replaced by underscores.`)
+
+	MaintenanceSelectors = flag.String("maintenance_selectors", "", `Comma-separated selectors of the operations in maintenance. Their routes respond
+	--maintenance_status_code with a Retry-After header without reaching the backend. It can also be changed at runtime
+	on /debug/maintenance of the debug port, without redeploying the service config.`)
+	MaintenanceStatusCode = flag.Int("maintenance_status_code", 503, `The status code of the operations in --maintenance_selectors, 503 or 423.`)
+	MaintenanceRetryAfter = flag.Duration("maintenance_retry_after", 60*time.Second, `The Retry-After of the responses of the operations in --maintenance_selectors,
+	rounded up to seconds. Not sent if 0.`)
+	ResponseCacheSelectors = flag.String("response_cache_selectors", "", `Comma-separated SELECTOR[=TTL] of the GET operations whose responses are cached by Envoy,
+	e.g. "bookstore.Bookstore.GetShelf=5m,bookstore.Bookstore.ListShelves". Their responses without a Cache-Control
+	header get "Cache-Control: max-age=TTL", with --response_cache_ttl if the TTL is omitted. The Cache-Control of the
+	backend, e.g. private or no-store, is kept. The API keys are in the cache key. The requests with an Authorization
+	header, e.g. a JWT, are never cached.`)
+	ResponseCacheTtl            = flag.Duration("response_cache_ttl", 60*time.Second, `The default time the responses of --response_cache_selectors are cached.`)
+	ResponseCacheKeyQueryParams = flag.String("response_cache_key_query_params", "", `Comma-separated query parameters in the cache key of the cached responses, in addition to the
+	ones of the API keys. All of them by default.`)
+	ResponseCacheKeyHeaders = flag.String("response_cache_key_headers", "", `Comma-separated request headers in the cache key of the cached responses, in addition to the
+	ones of the API keys, sent to the clients in the Vary header.`)
+	EtagSelectors = flag.String("etag_selectors", "", `Comma-separated selectors of the GET operations whose successful JSON responses, transcoded ones
+	included, get a strong ETag computed by Envoy. The requests with a matching If-None-Match header get a 304 Not Modified
+	without the body. Combined with --response_cache_selectors, the cached responses are revalidated without the backend.`)
+	EtagMaxBodyBytes = flag.Int("etag_max_body_bytes", 1<<20, `The max size of the response bodies of --etag_selectors buffered to compute their ETag. The
+	responses with a larger body pass through without an ETag. If 0, the size is not limited.`)
+	IdempotencySelectors = flag.String("idempotency_selectors", "", `Comma-separated selectors of the mutating operations whose requests are deduplicated by their
+	--idempotency_key_header. The duplicates of an in-flight request get a 409 Conflict, the duplicates of a completed one
+	get its stored response for --idempotency_ttl. The 5xx responses are not stored, so they can be retried.`)
+	IdempotencyKeyHeader = flag.String("idempotency_key_header", "Idempotency-Key", `The request header carrying the idempotency key of --idempotency_selectors.`)
+	IdempotencyTtl       = flag.Duration("idempotency_ttl", 10*time.Minute, `How long the responses of --idempotency_selectors are replayed to the duplicate requests.`)
+	RateLimitTiers       = flag.String("rate_limit_tiers", "", `Comma-separated TIER=REQUESTS/PERIOD limits of the consumer tiers, e.g. "free=10/1m,gold=1000/1m".
+	The requests of each api key are limited by the tier of its consumer in each proxy, those over the limit get a
+	429 Too Many Requests. The tiers without limit are not limited.`)
+	RateLimitConsumerTiers = flag.String("rate_limit_consumer_tiers", "", `Comma-separated PROJECT_NUMBER=TIER tiers of the consumers, by the consumer project number of the
+	Check responses, e.g. "123456=gold".`)
+	RateLimitDefaultTier    = flag.String("rate_limit_default_tier", "default", `The tier of the consumers not in --rate_limit_consumer_tiers. If empty, they are not limited.`)
+	RateLimitServiceAddress = flag.String("rate_limit_service_address", "", `The address of a gRPC rate limit service limiting the consumer tiers across all the proxies,
+	in the format grpc://HOST:PORT or grpcs://HOST:PORT. Its descriptors are "consumer_tier" and "api_key_hash", in the
+	domain of the service name.`)
+	ConcurrencyLimits = flag.String("concurrency_limits", "", `Comma-separated SELECTOR=N of the operations with at most N requests in flight at a time in each proxy,
+	e.g. "bookstore.Bookstore.ListShelves=100", so a slow operation can't hold all the capacity of the proxy. The requests
+	over the limit get a 503 Service Unavailable.`)
+	SpikeArrestRps = flag.Int("spike_arrest_rps", 0, `If not 0, each proxy serves at most this number of requests per rolling second, separately from the
+	quotas. The requests are spread over the second, those over the limit get a 429 Too Many Requests with a Retry-After.`)
+	SpikeArrestBurst = flag.Int("spike_arrest_burst", 0, `The number of requests of --spike_arrest_rps allowed at once after an idle time. If 0, the requests
+	are only smoothed.`)
+	DenyUserAgents = flag.String("deny_user_agents", "", `Comma-separated case-insensitive substrings of the user agents denied with a 403 Forbidden ahead of
+	the backends and of Service Control, e.g. "sqlmap,nikto". They are not denied for the operations disabling
+	envoy.filters.http.rbac in --disabled_filters.`)
+	UploadBackendAddress = flag.String("upload_backend_address", "", `The address of the backend serving the large requests of --upload_size_thresholds, e.g.
+	"http://127.0.0.1:8090", in the same format as --backend.`)
+	UploadSizeThresholds = flag.String("upload_size_thresholds", "", `Comma-separated SELECTOR=BYTES of the operations whose requests with a larger Content-Length are
+	routed to --upload_backend_address, e.g. "bookstore.Bookstore.CreateBook=1048576". The chunked requests without a
+	Content-Length are routed to their backend.`)
+	HonorGrpcTimeoutHeader = flag.Bool("honor_grpc_timeout_header", false, `If true, the grpc-timeout header sent by the clients shortens the deadline of their gRPC requests,
+	so the interactive clients can fail fast. It never lengthens the deadline of the operation. Envoy only reads it in the
+	requests with a gRPC content type when they are routed: the gRPC requests and the HTTP requests transcoded to gRPC.
+	The requests to the HTTP backends keep the deadline of their operation.`)
+	DenyPaths = flag.String("deny_paths", "", `Comma-separated case-insensitive substrings of the request paths denied with a 403 Forbidden ahead of
+	the backends and of Service Control, e.g. "/wp-admin,.php". They are not denied for the operations disabling
+	envoy.filters.http.rbac in --disabled_filters.`)
+	QueryParamMatchers = flag.String("query_param_matchers", "", `The query parameters the routes of the operations match, with their value if set. The format is
+	"SELECTOR=PARAM[:VALUE][,PARAM[:VALUE]...][;SELECTOR=...]", e.g. "storage.Objects.GetMedia=alt:media". An operation can have the
+	http pattern of another one, e.g. to route "?alt=media" to another backend, its routes are then ahead of the other ones. The
+	http patterns of the gRPC methods can't be shared, since the gRPC-JSON transcoder binds each http pattern once.`)
+
+	EnableRds = flag.Bool("enable_rds", false, `If true, configmanager serves the routes through RDS instead of inlining them in the listener, so
+	a service config change only affecting the routes doesn't drain the listener and its long-lived streams. The service control filter
+	config in the listener carries the service config id, so while service control is enabled every rollout of a new config id still
+	updates the listener. Only the route changes keeping the config id, e.g. of a modified --service_json_path, or the rollouts with
+	--skip_service_control_filter keep the listener.`)
+
+	ForceRegexRouteMatch = flag.Bool("force_regex_route_match", false, `If true, the uri templates whose only wildcard is a trailing "/**", e.g. "/v1/files/**",
+	are matched with a regex like the other templates with wildcards, instead of a path prefix.`)
+	ApiVersionHeader = flag.String("api_version_header", "", `If set, e.g. to Accept-Version, the apis of the service config with different versions can share their
+	http patterns, and the requests are routed to the api whose version equals the value of this header. Requests without
+	the header, or with an unknown version, are routed to the api listed first in the service config. The http patterns of the
+	gRPC methods can't be shared, since the gRPC-JSON transcoder binds each http pattern once.`)
+	ApiBasePath = flag.String("api_base_path", "", `If set, e.g. to /gateway/v1, the routes of the operations match their http patterns under this path prefix,
+	which is stripped before the requests are forwarded to the backends, so ESPv2 can serve behind a load balancer routing by path
+	prefix. The --healthz path and the gRPC health checks are not prefixed.`)
+
+	DeterministicOutput = flag.Bool("deterministic_output", false, `If true, the generated config is stable between runs: the lists derived from maps in the service config,
+	e.g. the metric costs, and the clusters are sorted by name, and the static bootstrap config is written as indented JSON,
+	so golden files and reviews of the generated config diff cleanly.`)
 
 	// Flags for external calls.
 	DisableOidcDiscovery = flag.Bool("disable_oidc_discovery", false, `Disable OpenID Connect Discovery. 
   When disabled, config generator will not make external calls to determine the JWKS URI, 
 	but the 'jwks_uri' field must not be empty in any authentication provider. 
 	This should be disabled when the URLs configured by the API Producer cannot be trusted.`)
+	OpenIDDiscoveryBudget = flag.Duration("openid_discovery_budget", 0, `The overall time for the retries of an OpenID Connect Discovery, see the openid_discovery callout of --callout_policies.
+	0 means no limit.`)
+	DeferOpenIDDiscovery = flag.Bool("defer_openid_discovery", false, `If true, a failed OpenID Connect Discovery doesn't fail the config generation.
+	The tokens of the provider are rejected until its discovery, retried in the background, succeeds and the config is updated.`)
+
 	DependencyErrorBehavior = flag.String("dependency_error_behavior", commonpb.DependencyErrorBehavior_BLOCK_INIT_ON_ANY_ERROR.String(),
 		`The behavior all Envoy filter will adhere to when waiting for external dependencies during filter config.
 						Value must match the enum espv2.api.envoy.v9.http.common.DependencyErrorBehavior.`)
 
+	ApiKeyLocations = flag.String("api_key_locations", "", `Additional locations to extract the API key from for all operations, separated by comma.
+	Each location is "query=NAME", "header=NAME", "header=NAME:PREFIX" or "cookie=NAME". With a PREFIX, only header values
+	starting with the prefix are used, e.g. "header=Authorization:ApiKey" extracts the key from "Authorization: ApiKey <key>".
+	If an operation has no API key locations in the service config, the default locations are kept.`)
+
+	JwtCallerAllowlist = flag.String("jwt_caller_allowlist", "", `Restrict the callers of operations to the listed identities. The "azp" or "email" claim
+	of the validated JWT must match one of the callers. Format: "SELECTOR=CALLER[,CALLER...][;SELECTOR=...]", e.g.
+	"echo.v1.Echo.Admin=admin@my-project.iam.gserviceaccount.com". Each selector must have an authentication requirement.`)
+	DisabledFilters = flag.String("disabled_filters", "", `Disable http filters for some operations, through their per-route configs.
+	Format: "SELECTOR=FILTER[,FILTER...][;SELECTOR=...]", e.g. "echo.v1.Echo.Passthrough=com.google.espv2.filters.http.backend_auth".
+	The filters that can be disabled are envoy.filters.http.jwt_authn, envoy.filters.http.rbac,
+	com.google.espv2.filters.http.backend_auth, com.google.espv2.filters.http.path_rewrite and
+	com.google.espv2.filters.http.service_control. The gRPC transcoder, envoy.filters.http.grpc_json_transcoder,
+	cannot be disabled: it has no per-route config, and transcodes the requests matching the HTTP rules of the
+	proto descriptor on all the routes.`)
+
 	// Envoy configurations.
-	AccessLog       = flag.String("access_log", "", "Path to a local file to which the access log entries will be written")
+	AccessLog       = flag.String("access_log", "", "Path to a local file to which the access log entries will be written. Use /dev/stdout or /dev/stderr to write them to the console.")
 	AccessLogFormat = flag.String("access_log_format", "", `String format to specify the format of access log.
 	If unset, the following format will be used.
 	https://www.envoyproxy.io/docs/envoy/latest/configuration/observability/access_log#default-format-string
 	For the detailed format grammar, please refer to the following document.
 	https://www.envoyproxy.io/docs/envoy/latest/configuration/observability/access_log#format-strings`)
+	AccessLogJsonFormat = flag.String("access_log_json_format", "", `A JSON object to write each access log entry as JSON, e.g.
+	{"status":"%RESPONSE_CODE%","path":"%REQ(:PATH)%","duration":"%DURATION%"}. It cannot be used together with --access_log_format.`)
+	AccessLogMinStatusCode = flag.Int("access_log_min_status_code", 0, `If set, only log the requests whose response code is not less than it, e.g. 400 to only log errors.`)
+
+	AccessLogServiceAddress = flag.String("access_log_service_address", "", `The address of a gRPC Access Log Service to stream the access log entries to,
+	in the format grpc://HOST:PORT or grpcs://HOST:PORT.`)
+	AccessLogServiceBufferSizeBytes     = flag.Int("access_log_service_buffer_size_bytes", 0, `The size of the access log buffer before it is flushed to the gRPC Access Log Service. If 0, Envoy decides the default.`)
+	AccessLogServiceBufferFlushInterval = flag.Duration("access_log_service_buffer_flush_interval", 0, `The interval to flush the access log buffer to the gRPC Access Log Service. If 0, Envoy decides the default.`)
+	AccessLogServiceRequestHeaders      = flag.String("access_log_service_request_headers", "", `Additional request headers(separated by comma) to log through the gRPC Access Log Service.`)
+	AccessLogServiceResponseHeaders     = flag.String("access_log_service_response_headers", "", `Additional response headers(separated by comma) to log through the gRPC Access Log Service.`)
+
+	AuditLog = flag.String("audit_log", "", `Path to a local file to which the auth outcome of every request is written as JSON, distinct from the
+	access log: the path without its query, the operation, JWT issuer and subject, SHA-256 of the api key, the ALLOW or DENY decision and
+	its reason. The decision is DENY for the requests rejected by the auth or the quota checks of ESPv2, by their response code details.`)
+	AuditLogToAccessLogService = flag.Bool("audit_log_to_access_log_service", false, `If true, the audit log entries are also streamed to --access_log_service_address, under the log
+	names espv2_audit_allow and espv2_audit_deny.`)
+
+	PrometheusMetricsPort = flag.Int("prometheus_metrics_port", 0, `If not 0, serve the stats of ESPv2 in the Prometheus format on /metrics at this port.
+		The stats are read from the admin interface, which must be enabled with --admin_port.`)
+	PrometheusMetricsAddress = flag.String("prometheus_metrics_address", util.LoopbackIPv4Addr, `The address the Prometheus metrics listener binds to. The stats are served without
+		authentication, so it is only reachable locally by default. Set it to 0.0.0.0 to let a remote Prometheus server scrape them.`)
+	PrometheusStatsFilter = flag.String("prometheus_stats_filter", options.DefaultPrometheusStatsFilter, `The regex selecting the stats served on the Prometheus metrics listener.`)
+
+	LocalReplyJsonFormat = flag.String("local_reply_json_format", "", `A JSON object used as the body of the error responses generated by ESPv2, including the
+	transcoding errors such as a malformed JSON request body. The string values can use the access log format operators, e.g.
+	{"error":{"status":"%RESPONSE_CODE%","message":"%LOCAL_REPLY_BODY%"}}. If unset, {"code":"%RESPONSE_CODE%","message":"%LOCAL_REPLY_BODY%"} is used.
+	If set, it also replaces the google.rpc.Status body of the gRPC errors of the backends transcoded to JSON. For them,
+	%LOCAL_REPLY_BODY% is the message of the google.rpc.Status, and the operators other than %RESPONSE_CODE%,
+	%LOCAL_REPLY_BODY% and %RESPONSE_CODE_DETAILS% are kept as is.`)
+	LocalReplyIncludeDetails = flag.Bool("local_reply_include_details", false, `Add a "details" list to the body of the error responses generated by ESPv2, with a
+	google.rpc.ErrorInfo whose metadata has the response code details, e.g. "jwt_authn_access_denied". The transcoded gRPC
+	errors of the backends get the same body format, with the details of their google.rpc.Status as the "details" list.`)
+	LocalReplyErrorInfoDomain = flag.String("local_reply_error_info_domain", "", `If set, add an "error_info" field with a google.rpc.ErrorInfo of this domain to the body of the
+	error responses generated by ESPv2. Its reason tells the kind of error, e.g. "UNAUTHENTICATED" or "ROUTE_NOT_FOUND", and its
+	metadata has the response code details. The transcoded gRPC errors formatted like them get it too, with the reason
+	"BACKEND_ERROR".`)
+	LocalReplyErrorInfoMetadata = flag.String("local_reply_error_info_metadata", "", `Comma-separated KEY=VALUE added to the metadata of the google.rpc.ErrorInfo of
+	--local_reply_error_info_domain. The values can use the access log format operators, e.g. "host=%REQ(:AUTHORITY)%".`)
+	LocalReplyHelpUrl = flag.String("local_reply_help_url", "", `If set, add a "help" field with a google.rpc.Help link to this URL to the body of the error
+	responses generated by ESPv2, and of the transcoded gRPC errors formatted like them.`)
 
 	EnvoyUseRemoteAddress  = flag.Bool("envoy_use_remote_address", false, "Envoy HttpConnectionManager configuration, please refer to envoy documentation for detailed information.")
 	EnvoyXffNumTrustedHops = flag.Int("envoy_xff_num_trusted_hops", 2, "Envoy HttpConnectionManager configuration, please refer to envoy documentation for detailed information.")
 
+	LogFormat = flag.String("log_format", "text", `The format of the config manager logs, must be one of "text" or "json". With "json", the logs are written to stderr
+	as one JSON object per line with the "severity", "component", "event" and "message" fields, e.g. for Cloud Logging.`)
+
+	RequestIdHeader = flag.String("request_id_header", "", `If set, the request ID is also sent to the backend in this header, e.g. x-correlation-id, and returned in it
+	when --always_set_request_id_in_response is set. The request ID is always sent in x-request-id.`)
+	PreserveExternalRequestId = flag.Bool("preserve_external_request_id", false, `Keep the x-request-id header of the incoming requests instead of generating a new request ID.
+	The --request_id_header of the incoming requests is kept too, instead of being overwritten by the request ID.`)
+	AlwaysSetRequestIdInResponse = flag.Bool("always_set_request_id_in_response", false, "Return the request ID in the responses.")
+
 	LogJwtPayloads = flag.String("log_jwt_payloads", "", `Log corresponding JWT JSON payload primitive fields through service control, separated by comma. Example, when --log_jwt_payload=sub,project_id, log
 	will have jwt_payload: sub=[SUBJECT];project_id=[PROJECT_ID] if the fields are available. The value must be a primitive field, JSON objects and arrays will not be logged.`)
 	LogRequestHeaders = flag.String("log_request_headers", "", `Log corresponding request headers through service control, separated by comma. Example, when --log_request_headers=
 	foo,bar, endpoint log will have request_headers: foo=foo_value;bar=bar_value if values are available;`)
 	LogResponseHeaders = flag.String("log_response_headers", "", `Log corresponding response headers through service control, separated by comma. Example, when --log_response_headers=
 	foo,bar,endpoint log will have response_headers: foo=foo_value;bar=bar_value if values are available.`)
+	ScCustomLabels = flag.String("service_control_custom_labels", "", `Add static labels to service control Check and Report operations, separated by comma.
+	Example, when --service_control_custom_labels=env=prod,team=books, operations will have labels env=prod and team=books.`)
+	ScHeaderLabels = flag.String("service_control_header_labels", "", `Add labels from request headers to service control Check and Report operations, separated by comma.
+	Example, when --service_control_header_labels=tenant=x-tenant-id, operations will have label tenant with the value of header x-tenant-id if it is present.`)
+	TracingOperationSampleRates = flag.String("tracing_operation_sample_rates", "", `Override the tracing sample rate of operations, separated by comma.
+	Example, --tracing_operation_sample_rates=echo.v1.Echo.Health=0,echo.v1.Echo.Pay=1.0 never traces Health and always traces Pay.`)
+	TracingCustomTags = flag.String("tracing_custom_tags", "", `Add static tags to the trace spans, separated by comma.
+	Example, when --tracing_custom_tags=env=prod,team=books, spans will have tags env=prod and team=books.`)
+	TracingHeaderTags = flag.String("tracing_header_tags", "", `Add tags from request headers to the trace spans, separated by comma.
+	Example, when --tracing_header_tags=tenant=x-tenant-id, spans will have tag tenant with the value of header x-tenant-id if it is present.`)
+	TracingSpanNamePrefix = flag.String("tracing_span_name_prefix", util.SpanNamePrefix, `The prefix of the trace span names, used alone for the routes not serving an operation.`)
+	TracingSpanNameFormat = flag.String("tracing_span_name_format", options.DefaultTracingSpanNameFormat, `The format of the trace span names of the operations, with the
+	placeholders {PREFIX}, {API}, {METHOD} and {HTTP_METHOD}. Example, --tracing_span_name_format="{PREFIX} {HTTP_METHOD} {API}.{METHOD}"
+	names the spans "ingress GET echo.v1.Echo.Get".`)
+	TracingDisableDecorators = flag.Bool("tracing_disable_decorators", false, `If true, the routes have no span name and Envoy names the trace spans after the requests.`)
+
+	ScReportRedaction = flag.String("service_control_report_redaction", "", `Drop or hash request fields before they are reported through service control Report, separated by comma.
+	Each entry is FIELD=ACTION, where FIELD is one of "url_query", "client_ip", "referer" or "header:NAME" for a header in --log_request_headers,
+	and ACTION is one of "keep", "drop" or "hash" (hex encoded SHA-256). Example, --service_control_report_redaction=url_query=drop,client_ip=hash,header:user-agent=hash.
+	Check and Quota are not affected.`)
 	MinStreamReportIntervalMs = flag.Uint64("min_stream_report_interval_ms", 0, `Minimum amount of time (milliseconds) between sending intermediate reports on a stream and the default is 10000 if not set.`)
+	StreamIntermediateReports = flag.Bool("stream_intermediate_reports", false, `Send intermediate service control reports every --min_stream_report_interval_ms for streaming gRPC methods,
+	so that the byte counts of long lived streams are reported before they end.`)
 
 	SuppressEnvoyHeaders = flag.Bool("suppress_envoy_headers", true, `Do not add any additional x-envoy- headers to requests or responses. This only affects the router filter
 	generated *x-envoy-* headers, other Envoy filters and the HTTP connection manager may continue to set x-envoy- headers.`)
@@ -112,8 +330,14 @@ var (
 
 	ConnectionBufferLimitBytes = flag.Int("connection_buffer_limit_bytes", -1, `Configure the maximum amount of data that is buffered for each request/response body. 
 			If not provided, Envoy will decide the default value.`)
+	HttpBodyBufferLimitBytes = flag.Int("http_body_buffer_limit_bytes", -1, `Configure the maximum amount of data that is buffered for each request of the methods
+			whose request or response type is google.api.HttpBody, e.g. to allow large file uploads through gRPC-JSON transcoding.
+			If not provided or not positive, --connection_buffer_limit_bytes applies.`)
 
 	JwksCacheDurationInS = flag.Int("jwks_cache_duration_in_s", 300, "Specify JWT public key cache duration in seconds. The default is 5 minutes.")
+	JwksCacheDir         = flag.String("jwks_cache_dir", "", `If set, the JWKS documents and OpenID discovery results fetched when the config is generated are persisted in this directory.
+	The OpenID discovery reads through the cache. If the jwks_uri of a provider is unavailable, its cached JWKS is inlined in the config instead.`)
+	JwksCacheTtl = flag.Duration("jwks_cache_ttl", 24*time.Hour, "How long the entries of --jwks_cache_dir are used.")
 
 	ScCheckTimeoutMs  = flag.Int("service_control_check_timeout_ms", 0, `Set the timeout in millisecond for service control Check request. Must be > 0 and the default is 1000 if not set.`)
 	ScQuotaTimeoutMs  = flag.Int("service_control_quota_timeout_ms", 0, `Set the timeout in millisecond for service control Quota request. Must be > 0 and the default is 1000 if not set.`)
@@ -123,7 +347,42 @@ var (
 	ScQuotaRetries  = flag.Int("service_control_quota_retries", -1, `Set the retry times for service control Quota request. Must be >= 0 and the default is 1 if not set.`)
 	ScReportRetries = flag.Int("service_control_report_retries", -1, `Set the retry times for service control Report request. Must be >= 0 and the default is 5 if not set.`)
 
+	ScCheckCacheEntries      = flag.Int("service_control_check_cache_entries", 0, `Set the maximum number of cached service control Check responses. Must be > 0 and the default is 10000 if not set.`)
+	ScCheckCacheExpirationMs = flag.Int("service_control_check_cache_expiration_ms", 0, `Set the time in millisecond a cached service control Check response is used. Must be > 0 and the default is 300000 if not set.`)
+	ScApiKeyGracePeriodMs    = flag.Int("service_control_api_key_grace_period_ms", 0, `When service control Check is unavailable, accept API keys that were verified within this time in millisecond,
+	even if --service_control_network_fail_open is off. The verified API keys are kept in the memory of Envoy across the listener updates, and they are
+	persisted to --service_control_api_key_grace_cache_path if set. Disabled if not set.`)
+	ScApiKeyGraceCachePath = flag.String("service_control_api_key_grace_cache_path", "", `The file to persist the API keys verified for --service_control_api_key_grace_period_ms,
+	so the grace period covers them after an Envoy restart. Only the SHA-256 hashes of the API keys are written. If not set, the verified API keys are only kept in memory.`)
+	ScOperationOverrides = flag.String("service_control_operation_overrides", "", `Override the service control network fail policy, Check timeout and retries per operation.
+	The format is "SELECTOR=KEY:VALUE[,KEY:VALUE...][;SELECTOR=...]", where KEY is one of "network_fail_open", "check_timeout_ms" or "check_retries".
+	For example, "1.echo_api_endpoints_cloudesf_testing_cloud_goog.Echo=network_fail_open:false,check_timeout_ms:500".`)
+
+	CalloutPolicies = flag.String("callout_policies", "", `Override the timeout and retries of the calls to the control-plane dependencies, instead of --http_request_timeout_s for all of them.
+	The format is "CALLOUT=KEY:VALUE[,KEY:VALUE...][;CALLOUT=...]", where CALLOUT is one of "imds", "iam", "jwks", "openid_discovery" or "service_control",
+	and KEY is one of "timeout", "retries" or "retry_backoff". The timeouts also cap the connect timeouts of the clusters of the callouts.
+	Envoy retries the failed fetches of the tokens and of the JWKS on its own, so only the timeout of "imds", "iam" and "jwks" can be set.
+	The "service_control" retries are the default of the Check, Quota and Report retries. The "openid_discovery" retries wait for retry_backoff,
+	1s by default, doubled after each retry. For example, "jwks=timeout:5s;openid_discovery=timeout:2s,retries:3,retry_backoff:500ms".`)
+
+	ScSkipCheck = flag.Bool("service_control_skip_check", false, `Skip the service control Check call for all methods, while still sending the Report.
+	API keys are not validated, so the methods should be protected by JWT authentication.`)
+	ScSkipCheckSelectors = flag.String("service_control_skip_check_selectors", "", `Comma-separated selectors of the methods to skip the service control Check call for, while still sending the Report.`)
+
+	AuditMode = flag.Bool("audit_mode", false, `Only log and report the JWT authentication, API key and quota failures of all methods, and still forward the requests.
+	It allows rolling out new auth requirements on the existing traffic before enforcing them. The failures are logged by the
+	service control filter, so it requires a service config with a control environment.`)
+	AuditModeSelectors = flag.String("audit_mode_selectors", "", `Comma-separated selectors of the methods in audit mode, see --audit_mode.`)
+
+	QuotaCostHeaders = flag.String("quota_cost_headers", "", `Multiply the quota metric costs of an operation by the integer value of a request header, e.g. the number of items in a batch request.
+	The format is "SELECTOR=METRIC:HEADER[,METRIC:HEADER...][;SELECTOR=...]". The metric must be in the quota metric rule of the selector.
+	The metric cost is used as is if the header is missing or is not a positive integer, e.g. 0.`)
+
 	ComputePlatformOverride = flag.String("compute_platform_override", "", "the overridden platform where the proxy is running at")
+	GcpProjectIdOverride    = flag.String("gcp_project_id_override", "", "the project id reported to service control instead of the one of the metadata server")
+	GcpZoneOverride         = flag.String("gcp_zone_override", "", "the zone or region reported to service control instead of the one of the metadata server")
+	GcpAttributesFile       = flag.String("gcp_attributes_file", "", `a JSON file with the "projectId", "zone" and "platform" reported to service control instead of the
+	ones of the metadata server, e.g. on GKE on-prem or other clouds. The fields are overridden by the flags above`)
 
 	// Flags for testing purpose.
 	SkipJwtAuthnFilter       = flag.Bool("skip_jwt_authn_filter", false, "skip jwt authn filter, for test purpose")
@@ -133,7 +392,41 @@ var (
 	TranscodingAlwaysPrintEnumsAsInts       = flag.Bool("transcoding_always_print_enums_as_ints", false, "Whether to always print enums as ints for grpc-json transcoding")
 	TranscodingPreserveProtoFieldNames      = flag.Bool("transcoding_preserve_proto_field_names", false, "Whether to preserve proto field names for grpc-json transcoding")
 	TranscodingIgnoreQueryParameters        = flag.String("transcoding_ignore_query_parameters", "", "A list of query parameters(separated by comma) to be ignored for transcoding method mapping in grpc-json transcoding.")
-	TranscodingIgnoreUnknownQueryParameters = flag.Bool("transcoding_ignore_unknown_query_parameters", false, "Whether to ignore query parameters that cannot be mapped to a corresponding protobuf field in grpc-json transcoding.")
+	TranscodingIgnoreUnknownQueryParameters = flag.Bool("transcoding_ignore_unknown_query_parameters", false, "Whether to ignore query parameters that cannot be mapped to a corresponding protobuf field in grpc-json transcoding. By default, such requests are rejected.")
+	TranscodingQueryArrayStyle              = flag.String("transcoding_query_array_style", "repeat", `The query style of the repeated fields
+	in grpc-json transcoding, "repeat" or "brackets". With "repeat", the repeated fields are bound from "param=a&param=b".
+	With "brackets", they are bound from "param[]=a&param[]=b" too, as sent by the OpenAPI-generated clients: the "[]"
+	suffix is stripped from the names of the query parameters before transcoding. The nested fields are bound from
+	"obj.field=value" either way.`)
+	TranscodingProtoDescriptor = flag.String("transcoding_proto_descriptor", "", `A local file path or a gs://BUCKET/OBJECT uri of a serialized FileDescriptorSet for grpc-json transcoding.
+	If set, it is used instead of the proto descriptor in the service config, unless --transcoding_proto_descriptor_merge is set.`)
+	TranscodingProtoDescriptorMerge = flag.Bool("transcoding_proto_descriptor_merge", false, `Whether to merge --transcoding_proto_descriptor into the proto descriptor
+	in the service config instead of replacing it. Its proto files replace the ones of the same name in the service config.`)
+	TranscodingGrpcStatusHttpCodes = flag.String("transcoding_grpc_status_http_codes", "", `Comma-separated CODE:STATUS overriding the HTTP status codes of the
+	gRPC errors in grpc-json transcoding, e.g. "NOT_FOUND:410,FAILED_PRECONDITION:409". The gRPC status codes are either
+	names or numbers. The other gRPC errors keep their default HTTP status code. The error details of the
+	grpc-status-details-bin trailer are in the JSON body of the errors either way.`)
+	TranscodingOperationGrpcStatusHttpCodes = flag.String("transcoding_operation_grpc_status_http_codes", "", `The per-operation overrides of
+	--transcoding_grpc_status_http_codes, in the format "SELECTOR=CODE:STATUS[,CODE:STATUS...][;SELECTOR=...]", e.g.
+	"bookstore.Bookstore.GetBook=NOT_FOUND:404".`)
+	TranscodingValidateRequestBody = flag.Bool("transcoding_validate_request_body", false, `Whether to validate the JSON request bodies
+	of grpc-json transcoding against the message types of the service config: the JSON type of the values, the required
+	fields, the enum values and the range of the integers. The invalid requests get a 400 listing the invalid fields.`)
+	TranscodingRejectUnknownBodyFields = flag.Bool("transcoding_reject_unknown_body_fields", false, `Whether to reject the JSON request
+	bodies of grpc-json transcoding with fields not in their message type, at any depth. By default, the transcoder ignores them.`)
+	TranscodingBodyValidationOptOutSelectors = flag.String("transcoding_body_validation_opt_out_selectors", "", `Comma-separated
+	operations whose JSON request bodies are not validated by --transcoding_validate_request_body and
+	--transcoding_reject_unknown_body_fields.`)
+	TranscodingStreamFormats = flag.String("transcoding_stream_formats", "", `Comma-separated SELECTOR=ndjson|sse streaming the
+	server-streaming methods of grpc-json transcoding as newline delimited JSON (application/x-ndjson) or Server-Sent Events
+	(text/event-stream), message by message, instead of a single JSON array, e.g. "bookstore.Bookstore.ListBooks=sse".
+	The gRPC errors after the first message are sent as a last message. Like the other streaming methods, their routes
+	have no response timeout.`)
+	TranscodingOperationPrintOptions = flag.String("transcoding_operation_print_options", "", `The per-operation overrides of
+	--transcoding_always_print_primitive_fields, --transcoding_always_print_enums_as_ints and
+	--transcoding_preserve_proto_field_names, in the format "SELECTOR=OPTION:BOOL[,OPTION:BOOL...][;SELECTOR=...]",
+	e.g. "bookstore.Bookstore.GetBook=always_print_primitive_fields:true,preserve_proto_field_names:true".
+	OPTION is always_print_primitive_fields, always_print_enums_as_ints or preserve_proto_field_names.`)
 
 	BackendRetryOns = flag.String("backend_retry_ons", "reset,connect-failure,refused-stream",
 		`The conditions under which ESPv2 does retry on the backends. One or more
@@ -147,70 +440,226 @@ var (
 	BackendRetryNum = flag.Uint("backend_retry_num", 1,
 		`The allowed number of retries. Must be >= 0 and defaults to 1. This retry
 	setting will be applied to all the backends if you have multiple ones.`)
+
+	BackendHostRewrite = flag.String("backend_host_rewrite", "preserve",
+		`How the Host header of the requests to the local backend of --backend_address is rewritten. One of "preserve"
+	(the Host of the client), "backend_address" (the host and the non-default port of --backend_address) or "literal"
+	(the value of --backend_host_rewrite_literal). The remote backends of the backend rules always get their own host.`)
+	BackendHostRewriteLiteral = flag.String("backend_host_rewrite_literal", "",
+		`The Host header of the requests to the local backend with --backend_host_rewrite=literal.`)
+
+	PathRewriteQueryParams = flag.String("path_rewrite_query_params", "preserve",
+		`How the backends with path_translation CONSTANT_ADDRESS get the query parameters of the original
+	request, ahead of the path template variables. One of "preserve" (all of them), "merge" (except the ones named
+	after a path template variable) or "drop" (none of them).`)
+	PathRewriteOriginalPathHeader = flag.String("path_rewrite_original_path_header", "",
+		`If set, the backends with path_translation CONSTANT_ADDRESS get the original path of the request,
+	including its query parameters, in this request header. The header sent by the client is overwritten.`)
+
+	ForwardOriginalPath = flag.Bool("forward_original_path", false, `If true, the remote backends get the original path of the request in the
+	x-envoy-original-path header, e.g. to build the externally visible URL of pagination links.`)
+	ForwardOriginalHost = flag.Bool("forward_original_host", false, `If true, the remote backends get the original host of the request in the
+	x-forwarded-host header.`)
+	ForwardOriginalMethod = flag.Bool("forward_original_method", false, `If true, the remote backends get the original HTTP method of the request,
+	before x-http-method-override, in the x-envoy-original-method header.`)
+
+	StrictSelectorValidation = flag.Bool("strict_selector_validation", false, `If true, reject the service configs with usage, backend, authentication or
+	system parameter rules whose selector is not a method in apis.methods, e.g. because of a typo.`)
+
+	BackendAuthJwtAudienceTemplate = flag.String("backend_auth_jwt_audience_template", "",
+		`The audience used for backend authentication when a backend rule does not set jwt_audience.
+	The placeholders {scheme}, {hostname}, {path} and {service_name} are expanded from the backend
+	rule address and the service config, e.g. "https://{hostname}{path}" gives a different audience to
+	each backend path on the same hostname. If unset, the audience is "{scheme}://{hostname}".`)
 )
 
 func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 	opts := options.ConfigGeneratorOptions{
-		CommonOptions:                           commonflags.DefaultCommonOptionsFromFlags(),
-		BackendAddress:                          *BackendAddress,
-		AccessLog:                               *AccessLog,
-		AccessLogFormat:                         *AccessLogFormat,
-		ComputePlatformOverride:                 *ComputePlatformOverride,
-		CorsAllowCredentials:                    *CorsAllowCredentials,
-		CorsAllowHeaders:                        *CorsAllowHeaders,
-		CorsAllowMethods:                        *CorsAllowMethods,
-		CorsAllowOrigin:                         *CorsAllowOrigin,
-		CorsAllowOriginRegex:                    *CorsAllowOriginRegex,
-		CorsExposeHeaders:                       *CorsExposeHeaders,
-		CorsPreset:                              *CorsPreset,
-		BackendDnsLookupFamily:                  *BackendDnsLookupFamily,
-		ClusterConnectTimeout:                   *ClusterConnectTimeout,
-		ListenerAddress:                         *ListenerAddress,
-		ServiceManagementURL:                    *ServiceManagementURL,
-		ServiceControlURL:                       *ServiceControlURL,
-		ListenerPort:                            *ListenerPort,
-		Healthz:                                 *Healthz,
-		SslSidestreamClientRootCertsPath:        *SslSidestreamClientRootCertsPath,
-		SslBackendClientCertPath:                *SslBackendClientCertPath,
-		SslBackendClientRootCertsPath:           *SslBackendClientRootCertsPath,
-		SslBackendClientCipherSuites:            *SslBackendClientCipherSuites,
-		SslServerCertPath:                       *SslServerCertPath,
-		SslServerCipherSuites:                   *SslServerCipherSuites,
-		SslMinimumProtocol:                      *SslMinimumProtocol,
-		SslMaximumProtocol:                      *SslMaximumProtocol,
-		EnableHSTS:                              *EnableHSTS,
-		DnsResolverAddresses:                    *DnsResolverAddresses,
-		ServiceAccountKey:                       *ServiceAccountKey,
-		TokenAgentPort:                          *TokenAgentPort,
-		DisableOidcDiscovery:                    *DisableOidcDiscovery,
-		DependencyErrorBehavior:                 *DependencyErrorBehavior,
-		SkipJwtAuthnFilter:                      *SkipJwtAuthnFilter,
-		SkipServiceControlFilter:                *SkipServiceControlFilter,
-		EnvoyUseRemoteAddress:                   *EnvoyUseRemoteAddress,
-		EnvoyXffNumTrustedHops:                  *EnvoyXffNumTrustedHops,
-		LogJwtPayloads:                          *LogJwtPayloads,
-		LogRequestHeaders:                       *LogRequestHeaders,
-		LogResponseHeaders:                      *LogResponseHeaders,
-		MinStreamReportIntervalMs:               *MinStreamReportIntervalMs,
-		SuppressEnvoyHeaders:                    *SuppressEnvoyHeaders,
-		UnderscoresInHeaders:                    *UnderscoresInHeaders,
-		ServiceControlNetworkFailOpen:           *ServiceControlNetworkFailOpen,
-		EnableGrpcForHttp1:                      *EnableGrpcForHttp1,
-		ConnectionBufferLimitBytes:              *ConnectionBufferLimitBytes,
-		JwksCacheDurationInS:                    *JwksCacheDurationInS,
-		BackendRetryOns:                         *BackendRetryOns,
-		BackendRetryNum:                         *BackendRetryNum,
-		ScCheckTimeoutMs:                        *ScCheckTimeoutMs,
-		ScQuotaTimeoutMs:                        *ScQuotaTimeoutMs,
-		ScReportTimeoutMs:                       *ScReportTimeoutMs,
-		ScCheckRetries:                          *ScCheckRetries,
-		ScQuotaRetries:                          *ScQuotaRetries,
-		ScReportRetries:                         *ScReportRetries,
-		TranscodingAlwaysPrintPrimitiveFields:   *TranscodingAlwaysPrintPrimitiveFields,
-		TranscodingAlwaysPrintEnumsAsInts:       *TranscodingAlwaysPrintEnumsAsInts,
-		TranscodingPreserveProtoFieldNames:      *TranscodingPreserveProtoFieldNames,
-		TranscodingIgnoreQueryParameters:        *TranscodingIgnoreQueryParameters,
-		TranscodingIgnoreUnknownQueryParameters: *TranscodingIgnoreUnknownQueryParameters,
+		CommonOptions:                            commonflags.DefaultCommonOptionsFromFlags(),
+		BackendAddress:                           *BackendAddress,
+		AccessLog:                                *AccessLog,
+		AccessLogFormat:                          *AccessLogFormat,
+		AccessLogJsonFormat:                      *AccessLogJsonFormat,
+		AccessLogMinStatusCode:                   *AccessLogMinStatusCode,
+		AccessLogServiceAddress:                  *AccessLogServiceAddress,
+		AccessLogServiceBufferSizeBytes:          *AccessLogServiceBufferSizeBytes,
+		AccessLogServiceBufferFlushInterval:      *AccessLogServiceBufferFlushInterval,
+		AccessLogServiceRequestHeaders:           *AccessLogServiceRequestHeaders,
+		AccessLogServiceResponseHeaders:          *AccessLogServiceResponseHeaders,
+		AuditLog:                                 *AuditLog,
+		AuditLogToAccessLogService:               *AuditLogToAccessLogService,
+		PrometheusMetricsPort:                    *PrometheusMetricsPort,
+		PrometheusMetricsAddress:                 *PrometheusMetricsAddress,
+		PrometheusStatsFilter:                    *PrometheusStatsFilter,
+		LocalReplyJsonFormat:                     *LocalReplyJsonFormat,
+		LocalReplyIncludeDetails:                 *LocalReplyIncludeDetails,
+		LocalReplyErrorInfoDomain:                *LocalReplyErrorInfoDomain,
+		LocalReplyErrorInfoMetadata:              *LocalReplyErrorInfoMetadata,
+		LocalReplyHelpUrl:                        *LocalReplyHelpUrl,
+		ComputePlatformOverride:                  *ComputePlatformOverride,
+		GcpProjectIdOverride:                     *GcpProjectIdOverride,
+		GcpZoneOverride:                          *GcpZoneOverride,
+		GcpAttributesFile:                        *GcpAttributesFile,
+		CorsAllowCredentials:                     *CorsAllowCredentials,
+		CorsAllowHeaders:                         *CorsAllowHeaders,
+		CorsAllowMethods:                         *CorsAllowMethods,
+		CorsAllowOrigin:                          *CorsAllowOrigin,
+		CorsAllowOriginRegex:                     *CorsAllowOriginRegex,
+		CorsExposeHeaders:                        *CorsExposeHeaders,
+		CorsPreset:                               *CorsPreset,
+		CorsMaxAge:                               *CorsMaxAge,
+		CorsAllowPrivateNetwork:                  *CorsAllowPrivateNetwork,
+		CorsReflectRequestHeaders:                *CorsReflectRequestHeaders,
+		CorsPreflightDirectResponse:              *CorsPreflightDirectResponse,
+		BackendDnsLookupFamily:                   *BackendDnsLookupFamily,
+		ClusterConnectTimeout:                    *ClusterConnectTimeout,
+		ListenerAddress:                          *ListenerAddress,
+		ServiceManagementURL:                     *ServiceManagementURL,
+		ServiceControlURL:                        *ServiceControlURL,
+		BackendConsumerHeaders:                   *BackendConsumerHeaders,
+		ListenerPort:                             *ListenerPort,
+		Healthz:                                  *Healthz,
+		HealthzMode:                              *HealthzMode,
+		HealthzGrpcService:                       *HealthzGrpcService,
+		EnableGrpcHealthPassthrough:              *EnableGrpcHealthPassthrough,
+		SslSidestreamClientRootCertsPath:         *SslSidestreamClientRootCertsPath,
+		SslBackendClientCertPath:                 *SslBackendClientCertPath,
+		SslBackendClientRootCertsPath:            *SslBackendClientRootCertsPath,
+		SslBackendClientCipherSuites:             *SslBackendClientCipherSuites,
+		SslServerCertPath:                        *SslServerCertPath,
+		SslServerCipherSuites:                    *SslServerCipherSuites,
+		AcmeDomains:                              *AcmeDomains,
+		AcmeHttpPort:                             *AcmeHttpPort,
+		SslMinimumProtocol:                       *SslMinimumProtocol,
+		SslMaximumProtocol:                       *SslMaximumProtocol,
+		EnableHSTS:                               *EnableHSTS,
+		DnsResolverAddresses:                     *DnsResolverAddresses,
+		ServiceAccountKey:                        *ServiceAccountKey,
+		TokenAgentPort:                           *TokenAgentPort,
+		ConfigManagerDebugPort:                   *ConfigManagerDebugPort,
+		ConfigManagerReadinessPort:               *ConfigManagerReadinessPort,
+		EnableRouteDebugHeaders:                  *EnableRouteDebugHeaders,
+		EnableOperationVirtualClusters:           *EnableOperationVirtualClusters,
+		MaintenanceSelectors:                     *MaintenanceSelectors,
+		MaintenanceStatusCode:                    *MaintenanceStatusCode,
+		MaintenanceRetryAfter:                    *MaintenanceRetryAfter,
+		ResponseCacheSelectors:                   *ResponseCacheSelectors,
+		ResponseCacheTtl:                         *ResponseCacheTtl,
+		ResponseCacheKeyQueryParams:              *ResponseCacheKeyQueryParams,
+		ResponseCacheKeyHeaders:                  *ResponseCacheKeyHeaders,
+		EtagSelectors:                            *EtagSelectors,
+		EtagMaxBodyBytes:                         *EtagMaxBodyBytes,
+		IdempotencySelectors:                     *IdempotencySelectors,
+		IdempotencyKeyHeader:                     *IdempotencyKeyHeader,
+		IdempotencyTtl:                           *IdempotencyTtl,
+		RateLimitTiers:                           *RateLimitTiers,
+		RateLimitConsumerTiers:                   *RateLimitConsumerTiers,
+		RateLimitDefaultTier:                     *RateLimitDefaultTier,
+		RateLimitServiceAddress:                  *RateLimitServiceAddress,
+		ConcurrencyLimits:                        *ConcurrencyLimits,
+		SpikeArrestRps:                           *SpikeArrestRps,
+		SpikeArrestBurst:                         *SpikeArrestBurst,
+		DenyUserAgents:                           *DenyUserAgents,
+		DenyPaths:                                *DenyPaths,
+		UploadBackendAddress:                     *UploadBackendAddress,
+		UploadSizeThresholds:                     *UploadSizeThresholds,
+		HonorGrpcTimeoutHeader:                   *HonorGrpcTimeoutHeader,
+		QueryParamMatchers:                       *QueryParamMatchers,
+		EnableRds:                                *EnableRds,
+		ForceRegexRouteMatch:                     *ForceRegexRouteMatch,
+		ApiVersionHeader:                         *ApiVersionHeader,
+		ApiBasePath:                              *ApiBasePath,
+		DeterministicOutput:                      *DeterministicOutput,
+		DisableOidcDiscovery:                     *DisableOidcDiscovery,
+		OpenIDDiscoveryBudget:                    *OpenIDDiscoveryBudget,
+		DeferOpenIDDiscovery:                     *DeferOpenIDDiscovery,
+		DependencyErrorBehavior:                  *DependencyErrorBehavior,
+		ApiKeyLocations:                          *ApiKeyLocations,
+		JwtCallerAllowlist:                       *JwtCallerAllowlist,
+		DisabledFilters:                          *DisabledFilters,
+		SkipJwtAuthnFilter:                       *SkipJwtAuthnFilter,
+		SkipServiceControlFilter:                 *SkipServiceControlFilter,
+		EnvoyUseRemoteAddress:                    *EnvoyUseRemoteAddress,
+		EnvoyXffNumTrustedHops:                   *EnvoyXffNumTrustedHops,
+		LogFormat:                                *LogFormat,
+		RequestIdHeader:                          *RequestIdHeader,
+		PreserveExternalRequestId:                *PreserveExternalRequestId,
+		AlwaysSetRequestIdInResponse:             *AlwaysSetRequestIdInResponse,
+		LogJwtPayloads:                           *LogJwtPayloads,
+		LogRequestHeaders:                        *LogRequestHeaders,
+		LogResponseHeaders:                       *LogResponseHeaders,
+		MinStreamReportIntervalMs:                *MinStreamReportIntervalMs,
+		StreamIntermediateReports:                *StreamIntermediateReports,
+		ScCustomLabels:                           *ScCustomLabels,
+		ScHeaderLabels:                           *ScHeaderLabels,
+		TracingOperationSampleRates:              *TracingOperationSampleRates,
+		TracingCustomTags:                        *TracingCustomTags,
+		TracingSpanNamePrefix:                    *TracingSpanNamePrefix,
+		TracingSpanNameFormat:                    *TracingSpanNameFormat,
+		TracingDisableDecorators:                 *TracingDisableDecorators,
+		TracingHeaderTags:                        *TracingHeaderTags,
+		ScReportRedaction:                        *ScReportRedaction,
+		SuppressEnvoyHeaders:                     *SuppressEnvoyHeaders,
+		UnderscoresInHeaders:                     *UnderscoresInHeaders,
+		ServiceControlNetworkFailOpen:            *ServiceControlNetworkFailOpen,
+		EnableGrpcForHttp1:                       *EnableGrpcForHttp1,
+		ConnectionBufferLimitBytes:               *ConnectionBufferLimitBytes,
+		HttpBodyBufferLimitBytes:                 *HttpBodyBufferLimitBytes,
+		JwksCacheDurationInS:                     *JwksCacheDurationInS,
+		JwksCacheDir:                             *JwksCacheDir,
+		JwksCacheTtl:                             *JwksCacheTtl,
+		BackendRetryOns:                          *BackendRetryOns,
+		BackendRetryNum:                          *BackendRetryNum,
+		PathRewriteQueryParams:                   *PathRewriteQueryParams,
+		BackendHostRewrite:                       *BackendHostRewrite,
+		BackendHostRewriteLiteral:                *BackendHostRewriteLiteral,
+		PathRewriteOriginalPathHeader:            *PathRewriteOriginalPathHeader,
+		ForwardOriginalPath:                      *ForwardOriginalPath,
+		ForwardOriginalHost:                      *ForwardOriginalHost,
+		ForwardOriginalMethod:                    *ForwardOriginalMethod,
+		StrictSelectorValidation:                 *StrictSelectorValidation,
+		BackendAuthJwtAudienceTemplate:           *BackendAuthJwtAudienceTemplate,
+		ScCheckTimeoutMs:                         *ScCheckTimeoutMs,
+		ScQuotaTimeoutMs:                         *ScQuotaTimeoutMs,
+		ScReportTimeoutMs:                        *ScReportTimeoutMs,
+		ScCheckRetries:                           *ScCheckRetries,
+		ScQuotaRetries:                           *ScQuotaRetries,
+		ScReportRetries:                          *ScReportRetries,
+		ScCheckCacheEntries:                      *ScCheckCacheEntries,
+		ScCheckCacheExpirationMs:                 *ScCheckCacheExpirationMs,
+		ScApiKeyGracePeriodMs:                    *ScApiKeyGracePeriodMs,
+		ScApiKeyGraceCachePath:                   *ScApiKeyGraceCachePath,
+		ScOperationOverrides:                     *ScOperationOverrides,
+		CalloutPolicies:                          *CalloutPolicies,
+		QuotaCostHeaders:                         *QuotaCostHeaders,
+		ScSkipCheck:                              *ScSkipCheck,
+		ScSkipCheckSelectors:                     *ScSkipCheckSelectors,
+		AuditMode:                                *AuditMode,
+		AuditModeSelectors:                       *AuditModeSelectors,
+		TranscodingAlwaysPrintPrimitiveFields:    *TranscodingAlwaysPrintPrimitiveFields,
+		TranscodingAlwaysPrintEnumsAsInts:        *TranscodingAlwaysPrintEnumsAsInts,
+		TranscodingPreserveProtoFieldNames:       *TranscodingPreserveProtoFieldNames,
+		TranscodingIgnoreQueryParameters:         *TranscodingIgnoreQueryParameters,
+		TranscodingIgnoreUnknownQueryParameters:  *TranscodingIgnoreUnknownQueryParameters,
+		TranscodingQueryArrayStyle:               *TranscodingQueryArrayStyle,
+		TranscodingProtoDescriptor:               *TranscodingProtoDescriptor,
+		TranscodingProtoDescriptorMerge:          *TranscodingProtoDescriptorMerge,
+		TranscodingGrpcStatusHttpCodes:           *TranscodingGrpcStatusHttpCodes,
+		TranscodingOperationGrpcStatusHttpCodes:  *TranscodingOperationGrpcStatusHttpCodes,
+		TranscodingValidateRequestBody:           *TranscodingValidateRequestBody,
+		TranscodingRejectUnknownBodyFields:       *TranscodingRejectUnknownBodyFields,
+		TranscodingBodyValidationOptOutSelectors: *TranscodingBodyValidationOptOutSelectors,
+		TranscodingStreamFormats:                 *TranscodingStreamFormats,
+		TranscodingOperationPrintOptions:         *TranscodingOperationPrintOptions,
+	}
+	if *ImpersonateServiceAccount != "" {
+		chain := strings.Split(*ImpersonateServiceAccount, ",")
+		opts.ImpersonateServiceAccount = strings.TrimSpace(chain[0])
+		for _, delegate := range chain[1:] {
+			if delegate = strings.TrimSpace(delegate); delegate != "" {
+				opts.ImpersonateServiceAccountDelegates = append(opts.ImpersonateServiceAccountDelegates, delegate)
+			}
+		}
 	}
 
 	glog.Infof("Config Generator options: %+v", opts)
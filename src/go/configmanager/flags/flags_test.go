@@ -30,3 +30,38 @@ func TestDefaultEnvoyConfigOptions(t *testing.T) {
 			defaultOptions, actualOptions)
 	}
 }
+
+func TestImpersonateServiceAccountFlag(t *testing.T) {
+	testData := []struct {
+		desc          string
+		flagValue     string
+		wantAccount   string
+		wantDelegates []string
+	}{
+		{
+			desc:        "service account without delegates",
+			flagValue:   "proxy@project.iam.gserviceaccount.com",
+			wantAccount: "proxy@project.iam.gserviceaccount.com",
+		},
+		{
+			desc:          "service account with a delegation chain",
+			flagValue:     "proxy@project.iam.gserviceaccount.com, delegate-1@project.iam.gserviceaccount.com,delegate-2@project.iam.gserviceaccount.com",
+			wantAccount:   "proxy@project.iam.gserviceaccount.com",
+			wantDelegates: []string{"delegate-1@project.iam.gserviceaccount.com", "delegate-2@project.iam.gserviceaccount.com"},
+		},
+	}
+
+	defer func() { *ImpersonateServiceAccount = "" }()
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			*ImpersonateServiceAccount = tc.flagValue
+			opts := EnvoyConfigOptionsFromFlags()
+			if opts.ImpersonateServiceAccount != tc.wantAccount {
+				t.Errorf("want impersonated service account %q, get %q", tc.wantAccount, opts.ImpersonateServiceAccount)
+			}
+			if !reflect.DeepEqual(opts.ImpersonateServiceAccountDelegates, tc.wantDelegates) {
+				t.Errorf("want delegates %v, get %v", tc.wantDelegates, opts.ImpersonateServiceAccountDelegates)
+			}
+		})
+	}
+}
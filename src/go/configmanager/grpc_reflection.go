@@ -0,0 +1,98 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig/grpcreflection"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// The interval to retry the reflection service of a backend still starting.
+var grpcReflectionRetryInterval = time.Second
+
+// fetchAndApplyServiceConfigFromReflection synthesizes the service config of
+// the gRPC backend from its reflection service, and applies it. --service
+// names the service, defaulting to the backend host.
+func (m *ConfigManager) fetchAndApplyServiceConfigFromReflection(timeout time.Duration) error {
+	scheme, hostname, port, _, err := util.ParseURI(m.envoyConfigOptions.BackendAddress)
+	if err != nil {
+		return fmt.Errorf("invalid --backend_address: %v", err)
+	}
+	protocol, useTLS, err := util.ParseBackendProtocol(scheme, "")
+	if err != nil {
+		return fmt.Errorf("invalid --backend_address: %v", err)
+	}
+	if protocol != util.GRPC {
+		return fmt.Errorf("--grpc_reflection requires a grpc:// or grpcs:// --backend_address, got %s", m.envoyConfigOptions.BackendAddress)
+	}
+
+	serviceName := *ServiceName
+	if serviceName == "" {
+		serviceName = hostname
+	}
+	serviceConfig, err := fetchServiceConfigFromReflection(fmt.Sprintf("%s:%d", hostname, port), useTLS, serviceName, timeout)
+	if err != nil {
+		return err
+	}
+	if serviceConfig.GetId() == m.curConfigId() {
+		return nil
+	}
+
+	m.serviceName = serviceName
+	m.logger.Event(severityInfo, "config_fetched", "synthesized service config from the gRPC backend reflection service", map[string]interface{}{
+		"service":   serviceName,
+		"config_id": serviceConfig.GetId(),
+	})
+	return m.applyServiceConfig(serviceConfig)
+}
+
+// fetchServiceConfigFromReflection retries the reflection service of the
+// backend until it responds or the timeout expires, e.g. while the backend
+// starts along with the proxy.
+func fetchServiceConfigFromReflection(address string, useTLS bool, serviceName string, timeout time.Duration) (*confpb.Service, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creds := grpc.WithInsecure()
+	if useTLS {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+	conn, err := grpc.DialContext(ctx, address, creds)
+	if err != nil {
+		return nil, fmt.Errorf("fail to connect to the gRPC backend %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	for {
+		serviceConfig, err := grpcreflection.FetchServiceConfig(ctx, conn, serviceName)
+		if err == nil {
+			return serviceConfig, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("fail to synthesize the service config from the gRPC backend %s in %v: %v", address, timeout, err)
+		case <-time.After(grpcReflectionRetryInterval):
+		}
+	}
+}
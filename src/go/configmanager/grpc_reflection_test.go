@@ -0,0 +1,111 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+
+	bookstorepb "github.com/GoogleCloudPlatform/esp-v2/tests/endpoints/bookstore_grpc/proto/v1"
+)
+
+func TestFetchAndApplyServiceConfigFromReflection(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	bookstorepb.RegisterBookstoreServer(server, &bookstorepb.UnimplementedBookstoreServer{})
+	reflection.Register(server)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	defer server.Stop()
+
+	// A port nothing listens on.
+	closedLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := closedLis.Addr().String()
+	closedLis.Close()
+
+	grpcReflectionRetryInterval = 10 * time.Millisecond
+	defer func() {
+		grpcReflectionRetryInterval = time.Second
+	}()
+
+	testData := []struct {
+		desc           string
+		backendAddress string
+		wantError      string
+	}{
+		{
+			desc:           "service config synthesized from the backend",
+			backendAddress: "grpc://" + lis.Addr().String(),
+		},
+		{
+			desc:           "http backend",
+			backendAddress: "http://" + lis.Addr().String(),
+			wantError:      "--grpc_reflection requires a grpc:// or grpcs:// --backend_address",
+		},
+		{
+			desc:           "backend not reachable",
+			backendAddress: "grpc://" + closedAddress,
+			wantError:      "fail to synthesize the service config from the gRPC backend",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = tc.backendAddress
+		opts.DisableTracing = true
+		logger, err := newStructuredLogger(opts.LogFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &ConfigManager{envoyConfigOptions: opts, logger: logger}
+		m.cache = cache.NewSnapshotCache(true, m, m)
+
+		err = m.fetchAndApplyServiceConfigFromReflection(200 * time.Millisecond)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+
+		if m.serviceName != "127.0.0.1" {
+			t.Errorf("Test (%s): want the service named by the backend host, get %s", tc.desc, m.serviceName)
+		}
+		if _, ok := m.serviceInfo.Methods["endpoints.examples.bookstore.Bookstore.ListShelves"]; !ok {
+			t.Errorf("Test (%s): want the method ListShelves, get %v", tc.desc, m.serviceInfo.Operations)
+		}
+		if m.appliedSnapshot == nil {
+			t.Errorf("Test (%s): want the service config applied", tc.desc)
+		}
+	}
+}
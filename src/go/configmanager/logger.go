@@ -0,0 +1,151 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Log severities, named as in Cloud Logging.
+const (
+	severityDebug   = "DEBUG"
+	severityInfo    = "INFO"
+	severityWarning = "WARNING"
+	severityError   = "ERROR"
+)
+
+// Components of the config manager logs.
+const (
+	componentConfigManager = "configmanager"
+	componentXdsCache      = "xds_cache"
+)
+
+// structuredLogger writes the config manager logs either through glog, or as
+// one JSON object per line so they can be ingested into Cloud Logging.
+type structuredLogger struct {
+	json bool
+
+	mu  sync.Mutex
+	out io.Writer
+	now func() time.Time
+}
+
+// newStructuredLogger creates a logger for the log format, one of "text" or
+// "json".
+func newStructuredLogger(format string) (*structuredLogger, error) {
+	switch format {
+	case "", "text":
+		return &structuredLogger{}, nil
+	case "json":
+		return &structuredLogger{
+			json: true,
+			out:  os.Stderr,
+			now:  time.Now,
+		}, nil
+	default:
+		return nil, fmt.Errorf(`invalid log format %q, must be one of "text" or "json"`, format)
+	}
+}
+
+// log writes the event with its fields. The debug logs are only written with
+// --v=1 or above.
+func (l *structuredLogger) log(severity, component, event, message string, fields map[string]interface{}) {
+	if severity == severityDebug && !glog.V(1) {
+		return
+	}
+
+	if !l.json {
+		l.logText(severity, event, message, fields)
+		return
+	}
+
+	entry := map[string]interface{}{
+		"time":      l.now().UTC().Format(time.RFC3339Nano),
+		"severity":  severity,
+		"component": component,
+		"message":   message,
+	}
+	if event != "" {
+		entry["event"] = event
+	}
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		glog.Errorf("fail to marshal log entry %v: %v", entry, err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.out, string(line))
+}
+
+func (l *structuredLogger) logText(severity, event, message string, fields map[string]interface{}) {
+	if event != "" || len(fields) != 0 {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var b strings.Builder
+		b.WriteString(message)
+		if event != "" {
+			fmt.Fprintf(&b, " event=%s", event)
+		}
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%v", k, fields[k])
+		}
+		message = b.String()
+	}
+
+	switch severity {
+	case severityError:
+		glog.Error(message)
+	case severityWarning:
+		glog.Warning(message)
+	default:
+		glog.Info(message)
+	}
+}
+
+func (l *structuredLogger) Infof(format string, args ...interface{}) {
+	l.log(severityInfo, componentConfigManager, "", fmt.Sprintf(format, args...), nil)
+}
+
+func (l *structuredLogger) Errorf(format string, args ...interface{}) {
+	l.log(severityError, componentConfigManager, "", fmt.Sprintf(format, args...), nil)
+}
+
+// Event logs a config manager event, e.g. a config fetch or rollout, with
+// the fields identifying it.
+func (l *structuredLogger) Event(severity, event, message string, fields map[string]interface{}) {
+	l.log(severity, componentConfigManager, event, message, fields)
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+)
+
+func TestStructuredLoggerJsonFormat(t *testing.T) {
+	testData := []struct {
+		desc      string
+		severity  string
+		component string
+		event     string
+		message   string
+		fields    map[string]interface{}
+		want      string
+	}{
+		{
+			desc:      "event with fields",
+			severity:  severityInfo,
+			component: componentConfigManager,
+			event:     "config_applied",
+			message:   "applied service config",
+			fields: map[string]interface{}{
+				"service":   "bookstore.endpoints.project123.cloud.goog",
+				"config_id": "2017-05-01r0",
+			},
+			want: `{
+				"time": "2020-06-01T10:00:00Z",
+				"severity": "INFO",
+				"component": "configmanager",
+				"event": "config_applied",
+				"message": "applied service config",
+				"service": "bookstore.endpoints.project123.cloud.goog",
+				"config_id": "2017-05-01r0"
+			}`,
+		},
+		{
+			desc:      "error field is written as string",
+			severity:  severityError,
+			component: componentConfigManager,
+			event:     "rollout_fetch_failed",
+			message:   "error occurred when getting configId by fetching rollout",
+			fields: map[string]interface{}{
+				"error": fmt.Errorf("connection refused"),
+			},
+			want: `{
+				"time": "2020-06-01T10:00:00Z",
+				"severity": "ERROR",
+				"component": "configmanager",
+				"event": "rollout_fetch_failed",
+				"message": "error occurred when getting configId by fetching rollout",
+				"error": "connection refused"
+			}`,
+		},
+		{
+			desc:      "message without event",
+			severity:  severityWarning,
+			component: componentXdsCache,
+			message:   "stream closed",
+			want: `{
+				"time": "2020-06-01T10:00:00Z",
+				"severity": "WARNING",
+				"component": "xds_cache",
+				"message": "stream closed"
+			}`,
+		},
+		{
+			desc:      "debug log is skipped by default",
+			severity:  severityDebug,
+			component: componentXdsCache,
+			message:   "respond open watch",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			logger, err := newStructuredLogger("json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			logger.out = &out
+			logger.now = func() time.Time {
+				return time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+			}
+
+			logger.log(tc.severity, tc.component, tc.event, tc.message, tc.fields)
+
+			if tc.want == "" {
+				if out.Len() != 0 {
+					t.Errorf("got log: %s, want no log", out.String())
+				}
+				return
+			}
+			if err := util.JsonEqual(tc.want, out.String()); err != nil {
+				t.Errorf("got unexpected log: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewStructuredLogger(t *testing.T) {
+	testData := []struct {
+		format    string
+		wantJson  bool
+		wantError string
+	}{
+		{
+			format: "",
+		},
+		{
+			format: "text",
+		},
+		{
+			format:   "json",
+			wantJson: true,
+		},
+		{
+			format:    "yaml",
+			wantError: `invalid log format "yaml", must be one of "text" or "json"`,
+		},
+	}
+
+	for _, tc := range testData {
+		logger, err := newStructuredLogger(tc.format)
+		if err != nil {
+			if err.Error() != tc.wantError {
+				t.Errorf("format %q: got error: %v, want error: %v", tc.format, err, tc.wantError)
+			}
+			continue
+		}
+		if tc.wantError != "" {
+			t.Errorf("format %q: got no error, want error: %v", tc.format, tc.wantError)
+			continue
+		}
+		if logger.json != tc.wantJson {
+			t.Errorf("format %q: got json: %v, want: %v", tc.format, logger.json, tc.wantJson)
+		}
+	}
+}
@@ -24,19 +24,26 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/commonflags"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/flags"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/tokengenerator"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
 
 	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
-	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 )
 
 func main() {
 	flag.Parse()
+	if err := commonflags.ApplyEnvironment(); err != nil {
+		glog.Exitf("fail to apply environment variables: %v", err)
+	}
+	if err := flags.ApplyConfigFile(); err != nil {
+		glog.Exitf("fail to apply config file: %v", err)
+	}
 	opts := flags.EnvoyConfigOptionsFromFlags()
 
 	// Create context that allows cancellation.
@@ -44,7 +51,7 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	var mf *metadata.MetadataFetcher
-	if !opts.NonGCP {
+	if !opts.NonGCP && util.IsGCPMetadataProvider(opts.MetadataProvider) {
 		glog.Info("running on GCP, initializing metadata fetcher")
 		mf = metadata.NewMetadataFetcher(opts.CommonOptions)
 	}
@@ -53,7 +60,10 @@ func main() {
 	if err != nil {
 		glog.Exitf("fail to initialize config manager: %v", err)
 	}
-	server := xds.NewServer(ctx, m.Cache(), nil)
+	if opts.AcmeDomains != "" {
+		go m.RunAcme(ctx)
+	}
+	server := m.NewAdsServer(ctx)
 	grpcServer := grpc.NewServer()
 	lis, err := net.Listen("unix", opts.AdsNamedPipe)
 	if err != nil {
@@ -72,15 +82,29 @@ func main() {
 	go func() {
 		sig := <-signalChan
 		glog.Warningf("Server got signal %v, stopping", sig)
+		// Keep serving the xDS resources while Envoy drains.
+		if sig == syscall.SIGTERM && *configmanager.DrainTimeout > 0 {
+			if err := m.DrainEnvoy(*configmanager.DrainTimeout); err != nil {
+				glog.Errorf("fail to drain envoy: %v", err)
+			}
+		}
 		cancel()
 		grpcServer.Stop()
 	}()
 
-	if opts.ServiceAccountKey != "" {
+	var tokenAgentHandler http.Handler
+	if opts.UsesTokenAgent() {
+		accessToken, identityToken, err := tokengenerator.MakeTokenFuncs(opts)
+		if err != nil {
+			glog.Exitf("fail to initialize the token agent: %v", err)
+		}
+		tokenAgentHandler = tokengenerator.MakeTokenAgentHandlerFromTokenFuncs(accessToken, identityToken)
+	}
+
+	if tokenAgentHandler != nil {
 		// Setup token agent server
-		r := tokengenerator.MakeTokenAgentHandler(opts.ServiceAccountKey)
 		go func() {
-			err := http.ListenAndServe(fmt.Sprintf(":%v", opts.TokenAgentPort), r)
+			err := http.ListenAndServe(fmt.Sprintf(":%v", opts.TokenAgentPort), tokenAgentHandler)
 
 			if err != nil {
 				glog.Errorf("token agent fail to serve: %v", err)
@@ -90,6 +114,26 @@ func main() {
 
 	}
 
+	if opts.ConfigManagerDebugPort != 0 {
+		// Setup debug server, only reachable on loopback.
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("localhost:%v", opts.ConfigManagerDebugPort), m.DebugHandler())
+			if err != nil {
+				glog.Errorf("debug server fail to serve: %v", err)
+			}
+		}()
+	}
+
+	if opts.ConfigManagerReadinessPort != 0 {
+		// Setup readiness server, reachable by the readiness probes.
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%v", opts.ConfigManagerReadinessPort), m.ReadinessHandler())
+			if err != nil {
+				glog.Errorf("readiness server fail to serve: %v", err)
+			}
+		}()
+	}
+
 	if err := grpcServer.Serve(lis); err != nil {
 		glog.Exitf("Server fail to serve: %v", err)
 	}
@@ -0,0 +1,141 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+const metricsPath = "/metrics"
+
+// configMetrics are the metrics of the config translation, served in the
+// Prometheus text format on the readiness endpoint. The gauges describe the
+// last generated config.
+type configMetrics struct {
+	mu                 sync.Mutex
+	operations         int
+	routes             int
+	clusters           int
+	listeners          int
+	snapshotBytes      int
+	generationDuration time.Duration
+	generations        int
+	generationFailures int
+	pollFailures       int
+}
+
+// recordGeneration records a config generated in duration from the service
+// info with its resources.
+func (c *configMetrics) recordGeneration(operations int, resources *configgenerator.Resources, duration time.Duration) {
+	routes, snapshotBytes := 0, 0
+	for _, cluster := range resources.Clusters {
+		snapshotBytes += proto.Size(cluster)
+	}
+	for _, listener := range resources.Listeners {
+		snapshotBytes += proto.Size(listener)
+		routes += countInlinedRoutes(listener)
+	}
+	for _, routeConfig := range resources.Routes {
+		snapshotBytes += proto.Size(routeConfig)
+		for _, host := range routeConfig.GetVirtualHosts() {
+			routes += len(host.GetRoutes())
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.operations = operations
+	c.routes = routes
+	c.clusters = len(resources.Clusters)
+	c.listeners = len(resources.Listeners)
+	c.snapshotBytes = snapshotBytes
+	c.generationDuration = duration
+	c.generations++
+}
+
+// countInlinedRoutes counts the routes inlined in the http connection managers
+// of a listener, without RDS.
+func countInlinedRoutes(listener *listenerpb.Listener) int {
+	routes := 0
+	for _, filterChain := range listener.GetFilterChains() {
+		for _, filter := range filterChain.GetFilters() {
+			httpConMgr := &hcmpb.HttpConnectionManager{}
+			if filter.GetName() != util.HTTPConnectionManager || ptypes.UnmarshalAny(filter.GetTypedConfig(), httpConMgr) != nil {
+				continue
+			}
+			for _, host := range httpConMgr.GetRouteConfig().GetVirtualHosts() {
+				routes += len(host.GetRoutes())
+			}
+		}
+	}
+	return routes
+}
+
+func (c *configMetrics) generationFailed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generationFailures++
+}
+
+func (c *configMetrics) pollFailed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pollFailures++
+}
+
+// write writes the metrics in the Prometheus text format.
+func (c *configMetrics) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, metric := range []struct {
+		name  string
+		typ   string
+		help  string
+		value interface{}
+	}{
+		{"espv2_config_operations", "gauge", "The operations of the last generated config.", c.operations},
+		{"espv2_config_routes", "gauge", "The routes of the last generated config.", c.routes},
+		{"espv2_config_clusters", "gauge", "The clusters of the last generated config.", c.clusters},
+		{"espv2_config_listeners", "gauge", "The listeners of the last generated config.", c.listeners},
+		{"espv2_config_snapshot_bytes", "gauge", "The serialized size of the resources of the last generated config.", c.snapshotBytes},
+		{"espv2_config_generation_duration_seconds", "gauge", "How long the last config took to generate.", c.generationDuration.Seconds()},
+		{"espv2_config_generations_total", "counter", "The configs generated.", c.generations},
+		{"espv2_config_generation_failures_total", "counter", "The service configs which failed to generate a config.", c.generationFailures},
+		{"espv2_config_poll_failures_total", "counter", "The checks of the source of the service config which failed to fetch or apply a config.", c.pollFailures},
+	} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", metric.name, metric.help, metric.name, metric.typ, metric.name, metric.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ConfigManager) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = m.metrics.write(w)
+}
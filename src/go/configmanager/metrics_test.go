@@ -0,0 +1,140 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	makeServiceConfig := func(kind string) *confpb.Service {
+		return &confpb.Service{
+			Name: "bookstore.endpoints.project123.cloud.goog",
+			Id:   "2018-12-05r0",
+			Apis: []*apipb.Api{
+				{
+					Name: "endpoints.examples.bookstore.Bookstore",
+					Methods: []*apipb.Method{
+						{
+							Name: "Echo",
+						},
+						{
+							Name: "Report",
+						},
+					},
+				},
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: "endpoints.examples.bookstore.Bookstore.Echo",
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: "/v1/echo/{id}",
+						},
+					},
+					{
+						Selector: "endpoints.examples.bookstore.Bookstore.Report",
+						Pattern: &annotationspb.HttpRule_Custom{
+							Custom: &annotationspb.CustomHttpPattern{
+								Kind: kind,
+								Path: "/v1/report/{id}",
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	testData := []struct {
+		desc      string
+		enableRds bool
+	}{
+		{
+			desc: "routes inlined in the listener",
+		},
+		{
+			desc:      "routes served through RDS",
+			enableRds: true,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "http://127.0.0.1:8082"
+			opts.DisableTracing = true
+			opts.EnableRds = tc.enableRds
+			logger, err := newStructuredLogger(opts.LogFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &ConfigManager{
+				envoyConfigOptions: opts,
+				logger:             logger,
+			}
+			m.cache = cache.NewSnapshotCache(true, m, m)
+
+			if err := m.applyServiceConfig(makeServiceConfig("REPORT")); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.applyServiceConfig(makeServiceConfig("BAD METHOD")); err == nil {
+				t.Fatal("want an error for the invalid custom http method")
+			}
+			m.metrics.pollFailed()
+
+			w := httptest.NewRecorder()
+			m.ReadinessHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("want status 200, get %d", w.Code)
+			}
+
+			got := make(map[string]string)
+			for _, line := range strings.Split(w.Body.String(), "\n") {
+				if fields := strings.Fields(line); len(fields) == 2 {
+					got[fields[0]] = fields[1]
+				}
+			}
+			for name, want := range map[string]string{
+				"espv2_config_operations":                "2",
+				"espv2_config_routes":                    "2",
+				"espv2_config_clusters":                  "2",
+				"espv2_config_listeners":                 "1",
+				"espv2_config_generations_total":         "1",
+				"espv2_config_generation_failures_total": "1",
+				"espv2_config_poll_failures_total":       "1",
+			} {
+				if got[name] != want {
+					t.Errorf("want %s %s, get %q in:\n%s", name, want, got[name], w.Body.String())
+				}
+			}
+			for _, name := range []string{"espv2_config_snapshot_bytes", "espv2_config_generation_duration_seconds"} {
+				if got[name] == "" || got[name] == "0" {
+					t.Errorf("want a non-zero %s, get %q", name, got[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// The backoff of the background retries of a deferred OpenID Connect
+// Discovery, doubled after each failure. The retry_backoff of the
+// openid_discovery callout, if set, is the initial one.
+const (
+	initialDeferredDiscoveryBackoff = 5 * time.Second
+	maxDeferredDiscoveryBackoff     = 5 * time.Minute
+)
+
+// deferredOpenIDProviders lists the providers of the applied services whose
+// OpenID Connect Discovery is deferred.
+func deferredOpenIDProviders(serviceInfo *configinfo.ServiceInfo) []string {
+	var providers []string
+	for _, s := range append([]*configinfo.ServiceInfo{serviceInfo}, serviceInfo.AdditionalServices...) {
+		for id := range s.DeferredOpenIDProviders {
+			providers = append(providers, id)
+		}
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// scheduleDeferredOpenIDDiscovery retries the deferred OpenID Connect
+// Discovery of the applied service config in the background, by applying it
+// again once the backoff elapsed. It is called with configMu held.
+func (m *ConfigManager) scheduleDeferredOpenIDDiscovery(serviceConfig *confpb.Service) {
+	if m.deferredDiscovery != nil {
+		m.deferredDiscovery.Stop()
+		m.deferredDiscovery = nil
+	}
+	providers := deferredOpenIDProviders(m.serviceInfo)
+	if len(providers) == 0 {
+		m.deferredDiscoveryBackoff = 0
+		return
+	}
+
+	backoff := 2 * m.deferredDiscoveryBackoff
+	if backoff == 0 {
+		backoff = initialDeferredDiscoveryBackoff
+		if policy := m.serviceInfo.CalloutPolicies[configinfo.OpenIDDiscoveryCallout]; policy != nil && policy.RetryBackoff > 0 {
+			backoff = policy.RetryBackoff
+		}
+	}
+	if backoff > maxDeferredDiscoveryBackoff {
+		backoff = maxDeferredDiscoveryBackoff
+	}
+	m.deferredDiscoveryBackoff = backoff
+	m.deferredDiscovery = time.AfterFunc(backoff, func() {
+		m.retryDeferredOpenIDDiscovery(serviceConfig)
+	})
+
+	m.logger.Event(severityWarning, "openid_discovery_deferred", "deferred the OpenID Connect Discovery of providers", map[string]interface{}{
+		"service":   serviceConfig.GetName(),
+		"config_id": serviceConfig.GetId(),
+		"providers": providers,
+		"retry_in":  backoff.String(),
+	})
+}
+
+// retryDeferredOpenIDDiscovery applies the service config again, unless
+// another one was applied in the meantime. The discovery is deferred again if
+// it still fails.
+func (m *ConfigManager) retryDeferredOpenIDDiscovery(serviceConfig *confpb.Service) {
+	m.configMu.Lock()
+	current := m.curServiceConfig == serviceConfig
+	m.configMu.Unlock()
+
+	if !current {
+		return
+	}
+	if err := m.applyServiceConfig(serviceConfig); err != nil {
+		m.logger.Errorf("fail to apply the service config to retry the OpenID Connect Discovery, %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestDeferredOpenIDDiscovery(t *testing.T) {
+	var available int32
+	openIDServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&available) == 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		jwksUriEntry, _ := json.Marshal(map[string]string{"jwks_uri": "https://fake-jwks.com"})
+		_, _ = w.Write(jwksUriEntry)
+	}))
+	defer openIDServer.Close()
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "grpc://127.0.0.1:8082"
+	opts.DisableTracing = true
+	opts.DeferOpenIDDiscovery = true
+	opts.CalloutPolicies = "openid_discovery=retry_backoff:10ms"
+	logger, err := newStructuredLogger(opts.LogFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &ConfigManager{
+		envoyConfigOptions: opts,
+		logger:             logger,
+		serviceName:        "bookstore.endpoints.project123.cloud.goog",
+	}
+	m.cache = cache.NewSnapshotCache(true, m, m)
+	if err := m.applyServiceConfig(&confpb.Service{
+		Name: "bookstore.endpoints.project123.cloud.goog",
+		Id:   "2020-01-01r0",
+		Apis: []*apipb.Api{
+			{
+				Name:    "endpoints.examples.bookstore.Bookstore",
+				Methods: []*apipb.Method{{Name: "ListShelves"}},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:     "auth_provider",
+					Issuer: openIDServer.URL,
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatalf("want the config applied with the discovery deferred, got: %v", err)
+	}
+
+	deferred := func() []string {
+		m.configMu.Lock()
+		defer m.configMu.Unlock()
+		return deferredOpenIDProviders(m.serviceInfo)
+	}
+	if got := deferred(); len(got) != 1 || got[0] != "auth_provider" {
+		t.Fatalf("want the discovery of auth_provider deferred, got: %v", got)
+	}
+
+	atomic.StoreInt32(&available, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deferred()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want the deferred discovery retried in the background, still deferred: %v", deferred())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	if jwksUri := m.curServiceConfig.GetAuthentication().GetProviders()[0].GetJwksUri(); jwksUri != "https://fake-jwks.com" {
+		t.Errorf("want the discovered jwks_uri applied, got: %q", jwksUri)
+	}
+	if m.deferredDiscovery != nil || m.deferredDiscoveryBackoff != 0 {
+		t.Errorf("want no retry scheduled once the discovery succeeded")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const readinessPath = "/ready"
+
+// The JSON view of the readiness, served on the readiness endpoint.
+type readinessView struct {
+	Ready    bool   `json:"ready"`
+	Service  string `json:"service,omitempty"`
+	ConfigID string `json:"configId,omitempty"`
+	// When the config was applied to the cache, and accepted by Envoy.
+	AppliedTime  string `json:"appliedTime,omitempty"`
+	AcceptedTime string `json:"acceptedTime,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// readiness reports the config accepted by Envoy, which is ready to serve
+// once it accepted the resources of a snapshot.
+func (m *ConfigManager) readiness() *readinessView {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+
+	if m.ackedConfig == nil {
+		view := &readinessView{
+			Service:  m.serviceName,
+			ConfigID: m.curConfigId(),
+			Reason:   "envoy has not accepted a generated config yet",
+		}
+		if m.appliedSnapshot == nil {
+			view.Reason = "no config has been generated yet"
+		}
+		return view
+	}
+	return &readinessView{
+		Ready:        true,
+		Service:      m.ackedConfig.serviceConfig.GetName(),
+		ConfigID:     m.ackedConfig.serviceConfig.GetId(),
+		AppliedTime:  m.ackedConfig.appliedTime.UTC().Format(time.RFC3339),
+		AcceptedTime: m.ackedConfig.ackedTime.UTC().Format(time.RFC3339),
+	}
+}
+
+// ReadinessHandler returns the handler of the readiness endpoint /ready. It
+// responds 503 until Envoy accepted the first generated config, so the
+// readiness probes don't send traffic to a proxy without routes. It also
+// serves the metrics of the config translation on /metrics.
+func (m *ConfigManager) ReadinessHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, m.handleMetrics)
+	mux.HandleFunc(readinessPath, func(w http.ResponseWriter, r *http.Request) {
+		view := m.readiness()
+		body, err := json.MarshalIndent(view, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !view.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write(body)
+	})
+	return mux
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+	logger, err := newStructuredLogger(opts.LogFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &ConfigManager{
+		envoyConfigOptions: opts,
+		logger:             logger,
+		serviceName:        "bookstore.endpoints.project123.cloud.goog",
+	}
+	m.cache = cache.NewSnapshotCache(true, m, m)
+	handler := m.ReadinessHandler()
+
+	testData := []struct {
+		desc       string
+		update     func()
+		wantStatus int
+		wantView   readinessView
+	}{
+		{
+			desc:       "no config generated",
+			update:     func() {},
+			wantStatus: http.StatusServiceUnavailable,
+			wantView: readinessView{
+				Service: "bookstore.endpoints.project123.cloud.goog",
+				Reason:  "no config has been generated yet",
+			},
+		},
+		{
+			desc: "config not accepted by envoy",
+			update: func() {
+				if err := m.applyServiceConfig(&confpb.Service{
+					Name: "bookstore.endpoints.project123.cloud.goog",
+					Id:   "2018-12-05r0",
+					Apis: []*apipb.Api{
+						{
+							Name: "endpoints.examples.bookstore.Bookstore",
+						},
+					},
+				}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantView: readinessView{
+				Service:  "bookstore.endpoints.project123.cloud.goog",
+				ConfigID: "2018-12-05r0",
+				Reason:   "envoy has not accepted a generated config yet",
+			},
+		},
+		{
+			desc: "config accepted by envoy",
+			update: func() {
+				m.onAck(resource.ClusterType, "2018-12-05r0")
+				m.onAck(resource.ListenerType, "2018-12-05r0")
+			},
+			wantStatus: http.StatusOK,
+			wantView: readinessView{
+				Ready:    true,
+				Service:  "bookstore.endpoints.project123.cloud.goog",
+				ConfigID: "2018-12-05r0",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		tc.update()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, readinessPath, nil))
+		if w.Code != tc.wantStatus {
+			t.Errorf("Test (%s): want status %d, get %d", tc.desc, tc.wantStatus, w.Code)
+		}
+
+		var gotView readinessView
+		if err := json.Unmarshal(w.Body.Bytes(), &gotView); err != nil {
+			t.Fatalf("Test (%s): fail to unmarshal %s: %v", tc.desc, w.Body.String(), err)
+		}
+		if gotView.Ready && (gotView.AppliedTime == "" || gotView.AcceptedTime == "") {
+			t.Errorf("Test (%s): want the applied and accepted times, get %s", tc.desc, w.Body.String())
+		}
+		gotView.AppliedTime, gotView.AcceptedTime = "", ""
+		if gotView != tc.wantView {
+			t.Errorf("Test (%s): want readiness %+v, get %+v", tc.desc, tc.wantView, gotView)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// The resource types Envoy subscribes to, which it acknowledges.
+var ackedTypeUrls = []string{resource.ClusterType, resource.RouteType, resource.ListenerType}
+
+// appliedConfig is a service config applied to the cache, with its snapshot.
+type appliedConfig struct {
+	serviceConfig *confpb.Service
+	serviceInfo   *configinfo.ServiceInfo
+	snapshot      *cache.Snapshot
+	appliedTime   time.Time
+	ackedTime     time.Time
+}
+
+// xdsCallbacks passes the ACKs and NACKs of the state of the world ADS
+// streams to the config manager.
+type xdsCallbacks struct {
+	m *ConfigManager
+}
+
+func (c xdsCallbacks) OnStreamOpen(context.Context, int64, string) error { return nil }
+func (c xdsCallbacks) OnStreamClosed(int64)                              {}
+func (c xdsCallbacks) OnStreamResponse(int64, *discoverypb.DiscoveryRequest, *discoverypb.DiscoveryResponse) {
+}
+func (c xdsCallbacks) OnFetchRequest(context.Context, *discoverypb.DiscoveryRequest) error {
+	return nil
+}
+func (c xdsCallbacks) OnFetchResponse(*discoverypb.DiscoveryRequest, *discoverypb.DiscoveryResponse) {
+}
+
+// OnStreamRequest handles the requests acknowledging a response, which carry
+// its nonce. The version of a NACK is the last one accepted by Envoy.
+func (c xdsCallbacks) OnStreamRequest(_ int64, req *discoverypb.DiscoveryRequest) error {
+	if req.GetResponseNonce() == "" {
+		return nil
+	}
+	if req.GetErrorDetail() != nil {
+		c.m.onNack(req.GetTypeUrl(), req.GetVersionInfo(), req.GetErrorDetail().GetMessage())
+	} else {
+		c.m.onAck(req.GetTypeUrl(), req.GetVersionInfo())
+	}
+	return nil
+}
+
+// onAck records the version of the resources accepted by Envoy. Once all the
+// resources of the applied snapshot are accepted, it is the one to roll back
+// to.
+func (m *ConfigManager) onAck(typeUrl, version string) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+
+	if m.ackedVersions == nil {
+		m.ackedVersions = make(map[string]string)
+	}
+	m.ackedVersions[typeUrl] = version
+	if m.appliedSnapshot == nil || (m.ackedConfig != nil && m.ackedConfig.snapshot == m.appliedSnapshot) {
+		return
+	}
+	for _, url := range ackedTypeUrls {
+		if len(m.appliedSnapshot.GetResources(url)) > 0 && m.ackedVersions[url] != m.appliedSnapshot.GetVersion(url) {
+			return
+		}
+	}
+
+	previous := m.ackedConfig
+	m.ackedConfig = &appliedConfig{
+		serviceConfig: m.curServiceConfig,
+		serviceInfo:   m.serviceInfo,
+		snapshot:      m.appliedSnapshot,
+		appliedTime:   m.appliedTime,
+		ackedTime:     time.Now(),
+	}
+	m.logger.Event(severityInfo, "config_acked", "envoy accepted the applied service config", map[string]interface{}{
+		"service":   m.serviceName,
+		"config_id": m.curConfigId(),
+	})
+	m.startCanary(m.ackedConfig, previous)
+}
+
+// onNack reverts to the last snapshot accepted by Envoy when it rejects the
+// resources of the applied one. The rejected config isn't applied again, and
+// with --halt_rollout_on_nack no new config is applied until the rollout is
+// resumed on the debug endpoint.
+func (m *ConfigManager) onNack(typeUrl, acceptedVersion, detail string) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+
+	// A NACK of an older snapshot, the applied one is already accepted.
+	if m.appliedSnapshot == nil || m.appliedSnapshot.GetVersion(typeUrl) == acceptedVersion {
+		return
+	}
+
+	m.rejectedConfigId = m.curConfigId()
+	m.rejectedReason = "the service config was rejected by envoy"
+	m.logger.Event(severityError, "config_rejected", "envoy rejected the applied service config", map[string]interface{}{
+		"service":   m.serviceName,
+		"config_id": m.rejectedConfigId,
+		"type_url":  typeUrl,
+		"error":     detail,
+	})
+	if *HaltRolloutOnNack && !m.rolloutHalted {
+		m.rolloutHalted = true
+		m.logger.Event(severityWarning, "rollout_halted", "no new service config is applied until the rollout is resumed", map[string]interface{}{
+			"service": m.serviceName,
+		})
+	}
+
+	if m.ackedConfig == nil {
+		m.logger.Event(severityError, "config_rollback_failed", "no service config was accepted by envoy to roll back to", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": m.rejectedConfigId,
+		})
+		return
+	}
+	if err := m.restoreConfig(m.ackedConfig); err != nil {
+		m.logger.Event(severityError, "config_rollback_failed", "fail to roll back to the service config accepted by envoy", map[string]interface{}{
+			"service":   m.serviceName,
+			"config_id": m.ackedConfig.serviceConfig.GetId(),
+			"error":     err,
+		})
+		return
+	}
+
+	m.logger.Event(severityWarning, "config_rolled_back", "rolled back to the service config accepted by envoy", map[string]interface{}{
+		"service":            m.serviceName,
+		"config_id":          m.curConfigId(),
+		"rejected_config_id": m.rejectedConfigId,
+	})
+}
+
+// restoreConfig sets the snapshot of a previously applied config in the cache
+// again. It is called with configMu held.
+func (m *ConfigManager) restoreConfig(config *appliedConfig) error {
+	if err := m.cache.SetSnapshot(m.envoyConfigOptions.Node, *config.snapshot); err != nil {
+		return err
+	}
+	m.curServiceConfig = config.serviceConfig
+	m.serviceInfo = config.serviceInfo
+	m.appliedSnapshot = config.snapshot
+	m.appliedTime = config.appliedTime
+	m.notifySnapshotUpdated()
+	if err := m.setDebugServiceInfo(m.serviceInfo); err != nil {
+		m.logger.Errorf("fail to dump ServiceInfo for the debug endpoint, %v", err)
+	}
+	return nil
+}
+
+// skipConfig reports why a config isn't applied: it was rejected by Envoy or
+// rolled back after its canary bake, or the rollout is halted.
+func (m *ConfigManager) skipConfig(configId string) string {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+
+	if m.rolloutHalted {
+		return "the rollout is halted after envoy rejected a service config"
+	}
+	if configId != "" && configId == m.rejectedConfigId {
+		return m.rejectedReason
+	}
+	return ""
+}
+
+// resumeRollout lets the rollout apply new service configs again, including
+// the rejected one.
+func (m *ConfigManager) resumeRollout() {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+
+	m.rolloutHalted = false
+	m.rejectedConfigId = ""
+	m.rejectedReason = ""
+	m.logger.Event(severityInfo, "rollout_resumed", "the rollout is resumed", map[string]interface{}{
+		"service": m.serviceName,
+	})
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestRollbackOnNack(t *testing.T) {
+	testEndpointName := "endpoints.examples.bookstore.Bookstore"
+	makeServiceConfig := func(id, path string) *confpb.Service {
+		return &confpb.Service{
+			Name: "bookstore.endpoints.project123.cloud.goog",
+			Id:   id,
+			Apis: []*apipb.Api{
+				{
+					Name: testEndpointName,
+					Methods: []*apipb.Method{
+						{
+							Name: "Echo",
+						},
+					},
+				},
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: testEndpointName + ".Echo",
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: path,
+						},
+					},
+				},
+			},
+		}
+	}
+
+	testData := []struct {
+		desc              string
+		haltRolloutOnNack bool
+		ackFirstConfig    bool
+		wantConfigId      string
+		wantSkipNewConfig bool
+	}{
+		{
+			desc:           "roll back to the accepted config",
+			ackFirstConfig: true,
+			wantConfigId:   "2018-12-05r0",
+		},
+		{
+			desc:              "roll back to the accepted config and halt the rollout",
+			haltRolloutOnNack: true,
+			ackFirstConfig:    true,
+			wantConfigId:      "2018-12-05r0",
+			wantSkipNewConfig: true,
+		},
+		{
+			desc:         "no accepted config to roll back to",
+			wantConfigId: "2018-12-05r1",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			*HaltRolloutOnNack = tc.haltRolloutOnNack
+			defer func() { *HaltRolloutOnNack = false }()
+
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "http://127.0.0.1:8082"
+			opts.DisableTracing = true
+			logger, err := newStructuredLogger(opts.LogFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &ConfigManager{
+				envoyConfigOptions: opts,
+				logger:             logger,
+			}
+			m.cache = cache.NewSnapshotCache(true, m, m)
+			callbacks := xdsCallbacks{m: m}
+
+			if err := m.applyServiceConfig(makeServiceConfig("2018-12-05r0", "/v1/echo")); err != nil {
+				t.Fatal(err)
+			}
+			if tc.ackFirstConfig {
+				for _, typeUrl := range []string{resource.ClusterType, resource.ListenerType} {
+					if err := callbacks.OnStreamRequest(1, &discoverypb.DiscoveryRequest{
+						TypeUrl:       typeUrl,
+						VersionInfo:   m.appliedSnapshot.GetVersion(typeUrl),
+						ResponseNonce: "1",
+					}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			if err := m.applyServiceConfig(makeServiceConfig("2018-12-05r1", "/v2/echo")); err != nil {
+				t.Fatal(err)
+			}
+			// A stale NACK, of the config before the accepted one, is ignored.
+			m.onNack(resource.ClusterType, m.appliedSnapshot.GetVersion(resource.ClusterType), "stale")
+			if m.rejectedConfigId != "" {
+				t.Fatalf("stale NACK rejected config %s", m.rejectedConfigId)
+			}
+
+			acceptedVersion := ""
+			if tc.ackFirstConfig {
+				acceptedVersion = "2018-12-05r0"
+			}
+			if err := callbacks.OnStreamRequest(1, &discoverypb.DiscoveryRequest{
+				TypeUrl:       resource.ListenerType,
+				VersionInfo:   acceptedVersion,
+				ResponseNonce: "2",
+				ErrorDetail:   &statuspb.Status{Message: "invalid listener"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := m.curConfigId(); got != tc.wantConfigId {
+				t.Errorf("want config id %s after the NACK, get %s", tc.wantConfigId, got)
+			}
+			snapshot, err := m.cache.GetSnapshot(opts.Node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := snapshot.GetVersion(resource.ListenerType); got != tc.wantConfigId {
+				t.Errorf("want listener version %s after the NACK, get %s", tc.wantConfigId, got)
+			}
+
+			if m.skipConfig("2018-12-05r1") == "" {
+				t.Errorf("the rejected config is not skipped")
+			}
+			if gotSkip := m.skipConfig("2018-12-05r2") != ""; gotSkip != tc.wantSkipNewConfig {
+				t.Errorf("want skipping a new config %v, get %v", tc.wantSkipNewConfig, gotSkip)
+			}
+
+			m.resumeRollout()
+			if reason := m.skipConfig("2018-12-05r1"); reason != "" {
+				t.Errorf("the config is skipped after resuming the rollout: %s", reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// The runtime settings of the config manager, served and changed on the debug
+// endpoints.
+type logLevelView struct {
+	Verbosity int `json:"verbosity"`
+}
+
+type routeDebugHeadersView struct {
+	Enabled bool `json:"enabled"`
+}
+
+type maintenanceView struct {
+	Selectors  []string `json:"selectors"`
+	StatusCode int      `json:"statusCode"`
+	RetryAfter string   `json:"retryAfter,omitempty"`
+}
+
+type pollView struct {
+	Service  string `json:"service"`
+	ConfigID string `json:"configId"`
+}
+
+// logVerbosity returns the glog verbosity of --v.
+func logVerbosity() int {
+	f := flag.Lookup("v")
+	if f == nil {
+		return 0
+	}
+	v, _ := strconv.Atoi(f.Value.String())
+	return v
+}
+
+// setLogVerbosity changes the glog verbosity of --v.
+func (m *ConfigManager) setLogVerbosity(verbosity int) error {
+	if verbosity < 0 {
+		return fmt.Errorf("verbosity must not be negative")
+	}
+	if err := flag.Set("v", strconv.Itoa(verbosity)); err != nil {
+		return err
+	}
+	m.logger.Event(severityInfo, "log_level_changed", "changed the log verbosity", map[string]interface{}{
+		"verbosity": verbosity,
+	})
+	return nil
+}
+
+func (m *ConfigManager) routeDebugHeadersEnabled() bool {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	return m.envoyConfigOptions.EnableRouteDebugHeaders
+}
+
+// setRouteDebugHeaders toggles the route debug response headers, and applies
+// the current service config again to update the routes of Envoy.
+func (m *ConfigManager) setRouteDebugHeaders(enabled bool) error {
+	m.configMu.Lock()
+	changed := m.envoyConfigOptions.EnableRouteDebugHeaders != enabled
+	m.envoyConfigOptions.EnableRouteDebugHeaders = enabled
+	serviceConfig := m.curServiceConfig
+	m.configMu.Unlock()
+
+	if !changed || serviceConfig == nil {
+		return nil
+	}
+	if err := m.applyServiceConfig(serviceConfig); err != nil {
+		return fmt.Errorf("fail to apply the service config with the route debug headers, %v", err)
+	}
+	m.logger.Event(severityInfo, "route_debug_headers_changed", "toggled the route debug headers", map[string]interface{}{
+		"service": m.serviceName,
+		"enabled": enabled,
+	})
+	return nil
+}
+
+func (m *ConfigManager) maintenance() *maintenanceView {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	view := &maintenanceView{
+		Selectors:  []string{},
+		StatusCode: m.envoyConfigOptions.MaintenanceStatusCode,
+	}
+	for _, selector := range strings.Split(m.envoyConfigOptions.MaintenanceSelectors, ",") {
+		if selector = strings.TrimSpace(selector); selector != "" {
+			view.Selectors = append(view.Selectors, selector)
+		}
+	}
+	if retryAfter := m.envoyConfigOptions.MaintenanceRetryAfter; retryAfter > 0 {
+		view.RetryAfter = retryAfter.String()
+	}
+	return view
+}
+
+// setMaintenanceSelectors replaces the operations in maintenance, and applies
+// the current service config again to update the routes of Envoy. The
+// selectors must be operations of the applied service config, and the
+// previous ones are kept if the new ones fail to apply.
+func (m *ConfigManager) setMaintenanceSelectors(selectors string) error {
+	m.configMu.Lock()
+	if m.serviceInfo != nil {
+		for _, selector := range strings.Split(selectors, ",") {
+			selector = strings.TrimSpace(selector)
+			if _, ok := m.serviceInfo.Methods[selector]; selector != "" && !ok {
+				m.configMu.Unlock()
+				return fmt.Errorf("selector %s is not an operation of service %s", selector, m.serviceName)
+			}
+		}
+	}
+	previous := m.envoyConfigOptions.MaintenanceSelectors
+	m.envoyConfigOptions.MaintenanceSelectors = selectors
+	serviceConfig := m.curServiceConfig
+	m.configMu.Unlock()
+
+	if previous == selectors || serviceConfig == nil {
+		return nil
+	}
+	if err := m.applyServiceConfig(serviceConfig); err != nil {
+		m.configMu.Lock()
+		m.envoyConfigOptions.MaintenanceSelectors = previous
+		m.configMu.Unlock()
+		return fmt.Errorf("fail to apply the service config with the operations in maintenance, %v", err)
+	}
+	m.configMu.Lock()
+	m.runtimeMaintenance = true
+	m.configMu.Unlock()
+	m.logger.Event(severityWarning, "maintenance_changed", "changed the operations in maintenance", map[string]interface{}{
+		"service":   m.serviceName,
+		"selectors": selectors,
+	})
+	return nil
+}
+
+// dropUnknownMaintenanceSelectors drops the operations in maintenance set on
+// the debug endpoint which are not in the service config about to be
+// applied, e.g. removed by a new rollout, so it doesn't fail to apply. It
+// requires configMu.
+func (m *ConfigManager) dropUnknownMaintenanceSelectors(serviceConfig *confpb.Service) {
+	operations := make(map[string]bool)
+	for _, api := range serviceConfig.GetApis() {
+		for _, method := range api.GetMethods() {
+			operations[fmt.Sprintf("%s.%s", api.GetName(), method.GetName())] = true
+		}
+	}
+
+	var kept, dropped []string
+	for _, selector := range strings.Split(m.envoyConfigOptions.MaintenanceSelectors, ",") {
+		if selector = strings.TrimSpace(selector); selector == "" {
+			continue
+		}
+		if operations[selector] {
+			kept = append(kept, selector)
+		} else {
+			dropped = append(dropped, selector)
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+	m.envoyConfigOptions.MaintenanceSelectors = strings.Join(kept, ",")
+	m.logger.Event(severityWarning, "maintenance_selectors_dropped", "dropped the operations in maintenance missing from the service config", map[string]interface{}{
+		"service":   serviceConfig.GetName(),
+		"config_id": serviceConfig.GetId(),
+		"dropped":   strings.Join(dropped, ","),
+	})
+}
+
+// pollNow checks the source of the service config for a new one without
+// waiting for the next poll. It requires pollServiceConfig.
+func (m *ConfigManager) pollNow() error {
+	m.logger.Event(severityInfo, "poll_forced", "checking for a new service config", map[string]interface{}{
+		"service": m.serviceName,
+	})
+	return m.pollServiceConfig()
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestRuntimeDebugEndpoints(t *testing.T) {
+	if flag.Lookup("v") == nil {
+		t.Skip("glog flags are not registered")
+	}
+	oldVerbosity := flag.Lookup("v").Value.String()
+	defer func() {
+		_ = flag.Set("v", oldVerbosity)
+	}()
+
+	testData := []struct {
+		desc              string
+		method            string
+		target            string
+		pollServiceConfig func() error
+		wantStatus        int
+		wantBody          string
+		check             func(m *ConfigManager) error
+	}{
+		{
+			desc:       "set the log verbosity",
+			method:     http.MethodPost,
+			target:     "/debug/log_level?verbosity=2",
+			wantStatus: http.StatusOK,
+			wantBody:   `"verbosity": 2`,
+			check: func(m *ConfigManager) error {
+				if got := logVerbosity(); got != 2 {
+					return fmt.Errorf("want verbosity 2, get %d", got)
+				}
+				return nil
+			},
+		},
+		{
+			desc:       "invalid log verbosity",
+			method:     http.MethodPost,
+			target:     "/debug/log_level?verbosity=high",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "query parameter verbosity must be an integer",
+		},
+		{
+			desc:       "get the route debug headers",
+			method:     http.MethodGet,
+			target:     "/debug/route_debug_headers",
+			wantStatus: http.StatusOK,
+			wantBody:   `"enabled": false`,
+		},
+		{
+			desc:       "enable the route debug headers",
+			method:     http.MethodPost,
+			target:     "/debug/route_debug_headers?enabled=true",
+			wantStatus: http.StatusOK,
+			wantBody:   `"enabled": true`,
+			check: func(m *ConfigManager) error {
+				if !m.serviceInfo.Options.EnableRouteDebugHeaders {
+					return fmt.Errorf("want the applied service config with the route debug headers")
+				}
+				if got := m.appliedSnapshot.GetVersion(resource.ListenerType); got != "2020-01-01r0.1" {
+					return fmt.Errorf("want the listener version 2020-01-01r0.1, get %s", got)
+				}
+				return nil
+			},
+		},
+		{
+			desc:       "get the operations in maintenance",
+			method:     http.MethodGet,
+			target:     "/debug/maintenance",
+			wantStatus: http.StatusOK,
+			wantBody:   `"selectors": []`,
+		},
+		{
+			desc:       "set the operations in maintenance",
+			method:     http.MethodPost,
+			target:     "/debug/maintenance?selectors=endpoints.examples.bookstore.Bookstore.ListShelves",
+			wantStatus: http.StatusOK,
+			wantBody:   `"endpoints.examples.bookstore.Bookstore.ListShelves"`,
+			check: func(m *ConfigManager) error {
+				if !m.serviceInfo.Methods["endpoints.examples.bookstore.Bookstore.ListShelves"].InMaintenance {
+					return fmt.Errorf("want the applied service config with ListShelves in maintenance")
+				}
+				if got := m.appliedSnapshot.GetVersion(resource.ListenerType); got != "2020-01-01r0.1" {
+					return fmt.Errorf("want the listener version 2020-01-01r0.1, get %s", got)
+				}
+				return nil
+			},
+		},
+		{
+			desc:       "unknown operation in maintenance",
+			method:     http.MethodPost,
+			target:     "/debug/maintenance?selectors=endpoints.examples.bookstore.Bookstore.DeleteShelf",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "selector endpoints.examples.bookstore.Bookstore.DeleteShelf is not an operation of service",
+			check: func(m *ConfigManager) error {
+				if got := m.envoyConfigOptions.MaintenanceSelectors; got != "" {
+					return fmt.Errorf("want no operations in maintenance, get %s", got)
+				}
+				if m.serviceInfo == nil {
+					return fmt.Errorf("want the applied service config kept")
+				}
+				return nil
+			},
+		},
+		{
+			desc:       "operations in maintenance missing from a new service config are dropped",
+			method:     http.MethodPost,
+			target:     "/debug/maintenance?selectors=endpoints.examples.bookstore.Bookstore.ListShelves",
+			wantStatus: http.StatusOK,
+			wantBody:   `"endpoints.examples.bookstore.Bookstore.ListShelves"`,
+			check: func(m *ConfigManager) error {
+				if err := m.applyServiceConfig(&confpb.Service{
+					Name: "bookstore.endpoints.project123.cloud.goog",
+					Id:   "2020-01-02r0",
+					Apis: []*apipb.Api{
+						{
+							Name:    "endpoints.examples.bookstore.Bookstore",
+							Methods: []*apipb.Method{{Name: "ListBooks"}},
+						},
+					},
+				}); err != nil {
+					return fmt.Errorf("want the new service config applied, get error: %v", err)
+				}
+				if got := m.maintenance().Selectors; len(got) != 0 {
+					return fmt.Errorf("want no operations in maintenance, get %v", got)
+				}
+				return nil
+			},
+		},
+		{
+			desc:       "poll with the fixed rollout strategy",
+			method:     http.MethodPost,
+			target:     "/debug/poll",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "no service config source to poll",
+		},
+		{
+			desc:              "poll the service config",
+			method:            http.MethodPost,
+			target:            "/debug/poll",
+			pollServiceConfig: func() error { return nil },
+			wantStatus:        http.StatusOK,
+			wantBody:          `"configId": "2020-01-01r0"`,
+		},
+		{
+			desc:              "poll fails",
+			method:            http.MethodPost,
+			target:            "/debug/poll",
+			pollServiceConfig: func() error { return fmt.Errorf("rollouts unavailable") },
+			wantStatus:        http.StatusInternalServerError,
+			wantBody:          "rollouts unavailable",
+		},
+		{
+			desc:       "poll is POST only",
+			method:     http.MethodGet,
+			target:     "/debug/poll",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.1:8082"
+		opts.DisableTracing = true
+		logger, err := newStructuredLogger(opts.LogFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &ConfigManager{
+			envoyConfigOptions: opts,
+			logger:             logger,
+			serviceName:        "bookstore.endpoints.project123.cloud.goog",
+			pollServiceConfig:  tc.pollServiceConfig,
+		}
+		m.cache = cache.NewSnapshotCache(true, m, m)
+		if err := m.applyServiceConfig(&confpb.Service{
+			Name: "bookstore.endpoints.project123.cloud.goog",
+			Id:   "2020-01-01r0",
+			Apis: []*apipb.Api{
+				{
+					Name:    "endpoints.examples.bookstore.Bookstore",
+					Methods: []*apipb.Method{{Name: "ListShelves"}},
+				},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := httptest.NewRecorder()
+		m.DebugHandler().ServeHTTP(resp, httptest.NewRequest(tc.method, tc.target, nil))
+		if resp.Code != tc.wantStatus {
+			t.Errorf("Test (%s): want status %d, get %d: %s", tc.desc, tc.wantStatus, resp.Code, resp.Body.String())
+		}
+		if !strings.Contains(resp.Body.String(), tc.wantBody) {
+			t.Errorf("Test (%s): want body containing %q, get %q", tc.desc, tc.wantBody, resp.Body.String())
+		}
+		if tc.check != nil {
+			if err := tc.check(m); err != nil {
+				t.Errorf("Test (%s): %v", tc.desc, err)
+			}
+		}
+	}
+}
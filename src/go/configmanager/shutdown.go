@@ -0,0 +1,218 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+)
+
+const (
+	// The admin path of the Service Control filter flushing its aggregated
+	// reports. Envoy has no such path without the filter.
+	flushReportsPath = "/service_control/flush_reports"
+	// The gauge of the flushes not done on all the worker threads yet.
+	reportFlushesPendingStat = "service_control.report_flushes_pending"
+)
+
+var (
+	// The interval to check the in-flight requests of Envoy while draining.
+	drainPollInterval = time.Second
+	// The interval to check the flushed Service Control reports, and the time
+	// to wait for them to be sent.
+	reportFlushPollInterval = 100 * time.Millisecond
+	reportFlushTimeout      = 5 * time.Second
+
+	adminClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// DrainEnvoy gracefully drains Envoy before the proxy exits: it fails the
+// health checks, drains the listeners, so the HTTP/1 connections are closed
+// after their current request and the HTTP/2 ones get a GOAWAY, waits up to
+// the timeout for the in-flight requests and streams, then flushes the last
+// Service Control reports and waits for them to be sent.
+func (m *ConfigManager) DrainEnvoy(timeout time.Duration) error {
+	if m.envoyConfigOptions.AdminPort == 0 {
+		return fmt.Errorf("draining envoy requires the admin interface, --admin_port cannot be 0")
+	}
+	adminURL := m.envoyAdminURL()
+	start := time.Now()
+	m.logger.Event(severityInfo, "drain_started", "draining envoy before shutting down", map[string]interface{}{
+		"drain_timeout": timeout.String(),
+	})
+
+	if err := postEnvoyAdmin(adminURL + "/healthcheck/fail"); err != nil {
+		m.logger.Event(severityWarning, "drain_healthcheck_failed", "fail to fail the health checks of envoy", map[string]interface{}{
+			"error": err,
+		})
+	}
+	if err := postEnvoyAdmin(adminURL + "/drain_listeners?graceful"); err != nil {
+		return fmt.Errorf("fail to drain the listeners of envoy: %v", err)
+	}
+
+	deadline := start.Add(timeout)
+	for {
+		active, err := activeDownstreamRequests(adminURL)
+		if err != nil {
+			m.logger.Errorf("fail to get the active requests of envoy, %v", err)
+		} else if active == 0 {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			m.logger.Event(severityWarning, "drain_timed_out", "in-flight requests remain after the drain timeout", map[string]interface{}{
+				"active_requests": active,
+			})
+			break
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	m.flushServiceControlReports(adminURL)
+	m.logger.Event(severityInfo, "drain_completed", "envoy is drained", map[string]interface{}{
+		"duration": time.Since(start).String(),
+	})
+	return nil
+}
+
+// envoyAdminURL returns the url of the admin interface of Envoy, on loopback
+// if it listens on all the addresses.
+func (m *ConfigManager) envoyAdminURL() string {
+	host := m.envoyConfigOptions.AdminAddress
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(m.envoyConfigOptions.AdminPort))
+}
+
+func postEnvoyAdmin(url string) error {
+	resp, err := adminClient.Post(url, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returns status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// flushServiceControlReports makes the Service Control filter send its
+// aggregated reports now instead of at its next flush, then waits up to
+// reportFlushTimeout for the flushes and the calls to Service Control to
+// complete.
+func (m *ConfigManager) flushServiceControlReports(adminURL string) {
+	resp, err := adminClient.Post(adminURL+flushReportsPath, "", nil)
+	if err != nil {
+		m.logger.Event(severityWarning, "drain_report_flush_failed", "fail to flush the service control reports", map[string]interface{}{
+			"error": err,
+		})
+		return
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// No Service Control filter, no reports.
+		return
+	default:
+		m.logger.Event(severityWarning, "drain_report_flush_failed", "fail to flush the service control reports", map[string]interface{}{
+			"error": fmt.Sprintf("%s returns status %d", flushReportsPath, resp.StatusCode),
+		})
+		return
+	}
+
+	deadline := time.Now().Add(reportFlushTimeout)
+	for {
+		pending, err := pendingServiceControlCalls(adminURL)
+		if err != nil {
+			m.logger.Errorf("fail to get the pending service control calls of envoy, %v", err)
+		} else if pending == 0 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			m.logger.Event(severityWarning, "drain_report_flush_timed_out", "service control calls remain after the report flush timeout", map[string]interface{}{
+				"pending_calls": pending,
+			})
+			return
+		}
+		time.Sleep(reportFlushPollInterval)
+	}
+}
+
+// activeDownstreamRequests sums the active requests of the HTTP connection
+// managers, excluding the admin one serving this request.
+func activeDownstreamRequests(adminURL string) (int, error) {
+	return sumEnvoyStats(adminURL, "downstream_rq_active$", func(name string) bool {
+		return strings.HasPrefix(name, "http.") && !strings.HasPrefix(name, "http.admin.") && strings.HasSuffix(name, ".downstream_rq_active")
+	})
+}
+
+// pendingServiceControlCalls sums the report flushes not done yet and the
+// calls to Service Control in flight.
+func pendingServiceControlCalls(adminURL string) (int, error) {
+	activeStat := "cluster." + util.ServiceControlClusterName + ".upstream_rq_active"
+	return sumEnvoyStats(adminURL, "^("+regexp.QuoteMeta(reportFlushesPendingStat)+"|"+regexp.QuoteMeta(activeStat)+")$", func(name string) bool {
+		return name == reportFlushesPendingStat || name == activeStat
+	})
+}
+
+// sumEnvoyStats sums the stats of Envoy matching the filter regex and the
+// match function.
+func sumEnvoyStats(adminURL, filter string, match func(name string) bool) (int, error) {
+	resp, err := adminClient.Get(adminURL + "/stats?filter=" + url.QueryEscape(filter))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("/stats returns status %d", resp.StatusCode)
+	}
+
+	sum := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, value := splitStat(scanner.Text())
+		if !match(name) {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value of stat %s: %v", name, err)
+		}
+		sum += n
+	}
+	return sum, scanner.Err()
+}
+
+// splitStat splits a "name: value" line of the /stats output.
+func splitStat(line string) (string, string) {
+	i := strings.LastIndex(line, ": ")
+	if i < 0 {
+		return "", ""
+	}
+	return line[:i], strings.TrimSpace(line[i+2:])
+}
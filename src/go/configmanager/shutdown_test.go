@@ -0,0 +1,201 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+)
+
+func TestDrainEnvoy(t *testing.T) {
+	drainPollInterval, reportFlushPollInterval, reportFlushTimeout = time.Millisecond, time.Millisecond, 50*time.Millisecond
+	defer func() {
+		drainPollInterval, reportFlushPollInterval, reportFlushTimeout = time.Second, 100*time.Millisecond, 5*time.Second
+	}()
+
+	testData := []struct {
+		desc            string
+		activeRequests  []int
+		drainStatus     int
+		flushStatus     int
+		pendingCalls    []int
+		timeout         time.Duration
+		wantStatsCalls  int
+		wantError       string
+		wantAdminCalled []string
+	}{
+		{
+			desc:            "in-flight requests complete",
+			activeRequests:  []int{3, 1, 0},
+			drainStatus:     http.StatusOK,
+			flushStatus:     http.StatusNotFound,
+			timeout:         time.Minute,
+			wantStatsCalls:  3,
+			wantAdminCalled: []string{"/healthcheck/fail", "/drain_listeners?graceful", "/stats", "/stats", "/stats", flushReportsPath},
+		},
+		{
+			desc:            "in-flight requests remain after the timeout",
+			activeRequests:  []int{2},
+			drainStatus:     http.StatusOK,
+			flushStatus:     http.StatusNotFound,
+			timeout:         0,
+			wantStatsCalls:  1,
+			wantAdminCalled: []string{"/healthcheck/fail", "/drain_listeners?graceful", "/stats", flushReportsPath},
+		},
+		{
+			desc:            "the flushed reports are sent",
+			activeRequests:  []int{0},
+			drainStatus:     http.StatusOK,
+			flushStatus:     http.StatusOK,
+			pendingCalls:    []int{2, 1, 0},
+			timeout:         time.Minute,
+			wantStatsCalls:  4,
+			wantAdminCalled: []string{"/healthcheck/fail", "/drain_listeners?graceful", "/stats", flushReportsPath, "/stats", "/stats", "/stats"},
+		},
+		{
+			desc:           "the flushed reports remain after the flush timeout",
+			activeRequests: []int{0},
+			drainStatus:    http.StatusOK,
+			flushStatus:    http.StatusOK,
+			pendingCalls:   []int{1},
+			timeout:        time.Minute,
+			wantStatsCalls: -1,
+		},
+		{
+			desc:            "the reports fail to flush",
+			activeRequests:  []int{0},
+			drainStatus:     http.StatusOK,
+			flushStatus:     http.StatusInternalServerError,
+			timeout:         time.Minute,
+			wantStatsCalls:  1,
+			wantAdminCalled: []string{"/healthcheck/fail", "/drain_listeners?graceful", "/stats", flushReportsPath},
+		},
+		{
+			desc:            "listeners fail to drain",
+			drainStatus:     http.StatusInternalServerError,
+			timeout:         time.Minute,
+			wantError:       "fail to drain the listeners of envoy",
+			wantAdminCalled: []string{"/healthcheck/fail", "/drain_listeners?graceful"},
+		},
+	}
+
+	for _, tc := range testData {
+		var mu sync.Mutex
+		var gotAdminCalled []string
+		statsCalls, pendingCalls := 0, 0
+		admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			gotAdminCalled = append(gotAdminCalled, r.URL.RequestURI())
+			switch r.URL.Path {
+			case "/drain_listeners":
+				w.WriteHeader(tc.drainStatus)
+			case flushReportsPath:
+				w.WriteHeader(tc.flushStatus)
+			case "/stats":
+				gotAdminCalled[len(gotAdminCalled)-1] = "/stats"
+				statsCalls++
+				if strings.Contains(r.URL.Query().Get("filter"), "service_control") {
+					pending := tc.pendingCalls[len(tc.pendingCalls)-1]
+					if pendingCalls < len(tc.pendingCalls) {
+						pending = tc.pendingCalls[pendingCalls]
+					}
+					pendingCalls++
+					fmt.Fprintf(w, "cluster.service-control-cluster.upstream_rq_active: %d\ncluster.service-control-cluster.upstream_rq_total: 10\n%s: 0\n", pending, reportFlushesPendingStat)
+					return
+				}
+				active := tc.activeRequests[len(tc.activeRequests)-1]
+				if statsCalls-pendingCalls-1 < len(tc.activeRequests) {
+					active = tc.activeRequests[statsCalls-pendingCalls-1]
+				}
+				fmt.Fprintf(w, "http.admin.downstream_rq_active: 1\nhttp.ingress_http.downstream_rq_active: %d\nhttp.ingress_http.rq_total: 10\n", active)
+			}
+		}))
+
+		host, port, _ := net.SplitHostPort(strings.TrimPrefix(admin.URL, "http://"))
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.AdminAddress = host
+		opts.AdminPort, _ = strconv.Atoi(port)
+		logger, err := newStructuredLogger(opts.LogFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &ConfigManager{envoyConfigOptions: opts, logger: logger}
+
+		err = m.DrainEnvoy(tc.timeout)
+		admin.Close()
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+			}
+		} else if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+		// The calls of a timed out flush depend on the timing.
+		if tc.wantStatsCalls < 0 {
+			continue
+		}
+		if statsCalls != tc.wantStatsCalls {
+			t.Errorf("Test (%s): want %d calls of /stats, get %d", tc.desc, tc.wantStatsCalls, statsCalls)
+		}
+		if !reflect.DeepEqual(gotAdminCalled, tc.wantAdminCalled) {
+			t.Errorf("Test (%s): want admin calls %v, get %v", tc.desc, tc.wantAdminCalled, gotAdminCalled)
+		}
+	}
+}
+
+func TestEnvoyAdminURL(t *testing.T) {
+	testData := []struct {
+		desc         string
+		adminAddress string
+		wantURL      string
+	}{
+		{
+			desc:         "all ipv4 addresses",
+			adminAddress: "0.0.0.0",
+			wantURL:      "http://127.0.0.1:8001",
+		},
+		{
+			desc:         "all ipv6 addresses",
+			adminAddress: "::",
+			wantURL:      "http://[::1]:8001",
+		},
+		{
+			desc:         "specific address",
+			adminAddress: "10.0.0.1",
+			wantURL:      "http://10.0.0.1:8001",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.AdminAddress = tc.adminAddress
+		opts.AdminPort = 8001
+		m := &ConfigManager{envoyConfigOptions: opts}
+		if got := m.envoyAdminURL(); got != tc.wantURL {
+			t.Errorf("Test (%s): want admin url %s, get %s", tc.desc, tc.wantURL, got)
+		}
+	}
+}
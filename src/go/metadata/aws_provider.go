@@ -0,0 +1,92 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+)
+
+const (
+	awsSessionTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	awsSessionTokenHeader    = "X-aws-ec2-metadata-token"
+	awsSessionTokenTTL       = "60"
+)
+
+// awsProvider fetches instance attributes from the EC2 instance metadata
+// service (IMDSv2). Access tokens are read from a file.
+type awsProvider struct {
+	*tokenFile
+	client  http.Client
+	baseUrl string
+}
+
+func newAwsProvider(opts options.CommonOptions) (*awsProvider, error) {
+	tf, err := newTokenFile(opts.MetadataTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return &awsProvider{
+		tokenFile: tf,
+		client: http.Client{
+			Timeout: opts.HttpRequestTimeout,
+		},
+		baseUrl: opts.MetadataURL,
+	}, nil
+}
+
+func (p *awsProvider) do(req *http.Request) (string, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed fetching AWS metadata: %v, status code %v", req.URL, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (p *awsProvider) FetchGCPAttributes() (*scpb.GcpAttributes, error) {
+	req, _ := http.NewRequest(http.MethodPut, p.baseUrl+util.AWSSessionTokenPath, nil)
+	req.Header.Add(awsSessionTokenTTLHeader, awsSessionTokenTTL)
+	sessionToken, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, p.baseUrl+util.AWSAvailabilityZonePath, nil)
+	req.Header.Add(awsSessionTokenHeader, sessionToken)
+	zone, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scpb.GcpAttributes{
+		Zone:     zone,
+		Platform: util.AWS,
+	}, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+)
+
+type azureComputeResponse struct {
+	Location string `json:"location"`
+	Zone     string `json:"zone"`
+}
+
+// azureProvider fetches instance attributes from the Azure instance metadata
+// service. Access tokens are read from a file.
+type azureProvider struct {
+	*tokenFile
+	client  http.Client
+	baseUrl string
+}
+
+func newAzureProvider(opts options.CommonOptions) (*azureProvider, error) {
+	tf, err := newTokenFile(opts.MetadataTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return &azureProvider{
+		tokenFile: tf,
+		client: http.Client{
+			Timeout: opts.HttpRequestTimeout,
+		},
+		baseUrl: opts.MetadataURL,
+	}, nil
+}
+
+func (p *azureProvider) FetchGCPAttributes() (*scpb.GcpAttributes, error) {
+	path := p.baseUrl + util.AzureComputePath
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	req.Header.Add("Metadata", "true")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed fetching Azure metadata: %v, status code %v", path, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var compute azureComputeResponse
+	if err := json.Unmarshal(body, &compute); err != nil {
+		return nil, fmt.Errorf("fail to parse Azure metadata: %v", err)
+	}
+
+	// Zone is empty for instances not deployed into an availability zone.
+	zone := compute.Location
+	if compute.Zone != "" {
+		zone = fmt.Sprintf("%s-%s", compute.Location, compute.Zone)
+	}
+	return &scpb.GcpAttributes{
+		Zone:     zone,
+		Platform: util.Azure,
+	}, nil
+}
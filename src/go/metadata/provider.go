@@ -0,0 +1,120 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+)
+
+const (
+	// Expiration used for tokens read from a file without an explicit expiry.
+	staticTokenExpiry = 5 * time.Minute
+)
+
+// Provider abstracts the platform that the proxy runs on. It supplies the
+// access token used to call Google services and the instance attributes
+// reported to Service Control.
+type Provider interface {
+	FetchAccessToken() (string, time.Duration, error)
+	FetchGCPAttributes() (*scpb.GcpAttributes, error)
+}
+
+// NewProvider returns the Provider selected by opts.MetadataProvider.
+var NewProvider = func(opts options.CommonOptions) (Provider, error) {
+	switch opts.MetadataProvider {
+	case "", util.GCPMetadataProvider:
+		return NewMetadataFetcher(opts), nil
+	case util.AWSMetadataProvider:
+		return newAwsProvider(opts)
+	case util.AzureMetadataProvider:
+		return newAzureProvider(opts)
+	case util.StaticTokenFileProvider:
+		return newStaticTokenFileProvider(opts)
+	default:
+		return nil, fmt.Errorf(`unknown metadata provider %q, must be one of "gcp", "aws", "azure" or "static_token_file"`, opts.MetadataProvider)
+	}
+}
+
+// tokenFile reads access tokens from a file that is kept up to date by
+// another process, e.g. a credential sidecar.
+type tokenFile struct {
+	path string
+}
+
+func newTokenFile(path string) (*tokenFile, error) {
+	if path == "" {
+		return nil, fmt.Errorf("--metadata_token_file must be specified for non-GCP metadata providers")
+	}
+	return &tokenFile{
+		path: path,
+	}, nil
+}
+
+func (f *tokenFile) FetchAccessToken() (string, time.Duration, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", 0, fmt.Errorf("fail to read token file %s: %v", f.path, err)
+	}
+
+	content := strings.TrimSpace(string(data))
+	if content == "" {
+		return "", 0, fmt.Errorf("token file %s is empty", f.path)
+	}
+
+	if strings.HasPrefix(content, "{") {
+		var resp metadataTokenResponse
+		if err := json.Unmarshal([]byte(content), &resp); err != nil {
+			return "", 0, fmt.Errorf("fail to parse token file %s: %v", f.path, err)
+		}
+		if resp.AccessToken == "" {
+			return "", 0, fmt.Errorf("token file %s has no access_token", f.path)
+		}
+		if resp.ExpiresIn <= 0 {
+			return resp.AccessToken, staticTokenExpiry, nil
+		}
+		return resp.AccessToken, time.Duration(resp.ExpiresIn) * time.Second, nil
+	}
+
+	return content, staticTokenExpiry, nil
+}
+
+// staticTokenFileProvider only supplies access tokens, no instance attributes
+// are available.
+type staticTokenFileProvider struct {
+	*tokenFile
+}
+
+func newStaticTokenFileProvider(opts options.CommonOptions) (*staticTokenFileProvider, error) {
+	tf, err := newTokenFile(opts.MetadataTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return &staticTokenFileProvider{
+		tokenFile: tf,
+	}, nil
+}
+
+func (p *staticTokenFileProvider) FetchGCPAttributes() (*scpb.GcpAttributes, error) {
+	return nil, fmt.Errorf("instance attributes are not available from a static token file")
+}
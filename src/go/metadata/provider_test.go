@@ -0,0 +1,272 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+)
+
+func TestNewProvider(t *testing.T) {
+	testData := []struct {
+		desc              string
+		provider          string
+		tokenFile         string
+		wantProviderError string
+	}{
+		{
+			desc:     "Empty provider defaults to GCP",
+			provider: "",
+		},
+		{
+			desc:     "GCP provider",
+			provider: util.GCPMetadataProvider,
+		},
+		{
+			desc:      "AWS provider",
+			provider:  util.AWSMetadataProvider,
+			tokenFile: "/tmp/token",
+		},
+		{
+			desc:      "Azure provider",
+			provider:  util.AzureMetadataProvider,
+			tokenFile: "/tmp/token",
+		},
+		{
+			desc:      "Static token file provider",
+			provider:  util.StaticTokenFileProvider,
+			tokenFile: "/tmp/token",
+		},
+		{
+			desc:              "Non-GCP provider without token file",
+			provider:          util.AWSMetadataProvider,
+			wantProviderError: "--metadata_token_file must be specified",
+		},
+		{
+			desc:              "Unknown provider",
+			provider:          "openstack",
+			wantProviderError: `unknown metadata provider "openstack"`,
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultCommonOptions()
+		opts.MetadataProvider = tc.provider
+		opts.MetadataTokenFile = tc.tokenFile
+
+		p, err := NewProvider(opts)
+		if tc.wantProviderError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantProviderError) {
+				t.Errorf("Test (%s): expected err: %v, got: %v", tc.desc, tc.wantProviderError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+		if p == nil {
+			t.Errorf("Test (%s): got nil provider", tc.desc)
+		}
+	}
+}
+
+func TestTokenFileFetchAccessToken(t *testing.T) {
+	testData := []struct {
+		desc               string
+		content            string
+		expectedToken      string
+		expectedExpiration time.Duration
+		wantError          string
+	}{
+		{
+			desc:               "Raw token",
+			content:            "ya29.raw\n",
+			expectedToken:      "ya29.raw",
+			expectedExpiration: staticTokenExpiry,
+		},
+		{
+			desc:               "JSON token with expiration",
+			content:            fakeToken,
+			expectedToken:      "ya29.new",
+			expectedExpiration: 3599 * time.Second,
+		},
+		{
+			desc:               "JSON token without expiration",
+			content:            `{"access_token": "ya29.json"}`,
+			expectedToken:      "ya29.json",
+			expectedExpiration: staticTokenExpiry,
+		},
+		{
+			desc:      "JSON token without access_token",
+			content:   `{"expires_in": 10}`,
+			wantError: "has no access_token",
+		},
+		{
+			desc:      "Empty file",
+			content:   "  ",
+			wantError: "is empty",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "token_file")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range testData {
+		path := filepath.Join(dir, "token")
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatalf("fail to write token file: %v", err)
+		}
+
+		tf, _ := newTokenFile(path)
+		token, expires, err := tf.FetchAccessToken()
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): expected err: %v, got: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+		if token != tc.expectedToken || expires != tc.expectedExpiration {
+			t.Errorf("Test (%s): expected token: %v, expiration: %v, got token: %v, expiration: %v", tc.desc, tc.expectedToken, tc.expectedExpiration, token, expires)
+		}
+	}
+}
+
+func TestAwsProviderFetchGCPAttributes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == util.AWSSessionTokenPath:
+			if r.Header.Get(awsSessionTokenTTLHeader) == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("session-token"))
+		case r.Method == http.MethodGet && r.URL.Path == util.AWSAvailabilityZonePath:
+			if r.Header.Get(awsSessionTokenHeader) != "session-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("us-east-1a"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	opts := options.DefaultCommonOptions()
+	opts.MetadataURL = ts.URL
+	opts.MetadataTokenFile = "/tmp/token"
+	p, err := newAwsProvider(opts)
+	if err != nil {
+		t.Fatalf("fail to create AWS provider: %v", err)
+	}
+
+	attrs, err := p.FetchGCPAttributes()
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	want := &scpb.GcpAttributes{
+		Zone:     "us-east-1a",
+		Platform: util.AWS,
+	}
+	if !proto.Equal(attrs, want) {
+		t.Errorf("expected attributes: %v, got: %v", want, attrs)
+	}
+}
+
+func TestAzureProviderFetchGCPAttributes(t *testing.T) {
+	testData := []struct {
+		desc                  string
+		resp                  string
+		statusCode            int
+		expectedGCPAttributes *scpb.GcpAttributes
+		wantError             string
+	}{
+		{
+			desc:       "Zonal instance",
+			resp:       `{"location": "westus2", "zone": "1"}`,
+			statusCode: http.StatusOK,
+			expectedGCPAttributes: &scpb.GcpAttributes{
+				Zone:     "westus2-1",
+				Platform: util.Azure,
+			},
+		},
+		{
+			desc:       "Regional instance",
+			resp:       `{"location": "westus2", "zone": ""}`,
+			statusCode: http.StatusOK,
+			expectedGCPAttributes: &scpb.GcpAttributes{
+				Zone:     "westus2",
+				Platform: util.Azure,
+			},
+		},
+		{
+			desc:       "Metadata server failure",
+			statusCode: http.StatusInternalServerError,
+			wantError:  "failed fetching Azure metadata",
+		},
+	}
+
+	for _, tc := range testData {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("api-version") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(tc.statusCode)
+			w.Write([]byte(tc.resp))
+		}))
+
+		opts := options.DefaultCommonOptions()
+		opts.MetadataURL = ts.URL
+		opts.MetadataTokenFile = "/tmp/token"
+		p, _ := newAzureProvider(opts)
+
+		attrs, err := p.FetchGCPAttributes()
+		ts.Close()
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): expected err: %v, got: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+		if !proto.Equal(attrs, tc.expectedGCPAttributes) {
+			t.Errorf("Test (%s): expected attributes: %v, got: %v", tc.desc, tc.expectedGCPAttributes, attrs)
+		}
+	}
+}
@@ -24,6 +24,8 @@ type AdsBootstrapperOptions struct {
 
 	// Flags for ADS
 	AdsConnectTimeout time.Duration
+	// If true, Envoy uses the incremental variant of ADS.
+	EnableDeltaXds bool
 }
 
 // DefaultAdsBootstrapperOptions returns AdsBootstrapperOptions with default values.
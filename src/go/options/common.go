@@ -29,7 +29,9 @@ type CommonOptions struct {
 	GeneratedHeaderPrefix string
 
 	// Flags for tracing
-	DisableTracing             bool
+	DisableTracing bool
+	// The tracer to export spans to, one of "stackdriver" or "zipkin".
+	TracingProvider            string
 	TracingProjectId           string
 	TracingStackdriverAddress  string
 	TracingSamplingRate        float64
@@ -39,12 +41,29 @@ type CommonOptions struct {
 	TracingMaxNumAnnotations   int64
 	TracingMaxNumMessageEvents int64
 	TracingMaxNumLinks         int64
+	// The Zipkin compatible collector, e.g. Zipkin or Jaeger, used when
+	// TracingProvider is "zipkin".
+	TracingZipkinCollectorAddress  string
+	TracingZipkinSharedSpanContext bool
+	TracingZipkinTraceId128Bit     bool
+
+	// Flags for stats sinks
+	// The UDP address, IP:PORT, of the StatsD server to flush the stats to.
+	StatsdAddress string
+	StatsdPrefix  string
+	// The format of the stat tags, one of "statsd" or "dogstatsd".
+	StatsdTagFormat string
 
 	// Flags for metadata
 	NonGCP             bool
 	HttpRequestTimeout time.Duration
 	MetadataURL        string
 	IamURL             string
+	// The platform that provides instance attributes and access tokens.
+	// One of "gcp", "aws", "azure" or "static_token_file".
+	MetadataProvider string
+	// File that holds the access token when the metadata provider is not GCP.
+	MetadataTokenFile string
 	// Configures the identity used when making requests to Service Control.
 	ServiceControlCredentials *IAMCredentialsOptions
 	// Configures the identity used when making requests to backends.
@@ -84,16 +103,20 @@ func DefaultCommonOptions() CommonOptions {
 		// b/148454048: This should be at least 20s due to IMDS latency issues with k8s workload identities.
 		HttpRequestTimeout: 30 * time.Second,
 
-		Node:                       "ESPv2",
-		TracingSamplingRate:        0.001,
-		TracingMaxNumAttributes:    32,
-		TracingMaxNumAnnotations:   32,
-		TracingMaxNumMessageEvents: 128,
-		TracingMaxNumLinks:         128,
-		TracingIncomingContext:     "traceparent,x-cloud-trace-context",
-		TracingOutgoingContext:     "traceparent,x-cloud-trace-context",
-		MetadataURL:                "http://169.254.169.254",
-		IamURL:                     "https://iamcredentials.googleapis.com",
-		GeneratedHeaderPrefix:      "X-Endpoint-",
+		Node:                           "ESPv2",
+		TracingProvider:                "stackdriver",
+		TracingZipkinSharedSpanContext: true,
+		StatsdTagFormat:                "statsd",
+		TracingSamplingRate:            0.001,
+		TracingMaxNumAttributes:        32,
+		TracingMaxNumAnnotations:       32,
+		TracingMaxNumMessageEvents:     128,
+		TracingMaxNumLinks:             128,
+		TracingIncomingContext:         "traceparent,x-cloud-trace-context",
+		TracingOutgoingContext:         "traceparent,x-cloud-trace-context",
+		MetadataURL:                    "http://169.254.169.254",
+		MetadataProvider:               "gcp",
+		IamURL:                         "https://iamcredentials.googleapis.com",
+		GeneratedHeaderPrefix:          "X-Endpoint-",
 	}
 }
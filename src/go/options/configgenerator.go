@@ -16,6 +16,7 @@ package options
 
 import (
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
@@ -37,6 +38,18 @@ type ConfigGeneratorOptions struct {
 	CorsExposeHeaders    string
 	CorsPreset           string
 
+	// The Access-Control-Max-Age of the preflight responses. Not sent if 0.
+	CorsMaxAge time.Duration
+	// Answers the preflight requests with Access-Control-Allow-Private-Network,
+	// allowing public websites to reach the service on a private network.
+	CorsAllowPrivateNetwork bool
+	// Answers the preflight requests with the headers of their
+	// Access-Control-Request-Headers, instead of CorsAllowHeaders.
+	CorsReflectRequestHeaders bool
+	// Answers the OPTIONS requests with direct responses from Envoy, so they
+	// don't need a local backend.
+	CorsPreflightDirectResponse bool
+
 	// Backend routing configurations.
 	BackendDnsLookupFamily string
 
@@ -45,10 +58,25 @@ type ConfigGeneratorOptions struct {
 
 	// Full URI to the backend: scheme, address/hostname, port
 	BackendAddress string
+	// How the Host header of the requests to the local backend is rewritten,
+	// one of "preserve" (the Host of the client), "backend_address" (the host
+	// of BackendAddress) or "literal" (BackendHostRewriteLiteral).
+	BackendHostRewrite        string
+	BackendHostRewriteLiteral string
 
 	// Network related configurations.
-	ListenerAddress                  string
-	Healthz                          string
+	ListenerAddress string
+	Healthz         string
+	// "proxy_only" returns 200 on the healthz path while the proxy is up,
+	// "backend_aware" fails it once the local backend is unhealthy.
+	HealthzMode string
+	// The service checked by the gRPC health checks of the local backend
+	// with the "backend_aware" HealthzMode. Empty for the whole server.
+	HealthzGrpcService string
+	// If true, the gRPC health checking protocol of the local gRPC backend is
+	// routed without authentication nor service control.
+	EnableGrpcHealthPassthrough bool
+
 	ServiceManagementURL             string
 	ServiceControlURL                string
 	ListenerPort                     int
@@ -63,37 +91,244 @@ type ConfigGeneratorOptions struct {
 	SslBackendClientCipherSuites     string
 	DnsResolverAddresses             string
 
+	// If set, the comma separated domains of the server certificate issued and
+	// renewed through ACME by the config manager, and served to the listener
+	// through SDS instead of the one of SslServerCertPath.
+	AcmeDomains string
+	// If not 0, the port of the plain HTTP listener serving the ACME HTTP-01
+	// challenges and redirecting the other requests to HTTPS.
+	AcmeHttpPort int
+
 	// Flags for non_gcp deployment.
 	ServiceAccountKey string
-	TokenAgentPort    uint
+	// The service account impersonated through the IAM Credentials API by the
+	// token agent, with its delegation chain, for the access tokens of Service
+	// Control and Service Management and the identity tokens of backend auth.
+	ImpersonateServiceAccount          string
+	ImpersonateServiceAccountDelegates []string
+	TokenAgentPort                     uint
+	// If not 0, the config manager serves the processed service config for
+	// debugging on this loopback port.
+	ConfigManagerDebugPort uint
+	// If not 0, the config manager serves its readiness on this port, ready
+	// once Envoy accepted a snapshot, and the metrics of the config
+	// translation.
+	ConfigManagerReadinessPort uint
+	// If true, the responses carry the operation and the backend cluster of
+	// the matched route, for debugging. It can be toggled at runtime on the
+	// debug port.
+	EnableRouteDebugHeaders bool
+	// If true, the virtual host has a virtual cluster per http pattern, named
+	// after its operation, so that Envoy breaks down the upstream request
+	// stats by operation.
+	EnableOperationVirtualClusters bool
+	// Comma-separated selectors of the operations in maintenance, whose
+	// routes return MaintenanceStatusCode without reaching the backend. It can
+	// be changed at runtime on the debug port.
+	MaintenanceSelectors string
+	// The status code of the operations in maintenance, 503 or 423.
+	MaintenanceStatusCode int
+	// The Retry-After of the responses of the operations in maintenance, not
+	// sent if 0.
+	MaintenanceRetryAfter time.Duration
+	// Comma-separated SELECTOR[=TTL] of the GET operations whose responses are
+	// cached by Envoy, fresh for ResponseCacheTtl if the TTL is omitted.
+	ResponseCacheSelectors string
+	ResponseCacheTtl       time.Duration
+	// Comma-separated query parameters and request headers of the cache key,
+	// in addition to the path and the API keys.
+	ResponseCacheKeyQueryParams string
+	ResponseCacheKeyHeaders     string
+	// Comma-separated selectors of the GET operations whose JSON responses
+	// get a strong ETag, answering the matching If-None-Match with a 304.
+	EtagSelectors string
+	// The max size of the response bodies buffered to compute their ETag,
+	// the larger ones get no ETag. If 0, not limited.
+	EtagMaxBodyBytes int
+	// Comma-separated selectors of the mutating operations whose requests are
+	// deduplicated by their IdempotencyKeyHeader for IdempotencyTtl.
+	IdempotencySelectors string
+	IdempotencyKeyHeader string
+	IdempotencyTtl       time.Duration
+	// The requests of each api key are limited by the tier of its consumer.
+	// RateLimitTiers is "TIER=REQUESTS/PERIOD,...", limiting each proxy, and
+	// RateLimitConsumerTiers "PROJECT_NUMBER=TIER,...". The other consumers
+	// get RateLimitDefaultTier.
+	RateLimitTiers         string
+	RateLimitConsumerTiers string
+	RateLimitDefaultTier   string
+	// If set, the consumer tiers are also limited by this gRPC rate limit
+	// service, shared by all the proxies.
+	RateLimitServiceAddress string
+	// Comma-separated SELECTOR=N of the operations with at most N requests in
+	// flight at a time in each proxy.
+	ConcurrencyLimits string
+	// If not 0, each proxy serves at most SpikeArrestRps requests per rolling
+	// second, smoothed over the second, with bursts of up to SpikeArrestBurst.
+	SpikeArrestRps   int
+	SpikeArrestBurst int
+	// Comma-separated case-insensitive substrings of the user agents and of
+	// the paths of the requests denied with a 403 Forbidden.
+	DenyUserAgents string
+	DenyPaths      string
+	// The requests of the operations in UploadSizeThresholds, as
+	// comma-separated SELECTOR=BYTES, with a larger content-length are routed
+	// to the backend at UploadBackendAddress.
+	UploadBackendAddress string
+	UploadSizeThresholds string
+	// The query parameters the routes of the operations match, in the format
+	// "SELECTOR=PARAM[:VALUE][,PARAM[:VALUE]...][;SELECTOR=...]". An operation
+	// with the http pattern of another one is routed ahead of it.
+	QueryParamMatchers string
+	// If true, the grpc-timeout header of the requests shortens their deadline.
+	// Envoy only reads it in the gRPC requests, including the transcoded ones,
+	// not in the requests to the HTTP backends.
+	HonorGrpcTimeoutHeader bool
+	// If true, the listener gets its routes from the config manager through
+	// RDS, so a route change doesn't drain the listener. The service control
+	// filter still changes the listener with every new config id.
+	EnableRds bool
+	// If true, the uri templates only ending with a "**" wildcard are matched
+	// with a regex like the others, instead of a path prefix.
+	ForceRegexRouteMatch bool
+	// If set, the operations of the apis with different versions can share
+	// their http patterns, and are routed by the api version in this request
+	// header. Requests without it are routed to the api listed first.
+	ApiVersionHeader string
+	// If set, e.g. to "/gateway/v1", the routes of the operations match their
+	// http patterns under this path prefix, which is stripped before the
+	// requests are forwarded to the backends.
+	ApiBasePath string
+	// If true, the lists derived from maps, e.g. the metric costs, and the
+	// clusters are sorted by name, so the generated configs are diffable.
+	DeterministicOutput bool
 
 	// Flags for external calls.
 	DisableOidcDiscovery    bool
 	DependencyErrorBehavior string
+	// The overall time for the retries of an OpenID Connect Discovery, 0 for
+	// no limit.
+	OpenIDDiscoveryBudget time.Duration
+	// If true, the providers failing OpenID Connect Discovery reject their
+	// tokens instead of failing the config generation, and their discovery is
+	// retried in the background.
+	DeferOpenIDDiscovery bool
+
+	// Additional locations to extract API keys from for all operations.
+	ApiKeyLocations string
+
+	// Callers allowed per operation, checked against the azp/email JWT claims.
+	// Format: "SELECTOR=CALLER[,CALLER...][;SELECTOR=...]".
+	JwtCallerAllowlist string
+
+	// Filters disabled per operation, in the format
+	// "SELECTOR=FILTER[,FILTER...][;SELECTOR=...]".
+	DisabledFilters string
 
 	// Flags for testing purpose.
 	SkipJwtAuthnFilter       bool
 	SkipServiceControlFilter bool
 
 	// Envoy configurations.
-	AccessLog       string
-	AccessLogFormat string
+	AccessLog           string
+	AccessLogFormat     string
+	AccessLogJsonFormat string
+	// Only log the requests with a response code not less than it, if not 0.
+	AccessLogMinStatusCode int
+
+	// The gRPC Access Log Service to stream the access log entries to.
+	AccessLogServiceAddress             string
+	AccessLogServiceBufferSizeBytes     int
+	AccessLogServiceBufferFlushInterval time.Duration
+	AccessLogServiceRequestHeaders      string
+	AccessLogServiceResponseHeaders     string
+
+	// Path of a local file to which the auth outcome of every request is
+	// written as JSON, distinct from the access log.
+	AuditLog string
+	// If true, the audit log entries are also streamed to the gRPC Access Log
+	// Service at AccessLogServiceAddress, under their own log names.
+	AuditLogToAccessLogService bool
+
+	// If not 0, the port of the listener serving the stats matching
+	// PrometheusStatsFilter in the Prometheus format on /metrics, bound to
+	// PrometheusMetricsAddress.
+	PrometheusMetricsPort    int
+	PrometheusMetricsAddress string
+	PrometheusStatsFilter    string
+
+	// The JSON object used as the body of the error responses generated by
+	// Envoy, and whether to add the response code details to it.
+	LocalReplyJsonFormat     string
+	LocalReplyIncludeDetails bool
+	// If set, the google.rpc.ErrorInfo of the error responses generated by
+	// Envoy has this domain and the extra metadata, as comma-separated
+	// KEY=VALUE. The google.rpc.Help of them links to LocalReplyHelpUrl.
+	LocalReplyErrorInfoDomain   string
+	LocalReplyErrorInfoMetadata string
+	LocalReplyHelpUrl           string
 
 	EnvoyUseRemoteAddress  bool
 	EnvoyXffNumTrustedHops int
 
+	// The format of the config manager logs, one of "text" or "json".
+	LogFormat string
+
+	// If set, the request ID is also sent in this header, besides x-request-id.
+	RequestIdHeader string
+	// Keep the x-request-id and RequestIdHeader of the incoming requests instead
+	// of generating them.
+	PreserveExternalRequestId bool
+	// Return the request ID in the responses.
+	AlwaysSetRequestIdInResponse bool
+
 	LogJwtPayloads            string
 	LogRequestHeaders         string
 	LogResponseHeaders        string
 	MinStreamReportIntervalMs uint64
+	// Send intermediate reports every MinStreamReportIntervalMs for streaming methods.
+	StreamIntermediateReports bool
+
+	// Labels added to service control Check and Report operations, both in the
+	// format "LABEL=VALUE[,LABEL=VALUE...]". For header labels, VALUE is the
+	// request header name.
+	ScCustomLabels string
+	ScHeaderLabels string
+
+	// Overrides of the trace sampling rate per operation, in the format
+	// "SELECTOR=RATE[,SELECTOR=RATE...]".
+	TracingOperationSampleRates string
+	// Span tags from static values and request headers, both in the format
+	// "TAG=VALUE[,TAG=VALUE...]". For header tags, VALUE is the request header name.
+	TracingCustomTags string
+	TracingHeaderTags string
+	// The span names of the operations, formatted with the placeholders
+	// {PREFIX}, {API}, {METHOD} and {HTTP_METHOD}. The other routes use the
+	// prefix alone. Without decorators, Envoy names the spans after the
+	// request.
+	TracingSpanNamePrefix    string
+	TracingSpanNameFormat    string
+	TracingDisableDecorators bool
+
+	// Redaction of the fields in service control Report, in the format
+	// "FIELD=ACTION[,FIELD=ACTION...]".
+	ScReportRedaction string
 
 	SuppressEnvoyHeaders          bool
 	UnderscoresInHeaders          bool
 	ServiceControlNetworkFailOpen bool
 	EnableGrpcForHttp1            bool
 	ConnectionBufferLimitBytes    int
+	// The per request buffer limit of the routes of google.api.HttpBody methods,
+	// not set if not positive.
+	HttpBodyBufferLimitBytes int
 
 	JwksCacheDurationInS int
+	// If set, the fetched JWKS documents and OpenID discovery results are
+	// persisted in this directory, and used for JwksCacheTtl when the identity
+	// providers are unavailable.
+	JwksCacheDir string
+	JwksCacheTtl time.Duration
 
 	ScCheckTimeoutMs  int
 	ScQuotaTimeoutMs  int
@@ -105,15 +340,112 @@ type ConfigGeneratorOptions struct {
 	ScQuotaRetries  int
 	ScReportRetries int
 
+	// How the backends with path_translation CONSTANT_ADDRESS get the query
+	// parameters of the original request, one of "preserve", "merge" or
+	// "drop", and the request header they get the original path in.
+	PathRewriteQueryParams        string
+	PathRewriteOriginalPathHeader string
+
+	// If true, the backends of the routes with a rewritten path or host get
+	// the original path, host and HTTP method of the request in headers.
+	ForwardOriginalPath   bool
+	ForwardOriginalHost   bool
+	ForwardOriginalMethod bool
+
+	// Rejects the service configs with usage, backend, authentication or system
+	// parameter rules whose selector is not a method of the apis, instead of
+	// creating a method for it.
+	StrictSelectorValidation bool
+
+	ScCheckCacheEntries      int
+	ScCheckCacheExpirationMs int
+	ScApiKeyGracePeriodMs    int
+	// The file persisting the API keys verified for the grace period.
+	ScApiKeyGraceCachePath string
+
+	// Skip the service control Check call for all methods, or for the
+	// comma-separated selectors, while still sending the Report.
+	ScSkipCheck          bool
+	ScSkipCheckSelectors string
+
+	// Log and report the JWT authentication, API key and quota failures of
+	// all methods, or of the comma-separated selectors, but still forward
+	// the requests.
+	AuditMode          bool
+	AuditModeSelectors string
+
+	// Comma-separated consumer info of the Check responses forwarded to the
+	// backend in the request headers, "project_number" and "api_key_hash".
+	BackendConsumerHeaders string
+
+	// Per-operation overrides of the service control network fail policy, Check timeout
+	// and retries, in the format "SELECTOR=KEY:VALUE[,KEY:VALUE...][;...]".
+	ScOperationOverrides string
+
+	// The timeouts and retries of the calls to the control-plane dependencies,
+	// in the format "CALLOUT=KEY:VALUE[,KEY:VALUE...][;...]".
+	CalloutPolicies string
+
+	// Request headers that the quota metric costs are multiplied by, in the
+	// format "SELECTOR=METRIC:HEADER[,METRIC:HEADER...][;...]".
+	QuotaCostHeaders string
+
+	// Default audience template for backend rules that do not set jwt_audience.
+	BackendAuthJwtAudienceTemplate string
+
 	ComputePlatformOverride string
+	// The project id and zone reported to service control instead of the ones
+	// of the metadata server, e.g. on GKE on-prem or other clouds.
+	GcpProjectIdOverride string
+	GcpZoneOverride      string
+	// A JSON file with the projectId, zone and platform reported to service
+	// control, overridden by the flags above.
+	GcpAttributesFile string
 
+	// Print options of the grpc_json_transcoder filter.
 	TranscodingAlwaysPrintPrimitiveFields   bool
 	TranscodingAlwaysPrintEnumsAsInts       bool
 	TranscodingPreserveProtoFieldNames      bool
 	TranscodingIgnoreQueryParameters        string
 	TranscodingIgnoreUnknownQueryParameters bool
+	// The query style of the repeated fields, "repeat" for
+	// "param=a&param=b" only, or "brackets" for "param[]=a&param[]=b" too.
+	TranscodingQueryArrayStyle string
+	// A local path or gs:// uri of a FileDescriptorSet used for transcoding
+	// instead of the one in the service config, or merged into it if
+	// TranscodingProtoDescriptorMerge is set.
+	TranscodingProtoDescriptor      string
+	TranscodingProtoDescriptorMerge bool
+	// The HTTP status codes of the transcoded gRPC errors, as comma-separated
+	// CODE:STATUS, and their per-operation overrides, as
+	// SELECTOR=CODE:STATUS[,CODE:STATUS...][;SELECTOR=...].
+	TranscodingGrpcStatusHttpCodes          string
+	TranscodingOperationGrpcStatusHttpCodes string
+	// The JSON request bodies of the transcoded methods are validated against
+	// the message types of the service config, and their unknown fields
+	// rejected, except the comma-separated operations of
+	// TranscodingBodyValidationOptOutSelectors.
+	TranscodingValidateRequestBody           bool
+	TranscodingRejectUnknownBodyFields       bool
+	TranscodingBodyValidationOptOutSelectors string
+	// The server streams of the transcoded methods streamed as newline
+	// delimited JSON or Server-Sent Events instead of a JSON array, as
+	// comma-separated SELECTOR=ndjson|sse.
+	TranscodingStreamFormats string
+	// The per-operation overrides of the print options, in the format
+	// "SELECTOR=OPTION:BOOL[,OPTION:BOOL...][;SELECTOR=...]". The operations
+	// of each distinct set of print options get a transcoder of their own.
+	TranscodingOperationPrintOptions string
 }
 
+// DefaultPrometheusStatsFilter keeps the request counts, the upstream
+// latencies and the filter errors.
+const DefaultPrometheusStatsFilter = `^(http\.ingress_http\.(downstream_rq_|downstream_cx_active|service_control\.|jwt_authn\.|rbac\.|backend_auth\.|path_matcher\.)|cluster\.backend-cluster-.*\.(upstream_rq_|upstream_cx_active)|server\.(live|uptime))`
+
+// DefaultTracingSpanNameFormat names the spans of the operations after their
+// short names, which collide across the APIs sharing a method name.
+const DefaultTracingSpanNameFormat = "{PREFIX} {METHOD}"
+
 // DefaultConfigGeneratorOptions returns ConfigGeneratorOptions with default values.
 //
 // The default values are expected to match the default values from the flags.
@@ -122,12 +454,23 @@ func DefaultConfigGeneratorOptions() ConfigGeneratorOptions {
 	return ConfigGeneratorOptions{
 		CommonOptions:                    DefaultCommonOptions(),
 		BackendDnsLookupFamily:           "auto",
+		TranscodingQueryArrayStyle:       util.QueryArrayStyleRepeat,
+		CorsMaxAge:                       480 * time.Hour,
 		BackendAddress:                   fmt.Sprintf("http://%s:8082", util.LoopbackIPv4Addr),
 		ClusterConnectTimeout:            20 * time.Second,
 		EnvoyXffNumTrustedHops:           2,
 		JwksCacheDurationInS:             300,
+		JwksCacheTtl:                     24 * time.Hour,
 		ListenerAddress:                  "0.0.0.0",
 		ListenerPort:                     8080,
+		HealthzMode:                      util.ProxyOnlyHealthzMode,
+		MaintenanceStatusCode:            http.StatusServiceUnavailable,
+		MaintenanceRetryAfter:            60 * time.Second,
+		ResponseCacheTtl:                 60 * time.Second,
+		EtagMaxBodyBytes:                 1 << 20,
+		IdempotencyKeyHeader:             "Idempotency-Key",
+		IdempotencyTtl:                   10 * time.Minute,
+		RateLimitDefaultTier:             "default",
 		TokenAgentPort:                   8791,
 		DisableOidcDiscovery:             false,
 		DependencyErrorBehavior:          commonpb.DependencyErrorBehavior_BLOCK_INIT_ON_ANY_ERROR.String(),
@@ -137,12 +480,26 @@ func DefaultConfigGeneratorOptions() ConfigGeneratorOptions {
 		ServiceControlNetworkFailOpen:    true,
 		EnableGrpcForHttp1:               true,
 		ConnectionBufferLimitBytes:       -1,
+		HttpBodyBufferLimitBytes:         -1,
 		ServiceManagementURL:             "https://servicemanagement.googleapis.com",
 		ServiceControlURL:                "https://servicecontrol.googleapis.com",
 		BackendRetryNum:                  1,
 		BackendRetryOns:                  "reset,connect-failure,refused-stream",
+		PathRewriteQueryParams:           "preserve",
+		BackendHostRewrite:               "preserve",
 		ScCheckRetries:                   -1,
 		ScQuotaRetries:                   -1,
 		ScReportRetries:                  -1,
+		PrometheusMetricsAddress:         util.LoopbackIPv4Addr,
+		PrometheusStatsFilter:            DefaultPrometheusStatsFilter,
+		TracingSpanNamePrefix:            util.SpanNamePrefix,
+		TracingSpanNameFormat:            DefaultTracingSpanNameFormat,
+		LogFormat:                        "text",
 	}
 }
+
+// UsesTokenAgent returns true if Envoy gets the access tokens from the local
+// token agent instead of the metadata server.
+func (o ConfigGeneratorOptions) UsesTokenAgent() bool {
+	return o.ServiceAccountKey != "" || o.ImpersonateServiceAccount != "" || !util.IsGCPMetadataProvider(o.MetadataProvider)
+}
@@ -0,0 +1,320 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcreflection synthesizes the service config of a gRPC backend
+// from its server reflection service, for the backends without a published
+// service config.
+package grpcreflection
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	apipb "google.golang.org/genproto/protobuf/api"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+const typeUrlPrefix = "type.googleapis.com/"
+
+// The services of the backend not served through the proxy.
+var ignoredServices = map[string]bool{
+	"grpc.reflection.v1alpha.ServerReflection": true,
+}
+
+// FetchServiceConfig discovers the services of the gRPC backend through its
+// reflection service, and synthesizes their service config:
+//   - Each service is an api with its methods, their message types and
+//     streaming flags. They are routed on their default POST paths.
+//   - The google.api.http options of the methods are their http rules, for
+//     gRPC-JSON transcoding.
+//   - The descriptors of the service protos and their dependencies are the
+//     FileDescriptorSet for transcoding.
+//   - The calls are allowed without API keys.
+//
+// The config id is derived from the descriptors, so it changes with the
+// protos of the backend.
+func FetchServiceConfig(ctx context.Context, conn *grpc.ClientConn, serviceName string) (*confpb.Service, error) {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fail to call the reflection service of the backend: %v", err)
+	}
+	defer func() {
+		_ = stream.CloseSend()
+	}()
+	c := &reflectionClient{
+		stream: stream,
+		files:  make(map[string]*descpb.FileDescriptorProto),
+	}
+
+	services, err := c.listServices()
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("the backend reflection service lists no service")
+	}
+	for _, service := range services {
+		if err := c.loadFiles(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service},
+		}); err != nil {
+			return nil, fmt.Errorf("fail to get the descriptor of service %s: %v", service, err)
+		}
+	}
+	if err := c.loadDependencies(); err != nil {
+		return nil, err
+	}
+
+	return c.makeServiceConfig(serviceName, services)
+}
+
+type reflectionClient struct {
+	stream rpb.ServerReflection_ServerReflectionInfoClient
+	// The file descriptors by file name.
+	files map[string]*descpb.FileDescriptorProto
+}
+
+func (c *reflectionClient) call(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+	if err := c.stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := c.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if errResp := resp.GetErrorResponse(); errResp != nil {
+		return nil, fmt.Errorf("reflection error %d: %s", errResp.GetErrorCode(), errResp.GetErrorMessage())
+	}
+	return resp, nil
+}
+
+// listServices returns the names of the services of the backend, sorted.
+func (c *reflectionClient) listServices() ([]string, error) {
+	resp, err := c.call(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to list the services of the backend: %v", err)
+	}
+
+	var services []string
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		if !ignoredServices[service.GetName()] {
+			services = append(services, service.GetName())
+		}
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+func (c *reflectionClient) loadFiles(req *rpb.ServerReflectionRequest) error {
+	resp, err := c.call(req)
+	if err != nil {
+		return err
+	}
+	for _, data := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		file := &descpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(data, file); err != nil {
+			return fmt.Errorf("invalid file descriptor: %v", err)
+		}
+		c.files[file.GetName()] = file
+	}
+	return nil
+}
+
+// loadDependencies gets the files imported by the loaded ones, which the
+// server may not have sent along.
+func (c *reflectionClient) loadDependencies() error {
+	for {
+		var missing []string
+		for _, file := range c.files {
+			for _, dep := range file.GetDependency() {
+				if _, ok := c.files[dep]; !ok {
+					missing = append(missing, dep)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+
+		sort.Strings(missing)
+		for _, name := range missing {
+			if _, ok := c.files[name]; ok {
+				continue
+			}
+			if err := c.loadFiles(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: name},
+			}); err != nil {
+				return fmt.Errorf("fail to get the descriptor of file %s: %v", name, err)
+			}
+			if _, ok := c.files[name]; !ok {
+				return fmt.Errorf("the backend reflection service doesn't return file %s", name)
+			}
+		}
+	}
+}
+
+// orderedFiles returns the files with their dependencies first, as the
+// transcoder builds them in order.
+func (c *reflectionClient) orderedFiles() []*descpb.FileDescriptorProto {
+	var names []string
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ordered []*descpb.FileDescriptorProto
+	added := make(map[string]bool)
+	var add func(name string)
+	add = func(name string) {
+		if added[name] {
+			return
+		}
+		added[name] = true
+		file := c.files[name]
+		for _, dep := range file.GetDependency() {
+			add(dep)
+		}
+		ordered = append(ordered, file)
+	}
+	for _, name := range names {
+		add(name)
+	}
+	return ordered
+}
+
+// findService returns the descriptor of the service by its full name.
+func (c *reflectionClient) findService(fullName string) *descpb.ServiceDescriptorProto {
+	for _, file := range c.files {
+		for _, service := range file.GetService() {
+			name := service.GetName()
+			if file.GetPackage() != "" {
+				name = file.GetPackage() + "." + name
+			}
+			if name == fullName {
+				return service
+			}
+		}
+	}
+	return nil
+}
+
+func (c *reflectionClient) makeServiceConfig(serviceName string, services []string) (*confpb.Service, error) {
+	descriptorSet, err := proto.Marshal(&descpb.FileDescriptorSet{File: c.orderedFiles()})
+	if err != nil {
+		return nil, fmt.Errorf("fail to marshal the file descriptor set: %v", err)
+	}
+	sum := sha256.Sum256(descriptorSet)
+
+	serviceConfig := &confpb.Service{
+		Name:      serviceName,
+		Id:        "reflection-" + hex.EncodeToString(sum[:])[:12],
+		Endpoints: []*confpb.Endpoint{{Name: serviceName}},
+		Http:      &annotationspb.Http{},
+		Usage:     &confpb.Usage{},
+	}
+	for _, name := range services {
+		service := c.findService(name)
+		if service == nil {
+			return nil, fmt.Errorf("service %s is not in its file descriptor", name)
+		}
+
+		api := &apipb.Api{Name: name}
+		for _, method := range service.GetMethod() {
+			selector := name + "." + method.GetName()
+			api.Methods = append(api.Methods, &apipb.Method{
+				Name:              method.GetName(),
+				RequestTypeUrl:    typeUrlPrefix + strings.TrimPrefix(method.GetInputType(), "."),
+				RequestStreaming:  method.GetClientStreaming(),
+				ResponseTypeUrl:   typeUrlPrefix + strings.TrimPrefix(method.GetOutputType(), "."),
+				ResponseStreaming: method.GetServerStreaming(),
+			})
+			serviceConfig.Usage.Rules = append(serviceConfig.Usage.Rules, &confpb.UsageRule{
+				Selector:               selector,
+				AllowUnregisteredCalls: true,
+			})
+
+			rule, err := httpRule(method, fmt.Sprintf("/%s/%s", name, method.GetName()))
+			if err != nil {
+				return nil, fmt.Errorf("invalid google.api.http option of method %s: %v", selector, err)
+			}
+			if rule != nil {
+				rule.Selector = selector
+				serviceConfig.Http.Rules = append(serviceConfig.Http.Rules, rule)
+			}
+		}
+		serviceConfig.Apis = append(serviceConfig.Apis, api)
+	}
+
+	sourceFile, err := ptypes.MarshalAny(&smpb.ConfigFile{
+		FilePath:     "reflection.pb",
+		FileContents: descriptorSet,
+		FileType:     smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO,
+	})
+	if err != nil {
+		return nil, err
+	}
+	serviceConfig.SourceInfo = &confpb.SourceInfo{
+		SourceFiles: []*anypb.Any{sourceFile},
+	}
+	return serviceConfig, nil
+}
+
+// httpRule returns the google.api.http option of the method, if any, without
+// the bindings of its default gRPC path, which is always routed.
+func httpRule(method *descpb.MethodDescriptorProto, grpcPath string) (*annotationspb.HttpRule, error) {
+	if method.GetOptions() == nil || !proto.HasExtension(method.GetOptions(), annotationspb.E_Http) {
+		return nil, nil
+	}
+	ext, err := proto.GetExtension(method.GetOptions(), annotationspb.E_Http)
+	if err != nil {
+		return nil, err
+	}
+	rule, ok := ext.(*annotationspb.HttpRule)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %T", ext)
+	}
+	rule = proto.Clone(rule).(*annotationspb.HttpRule)
+
+	var bindings []*annotationspb.HttpRule
+	for _, binding := range rule.GetAdditionalBindings() {
+		if binding.GetPost() != grpcPath {
+			bindings = append(bindings, binding)
+		}
+	}
+	rule.AdditionalBindings = bindings
+	if rule.GetPost() == grpcPath {
+		if len(bindings) == 0 {
+			return nil, nil
+		}
+		// Promote the first other binding.
+		first := bindings[0]
+		first.AdditionalBindings = bindings[1:]
+		rule = first
+	}
+	return rule, nil
+}
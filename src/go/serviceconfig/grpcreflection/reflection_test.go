@@ -0,0 +1,145 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcreflection
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/reflection"
+
+	bookstorepb "github.com/GoogleCloudPlatform/esp-v2/tests/endpoints/bookstore_grpc/proto/v1"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func startBackend(t *testing.T, withReflection bool) *grpc.ClientConn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	bookstorepb.RegisterBookstoreServer(server, &bookstorepb.UnimplementedBookstoreServer{})
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	if withReflection {
+		reflection.Register(server)
+	}
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func TestFetchServiceConfig(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn := startBackend(t, true)
+
+	serviceConfig, err := FetchServiceConfig(ctx, conn, "bookstore.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if serviceConfig.GetName() != "bookstore.local" || !strings.HasPrefix(serviceConfig.GetId(), "reflection-") {
+		t.Errorf("want service bookstore.local with a reflection config id, get %s %s", serviceConfig.GetName(), serviceConfig.GetId())
+	}
+
+	var gotApis []string
+	for _, api := range serviceConfig.GetApis() {
+		gotApis = append(gotApis, api.GetName())
+	}
+	if wantApis := []string{"endpoints.examples.bookstore.Bookstore", "grpc.health.v1.Health"}; !reflect.DeepEqual(gotApis, wantApis) {
+		t.Errorf("want apis %v, get %v", wantApis, gotApis)
+	}
+
+	for _, method := range serviceConfig.GetApis()[1].GetMethods() {
+		if method.GetName() == "Watch" {
+			if method.GetRequestStreaming() || !method.GetResponseStreaming() {
+				t.Errorf("want Watch streaming the responses only, get %v", method)
+			}
+			if method.GetRequestTypeUrl() != "type.googleapis.com/grpc.health.v1.HealthCheckRequest" {
+				t.Errorf("want Watch request type grpc.health.v1.HealthCheckRequest, get %s", method.GetRequestTypeUrl())
+			}
+		}
+	}
+
+	var listShelves *annotationspb.HttpRule
+	for _, rule := range serviceConfig.GetHttp().GetRules() {
+		if rule.GetSelector() == "endpoints.examples.bookstore.Bookstore.ListShelves" {
+			listShelves = rule
+		}
+	}
+	if listShelves.GetGet() != "/v1/shelves" || len(listShelves.GetAdditionalBindings()) != 0 {
+		t.Errorf("want the http rule GET /v1/shelves of ListShelves, without its default gRPC path, get %v", listShelves)
+	}
+
+	if len(serviceConfig.GetUsage().GetRules()) == 0 || !serviceConfig.GetUsage().GetRules()[0].GetAllowUnregisteredCalls() {
+		t.Errorf("want the calls allowed without API keys, get %v", serviceConfig.GetUsage())
+	}
+
+	configFile := &smpb.ConfigFile{}
+	if err := ptypes.UnmarshalAny(serviceConfig.GetSourceInfo().GetSourceFiles()[0], configFile); err != nil {
+		t.Fatal(err)
+	}
+	if configFile.GetFileType() != smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO {
+		t.Errorf("want a file descriptor set, get %v", configFile.GetFileType())
+	}
+	descriptorSet := &descpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(configFile.GetFileContents(), descriptorSet); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, file := range descriptorSet.GetFile() {
+		for _, dep := range file.GetDependency() {
+			if !seen[dep] {
+				t.Errorf("want file %s before file %s importing it", dep, file.GetName())
+			}
+		}
+		seen[file.GetName()] = true
+	}
+	if !seen["google/api/annotations.proto"] {
+		t.Errorf("want the dependencies of the service protos, get files %v", seen)
+	}
+}
+
+func TestFetchServiceConfigWithoutReflection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn := startBackend(t, false)
+
+	_, err := FetchServiceConfig(ctx, conn, "bookstore.local")
+	if err == nil || !strings.Contains(err.Error(), "fail to list the services of the backend") {
+		t.Errorf("want error listing the services, get %v", err)
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package openapi converts an OpenAPI 3 document to the equivalent service
+// config, so ESPv2 can serve it without Service Management.
+package openapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+// The name of the system parameter of the API key locations.
+const apiKeyParameterName = "api_key"
+
+// The HTTP methods of a path item, in the order of their http rules.
+var httpMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+type document struct {
+	OpenAPI    string                `json:"openapi"`
+	Info       info                  `json:"info"`
+	Servers    []server              `json:"servers"`
+	Paths      map[string]*pathItem  `json:"paths"`
+	Components components            `json:"components"`
+	Security   []securityRequirement `json:"security"`
+	Backend    *backend              `json:"x-google-backend"`
+}
+
+type info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type server struct {
+	URL string `json:"url"`
+	// Marks the server whose host is the service name.
+	Endpoint json.RawMessage `json:"x-google-endpoint"`
+}
+
+type components struct {
+	SecuritySchemes map[string]*securityScheme `json:"securitySchemes"`
+}
+
+type pathItem struct {
+	Operations map[string]*operation
+	Backend    *backend
+}
+
+func (p *pathItem) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	p.Operations = make(map[string]*operation)
+	for _, method := range httpMethods {
+		if field, ok := fields[method]; ok {
+			op := &operation{}
+			if err := json.Unmarshal(field, op); err != nil {
+				return fmt.Errorf("invalid %s operation: %v", method, err)
+			}
+			p.Operations[method] = op
+		}
+	}
+	if field, ok := fields["x-google-backend"]; ok {
+		p.Backend = &backend{}
+		if err := json.Unmarshal(field, p.Backend); err != nil {
+			return fmt.Errorf("invalid x-google-backend: %v", err)
+		}
+	}
+	return nil
+}
+
+type operation struct {
+	OperationID string `json:"operationId"`
+	// Nil if not set, so the document security applies. An empty list
+	// disables it.
+	Security    *[]securityRequirement `json:"security"`
+	RequestBody json.RawMessage        `json:"requestBody"`
+	Backend     *backend               `json:"x-google-backend"`
+}
+
+// securityRequirement maps the names of the security schemes to their scopes,
+// all of them are required.
+type securityRequirement map[string][]string
+
+type securityScheme struct {
+	Type string `json:"type"`
+	// The location of the API key of an apiKey scheme.
+	Name string `json:"name"`
+	In   string `json:"in"`
+	// The JWT provider of an oauth2, openIdConnect or http scheme.
+	Issuer    string `json:"x-google-issuer"`
+	JwksURI   string `json:"x-google-jwks_uri"`
+	Audiences string `json:"x-google-audiences"`
+}
+
+type backend struct {
+	Address         string  `json:"address"`
+	PathTranslation string  `json:"path_translation"`
+	Deadline        float64 `json:"deadline"`
+	JwtAudience     string  `json:"jwt_audience"`
+	DisableAuth     bool    `json:"disable_auth"`
+	Protocol        string  `json:"protocol"`
+}
+
+// IsOpenAPIDocument reports whether the JSON data is an OpenAPI 3 document.
+func IsOpenAPIDocument(data []byte) bool {
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	return strings.HasPrefix(doc.OpenAPI, "3.")
+}
+
+// ToServiceConfig converts an OpenAPI 3 document in JSON to a service config:
+//   - The service name is the host of the server with x-google-endpoint, or
+//     of the first server.
+//   - The config id is derived from the content of the document, so it
+//     changes with the document.
+//   - Each operation is a method named by its operationId, with its http
+//     rule.
+//   - The security schemes with x-google-issuer are the JWT providers, the
+//     apiKey ones are the API key locations of the operations requiring them.
+//   - x-google-backend of the operations, else of their paths, else of the
+//     document are the backend rules.
+//
+// The alternatives of a security requirement are merged: an operation accepts
+// any of their JWT providers, requires an API key if any of them does, and
+// allows requests without credential if one of them is empty.
+func ToServiceConfig(data []byte) (*confpb.Service, error) {
+	doc := &document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("fail to parse OpenAPI document: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q, only 3.x is supported", doc.OpenAPI)
+	}
+
+	serviceName, err := doc.serviceName()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	apiName := "1." + strings.ReplaceAll(serviceName, ".", "_")
+
+	serviceConfig := &confpb.Service{
+		Name:      serviceName,
+		Id:        "openapi-" + hex.EncodeToString(sum[:])[:12],
+		Title:     doc.Info.Title,
+		Endpoints: []*confpb.Endpoint{{Name: serviceName}},
+	}
+	api := &apipb.Api{
+		Name:    apiName,
+		Version: doc.Info.Version,
+	}
+	httpRules := &annotationspb.Http{}
+	authentication := &confpb.Authentication{}
+	backendRules := &confpb.Backend{}
+	usage := &confpb.Usage{}
+	systemParameters := &confpb.SystemParameters{}
+
+	providers, err := doc.authProviders()
+	if err != nil {
+		return nil, err
+	}
+	authentication.Providers = providers
+
+	var paths []string
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	operationIDs := make(map[string]string)
+	for _, path := range paths {
+		item := doc.Paths[path]
+		for _, method := range httpMethods {
+			op, ok := item.Operations[method]
+			if !ok {
+				continue
+			}
+			if op.OperationID == "" {
+				return nil, fmt.Errorf("operation %s %s has no operationId", strings.ToUpper(method), path)
+			}
+			name := sanitizeOperationID(op.OperationID)
+			if other, ok := operationIDs[name]; ok {
+				return nil, fmt.Errorf("operation %s %s has the same operationId %s as operation %s", strings.ToUpper(method), path, name, other)
+			}
+			operationIDs[name] = strings.ToUpper(method) + " " + path
+			selector := apiName + "." + name
+
+			api.Methods = append(api.Methods, &apipb.Method{Name: name})
+			httpRules.Rules = append(httpRules.Rules, makeHttpRule(selector, method, path, op))
+
+			security := doc.Security
+			if op.Security != nil {
+				security = *op.Security
+			}
+			authRule, requireApiKey, apiKeyParameters, err := doc.makeSecurity(selector, security)
+			if err != nil {
+				return nil, fmt.Errorf("operation %s: %v", op.OperationID, err)
+			}
+			if authRule != nil {
+				authentication.Rules = append(authentication.Rules, authRule)
+			}
+			usage.Rules = append(usage.Rules, &confpb.UsageRule{
+				Selector:               selector,
+				AllowUnregisteredCalls: !requireApiKey,
+			})
+			if len(apiKeyParameters) > 0 {
+				systemParameters.Rules = append(systemParameters.Rules, &confpb.SystemParameterRule{
+					Selector:   selector,
+					Parameters: apiKeyParameters,
+				})
+			}
+
+			// The backend of the document appends the operation path, the
+			// ones of the paths and operations are the full url.
+			b, pathTranslation := op.Backend, confpb.BackendRule_CONSTANT_ADDRESS
+			if b == nil {
+				b = item.Backend
+			}
+			if b == nil {
+				b, pathTranslation = doc.Backend, confpb.BackendRule_APPEND_PATH_TO_ADDRESS
+			}
+			if b != nil {
+				rule, err := makeBackendRule(selector, b, pathTranslation)
+				if err != nil {
+					return nil, fmt.Errorf("operation %s: %v", op.OperationID, err)
+				}
+				backendRules.Rules = append(backendRules.Rules, rule)
+			}
+		}
+	}
+	if len(api.Methods) == 0 {
+		return nil, fmt.Errorf("OpenAPI document has no operation")
+	}
+
+	serviceConfig.Apis = []*apipb.Api{api}
+	serviceConfig.Http = httpRules
+	if len(authentication.Providers) > 0 {
+		serviceConfig.Authentication = authentication
+	}
+	if len(backendRules.Rules) > 0 {
+		serviceConfig.Backend = backendRules
+	}
+	serviceConfig.Usage = usage
+	if len(systemParameters.Rules) > 0 {
+		serviceConfig.SystemParameters = systemParameters
+	}
+	return serviceConfig, nil
+}
+
+func (doc *document) serviceName() (string, error) {
+	if len(doc.Servers) == 0 {
+		return "", fmt.Errorf("OpenAPI document has no server to name the service")
+	}
+	s := doc.Servers[0]
+	for _, candidate := range doc.Servers {
+		if len(candidate.Endpoint) > 0 {
+			s = candidate
+			break
+		}
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid server url %q, its host is the service name", s.URL)
+	}
+	return u.Hostname(), nil
+}
+
+// authProviders returns the JWT providers of the security schemes, ordered by
+// name.
+func (doc *document) authProviders() ([]*confpb.AuthProvider, error) {
+	var names []string
+	for name := range doc.Components.SecuritySchemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var providers []*confpb.AuthProvider
+	for _, name := range names {
+		scheme := doc.Components.SecuritySchemes[name]
+		switch scheme.Type {
+		case "apiKey":
+			continue
+		case "oauth2", "openIdConnect", "http":
+		default:
+			return nil, fmt.Errorf("security scheme %s has unsupported type %q", name, scheme.Type)
+		}
+		if scheme.Issuer == "" {
+			return nil, fmt.Errorf("security scheme %s of type %s requires x-google-issuer", name, scheme.Type)
+		}
+		providers = append(providers, &confpb.AuthProvider{
+			Id:        name,
+			Issuer:    scheme.Issuer,
+			JwksUri:   scheme.JwksURI,
+			Audiences: scheme.Audiences,
+		})
+	}
+	return providers, nil
+}
+
+// makeSecurity converts the security requirement of an operation to its
+// authentication rule, whether it requires an API key, and the API key
+// locations.
+func (doc *document) makeSecurity(selector string, security []securityRequirement) (*confpb.AuthenticationRule, bool, []*confpb.SystemParameter, error) {
+	var rule *confpb.AuthenticationRule
+	requireApiKey := false
+	allowWithoutCredential := false
+	var apiKeyParameters []*confpb.SystemParameter
+	seen := make(map[string]bool)
+
+	for _, requirement := range security {
+		if len(requirement) == 0 {
+			allowWithoutCredential = true
+			continue
+		}
+		var names []string
+		for name := range requirement {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			scheme, ok := doc.Components.SecuritySchemes[name]
+			if !ok {
+				return nil, false, nil, fmt.Errorf("security scheme %s is not defined", name)
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			if scheme.Type == "apiKey" {
+				requireApiKey = true
+				parameter := &confpb.SystemParameter{Name: apiKeyParameterName}
+				switch scheme.In {
+				case "query":
+					parameter.UrlQueryParameter = scheme.Name
+				case "header":
+					parameter.HttpHeader = scheme.Name
+				default:
+					return nil, false, nil, fmt.Errorf("API key of security scheme %s must be in query or header, not %q", name, scheme.In)
+				}
+				apiKeyParameters = append(apiKeyParameters, parameter)
+				continue
+			}
+
+			if rule == nil {
+				rule = &confpb.AuthenticationRule{Selector: selector}
+			}
+			rule.Requirements = append(rule.Requirements, &confpb.AuthRequirement{
+				ProviderId: name,
+				Audiences:  scheme.Audiences,
+			})
+		}
+	}
+	if rule != nil {
+		rule.AllowWithoutCredential = allowWithoutCredential
+	}
+	if allowWithoutCredential {
+		requireApiKey = false
+	}
+	return rule, requireApiKey, apiKeyParameters, nil
+}
+
+func makeHttpRule(selector, method, path string, op *operation) *annotationspb.HttpRule {
+	rule := &annotationspb.HttpRule{Selector: selector}
+	switch method {
+	case "get":
+		rule.Pattern = &annotationspb.HttpRule_Get{Get: path}
+	case "put":
+		rule.Pattern = &annotationspb.HttpRule_Put{Put: path}
+	case "post":
+		rule.Pattern = &annotationspb.HttpRule_Post{Post: path}
+	case "delete":
+		rule.Pattern = &annotationspb.HttpRule_Delete{Delete: path}
+	case "patch":
+		rule.Pattern = &annotationspb.HttpRule_Patch{Patch: path}
+	default:
+		rule.Pattern = &annotationspb.HttpRule_Custom{
+			Custom: &annotationspb.CustomHttpPattern{
+				Kind: strings.ToUpper(method),
+				Path: path,
+			},
+		}
+	}
+	if len(op.RequestBody) > 0 {
+		rule.Body = "*"
+	}
+	return rule
+}
+
+// makeBackendRule converts x-google-backend, whose path translation defaults
+// to the given one.
+func makeBackendRule(selector string, b *backend, defaultPathTranslation confpb.BackendRule_PathTranslation) (*confpb.BackendRule, error) {
+	if b.Address == "" {
+		return nil, fmt.Errorf("x-google-backend requires an address")
+	}
+	rule := &confpb.BackendRule{
+		Selector:        selector,
+		Address:         b.Address,
+		Deadline:        b.Deadline,
+		PathTranslation: defaultPathTranslation,
+		Protocol:        b.Protocol,
+	}
+	if b.PathTranslation != "" {
+		translation, ok := confpb.BackendRule_PathTranslation_value[b.PathTranslation]
+		if !ok || translation == int32(confpb.BackendRule_PATH_TRANSLATION_UNSPECIFIED) {
+			return nil, fmt.Errorf("invalid path_translation %q of x-google-backend", b.PathTranslation)
+		}
+		rule.PathTranslation = confpb.BackendRule_PathTranslation(translation)
+	}
+	switch {
+	case b.DisableAuth && b.JwtAudience != "":
+		return nil, fmt.Errorf("x-google-backend cannot set both jwt_audience and disable_auth")
+	case b.DisableAuth:
+		rule.Authentication = &confpb.BackendRule_DisableAuth{DisableAuth: true}
+	case b.JwtAudience != "":
+		rule.Authentication = &confpb.BackendRule_JwtAudience{JwtAudience: b.JwtAudience}
+	}
+	return rule, nil
+}
+
+// sanitizeOperationID replaces the characters not allowed in a method name.
+func sanitizeOperationID(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, id)
+}
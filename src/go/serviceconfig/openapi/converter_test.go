@@ -0,0 +1,348 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestToServiceConfig(t *testing.T) {
+	testData := []struct {
+		desc      string
+		document  string
+		want      *confpb.Service
+		wantError string
+	}{
+		{
+			desc: "operations with http rules",
+			document: `{
+				"openapi": "3.0.3",
+				"info": {"title": "Bookstore", "version": "1.0.0"},
+				"servers": [{"url": "https://bookstore.example.com/v1"}],
+				"paths": {
+					"/shelves/{shelf}": {
+						"get": {"operationId": "GetShelf"},
+						"delete": {"operationId": "DeleteShelf"},
+						"head": {"operationId": "head-shelf"}
+					},
+					"/shelves": {
+						"post": {"operationId": "CreateShelf", "requestBody": {"content": {}}}
+					}
+				}
+			}`,
+			want: &confpb.Service{
+				Name:      "bookstore.example.com",
+				Title:     "Bookstore",
+				Endpoints: []*confpb.Endpoint{{Name: "bookstore.example.com"}},
+				Apis: []*apipb.Api{
+					{
+						Name:    "1.bookstore_example_com",
+						Version: "1.0.0",
+						Methods: []*apipb.Method{
+							{Name: "CreateShelf"},
+							{Name: "GetShelf"},
+							{Name: "DeleteShelf"},
+							{Name: "head_shelf"},
+						},
+					},
+				},
+				Http: &annotationspb.Http{
+					Rules: []*annotationspb.HttpRule{
+						{
+							Selector: "1.bookstore_example_com.CreateShelf",
+							Pattern:  &annotationspb.HttpRule_Post{Post: "/shelves"},
+							Body:     "*",
+						},
+						{
+							Selector: "1.bookstore_example_com.GetShelf",
+							Pattern:  &annotationspb.HttpRule_Get{Get: "/shelves/{shelf}"},
+						},
+						{
+							Selector: "1.bookstore_example_com.DeleteShelf",
+							Pattern:  &annotationspb.HttpRule_Delete{Delete: "/shelves/{shelf}"},
+						},
+						{
+							Selector: "1.bookstore_example_com.head_shelf",
+							Pattern: &annotationspb.HttpRule_Custom{
+								Custom: &annotationspb.CustomHttpPattern{Kind: "HEAD", Path: "/shelves/{shelf}"},
+							},
+						},
+					},
+				},
+				Usage: &confpb.Usage{
+					Rules: []*confpb.UsageRule{
+						{Selector: "1.bookstore_example_com.CreateShelf", AllowUnregisteredCalls: true},
+						{Selector: "1.bookstore_example_com.GetShelf", AllowUnregisteredCalls: true},
+						{Selector: "1.bookstore_example_com.DeleteShelf", AllowUnregisteredCalls: true},
+						{Selector: "1.bookstore_example_com.head_shelf", AllowUnregisteredCalls: true},
+					},
+				},
+			},
+		},
+		{
+			desc: "security schemes and backends",
+			document: `{
+				"openapi": "3.0.3",
+				"info": {"title": "Echo", "version": "2.0.0"},
+				"servers": [
+					{"url": "https://echo.example.com"},
+					{"url": "https://echo.endpoints.project123.cloud.goog", "x-google-endpoint": {}}
+				],
+				"security": [{"google_id_token": []}],
+				"x-google-backend": {"address": "https://echo-backend.run.app", "deadline": 10},
+				"components": {
+					"securitySchemes": {
+						"google_id_token": {
+							"type": "oauth2",
+							"x-google-issuer": "https://accounts.google.com",
+							"x-google-jwks_uri": "https://www.googleapis.com/oauth2/v3/certs",
+							"x-google-audiences": "echo-client"
+						},
+						"api_key": {"type": "apiKey", "name": "x-api-key", "in": "header"}
+					}
+				},
+				"paths": {
+					"/echo": {
+						"post": {
+							"operationId": "Echo",
+							"security": [{"api_key": []}, {}]
+						}
+					},
+					"/auth/info": {
+						"get": {
+							"operationId": "AuthInfo",
+							"security": [{"google_id_token": [], "api_key": []}],
+							"x-google-backend": {
+								"address": "https://auth-backend.run.app/info",
+								"jwt_audience": "auth-backend"
+							}
+						}
+					},
+					"/health": {
+						"x-google-backend": {
+							"address": "https://health-backend.run.app",
+							"path_translation": "APPEND_PATH_TO_ADDRESS",
+							"disable_auth": true
+						},
+						"get": {"operationId": "Health", "security": []}
+					}
+				}
+			}`,
+			want: &confpb.Service{
+				Name:      "echo.endpoints.project123.cloud.goog",
+				Title:     "Echo",
+				Endpoints: []*confpb.Endpoint{{Name: "echo.endpoints.project123.cloud.goog"}},
+				Apis: []*apipb.Api{
+					{
+						Name:    "1.echo_endpoints_project123_cloud_goog",
+						Version: "2.0.0",
+						Methods: []*apipb.Method{
+							{Name: "AuthInfo"},
+							{Name: "Echo"},
+							{Name: "Health"},
+						},
+					},
+				},
+				Http: &annotationspb.Http{
+					Rules: []*annotationspb.HttpRule{
+						{
+							Selector: "1.echo_endpoints_project123_cloud_goog.AuthInfo",
+							Pattern:  &annotationspb.HttpRule_Get{Get: "/auth/info"},
+						},
+						{
+							Selector: "1.echo_endpoints_project123_cloud_goog.Echo",
+							Pattern:  &annotationspb.HttpRule_Post{Post: "/echo"},
+						},
+						{
+							Selector: "1.echo_endpoints_project123_cloud_goog.Health",
+							Pattern:  &annotationspb.HttpRule_Get{Get: "/health"},
+						},
+					},
+				},
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:        "google_id_token",
+							Issuer:    "https://accounts.google.com",
+							JwksUri:   "https://www.googleapis.com/oauth2/v3/certs",
+							Audiences: "echo-client",
+						},
+					},
+					Rules: []*confpb.AuthenticationRule{
+						{
+							Selector: "1.echo_endpoints_project123_cloud_goog.AuthInfo",
+							Requirements: []*confpb.AuthRequirement{
+								{ProviderId: "google_id_token", Audiences: "echo-client"},
+							},
+						},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Selector:        "1.echo_endpoints_project123_cloud_goog.AuthInfo",
+							Address:         "https://auth-backend.run.app/info",
+							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+							Authentication:  &confpb.BackendRule_JwtAudience{JwtAudience: "auth-backend"},
+						},
+						{
+							Selector:        "1.echo_endpoints_project123_cloud_goog.Echo",
+							Address:         "https://echo-backend.run.app",
+							Deadline:        10,
+							PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+						},
+						{
+							Selector:        "1.echo_endpoints_project123_cloud_goog.Health",
+							Address:         "https://health-backend.run.app",
+							PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+							Authentication:  &confpb.BackendRule_DisableAuth{DisableAuth: true},
+						},
+					},
+				},
+				Usage: &confpb.Usage{
+					Rules: []*confpb.UsageRule{
+						{Selector: "1.echo_endpoints_project123_cloud_goog.AuthInfo"},
+						{Selector: "1.echo_endpoints_project123_cloud_goog.Echo", AllowUnregisteredCalls: true},
+						{Selector: "1.echo_endpoints_project123_cloud_goog.Health", AllowUnregisteredCalls: true},
+					},
+				},
+				SystemParameters: &confpb.SystemParameters{
+					Rules: []*confpb.SystemParameterRule{
+						{
+							Selector:   "1.echo_endpoints_project123_cloud_goog.AuthInfo",
+							Parameters: []*confpb.SystemParameter{{Name: "api_key", HttpHeader: "x-api-key"}},
+						},
+						{
+							Selector:   "1.echo_endpoints_project123_cloud_goog.Echo",
+							Parameters: []*confpb.SystemParameter{{Name: "api_key", HttpHeader: "x-api-key"}},
+						},
+					},
+				},
+			},
+		},
+		{
+			desc:      "swagger 2",
+			document:  `{"swagger": "2.0", "host": "bookstore.example.com"}`,
+			wantError: `unsupported OpenAPI version "", only 3.x is supported`,
+		},
+		{
+			desc: "operation without operationId",
+			document: `{
+				"openapi": "3.0.3",
+				"servers": [{"url": "https://bookstore.example.com"}],
+				"paths": {"/shelves": {"get": {}}}
+			}`,
+			wantError: "operation GET /shelves has no operationId",
+		},
+		{
+			desc: "duplicate operationId",
+			document: `{
+				"openapi": "3.0.3",
+				"servers": [{"url": "https://bookstore.example.com"}],
+				"paths": {"/shelves": {"get": {"operationId": "List"}, "put": {"operationId": "List"}}}
+			}`,
+			wantError: "operation PUT /shelves has the same operationId List as operation GET /shelves",
+		},
+		{
+			desc: "undefined security scheme",
+			document: `{
+				"openapi": "3.0.3",
+				"servers": [{"url": "https://bookstore.example.com"}],
+				"paths": {"/shelves": {"get": {"operationId": "List", "security": [{"jwt": []}]}}}
+			}`,
+			wantError: "operation List: security scheme jwt is not defined",
+		},
+		{
+			desc: "JWT provider without issuer",
+			document: `{
+				"openapi": "3.0.3",
+				"servers": [{"url": "https://bookstore.example.com"}],
+				"components": {"securitySchemes": {"jwt": {"type": "http", "scheme": "bearer"}}},
+				"paths": {"/shelves": {"get": {"operationId": "List"}}}
+			}`,
+			wantError: "security scheme jwt of type http requires x-google-issuer",
+		},
+		{
+			desc: "invalid path translation",
+			document: `{
+				"openapi": "3.0.3",
+				"servers": [{"url": "https://bookstore.example.com"}],
+				"paths": {"/shelves": {"get": {"operationId": "List", "x-google-backend": {"address": "https://backend", "path_translation": "APPEND"}}}}
+			}`,
+			wantError: `operation List: invalid path_translation "APPEND" of x-google-backend`,
+		},
+	}
+
+	for _, tc := range testData {
+		got, err := ToServiceConfig([]byte(tc.document))
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+
+		sum := sha256.Sum256([]byte(tc.document))
+		tc.want.Id = "openapi-" + hex.EncodeToString(sum[:])[:12]
+		if !proto.Equal(got, tc.want) {
+			t.Errorf("Test (%s): \nwant: %v\nget:  %v", tc.desc, tc.want, got)
+		}
+	}
+}
+
+func TestIsOpenAPIDocument(t *testing.T) {
+	testData := []struct {
+		desc string
+		data string
+		want bool
+	}{
+		{
+			desc: "OpenAPI 3",
+			data: `{"openapi": "3.0.3"}`,
+			want: true,
+		},
+		{
+			desc: "service config",
+			data: `{"name": "bookstore.endpoints.project123.cloud.goog"}`,
+		},
+		{
+			desc: "swagger 2",
+			data: `{"swagger": "2.0"}`,
+		},
+		{
+			desc: "not JSON",
+			data: `name: "bookstore.endpoints.project123.cloud.goog"`,
+		},
+	}
+
+	for _, tc := range testData {
+		if got := IsOpenAPIDocument([]byte(tc.data)); got != tc.want {
+			t.Errorf("Test (%s): want %v, get %v", tc.desc, tc.want, got)
+		}
+	}
+}
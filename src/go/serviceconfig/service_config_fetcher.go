@@ -16,7 +16,9 @@ package serviceconfig
 
 import (
 	"fmt"
+	"hash/fnv"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
@@ -66,15 +68,51 @@ func (s *ServiceConfigFetcher) FetchConfig(configId string) (*confpb.Service, er
 // Fetch all the rollouts and use the latest success rollout. Among its all
 // service configs, pick up the one with highest traffic percentage.
 func (s *ServiceConfigFetcher) LoadConfigIdFromRollouts() (string, error) {
-	rollouts := new(smpb.ListServiceRolloutsResponse)
-	fetchRolloutUrl := util.FetchRolloutsURL(s.serviceManagementUrl, s.serviceName)
-	if err := util.CallGoogleapis(s.client, fetchRolloutUrl, util.GET, s.accessToken, s.retryConfigs, rollouts); err != nil {
+	rollouts, err := s.fetchRollouts()
+	if err != nil {
 		return "", err
 	}
 
 	return highestTrafficConfigIdInLatestRollout(rollouts)
 }
 
+// Fetch all the rollouts and use the latest success rollout. Among its all
+// service configs, pick up the one of the instance, so that the instances of
+// the service serve its configs by their traffic percentages.
+func (s *ServiceConfigFetcher) LoadConfigIdFromRolloutsForInstance(instanceKey string) (string, error) {
+	rollouts, err := s.fetchRollouts()
+	if err != nil {
+		return "", err
+	}
+
+	return trafficSplitConfigIdInLatestRollout(rollouts, instanceKey)
+}
+
+// Fetch all the rollouts and use the latest success rollout. Return the config
+// id with the highest traffic, and the traffic percentages of all its configs
+// with traffic, so the proxy can serve the config ids by their percentages.
+func (s *ServiceConfigFetcher) LoadConfigIdAndPercentagesFromRollouts() (string, map[string]float64, error) {
+	rollouts, err := s.fetchRollouts()
+	if err != nil {
+		return "", nil, err
+	}
+
+	configId, err := highestTrafficConfigIdInLatestRollout(rollouts)
+	if err != nil {
+		return "", nil, err
+	}
+	return configId, trafficPercentagesInLatestRollout(rollouts), nil
+}
+
+func (s *ServiceConfigFetcher) fetchRollouts() (*smpb.ListServiceRolloutsResponse, error) {
+	rollouts := new(smpb.ListServiceRolloutsResponse)
+	fetchRolloutUrl := util.FetchRolloutsURL(s.serviceManagementUrl, s.serviceName)
+	if err := util.CallGoogleapis(s.client, fetchRolloutUrl, util.GET, s.accessToken, s.retryConfigs, rollouts); err != nil {
+		return nil, err
+	}
+	return rollouts, nil
+}
+
 func highestTrafficConfigIdInLatestRollout(rollouts *smpb.ListServiceRolloutsResponse) (string, error) {
 	if rollouts == nil || len(rollouts.GetRollouts()) == 0 {
 		return "", fmt.Errorf("problematic rollouts: %v", rollouts)
@@ -96,3 +134,53 @@ func highestTrafficConfigIdInLatestRollout(rollouts *smpb.ListServiceRolloutsRes
 	}
 	return highTrafficConfigId, nil
 }
+
+// trafficPercentagesInLatestRollout returns the traffic percentages of the
+// configs of the latest rollout, skipping the ones without traffic.
+func trafficPercentagesInLatestRollout(rollouts *smpb.ListServiceRolloutsResponse) map[string]float64 {
+	percentages := make(map[string]float64)
+	for configId, percent := range rollouts.GetRollouts()[0].GetTrafficPercentStrategy().GetPercentages() {
+		if percent > 0 {
+			percentages[configId] = percent
+		}
+	}
+	return percentages
+}
+
+// trafficSplitConfigIdInLatestRollout hashes the instance key to a point of
+// the traffic percentages of the latest rollout, sorted by config id, and
+// returns the config id covering it. Each instance keeps its config id as long
+// as the percentages don't change.
+func trafficSplitConfigIdInLatestRollout(rollouts *smpb.ListServiceRolloutsResponse, instanceKey string) (string, error) {
+	if rollouts == nil || len(rollouts.GetRollouts()) == 0 {
+		return "", fmt.Errorf("problematic rollouts: %v", rollouts)
+	}
+
+	percentages := rollouts.GetRollouts()[0].GetTrafficPercentStrategy().GetPercentages()
+	var configIds []string
+	total := 0.
+	for configId, percent := range percentages {
+		if percent <= 0 {
+			continue
+		}
+		configIds = append(configIds, configId)
+		total += percent
+	}
+	if len(configIds) == 0 {
+		return "", fmt.Errorf("problematic rollouts, no config has traffic: %v", rollouts)
+	}
+	sort.Strings(configIds)
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(instanceKey))
+	point := float64(h.Sum32()%10000) / 10000 * total
+
+	cumulative := 0.
+	for _, configId := range configIds {
+		cumulative += percentages[configId]
+		if point < cumulative {
+			return configId, nil
+		}
+	}
+	return configIds[len(configIds)-1], nil
+}
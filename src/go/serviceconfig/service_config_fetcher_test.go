@@ -16,8 +16,11 @@ package serviceconfig
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -228,3 +231,153 @@ func TestServiceConfigFetcherLoadConfigIdFromRollouts(t *testing.T) {
 		_test(tc.desc, tc.callGoogleapisOverridden, tc.serviceRollouts, tc.wantConfigId, tc.wantError)
 	}
 }
+
+func TestTrafficSplitConfigIdInLatestRollout(t *testing.T) {
+	makeRollouts := func(percentages map[string]float64) *smpb.ListServiceRolloutsResponse {
+		return &smpb.ListServiceRolloutsResponse{
+			Rollouts: []*smpb.Rollout{
+				{
+					Strategy: &smpb.Rollout_TrafficPercentStrategy_{
+						TrafficPercentStrategy: &smpb.Rollout_TrafficPercentStrategy{
+							Percentages: percentages,
+						},
+					},
+				},
+			},
+		}
+	}
+
+	testCase := []struct {
+		desc      string
+		rollouts  *smpb.ListServiceRolloutsResponse
+		wantShare map[string]float64
+		wantError string
+	}{
+		{
+			desc: "all the instances pick the config with the full traffic",
+			rollouts: makeRollouts(map[string]float64{
+				"config-1": 100,
+			}),
+			wantShare: map[string]float64{
+				"config-1": 1,
+			},
+		},
+		{
+			desc: "the instances split by the traffic percentages",
+			rollouts: makeRollouts(map[string]float64{
+				"config-1": 20,
+				"config-2": 80,
+			}),
+			wantShare: map[string]float64{
+				"config-1": 0.2,
+				"config-2": 0.8,
+			},
+		},
+		{
+			desc: "configs without traffic are never picked",
+			rollouts: makeRollouts(map[string]float64{
+				"config-1": 0,
+				"config-2": 50,
+				"config-3": 50,
+			}),
+			wantShare: map[string]float64{
+				"config-2": 0.5,
+				"config-3": 0.5,
+			},
+		},
+		{
+			desc: "failure due to no config with traffic",
+			rollouts: makeRollouts(map[string]float64{
+				"config-1": 0,
+			}),
+			wantError: "problematic rollouts, no config has traffic",
+		},
+		{
+			desc:      "failure due to problematic rollouts",
+			rollouts:  &smpb.ListServiceRolloutsResponse{},
+			wantError: "problematic rollouts: ",
+		},
+	}
+
+	const instances = 1000
+	for _, tc := range testCase {
+		counts := make(map[string]int)
+		for i := 0; i < instances; i++ {
+			instanceKey := fmt.Sprintf("instance-%d", i)
+			configId, err := trafficSplitConfigIdInLatestRollout(tc.rollouts, instanceKey)
+			if err != nil {
+				if tc.wantError == "" || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("test(%s), want error: %s, get error: %v", tc.desc, tc.wantError, err)
+				}
+				break
+			}
+
+			// The same instance always picks the same config.
+			if again, _ := trafficSplitConfigIdInLatestRollout(tc.rollouts, instanceKey); again != configId {
+				t.Fatalf("test(%s), instance %s picked config %s, then %s", tc.desc, instanceKey, configId, again)
+			}
+			counts[configId]++
+		}
+		if tc.wantError != "" {
+			continue
+		}
+
+		for configId, count := range counts {
+			if _, ok := tc.wantShare[configId]; !ok {
+				t.Errorf("test(%s), %d instances picked unexpected config %s", tc.desc, count, configId)
+			}
+		}
+		for configId, wantShare := range tc.wantShare {
+			if gotShare := float64(counts[configId]) / instances; math.Abs(gotShare-wantShare) > 0.05 {
+				t.Errorf("test(%s), want share %v of the instances for config %s, get %v", tc.desc, wantShare, configId, gotShare)
+			}
+		}
+	}
+}
+
+func TestTrafficPercentagesInLatestRollout(t *testing.T) {
+	testCase := []struct {
+		desc            string
+		percentages     map[string]float64
+		wantPercentages map[string]float64
+	}{
+		{
+			desc: "a single config with the full traffic",
+			percentages: map[string]float64{
+				"config-1": 100,
+			},
+			wantPercentages: map[string]float64{
+				"config-1": 100,
+			},
+		},
+		{
+			desc: "a rollout in progress, configs without traffic are skipped",
+			percentages: map[string]float64{
+				"config-1": 0,
+				"config-2": 30,
+				"config-3": 70,
+			},
+			wantPercentages: map[string]float64{
+				"config-2": 30,
+				"config-3": 70,
+			},
+		},
+	}
+
+	for _, tc := range testCase {
+		rollouts := &smpb.ListServiceRolloutsResponse{
+			Rollouts: []*smpb.Rollout{
+				{
+					Strategy: &smpb.Rollout_TrafficPercentStrategy_{
+						TrafficPercentStrategy: &smpb.Rollout_TrafficPercentStrategy{
+							Percentages: tc.percentages,
+						},
+					},
+				},
+			},
+		}
+		if got := trafficPercentagesInLatestRollout(rollouts); !reflect.DeepEqual(got, tc.wantPercentages) {
+			t.Errorf("test(%s), want percentages: %v, get percentages: %v", tc.desc, tc.wantPercentages, got)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// URLServiceConfigFetcher fetches the service config mirrored in a
+// gs://BUCKET/OBJECT uri or at an https url, e.g. a signed one. The format of
+// the service config follows the extension of the object or the url path, as
+// for a local file.
+type URLServiceConfigFetcher struct {
+	configUrl   string
+	fetchUrl    string
+	client      *http.Client
+	accessToken util.GetAccessTokenFunc
+	// The ETag of the last fetched service config.
+	etag string
+}
+
+func NewURLServiceConfigFetcher(client *http.Client, configUrl string, accessToken util.GetAccessTokenFunc) (*URLServiceConfigFetcher, error) {
+	f := &URLServiceConfigFetcher{
+		configUrl: configUrl,
+		fetchUrl:  configUrl,
+		client:    client,
+	}
+
+	if strings.HasPrefix(configUrl, util.GcsURIPrefix) {
+		bucket, object, err := util.ParseGcsURI(configUrl)
+		if err != nil {
+			return nil, err
+		}
+		f.fetchUrl = util.FetchGcsObjectURL(bucket, object)
+		// A signed https url carries its own authorization.
+		f.accessToken = accessToken
+	} else if !strings.HasPrefix(configUrl, "https://") {
+		return nil, fmt.Errorf("service config url %s should start with %s or https://", configUrl, util.GcsURIPrefix)
+	}
+	return f, nil
+}
+
+// FetchConfig fetches the service config, and returns nil if it is not
+// modified since the last fetch.
+func (f *URLServiceConfigFetcher) FetchConfig() (*confpb.Service, error) {
+	req, err := http.NewRequest(util.GET, f.fetchUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create request for service config %s: %v", f.configUrl, err)
+	}
+	if f.accessToken != nil {
+		token, _, err := f.accessToken()
+		if err != nil {
+			return nil, fmt.Errorf("fail to get access token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fail to fetch service config %s: %v", f.configUrl, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read service config %s: %v", f.configUrl, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fail to fetch service config %s, got status %d: %s", f.configUrl, resp.StatusCode, body)
+	}
+
+	// The gs:// uri and the url path keep the extension of the file.
+	path := f.configUrl
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	serviceConfig, err := util.UnmarshalServiceConfigFile(path, body)
+	if err != nil {
+		return nil, fmt.Errorf("fail to unmarshal service config %s: %v", f.configUrl, err)
+	}
+	f.etag = resp.Header.Get("ETag")
+	return serviceConfig, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+)
+
+type fakeConfigServer struct {
+	mu            sync.Mutex
+	config        string
+	etag          string
+	authorization string
+}
+
+func (s *fakeConfigServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorization = r.Header.Get("Authorization")
+	if r.Header.Get("If-None-Match") == s.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	_, _ = w.Write([]byte(s.config))
+}
+
+func (s *fakeConfigServer) set(config, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.etag = etag
+}
+
+func TestURLServiceConfigFetcher(t *testing.T) {
+	configServer := &fakeConfigServer{}
+	server := httptest.NewTLSServer(configServer)
+	defer server.Close()
+
+	oldFetchGcsObjectURL := util.FetchGcsObjectURL
+	util.FetchGcsObjectURL = func(bucket, object string) string {
+		return fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", server.URL, bucket, object)
+	}
+	defer func() { util.FetchGcsObjectURL = oldFetchGcsObjectURL }()
+	accessToken := func() (string, time.Duration, error) { return "access-token", time.Duration(60), nil }
+
+	testCases := []struct {
+		desc              string
+		configUrl         string
+		config            string
+		wantAuthorization string
+	}{
+		{
+			desc:      "fetch from a signed https url",
+			configUrl: server.URL + "/service.json?X-Goog-Signature=signature",
+			config:    `{"name": "bookstore.endpoints.project123.cloud.goog", "id": "%s"}`,
+		},
+		{
+			desc:              "fetch from a gs uri in the proto text format",
+			configUrl:         "gs://bucket/service.textproto",
+			config:            `name: "bookstore.endpoints.project123.cloud.goog" id: "%s"`,
+			wantAuthorization: "Bearer access-token",
+		},
+	}
+
+	for _, tc := range testCases {
+		f, err := NewURLServiceConfigFetcher(server.Client(), tc.configUrl, accessToken)
+		if err != nil {
+			t.Fatalf("test(%s), fail to create fetcher: %v", tc.desc, err)
+		}
+
+		configServer.set(fmt.Sprintf(tc.config, "2018-12-05r0"), `"etag-0"`)
+		serviceConfig, err := f.FetchConfig()
+		if err != nil {
+			t.Fatalf("test(%s), fail to fetch config: %v", tc.desc, err)
+		}
+		if serviceConfig.GetId() != "2018-12-05r0" {
+			t.Errorf("test(%s), want config id 2018-12-05r0, get service config: %v", tc.desc, serviceConfig)
+		}
+		if configServer.authorization != tc.wantAuthorization {
+			t.Errorf("test(%s), want authorization %q, get %q", tc.desc, tc.wantAuthorization, configServer.authorization)
+		}
+
+		// The unmodified service config isn't fetched again.
+		serviceConfig, err = f.FetchConfig()
+		if err != nil || serviceConfig != nil {
+			t.Errorf("test(%s), want no service config for the same ETag, get service config: %v, error: %v", tc.desc, serviceConfig, err)
+		}
+
+		configServer.set(fmt.Sprintf(tc.config, "2018-12-05r1"), `"etag-1"`)
+		serviceConfig, err = f.FetchConfig()
+		if err != nil {
+			t.Fatalf("test(%s), fail to fetch the modified config: %v", tc.desc, err)
+		}
+		if serviceConfig.GetId() != "2018-12-05r1" {
+			t.Errorf("test(%s), want config id 2018-12-05r1, get service config: %v", tc.desc, serviceConfig)
+		}
+	}
+}
+
+func TestURLServiceConfigFetcherError(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("access denied"))
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		desc      string
+		configUrl string
+		wantError string
+	}{
+		{
+			desc:      "failure due to an http url",
+			configUrl: "http://example.com/service.json",
+			wantError: "should start with gs:// or https://",
+		},
+		{
+			desc:      "failure due to a gs uri without object",
+			configUrl: "gs://bucket",
+			wantError: "should be in the format gs://BUCKET/OBJECT",
+		},
+		{
+			desc:      "failure due to the response status",
+			configUrl: server.URL + "/service.json",
+			wantError: "got status 403: access denied",
+		},
+	}
+
+	for _, tc := range testCases {
+		f, err := NewURLServiceConfigFetcher(server.Client(), tc.configUrl, nil)
+		if err == nil {
+			_, err = f.FetchConfig()
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+			t.Errorf("test(%s), want error: %s, get error: %v", tc.desc, tc.wantError, err)
+		}
+	}
+}
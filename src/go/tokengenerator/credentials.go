@@ -0,0 +1,245 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokengenerator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	serviceAccountCredentials  = "service_account"
+	authorizedUserCredentials  = "authorized_user"
+	externalAccountCredentials = "external_account"
+
+	defaultStsTokenURL = "https://sts.googleapis.com/v1/token"
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// credentialsFile is the credentials JSON file of --service_account_key: a
+// service account key, the refresh token of a user, or the external account
+// of a workload identity federation.
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// The fields of the external accounts.
+	Audience                       string                   `json:"audience"`
+	SubjectTokenType               string                   `json:"subject_token_type"`
+	TokenURL                       string                   `json:"token_url"`
+	ServiceAccountImpersonationURL string                   `json:"service_account_impersonation_url"`
+	CredentialSource               externalCredentialSource `json:"credential_source"`
+}
+
+// externalCredentialSource is where the external accounts read the subject
+// token exchanged for an access token: a file kept up to date by another
+// process, or a url, e.g. of a local metadata server.
+type externalCredentialSource struct {
+	File    string            `json:"file"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Format  struct {
+		// Either "text" or "json".
+		Type                  string `json:"type"`
+		SubjectTokenFieldName string `json:"subject_token_field_name"`
+	} `json:"format"`
+}
+
+func parseCredentialsFile(keyData []byte) (*credentialsFile, error) {
+	f := &credentialsFile{}
+	if err := json.Unmarshal(keyData, f); err != nil {
+		return nil, fmt.Errorf("fail to parse the credentials: %v", err)
+	}
+	return f, nil
+}
+
+// newTokenSource returns the access token source of the credentials.
+func newTokenSource(keyData []byte, scopes []string) (oauth2.TokenSource, error) {
+	f, err := parseCredentialsFile(keyData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch f.Type {
+	case serviceAccountCredentials, authorizedUserCredentials:
+		creds, err := google.CredentialsFromJSON(oauth2.NoContext, keyData, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		return creds.TokenSource, nil
+	case externalAccountCredentials:
+		if f.Audience == "" || f.SubjectTokenType == "" {
+			return nil, fmt.Errorf("the external account credentials need an audience and a subject_token_type")
+		}
+		if (f.CredentialSource.File == "") == (f.CredentialSource.URL == "") {
+			return nil, fmt.Errorf("the credential_source of the external account credentials needs either a file or a url")
+		}
+		return &externalAccountTokenSource{
+			creds:  f,
+			scopes: scopes,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported credentials type %q, must be one of %q, %q or %q", f.Type, serviceAccountCredentials, authorizedUserCredentials, externalAccountCredentials)
+	}
+}
+
+// newIdentityTokenSource returns the source of the identity tokens for an
+// audience, only supported by the service account keys.
+func newIdentityTokenSource(keyData []byte, audience string) (oauth2.TokenSource, error) {
+	f, err := parseCredentialsFile(keyData)
+	if err != nil {
+		return nil, err
+	}
+	if f.Type != serviceAccountCredentials {
+		return nil, fmt.Errorf("identity tokens need a service account key or --impersonate_service_account, the credentials type is %q", f.Type)
+	}
+
+	cfg, err := google.JWTConfigFromJSON(keyData)
+	if err != nil {
+		return nil, err
+	}
+	return (&jwt.Config{
+		Email:        cfg.Email,
+		PrivateKey:   cfg.PrivateKey,
+		PrivateKeyID: cfg.PrivateKeyID,
+		TokenURL:     cfg.TokenURL,
+		PrivateClaims: map[string]interface{}{
+			"target_audience": audience,
+		},
+		UseIDToken: true,
+	}).TokenSource(oauth2.NoContext), nil
+}
+
+// externalAccountTokenSource exchanges the subject token of an external
+// account for a federated access token at the Security Token Service, then
+// for the access token of a service account if it is impersonated.
+type externalAccountTokenSource struct {
+	creds  *credentialsFile
+	scopes []string
+}
+
+func (s *externalAccountTokenSource) Token() (*oauth2.Token, error) {
+	subjectToken, err := s.subjectToken()
+	if err != nil {
+		return nil, err
+	}
+
+	tokenURL := s.creds.TokenURL
+	if tokenURL == "" {
+		tokenURL = defaultStsTokenURL
+	}
+	scopes := s.scopes
+	if s.creds.ServiceAccountImpersonationURL != "" {
+		// The federated token only calls IAM to impersonate the service account.
+		scopes = []string{cloudPlatformScope}
+	}
+	form := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {s.creds.Audience},
+		"scope":                {strings.Join(scopes, " ")},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token_type":   {s.creds.SubjectTokenType},
+		"subject_token":        {subjectToken},
+	}
+	resp, err := http.PostForm(tokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("fail to exchange the subject token at %s: %v", tokenURL, err)
+	}
+	var stsResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := decodeTokenResponse(resp, tokenURL, &stsResp); err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{
+		AccessToken: stsResp.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      timeNow().Add(time.Duration(stsResp.ExpiresIn) * time.Second),
+	}
+
+	if s.creds.ServiceAccountImpersonationURL == "" {
+		return token, nil
+	}
+	return iamGenerateAccessToken(s.creds.ServiceAccountImpersonationURL, token.AccessToken, nil, s.scopes)
+}
+
+func (s *externalAccountTokenSource) subjectToken() (string, error) {
+	source := s.creds.CredentialSource
+	var data []byte
+	if source.File != "" {
+		var err error
+		if data, err = ioutil.ReadFile(source.File); err != nil {
+			return "", fmt.Errorf("fail to read the subject token file %s: %v", source.File, err)
+		}
+	} else {
+		req, err := http.NewRequest(http.MethodGet, source.URL, nil)
+		if err != nil {
+			return "", err
+		}
+		for name, value := range source.Headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("fail to fetch the subject token from %s: %v", source.URL, err)
+		}
+		defer resp.Body.Close()
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("fail to fetch the subject token from %s: %s, %s", source.URL, resp.Status, data)
+		}
+	}
+
+	if source.Format.Type != "json" {
+		return strings.TrimSpace(string(data)), nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", fmt.Errorf("fail to parse the subject token: %v", err)
+	}
+	token, ok := fields[source.Format.SubjectTokenFieldName].(string)
+	if !ok || token == "" {
+		return "", fmt.Errorf("the subject token has no field %q", source.Format.SubjectTokenFieldName)
+	}
+	return token, nil
+}
+
+// decodeTokenResponse decodes the JSON response of a token endpoint.
+func decodeTokenResponse(resp *http.Response, endpoint string, v interface{}) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %s: %s", endpoint, resp.Status, bytes.TrimSpace(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("fail to parse the response of %s: %v", endpoint, err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokengenerator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExternalAccountTokenSource(t *testing.T) {
+	var stsForms []map[string]string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("fail to parse the STS request: %v", err)
+		}
+		form := make(map[string]string)
+		for name := range r.PostForm {
+			form[name] = r.PostForm.Get(name)
+		}
+		stsForms = append(stsForms, form)
+		_, _ = w.Write([]byte(`{"access_token": "federated-token", "issued_token_type": "urn:ietf:params:oauth:token-type:access_token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer sts.Close()
+
+	iam := newFakeIamServer(t)
+	defer iam.Close()
+
+	subject := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Azure" {
+			http.Error(w, "missing header", http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token": "subject-token-from-url"}`))
+	}))
+	defer subject.Close()
+
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	subjectFile := filepath.Join(dir, "subject_token")
+	if err := ioutil.WriteFile(subjectFile, []byte("subject-token-from-file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		desc             string
+		credentials      string
+		wantToken        string
+		wantSubjectToken string
+		wantScope        string
+		wantError        string
+	}{
+		{
+			desc: "subject token from a text file",
+			credentials: fmt.Sprintf(`{
+				"type": "external_account",
+				"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/oidc",
+				"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+				"token_url": %q,
+				"credential_source": {"file": %q}
+			}`, sts.URL, subjectFile),
+			wantToken:        "federated-token",
+			wantSubjectToken: "subject-token-from-file",
+			wantScope:        "https://www.googleapis.com/auth/servicecontrol",
+		},
+		{
+			desc: "subject token from a url in json, with an impersonated service account",
+			credentials: fmt.Sprintf(`{
+				"type": "external_account",
+				"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/azure",
+				"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+				"token_url": %q,
+				"service_account_impersonation_url": %q,
+				"credential_source": {
+					"url": %q,
+					"headers": {"Metadata-Flavor": "Azure"},
+					"format": {"type": "json", "subject_token_field_name": "access_token"}
+				}
+			}`, sts.URL, iam.URL+"/v1/projects/-/serviceAccounts/proxy@project.iam.gserviceaccount.com:generateAccessToken", subject.URL),
+			wantToken:        "impersonated-access-token",
+			wantSubjectToken: "subject-token-from-url",
+			wantScope:        cloudPlatformScope,
+		},
+		{
+			desc: "missing credential source",
+			credentials: `{
+				"type": "external_account",
+				"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/oidc",
+				"subject_token_type": "urn:ietf:params:oauth:token-type:jwt"
+			}`,
+			wantError: "needs either a file or a url",
+		},
+		{
+			desc:        "unsupported credentials type",
+			credentials: `{"type": "impersonated_service_account"}`,
+			wantError:   `unsupported credentials type "impersonated_service_account"`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			stsForms = nil
+			src, err := newTokenSource([]byte(tc.credentials), []string{"https://www.googleapis.com/auth/servicecontrol"})
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error %q, get %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := src.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.AccessToken != tc.wantToken {
+				t.Errorf("want token %q, get %q", tc.wantToken, token.AccessToken)
+			}
+			if len(stsForms) != 1 {
+				t.Fatalf("want 1 STS call, get %d", len(stsForms))
+			}
+			if got := stsForms[0]["subject_token"]; got != tc.wantSubjectToken {
+				t.Errorf("want subject token %q, get %q", tc.wantSubjectToken, got)
+			}
+			if got := stsForms[0]["scope"]; got != tc.wantScope {
+				t.Errorf("want scope %q, get %q", tc.wantScope, got)
+			}
+		})
+	}
+}
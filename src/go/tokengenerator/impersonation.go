@@ -0,0 +1,141 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokengenerator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+)
+
+// The prefix of the delegates of the IAM Credentials API, by
+// https://cloud.google.com/iam/docs/reference/credentials/rest/v1/projects.serviceAccounts/generateAccessToken.
+const delegatePrefix = "projects/-/serviceAccounts/"
+
+// IdentityTokenFunc returns an identity token for an audience, and how long it
+// is valid.
+type IdentityTokenFunc func(audience string) (string, time.Duration, error)
+
+// ImpersonatedTokenFuncs returns the cached access and identity token functions
+// of a service account, impersonated through the IAM Credentials API at iamURL
+// with the access tokens of sourceToken.
+func ImpersonatedTokenFuncs(sourceToken util.GetAccessTokenFunc, iamURL, serviceAccount string, delegates []string) (util.GetAccessTokenFunc, IdentityTokenFunc) {
+	accessTokens := newCachedToken(accessTokenKind)
+	identityTokens := newAudienceTokens()
+
+	accessToken := func() (string, time.Duration, error) {
+		return accessTokens.get(func() (*oauth2.Token, error) {
+			token, _, err := sourceToken()
+			if err != nil {
+				return nil, fmt.Errorf("fail to get the access token to impersonate %s: %v", serviceAccount, err)
+			}
+			return iamGenerateAccessToken(iamURL+util.IamAccessTokenPath(serviceAccount), token, delegates, _GOOGLE_API_SCOPE)
+		})
+	}
+	identityToken := func(audience string) (string, time.Duration, error) {
+		return identityTokens.get(audience, func(audience string) (*oauth2.Token, error) {
+			token, _, err := sourceToken()
+			if err != nil {
+				return nil, fmt.Errorf("fail to get the access token to impersonate %s: %v", serviceAccount, err)
+			}
+			return iamGenerateIdToken(iamURL+util.IamIdentityTokenPath(serviceAccount), token, delegates, audience)
+		})
+	}
+	return accessToken, identityToken
+}
+
+// iamGenerateAccessToken calls the generateAccessToken method of the IAM
+// Credentials API.
+func iamGenerateAccessToken(url, sourceToken string, delegates, scopes []string) (*oauth2.Token, error) {
+	var resp struct {
+		AccessToken string `json:"accessToken"`
+		ExpireTime  string `json:"expireTime"`
+	}
+	if err := callIam(url, sourceToken, map[string]interface{}{
+		"delegates": delegateNames(delegates),
+		"scope":     scopes,
+	}, &resp); err != nil {
+		return nil, err
+	}
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse the expireTime of %s: %v", url, err)
+	}
+	return &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
+
+// iamGenerateIdToken calls the generateIdToken method of the IAM Credentials
+// API. The expiry is the one of the token claims.
+func iamGenerateIdToken(url, sourceToken string, delegates []string, audience string) (*oauth2.Token, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := callIam(url, sourceToken, map[string]interface{}{
+		"delegates":    delegateNames(delegates),
+		"audience":     audience,
+		"includeEmail": true,
+	}, &resp); err != nil {
+		return nil, err
+	}
+	claims, err := jws.Decode(resp.Token)
+	if err != nil {
+		return nil, fmt.Errorf("fail to decode the identity token of %s: %v", url, err)
+	}
+	return &oauth2.Token{
+		AccessToken: resp.Token,
+		TokenType:   "Bearer",
+		Expiry:      time.Unix(claims.Exp, 0),
+	}, nil
+}
+
+func callIam(url, sourceToken string, body map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sourceToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fail to call %s: %v", url, err)
+	}
+	return decodeTokenResponse(resp, url, v)
+}
+
+func delegateNames(delegates []string) []string {
+	names := make([]string, 0, len(delegates))
+	for _, delegate := range delegates {
+		if !strings.HasPrefix(delegate, delegatePrefix) {
+			delegate = delegatePrefix + delegate
+		}
+		names = append(names, delegate)
+	}
+	return names
+}
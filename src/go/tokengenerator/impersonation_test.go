@@ -0,0 +1,121 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokengenerator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIamServer serves the generateAccessToken and generateIdToken methods of
+// the IAM Credentials API, recording the requests.
+type fakeIamServer struct {
+	*httptest.Server
+	authorizations []string
+	bodies         []map[string]interface{}
+}
+
+func newFakeIamServer(t *testing.T) *fakeIamServer {
+	s := &fakeIamServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("fail to decode the IAM request: %v", err)
+		}
+		s.authorizations = append(s.authorizations, r.Header.Get("Authorization"))
+		s.bodies = append(s.bodies, body)
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":generateAccessToken"):
+			_, _ = fmt.Fprintf(w, `{"accessToken": "impersonated-access-token", "expireTime": %q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		case strings.HasSuffix(r.URL.Path, ":generateIdToken"):
+			_, _ = fmt.Fprintf(w, `{"token": %q}`, fakeIdToken(body["audience"].(string), time.Now().Add(time.Hour)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return s
+}
+
+func fakeIdToken(audience string, exp time.Time) string {
+	enc := base64.RawURLEncoding
+	claims := fmt.Sprintf(`{"aud": %q, "exp": %d}`, audience, exp.Unix())
+	return enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+func TestImpersonatedTokenFuncs(t *testing.T) {
+	iam := newFakeIamServer(t)
+	defer iam.Close()
+
+	sourceToken := func() (string, time.Duration, error) {
+		return "source-token", time.Hour, nil
+	}
+	accessToken, identityToken := ImpersonatedTokenFuncs(sourceToken, iam.URL, "proxy@project.iam.gserviceaccount.com", []string{"delegate@project.iam.gserviceaccount.com"})
+
+	for i := 0; i < 2; i++ {
+		token, expires, err := accessToken()
+		if err != nil || token != "impersonated-access-token" || expires < 59*time.Minute {
+			t.Errorf("get access token %q expiring in %v, err: %v", token, expires, err)
+		}
+	}
+	for _, audience := range []string{"https://a.run.app", "https://b.run.app", "https://a.run.app"} {
+		token, expires, err := identityToken(audience)
+		if err != nil || token == "" || expires < 59*time.Minute {
+			t.Errorf("audience %s: get identity token %q expiring in %v, err: %v", audience, token, expires, err)
+		}
+	}
+
+	// The tokens are cached, by audience for the identity tokens.
+	if len(iam.bodies) != 3 {
+		t.Fatalf("want 3 IAM calls, get %d: %v", len(iam.bodies), iam.bodies)
+	}
+	wantDelegates := []interface{}{"projects/-/serviceAccounts/delegate@project.iam.gserviceaccount.com"}
+	for i, body := range iam.bodies {
+		if iam.authorizations[i] != "Bearer source-token" {
+			t.Errorf("IAM call %d: want the source token, get authorization %q", i, iam.authorizations[i])
+		}
+		if !reflect.DeepEqual(body["delegates"], wantDelegates) {
+			t.Errorf("IAM call %d: want delegates %v, get %v", i, wantDelegates, body["delegates"])
+		}
+	}
+	if got := iam.bodies[0]["scope"]; len(got.([]interface{})) != len(_GOOGLE_API_SCOPE) {
+		t.Errorf("want the scopes %v, get %v", _GOOGLE_API_SCOPE, got)
+	}
+	if got := iam.bodies[2]["audience"]; got != "https://b.run.app" {
+		t.Errorf("want the audience https://b.run.app, get %v", got)
+	}
+}
+
+func TestImpersonatedTokenFuncsSourceTokenError(t *testing.T) {
+	sourceToken := func() (string, time.Duration, error) {
+		return "", 0, fmt.Errorf("metadata-server-error")
+	}
+	accessToken, identityToken := ImpersonatedTokenFuncs(sourceToken, "http://127.0.0.1:0", "proxy@project.iam.gserviceaccount.com", nil)
+
+	wantErr := "fail to get the access token to impersonate proxy@project.iam.gserviceaccount.com: metadata-server-error"
+	if _, _, err := accessToken(); err == nil || err.Error() != wantErr {
+		t.Errorf("want error %q, get %v", wantErr, err)
+	}
+	if _, _, err := identityToken("https://a.run.app"); err == nil || err.Error() != wantErr {
+		t.Errorf("want error %q, get %v", wantErr, err)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokengenerator
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Follow the similar logic as GCE metadata server, where returned token
+	// will be valid for at least 60s.
+	minTokenValidity = 60 * time.Second
+	// The cached tokens expiring within this duration are refreshed in the
+	// background, so the requests don't wait for the token fetches.
+	tokenRefreshAhead = 5 * time.Minute
+
+	accessTokenKind   = "access_token"
+	identityTokenKind = "identity_token"
+)
+
+var (
+	// The token fetches and their failures by token kind, served on the
+	// metrics endpoint of the token agent.
+	metricsMu          sync.Mutex
+	tokenFetches       = make(map[string]int)
+	tokenFetchFailures = make(map[string]int)
+
+	// Overridden in the tests.
+	timeNow = time.Now
+)
+
+// cachedToken caches the token of a token kind, and of an audience for the
+// identity tokens.
+type cachedToken struct {
+	kind string
+
+	mu         sync.Mutex
+	token      *oauth2.Token
+	refreshing bool
+}
+
+func newCachedToken(kind string) *cachedToken {
+	return &cachedToken{
+		kind: kind,
+	}
+}
+
+// active returns the cached token if it is valid for at least
+// minTokenValidity, and whether it should be refreshed.
+func (c *cachedToken) active() (token string, expires time.Duration, refresh bool) {
+	now := timeNow()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == nil || c.token.AccessToken == "" || now.After(c.token.Expiry.Add(-minTokenValidity)) {
+		return "", 0, false
+	}
+	refresh = !c.refreshing && now.After(c.token.Expiry.Add(-tokenRefreshAhead))
+	if refresh {
+		c.refreshing = true
+	}
+	return c.token.AccessToken, c.token.Expiry.Sub(now), refresh
+}
+
+// get returns the cached token, or fetches a new one. A cached token expiring
+// soon is returned while a new one is fetched in the background.
+func (c *cachedToken) get(fetch func() (*oauth2.Token, error)) (string, time.Duration, error) {
+	token, expires, refresh := c.active()
+	if token != "" {
+		if refresh {
+			go func() {
+				if _, _, err := c.fetch(fetch); err != nil {
+					glog.Warningf("fail to refresh the %s ahead of its expiry: %v", c.kind, err)
+				}
+			}()
+		}
+		return token, expires, nil
+	}
+	return c.fetch(fetch)
+}
+
+func (c *cachedToken) fetch(fetch func() (*oauth2.Token, error)) (string, time.Duration, error) {
+	token, err := fetch()
+	recordTokenFetch(c.kind, err)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshing = false
+	if err != nil {
+		return "", 0, err
+	}
+	c.token = token
+	return token.AccessToken, token.Expiry.Sub(timeNow()), nil
+}
+
+// audienceTokens caches the identity tokens by audience.
+type audienceTokens struct {
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+func newAudienceTokens() *audienceTokens {
+	return &audienceTokens{
+		tokens: make(map[string]*cachedToken),
+	}
+}
+
+func (a *audienceTokens) get(audience string, fetch func(audience string) (*oauth2.Token, error)) (string, time.Duration, error) {
+	a.mu.Lock()
+	c, ok := a.tokens[audience]
+	if !ok {
+		c = newCachedToken(identityTokenKind)
+		a.tokens[audience] = c
+	}
+	a.mu.Unlock()
+
+	return c.get(func() (*oauth2.Token, error) {
+		return fetch(audience)
+	})
+}
+
+func recordTokenFetch(kind string, err error) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	tokenFetches[kind]++
+	if err != nil {
+		tokenFetchFailures[kind]++
+	}
+}
+
+// writeMetrics writes the token fetch metrics in the Prometheus text format.
+func writeMetrics(w io.Writer) error {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	for _, metric := range []struct {
+		name   string
+		help   string
+		values map[string]int
+	}{
+		{"espv2_token_fetches_total", "The tokens fetched by the token agent.", tokenFetches},
+		{"espv2_token_fetch_failures_total", "The token fetches of the token agent which failed.", tokenFetchFailures},
+	} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name); err != nil {
+			return err
+		}
+		for _, kind := range []string{accessTokenKind, identityTokenKind} {
+			if _, err := fmt.Fprintf(w, "%s{kind=%q} %d\n", metric.name, kind, metric.values[kind]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
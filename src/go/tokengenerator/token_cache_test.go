@@ -0,0 +1,166 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokengenerator
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestCachedToken(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	testData := []struct {
+		desc        string
+		cachedValid time.Duration
+		fetchErr    error
+		wantToken   string
+		wantErr     string
+		wantFetches int
+	}{
+		{
+			desc:        "no cached token, fetched",
+			wantToken:   "new-token",
+			wantFetches: 1,
+		},
+		{
+			desc:        "cached token valid for long, not fetched",
+			cachedValid: time.Hour,
+			wantToken:   "cached-token",
+		},
+		{
+			desc:        "cached token expiring soon, returned while refreshed in the background",
+			cachedValid: 3 * time.Minute,
+			wantToken:   "cached-token",
+			wantFetches: 1,
+		},
+		{
+			desc:        "cached token valid for less than a minute, fetched",
+			cachedValid: 30 * time.Second,
+			wantToken:   "new-token",
+			wantFetches: 1,
+		},
+		{
+			desc:        "fetch failed",
+			fetchErr:    fmt.Errorf("token-server-error"),
+			wantErr:     "token-server-error",
+			wantFetches: 1,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := newCachedToken(accessTokenKind)
+			if tc.cachedValid != 0 {
+				c.token = &oauth2.Token{
+					AccessToken: "cached-token",
+					Expiry:      now.Add(tc.cachedValid),
+				}
+			}
+
+			fetched := make(chan struct{}, 2)
+			fetch := func() (*oauth2.Token, error) {
+				defer func() { fetched <- struct{}{} }()
+				if tc.fetchErr != nil {
+					return nil, tc.fetchErr
+				}
+				return &oauth2.Token{
+					AccessToken: "new-token",
+					Expiry:      now.Add(time.Hour),
+				}, nil
+			}
+
+			token, _, err := c.get(fetch)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("want error %q, get %v", tc.wantErr, err)
+				}
+			} else if err != nil || token != tc.wantToken {
+				t.Errorf("want token %q, get %q, err: %v", tc.wantToken, token, err)
+			}
+
+			for i := 0; i < tc.wantFetches; i++ {
+				select {
+				case <-fetched:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("want %d fetches, get %d", tc.wantFetches, i)
+				}
+			}
+			select {
+			case <-fetched:
+				t.Errorf("want %d fetches, get more", tc.wantFetches)
+			default:
+			}
+
+			// After the fetches, the new token is served from the cache.
+			if tc.wantFetches > 0 && tc.fetchErr == nil {
+				if token, _, err := c.get(fetch); err != nil || token != "new-token" {
+					t.Errorf("want the new token from the cache, get %q, err: %v", token, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAudienceTokens(t *testing.T) {
+	a := newAudienceTokens()
+	var fetched []string
+	fetch := func(audience string) (*oauth2.Token, error) {
+		fetched = append(fetched, audience)
+		return &oauth2.Token{
+			AccessToken: "id-token-for-" + audience,
+			Expiry:      time.Now().Add(time.Hour),
+		}, nil
+	}
+
+	for _, audience := range []string{"https://a.run.app", "https://b.run.app", "https://a.run.app"} {
+		token, _, err := a.get(audience, fetch)
+		if err != nil || token != "id-token-for-"+audience {
+			t.Errorf("audience %s: get token %q, err: %v", audience, token, err)
+		}
+	}
+	if want := "https://a.run.app,https://b.run.app"; strings.Join(fetched, ",") != want {
+		t.Errorf("want fetches for %s, get %v", want, fetched)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	metricsMu.Lock()
+	tokenFetches = map[string]int{accessTokenKind: 3, identityTokenKind: 2}
+	tokenFetchFailures = map[string]int{identityTokenKind: 1}
+	metricsMu.Unlock()
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`espv2_token_fetches_total{kind="access_token"} 3`,
+		`espv2_token_fetches_total{kind="identity_token"} 2`,
+		`espv2_token_fetch_failures_total{kind="access_token"} 0`,
+		`espv2_token_fetch_failures_total{kind="identity_token"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("want %s in:\n%s", want, buf.String())
+		}
+	}
+}
@@ -18,14 +18,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"sync"
 	"time"
 
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
 var (
@@ -35,63 +35,93 @@ var (
 		// Call servicecontrol to get latest rollout id.
 		"https://www.googleapis.com/auth/servicecontrol",
 	}
-	tokenCache = &oauth2.Token{}
-	tokenMux   = sync.Mutex{}
+	accessTokenCache   = newCachedToken(accessTokenKind)
+	identityTokenCache = newAudienceTokens()
 )
 
 var GenerateAccessTokenFromFile = func(saFilePath string) (string, time.Duration, error) {
-	if token, duration := activeAccessToken(); token != "" {
-		return token, duration, nil
-	}
-
-	data, err := ioutil.ReadFile(saFilePath)
-	if err != nil {
-		return "", 0, err
-	}
-
-	return generateAccessToken(data)
+	return accessTokenCache.get(func() (*oauth2.Token, error) {
+		data, err := ioutil.ReadFile(saFilePath)
+		if err != nil {
+			return nil, err
+		}
+		return generateAccessToken(data, _GOOGLE_API_SCOPE)
+	})
 }
 
 // A test-friendly version of `GenerateAccessTokenFromFile`
 func generateAccessTokenFromData(saData []byte) (string, time.Duration, error) {
-	if token, duration := activeAccessToken(); token != "" {
-		return token, duration, nil
-	}
-
-	return generateAccessToken(saData)
+	return accessTokenCache.get(func() (*oauth2.Token, error) {
+		return generateAccessToken(saData, _GOOGLE_API_SCOPE)
+	})
 }
 
-func activeAccessToken() (string, time.Duration) {
-	now := time.Now()
-	tokenMux.Lock()
-	defer tokenMux.Unlock()
-
-	// Follow the similar logic as GCE metadata server, where returned token will be valid for at
-	// least 60s.
-	if tokenCache.AccessToken == "" || now.After(tokenCache.Expiry.Add(-time.Second*60)) {
-		return "", 0
-
+func generateAccessToken(keyData []byte, scopes []string) (*oauth2.Token, error) {
+	src, err := newTokenSource(keyData, scopes)
+	if err != nil {
+		return nil, err
 	}
+	return src.Token()
+}
 
-	return tokenCache.AccessToken, tokenCache.Expiry.Sub(now)
+// GenerateIdentityTokenFromFile returns the identity token of the service
+// account key for an audience.
+var GenerateIdentityTokenFromFile = func(saFilePath, audience string) (string, time.Duration, error) {
+	return identityTokenCache.get(audience, func(audience string) (*oauth2.Token, error) {
+		data, err := ioutil.ReadFile(saFilePath)
+		if err != nil {
+			return nil, err
+		}
+		src, err := newIdentityTokenSource(data, audience)
+		if err != nil {
+			return nil, err
+		}
+		return src.Token()
+	})
 }
 
-func generateAccessToken(keyData []byte) (string, time.Duration, error) {
-	creds, err := google.CredentialsFromJSON(oauth2.NoContext, keyData, _GOOGLE_API_SCOPE...)
-	if err != nil {
-		return "", 0, err
+// MakeTokenFuncs returns the access and identity token functions of the token
+// agent: the ones of --service_account_key, or of the non-GCP metadata
+// provider, or of the metadata server, impersonating
+// --impersonate_service_account if set.
+func MakeTokenFuncs(opts options.ConfigGeneratorOptions) (util.GetAccessTokenFunc, IdentityTokenFunc, error) {
+	var sourceToken util.GetAccessTokenFunc
+	switch {
+	case opts.ServiceAccountKey != "" && opts.ImpersonateServiceAccount == "":
+		return func() (string, time.Duration, error) {
+				return GenerateAccessTokenFromFile(opts.ServiceAccountKey)
+			}, func(audience string) (string, time.Duration, error) {
+				return GenerateIdentityTokenFromFile(opts.ServiceAccountKey, audience)
+			}, nil
+	case opts.ServiceAccountKey != "":
+		// Impersonating a service account needs an access token for IAM.
+		sourceTokens := newCachedToken(accessTokenKind)
+		sourceToken = func() (string, time.Duration, error) {
+			return sourceTokens.get(func() (*oauth2.Token, error) {
+				data, err := ioutil.ReadFile(opts.ServiceAccountKey)
+				if err != nil {
+					return nil, err
+				}
+				return generateAccessToken(data, []string{cloudPlatformScope})
+			})
+		}
+	case !util.IsGCPMetadataProvider(opts.MetadataProvider):
+		p, err := metadata.NewProvider(opts.CommonOptions)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fail to initialize metadata provider: %v", err)
+		}
+		sourceToken = p.FetchAccessToken
+	default:
+		sourceToken = metadata.NewMetadataFetcher(opts.CommonOptions).FetchAccessToken
 	}
 
-	token, err := creds.TokenSource.Token()
-	if err != nil {
-		return "", 0, err
+	if opts.ImpersonateServiceAccount == "" {
+		return sourceToken, func(audience string) (string, time.Duration, error) {
+			return "", 0, fmt.Errorf("identity tokens need --service_account_key or --impersonate_service_account")
+		}, nil
 	}
-
-	tokenMux.Lock()
-	defer tokenMux.Unlock()
-
-	tokenCache = token
-	return token.AccessToken, token.Expiry.Sub(time.Now()), nil
+	accessToken, identityToken := ImpersonatedTokenFuncs(sourceToken, opts.IamURL, opts.ImpersonateServiceAccount, opts.ImpersonateServiceAccountDelegates)
+	return accessToken, identityToken, nil
 }
 
 // Create the token agent handler to provide envoy with access
@@ -100,15 +130,38 @@ func generateAccessToken(keyData []byte) (string, time.Duration, error) {
 // It follows the following scheme:
 // Request: GET /local/access_token.
 // Response: access token response is a JSON payload in the format:
-// {
-//   "access_token": "string",
-//   "expires_in": uint
-// }
+//
+//	{
+//	  "access_token": "string",
+//	  "expires_in": uint
+//	}
 func MakeTokenAgentHandler(serviceAccountKey string) http.Handler {
+	return MakeTokenAgentHandlerFromTokenFuncs(func() (string, time.Duration, error) {
+		return GenerateAccessTokenFromFile(serviceAccountKey)
+	}, func(audience string) (string, time.Duration, error) {
+		return GenerateIdentityTokenFromFile(serviceAccountKey, audience)
+	})
+}
+
+// Create the token agent handler with the access token returned by
+// accessToken, e.g. from a non-GCP metadata provider.
+func MakeTokenAgentHandlerFromTokenFunc(accessToken util.GetAccessTokenFunc) http.Handler {
+	return MakeTokenAgentHandlerFromTokenFuncs(accessToken, func(audience string) (string, time.Duration, error) {
+		return "", 0, fmt.Errorf("identity tokens are not available from this credential source")
+	})
+}
+
+// Create the token agent handler with the access and identity tokens of the
+// token functions. Besides the access tokens, it serves:
+// Request: GET /local/identity_token?audience=AUDIENCE.
+// Response: the identity token for the audience, like the metadata server.
+// Request: GET /local/metrics.
+// Response: the token fetches and failures in the Prometheus text format.
+func MakeTokenAgentHandlerFromTokenFuncs(accessToken util.GetAccessTokenFunc, identityToken IdentityTokenFunc) http.Handler {
 	r := mux.NewRouter()
 
 	r.PathPrefix(util.TokenAgentAccessTokenPath).Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, expire, err := GenerateAccessTokenFromFile(serviceAccountKey)
+		token, expire, err := accessToken()
 
 		if err != nil {
 			glog.Errorf("local access token agent had error: %v", err)
@@ -119,5 +172,26 @@ func MakeTokenAgentHandler(serviceAccountKey string) http.Handler {
 		_, _ = w.Write([]byte(fmt.Sprintf(`{"access_token": "%s", "expires_in": %v}`, token, int(expire.Seconds()))))
 	})
 
+	r.PathPrefix(util.TokenAgentIdentityTokenPath).Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		audience := r.URL.Query().Get("audience")
+		if audience == "" {
+			http.Error(w, "the audience query parameter is required", http.StatusBadRequest)
+			return
+		}
+		token, _, err := identityToken(audience)
+		if err != nil {
+			glog.Errorf("local identity token agent had error for audience %s: %v", audience, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		_, _ = w.Write([]byte(token))
+	})
+
+	r.Path(util.TokenAgentMetricsPath).Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = writeMetrics(w)
+	})
+
 	return r
 }
@@ -108,3 +108,63 @@ func TestMakeTokenAgentHandler(t *testing.T) {
 
 	}
 }
+
+func TestMakeTokenAgentHandlerFromTokenFuncs(t *testing.T) {
+	accessToken := func() (string, time.Duration, error) {
+		return "ya29.new", 100 * time.Second, nil
+	}
+	identityToken := func(audience string) (string, time.Duration, error) {
+		if audience == "https://bad.run.app" {
+			return "", 0, fmt.Errorf("gen-identity-token-error")
+		}
+		return "id-token-for-" + audience, 100 * time.Second, nil
+	}
+	s := httptest.NewServer(MakeTokenAgentHandlerFromTokenFuncs(accessToken, identityToken))
+	defer s.Close()
+
+	testCases := []struct {
+		desc      string
+		path      string
+		wantResp  string
+		wantError string
+	}{
+		{
+			desc:     "success, get access token",
+			path:     "/local/access_token",
+			wantResp: `{"access_token": "ya29.new", "expires_in": 100}`,
+		},
+		{
+			desc:     "success, get identity token",
+			path:     "/local/identity_token?audience=https://a.run.app",
+			wantResp: "id-token-for-https://a.run.app",
+		},
+		{
+			desc:      "fail, identity token without audience",
+			path:      "/local/identity_token",
+			wantError: "400 Bad Request",
+		},
+		{
+			desc:      "fail, error in generating identity token",
+			path:      "/local/identity_token?audience=https://bad.run.app",
+			wantError: "500 Internal Server Error, gen-identity-token-error",
+		},
+		{
+			desc:     "success, get metrics",
+			path:     "/local/metrics",
+			wantResp: "# HELP espv2_token_fetches_total",
+		},
+	}
+
+	for _, tc := range testCases {
+		_, resp, err := utils.DoWithHeaders(s.URL+tc.path, "GET", "", nil)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("test(%s): get error: %v, want error: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil || !strings.HasPrefix(string(resp), tc.wantResp) {
+			t.Errorf("test(%s): get resp: %s, err: %v, want resp %s", tc.desc, string(resp), err, tc.wantResp)
+		}
+	}
+}
@@ -21,13 +21,17 @@ import (
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
 	opencensuspb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
 	tracepb "github.com/envoyproxy/go-control-plane/envoy/config/trace/v3"
 	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tracingpb "github.com/envoyproxy/go-control-plane/envoy/type/tracing/v3"
 	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 )
 
 func createTraceContexts(ctx_str string) ([]tracepb.OpenCensusConfig_TraceContext, error) {
@@ -63,7 +67,7 @@ func getTracingProjectId(opts options.CommonOptions) (string, error) {
 
 	// Otherwise determine project-id automatically
 	glog.Infof("tracing_project_id was not specified, attempting to fetch it from GCP Metadata server")
-	if opts.NonGCP {
+	if opts.NonGCP || !util.IsGCPMetadataProvider(opts.MetadataProvider) {
 		return "", fmt.Errorf("tracing_project_id was not specified and can not be fetched from GCP Metadata server on non-GCP runtime")
 	}
 
@@ -109,39 +113,157 @@ func createOpenCensusConfig(opts options.CommonOptions) (*tracepb.OpenCensusConf
 	return cfg, nil
 }
 
+// zipkinCollectorPath returns the path of the Zipkin collector, which defaults
+// to the v2 spans endpoint.
+func zipkinCollectorPath(address string) (string, error) {
+	_, _, _, path, err := util.ParseURI(address)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "/api/v2/spans", nil
+	}
+	return path, nil
+}
+
+func createZipkinConfig(opts options.CommonOptions) (*tracepb.ZipkinConfig, error) {
+	if opts.TracingZipkinCollectorAddress == "" {
+		return nil, fmt.Errorf("tracing_zipkin_collector_address is required when tracing_provider is zipkin")
+	}
+	path, err := zipkinCollectorPath(opts.TracingZipkinCollectorAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracepb.ZipkinConfig{
+		CollectorCluster:         util.ZipkinCollectorClusterName,
+		CollectorEndpoint:        path,
+		CollectorEndpointVersion: tracepb.ZipkinConfig_HTTP_JSON,
+		TraceId_128Bit:           opts.TracingZipkinTraceId128Bit,
+		SharedSpanContext:        &wrapperspb.BoolValue{Value: opts.TracingZipkinSharedSpanContext},
+	}, nil
+}
+
+// SampleRateToPercent converts a trace sampling rate from 0.0 to 1.0 into the
+// percentage used by the HCM tracing config.
+func SampleRateToPercent(rate float64) (*typepb.Percent, error) {
+	if rate < 0.0 || rate > 1.0 {
+		return nil, fmt.Errorf("invalid trace sampling rate: %v. It must be >= 0.0 and <= 1.0", rate)
+	}
+
+	// This results in precision errors. Round percentage to 4 decimal points.
+	percentSampleRate := rate * 100
+	percentSampleRate = math.Round(percentSampleRate*10000) / 10000
+	return &typepb.Percent{
+		Value: percentSampleRate,
+	}, nil
+}
+
+// SampleRateToFractionalPercent converts a trace sampling rate from 0.0 to 1.0
+// into the fractional percentage used by the route tracing config.
+func SampleRateToFractionalPercent(rate float64) (*typepb.FractionalPercent, error) {
+	if rate < 0.0 || rate > 1.0 {
+		return nil, fmt.Errorf("invalid trace sampling rate: %v. It must be >= 0.0 and <= 1.0", rate)
+	}
+
+	// Same precision as SampleRateToPercent, 4 decimal points of percentage.
+	return &typepb.FractionalPercent{
+		Numerator:   uint32(math.Round(rate * 1000000)),
+		Denominator: typepb.FractionalPercent_MILLION,
+	}, nil
+}
+
+// CreateCustomTags outputs the custom span tags, from static values in the
+// format "TAG=VALUE[,TAG=VALUE...]" and from request headers in the format
+// "TAG=HEADER[,TAG=HEADER...]".
+func CreateCustomTags(literalTags, headerTags string) ([]*tracingpb.CustomTag, error) {
+	var tags []*tracingpb.CustomTag
+	literals, err := parseTags(literalTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracing custom tags: %v", err)
+	}
+	for _, kv := range literals {
+		tags = append(tags, &tracingpb.CustomTag{
+			Tag: kv[0],
+			Type: &tracingpb.CustomTag_Literal_{
+				Literal: &tracingpb.CustomTag_Literal{
+					Value: kv[1],
+				},
+			},
+		})
+	}
+
+	headers, err := parseTags(headerTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracing header tags: %v", err)
+	}
+	for _, kv := range headers {
+		tags = append(tags, &tracingpb.CustomTag{
+			Tag: kv[0],
+			Type: &tracingpb.CustomTag_RequestHeader{
+				RequestHeader: &tracingpb.CustomTag_Header{
+					Name: kv[1],
+				},
+			},
+		})
+	}
+	return tags, nil
+}
+
+func parseTags(s string) ([][2]string, error) {
+	var tags [][2]string
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("tag %q must be in the format TAG=VALUE", entry)
+		}
+		tags = append(tags, [2]string{strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])})
+	}
+	return tags, nil
+}
+
 // CreateTracing outputs envoy HCM tracing config.
 func CreateTracing(opts options.CommonOptions) (*hcmpb.HttpConnectionManager_Tracing, error) {
 
-	openCensusConfig, err := createOpenCensusConfig(opts)
+	var tracerName string
+	var tracerConfig proto.Message
+	var err error
+	switch opts.TracingProvider {
+	case "", "stackdriver":
+		tracerName = "envoy.tracers.opencensus"
+		tracerConfig, err = createOpenCensusConfig(opts)
+	case "zipkin":
+		tracerName = "envoy.tracers.zipkin"
+		tracerConfig, err = createZipkinConfig(opts)
+	default:
+		return nil, fmt.Errorf("invalid tracing provider: %v. It must be one of (stackdriver|zipkin)", opts.TracingProvider)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	typedConfig, err := ptypes.MarshalAny(openCensusConfig)
+	typedConfig, err := ptypes.MarshalAny(tracerConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	if opts.TracingSamplingRate < 0.0 || opts.TracingSamplingRate > 1.0 {
-		return nil, fmt.Errorf("invalid trace sampling rate: %v. It must be >= 0.0 and <= 1.0", opts.TracingSamplingRate)
+	percentSampleRate, err := SampleRateToPercent(opts.TracingSamplingRate)
+	if err != nil {
+		return nil, err
 	}
 
-	// This results in precision errors. Round percentage to 4 decimal points.
-	percentSampleRate := opts.TracingSamplingRate * 100
-	percentSampleRate = math.Round(percentSampleRate*10000) / 10000
-
 	return &hcmpb.HttpConnectionManager_Tracing{
 		ClientSampling: &typepb.Percent{
 			Value: 0,
 		},
-		RandomSampling: &typepb.Percent{
-			Value: percentSampleRate,
-		},
-		OverallSampling: &typepb.Percent{
-			Value: percentSampleRate,
-		},
+		RandomSampling:  percentSampleRate,
+		OverallSampling: percentSampleRate,
 		Provider: &tracepb.Tracing_Http{
-			Name:       "envoy.tracers.opencensus",
+			Name:       tracerName,
 			ConfigType: &tracepb.Tracing_Http_TypedConfig{TypedConfig: typedConfig},
 		},
 	}, nil
@@ -29,6 +29,8 @@ import (
 	opencensuspb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
 	tracepb "github.com/envoyproxy/go-control-plane/envoy/config/trace/v3"
 	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tracingpb "github.com/envoyproxy/go-control-plane/envoy/type/tracing/v3"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 )
 
 const (
@@ -469,3 +471,137 @@ func runTest(_ *testing.T, shouldRunServer bool, f func()) {
 
 	f()
 }
+
+func TestZipkinConfig(t *testing.T) {
+	testData := []struct {
+		desc                 string
+		collectorAddress     string
+		disableSharedSpanCtx bool
+		traceId128Bit        bool
+		wantResult           *tracepb.ZipkinConfig
+		wantError            string
+	}{
+		{
+			desc:             "Success with the default collector path",
+			collectorAddress: "http://zipkin:9411",
+			wantResult: &tracepb.ZipkinConfig{
+				CollectorCluster:         "zipkin-collector-cluster",
+				CollectorEndpoint:        "/api/v2/spans",
+				CollectorEndpointVersion: tracepb.ZipkinConfig_HTTP_JSON,
+				SharedSpanContext:        &wrapperspb.BoolValue{Value: true},
+			},
+		},
+		{
+			desc:                 "Success with a custom collector path and 128-bit trace ids",
+			collectorAddress:     "https://jaeger-collector:9411/zipkin/spans",
+			disableSharedSpanCtx: true,
+			traceId128Bit:        true,
+			wantResult: &tracepb.ZipkinConfig{
+				CollectorCluster:         "zipkin-collector-cluster",
+				CollectorEndpoint:        "/zipkin/spans",
+				CollectorEndpointVersion: tracepb.ZipkinConfig_HTTP_JSON,
+				TraceId_128Bit:           true,
+				SharedSpanContext:        &wrapperspb.BoolValue{Value: false},
+			},
+		},
+		{
+			desc:      "Failed without the collector address",
+			wantError: "tracing_zipkin_collector_address is required",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultCommonOptions()
+		opts.TracingProvider = "zipkin"
+		opts.TracingZipkinCollectorAddress = tc.collectorAddress
+		opts.TracingZipkinSharedSpanContext = !tc.disableSharedSpanCtx
+		opts.TracingZipkinTraceId128Bit = tc.traceId128Bit
+
+		got, err := createZipkinConfig(opts)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): failed, got err: %v, want err: %v", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): failed, got err: %v, want no err", tc.desc, err)
+		}
+		if !proto.Equal(got, tc.wantResult) {
+			t.Errorf("Test (%s): failed, got : %v, want: %v", tc.desc, got, tc.wantResult)
+		}
+
+		tracing, err := CreateTracing(opts)
+		if err != nil {
+			t.Fatalf("Test (%s): failed, got err: %v, want no err", tc.desc, err)
+		}
+		if gotName := tracing.GetProvider().GetName(); gotName != "envoy.tracers.zipkin" {
+			t.Errorf("Test (%s): failed, got provider: %v, want: envoy.tracers.zipkin", tc.desc, gotName)
+		}
+	}
+}
+
+func TestCreateCustomTags(t *testing.T) {
+	testData := []struct {
+		desc        string
+		literalTags string
+		headerTags  string
+		wantTags    []*tracingpb.CustomTag
+		wantError   string
+	}{
+		{
+			desc: "No custom tags by default",
+		},
+		{
+			desc:        "Success with literal and header tags",
+			literalTags: "env=prod, team=books",
+			headerTags:  "tenant=x-tenant-id",
+			wantTags: []*tracingpb.CustomTag{
+				{
+					Tag: "env",
+					Type: &tracingpb.CustomTag_Literal_{
+						Literal: &tracingpb.CustomTag_Literal{Value: "prod"},
+					},
+				},
+				{
+					Tag: "team",
+					Type: &tracingpb.CustomTag_Literal_{
+						Literal: &tracingpb.CustomTag_Literal{Value: "books"},
+					},
+				},
+				{
+					Tag: "tenant",
+					Type: &tracingpb.CustomTag_RequestHeader{
+						RequestHeader: &tracingpb.CustomTag_Header{Name: "x-tenant-id"},
+					},
+				},
+			},
+		},
+		{
+			desc:       "Failed with an invalid header tag",
+			headerTags: "tenant",
+			wantError:  `invalid tracing header tags: tag "tenant" must be in the format TAG=VALUE`,
+		},
+	}
+
+	for _, tc := range testData {
+		got, err := CreateCustomTags(tc.literalTags, tc.headerTags)
+		if tc.wantError != "" {
+			if err == nil || err.Error() != tc.wantError {
+				t.Errorf("Test (%s): failed, got err: %v, want err: %v", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): failed, got err: %v, want no err", tc.desc, err)
+		}
+		if len(got) != len(tc.wantTags) {
+			t.Fatalf("Test (%s): failed, got : %v, want: %v", tc.desc, got, tc.wantTags)
+		}
+		for i := range got {
+			if !proto.Equal(got[i], tc.wantTags[i]) {
+				t.Errorf("Test (%s): failed, got : %v, want: %v", tc.desc, got[i], tc.wantTags[i])
+			}
+		}
+	}
+}
@@ -17,6 +17,7 @@ package httppattern
 import (
 	"bytes"
 	"fmt"
+	"strings"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -122,6 +123,52 @@ func (u *UriTemplate) Equal(v *UriTemplate) bool {
 	return cmp.Equal(u.Segments, v.Segments) && cmp.Equal(u.Variables, v.Variables) && cmp.Equal(u.Verb, v.Verb)
 }
 
+// Clone returns a deep copy of the uriTemplate, which can be modified without
+// affecting the original one.
+func (u *UriTemplate) Clone() *UriTemplate {
+	clone := &UriTemplate{
+		Verb:   u.Verb,
+		Origin: u.Origin,
+	}
+	clone.Segments = cloneStrings(u.Segments)
+	for _, v := range u.Variables {
+		clone.Variables = append(clone.Variables, &variable{
+			StartSegment:      v.StartSegment,
+			EndSegment:        v.EndSegment,
+			FieldPath:         cloneStrings(v.FieldPath),
+			HasDoubleWildCard: v.HasDoubleWildCard,
+		})
+	}
+	return clone
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// AddPrefix prepends the segments of a literal path prefix, e.g.
+// "/gateway/v1", to the uri template. The variables keep binding the same
+// segments.
+func (u *UriTemplate) AddPrefix(prefix string) {
+	segments := strings.Split(strings.Trim(prefix, "/"), "/")
+	u.Segments = append(segments, u.Segments...)
+	for _, v := range u.Variables {
+		v.StartSegment += len(segments)
+		// A negative end segment is relative to the end of the path.
+		if v.EndSegment >= 0 {
+			v.EndSegment += len(segments)
+		}
+	}
+	if u.Origin == "/" {
+		u.Origin = "/" + strings.Join(segments, "/")
+	} else {
+		u.Origin = "/" + strings.Join(segments, "/") + u.Origin
+	}
+}
+
 // Replace all the variable fields found in the input map.
 func (u *UriTemplate) ReplaceVariableField(fieldMapping map[string]string) {
 	for _, v := range u.Variables {
@@ -147,6 +194,32 @@ func (u *UriTemplate) IsExactMatch() bool {
 	return true
 }
 
+// IsPrefixMatch returns true if the only wildcard of the uri template is its
+// last segment "**", without a verb. Its regex then matches the same paths as
+// the prefix from PrefixMatchString.
+func (u *UriTemplate) IsPrefixMatch() bool {
+	if len(u.Segments) == 0 || u.Segments[len(u.Segments)-1] != DoubleWildCardKey || u.Verb != "" {
+		return false
+	}
+	for _, seg := range u.Segments[:len(u.Segments)-1] {
+		if seg == SingleWildCardKey || seg == DoubleWildCardKey {
+			return false
+		}
+	}
+	return true
+}
+
+// PrefixMatchString returns the path prefix of a uri template ending with
+// "**", with a trailing slash, e.g. "/v1/files/" for "/v1/files/**".
+func (u *UriTemplate) PrefixMatchString() string {
+	buff := bytes.Buffer{}
+	for _, seg := range u.Segments[:len(u.Segments)-1] {
+		buff.WriteString("/" + seg)
+	}
+	buff.WriteString("/")
+	return buff.String()
+}
+
 // Generate regular expression of the current uri template.
 func (u *UriTemplate) Regex() string {
 	regex := bytes.Buffer{}
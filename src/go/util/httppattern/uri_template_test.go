@@ -15,6 +15,7 @@
 package httppattern
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -291,3 +292,103 @@ func TestUriTemplateRegex(t *testing.T) {
 		})
 	}
 }
+
+func TestUriTemplatePrefixMatch(t *testing.T) {
+	testData := []struct {
+		desc       string
+		uri        string
+		wantPrefix string
+	}{
+		{
+			desc:       "Trailing wildcard",
+			uri:        "/v1/files/**",
+			wantPrefix: "/v1/files/",
+		},
+		{
+			desc:       "Trailing wildcard in segment binding",
+			uri:        "/v1/{name=files/**}",
+			wantPrefix: "/v1/files/",
+		},
+		{
+			desc:       "Root wildcard",
+			uri:        "/**",
+			wantPrefix: "/",
+		},
+		{
+			desc: "No wildcard",
+			uri:  "/v1/files",
+		},
+		{
+			desc: "Single wildcard before the trailing wildcard",
+			uri:  "/v1/{bucket}/**",
+		},
+		{
+			desc: "Trailing wildcard with verb",
+			uri:  "/v1/files/**:upload",
+		},
+		{
+			desc: "Trailing single wildcard",
+			uri:  "/v1/files/*",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			uriTemplate, _ := ParseUriTemplate(tc.uri)
+			if uriTemplate == nil {
+				t.Fatalf("fail to parse uri template %s", tc.uri)
+			}
+
+			if got := uriTemplate.IsPrefixMatch(); got != (tc.wantPrefix != "") {
+				t.Fatalf("Test (%v): got IsPrefixMatch %v", tc.desc, got)
+			}
+			if tc.wantPrefix == "" {
+				return
+			}
+			if got := uriTemplate.PrefixMatchString(); got != tc.wantPrefix {
+				t.Errorf("Test (%v): \n got %v \nwant %v", tc.desc, got, tc.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestUriTemplateClone(t *testing.T) {
+	for _, template := range []string{"/shelves/{shelf}/books/{book}", "/a/{b=c/**}/d:verb", "/**"} {
+		uriTemplate, err := ParseUriTemplate(template)
+		if err != nil {
+			t.Fatalf("fail to parse %s: %v", template, err)
+		}
+		want := uriTemplate.String()
+		clone := uriTemplate.Clone()
+		if !clone.Equal(uriTemplate) || clone.Origin != uriTemplate.Origin {
+			t.Errorf("Test (%s): want clone %v, get %v", template, uriTemplate, clone)
+		}
+
+		clone.ReplaceVariableField(map[string]string{"shelf": "shelf_id", "b": "b_id"})
+		if got := uriTemplate.String(); got != want {
+			t.Errorf("Test (%s): want the original template %s unchanged by its clone, get %s", template, want, got)
+		}
+	}
+}
+
+func TestUriTemplateAddPrefix(t *testing.T) {
+	for _, template := range []string{"/", "/shelves/{shelf}/books/{book}", "/a/{b=c/**}/d:verb", "/v1/files/**", "/{name=*}"} {
+		uriTemplate, err := ParseUriTemplate(template)
+		if err != nil {
+			t.Fatalf("fail to parse %s: %v", template, err)
+		}
+		uriTemplate.AddPrefix("/gateway/v1")
+
+		wantOrigin := "/gateway/v1" + strings.TrimSuffix(template, "/")
+		want, err := ParseUriTemplate(wantOrigin)
+		if err != nil {
+			t.Fatalf("fail to parse %s: %v", wantOrigin, err)
+		}
+		if !uriTemplate.Equal(want) || uriTemplate.Origin != wantOrigin {
+			t.Errorf("Test (%s): want prefixed template %v, get %v", template, want, uriTemplate)
+		}
+		if got, wantRegex := uriTemplate.Regex(), want.Regex(); got != wantRegex {
+			t.Errorf("Test (%s): want regex %s, get %s", template, wantRegex, got)
+		}
+	}
+}
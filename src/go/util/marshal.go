@@ -15,15 +15,28 @@
 package util
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"path/filepath"
 
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig/openapi"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 
+	rcdpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/access_log/response_code_details"
 	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/backend_auth"
+	bvpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/body_validation"
+	ccpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/cache_control"
+	clpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/concurrency_limit"
+	etagpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/etag"
+	gsmpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/grpc_status_mapping"
+	idpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/idempotency"
 	prpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/path_rewrite"
+	qrpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/query_rewrite"
+	rlpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/rate_limit"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	sfpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/stream_format"
 
 	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	statspb "github.com/envoyproxy/go-control-plane/envoy/config/metrics/v3"
@@ -32,11 +45,16 @@ import (
 	accessgrpcpb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
 	transcoderpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_json_transcoder/v3"
 	gspb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_stats/v3"
+	htmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/header_to_metadata/v3"
 	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	lrlpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	ratelimitpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ratelimit/v3"
+	rbacpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
 	routerpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	tlspb "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
@@ -81,10 +99,20 @@ var Resolver = FuncResolver(func(url string) (proto.Message, error) {
 		return new(gspb.FilterConfig), nil
 	case "type.googleapis.com/envoy.extensions.filters.http.grpc_json_transcoder.v3.GrpcJsonTranscoder":
 		return new(transcoderpb.GrpcJsonTranscoder), nil
+	case "type.googleapis.com/envoy.extensions.filters.http.header_to_metadata.v3.Config":
+		return new(htmpb.Config), nil
 	case "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.JwtAuthentication":
 		return new(jwtpb.JwtAuthentication), nil
 	case "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.PerRouteConfig":
 		return new(jwtpb.PerRouteConfig), nil
+	case "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC":
+		return new(rbacpb.RBAC), nil
+	case "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBACPerRoute":
+		return new(rbacpb.RBACPerRoute), nil
+	case "type.googleapis.com/envoy.extensions.filters.http.ratelimit.v3.RateLimit":
+		return new(ratelimitpb.RateLimit), nil
+	case "type.googleapis.com/envoy.extensions.filters.http.local_ratelimit.v3.LocalRateLimit":
+		return new(lrlpb.LocalRateLimit), nil
 	case "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager":
 		return new(hcmpb.HttpConnectionManager), nil
 	case "type.googleapis.com/espv2.api.envoy.v9.http.path_rewrite.PerRouteFilterConfig":
@@ -97,6 +125,40 @@ var Resolver = FuncResolver(func(url string) (proto.Message, error) {
 		return new(bapb.PerRouteFilterConfig), nil
 	case "type.googleapis.com/espv2.api.envoy.v9.http.backend_auth.FilterConfig":
 		return new(bapb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.access_log.response_code_details.FilterConfig":
+		return new(rcdpb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.etag.PerRouteFilterConfig":
+		return new(etagpb.PerRouteFilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.etag.FilterConfig":
+		return new(etagpb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.idempotency.FilterConfig":
+		return new(idpb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.idempotency.PerRouteFilterConfig":
+		return new(idpb.PerRouteFilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.rate_limit.FilterConfig":
+		return new(rlpb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.concurrency_limit.PerRouteFilterConfig":
+		return new(clpb.PerRouteFilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.grpc_status_mapping.FilterConfig":
+		return new(gsmpb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.grpc_status_mapping.PerRouteFilterConfig":
+		return new(gsmpb.PerRouteFilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.body_validation.FilterConfig":
+		return new(bvpb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.body_validation.PerRouteFilterConfig":
+		return new(bvpb.PerRouteFilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.stream_format.FilterConfig":
+		return new(sfpb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.stream_format.PerRouteFilterConfig":
+		return new(sfpb.PerRouteFilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.cache_control.FilterConfig":
+		return new(ccpb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.cache_control.PerRouteFilterConfig":
+		return new(ccpb.PerRouteFilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.query_rewrite.FilterConfig":
+		return new(qrpb.FilterConfig), nil
+	case "type.googleapis.com/espv2.api.envoy.v9.http.query_rewrite.PerRouteFilterConfig":
+		return new(qrpb.PerRouteFilterConfig), nil
 	case "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router":
 		return new(routerpb.Router), nil
 	case "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext":
@@ -135,6 +197,10 @@ var UnmarshalBytesToPbMessage = func(input []byte, output proto.Message) error {
 		if err := proto.Unmarshal(input, output.(*smpb.ListServiceRolloutsResponse)); err != nil {
 			return fmt.Errorf("fail to unmarshal %T: %v", t, err)
 		}
+	case *descpb.FileDescriptorSet:
+		if err := proto.Unmarshal(input, output.(*descpb.FileDescriptorSet)); err != nil {
+			return fmt.Errorf("fail to unmarshal %T: %v", t, err)
+		}
 	case *servicecontrolpb.ReportResponse:
 		if err := proto.Unmarshal(input, output.(*servicecontrolpb.ReportResponse)); err != nil {
 			return fmt.Errorf("fail to unmarshal %T: %v", t, err)
@@ -159,7 +225,35 @@ func UnmarshalServiceConfig(config io.Reader) (*confpb.Service, error) {
 	return &serviceConfig, nil
 }
 
+// UnmarshalServiceConfigFile converts the content of a service config file to
+// proto. The file is in the proto text format if its extension is .textproto,
+// .prototxt or .pbtxt, otherwise in JSON, either a service config or an
+// OpenAPI 3 document converted to one.
+func UnmarshalServiceConfigFile(path string, config []byte) (*confpb.Service, error) {
+	switch filepath.Ext(path) {
+	case ".textproto", ".prototxt", ".pbtxt":
+		var serviceConfig confpb.Service
+		if err := proto.UnmarshalText(string(config), &serviceConfig); err != nil {
+			return nil, fmt.Errorf("fail to unmarshal serviceConfig in text format: %s", err)
+		}
+		return &serviceConfig, nil
+	default:
+		if openapi.IsOpenAPIDocument(config) {
+			return openapi.ToServiceConfig(config)
+		}
+		return UnmarshalServiceConfig(bytes.NewReader(config))
+	}
+}
+
 func ProtoToJson(msg proto.Message) (string, error) {
 	marshaler := &jsonpb.Marshaler{}
 	return marshaler.MarshalToString(msg)
 }
+
+// ProtoToIndentedJson marshals the message to JSON with one field per line.
+// The fields are in the order of the proto and the map entries are sorted by
+// key, so the output is stable for diffs.
+func ProtoToIndentedJson(msg proto.Message) (string, error) {
+	marshaler := &jsonpb.Marshaler{Indent: "  "}
+	return marshaler.MarshalToString(msg)
+}
@@ -23,9 +23,12 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
+	rcdpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/access_log/response_code_details"
+
 	statspb "github.com/envoyproxy/go-control-plane/envoy/config/metrics/v3"
 	accessfilepb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
 	accessgrpcpb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	htmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/header_to_metadata/v3"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
 	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
@@ -42,6 +45,8 @@ func TestResolver(t *testing.T) {
 		{msg: &statspb.StatsSink{}},
 		{msg: &statspb.StatsdSink{}},
 		{msg: &statspb.StatsConfig{}},
+		{msg: &htmpb.Config{}},
+		{msg: &rcdpb.FilterConfig{}},
 	}
 
 	marshaler := &jsonpb.Marshaler{
@@ -110,3 +115,66 @@ func TestUnmarshalBytesToPbMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalServiceConfigFile(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		path      string
+		config    string
+		wantResp  *confpb.Service
+		wantError string
+	}{
+		{
+			desc:   "unmarshal JSON",
+			path:   "/etc/espv2/service.json",
+			config: `{"name": "bookstore.endpoints.project123.cloud.goog", "id": "test-id"}`,
+			wantResp: &confpb.Service{
+				Name: "bookstore.endpoints.project123.cloud.goog",
+				Id:   "test-id",
+			},
+		},
+		{
+			desc:   "unmarshal proto text format",
+			path:   "/etc/espv2/service.textproto",
+			config: `name: "bookstore.endpoints.project123.cloud.goog" id: "test-id"`,
+			wantResp: &confpb.Service{
+				Name: "bookstore.endpoints.project123.cloud.goog",
+				Id:   "test-id",
+			},
+		},
+		{
+			desc:      "JSON with the extension of the proto text format",
+			path:      "/etc/espv2/service.pbtxt",
+			config:    `{"name": "bookstore.endpoints.project123.cloud.goog"}`,
+			wantError: "fail to unmarshal serviceConfig in text format",
+		},
+		{
+			desc:      "invalid JSON",
+			path:      "/etc/espv2/service",
+			config:    `name: "bookstore.endpoints.project123.cloud.goog"`,
+			wantError: "fail to unmarshal serviceConfig",
+		},
+		{
+			desc:      "OpenAPI document converted to a service config",
+			path:      "/etc/espv2/openapi.json",
+			config:    `{"openapi": "3.0.3", "paths": {}}`,
+			wantError: "OpenAPI document has no server to name the service",
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := UnmarshalServiceConfigFile(tc.path, []byte(tc.config))
+		if err != nil {
+			if tc.wantError == "" || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if tc.wantError != "" {
+			t.Errorf("Test (%s): want error: %s, get no error", tc.desc, tc.wantError)
+		}
+		if !proto.Equal(got, tc.wantResp) {
+			t.Errorf("Test (%s): want: %v, get: %v", tc.desc, tc.wantResp, got)
+		}
+	}
+}
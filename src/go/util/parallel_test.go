@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForEachIndex(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	testData := []struct {
+		desc      string
+		n         int
+		failing   map[int]bool
+		wantError string
+	}{
+		{
+			desc: "no index",
+			n:    0,
+		},
+		{
+			desc: "fewer indexes than workers",
+			n:    2,
+		},
+		{
+			desc: "more indexes than workers",
+			n:    1000,
+		},
+		{
+			desc:      "the error of the lowest failing index is returned",
+			n:         1000,
+			failing:   map[int]bool{999: true, 500: true, 7: true},
+			wantError: "index 7 failed",
+		},
+	}
+
+	for _, tc := range testData {
+		calls := make([]int32, tc.n)
+		err := ForEachIndex(tc.n, func(i int) error {
+			atomic.AddInt32(&calls[i], 1)
+			if tc.failing[i] {
+				return fmt.Errorf("index %d failed", i)
+			}
+			return nil
+		})
+
+		if tc.wantError == "" && err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+		if tc.wantError != "" && (err == nil || err.Error() != tc.wantError) {
+			t.Errorf("Test (%s): want error: %s, get error: %v", tc.desc, tc.wantError, err)
+		}
+		for i, c := range calls {
+			if c > 1 || c == 0 && tc.wantError == "" {
+				t.Errorf("Test (%s): want index %d called once, get %d calls", tc.desc, i, c)
+			}
+		}
+	}
+}
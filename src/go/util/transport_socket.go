@@ -106,6 +106,39 @@ func CreateDownstreamTransportSocket(sslServerPath, sslMinimumProtocol, sslMaxim
 	}, nil
 }
 
+// CreateDownstreamSdsTransportSocket creates a TransportSocket for Downstream,
+// with the certificate of the secret served by the control plane through SDS.
+func CreateDownstreamSdsTransportSocket(secretName, sslMinimumProtocol, sslMaximumProtocol string, cipherSuites string) (*corepb.TransportSocket, error) {
+	commonTls, err := createCommonTlsContext("", "", "", sslMinimumProtocol, sslMaximumProtocol, cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	commonTls.AlpnProtocols = []string{"h2", "http/1.1"}
+	commonTls.TlsCertificateSdsSecretConfigs = []*tlspb.SdsSecretConfig{
+		{
+			Name: secretName,
+			SdsConfig: &corepb.ConfigSource{
+				ResourceApiVersion: corepb.ApiVersion_V3,
+				ConfigSourceSpecifier: &corepb.ConfigSource_Ads{
+					Ads: &corepb.AggregatedConfigSource{},
+				},
+			},
+		},
+	}
+	tlsContext, err := ptypes.MarshalAny(&tlspb.DownstreamTlsContext{
+		CommonTlsContext: commonTls,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &corepb.TransportSocket{
+		Name: TLSTransportSocket,
+		ConfigType: &corepb.TransportSocket_TypedConfig{
+			TypedConfig: tlsContext,
+		},
+	}, nil
+}
+
 func createCommonTlsContext(rootCertsPath, sslPath, sslFileName, sslMinimumProtocol, sslMaximumProtocol string, cipherSuites string) (*tlspb.CommonTlsContext, error) {
 	commonTls := &tlspb.CommonTlsContext{}
 	// Add TLS certificate
@@ -266,3 +266,76 @@ func TestCreateDownstreamTransportSocket(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateDownstreamSdsTransportSocket(t *testing.T) {
+	testData := []struct {
+		desc                string
+		secretName          string
+		sslMinimumProtocol  string
+		wantTransportSocket string
+	}{
+		{
+			desc:       "Downstream Transport Socket for TLS with an SDS secret",
+			secretName: "acme_server_cert",
+			wantTransportSocket: `{
+				"name":"envoy.transport_sockets.tls",
+				"typedConfig":{
+					"@type":"type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext",
+					"commonTlsContext":{
+						"alpnProtocols":["h2","http/1.1"],
+						"tlsCertificateSdsSecretConfigs":[
+							{
+								"name":"acme_server_cert",
+								"sdsConfig":{
+									"ads":{},
+									"resourceApiVersion":"V3"
+								}
+							}
+						]
+					}
+				}
+			}`,
+		},
+		{
+			desc:               "Downstream Transport Socket for TLS with an SDS secret, with version requirements",
+			secretName:         "acme_server_cert",
+			sslMinimumProtocol: "TLSv1.2",
+			wantTransportSocket: `{
+				"name":"envoy.transport_sockets.tls",
+				"typedConfig":{
+					"@type":"type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext",
+					"commonTlsContext":{
+						"alpnProtocols":["h2","http/1.1"],
+						"tlsCertificateSdsSecretConfigs":[
+							{
+								"name":"acme_server_cert",
+								"sdsConfig":{
+									"ads":{},
+									"resourceApiVersion":"V3"
+								}
+							}
+						],
+						"tlsParams":{
+							"tlsMinimumProtocolVersion":"TLSv1_2"
+						}
+					}
+				}
+			}`,
+		},
+	}
+
+	for i, tc := range testData {
+		gotTransportSocket, err := CreateDownstreamSdsTransportSocket(tc.secretName, tc.sslMinimumProtocol, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		marshaler := &jsonpb.Marshaler{}
+		gotConfig, err := marshaler.MarshalToString(gotTransportSocket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := JsonEqual(tc.wantTransportSocket, gotConfig); err != nil {
+			t.Errorf("Test Desc(%d): %s, CreateDownstreamSdsTransportSocket failed,\n %v", i, tc.desc, err)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package util
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -23,9 +24,13 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
+	// The scheme prefix of Google Cloud Storage object uris.
+	GcsURIPrefix = "gs://"
+
 	// Default port for HTTP.
 	HTTPDefaultPort = "80"
 
@@ -102,9 +107,11 @@ func ParseBackendProtocol(scheme string, httpProtocol string) (BackendProtocol,
 }
 
 // Note: the path of openID discovery may be https
-var getRemoteContent = func(path string) ([]byte, error) {
+var getRemoteContent = func(path string, timeout time.Duration) ([]byte, error) {
 	req, _ := http.NewRequest("GET", path, nil)
-	client := &http.Client{}
+	client := &http.Client{
+		Timeout: timeout,
+	}
 	resp, err := client.Do(req)
 
 	if err != nil {
@@ -118,14 +125,29 @@ var getRemoteContent = func(path string) ([]byte, error) {
 	return ioutil.ReadAll(resp.Body)
 }
 
-func ResolveJwksUriUsingOpenID(uri string) (string, error) {
+// FetchJwks fetches the JWKS document of a jwks_uri, within the timeout if
+// not 0.
+func FetchJwks(uri string, timeout time.Duration) ([]byte, error) {
+	body, err := getRemoteContent(uri, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch jwks from %s: %v", uri, err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, fmt.Errorf("Empty jwks from %s", uri)
+	}
+	return body, nil
+}
+
+// ResolveJwksUriUsingOpenID fetches the jwks_uri of an issuer from its OpenID
+// discovery configuration, within the timeout if not 0.
+func ResolveJwksUriUsingOpenID(uri string, timeout time.Duration) (string, error) {
 	if !strings.HasPrefix(uri, "http") {
 		uri = fmt.Sprintf("https://%s", uri)
 	}
 	uri = strings.TrimSuffix(uri, "/")
 	uri = fmt.Sprintf("%s%s", uri, OpenIDDiscoveryCfgURLSuffix)
 
-	body, err := getRemoteContent(uri)
+	body, err := getRemoteContent(uri, timeout)
 	if err != nil {
 		return "", fmt.Errorf("Failed to fetch jwks_uri from %s: %v", uri, err)
 	}
@@ -142,6 +164,18 @@ func ResolveJwksUriUsingOpenID(uri string) (string, error) {
 	return jwksURI, nil
 }
 
+// ParseGcsURI splits a gs://BUCKET/OBJECT uri into its bucket and object.
+func ParseGcsURI(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, GcsURIPrefix) {
+		return "", "", fmt.Errorf("uri %s should start with %s", uri, GcsURIPrefix)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, GcsURIPrefix), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("uri %s should be in the format %sBUCKET/OBJECT", uri, GcsURIPrefix)
+	}
+	return parts[0], parts[1], nil
+}
+
 func IamIdentityTokenPath(IamServiceAccount string) string {
 	return fmt.Sprintf("/v1/projects/-/serviceAccounts/%s:generateIdToken", IamServiceAccount)
 }
@@ -173,4 +207,9 @@ var (
 		return fmt.Sprintf("%s/v1/services/%s/configs/%s?view=FULL",
 			serviceManagementUrl, serviceName, configId)
 	}
+
+	FetchGcsObjectURL = func(bucket, object string) string {
+		return fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media",
+			bucket, url.PathEscape(object))
+	}
 )
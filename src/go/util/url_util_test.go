@@ -20,6 +20,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -442,7 +443,7 @@ func TestResolveJwksUriUsingOpenID(t *testing.T) {
 		},
 	}
 	for i, tc := range testData {
-		uri, err := ResolveJwksUriUsingOpenID(tc.issuer)
+		uri, err := ResolveJwksUriUsingOpenID(tc.issuer, 30*time.Second)
 		if uri != tc.wantUri {
 			t.Errorf("Test Desc(%d): %s, resolve jwksUri by openID got: %v, want: %v", i, tc.desc, uri, tc.wantUri)
 		}
@@ -483,6 +484,48 @@ func TestExtraAddressFromURI(t *testing.T) {
 	}
 }
 
+func TestParseGcsURI(t *testing.T) {
+	testData := []struct {
+		desc         string
+		uri          string
+		wantedBucket string
+		wantedObject string
+		wantedError  string
+	}{
+		{
+			desc:         "Succeeded to parse uri",
+			uri:          "gs://my-bucket/path/to/api_descriptor.pb",
+			wantedBucket: "my-bucket",
+			wantedObject: "path/to/api_descriptor.pb",
+		},
+		{
+			desc:        "Failed with wrong scheme",
+			uri:         "https://my-bucket/api_descriptor.pb",
+			wantedError: "should start with gs://",
+		},
+		{
+			desc:        "Failed without object",
+			uri:         "gs://my-bucket/",
+			wantedError: "should be in the format gs://BUCKET/OBJECT",
+		},
+		{
+			desc:        "Failed without bucket",
+			uri:         "gs:///api_descriptor.pb",
+			wantedError: "should be in the format gs://BUCKET/OBJECT",
+		},
+	}
+
+	for i, tc := range testData {
+		bucket, object, err := ParseGcsURI(tc.uri)
+		if bucket != tc.wantedBucket || object != tc.wantedObject {
+			t.Errorf("Test Desc(%d): %s, ParseGcsURI got: (%v, %v), want: (%v, %v)", i, tc.desc, bucket, object, tc.wantedBucket, tc.wantedObject)
+		}
+		if (err == nil) != (tc.wantedError == "") || (err != nil && !strings.Contains(err.Error(), tc.wantedError)) {
+			t.Errorf("Test Desc(%d): %s, ParseGcsURI got error: %v, want: %v", i, tc.desc, err, tc.wantedError)
+		}
+	}
+}
+
 func TestFetchConfigRelatedUrl(t *testing.T) {
 	sm := "https://servicemanagement.googleapis.com"
 	sn := "service-name"
@@ -25,6 +25,10 @@ const (
 	// JwtPayloadMetadataName is the field name passed into metadata
 	JwtPayloadMetadataName = "jwt_payloads"
 
+	// The filter state set by the service control filter.
+	FilterStateApiMethod  = "com.google.espv2.filters.http.service_control.api_method"
+	FilterStateApiKeyHash = "com.google.espv2.filters.http.service_control.api_key_hash"
+
 	// Supported Http Methods.
 
 	GET     = "GET"
@@ -40,6 +44,17 @@ const (
 	FixedRolloutStrategy   = "fixed"
 	ManagedRolloutStrategy = "managed"
 
+	// Healthz modes
+	ProxyOnlyHealthzMode    = "proxy_only"
+	BackendAwareHealthzMode = "backend_aware"
+
+	// The Check method of the gRPC health checking protocol.
+	GrpcHealthCheckSelector = "grpc.health.v1.Health.Check"
+	GrpcHealthCheckPath     = "/grpc.health.v1.Health/Check"
+
+	// The path prefix of the ACME HTTP-01 challenges, followed by the token.
+	AcmeHttpChallengePathPrefix = "/.well-known/acme-challenge/"
+
 	// Metadata suffix
 
 	ConfigIDPath          = "/computeMetadata/v1/instance/attributes/endpoints-service-version"
@@ -58,8 +73,19 @@ const (
 	// GKE/GCE platforms are zonal. Regional path does not exist in IMDS.
 	ZonePath = "/computeMetadata/v1/instance/zone"
 
+	// AWS IMDSv2 paths.
+	AWSSessionTokenPath     = "/latest/api/token"
+	AWSAvailabilityZonePath = "/latest/meta-data/placement/availability-zone"
+
+	// Azure IMDS path, the api-version query parameter is required.
+	AzureComputePath = "/metadata/instance/compute?api-version=2020-09-01&format=json"
+
 	// The path of getting access token from token agent server
 	TokenAgentAccessTokenPath = "/local/access_token"
+	// The paths of the identity tokens and of the token fetch metrics of the
+	// token agent server.
+	TokenAgentIdentityTokenPath = "/local/identity_token"
+	TokenAgentMetricsPath       = "/local/metrics"
 
 	// b/147591854: This string must NOT have a trailing slash
 	OpenIDDiscoveryCfgURLSuffix = "/.well-known/openid-configuration"
@@ -68,6 +94,14 @@ const (
 	GAEFlex = "GAE_FLEX(ESPv2)"
 	GKE     = "GKE(ESPv2)"
 	GCE     = "GCE(ESPv2)"
+	AWS     = "AWS(ESPv2)"
+	Azure   = "AZURE(ESPv2)"
+
+	// Metadata providers
+	GCPMetadataProvider     = "gcp"
+	AWSMetadataProvider     = "aws"
+	AzureMetadataProvider   = "azure"
+	StaticTokenFileProvider = "static_token_file"
 
 	// System Parameter Name
 	ApiKeyParameterName = "api_key"
@@ -93,14 +127,54 @@ const (
 	// Default api key locations
 	DefaultApiKeyQueryParamKey    = "key"
 	DefaultApiKeyQueryParamApiKey = "api_key"
+	DefaultApiKeyHeader           = "x-api-key"
 
 	// Strict Transport Security header key and value
 	HSTSHeaderKey   = "Strict-Transport-Security"
 	HSTSHeaderValue = "max-age=31536000; includeSubdomains"
 
+	// The response headers of the matched route with --enable_route_debug_headers.
+	RouteDebugOperationHeaderKey = "x-espv2-debug-operation"
+	RouteDebugClusterHeaderKey   = "x-espv2-debug-cluster"
+
+	// The request headers with the original path, host and HTTP method of the
+	// requests to the remote backends.
+	OriginalPathHeaderKey   = "x-envoy-original-path"
+	OriginalHostHeaderKey   = "x-forwarded-host"
+	OriginalMethodHeaderKey = "x-envoy-original-method"
+
+	// The response header of the operations in maintenance.
+	RetryAfterHeaderKey = "Retry-After"
+
+	// The CORS headers of the preflight requests and responses.
+	AccessControlRequestMethod       = "access-control-request-method"
+	AccessControlAllowOrigin         = "access-control-allow-origin"
+	AccessControlAllowMethods        = "access-control-allow-methods"
+	AccessControlAllowHeaders        = "access-control-allow-headers"
+	AccessControlMaxAge              = "access-control-max-age"
+	AccessControlAllowCredentials    = "access-control-allow-credentials"
+	AccessControlAllowPrivateNetwork = "access-control-allow-private-network"
+
 	// Standard type url prefix.
 	TypeUrlPrefix = "type.googleapis.com/"
 
+	// The type of the raw HTTP request and response bodies.
+	HttpBodyTypeName = "google.api.HttpBody"
+
+	// The prefix of the well-known types, e.g. google.protobuf.Timestamp,
+	// which have their own JSON mapping.
+	WellKnownTypePrefix = "google.protobuf."
+
+	// The formats of the transcoded server streams other than a JSON array:
+	// newline delimited JSON and Server-Sent Events.
+	StreamFormatNdjson = "ndjson"
+	StreamFormatSse    = "sse"
+
+	// The query styles of the repeated fields of the transcoded requests:
+	// "param=a&param=b", and "param[]=a&param[]=b" too.
+	QueryArrayStyleRepeat   = "repeat"
+	QueryArrayStyleBrackets = "brackets"
+
 	// Loopback Address
 	LoopbackIPv4Addr = "127.0.0.1"
 
@@ -117,6 +191,12 @@ const (
 
 type BackendProtocol int32
 
+// IsGCPMetadataProvider returns true if instance attributes and access tokens
+// are fetched from the GCP metadata server. An empty provider defaults to GCP.
+func IsGCPMetadataProvider(provider string) bool {
+	return provider == "" || provider == GCPMetadataProvider
+}
+
 type GetAccessTokenFunc func() (string, time.Duration, error)
 type GetNewRolloutIdFunc func() (string, error)
 
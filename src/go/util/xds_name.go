@@ -23,6 +23,8 @@ const (
 	Buffer = "envoy.filters.http.buffer"
 	// CORS HTTP filter
 	CORS = "envoy.filters.http.cors"
+	// Cache HTTP filter
+	Cache = "envoy.filters.http.cache"
 	// GRPCJSONTranscoder HTTP filter
 	GRPCJSONTranscoder = "envoy.filters.http.grpc_json_transcoder"
 	// GRPCWeb HTTP filter
@@ -37,10 +39,24 @@ const (
 	HTTPConnectionManager = "envoy.filters.network.http_connection_manager"
 	// JwtAuthn filter.
 	JwtAuthn = "envoy.filters.http.jwt_authn"
+	// HeaderToMetadata HTTP filter
+	HeaderToMetadata = "envoy.filters.http.header_to_metadata"
+	// RBAC HTTP filter
+	RBAC = "envoy.filters.http.rbac"
+	// RateLimit HTTP filter, calling a global rate limit service.
+	RateLimit = "envoy.filters.http.ratelimit"
+	// EnvoyLocalRateLimit HTTP filter, used for the spike arrest.
+	EnvoyLocalRateLimit = "envoy.filters.http.local_ratelimit"
 	// TLSTransportSocket is Envoy TLS Transport Socket name.
 	TLSTransportSocket = "envoy.transport_sockets.tls"
 	// AccessFileLogger filter name
 	AccessFileLogger = "envoy.access_loggers.file"
+	// HttpGrpcAccessLogger is the gRPC Access Log Service logger name.
+	HttpGrpcAccessLogger = "envoy.access_loggers.http_grpc"
+	// StatsdSink is the StatsD stats sink name.
+	StatsdSink = "envoy.stat_sinks.statsd"
+	// DogStatsdSink is the DogStatsD stats sink name.
+	DogStatsdSink = "envoy.stat_sinks.dog_statsd"
 
 	// ESPv2 custom http filters.
 
@@ -52,6 +68,29 @@ const (
 	BackendAuth = "com.google.espv2.filters.http.backend_auth"
 	// gRPC Metadata Scrubber filter.
 	GrpcMetadataScrubber = "com.google.espv2.filters.http.grpc_metadata_scrubber"
+	// Etag filter.
+	Etag = "com.google.espv2.filters.http.etag"
+	// Idempotency filter.
+	Idempotency = "com.google.espv2.filters.http.idempotency"
+	// Local rate limit filter, limiting the consumer tiers in each proxy.
+	LocalRateLimit = "com.google.espv2.filters.http.rate_limit"
+	// Concurrency limit filter.
+	ConcurrencyLimit = "com.google.espv2.filters.http.concurrency_limit"
+	// gRPC status mapping filter.
+	GrpcStatusMapping = "com.google.espv2.filters.http.grpc_status_mapping"
+	// Body validation filter.
+	BodyValidation = "com.google.espv2.filters.http.body_validation"
+	// Stream format filter.
+	StreamFormat = "com.google.espv2.filters.http.stream_format"
+	// Cache control filter, making the responses cacheable by Cache filter.
+	CacheControl = "com.google.espv2.filters.http.cache_control"
+	// Query rewrite filter, rewriting the query parameters before transcoding.
+	QueryRewrite = "com.google.espv2.filters.http.query_rewrite"
+
+	// ESPv2 custom access log filters.
+
+	// Response code details access log filter.
+	ResponseCodeDetailsAccessLogFilter = "com.google.espv2.access_log_filters.response_code_details"
 
 	// The metadata server cluster name.
 	MetadataServerClusterName = "metadata-cluster"
@@ -65,8 +104,26 @@ const (
 	// The service control server cluster name.
 	ServiceControlClusterName = "service-control-cluster"
 
+	// The Envoy admin interface cluster name, used to serve the metrics.
+	AdminClusterName = "admin-cluster"
+
+	// The Zipkin collector cluster name.
+	ZipkinCollectorClusterName = "zipkin-collector-cluster"
+
+	// The gRPC Access Log Service cluster name.
+	AccessLogServiceClusterName = "access-log-service-cluster"
+
+	// The gRPC rate limit service cluster name.
+	RateLimitServiceClusterName = "rate-limit-service-cluster"
+
 	IngressListenerName  = "ingress_listener"
 	LoopbackListenerName = "loopback_listener"
+	MetricsListenerName  = "metrics_listener"
+	// The plain HTTP listener serving the ACME HTTP-01 challenges.
+	AcmeHttpListenerName = "acme_http_listener"
+
+	// The SDS secret of the server certificate issued by the ACME CA.
+	AcmeSecretName = "acme_server_cert"
 )
 
 // Jwt provider cluster's name will be in form of "jwt-provider-cluster-${JWT_PROVIDER_ADDRESS}".
@@ -118,7 +118,9 @@ func TestStatisticsServiceControlCallStatus(t *testing.T) {
 			checkRespCode: 200,
 			reqCnt:        5,
 			wantCounters: utils.StatCounters{
-				"http.ingress_http.service_control.check.OK": 1,
+				"http.ingress_http.service_control.check.OK":         1,
+				"http.ingress_http.service_control.check_cache_miss": 1,
+				"http.ingress_http.service_control.check_cache_hit":  4,
 				// The quota call for the first incoming request and the quota call by cache flush after 1s.
 				"http.ingress_http.service_control.allocate_quota.OK": 2,
 				"http.ingress_http.service_control.report.OK":         1,
@@ -34,6 +34,17 @@ class TestStartProxy(unittest.TestCase):
              ['bin/bootstrap', '--logtostderr', '--admin_port', '8001',
               '--http_request_timeout_s', '1',
               '/tmp/bootstrap.json']),
+            (["--statsd_address=127.0.0.1:8125", "--statsd_prefix=espv2",
+              "--statsd_tag_format=dogstatsd"],
+             ['bin/bootstrap', '--logtostderr', '--admin_port', '0',
+              '--statsd_address', '127.0.0.1:8125',
+              '--statsd_prefix', 'espv2',
+              '--statsd_tag_format', 'dogstatsd',
+              '/tmp/bootstrap.json']),
+            (["--enable_delta_xds"],
+             ['bin/bootstrap', '--logtostderr', '--admin_port', '0',
+              '--enable_delta_xds',
+              '/tmp/bootstrap.json']),
             ([], ['bin/bootstrap',
                   '--logtostderr', '--admin_port', '0',
                   '/tmp/bootstrap.json']),
@@ -48,9 +59,11 @@ class TestStartProxy(unittest.TestCase):
             # grpc backend with fixed version.
             (['--service=test_bookstore.gloud.run', '--version=2019-11-09r0',
               '--backend=grpc://127.0.0.1:8000', '--http_request_timeout_s=10',
-              '--log_jwt_payloads=aud,exp', '--disable_tracing', '--healthz=/'],
+              '--log_jwt_payloads=aud,exp', '--disable_tracing', '--healthz=/',
+              '--readiness_port=8090'],
              ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
               '--backend_address', 'grpc://127.0.0.1:8000','--healthz', '/',
+              '--config_manager_readiness_port', '8090',
               '--v', '0', '--log_jwt_payloads', 'aud,exp',
               '--service', 'test_bookstore.gloud.run',
               '--http_request_timeout_s', '10',
@@ -131,6 +144,14 @@ class TestStartProxy(unittest.TestCase):
               '--check_metadata', '--underscores_in_headers',
               '--disable_tracing'
               ]),
+            # backend_consumer_headers specified
+            (['-R=managed', '--disable_tracing',
+              '--backend_consumer_headers=project_number,api_key_hash'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'managed',
+              '--backend_address', 'http://127.0.0.1:8082', '--v', '0',
+              '--backend_consumer_headers', 'project_number,api_key_hash',
+              '--disable_tracing'
+              ]),
             # ssl_server_cert_path specified
             (['-R=managed','--listener_port=8080',  '--disable_tracing',
               '--ssl_server_cert_path=/etc/endpoint/ssl'],
@@ -278,6 +299,50 @@ class TestStartProxy(unittest.TestCase):
               '--cors_expose_headers', 'Content-Length,Content-Range',
               '--service_account_key', '/tmp/service_accout_key', '--non_gcp',
               ]),
+            # Impersonated service account
+            (['--service=test_bookstore.gloud.run',
+              '--backend=https://127.0.0.1',
+              '--service_account_key', '/tmp/service_accout_key',
+              '--impersonate_service_account', 'proxy@project.iam.gserviceaccount.com,delegate@project.iam.gserviceaccount.com'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'https://127.0.0.1', '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--service_account_key', '/tmp/service_accout_key',
+              '--impersonate_service_account', 'proxy@project.iam.gserviceaccount.com,delegate@project.iam.gserviceaccount.com',
+              ]),
+            # Cors with max age, private network access and reflected headers
+            (['--service=test_bookstore.gloud.run',
+              '--backend=https://127.0.0.1', '--cors_preset=basic',
+              '--cors_max_age=1h', '--cors_allow_private_network',
+              '--cors_reflect_request_headers', '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'https://127.0.0.1', '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              '--cors_preset', 'basic',
+              '--cors_allow_origin', '*', '--cors_allow_origin_regex', '',
+              '--cors_allow_methods', 'GET, POST, PUT, PATCH, DELETE, OPTIONS',
+              '--cors_allow_headers', '',
+              '--cors_expose_headers', 'Content-Length,Content-Range',
+              '--cors_max_age', '1h', '--cors_allow_private_network',
+              '--cors_reflect_request_headers',
+              ]),
+            # Cors answered without the local backend
+            (['--service=test_bookstore.gloud.run',
+              '--backend=https://127.0.0.1', '--cors_preset=basic',
+              '--cors_preflight_direct_response', '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'https://127.0.0.1', '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              '--cors_preset', 'basic',
+              '--cors_allow_origin', '*', '--cors_allow_origin_regex', '',
+              '--cors_allow_methods', 'GET, POST, PUT, PATCH, DELETE, OPTIONS',
+              '--cors_allow_headers',
+              'DNT,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type,Range,Authorization',
+              '--cors_expose_headers', 'Content-Length,Content-Range',
+              '--cors_preflight_direct_response',
+              ]),
             # backend routing (with deprecated flag)
             (['--backend=https://127.0.0.1:8000', '--enable_backend_routing',
               '--service_json_path=/tmp/service.json',
@@ -290,6 +355,70 @@ class TestStartProxy(unittest.TestCase):
               '--disable_tracing',
               '--compute_platform_override', 'Cloud Run(ESPv2)'
               ]),
+            (['--backend=127.0.0.1:8000',
+              '--service_json_path=/tmp/service.textproto',
+              '--service_json_watch_interval=5s',
+              '--disable_tracing'],
+             ['bin/configmanager',  '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000', '--v', '0',
+              '--service_json_path', '/tmp/service.textproto',
+              '--service_json_watch_interval', '5s',
+              '--disable_tracing',
+              ]),
+            (['--backend=127.0.0.1:8000',
+              '--service_config_url=gs://bucket/service.json',
+              '--service_config_url_poll_interval=60s',
+              '--config_file=/etc/espv2/config.json',
+              '--disable_tracing'],
+             ['bin/configmanager',  '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000', '--v', '0',
+              '--config_file', '/etc/espv2/config.json',
+              '--service_config_url', 'gs://bucket/service.json',
+              '--service_config_url_poll_interval', '60s',
+              '--disable_tracing',
+              ]),
+            (['--backend=grpc://127.0.0.1:8000',
+              '--healthz=healthz', '--healthz_mode=backend_aware',
+              '--disable_tracing'],
+             ['bin/configmanager',  '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'grpc://127.0.0.1:8000',
+              '--healthz', 'healthz', '--healthz_mode', 'backend_aware',
+              '--v', '0',
+              '--disable_tracing',
+              ]),
+            (['--backend=grpc://127.0.0.1:8000',
+              '--healthz=healthz', '--healthz_mode=backend_aware',
+              '--healthz_grpc_service=bookstore.Bookstore',
+              '--enable_grpc_health_passthrough',
+              '--disable_tracing'],
+             ['bin/configmanager',  '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'grpc://127.0.0.1:8000',
+              '--healthz', 'healthz', '--healthz_mode', 'backend_aware',
+              '--healthz_grpc_service', 'bookstore.Bookstore',
+              '--enable_grpc_health_passthrough',
+              '--v', '0',
+              '--disable_tracing',
+              ]),
+            (['--backend=grpc://127.0.0.1:8000',
+              '--grpc_reflection',
+              '--disable_tracing'],
+             ['bin/configmanager',  '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'grpc://127.0.0.1:8000', '--v', '0',
+              '--grpc_reflection',
+              '--disable_tracing',
+              ]),
+            (['--backend=127.0.0.1:8000',
+              '--service_json_path=/tmp/service.json',
+              '--additional_services=echo.endpoints.project123.cloud.goog:2020-01-01r0',
+              '--additional_service_json_paths=/tmp/a.json,/tmp/b.json',
+              '--disable_tracing'],
+             ['bin/configmanager',  '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000', '--v', '0',
+              '--service_json_path', '/tmp/service.json',
+              '--additional_services', 'echo.endpoints.project123.cloud.goog:2020-01-01r0',
+              '--additional_service_json_paths', '/tmp/a.json,/tmp/b.json',
+              '--disable_tracing',
+              ]),
             # grpc backend with fixed version and tracing
             (['--service=test_bookstore.gloud.run', '--version=2019-11-09r0',
               '--backend=grpc://127.0.0.1:8000', '--http_request_timeout_s=10',
@@ -302,6 +431,53 @@ class TestStartProxy(unittest.TestCase):
               '--service_config_id', '2019-11-09r0',
               '--disable_tracing',
               ]),
+            # callout policies
+            (['--service=test_bookstore.gloud.run',
+              '--backend=grpc://127.0.0.1:8000', '--http_request_timeout_s=10',
+              '--callout_policies=jwks=timeout:5s;openid_discovery=retries:3',
+              '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'grpc://127.0.0.1:8000', '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--http_request_timeout_s', '10',
+              '--callout_policies', 'jwks=timeout:5s;openid_discovery=retries:3',
+              '--disable_tracing',
+              ]),
+            # jwks cache
+            (['--service=test_bookstore.gloud.run',
+              '--backend=grpc://127.0.0.1:8000',
+              '--jwks_cache_dir=/var/cache/espv2', '--jwks_cache_ttl=12h',
+              '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'grpc://127.0.0.1:8000', '--v', '0',
+              '--jwks_cache_dir', '/var/cache/espv2',
+              '--jwks_cache_ttl', '12h',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              ]),
+            # deferred openid discovery
+            (['--service=test_bookstore.gloud.run',
+              '--backend=grpc://127.0.0.1:8000',
+              '--openid_discovery_budget=30s', '--defer_openid_discovery',
+              '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'grpc://127.0.0.1:8000', '--v', '0',
+              '--openid_discovery_budget', '30s',
+              '--defer_openid_discovery',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              ]),
+            # audit mode
+            (['--service=test_bookstore.gloud.run',
+              '--backend=grpc://127.0.0.1:8000',
+              '--audit_mode_selectors=test.Echo,test.EchoAuth',
+              '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'grpc://127.0.0.1:8000', '--v', '0',
+              '--audit_mode_selectors', 'test.Echo,test.EchoAuth',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              ]),
             # json-grpc transcoder json print options
             (['--service=test_bookstore.gloud.run',
               '--backend=grpc://127.0.0.1:8000',
@@ -341,6 +517,17 @@ class TestStartProxy(unittest.TestCase):
               '--disable_tracing',
               '--transcoding_ignore_unknown_query_parameters'
               ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=grpc://127.0.0.1:8000',
+              '--transcoding_query_array_style=brackets',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'grpc://127.0.0.1:8000', '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              '--transcoding_query_array_style', 'brackets'
+              ]),
             # Connection buffer limit bytes
             (['--service=test_bookstore.gloud.run',
               '--backend=grpc://127.0.0.1:8000',
@@ -381,6 +568,270 @@ class TestStartProxy(unittest.TestCase):
               '--access_log_format', '%START_TIME%',
               '--disable_tracing',
               ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--access_log=/dev/stdout',
+              '--access_log_json_format={"status":"%RESPONSE_CODE%"}',
+              '--access_log_min_status_code=400',
+              '--audit_log=/var/log/audit.log',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--access_log', '/dev/stdout',
+              '--access_log_json_format', '{"status":"%RESPONSE_CODE%"}',
+              '--access_log_min_status_code', '400',
+              '--audit_log', '/var/log/audit.log',
+              '--disable_tracing',
+              ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--status_port=8001',
+              '--prometheus_metrics_port=9090',
+              '--prometheus_metrics_address=0.0.0.0',
+              '--prometheus_stats_filter=^server\\.',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--prometheus_metrics_port', '9090',
+              '--admin_port', '8001',
+              '--prometheus_metrics_address', '0.0.0.0',
+              '--prometheus_stats_filter', '^server\\.',
+              '--disable_tracing',
+              ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--status_port=8001',
+              '--drain_timeout=30',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--drain_timeout', '30s',
+              '--admin_port', '8001',
+              '--disable_tracing',
+              ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--enable_rds',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--enable_rds',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--maintenance_selectors=bookstore.Bookstore.DeleteShelf',
+              '--maintenance_status_code=423',
+              '--maintenance_retry_after=5m',
+              '--api_version_header=Accept-Version',
+              '--api_base_path=/gateway/v1',
+              '--response_cache_selectors=bookstore.Bookstore.GetShelf=5m',
+              '--response_cache_ttl=30s',
+              '--response_cache_key_query_params=page',
+              '--response_cache_key_headers=Accept-Language',
+              '--etag_selectors=bookstore.Bookstore.GetShelf',
+              '--etag_max_body_bytes=65536',
+              '--idempotency_selectors=bookstore.Bookstore.CreateShelf',
+              '--idempotency_key_header=X-Request-Key',
+              '--idempotency_ttl=30m',
+              '--rate_limit_tiers=free=10/1m,gold=1000/1m',
+              '--rate_limit_consumer_tiers=123456=gold',
+              '--rate_limit_default_tier=free',
+              '--rate_limit_service_address=grpc://127.0.0.1:8081',
+              '--concurrency_limits=bookstore.Bookstore.ListShelves=100',
+              '--spike_arrest_rps=100',
+              '--spike_arrest_burst=20',
+              '--deny_user_agents=sqlmap,nikto',
+              '--deny_paths=/wp-admin,.php',
+              '--upload_backend_address=http://127.0.0.1:8090',
+              '--upload_size_thresholds=bookstore.Bookstore.CreateBook=1048576',
+              '--query_param_matchers=bookstore.Bookstore.GetShelfContent=alt:media',
+              '--enable_operation_virtual_clusters',
+              '--gcp_project_id_override=onprem-project',
+              '--gcp_zone_override=onprem-dc1',
+              '--gcp_attributes_file=/etc/espv2/gcp_attributes.json',
+              '--honor_grpc_timeout_header',
+              '--transcoding_grpc_status_http_codes=NOT_FOUND:410',
+              '--transcoding_operation_grpc_status_http_codes=bookstore.Bookstore.GetShelf=NOT_FOUND:404',
+              '--transcoding_validate_request_body',
+              '--transcoding_reject_unknown_body_fields',
+              '--transcoding_body_validation_opt_out_selectors=bookstore.Bookstore.CreateShelf',
+              '--transcoding_stream_formats=bookstore.Bookstore.ListShelves=sse',
+              '--transcoding_operation_print_options=bookstore.Bookstore.GetShelf=always_print_primitive_fields:true',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--api_version_header', 'Accept-Version',
+              '--api_base_path', '/gateway/v1',
+              '--response_cache_selectors', 'bookstore.Bookstore.GetShelf=5m',
+              '--response_cache_ttl', '30s',
+              '--response_cache_key_query_params', 'page',
+              '--response_cache_key_headers', 'Accept-Language',
+              '--etag_selectors', 'bookstore.Bookstore.GetShelf',
+              '--etag_max_body_bytes', '65536',
+              '--idempotency_selectors', 'bookstore.Bookstore.CreateShelf',
+              '--idempotency_key_header', 'X-Request-Key',
+              '--idempotency_ttl', '30m',
+              '--rate_limit_tiers', 'free=10/1m,gold=1000/1m',
+              '--rate_limit_consumer_tiers', '123456=gold',
+              '--rate_limit_default_tier', 'free',
+              '--rate_limit_service_address', 'grpc://127.0.0.1:8081',
+              '--concurrency_limits', 'bookstore.Bookstore.ListShelves=100',
+              '--spike_arrest_rps', '100',
+              '--spike_arrest_burst', '20',
+              '--deny_user_agents', 'sqlmap,nikto',
+              '--deny_paths', '/wp-admin,.php',
+              '--upload_backend_address', 'http://127.0.0.1:8090',
+              '--upload_size_thresholds', 'bookstore.Bookstore.CreateBook=1048576',
+              '--query_param_matchers', 'bookstore.Bookstore.GetShelfContent=alt:media',
+              '--enable_operation_virtual_clusters',
+              '--honor_grpc_timeout_header',
+              '--transcoding_grpc_status_http_codes', 'NOT_FOUND:410',
+              '--transcoding_operation_grpc_status_http_codes', 'bookstore.Bookstore.GetShelf=NOT_FOUND:404',
+              '--transcoding_validate_request_body',
+              '--transcoding_reject_unknown_body_fields',
+              '--transcoding_body_validation_opt_out_selectors', 'bookstore.Bookstore.CreateShelf',
+              '--transcoding_stream_formats', 'bookstore.Bookstore.ListShelves=sse',
+              '--transcoding_operation_print_options', 'bookstore.Bookstore.GetShelf=always_print_primitive_fields:true',
+              '--maintenance_selectors', 'bookstore.Bookstore.DeleteShelf',
+              '--maintenance_status_code', '423',
+              '--maintenance_retry_after', '5m',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              '--gcp_project_id_override', 'onprem-project',
+              '--gcp_zone_override', 'onprem-dc1',
+              '--gcp_attributes_file', '/etc/espv2/gcp_attributes.json',
+              ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--version=2019-11-09r0',
+              '--fallback_to_managed_rollout',
+              '--halt_rollout_on_nack',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--service_config_id', '2019-11-09r0',
+              '--fallback_to_managed_rollout',
+              '--halt_rollout_on_nack',
+              '--disable_tracing',
+              ]),
+            # certificate issued through ACME
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--acme_domains=api.example.com,www.example.com',
+              '--acme_accept_tos',
+              '--acme_email=admin@example.com',
+              '--acme_http_port=8080',
+              '--acme_cache_dir=/var/lib/espv2/acme',
+              '--acme_renew_before_days=20',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--acme_domains', 'api.example.com,www.example.com',
+              '--acme_accept_tos',
+              '--acme_email', 'admin@example.com',
+              '--acme_http_port', '8080',
+              '--acme_cache_dir', '/var/lib/espv2/acme',
+              '--acme_renew_before', '480h',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--acme_domains=*.example.com',
+              '--acme_accept_tos',
+              '--acme_challenge=dns-01',
+              '--acme_dns_project=dns-project',
+              '--acme_dns_managed_zone=example-zone',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'fixed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--acme_domains', '*.example.com',
+              '--acme_accept_tos',
+              '--acme_challenge', 'dns-01',
+              '--acme_dns_project', 'dns-project',
+              '--acme_dns_managed_zone', 'example-zone',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--rollout_strategy=managed',
+              '--status_port=8090',
+              '--canary_bake_period=600',
+              '--canary_max_error_rate=0.01',
+              '--canary_min_requests=500',
+              '--canary_max_latency_ms=250',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'managed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--canary_bake_period', '600s',
+              '--canary_max_error_rate', '0.01',
+              '--canary_min_requests', '500',
+              '--canary_max_latency', '250ms',
+              '--disable_tracing',
+              ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--rollout_strategy=managed',
+              '--rollout_traffic_split',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'managed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--rollout_traffic_split',
+              '--disable_tracing',
+              ]),
+            (['--service=test_bookstore.gloud.run',
+              '--backend=127.0.0.1:8000',
+              '--rollout_strategy=managed',
+              '--rollout_dual_serving',
+              '--disable_tracing',
+              ],
+             ['bin/configmanager', '--logtostderr',
+              '--rollout_strategy', 'managed',
+              '--backend_address', 'http://127.0.0.1:8000',
+              '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--rollout_dual_serving',
+              '--disable_tracing',
+              ]),
             # Tracing disabled on non-gcp
             (['--service=test_bookstore.gloud.run',
               '--backend=http://127.0.0.1',
@@ -465,6 +916,52 @@ class TestStartProxy(unittest.TestCase):
               '--backend_retry_num', '10',
               '--disable_tracing'
               ]),
+            # path rewrite setting
+            (['-R=managed',
+              '--http2_port=8079', '--path_rewrite_query_params=merge',
+              '--path_rewrite_original_path_header=x-original-path',
+              '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'managed',
+              '--backend_address', 'http://127.0.0.1:8082', '--v', '0',
+              '--listener_port', '8079',
+              '--path_rewrite_query_params', 'merge',
+              '--path_rewrite_original_path_header', 'x-original-path',
+              '--disable_tracing'
+              ]),
+            # local backend host rewrite
+            (['-R=managed',
+              '--http2_port=8079', '--backend_host_rewrite=literal',
+              '--backend_host_rewrite_literal=api.example.com',
+              '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'managed',
+              '--backend_address', 'http://127.0.0.1:8082', '--v', '0',
+              '--listener_port', '8079',
+              '--backend_host_rewrite', 'literal',
+              '--backend_host_rewrite_literal', 'api.example.com',
+              '--disable_tracing'
+              ]),
+            # original request headers
+            (['-R=managed',
+              '--http2_port=8079', '--forward_original_path',
+              '--forward_original_host', '--forward_original_method',
+              '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'managed',
+              '--backend_address', 'http://127.0.0.1:8082', '--v', '0',
+              '--listener_port', '8079',
+              '--forward_original_path', '--forward_original_host',
+              '--forward_original_method',
+              '--disable_tracing'
+              ]),
+            # strict selector validation
+            (['-R=managed',
+              '--http2_port=8079', '--strict_selector_validation',
+              '--disable_tracing'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'managed',
+              '--backend_address', 'http://127.0.0.1:8082', '--v', '0',
+              '--listener_port', '8079',
+              '--strict_selector_validation',
+              '--disable_tracing'
+              ]),
             # Service account key does not assume non-gcp
             # and does not disable tracing.
             (['--service=test_bookstore.gloud.run',
@@ -554,6 +1051,38 @@ class TestStartProxy(unittest.TestCase):
             ['--transcoding_ignore_query_parameters=foo,bar',
              '--transcoding_ignore_unknown_query_parameters'],
             ['--access_log_format'],
+            ['--access_log=/foo', '--access_log_format=%START_TIME%',
+             '--access_log_json_format={"status":"%RESPONSE_CODE%"}'],
+            ['--prometheus_metrics_port=9090'],
+            ['--drain_timeout=30'],
+            ['--acme_domains=api.example.com', '--acme_http_port=8080'],
+            ['--acme_domains=api.example.com', '--acme_accept_tos'],
+            ['--acme_domains=api.example.com', '--acme_accept_tos',
+             '--acme_http_port=80'],
+            ['--acme_domains=api.example.com', '--acme_accept_tos',
+             '--acme_challenge=dns-01', '--acme_dns_project=dns-project'],
+            ['--acme_domains=api.example.com', '--acme_accept_tos',
+             '--acme_http_port=8080', '--ssl_server_cert_path=/etc/ssl'],
+            ['--acme_http_port=8080'],
+            ['--backend_host_rewrite=literal'],
+            ['--backend_host_rewrite_literal=api.example.com'],
+            ['--backend_host_rewrite=backend_address',
+             '--backend_host_rewrite_literal=api.example.com'],
+            ['--rollout_traffic_split'],
+            ['--rollout_dual_serving'],
+            ['--rollout_strategy=managed', '--rollout_dual_serving',
+             '--rollout_traffic_split'],
+            ['--service_json_watch_interval=5s'],
+            ['--service_config_url_poll_interval=60s'],
+            ['--service_config_url=gs://bucket/service.json',
+             '--service_json_path=/tmp/service.json'],
+            ['--service_config_url=gs://bucket/service.json',
+             '--version=2019-11-09r0'],
+            ['--grpc_reflection', '--service_json_path=/tmp/service.json'],
+            ['--healthz_mode=backend_aware'],
+            ['--healthz=healthz', '--healthz_mode=backend'],
+            ['--grpc_reflection', '--service_config_url=gs://bucket/service.json'],
+            ['--fallback_to_managed_rollout'],
             ['--dns=127.0.0.1', '--dns_resolver_address=127.0.0.1'],
             ['--ssl_client_cert_path=/tmp', '--ssl_backend_client_cert_path=/tmp'],
             ['--ssl_client_root_certs_file=/tmp/server.crt', '--ssl_backend_client_root_certs_file=/tmp/server.crt']